@@ -0,0 +1,293 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/exec"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// hookTimeout bounds an action hook command
+const hookTimeout = 30 * time.Second
+
+// Action is a response a decision runs. Run is called on the loop every
+// cycle the decision holds, so it must return quickly.
+type Action interface {
+	Name() string
+	Run(ctx context.Context, ev ActionEvent) error
+}
+
+// Releaser is an Action holding enforcement state, such as a lock or a
+// quarantine, that must be let go of at shutdown
+type Releaser interface {
+	Release(ctx context.Context) error
+}
+
+// ActionEvent is the cycle an action responds to
+type ActionEvent struct {
+	Context  string // the named context deciding; empty without contexts
+	Decision string
+	Previous string // the decision of the cycle before
+	Mu       float64
+	CH       bool
+	Cycle    uint64
+
+	cfg *HarmonyConfig // the config the cycle decided under
+}
+
+// entered reports whether this cycle changed the decision
+func (ev *ActionEvent) entered() bool {
+	return ev.Decision != ev.Previous
+}
+
+// config returns the config ev's cycle decided under, so an action sees
+// the same config as the decision even across a reload
+func (ev *ActionEvent) config() *HarmonyConfig {
+	if ev.cfg != nil {
+		return ev.cfg
+	}
+	return activeConfig()
+}
+
+// ActionFunc adapts a plain function to Action
+type ActionFunc struct {
+	name string
+	run  func(ctx context.Context, ev ActionEvent) error
+}
+
+func NewActionFunc(name string, run func(ctx context.Context, ev ActionEvent) error) *ActionFunc {
+	return &ActionFunc{name: name, run: run}
+}
+
+func (f *ActionFunc) Name() string                                  { return f.name }
+func (f *ActionFunc) Run(ctx context.Context, ev ActionEvent) error { return f.run(ctx, ev) }
+
+// ActionRegistry holds the actions a config may name
+type ActionRegistry struct {
+	mu      sync.RWMutex
+	actions map[string]Action
+}
+
+var harmonyActions = newDefaultActions()
+
+func newDefaultActions() *ActionRegistry {
+	r := &ActionRegistry{actions: make(map[string]Action)}
+	r.Register(NewActionFunc("alert", func(ctx context.Context, ev ActionEvent) error {
+		harmonyMetrics.observeAlert(ev.Decision)
+		slog.WarnContext(ctx, "harmony alert", "context", ev.Context, "decision", ev.Decision, "mu", ev.Mu, "ch", ev.CH)
+		return nil
+	}))
+	r.Register(newAutohealer(triggerAutoheal))
+	r.Register(NewActionFunc("log_fault", logHarmonyFault))
+	r.Register(enforcingFunc{NewActionFunc("hold_privileged_access", holdPrivilegedAccess)})
+	r.Register(NewActionFunc("notify", notifyAction))
+	r.Register(hookAction("quarantine"))
+	r.Register(hookAction("revoke-tokens"))
+	return r
+}
+
+// optionalHooks are the built-in actions that also run a hook, if one is
+// configured under their name
+var optionalHooks = map[string]bool{"autoheal": true, "hold_privileged_access": true}
+
+// actionAliases are older names of built-in actions, still accepted in
+// actions and hooks
+var actionAliases = map[string]string{"revoke_tokens": "revoke-tokens"}
+
+// canonicalAction returns the current name of action name
+func canonicalAction(name string) string {
+	if canonical, ok := actionAliases[name]; ok {
+		return canonical
+	}
+	return name
+}
+
+// Register adds a, replacing any action with the same name
+func (r *ActionRegistry) Register(a Action) error {
+	if a.Name() == "" {
+		return fmt.Errorf("action needs a name")
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.actions[a.Name()] = a
+	return nil
+}
+
+// Lookup returns the named action, by its current name or an alias
+func (r *ActionRegistry) Lookup(name string) (Action, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	a, ok := r.actions[canonicalAction(name)]
+	return a, ok
+}
+
+// Release releases the registered actions that hold state, then waits for
+// running hooks to finish. Privileged access held by hold_privileged_access
+// stays held: a monitor that has stopped can't vouch for reopening it.
+func (r *ActionRegistry) Release(ctx context.Context) error {
+	r.mu.RLock()
+	var errs []error
+	for name, a := range r.actions {
+		if rel, ok := a.(Releaser); ok {
+			if err := rel.Release(ctx); err != nil {
+				errs = append(errs, fmt.Errorf("release %s: %w", name, err))
+			}
+		}
+	}
+	r.mu.RUnlock()
+
+	done := make(chan struct{})
+	go func() {
+		hooksWG.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		errs = append(errs, fmt.Errorf("wait for action hooks: %w", ctx.Err()))
+	}
+	return errors.Join(errs...)
+}
+
+// action resolves name to a registered action, or to a hook of that name
+func (c *HarmonyConfig) action(name string) (Action, bool) {
+	if a, ok := harmonyActions.Lookup(name); ok {
+		return a, true
+	}
+	if _, ok := c.Hooks[name]; ok {
+		return hookAction(name), true
+	}
+	return nil, false
+}
+
+// hook returns the command of hook action name, configured under its
+// current name or an alias
+func (c *HarmonyConfig) hook(name string) []string {
+	if argv, ok := c.Hooks[name]; ok {
+		return argv
+	}
+	for alias, canonical := range actionAliases {
+		if canonical == name {
+			if argv, ok := c.Hooks[alias]; ok {
+				return argv
+			}
+		}
+	}
+	return nil
+}
+
+// notifyAction sends the decision to the notifiers routed for kind action
+func notifyAction(ctx context.Context, ev ActionEvent) error {
+	summary := fmt.Sprintf("%s, mu %.6f, ch %t", ev.Decision, ev.Mu, ev.CH)
+	if ev.Context != "" {
+		summary = "context " + ev.Context + ": " + summary
+	}
+	harmonyAlerts.raise(ctx, Alert{
+		Kind:     AlertAction,
+		Context:  ev.Context,
+		Subject:  ev.Decision,
+		Previous: ev.Previous,
+		Severity: decisionSeverity(ev.Decision),
+		Summary:  summary,
+		Cycle:    ev.Cycle,
+		Time:     harmonyClock.Now(),
+	})
+	return nil
+}
+
+// hookAction runs the command configured under hooks for its name. It
+// runs once as a decision is entered, in the background, and not again
+// while a previous run is still going.
+type hookAction string
+
+// hooksRunning holds the hooks running now, by name and context, and hooksWG
+// counts them
+var (
+	hooksRunning sync.Map
+	hooksWG      sync.WaitGroup
+)
+
+func (h hookAction) Name() string   { return string(h) }
+func (h hookAction) enforces() bool { return true }
+
+func (h hookAction) Run(ctx context.Context, ev ActionEvent) error {
+	argv := ev.config().hook(string(h))
+	if len(argv) == 0 {
+		return fmt.Errorf("no hook configured for %s", h)
+	}
+	if !ev.entered() {
+		return nil
+	}
+	return runHook(ctx, string(h), argv, ev)
+}
+
+// runHook runs argv, the hook of action name, in the background with ev
+// and env in its environment, unless it is still running for ev's context
+func runHook(ctx context.Context, name string, argv []string, ev ActionEvent, env ...string) error {
+	key := name + "/" + ev.Context
+	if _, busy := hooksRunning.LoadOrStore(key, struct{}{}); busy {
+		return fmt.Errorf("hook %s is still running", name)
+	}
+	hooksWG.Add(1)
+	go func() {
+		defer hooksWG.Done()
+		defer hooksRunning.Delete(key)
+		hctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), hookTimeout)
+		defer cancel()
+		cmd := exec.CommandContext(hctx, argv[0], argv[1:]...)
+		cmd.Env = append(os.Environ(),
+			"HARMONY_ACTION="+name,
+			"HARMONY_CONTEXT="+ev.Context,
+			"HARMONY_DECISION="+ev.Decision,
+			"HARMONY_PREVIOUS="+ev.Previous,
+			"HARMONY_MU="+strconv.FormatFloat(ev.Mu, 'g', -1, 64),
+			"HARMONY_CH="+strconv.FormatBool(ev.CH),
+			"HARMONY_CYCLE="+strconv.FormatUint(ev.Cycle, 10),
+		)
+		cmd.Env = append(cmd.Env, env...)
+		out, err := cmd.CombinedOutput()
+		if err != nil {
+			harmonyMetrics.observeActionError(name)
+			slog.ErrorContext(hctx, "action hook failed", "action", name, "context", ev.Context, "err", err, "output", string(out))
+			return
+		}
+		slog.InfoContext(hctx, "action hook ran", "action", name, "context", ev.Context, "decision", ev.Decision)
+	}()
+	return nil
+}
+
+// holdPrivilegedAccess is the hold_privileged_access action. Holding is
+// up to its hook, which runs as the decision is entered; without one the
+// action does nothing.
+func holdPrivilegedAccess(ctx context.Context, ev ActionEvent) error {
+	if len(ev.config().hook("hold_privileged_access")) == 0 {
+		return nil
+	}
+	return hookAction("hold_privileged_access").Run(ctx, ev)
+}
+
+// validateHooks checks each hook names a command, once, and doesn't shadow
+// a built-in action
+func (c *HarmonyConfig) validateHooks() error {
+	for name, argv := range c.Hooks {
+		if len(argv) == 0 || argv[0] == "" {
+			return fmt.Errorf("hook %s names no command", name)
+		}
+		if canonical := canonicalAction(name); canonical != name {
+			if _, ok := c.Hooks[canonical]; ok {
+				return fmt.Errorf("hooks %s and %s name the same action", name, canonical)
+			}
+		}
+		if a, ok := harmonyActions.Lookup(name); ok && !optionalHooks[name] {
+			if _, ok := a.(hookAction); !ok {
+				return fmt.Errorf("hook %s shadows the built-in action", name)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"testing"
+)
+
+func TestDefaultActions(t *testing.T) {
+	r := newDefaultActions()
+	for _, name := range []string{"alert", "autoheal", "log_fault", "hold_privileged_access", "notify", "quarantine", "revoke-tokens"} {
+		if _, ok := r.Lookup(name); !ok {
+			t.Errorf("built-in action %s isn't registered", name)
+		}
+	}
+	a, ok := r.Lookup("revoke_tokens")
+	if !ok || a.Name() != "revoke-tokens" {
+		t.Errorf("revoke_tokens resolves to %v, want revoke-tokens", a)
+	}
+	for _, name := range []string{"quarantine", "revoke-tokens"} {
+		a, _ := r.Lookup(name)
+		if !enforces(a) {
+			t.Errorf("%s doesn't enforce, so followers would run it", name)
+		}
+	}
+	if _, ok := r.Lookup("nope"); ok {
+		t.Error("unknown action resolved")
+	}
+}
+
+func TestActionsNeedTheirHooks(t *testing.T) {
+	tests := []struct {
+		name    string
+		actions []string
+		hooks   map[string][]string
+		ok      bool
+	}{
+		{"quarantine without a hook", []string{"quarantine"}, nil, false},
+		{"revoke-tokens without a hook", []string{"revoke-tokens"}, nil, false},
+		{"quarantine", []string{"quarantine"}, map[string][]string{"quarantine": {"/bin/true"}}, true},
+		{"revoke-tokens", []string{"revoke-tokens"}, map[string][]string{"revoke-tokens": {"/bin/true"}}, true},
+		{"old name, old hook", []string{"revoke_tokens"}, map[string][]string{"revoke_tokens": {"/bin/true"}}, true},
+		{"new name, old hook", []string{"revoke-tokens"}, map[string][]string{"revoke_tokens": {"/bin/true"}}, true},
+		{"both hook names", []string{"revoke-tokens"}, map[string][]string{"revoke_tokens": {"/bin/true"}, "revoke-tokens": {"/bin/true"}}, false},
+		{"custom hook", []string{"page-oncall"}, map[string][]string{"page-oncall": {"/bin/true"}}, true},
+		{"unknown action", []string{"page-oncall"}, nil, false},
+		{"hook shadowing a built-in", []string{"alert"}, map[string][]string{"notify": {"/bin/true"}}, false},
+		{"autoheal without a hook", []string{"autoheal"}, nil, true},
+		{"autoheal's own hook", []string{"autoheal"}, map[string][]string{"autoheal": {"/bin/true"}}, true},
+		{"hold_privileged_access's own hook", []string{"hold_privileged_access"}, map[string][]string{"hold_privileged_access": {"/bin/true"}}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := DefaultHarmonyConfig()
+			cfg.Actions = map[string][]string{DecisionHalt: tt.actions}
+			cfg.Hooks = tt.hooks
+			err := cfg.validateHooks()
+			if err == nil {
+				err = cfg.validateStates()
+			}
+			if (err == nil) != tt.ok {
+				t.Errorf("got %v, want ok %t", err, tt.ok)
+			}
+		})
+	}
+}
+
+func TestRunActionsInOrder(t *testing.T) {
+	var ran []string
+	r := &ActionRegistry{actions: make(map[string]Action)}
+	for _, name := range []string{"first", "second", "third"} {
+		r.Register(NewActionFunc(name, func(context.Context, ActionEvent) error {
+			ran = append(ran, name)
+			return nil
+		}))
+	}
+	r.Register(NewActionFunc("broken", func(context.Context, ActionEvent) error {
+		ran = append(ran, "broken")
+		return errors.New("broken")
+	}))
+	old := harmonyActions
+	harmonyActions = r
+	t.Cleanup(func() { harmonyActions = old })
+
+	cfg := DefaultHarmonyConfig()
+	cfg.Actions = map[string][]string{
+		DecisionHalt:    {"third", "broken", "first", "second"},
+		DecisionCaution: {"second"},
+	}
+	cfg.runActions(context.Background(), ActionEvent{Decision: DecisionHalt, Previous: DecisionGo})
+	if want := []string{"third", "broken", "first", "second"}; !slices.Equal(ran, want) {
+		t.Errorf("ran %v, want %v: in order, past the failure", ran, want)
+	}
+
+	ran = nil
+	cfg.runActions(context.Background(), ActionEvent{Decision: DecisionCaution})
+	if want := []string{"second"}; !slices.Equal(ran, want) {
+		t.Errorf("caution ran %v, want %v", ran, want)
+	}
+	ran = nil
+	cfg.runActions(context.Background(), ActionEvent{Decision: DecisionGo})
+	if len(ran) != 0 {
+		t.Errorf("CHANGE_GO ran %v, want its default of nothing", ran)
+	}
+}
+
+func TestActionsSeeTheCycleConfig(t *testing.T) {
+	var seen *HarmonyConfig
+	r := &ActionRegistry{actions: make(map[string]Action)}
+	r.Register(NewActionFunc("capture", func(_ context.Context, ev ActionEvent) error {
+		seen = ev.config()
+		return nil
+	}))
+	old := harmonyActions
+	harmonyActions = r
+	t.Cleanup(func() { harmonyActions = old })
+
+	cfg := DefaultHarmonyConfig()
+	cfg.Actions = map[string][]string{DecisionHalt: {"capture"}}
+	cfg.runActions(context.Background(), ActionEvent{Decision: DecisionHalt})
+	if seen != cfg {
+		t.Error("action saw the active config, not the cycle's")
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"fmt"
+	"math"
+)
+
+// Aggregator combines scores, already clamped to [min_score, 1], into mu.
+// Weights are non-negative and sum to more than 0.
+//
+// With one score at s and the rest at 1, mu falls from 1 roughly as: min
+// to s whatever its weight; harmonic to 1/(1 + w(1/s - 1)), so a zero all
+// but vetoes; geometric to s^w; arithmetic only to 1 - w(1 - s). P-norms
+// run from min (p → -∞) through harmonic (-1) and geometric (→ 0) to
+// arithmetic (1).
+type Aggregator func(scores, weights []float64) float64
+
+// GeometricMean is the default: any score near zero drags mu toward zero
+func GeometricMean(scores, weights []float64) float64 {
+	logSum := 0.0
+	for i, w := range weights {
+		logSum += w * math.Log(scores[i])
+	}
+	return math.Exp(logSum / weightTotal(weights))
+}
+
+// ArithmeticMean lets good scores compensate for a bad one
+func ArithmeticMean(scores, weights []float64) float64 {
+	sum := 0.0
+	for i, w := range weights {
+		sum += w * scores[i]
+	}
+	return sum / weightTotal(weights)
+}
+
+// HarmonicMean is dominated by the lowest scores
+func HarmonicMean(scores, weights []float64) float64 {
+	sum := 0.0
+	for i, w := range weights {
+		sum += w / scores[i]
+	}
+	return weightTotal(weights) / sum
+}
+
+// Minimum is the lowest score with a non-zero weight
+func Minimum(scores, weights []float64) float64 {
+	m := 1.0
+	for i, w := range weights {
+		if w > 0 && scores[i] < m {
+			m = scores[i]
+		}
+	}
+	return m
+}
+
+// PNorm returns the weighted power mean of order p, which must not be 0
+func PNorm(p float64) Aggregator {
+	return func(scores, weights []float64) float64 {
+		sum := 0.0
+		for i, w := range weights {
+			sum += w * math.Pow(scores[i], p)
+		}
+		return math.Pow(sum/weightTotal(weights), 1/p)
+	}
+}
+
+func weightTotal(weights []float64) float64 {
+	total := 0.0
+	for _, w := range weights {
+		total += w
+	}
+	return total
+}
+
+// aggregator returns the configured Aggregator
+func (c *HarmonyConfig) aggregator() (Aggregator, error) {
+	switch c.Aggregator {
+	case "", "geometric":
+		return GeometricMean, nil
+	case "arithmetic":
+		return ArithmeticMean, nil
+	case "harmonic":
+		return HarmonicMean, nil
+	case "min":
+		return Minimum, nil
+	case "pnorm":
+		if c.P == 0 || math.IsNaN(c.P) || math.IsInf(c.P, 0) {
+			return nil, fmt.Errorf("pnorm needs a finite, non-zero p, not %v", c.P)
+		}
+		return PNorm(c.P), nil
+	}
+	return nil, fmt.Errorf("unknown aggregator %q: want geometric, arithmetic, harmonic, min or pnorm", c.Aggregator)
+}
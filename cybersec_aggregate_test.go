@@ -0,0 +1,149 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+const aggregateTolerance = 1e-9
+
+func TestAggregators(t *testing.T) {
+	tests := []struct {
+		name    string
+		scores  []float64
+		weights []float64
+		want    map[string]float64 // by aggregator
+	}{
+		{
+			name:    "all healthy",
+			scores:  []float64{1, 1, 1},
+			weights: []float64{0.5, 0.3, 0.2},
+			want:    map[string]float64{"geometric": 1, "arithmetic": 1, "harmonic": 1, "min": 1},
+		},
+		{
+			name:    "weighted mix",
+			scores:  []float64{0.9, 0.5, 1},
+			weights: []float64{0.5, 0.3, 0.2},
+			want: map[string]float64{
+				"geometric":  0.7705702822246666, // 0.9^0.5 × 0.5^0.3
+				"arithmetic": 0.8,                // 0.45 + 0.15 + 0.2
+				"harmonic":   0.7377049180327869, // 1 / (0.5/0.9 + 0.3/0.5 + 0.2)
+				"min":        0.5,
+			},
+		},
+		{
+			name:    "one bad of four, equal weights",
+			scores:  []float64{0.2, 1, 1, 1},
+			weights: []float64{1, 1, 1, 1},
+			want: map[string]float64{
+				"geometric":  0.668740304976422, // 0.2^(1/4)
+				"arithmetic": 0.8,
+				"harmonic":   0.5, // 4 / (5 + 3)
+				"min":        0.2,
+			},
+		},
+		{
+			name:    "unnormalized weights",
+			scores:  []float64{0.9, 0.5, 1},
+			weights: []float64{5, 3, 2},
+			want: map[string]float64{
+				"geometric":  0.7705702822246666,
+				"arithmetic": 0.8,
+				"harmonic":   0.7377049180327869,
+				"min":        0.5,
+			},
+		},
+		{
+			name:    "a zero weight is ignored",
+			scores:  []float64{0.9, 0.01},
+			weights: []float64{1, 0},
+			want:    map[string]float64{"geometric": 0.9, "arithmetic": 0.9, "harmonic": 0.9, "min": 0.9},
+		},
+	}
+	for _, tt := range tests {
+		for name, want := range tt.want {
+			t.Run(tt.name+"/"+name, func(t *testing.T) {
+				agg, err := (&HarmonyConfig{Aggregator: name}).aggregator()
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got := agg(tt.scores, tt.weights); math.Abs(got-want) > aggregateTolerance {
+					t.Errorf("mu = %.12f, want %.12f", got, want)
+				}
+			})
+		}
+	}
+}
+
+// TestAggregatorSensitivity checks the single-provider sensitivities the
+// Aggregator comment claims: one score at s with weight w, the rest at 1
+func TestAggregatorSensitivity(t *testing.T) {
+	sensitivity := map[string]func(s, w float64) float64{
+		"min":        func(s, w float64) float64 { return s },
+		"harmonic":   func(s, w float64) float64 { return 1 / (1 + w*(1/s-1)) },
+		"geometric":  func(s, w float64) float64 { return math.Pow(s, w) },
+		"arithmetic": func(s, w float64) float64 { return 1 - w*(1-s) },
+	}
+	order := []string{"min", "harmonic", "geometric", "arithmetic"}
+	for _, s := range []float64{0.001, 0.1, 0.5, 0.9, 0.999} {
+		for _, w := range []float64{0.05, 0.25, 0.5, 1} {
+			scores := []float64{s, 1}
+			weights := []float64{w, 1 - w}
+			prev := 0.0
+			for _, name := range order {
+				agg, err := (&HarmonyConfig{Aggregator: name}).aggregator()
+				if err != nil {
+					t.Fatal(err)
+				}
+				got := agg(scores, weights)
+				if want := sensitivity[name](s, w); math.Abs(got-want) > aggregateTolerance {
+					t.Errorf("%s(s=%v, w=%v) = %.12f, want %.12f", name, s, w, got, want)
+				}
+				// Each aggregator is at least as lenient as the one before
+				if got < prev-aggregateTolerance {
+					t.Errorf("%s(s=%v, w=%v) = %v, below the stricter aggregator's %v", name, s, w, got, prev)
+				}
+				prev = got
+			}
+		}
+	}
+}
+
+func TestPNormMatchesTheMeans(t *testing.T) {
+	scores := []float64{0.9, 0.5, 1}
+	weights := []float64{0.5, 0.3, 0.2}
+	tests := []struct {
+		p    float64
+		want float64
+	}{
+		{1, ArithmeticMean(scores, weights)},
+		{-1, HarmonicMean(scores, weights)},
+		{2, 0.8246211251235321}, // sqrt(0.5×0.81 + 0.3×0.25 + 0.2)
+		{1e-6, GeometricMean(scores, weights)},
+		{-1000, Minimum(scores, weights)},
+	}
+	for _, tt := range tests {
+		// p near 0 and very negative only approach their limits
+		if got := PNorm(tt.p)(scores, weights); math.Abs(got-tt.want) > 1e-3 {
+			t.Errorf("PNorm(%v) = %.12f, want %.12f", tt.p, got, tt.want)
+		}
+	}
+}
+
+func TestAggregatorConfig(t *testing.T) {
+	for _, c := range []HarmonyConfig{
+		{Aggregator: "median"},
+		{Aggregator: "pnorm"},
+		{Aggregator: "pnorm", P: math.Inf(1)},
+		{Aggregator: "pnorm", P: math.NaN()},
+	} {
+		if _, err := c.aggregator(); err == nil {
+			t.Errorf("aggregator %q with p %v: want an error", c.Aggregator, c.P)
+		}
+	}
+	if agg, err := (&HarmonyConfig{}).aggregator(); err != nil {
+		t.Fatal(err)
+	} else if got := agg([]float64{0.25}, []float64{1}); got != 0.25 {
+		t.Errorf("default aggregator gave %v for a single 0.25, want the geometric mean", got)
+	}
+}
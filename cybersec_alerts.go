@@ -0,0 +1,417 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Alert kinds a route can match
+const (
+	AlertDecision      = "decision"       // the decision changed
+	AlertAction        = "action"         // a decision ran the notify action
+	AlertFloor         = "floor"          // a score fell below its floor
+	AlertProviderError = "provider_error" // a score provider failed
+	AlertDrift         = "drift"          // a source saw an unreviewed change
+)
+
+const (
+	defaultAlertDedup     = 5 * time.Minute
+	defaultAlertRateLimit = 10
+	alertQueueDepth       = 64
+	notifyTimeout         = 10 * time.Second
+)
+
+// AlertConfig routes alerts to notifiers
+type AlertConfig struct {
+	// Notifiers by name
+	Notifiers map[string]NotifierConfig `yaml:"notifiers"`
+
+	// Routes send each alert to the notifiers of every route it matches
+	Routes []AlertRoute `yaml:"routes"`
+
+	// Dedup suppresses an incident reopened within this window
+	Dedup time.Duration `yaml:"dedup"`
+
+	// ResolveAfter is how long harmony must be at CHANGE_GO, and a cause
+	// quiet, before its incident resolves
+	ResolveAfter time.Duration `yaml:"resolve_after"`
+
+	// RateLimit is how many alerts a notifier is sent a minute
+	RateLimit int `yaml:"rate_limit"`
+}
+
+// AlertRoute matches alerts of Kind. Decisions and Providers, if set,
+// narrow it to those decisions or score providers; a route matching a
+// decision also gets the recovery from it.
+type AlertRoute struct {
+	Kind      string   `yaml:"kind"`
+	Decisions []string `yaml:"decisions"`
+	Providers []string `yaml:"providers"`
+	Notify    []string `yaml:"notify"`
+}
+
+func defaultAlertConfig() AlertConfig {
+	return AlertConfig{Dedup: defaultAlertDedup, ResolveAfter: defaultAlertResolveAfter, RateLimit: defaultAlertRateLimit}
+}
+
+func (a *AlertConfig) validate(r *ProviderRegistry) error {
+	for name, nc := range a.Notifiers {
+		if _, err := newNotifier(nc); err != nil {
+			return fmt.Errorf("notifier %s: %w", name, err)
+		}
+	}
+	registered := map[string]bool{}
+	for _, p := range r.Providers() {
+		registered[p.Name()] = true
+	}
+	for i, route := range a.Routes {
+		switch route.Kind {
+		case AlertDecision, AlertAction, AlertFloor, AlertProviderError, AlertDrift:
+		default:
+			return fmt.Errorf("alert route %d: unknown kind %q", i, route.Kind)
+		}
+		byDecision := route.Kind == AlertDecision || route.Kind == AlertAction
+		if len(route.Decisions) > 0 && !byDecision {
+			return fmt.Errorf("alert route %d: decisions don't apply to kind %s", i, route.Kind)
+		}
+		if len(route.Providers) > 0 && byDecision {
+			return fmt.Errorf("alert route %d: providers don't apply to kind %s", i, route.Kind)
+		}
+		for _, decision := range route.Decisions {
+			if _, ok := defaultActions[decision]; !ok {
+				return fmt.Errorf("alert route %d: unknown decision %s", i, decision)
+			}
+		}
+		for _, name := range route.Providers {
+			if !registered[name] {
+				return fmt.Errorf("alert route %d: unknown score provider %s", i, name)
+			}
+		}
+		if len(route.Notify) == 0 {
+			return fmt.Errorf("alert route %d notifies no one", i)
+		}
+		for _, name := range route.Notify {
+			if _, ok := a.Notifiers[name]; !ok {
+				return fmt.Errorf("alert route %d: unknown notifier %s", i, name)
+			}
+		}
+	}
+	if a.Dedup < 0 {
+		return fmt.Errorf("alert dedup %v must be non-negative", a.Dedup)
+	}
+	if a.ResolveAfter <= 0 {
+		return fmt.Errorf("alert resolve_after %v must be positive", a.ResolveAfter)
+	}
+	if a.RateLimit < 1 {
+		return fmt.Errorf("alert rate_limit %d must be at least 1", a.RateLimit)
+	}
+	return nil
+}
+
+// Alert is one notification
+type Alert struct {
+	Kind     string
+	Context  string // the named context, for AlertAction
+	Subject  string // the decision or score provider
+	Previous string // the decision before, for AlertDecision
+	Severity string // critical, error, warning or info
+	Resolved bool   // the incident resolved
+	Summary  string
+	Details  []string
+	Cycle    uint64
+	Time     time.Time
+
+	// The incident the alert is filed under, its first alert and how many
+	// it has had
+	Incident  string
+	FirstSeen time.Time
+	Count     int
+}
+
+// key identifies repeats of a, for incidents and deduplication
+func (a *Alert) key() string {
+	if a.Context != "" {
+		return a.Kind + ":" + a.Context + ":" + a.Subject
+	}
+	return a.Kind + ":" + a.Subject
+}
+
+func (a *Alert) matches(route *AlertRoute) bool {
+	if a.Kind != route.Kind {
+		return false
+	}
+	if len(route.Decisions) > 0 && !slices.Contains(route.Decisions, a.Subject) &&
+		!(a.Resolved && slices.Contains(route.Decisions, a.Previous)) {
+		return false
+	}
+	if len(route.Providers) > 0 && !slices.Contains(route.Providers, a.Subject) {
+		return false
+	}
+	return true
+}
+
+// delivery is an alert queued for one notifier
+type delivery struct {
+	notifier string
+	to       Notifier
+	alert    Alert
+}
+
+// rateWindow counts what a notifier was sent in the current minute
+type rateWindow struct {
+	start time.Time
+	sent  int
+}
+
+// alertDispatcher turns cycles into alerts and routes them. Sending is
+// done off the loop by a worker; when its queue is full, alerts are
+// dropped rather than delaying a cycle.
+type alertDispatcher struct {
+	mu        sync.Mutex
+	cfg       AlertConfig
+	notifiers map[string]Notifier
+	last      string               // the decision of the last cycle
+	calm      time.Time            // since when it has been CHANGE_GO
+	sent      map[string]time.Time // by alert key, for dedup
+	windows   map[string]*rateWindow
+	incidents map[string]*AlertIncident // open, by alert key
+	resolved  []*AlertIncident          // the latest resolved, oldest first
+	seq       uint64                    // the last incident ID
+	queue     chan delivery
+	pending   sync.WaitGroup // queued deliveries not yet sent
+}
+
+var harmonyAlerts = newAlertDispatcher()
+
+func newAlertDispatcher() *alertDispatcher {
+	d := &alertDispatcher{
+		cfg:       defaultAlertConfig(),
+		last:      DecisionGo,
+		sent:      make(map[string]time.Time),
+		windows:   make(map[string]*rateWindow),
+		incidents: make(map[string]*AlertIncident),
+		queue:     make(chan delivery, alertQueueDepth),
+	}
+	go d.run()
+	return d
+}
+
+// newNotifiers builds cfg's notifiers, by name
+func newNotifiers(cfg *AlertConfig) (map[string]Notifier, error) {
+	notifiers := make(map[string]Notifier, len(cfg.Notifiers))
+	for name, nc := range cfg.Notifiers {
+		n, err := newNotifier(nc)
+		if err != nil {
+			return nil, fmt.Errorf("notifier %s: %w", name, err)
+		}
+		notifiers[name] = n
+	}
+	return notifiers, nil
+}
+
+// configure replaces the routes with cfg's and the notifiers with
+// notifiers, built from cfg by newNotifiers. Dedup, rate limit and
+// incident state carry over.
+func (d *alertDispatcher) configure(cfg *AlertConfig, notifiers map[string]Notifier) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.cfg = *cfg
+	d.notifiers = notifiers
+}
+
+// resume takes up decision alerting from decision, as a node taking over
+// from another does, so the decision it inherits isn't alerted as a change
+func (d *alertDispatcher) resume(decision string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.last = decision
+	d.calm = time.Time{}
+}
+
+// observeCycle raises alerts for a cycle: a change of decision away from
+// CHANGE_GO, and each floor breach. The return to CHANGE_GO is left to the
+// incidents' resolution. reasons explain a CHANGE_HALT, and explained any
+// decision.
+func (d *alertDispatcher) observeCycle(ctx context.Context, rec CycleRecord, breaches []floorBreach, reasons, explained []string) {
+	d.mu.Lock()
+	prev := d.last
+	d.last = rec.Decision
+	switch {
+	case rec.Decision != DecisionGo:
+		d.calm = time.Time{}
+		if inc, ok := d.incidents[AlertDecision+":"+rec.Decision]; ok {
+			inc.LastSeen = rec.Time
+		}
+	case d.calm.IsZero():
+		d.calm = rec.Time
+	}
+	d.mu.Unlock()
+
+	if rec.Decision != prev && rec.Decision != DecisionGo {
+		d.raise(ctx, Alert{
+			Kind:     AlertDecision,
+			Subject:  rec.Decision,
+			Previous: prev,
+			Severity: decisionSeverity(rec.Decision),
+			Summary:  fmt.Sprintf("%s (was %s), mu %.6f", rec.Decision, prev, rec.Mu),
+			Details:  slices.Concat(reasons, explained),
+			Cycle:    rec.Cycle,
+			Time:     rec.Time,
+		})
+	}
+	for _, b := range breaches {
+		severity := "warning"
+		if b.halts {
+			severity = "error"
+		}
+		d.raise(ctx, Alert{
+			Kind:     AlertFloor,
+			Subject:  b.name,
+			Severity: severity,
+			Summary:  fmt.Sprintf("%s score %.6f below floor %v", b.name, b.score, b.floor),
+			Cycle:    rec.Cycle,
+			Time:     rec.Time,
+		})
+	}
+	d.resolveQuiet(ctx, rec.Time)
+}
+
+// providerError raises an alert for a failed score provider
+func (d *alertDispatcher) providerError(ctx context.Context, provider string, err error) {
+	d.raise(ctx, Alert{
+		Kind:     AlertProviderError,
+		Subject:  provider,
+		Severity: "error",
+		Summary:  fmt.Sprintf("score provider %s failed: %v", provider, err),
+		Cycle:    cycleID(ctx),
+		Time:     harmonyClock.Now(),
+	})
+}
+
+func decisionSeverity(decision string) string {
+	switch decision {
+	case DecisionHalt:
+		return "critical"
+	case DecisionDegraded:
+		return "error"
+	case DecisionCaution:
+		return "warning"
+	}
+	return "info"
+}
+
+// forget clears the dedup state of every alert of kind
+func (d *alertDispatcher) forget(kind string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for key := range d.sent {
+		if strings.HasPrefix(key, kind+":") {
+			delete(d.sent, key)
+		}
+	}
+}
+
+// raise files a under its incident and routes it, then queues it for each
+// notifier that isn't over its rate limit. Only an incident's first alert
+// is sent, or one more severe than those before; an incident reopened
+// within the dedup window isn't.
+func (d *alertDispatcher) raise(ctx context.Context, a Alert) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	now := harmonyClock.Now()
+	opened, escalated := true, false
+	switch {
+	case !a.Resolved:
+		opened, escalated = d.group(&a, now)
+	case a.Incident == "":
+		d.close(&a, now)
+	}
+
+	var names []string
+	for i := range d.cfg.Routes {
+		if a.matches(&d.cfg.Routes[i]) {
+			for _, name := range d.cfg.Routes[i].Notify {
+				if !slices.Contains(names, name) {
+					names = append(names, name)
+				}
+			}
+		}
+	}
+	if len(names) == 0 {
+		return
+	}
+
+	if !opened && !escalated {
+		for _, name := range names {
+			harmonyMetrics.observeNotification(name, "grouped")
+		}
+		return
+	}
+	if at, ok := d.sent[a.key()]; ok && !a.Resolved && !escalated && now.Sub(at) < d.cfg.Dedup {
+		for _, name := range names {
+			harmonyMetrics.observeNotification(name, "deduplicated")
+		}
+		return
+	}
+	if !a.Resolved {
+		d.sent[a.key()] = now
+	}
+
+	for _, name := range names {
+		w, ok := d.windows[name]
+		if !ok || now.Sub(w.start) >= time.Minute {
+			w = &rateWindow{start: now}
+			d.windows[name] = w
+		}
+		if w.sent >= d.cfg.RateLimit {
+			harmonyMetrics.observeNotification(name, "rate_limited")
+			slog.WarnContext(ctx, "alert rate limited", "notifier", name, "kind", a.Kind, "subject", a.Subject)
+			continue
+		}
+		w.sent++
+		d.pending.Add(1)
+		select {
+		case d.queue <- delivery{notifier: name, to: d.notifiers[name], alert: a}:
+		default:
+			d.pending.Done()
+			harmonyMetrics.observeNotification(name, "dropped")
+			slog.WarnContext(ctx, "alert queue full, dropping alert", "notifier", name, "kind", a.Kind, "subject", a.Subject)
+		}
+	}
+}
+
+// run sends queued alerts, one at a time
+func (d *alertDispatcher) run() {
+	for dl := range d.queue {
+		ctx, cancel := context.WithTimeout(context.Background(), notifyTimeout)
+		err := dl.to.Notify(ctx, dl.alert)
+		cancel()
+		d.pending.Done()
+		if err != nil {
+			harmonyMetrics.observeNotification(dl.notifier, "failed")
+			slog.Warn("alert notification failed", "notifier", dl.notifier, "kind", dl.alert.Kind, "subject", dl.alert.Subject, "err", err)
+			continue
+		}
+		harmonyMetrics.observeNotification(dl.notifier, "sent")
+	}
+}
+
+// flush waits for the queued alerts to be sent, or for ctx to be done
+func (d *alertDispatcher) flush(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		d.pending.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("flush alerts: %w", ctx.Err())
+	}
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"math"
+)
+
+// AnomalyConfig tunes the per-score anomaly detector. It is off unless
+// ZThreshold is set.
+type AnomalyConfig struct {
+	// Alpha is the EWMA smoothing factor, in (0, 1]; lower adapts slower
+	Alpha float64 `yaml:"alpha"`
+
+	// ZThreshold flags a score this many standard deviations below its
+	// moving mean
+	ZThreshold float64 `yaml:"z_threshold"`
+
+	// MinStddev keeps a flat score from making every wobble anomalous
+	MinStddev float64 `yaml:"min_stddev"`
+
+	// Warmup is how many cycles a score is learned before it is judged
+	Warmup int `yaml:"warmup"`
+
+	// Flips flags an oscillation after this many consecutive reversals of
+	// direction, each larger than MinStddev; 0 disables it
+	Flips int `yaml:"flips"`
+
+	// Halt makes anomalies halt like a failed CH check; otherwise they are
+	// only reported
+	Halt bool `yaml:"halt"`
+}
+
+func defaultAnomalyConfig() AnomalyConfig {
+	return AnomalyConfig{Alpha: 0.05, MinStddev: 0.01, Warmup: 100, Flips: 6}
+}
+
+func (a *AnomalyConfig) validate() error {
+	if !(a.Alpha > 0 && a.Alpha <= 1) {
+		return fmt.Errorf("anomaly alpha %v must be in (0, 1]", a.Alpha)
+	}
+	if !(a.ZThreshold >= 0) || math.IsInf(a.ZThreshold, 0) {
+		return fmt.Errorf("anomaly z_threshold %v must be non-negative", a.ZThreshold)
+	}
+	if !(a.MinStddev >= 0) {
+		return fmt.Errorf("anomaly min_stddev %v must be non-negative", a.MinStddev)
+	}
+	if a.Warmup < 0 || a.Flips < 0 {
+		return fmt.Errorf("anomaly warmup and flips must be non-negative")
+	}
+	return nil
+}
+
+// scoreTrend is the moving statistics of one score
+type scoreTrend struct {
+	n        int
+	mean     float64
+	variance float64
+	last     float64
+	dir      int // sign of the last significant change
+	flips    int // consecutive reversals of dir
+}
+
+// anomaly is a score that broke from its trend
+type anomaly struct {
+	name  string
+	kind  string // "drop" or "oscillation"
+	score float64
+	z     float64
+	halts bool
+}
+
+// anomalyDetector keeps a trend per score. Like haltGate it is only
+// touched by the loop, and its state survives config reloads.
+type anomalyDetector struct {
+	trends map[string]*scoreTrend
+}
+
+var harmonyAnomalies = &anomalyDetector{trends: make(map[string]*scoreTrend)}
+
+// observe judges x against the trend, then folds it in
+func (t *scoreTrend) observe(x float64, cfg *AnomalyConfig) (kind string, z float64) {
+	if t.n == 0 {
+		t.n, t.mean, t.last = 1, x, x
+		return "", 0
+	}
+	std := math.Max(math.Sqrt(t.variance), cfg.MinStddev)
+	z = (x - t.mean) / std
+	judged := t.n >= cfg.Warmup
+	if judged && z < -cfg.ZThreshold {
+		kind = "drop"
+	}
+
+	if delta := x - t.last; math.Abs(delta) > cfg.MinStddev {
+		dir := 1
+		if delta < 0 {
+			dir = -1
+		}
+		if t.dir != 0 && dir != t.dir {
+			t.flips++
+		} else {
+			t.flips = 0
+		}
+		t.dir = dir
+	}
+	if kind == "" && judged && cfg.Flips > 0 && t.flips >= cfg.Flips {
+		kind = "oscillation"
+	}
+
+	diff := x - t.mean
+	incr := cfg.Alpha * diff
+	t.mean += incr
+	t.variance = (1 - cfg.Alpha) * (t.variance + diff*incr)
+	t.last = x
+	t.n++
+	return kind, z
+}
+
+// check runs the detector over a cycle's scores. Every anomaly is logged
+// and counted; with Halt set they are also returned as failed checks named
+// "anomaly:<provider>".
+func (d *anomalyDetector) check(ctx context.Context, c *CyberSecContext, cfg *AnomalyConfig) (anomalies []anomaly, failed []string) {
+	if cfg.ZThreshold == 0 {
+		return nil, nil
+	}
+	for i, name := range c.Names {
+		t, ok := d.trends[name]
+		if !ok {
+			t = &scoreTrend{}
+			d.trends[name] = t
+		}
+		kind, z := t.observe(c.Scores[i], cfg)
+		if kind == "" {
+			continue
+		}
+		a := anomaly{name: name, kind: kind, score: c.Scores[i], z: z, halts: cfg.Halt}
+		anomalies = append(anomalies, a)
+		harmonyMetrics.observeAnomaly(name, kind)
+		slog.WarnContext(ctx, "score anomaly", "provider", name, "kind", kind, "score", a.score, "z", z, "halts", a.halts)
+		if a.halts {
+			failed = append(failed, "anomaly:"+name)
+		}
+	}
+	return anomalies, failed
+}
+
+func anomalyNames(anomalies []anomaly) []string {
+	names := make([]string, len(anomalies))
+	for i, a := range anomalies {
+		names[i] = a.name + ":" + a.kind
+	}
+	return names
+}
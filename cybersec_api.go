@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"time"
+)
+
+// HarmonyAPIScope is the ForgeToken scope the status API's read routes
+// require by default
+const HarmonyAPIScope = "harmony:read"
+
+// Scopes of the routes that feed the engine or change its state, which the
+// read scope doesn't grant
+const (
+	// HarmonyFalcoScope posts Falco events, for Falco's http_output or
+	// falcosidekick
+	HarmonyFalcoScope = "harmony:falco:ingest"
+
+	// HarmonyRedTeamScope reports and withdraws red team exercises
+	HarmonyRedTeamScope = "harmony:redteam:write"
+
+	// HarmonyFirewallReviewScope accepts firewall drift as reviewed
+	HarmonyFirewallReviewScope = "harmony:firewall:review"
+
+	// HarmonyQuorumReportScope reports a fleet node's decisions to the
+	// quorum coordinator
+	HarmonyQuorumReportScope = "harmony:quorum:report"
+)
+
+// harmonyStarted is when the engine started, for the uptime in status
+var harmonyStarted = time.Now()
+
+// harmonyStatus is the body of /harmony/status
+type harmonyStatus struct {
+	Cycle    uint64                   `json:"cycle"`
+	Time     time.Time                `json:"time"`
+	Mu       float64                  `json:"mu"`
+	Scores   map[string]float64       `json:"scores"`
+	Decision string                   `json:"decision"`
+	Degraded []string                 `json:"degraded_providers,omitempty"`
+	Failed   []string                 `json:"failed_checks,omitempty"`
+	Contexts map[string]ContextRecord `json:"contexts,omitempty"`
+	Halted   bool                     `json:"halted"`
+	Leading  bool                     `json:"leading"` // this engine runs the enforcement actions
+	Uptime   string                   `json:"uptime"`
+	Interval string                   `json:"interval"` // the tick interval, as sampling has it
+
+	// Explanation is of the last cycle this engine decided
+	Explanation *Explanation `json:"explanation,omitempty"`
+}
+
+// harmonyChecks is the body of /harmony/checks
+type harmonyChecks struct {
+	Cycle   uint64          `json:"cycle"`
+	Time    time.Time       `json:"time"`
+	CH      bool            `json:"ch"`
+	Checks  map[string]bool `json:"checks"`
+	Results CheckResults    `json:"results"` // each check's status, time and reason
+	Floors  []string        `json:"floor_breaches,omitempty"`
+}
+
+// newHarmonyAPI returns the status API, each route authenticated by
+// verifier for its own scope
+func newHarmonyAPI(verifier *forgeVerifier) http.Handler {
+	mux := http.NewServeMux()
+	route := func(pattern, scope string, h http.HandlerFunc) {
+		mux.Handle(pattern, verifier.requireForgeToken(scope, h))
+	}
+	read := verifier.scope
+	route("GET /harmony/status", read, serveStatus)
+	route("GET /harmony/history", read, harmonyHistory.ServeHTTP)
+	route("GET /harmony/checks", read, serveChecks)
+	route("GET /harmony/attribution", read, serveAttribution)
+	route("GET /harmony/incidents", read, serveIncidents)
+	route("POST /harmony/simulate", read, serveSimulate)
+	route("GET /harmony/quorum", read, serveQuorum)
+	route("POST /harmony/quorum/report", HarmonyQuorumReportScope, serveQuorumReport)
+	route("GET /harmony/raft", read, serveRaft)
+	route("POST /harmony/falco", HarmonyFalcoScope, serveFalco)
+	route("GET /harmony/firewall", read, serveFirewall)
+	route("POST /harmony/firewall/review", HarmonyFirewallReviewScope, serveFirewallReview)
+	route("GET /harmony/redteam/exercises", read, serveRedTeamExercises)
+	route("POST /harmony/redteam/exercises", HarmonyRedTeamScope, serveRedTeamReport)
+	route("DELETE /harmony/redteam/exercises/{id}", HarmonyRedTeamScope, serveRedTeamDelete)
+	return mux
+}
+
+// latestCycle returns the last recorded cycle, or writes 503 before the
+// first one
+func latestCycle(w http.ResponseWriter) (CycleRecord, bool) {
+	last := harmonyHistory.Last(1)
+	if len(last) == 0 {
+		http.Error(w, "no cycle has run yet", http.StatusServiceUnavailable)
+		return CycleRecord{}, false
+	}
+	return last[0], true
+}
+
+func serveStatus(w http.ResponseWriter, r *http.Request) {
+	rec, ok := latestCycle(w)
+	if !ok {
+		return
+	}
+	writeJSON(w, harmonyStatus{
+		Cycle:    rec.Cycle,
+		Time:     rec.Time,
+		Mu:       rec.Mu,
+		Scores:   rec.Scores,
+		Decision: rec.Decision,
+		Degraded: rec.Degraded,
+		Failed:   rec.Failed,
+		Contexts: rec.Contexts,
+		Halted:   rec.Decision == DecisionHalt,
+		Leading:  harmonyElector == nil || harmonyElector.Leading(),
+		Uptime:   time.Since(harmonyStarted).Round(time.Second).String(),
+		Interval: harmonySampler.interval(activeConfig()).String(),
+
+		Explanation: harmonyExplanation.get(),
+	})
+}
+
+func serveChecks(w http.ResponseWriter, r *http.Request) {
+	rec, ok := latestCycle(w)
+	if !ok {
+		return
+	}
+	checks := make(map[string]bool, len(rec.Checks))
+	for _, c := range rec.Checks {
+		checks[c.Name] = c.Passed
+	}
+	writeJSON(w, harmonyChecks{
+		Cycle:   rec.Cycle,
+		Time:    rec.Time,
+		CH:      rec.CH,
+		Checks:  checks,
+		Results: rec.Checks,
+		Floors:  rec.Floors,
+	})
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+// serveHarmonyAPI serves the status API on addr. It returns once the
+// listener is bound, with a func that shuts the server down; serving errors
+// are logged.
+func serveHarmonyAPI(addr string, verifier *forgeVerifier) (func(context.Context) error, error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("listen for harmony api: %w", err)
+	}
+	srv := &http.Server{Handler: newHarmonyAPI(verifier), ReadHeaderTimeout: 5 * time.Second}
+	go func() {
+		if err := srv.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			slog.Error("harmony api server stopped", "err", err)
+		}
+	}()
+	return srv.Shutdown, nil
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+)
+
+// defaultAttributionWindow is how far back a drop in mu is attributed,
+// as far as the history reaches
+const defaultAttributionWindow = 5 * time.Minute
+
+// attributionMention is the least share of a drop the summary names a
+// provider for
+const attributionMention = 0.1
+
+// ProviderShare is one provider's part in a change of mu
+type ProviderShare struct {
+	Provider string  `json:"provider"`
+	From     float64 `json:"from"`
+	To       float64 `json:"to"`
+	// Share is the provider's fraction of the change in ln mu; the shares
+	// sum to 1
+	Share float64 `json:"share"`
+}
+
+// Attribution decomposes the drop in mu over a window, from its peak to
+// the last cycle, among the providers
+type Attribution struct {
+	Window    string          `json:"window"`
+	From      time.Time       `json:"from"` // the peak
+	To        time.Time       `json:"to"`
+	MuFrom    float64         `json:"mu_from"`
+	MuTo      float64         `json:"mu_to"`
+	Drop      float64         `json:"drop"`      // mu_from less mu_to
+	Providers []ProviderShare `json:"providers"` // largest share first
+}
+
+// attributeDrop attributes the drop in mu over the window of records
+// ending at now. Each provider's part is its score's effect on ln mu, moved
+// alone from the peak to the end, averaged with its effect moved back
+// alone from the end: exact for the geometric mean, and the shares are
+// normalized for the others. Providers missing from either cycle are left
+// out. It returns nil without a drop to attribute.
+func attributeDrop(cfg *HarmonyConfig, records []CycleRecord, window time.Duration, weight func(string) float64, now time.Time) *Attribution {
+	var in []CycleRecord
+	for _, rec := range records {
+		if !rec.Time.Before(now.Add(-window)) {
+			in = append(in, rec)
+		}
+	}
+	if len(in) < 2 {
+		return nil
+	}
+	last := in[len(in)-1]
+	peak := in[0]
+	for _, rec := range in[:len(in)-1] {
+		if rec.Mu > peak.Mu {
+			peak = rec
+		}
+	}
+	if !(peak.Mu > last.Mu) {
+		return nil
+	}
+
+	var names []string
+	for name := range peak.Scores {
+		if _, ok := last.Scores[name]; ok {
+			names = append(names, name)
+		}
+	}
+	slices.Sort(names)
+	ctx := func(rec CycleRecord, swap string, with CycleRecord) *CyberSecContext {
+		c := &CyberSecContext{}
+		for _, name := range names {
+			s := rec.Scores[name]
+			if name == swap {
+				s = with.Scores[name]
+			}
+			c.Names = append(c.Names, name)
+			c.Scores = append(c.Scores, s)
+			c.Weights = append(c.Weights, weight(name))
+		}
+		return c
+	}
+	lnMu := func(c *CyberSecContext) float64 {
+		return math.Log(math.Max(c.calculateMuWith(cfg), cfg.MinScore))
+	}
+	from, to := lnMu(ctx(peak, "", peak)), lnMu(ctx(last, "", last))
+
+	a := &Attribution{Window: window.String(), From: peak.Time, To: last.Time, MuFrom: peak.Mu, MuTo: last.Mu, Drop: peak.Mu - last.Mu}
+	total := 0.0
+	for _, name := range names {
+		forward := from - lnMu(ctx(peak, name, last))
+		backward := lnMu(ctx(last, name, peak)) - to
+		part := (forward + backward) / 2
+		a.Providers = append(a.Providers, ProviderShare{Provider: name, From: peak.Scores[name], To: last.Scores[name], Share: part})
+		total += part
+	}
+	if total == 0 {
+		return nil
+	}
+	for i := range a.Providers {
+		a.Providers[i].Share /= total
+	}
+	slices.SortStableFunc(a.Providers, func(x, y ProviderShare) int {
+		switch {
+		case x.Share > y.Share:
+			return -1
+		case x.Share < y.Share:
+			return 1
+		}
+		return 0
+	})
+	return a
+}
+
+// summary says which providers drove the drop:
+//
+//	patch_latency drove 80% of the drop in mu over 5m0s, zero_day_exposure 15%
+func (a *Attribution) summary() string {
+	var parts []string
+	for _, p := range a.Providers {
+		if p.Share < attributionMention && len(parts) > 0 {
+			break
+		}
+		parts = append(parts, fmt.Sprintf("%s %.0f%%", p.Provider, 100*p.Share))
+	}
+	parts[0] = strings.Replace(parts[0], " ", " drove ", 1) + " of the drop in mu over " + a.Window
+	return strings.Join(parts, ", ")
+}
+
+// lines renders a for logs and alerts
+func (a *Attribution) lines() []string {
+	lines := []string{a.summary(), fmt.Sprintf("mu fell %.6f, from %.6f at %s to %.6f",
+		a.Drop, a.MuFrom, a.From.Format(time.TimeOnly), a.MuTo)}
+	for _, p := range a.Providers {
+		lines = append(lines, fmt.Sprintf("%s %.6f to %.6f: %.0f%%", p.Provider, p.From, p.To, 100*p.Share))
+	}
+	return lines
+}
+
+// attributeRecent attributes the drop over the configured window of the
+// history, ending with rec if the history doesn't have it yet
+func attributeRecent(cfg *HarmonyConfig, rec CycleRecord, window time.Duration) *Attribution {
+	records := harmonyHistory.Last(0)
+	if n := len(records); n == 0 || records[n-1].Cycle != rec.Cycle {
+		records = append(records, rec)
+	}
+	return attributeDrop(cfg, records, window, harmonyProviders.weight, rec.Time)
+}
+
+// serveAttribution answers GET /harmony/attribution, ?window= overriding
+// the configured window
+func serveAttribution(w http.ResponseWriter, r *http.Request) {
+	rec, ok := latestCycle(w)
+	if !ok {
+		return
+	}
+	cfg := activeConfig()
+	window := cfg.AttributionWindow
+	if s := r.URL.Query().Get("window"); s != "" {
+		var err error
+		if window, err = time.ParseDuration(s); err != nil || window <= 0 {
+			http.Error(w, "window must be a positive duration", http.StatusBadRequest)
+			return
+		}
+	}
+	a := attributeRecent(cfg, rec, window)
+	if a == nil {
+		a = &Attribution{Window: window.String(), To: rec.Time, MuFrom: rec.Mu, MuTo: rec.Mu, Providers: []ProviderShare{}}
+	}
+	writeJSON(w, a)
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"math"
+	"sync"
+	"time"
+)
+
+// autoheal runs on every cycle its decision holds, which at 10 Hz would
+// hammer the remediation system through a long fault. Within a fault
+// episode - a run of consecutive cycles autoheal is asked to act on, per
+// context - it fires at once, then backs off exponentially; across all
+// episodes it fires at most MaxPerWindow times per Window. Each episode has
+// an idempotency key, logged with every trigger, so remediation can tell a
+// retry from a new fault.
+
+// AutohealConfig paces autoheal
+type AutohealConfig struct {
+	// Backoff is the wait after an episode's first trigger; each trigger
+	// after that waits Multiplier times longer, up to MaxBackoff
+	Backoff    time.Duration `yaml:"backoff"`
+	MaxBackoff time.Duration `yaml:"max_backoff"`
+	Multiplier float64       `yaml:"multiplier"`
+
+	// MaxPerWindow caps triggers per Window, across episodes
+	MaxPerWindow int           `yaml:"max_per_window"`
+	Window       time.Duration `yaml:"window"`
+}
+
+func defaultAutohealConfig() AutohealConfig {
+	return AutohealConfig{
+		Backoff:      time.Second,
+		MaxBackoff:   5 * time.Minute,
+		Multiplier:   2,
+		MaxPerWindow: 10,
+		Window:       time.Hour,
+	}
+}
+
+func (a *AutohealConfig) validate() error {
+	if a.Backoff <= 0 {
+		return fmt.Errorf("autoheal backoff %v must be positive", a.Backoff)
+	}
+	if a.MaxBackoff < a.Backoff {
+		return fmt.Errorf("autoheal max_backoff %v must be at least backoff %v", a.MaxBackoff, a.Backoff)
+	}
+	if !(a.Multiplier >= 1) || math.IsInf(a.Multiplier, 0) {
+		return fmt.Errorf("autoheal multiplier %v must be at least 1", a.Multiplier)
+	}
+	if a.MaxPerWindow < 1 {
+		return fmt.Errorf("autoheal max_per_window %d must be at least 1", a.MaxPerWindow)
+	}
+	if a.Window <= 0 {
+		return fmt.Errorf("autoheal window %v must be positive", a.Window)
+	}
+	return nil
+}
+
+// backoff is the wait after an episode's nth trigger
+func (a *AutohealConfig) backoff(n int) time.Duration {
+	d := float64(a.Backoff) * math.Pow(a.Multiplier, float64(n-1))
+	if d > float64(a.MaxBackoff) {
+		return a.MaxBackoff
+	}
+	return time.Duration(d)
+}
+
+// autohealEpisode is one context's run of cycles asking for autoheal
+type autohealEpisode struct {
+	key      string
+	last     uint64 // the last cycle that asked
+	attempts int
+	next     time.Time // no trigger before this
+	limited  bool      // the window cap has been logged
+}
+
+// autohealer is the autoheal action
+type autohealer struct {
+	trigger func(ctx context.Context, ev ActionEvent, key string) error
+
+	mu       sync.Mutex
+	episodes map[string]*autohealEpisode // by context
+	fired    []time.Time                 // triggers in the window, oldest first
+}
+
+func newAutohealer(trigger func(ctx context.Context, ev ActionEvent, key string) error) *autohealer {
+	return &autohealer{trigger: trigger, episodes: make(map[string]*autohealEpisode)}
+}
+
+func (a *autohealer) Name() string   { return "autoheal" }
+func (a *autohealer) enforces() bool { return true }
+
+func (a *autohealer) Run(ctx context.Context, ev ActionEvent) error {
+	cfg := ev.config().Autoheal
+	now := harmonyClock.Now()
+
+	a.mu.Lock()
+	ep := a.episodes[ev.Context]
+	if ep == nil || ev.Cycle != ep.last+1 {
+		name := ev.Context
+		if name == "" {
+			name = "harmony"
+		}
+		ep = &autohealEpisode{key: fmt.Sprintf("autoheal-%s-%d", name, now.UnixMilli())}
+		a.episodes[ev.Context] = ep
+	}
+	ep.last = ev.Cycle
+	if now.Before(ep.next) {
+		a.mu.Unlock()
+		harmonyMetrics.observeAutohealSuppressed("backoff")
+		return nil
+	}
+	cut := 0
+	for cut < len(a.fired) && now.Sub(a.fired[cut]) >= cfg.Window {
+		cut++
+	}
+	a.fired = a.fired[cut:]
+	if len(a.fired) >= cfg.MaxPerWindow {
+		logLimit := !ep.limited
+		ep.limited = true
+		a.mu.Unlock()
+		harmonyMetrics.observeAutohealSuppressed("limit")
+		if logLimit {
+			slog.WarnContext(ctx, "autoheal suppressed: trigger limit reached",
+				"key", ep.key, "limit", cfg.MaxPerWindow, "window", cfg.Window)
+		}
+		return nil
+	}
+	ep.attempts++
+	ep.next = now.Add(cfg.backoff(ep.attempts))
+	ep.limited = false
+	a.fired = append(a.fired, now)
+	key, attempt, wait := ep.key, ep.attempts, ep.next.Sub(now)
+	a.mu.Unlock()
+
+	if err := a.trigger(ctx, ev, key); err != nil {
+		return err
+	}
+	harmonyMetrics.observeAutoheal()
+	slog.InfoContext(ctx, "autoheal triggered", "key", key, "attempt", attempt,
+		"context", ev.Context, "decision", ev.Decision, "next_in", wait)
+	return nil
+}
+
+// triggerAutoheal runs the autoheal hook, if one is configured, with the
+// episode's idempotency key in HARMONY_AUTOHEAL_KEY
+func triggerAutoheal(ctx context.Context, ev ActionEvent, key string) error {
+	argv := ev.config().hook("autoheal")
+	if len(argv) == 0 {
+		return nil
+	}
+	return runHook(ctx, "autoheal", argv, ev, "HARMONY_AUTOHEAL_KEY="+key)
+}
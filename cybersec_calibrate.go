@@ -0,0 +1,133 @@
+package main
+
+import (
+	"fmt"
+	"math"
+)
+
+// Calibration types: how a provider's raw output maps onto a [0, 1] score
+const (
+	CalibrateMinMax    = "minmax"    // linear from Min (0) to Max (1)
+	CalibrateLogistic  = "logistic"  // 1 / (1 + e^(-Steepness (x - Midpoint)))
+	CalibratePiecewise = "piecewise" // linear between Points
+)
+
+// Calibration maps a provider's raw output to a score, so a provider can
+// report in its own units. Outputs outside the mapping are clamped.
+type Calibration struct {
+	// Type is minmax, logistic or piecewise
+	Type string `yaml:"type"`
+
+	// Min and Max are the raw outputs scored 0 and 1; Max below Min
+	// inverts the scale, for providers where lower is better
+	Min float64 `yaml:"min"`
+	Max float64 `yaml:"max"`
+
+	// Midpoint is the raw output scored 0.5; a negative Steepness inverts
+	// the curve
+	Midpoint  float64 `yaml:"midpoint"`
+	Steepness float64 `yaml:"steepness"`
+
+	// Points are raw outputs and their scores, in ascending raw order
+	Points []CalibrationPoint `yaml:"points"`
+}
+
+// CalibrationPoint is one point of a piecewise calibration
+type CalibrationPoint struct {
+	Raw   float64 `yaml:"raw"`
+	Score float64 `yaml:"score"`
+}
+
+// apply maps raw to a score in [0, 1]
+func (c *Calibration) apply(raw float64) float64 {
+	var s float64
+	switch c.Type {
+	case CalibrateMinMax:
+		s = (raw - c.Min) / (c.Max - c.Min)
+	case CalibrateLogistic:
+		s = 1 / (1 + math.Exp(-c.Steepness*(raw-c.Midpoint)))
+	case CalibratePiecewise:
+		pts := c.Points
+		switch {
+		case raw <= pts[0].Raw:
+			s = pts[0].Score
+		case raw >= pts[len(pts)-1].Raw:
+			s = pts[len(pts)-1].Score
+		default:
+			for i := 1; i < len(pts); i++ {
+				if raw <= pts[i].Raw {
+					a, b := pts[i-1], pts[i]
+					s = a.Score + (raw-a.Raw)/(b.Raw-a.Raw)*(b.Score-a.Score)
+					break
+				}
+			}
+		}
+	default:
+		return raw
+	}
+	return math.Max(0, math.Min(s, 1))
+}
+
+func (c *Calibration) validate(name string) error {
+	finite := func(xs ...float64) bool {
+		for _, x := range xs {
+			if math.IsNaN(x) || math.IsInf(x, 0) {
+				return false
+			}
+		}
+		return true
+	}
+	switch c.Type {
+	case CalibrateMinMax:
+		if !finite(c.Min, c.Max) || c.Min == c.Max {
+			return fmt.Errorf("minmax calibration for %s needs distinct, finite min and max", name)
+		}
+	case CalibrateLogistic:
+		if !finite(c.Midpoint, c.Steepness) || c.Steepness == 0 {
+			return fmt.Errorf("logistic calibration for %s needs a finite midpoint and a non-zero steepness", name)
+		}
+	case CalibratePiecewise:
+		if len(c.Points) < 2 {
+			return fmt.Errorf("piecewise calibration for %s needs at least 2 points", name)
+		}
+		for i, p := range c.Points {
+			if !finite(p.Raw) || !(p.Score >= 0 && p.Score <= 1) {
+				return fmt.Errorf("piecewise calibration for %s: point %d must have a finite raw and a score in [0, 1]", name, i)
+			}
+			if i > 0 && p.Raw <= c.Points[i-1].Raw {
+				return fmt.Errorf("piecewise calibration for %s: points must ascend in raw", name)
+			}
+		}
+	default:
+		return fmt.Errorf("unknown calibration type %q for %s", c.Type, name)
+	}
+	return nil
+}
+
+// calibrate maps name's raw output to its score. Providers without a
+// calibration already report a score.
+func (c *HarmonyConfig) calibrate(name string, raw float64) (float64, bool) {
+	cal, ok := c.Calibration[name]
+	if !ok {
+		return raw, false
+	}
+	return cal.apply(raw), true
+}
+
+// validateCalibration checks calibrations name registered providers and
+// are well formed
+func (c *HarmonyConfig) validateCalibration(r *ProviderRegistry) error {
+	registered := map[string]bool{}
+	for _, p := range r.Providers() {
+		registered[p.Name()] = true
+	}
+	for name, cal := range c.Calibration {
+		if !registered[name] {
+			return fmt.Errorf("calibration for unknown score provider %s", name)
+		}
+		if err := cal.validate(name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+	"sync"
+	"time"
+)
+
+// Check is one change-harmony precondition. Evaluate returns nil if it
+// holds, or an error saying why not. A required check that fails breaks
+// CH; one that isn't is reported but doesn't halt. Evaluate is called on
+// the loop every cycle, so it must return quickly.
+type Check interface {
+	Name() string
+	Required() bool
+	Evaluate(ctx context.Context) error
+}
+
+var errCheckFailed = errors.New("check reported failure")
+
+// CheckFunc adapts a plain boolean check to Check
+type CheckFunc struct {
+	name     string
+	required bool
+	check    func() bool
+}
+
+func NewCheckFunc(name string, required bool, check func() bool) *CheckFunc {
+	return &CheckFunc{name: name, required: required, check: check}
+}
+
+func (f *CheckFunc) Name() string   { return f.name }
+func (f *CheckFunc) Required() bool { return f.required }
+func (f *CheckFunc) Evaluate(context.Context) error {
+	if !f.check() {
+		return errCheckFailed
+	}
+	return nil
+}
+
+// CheckRegistry holds the checks run on every tick, in registration order
+type CheckRegistry struct {
+	mu         sync.RWMutex
+	checks     []Check
+	configured map[string]bool // checks added from the config
+}
+
+var harmonyCH = newDefaultChecks()
+
+// newDefaultChecks registers the built-in checks. Each fails, so CH fails
+// closed, until a site check of the same name says how to evaluate it.
+func newDefaultChecks() *CheckRegistry {
+	r := &CheckRegistry{configured: make(map[string]bool)}
+	for _, name := range builtinChecks {
+		r.Register(pendingCheck(name))
+	}
+	return r
+}
+
+var builtinChecks = []string{
+	"no_active_apt_beacon",
+	"ransomware_canary_alive",
+	"backup_immutability_verified",
+	"incident_response_sla_green",
+	"board_level_cyber_risk_sign_off",
+}
+
+// pendingCheck is a built-in check no site check backs yet
+type pendingCheck string
+
+func (p pendingCheck) Name() string   { return string(p) }
+func (p pendingCheck) Required() bool { return true }
+func (p pendingCheck) Evaluate(context.Context) error {
+	return fmt.Errorf("no site check configured for %s", string(p))
+}
+
+// Register adds c, replacing any check with the same name in place
+func (r *CheckRegistry) Register(c Check) error {
+	if c.Name() == "" {
+		return fmt.Errorf("check needs a name")
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if i := r.index(c.Name()); i >= 0 {
+		r.checks[i] = c
+		return nil
+	}
+	r.checks = append(r.checks, c)
+	return nil
+}
+
+// Remove drops the named check and reports whether it was registered
+func (r *CheckRegistry) Remove(name string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	i := r.index(name)
+	if i < 0 {
+		return false
+	}
+	r.checks = append(r.checks[:i:i], r.checks[i+1:]...)
+	return true
+}
+
+// Checks returns the registered checks in order
+func (r *CheckRegistry) Checks() []Check {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return append([]Check(nil), r.checks...)
+}
+
+// Lookup returns the named check
+func (r *CheckRegistry) Lookup(name string) (Check, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if i := r.index(name); i >= 0 {
+		return r.checks[i], true
+	}
+	return nil, false
+}
+
+func (r *CheckRegistry) index(name string) int {
+	for i, c := range r.checks {
+		if c.Name() == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// builtin reports whether name is registered other than by the config,
+// and not as a pending built-in the config may back
+func (r *CheckRegistry) builtin(name string) bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	i := r.index(name)
+	if i < 0 || r.configured[name] {
+		return false
+	}
+	_, pending := r.checks[i].(pendingCheck)
+	return !pending
+}
+
+// setConfigured replaces the checks added by the last config with checks.
+// A check backing a pending built-in takes its place, and gives it back
+// once no longer configured.
+func (r *CheckRegistry) setConfigured(checks []Check) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	kept := r.checks[:0:0]
+	for _, c := range r.checks {
+		switch {
+		case !r.configured[c.Name()]:
+			kept = append(kept, c)
+		case slices.Contains(builtinChecks, c.Name()):
+			kept = append(kept, pendingCheck(c.Name()))
+		}
+	}
+	r.checks = kept
+	r.configured = make(map[string]bool, len(checks))
+	for _, c := range checks {
+		if i := r.index(c.Name()); i >= 0 {
+			r.checks[i] = c
+		} else {
+			r.checks = append(r.checks, c)
+		}
+		r.configured[c.Name()] = true
+	}
+}
+
+// CheckResult is the outcome of one CH sub-check
+type CheckResult struct {
+	Name     string    `json:"name"`
+	Passed   bool      `json:"passed"`
+	Required bool      `json:"required"`
+	At       time.Time `json:"at"`
+	Reason   string    `json:"reason,omitempty"` // why it failed
+}
+
+// CheckResults are the outcomes of the CH sub-checks of one cycle
+type CheckResults []CheckResult
+
+// Passed reports whether CH holds: no required sub-check failed
+func (r CheckResults) Passed() bool {
+	return len(r.Failed()) == 0
+}
+
+// Failed returns the names of the required sub-checks that failed
+func (r CheckResults) Failed() []string {
+	var failed []string
+	for _, c := range r {
+		if !c.Passed && c.Required {
+			failed = append(failed, c.Name)
+		}
+	}
+	return failed
+}
+
+// runCheck evaluates one sub-check. A check that panics fails, with the
+// panic as its reason, rather than taking the loop down.
+func runCheck(ctx context.Context, c Check) (res CheckResult) {
+	res = CheckResult{Name: c.Name(), Required: c.Required(), At: harmonyClock.Now()}
+	defer func() {
+		if r := recover(); r != nil {
+			res.Passed, res.Reason = false, fmt.Sprintf("check panicked: %v", r)
+		}
+	}()
+	if err := c.Evaluate(ctx); err != nil {
+		res.Reason = err.Error()
+		return res
+	}
+	res.Passed = true
+	return res
+}
+
+// checkAttrs groups the failed sub-checks by name, with their reasons
+func checkAttrs(r CheckResults) slog.Attr {
+	var attrs []any
+	for _, c := range r {
+		if !c.Passed {
+			attrs = append(attrs, slog.String(c.Name, c.Reason))
+		}
+	}
+	return slog.Group("failed_checks", attrs...)
+}
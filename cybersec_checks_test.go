@@ -0,0 +1,38 @@
+package main
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+)
+
+func TestBuiltinChecksFailUntilBacked(t *testing.T) {
+	r := newDefaultChecks()
+	for _, c := range r.Checks() {
+		if res := runCheck(context.Background(), c); res.Passed || !res.Required {
+			t.Errorf("unbacked %s: passed %t, required %t; want a required failure", c.Name(), res.Passed, res.Required)
+		}
+	}
+
+	cfg := DefaultHarmonyConfig()
+	cfg.Checks = map[string]CheckConfig{
+		"ransomware_canary_alive": {Type: CheckFile, Path: filepath.Join(t.TempDir(), "canary-tripped"), Absent: true},
+	}
+	if err := cfg.validateChecks(r); err != nil {
+		t.Fatalf("backing a built-in check: %v", err)
+	}
+	cfg.applyChecks(r)
+	checks := r.Checks()
+	if len(checks) != len(builtinChecks) || checks[1].Name() != "ransomware_canary_alive" {
+		t.Fatalf("backed check isn't in the built-in's place: %v", checks)
+	}
+	if err := checks[1].Evaluate(context.Background()); err != nil {
+		t.Errorf("backed check: %v", err)
+	}
+
+	DefaultHarmonyConfig().applyChecks(r)
+	c, _ := r.Lookup("ransomware_canary_alive")
+	if _, ok := c.(pendingCheck); !ok {
+		t.Errorf("dropping the site check left %T, want the pending built-in back", c)
+	}
+}
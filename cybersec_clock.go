@@ -0,0 +1,82 @@
+package main
+
+import (
+	"math/rand/v2"
+	"sync"
+	"time"
+)
+
+// Clock paces the harmony loop. Tests swap harmonyClock for a fakeClock and
+// step time by hand instead of sleeping.
+type Clock interface {
+	Now() time.Time
+	NewTicker(interval, jitter time.Duration) Ticker
+}
+
+type Ticker interface {
+	C() <-chan time.Time
+	Stop()
+}
+
+var harmonyClock Clock = systemClock{}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time { return time.Now() }
+
+func (systemClock) NewTicker(interval, jitter time.Duration) Ticker {
+	t := &systemTicker{c: make(chan time.Time, 1), stop: make(chan struct{})}
+	go t.run(time.Now(), interval, jitter)
+	return t
+}
+
+// systemTicker ticks on a grid of interval from its start, each tick
+// delayed at random by up to jitter. Like time.Ticker it drops the ticks a
+// slow loop misses, and a late tick doesn't move the grid, so a long cycle
+// delays the one tick it overran and no others.
+type systemTicker struct {
+	c    chan time.Time
+	stop chan struct{}
+	once sync.Once
+}
+
+func (t *systemTicker) C() <-chan time.Time { return t.c }
+func (t *systemTicker) Stop()               { t.once.Do(func() { close(t.stop) }) }
+
+func (t *systemTicker) run(slot time.Time, interval, jitter time.Duration) {
+	timer := time.NewTimer(time.Hour)
+	defer timer.Stop()
+	for {
+		var skipped int
+		slot, skipped = nextSlot(slot, time.Now(), interval)
+		at := slot
+		if jitter > 0 {
+			at = at.Add(rand.N(jitter))
+		}
+		timer.Reset(time.Until(at))
+		select {
+		case <-t.stop:
+			return
+		case now := <-timer.C:
+			select {
+			case t.c <- now:
+			default:
+				skipped++ // the loop is still on the last tick
+			}
+		}
+		if skipped > 0 {
+			harmonyMetrics.observeSkippedTicks(skipped)
+		}
+	}
+}
+
+// nextSlot returns the first slot on the grid after both slot and now, and
+// how many slots it passed over
+func nextSlot(slot, now time.Time, interval time.Duration) (time.Time, int) {
+	next := slot.Add(interval)
+	if next.After(now) {
+		return next, 0
+	}
+	missed := now.Sub(next)/interval + 1
+	return next.Add(missed * interval), int(missed)
+}
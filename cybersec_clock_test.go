@@ -0,0 +1,125 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestNextSlot(t *testing.T) {
+	start := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	const interval = 100 * time.Millisecond
+	tests := []struct {
+		name    string
+		now     time.Duration // after start
+		next    time.Duration // after start
+		skipped int
+	}{
+		{"on time", 20 * time.Millisecond, 100 * time.Millisecond, 0},
+		{"just before the slot", 99 * time.Millisecond, 100 * time.Millisecond, 0},
+		{"at the slot", 100 * time.Millisecond, 200 * time.Millisecond, 1},
+		{"one slot missed", 150 * time.Millisecond, 200 * time.Millisecond, 1},
+		{"many slots missed", 1050 * time.Millisecond, 1100 * time.Millisecond, 10},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			next, skipped := nextSlot(start, start.Add(tt.now), interval)
+			if want := start.Add(tt.next); !next.Equal(want) || skipped != tt.skipped {
+				t.Errorf("nextSlot = %v, %d; want %v, %d", next.Sub(start), skipped, tt.next, tt.skipped)
+			}
+		})
+	}
+}
+
+func TestNextSlotDoesNotDrift(t *testing.T) {
+	start := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	const interval = 100 * time.Millisecond
+	slot := start
+	for i := 1; i <= 1000; i++ {
+		// Each tick is taken late, but the grid stays put
+		slot, _ = nextSlot(slot, slot.Add(3*time.Millisecond), interval)
+		if want := start.Add(time.Duration(i) * interval); !slot.Equal(want) {
+			t.Fatalf("slot %d at %v, want %v", i, slot.Sub(start), want.Sub(start))
+		}
+	}
+}
+
+func TestSystemTickerDropsMissedTicks(t *testing.T) {
+	const interval = 10 * time.Millisecond
+	before := testutil.ToFloat64(harmonyMetrics.skipped)
+	ticker := systemClock{}.NewTicker(interval, 0)
+	defer ticker.Stop()
+
+	// A cycle overrunning ten slots gets one stale tick, then the grid
+	// resumes: no burst to catch up
+	time.Sleep(10 * interval)
+	ticks := 0
+	for deadline := time.After(3 * interval); ; {
+		select {
+		case <-ticker.C():
+			ticks++
+			continue
+		case <-deadline:
+		}
+		break
+	}
+	if ticks > 5 {
+		t.Errorf("got %d ticks in 3 intervals after the overrun, want at most 5", ticks)
+	}
+	if skipped := testutil.ToFloat64(harmonyMetrics.skipped) - before; skipped < 5 {
+		t.Errorf("ticks_skipped_total rose by %v, want at least 5", skipped)
+	}
+}
+
+func TestSystemTickerJitter(t *testing.T) {
+	const interval, jitter = 20 * time.Millisecond, 5 * time.Millisecond
+	ticker := systemClock{}.NewTicker(interval, jitter)
+	defer ticker.Stop()
+	start := time.Now()
+	for range 10 {
+		<-ticker.C()
+	}
+	// Jitter delays ticks within their slot without moving the grid
+	if elapsed := time.Since(start); elapsed < 10*interval-time.Millisecond || elapsed > 10*interval+jitter+30*time.Millisecond {
+		t.Errorf("10 ticks took %v, want about %v", elapsed, 10*interval)
+	}
+}
+
+// fakeClock ticks only when Tick is called
+type fakeClock struct {
+	now time.Time
+	c   chan time.Time
+}
+
+func newFakeClock(now time.Time) *fakeClock {
+	return &fakeClock{now: now, c: make(chan time.Time)}
+}
+
+func (f *fakeClock) Now() time.Time                      { return f.now }
+func (f *fakeClock) NewTicker(_, _ time.Duration) Ticker { return fakeTicker{f.c} }
+
+// Advance moves the clock on by d without ticking
+func (f *fakeClock) Advance(d time.Duration) { f.now = f.now.Add(d) }
+
+// Tick advances the clock by d and delivers one tick, blocking until the
+// loop receives it
+func (f *fakeClock) Tick(d time.Duration) {
+	f.now = f.now.Add(d)
+	f.c <- f.now
+}
+
+type fakeTicker struct{ c chan time.Time }
+
+func (t fakeTicker) C() <-chan time.Time { return t.c }
+func (t fakeTicker) Stop()               {}
+
+// useFakeClock swaps harmonyClock for a fakeClock at now for the test
+func useFakeClock(t *testing.T, now time.Time) *fakeClock {
+	t.Helper()
+	fc := newFakeClock(now)
+	saved := harmonyClock
+	harmonyClock = fc
+	t.Cleanup(func() { harmonyClock = saved })
+	return fc
+}
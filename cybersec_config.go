@@ -0,0 +1,320 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// HarmonyConfig tunes the harmony loop. Zero fields take their defaults.
+type HarmonyConfig struct {
+	// Threshold is the mu at or above which a change may proceed
+	Threshold float64 `yaml:"threshold"`
+
+	// ResumeThreshold is the mu needed to end a halt; 0 means Threshold
+	ResumeThreshold float64 `yaml:"resume_threshold"`
+
+	// CautionThreshold and DegradedThreshold grade dips below Threshold
+	// that don't halt; 0 disables the state
+	CautionThreshold  float64 `yaml:"caution_threshold"`
+	DegradedThreshold float64 `yaml:"degraded_threshold"`
+
+	// Actions by decision, run in order; decisions not listed run their
+	// default actions
+	Actions map[string][]string `yaml:"actions"`
+
+	// Hooks are the commands of hook actions, by action name: quarantine
+	// and revoke-tokens need one, and any other name becomes an action
+	Hooks map[string][]string `yaml:"hooks"`
+
+	// Calibration maps providers' raw outputs to scores, by provider name,
+	// before floors, anomalies and aggregation see them
+	Calibration map[string]Calibration `yaml:"calibration"`
+
+	// Floors are per-score minimums, checked apart from mu. A breach is
+	// reported; it halts only for scores listed in HaltOnFloor.
+	Floors      map[string]float64 `yaml:"floors"`
+	HaltOnFloor []string           `yaml:"halt_on_floor"`
+
+	// ProviderPolicy bounds every provider's query and scores a failed
+	// one; ProviderPolicies override it by provider, field by field
+	ProviderPolicy   ProviderPolicy            `yaml:"provider_policy"`
+	ProviderPolicies map[string]ProviderPolicy `yaml:"provider_policies"`
+
+	// Contexts grade subsets of the providers apart, by context name; the
+	// cycle's decision is then the most severe of theirs
+	Contexts map[string]ContextConfig `yaml:"contexts"`
+
+	// Sources back score providers with real integrations, replacing the
+	// built-in queries they name
+	Sources SourcesConfig `yaml:"sources"`
+
+	// Checks are site CH sub-checks, by name, run after the built-in ones
+	Checks map[string]CheckConfig `yaml:"checks"`
+
+	// Parallelism is how many providers are polled at once
+	Parallelism int `yaml:"parallelism"`
+
+	// Anomaly flags scores that drop or oscillate against their own trend
+	Anomaly AnomalyConfig `yaml:"anomaly"`
+
+	// Journal rotates the fault journal set with -fault-journal
+	Journal JournalConfig `yaml:"journal"`
+
+	// Autoheal backs off and caps autoheal through a sustained fault
+	Autoheal AutohealConfig `yaml:"autoheal"`
+
+	// Quorum joins the node to a fleet that halts only when enough of its
+	// nodes agree
+	Quorum QuorumConfig `yaml:"quorum"`
+
+	// Alerts routes decision changes, floor breaches and provider errors
+	// to Slack, PagerDuty or email
+	Alerts AlertConfig `yaml:"alerts"`
+
+	// HaltAfter is how many consecutive halting cycles it takes to halt
+	HaltAfter int `yaml:"halt_after"`
+
+	// MinScore floors every score so one zero can't take log(0)
+	MinScore float64 `yaml:"min_score"`
+
+	// Aggregator combines the scores into mu: geometric (the default),
+	// arithmetic, harmonic, min or pnorm, the power mean of order P
+	Aggregator string  `yaml:"aggregator"`
+	P          float64 `yaml:"p"`
+
+	// Interval is the tick period
+	Interval time.Duration `yaml:"interval"`
+
+	// Jitter delays each tick at random by up to this much, under the
+	// interval, so engines sharing a backend don't query it in step
+	Jitter time.Duration `yaml:"jitter"`
+
+	// Sampling speeds the ticks up as mu nears the threshold or turns
+	// volatile, and slows them down while it is quiet
+	Sampling SamplingConfig `yaml:"sampling"`
+
+	// HistoryDepth is how many past cycles are kept for /harmony/history
+	HistoryDepth int `yaml:"history_depth"`
+
+	// AttributionWindow is how far back a drop in mu is attributed to the
+	// providers that drove it, within the history kept
+	AttributionWindow time.Duration `yaml:"attribution_window"`
+
+	// Weights by provider name; they must sum to 1. Providers not listed
+	// keep the weight they were registered with.
+	Weights map[string]float64 `yaml:"weights"`
+}
+
+const weightSumTolerance = 1e-6
+
+// defaultParallelism polls the built-in providers all at once
+const defaultParallelism = 8
+
+// DefaultHarmonyConfig returns the built-in tuning: the 0.9995 harmony
+// threshold at 10 Hz
+func DefaultHarmonyConfig() *HarmonyConfig {
+	return &HarmonyConfig{
+		Threshold:         harmonyThreshold,
+		MinScore:          minScore,
+		HaltAfter:         1,
+		Interval:          100 * time.Millisecond,
+		HistoryDepth:      defaultHistoryDepth,
+		AttributionWindow: defaultAttributionWindow,
+		Sampling:          defaultSamplingConfig(),
+		Anomaly:           defaultAnomalyConfig(),
+		Alerts:            defaultAlertConfig(),
+		Journal:           defaultJournalConfig(),
+		Autoheal:          defaultAutohealConfig(),
+		Quorum:            defaultQuorumConfig(),
+		ProviderPolicy:    defaultProviderPolicy(),
+		Parallelism:       defaultParallelism,
+	}
+}
+
+var harmonyConfig atomic.Pointer[HarmonyConfig]
+
+// activeConfig returns the configuration the loop is running with
+func activeConfig() *HarmonyConfig {
+	if c := harmonyConfig.Load(); c != nil {
+		return c
+	}
+	return DefaultHarmonyConfig()
+}
+
+// LoadHarmonyConfig reads a YAML config from path over the defaults. An
+// empty path returns the defaults.
+func LoadHarmonyConfig(path string) (*HarmonyConfig, error) {
+	if path == "" {
+		return DefaultHarmonyConfig(), nil
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("open harmony config: %w", err)
+	}
+	defer f.Close()
+	return parseHarmonyConfig(f, path)
+}
+
+// parseHarmonyConfig reads a YAML config from r, named name in errors,
+// over the defaults
+func parseHarmonyConfig(r io.Reader, name string) (*HarmonyConfig, error) {
+	cfg := DefaultHarmonyConfig()
+	dec := yaml.NewDecoder(r)
+	dec.KnownFields(true)
+	if err := dec.Decode(cfg); err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("parse harmony config %s: %w", name, err)
+	}
+	if err := cfg.Validate(harmonyProviders); err != nil {
+		return nil, fmt.Errorf("harmony config %s: %w", name, err)
+	}
+	return cfg, nil
+}
+
+// Validate checks ranges and that the weights name registered providers
+// and, once applied, sum to 1. Providers are checked as c's sources would
+// register them.
+func (c *HarmonyConfig) Validate(r *ProviderRegistry) error {
+	if !(c.Threshold > 0 && c.Threshold <= 1) {
+		return fmt.Errorf("threshold %v must be in (0, 1]", c.Threshold)
+	}
+	if c.ResumeThreshold != 0 && !(c.ResumeThreshold >= c.Threshold && c.ResumeThreshold <= 1) {
+		return fmt.Errorf("resume_threshold %v must be in [threshold, 1]", c.ResumeThreshold)
+	}
+	if err := c.validateHooks(); err != nil {
+		return err
+	}
+	if err := c.validateStates(); err != nil {
+		return err
+	}
+	if err := c.Sources.validate(); err != nil {
+		return err
+	}
+	r = c.Sources.preview(r)
+	if err := c.validateCalibration(r); err != nil {
+		return err
+	}
+	if err := c.validateFloors(r); err != nil {
+		return err
+	}
+	if err := c.validateProviderPolicies(r); err != nil {
+		return err
+	}
+	if err := c.validateContexts(r); err != nil {
+		return err
+	}
+	if err := c.validateChecks(harmonyCH); err != nil {
+		return err
+	}
+	if c.Parallelism < 1 {
+		return fmt.Errorf("parallelism %d must be at least 1", c.Parallelism)
+	}
+	if err := c.Anomaly.validate(); err != nil {
+		return err
+	}
+	if err := c.Journal.validate(); err != nil {
+		return err
+	}
+	if err := c.Autoheal.validate(); err != nil {
+		return err
+	}
+	if err := c.Quorum.validate(); err != nil {
+		return err
+	}
+	if err := c.Alerts.validate(r); err != nil {
+		return err
+	}
+	if c.HaltAfter < 1 {
+		return fmt.Errorf("halt_after %d must be at least 1", c.HaltAfter)
+	}
+	if !(c.MinScore > 0 && c.MinScore < c.Threshold) {
+		return fmt.Errorf("min_score %v must be in (0, threshold)", c.MinScore)
+	}
+	if _, err := c.aggregator(); err != nil {
+		return err
+	}
+	if c.Interval < time.Millisecond {
+		return fmt.Errorf("interval %v must be at least 1ms", c.Interval)
+	}
+	if c.Jitter < 0 || c.Jitter >= c.Interval {
+		return fmt.Errorf("jitter %v must be non-negative and under the interval", c.Jitter)
+	}
+	if err := c.Sampling.validate(c.Interval, c.Jitter); err != nil {
+		return err
+	}
+	if c.HistoryDepth < 1 {
+		return fmt.Errorf("history_depth %d must be at least 1", c.HistoryDepth)
+	}
+	if c.AttributionWindow <= 0 {
+		return fmt.Errorf("attribution_window %v must be positive", c.AttributionWindow)
+	}
+	if len(c.Weights) == 0 {
+		return nil
+	}
+
+	sum := 0.0
+	registered := map[string]bool{}
+	for _, p := range r.Providers() {
+		registered[p.Name()] = true
+		w, ok := c.Weights[p.Name()]
+		if !ok {
+			w = baseWeight(p)
+		}
+		sum += w
+	}
+	for name, w := range c.Weights {
+		if !registered[name] {
+			return fmt.Errorf("weight for unknown score provider %s", name)
+		}
+		if w < 0 || math.IsNaN(w) || math.IsInf(w, 0) {
+			return fmt.Errorf("weight %v for %s must be non-negative", w, name)
+		}
+	}
+	if math.Abs(sum-1) > weightSumTolerance {
+		return fmt.Errorf("weights sum to %v, not 1", sum)
+	}
+	return nil
+}
+
+// applyMu serializes Apply, which builds on the registry it replaces
+var applyMu sync.Mutex
+
+// Apply registers c's sources in r, reweights r's providers, resizes the
+// history, reroutes alerts, registers the site checks and makes c the
+// active configuration. Weights set by an earlier config but absent from c
+// are reset, as are sources. The providers and notifiers are built before
+// anything is replaced, so a config that fails to apply leaves the running
+// one as it was.
+func (c *HarmonyConfig) Apply(r *ProviderRegistry) error {
+	applyMu.Lock()
+	defer applyMu.Unlock()
+
+	next := &ProviderRegistry{providers: r.Providers()}
+	added, dropped, err := c.Sources.apply(next)
+	if err == nil {
+		err = next.setWeights(c.Weights)
+	}
+	var notifiers map[string]Notifier
+	if err == nil {
+		notifiers, err = newNotifiers(&c.Alerts)
+	}
+	if err != nil {
+		closeSources(added)
+		return err
+	}
+
+	r.setProviders(next.Providers())
+	harmonyAlerts.configure(&c.Alerts, notifiers)
+	c.applyChecks(harmonyCH)
+	harmonyHistory.Resize(c.HistoryDepth)
+	harmonyConfig.Store(c)
+	closeSources(dropped)
+	return nil
+}
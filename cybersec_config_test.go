@@ -0,0 +1,45 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestApplyFailsWhole(t *testing.T) {
+	running := harmonyConfig.Load()
+	tests := []struct {
+		name string
+		cfg  func(*HarmonyConfig)
+		err  string
+	}{
+		{"unknown weight", func(c *HarmonyConfig) {
+			c.Weights = map[string]float64{"nope": 1}
+		}, "no score provider nope"},
+		{"notifier secret unset", func(c *HarmonyConfig) {
+			c.Alerts.Notifiers = map[string]NotifierConfig{"ops": {Type: "slack", URL: "${HARMONY_TEST_UNSET_WEBHOOK}"}}
+		}, "notifier ops"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := newDefaultProviders()
+			before := r.Providers()
+			cfg := DefaultHarmonyConfig()
+			cfg.Sources.RedTeam = &RedTeamConfig{}
+			tt.cfg(cfg)
+			if err := cfg.Apply(r); err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Fatalf("got %v, want %q", err, tt.err)
+			}
+			// Nothing of the failed config took effect
+			p, _ := r.lookup("red_team_dwell_time")
+			if _, ok := p.(unsourced); !ok {
+				t.Errorf("failed config registered its source: %T", p)
+			}
+			if after := r.Providers(); len(after) != len(before) {
+				t.Errorf("providers changed from %d to %d", len(before), len(after))
+			}
+			if harmonyConfig.Load() != running {
+				t.Error("failed config became active")
+			}
+		})
+	}
+}
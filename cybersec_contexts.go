@@ -0,0 +1,253 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"regexp"
+	"slices"
+	"sort"
+)
+
+// A named context grades a subset of the providers on its own, with its
+// own thresholds, debouncing and actions. When contexts are configured the
+// cycle's decision is the composite: the most severe context decision.
+// CH checks, floors and anomalies apply to every context.
+
+// ContextConfig is one named context. Zero fields take the top-level
+// value.
+type ContextConfig struct {
+	// Providers are the registered providers the context grades
+	Providers []string `yaml:"providers"`
+
+	// Weights of the context's providers relative to each other; those
+	// not listed keep their top-level weight. They are normalized within
+	// the context.
+	Weights map[string]float64 `yaml:"weights"`
+
+	Threshold         float64 `yaml:"threshold"`
+	ResumeThreshold   float64 `yaml:"resume_threshold"`
+	CautionThreshold  float64 `yaml:"caution_threshold"`
+	DegradedThreshold float64 `yaml:"degraded_threshold"`
+	HaltAfter         int     `yaml:"halt_after"`
+
+	// Actions by decision; decisions not listed run the top-level actions
+	Actions map[string][]string `yaml:"actions"`
+}
+
+var contextName = regexp.MustCompile(`^[a-z][a-z0-9_-]*$`)
+
+// severity ranks decisions, mildest first
+func severity(decision string) int {
+	switch decision {
+	case DecisionCaution:
+		return 1
+	case DecisionDegraded:
+		return 2
+	case DecisionHalt:
+		return 3
+	}
+	return 0
+}
+
+// contextNames returns the configured contexts, sorted
+func (c *HarmonyConfig) contextNames() []string {
+	names := make([]string, 0, len(c.Contexts))
+	for name := range c.Contexts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// forContext returns the config name's context decides and acts with: c
+// with the context's thresholds and actions laid over it
+func (c *HarmonyConfig) forContext(name string) *HarmonyConfig {
+	cc := c.Contexts[name]
+	d := *c
+	d.Contexts = nil
+	if cc.Threshold != 0 {
+		d.Threshold = cc.Threshold
+	}
+	if cc.ResumeThreshold != 0 {
+		d.ResumeThreshold = cc.ResumeThreshold
+	}
+	if cc.CautionThreshold != 0 {
+		d.CautionThreshold = cc.CautionThreshold
+	}
+	if cc.DegradedThreshold != 0 {
+		d.DegradedThreshold = cc.DegradedThreshold
+	}
+	if cc.HaltAfter != 0 {
+		d.HaltAfter = cc.HaltAfter
+	}
+	if len(cc.Actions) > 0 {
+		d.Actions = make(map[string][]string, len(c.Actions)+len(cc.Actions))
+		for decision, names := range c.Actions {
+			d.Actions[decision] = names
+		}
+		for decision, names := range cc.Actions {
+			d.Actions[decision] = names
+		}
+	}
+	return &d
+}
+
+// validateContexts checks each context names registered providers, and
+// that its thresholds and actions are valid for it
+func (c *HarmonyConfig) validateContexts(r *ProviderRegistry) error {
+	registered := map[string]bool{}
+	for _, p := range r.Providers() {
+		registered[p.Name()] = true
+	}
+	for _, name := range c.contextNames() {
+		cc := c.Contexts[name]
+		if !contextName.MatchString(name) {
+			return fmt.Errorf("context name %q must be lower case letters, digits, _ and -", name)
+		}
+		if len(cc.Providers) == 0 {
+			return fmt.Errorf("context %s names no providers", name)
+		}
+		for i, p := range cc.Providers {
+			if !registered[p] {
+				return fmt.Errorf("context %s: unknown score provider %s", name, p)
+			}
+			if slices.Contains(cc.Providers[:i], p) {
+				return fmt.Errorf("context %s lists %s twice", name, p)
+			}
+		}
+		for p, w := range cc.Weights {
+			if !slices.Contains(cc.Providers, p) {
+				return fmt.Errorf("context %s: weight for %s, which isn't one of its providers", name, p)
+			}
+			if !(w >= 0) {
+				return fmt.Errorf("context %s: weight %v for %s must be non-negative", name, w, p)
+			}
+		}
+		total := 0.0
+		for _, p := range r.Providers() {
+			if !slices.Contains(cc.Providers, p.Name()) {
+				continue
+			}
+			w, ok := cc.Weights[p.Name()]
+			if !ok {
+				if w, ok = c.Weights[p.Name()]; !ok {
+					w = baseWeight(p)
+				}
+			}
+			total += w
+		}
+		if total == 0 {
+			return fmt.Errorf("context %s: its providers' weights are all 0", name)
+		}
+		if err := c.forContext(name).Validate(r); err != nil {
+			return fmt.Errorf("context %s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// subset is the part of a collected cycle that context cc grades, with its
+// weights normalized. weight gives the top-level weight of a provider the
+// context doesn't weigh itself.
+func (cc *ContextConfig) subset(c *CyberSecContext, weight func(name string) float64) *CyberSecContext {
+	sub := &CyberSecContext{Aggregate: c.Aggregate}
+	total := 0.0
+	for i, name := range c.Names {
+		if !slices.Contains(cc.Providers, name) {
+			continue
+		}
+		w, ok := cc.Weights[name]
+		if !ok {
+			w = weight(name)
+		}
+		sub.Names = append(sub.Names, name)
+		sub.Scores = append(sub.Scores, c.Scores[i])
+		sub.Weights = append(sub.Weights, w)
+		total += w
+	}
+	if total > 0 {
+		for i := range sub.Weights {
+			sub.Weights[i] /= total
+		}
+	}
+	return sub
+}
+
+// ContextRecord is one context's part of a cycle
+type ContextRecord struct {
+	Mu       float64 `json:"mu"`
+	Decision string  `json:"decision"`
+}
+
+// contextResult is a graded context, for fault reasons
+type contextResult struct {
+	name      string
+	mu        float64
+	threshold float64
+	resume    float64
+	decision  string
+}
+
+// harmonyContextGates debounce each context as harmonyGate does the
+// single context. They are only touched by the loop.
+var harmonyContextGates = map[string]*haltGate{}
+
+// evaluateContexts grades each context configured in cfg, runs its
+// actions, and returns the composite decision
+func evaluateContexts(ctx context.Context, cfg *HarmonyConfig, c *CyberSecContext, ch bool) (string, []contextResult) {
+	composite := DecisionGo
+	var results []contextResult
+	for _, name := range cfg.contextNames() {
+		cc := cfg.Contexts[name]
+		dcfg := cfg.forContext(name)
+		sub := cc.subset(c, harmonyProviders.weight)
+		// Skipped providers can leave a context empty, which calculateMu
+		// scores 0
+		mu := sub.calculateMuWith(cfg)
+
+		gate, ok := harmonyContextGates[name]
+		if !ok {
+			gate = &haltGate{last: DecisionGo}
+			harmonyContextGates[name] = gate
+		}
+		prev := gate.last
+		decision := gate.decide(mu, ch, dcfg)
+		gate.last = decision
+		dcfg.runActions(ctx, ActionEvent{
+			Context:  name,
+			Decision: decision,
+			Previous: prev,
+			Mu:       mu,
+			CH:       ch,
+			Cycle:    cycleID(ctx),
+		})
+		harmonyMetrics.observeContext(name, mu, decision)
+		if decision != DecisionGo {
+			slog.DebugContext(ctx, "harmony context", "context", name, "mu", mu, "decision", decision)
+		}
+		if severity(decision) > severity(composite) {
+			composite = decision
+		}
+		results = append(results, contextResult{name: name, mu: mu, threshold: dcfg.Threshold, resume: dcfg.resumeThreshold(), decision: decision})
+	}
+	for name := range harmonyContextGates {
+		if _, ok := cfg.Contexts[name]; !ok {
+			delete(harmonyContextGates, name)
+		}
+	}
+	harmonyGate.last = composite
+	harmonyMetrics.observeDecision(composite)
+	return composite, results
+}
+
+func contextRecords(results []contextResult) map[string]ContextRecord {
+	if len(results) == 0 {
+		return nil
+	}
+	recs := make(map[string]ContextRecord, len(results))
+	for _, r := range results {
+		recs[r.name] = ContextRecord{Mu: r.mu, Decision: r.decision}
+	}
+	return recs
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/cilium/ebpf"
+	"github.com/cilium/ebpf/link"
+	"github.com/cilium/ebpf/rlimit"
+)
+
+// ebpfScoreOrder is the order of the scores in the probe's cyber_map,
+// which weighs them as the built-in providers do (see cybersec_ebpf.c)
+var ebpfScoreOrder = []string{
+	"soc_alert_coherence",
+	"patch_latency",
+	"zero_day_exposure",
+	"firewall_rules_entropy",
+	"red_team_dwell_time",
+}
+
+// ebpfProbe is the kernel probe of cybersec_ebpf.c, attached and fed each
+// cycle's scores
+type ebpfProbe struct {
+	coll   *ebpf.Collection
+	scores *ebpf.Map
+	links  []link.Link
+
+	mu  sync.Mutex
+	err error // of the last publish
+}
+
+// harmonyProbe is nil unless -ebpf-object is set
+var harmonyProbe *ebpfProbe
+
+// loadEBPFProbe loads the compiled probe from path and attaches it
+func loadEBPFProbe(path string) (*ebpfProbe, error) {
+	if err := rlimit.RemoveMemlock(); err != nil {
+		return nil, fmt.Errorf("remove memlock limit: %w", err)
+	}
+	spec, err := ebpf.LoadCollectionSpec(path)
+	if err != nil {
+		return nil, fmt.Errorf("load ebpf object %s: %w", path, err)
+	}
+	coll, err := ebpf.NewCollection(spec)
+	if err != nil {
+		return nil, fmt.Errorf("load ebpf collection: %w", err)
+	}
+	p := &ebpfProbe{coll: coll, scores: coll.Maps["cyber_map"]}
+	if p.scores == nil {
+		coll.Close()
+		return nil, fmt.Errorf("ebpf object %s has no cyber_map", path)
+	}
+	prog := coll.Programs["trace_write"]
+	if prog == nil {
+		coll.Close()
+		return nil, fmt.Errorf("ebpf object %s has no trace_write program", path)
+	}
+	kp, err := link.Kprobe("__x64_sys_write", prog, nil)
+	if err != nil {
+		coll.Close()
+		return nil, fmt.Errorf("attach kprobe: %w", err)
+	}
+	p.links = append(p.links, kp)
+	return p, nil
+}
+
+// publish writes the cycle's scores into cyber_map. Scores the context
+// lacks are written as 0, which the probe floors like calculateMu.
+func (p *ebpfProbe) publish(c *CyberSecContext) (err error) {
+	defer func() {
+		p.mu.Lock()
+		p.err = err
+		p.mu.Unlock()
+	}()
+	for i, name := range ebpfScoreOrder {
+		score := 0.0
+		for j, n := range c.Names {
+			if n == name {
+				score = c.Scores[j]
+			}
+		}
+		if err := p.scores.Put(uint32(i), float32(score)); err != nil {
+			return fmt.Errorf("update cyber_map[%d]: %w", i, err)
+		}
+	}
+	return nil
+}
+
+// healthy reports whether the probe is attached and took the last scores
+func (p *ebpfProbe) healthy() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(p.links) == 0 {
+		return errors.New("ebpf probe is detached")
+	}
+	return p.err
+}
+
+// Close detaches the probe and unloads it
+func (p *ebpfProbe) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var errs []error
+	for _, l := range p.links {
+		if err := l.Close(); err != nil {
+			errs = append(errs, fmt.Errorf("detach ebpf link: %w", err))
+		}
+	}
+	p.links = nil
+	p.coll.Close()
+	return errors.Join(errs...)
+}
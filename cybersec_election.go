@@ -0,0 +1,450 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/raft"
+	"github.com/redis/go-redis/v9"
+)
+
+// When several engines watch the same estate, only the elected leader runs
+// the enforcement actions - autoheal, hold_privileged_access and the hooks.
+// Under the redis and k8s-lease backends, followers still evaluate every
+// cycle, so their decisions, history and alerts stay current, and stand by
+// to take over. In a Raft group (-raft-dir, whatever the backend) only the
+// Raft leader evaluates: followers skip the cycle and take the leader's
+// history and config from the log. A new leader runs the hooks of the
+// decision it inherits, as if it had just been entered.
+
+// Election backends
+const (
+	ElectNone     = "none"
+	ElectRaft     = "raft"
+	ElectRedis    = "redis"
+	ElectK8sLease = "k8s-lease"
+)
+
+const defaultElectionTTL = 15 * time.Second
+
+// Elector decides whether this engine enforces. Leading is asked every
+// cycle, so it must return quickly.
+type Elector interface {
+	Name() string
+	Leading() bool
+	Close() error
+}
+
+// ElectionOptions configure the lock-based electors
+type ElectionOptions struct {
+	Identity  string        // this engine, as the lock holder; empty means the hostname
+	Name      string        // the lock key or lease name
+	TTL       time.Duration // how long a lock outlives its holder
+	RedisURL  string        // for redis
+	Namespace string        // for k8s-lease; empty means the pod's own
+}
+
+// harmonyElector is the election this engine stands in; nil enforces
+// unconditionally
+var harmonyElector Elector
+
+// newElector starts the backend named kind
+func newElector(kind string, opts ElectionOptions) (Elector, error) {
+	if opts.Identity == "" {
+		host, err := os.Hostname()
+		if err != nil {
+			return nil, fmt.Errorf("election identity: %w", err)
+		}
+		opts.Identity = host
+	}
+	if opts.TTL == 0 {
+		opts.TTL = defaultElectionTTL
+	}
+	if opts.TTL < time.Second {
+		return nil, fmt.Errorf("election ttl %v must be at least 1s", opts.TTL)
+	}
+	switch kind {
+	case "", ElectNone:
+		return nil, nil
+	case ElectRaft:
+		if harmonyRaft == nil {
+			return nil, fmt.Errorf("raft election needs -raft-dir")
+		}
+		return raftElector{harmonyRaft}, nil
+	case ElectRedis:
+		return newRedisElector(opts)
+	case ElectK8sLease:
+		return newLeaseElector(opts)
+	}
+	return nil, fmt.Errorf("unknown election %q: want none, raft, redis or k8s-lease", kind)
+}
+
+// leadership is what the loop last saw of the election
+type leadership struct {
+	leading bool
+	gained  bool // leading began this cycle
+}
+
+// harmonyLeadership is only touched by the loop
+var harmonyLeadership = leadership{leading: true}
+
+// observeLeadership asks the elector at the start of a cycle
+func observeLeadership(ctx context.Context) {
+	leading := harmonyElector == nil || harmonyElector.Leading()
+	prev := harmonyLeadership.leading
+	harmonyLeadership = leadership{leading: leading, gained: leading && !prev}
+	switch {
+	case leading && !prev:
+		slog.InfoContext(ctx, "elected to enforce", "election", harmonyElector.Name())
+	case !leading && prev:
+		slog.WarnContext(ctx, "not the elected leader, standing by", "election", harmonyElector.Name())
+	}
+}
+
+// enforcer marks an action that only the elected leader runs
+type enforcer interface {
+	enforces() bool
+}
+
+func enforces(a Action) bool {
+	e, ok := a.(enforcer)
+	return ok && e.enforces()
+}
+
+// enforcingFunc is an ActionFunc that only the leader runs
+type enforcingFunc struct{ *ActionFunc }
+
+func (enforcingFunc) enforces() bool { return true }
+
+// raftElector follows the Raft group's leader
+type raftElector struct{ n *raftNode }
+
+func (raftElector) Name() string    { return ElectRaft }
+func (e raftElector) Leading() bool { return e.n.r.State() == raft.Leader }
+func (raftElector) Close() error    { return nil }
+
+// lockElector campaigns for a lock that expires TTL after it was last
+// renewed, renewing every TTL/3. It counts itself leader until 2/3 TTL
+// after the start of its last successful renewal, so it stops enforcing
+// before the lock can pass to another engine.
+type lockElector struct {
+	name    string
+	ttl     time.Duration
+	acquire func(ctx context.Context) (bool, error) // take or renew the lock
+	release func(ctx context.Context) error
+
+	mu    sync.Mutex
+	until time.Time
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+func (e *lockElector) start() {
+	e.stop, e.done = make(chan struct{}), make(chan struct{})
+	go e.run()
+}
+
+func (e *lockElector) run() {
+	defer close(e.done)
+	every := e.ttl / 3
+	failing := false
+	for {
+		start := time.Now()
+		ctx, cancel := context.WithTimeout(context.Background(), every)
+		held, err := e.acquire(ctx)
+		cancel()
+		switch {
+		case err != nil && !failing:
+			slog.Warn("leader election failed", "election", e.name, "err", err)
+		case err == nil && failing:
+			slog.Info("leader election recovered", "election", e.name)
+		}
+		failing = err != nil
+		e.mu.Lock()
+		if held {
+			e.until = start.Add(e.ttl - every)
+		} else if err == nil {
+			e.until = time.Time{}
+		}
+		e.mu.Unlock()
+
+		select {
+		case <-e.stop:
+			return
+		case <-time.After(every):
+		}
+	}
+}
+
+func (e *lockElector) Name() string { return e.name }
+
+func (e *lockElector) Leading() bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return time.Now().Before(e.until)
+}
+
+// Close stops campaigning and gives the lock up if it is held, so a
+// follower need not wait out the TTL
+func (e *lockElector) Close() error {
+	close(e.stop)
+	<-e.done
+	e.mu.Lock()
+	e.until = time.Time{}
+	e.mu.Unlock()
+	ctx, cancel := context.WithTimeout(context.Background(), e.ttl/3)
+	defer cancel()
+	return e.release(ctx)
+}
+
+// redisAcquire takes KEYS[1] for ARGV[1] if it is free or already ARGV[1]'s,
+// for ARGV[2] milliseconds
+var redisAcquire = redis.NewScript(`
+local holder = redis.call('GET', KEYS[1])
+if holder and holder ~= ARGV[1] then return 0 end
+redis.call('SET', KEYS[1], ARGV[1], 'PX', ARGV[2])
+return 1
+`)
+
+// redisRelease deletes KEYS[1] if ARGV[1] holds it
+var redisRelease = redis.NewScript(`
+if redis.call('GET', KEYS[1]) == ARGV[1] then return redis.call('DEL', KEYS[1]) end
+return 0
+`)
+
+func newRedisElector(opts ElectionOptions) (Elector, error) {
+	if opts.RedisURL == "" {
+		return nil, fmt.Errorf("redis election needs a redis url")
+	}
+	ropts, err := redis.ParseURL(opts.RedisURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid redis URL: %w", err)
+	}
+	client := redis.NewClient(ropts)
+	key := []string{opts.Name}
+	e := &lockElector{
+		name: ElectRedis,
+		ttl:  opts.TTL,
+		acquire: func(ctx context.Context) (bool, error) {
+			n, err := redisAcquire.Run(ctx, client, key, opts.Identity, opts.TTL.Milliseconds()).Int64()
+			return n == 1, err
+		},
+		release: func(ctx context.Context) error {
+			defer client.Close()
+			return redisRelease.Run(ctx, client, key, opts.Identity).Err()
+		},
+	}
+	e.start()
+	return e, nil
+}
+
+// The in-cluster service account the k8s-lease elector authenticates as
+const serviceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+
+// k8sMicroTime is the wire format of a Lease's MicroTime fields
+const k8sMicroTime = "2006-01-02T15:04:05.000000Z07:00"
+
+// k8sLease is the part of a coordination.k8s.io/v1 Lease the elector uses
+type k8sLease struct {
+	APIVersion string `json:"apiVersion"`
+	Kind       string `json:"kind"`
+	Metadata   struct {
+		Name            string `json:"name"`
+		Namespace       string `json:"namespace"`
+		ResourceVersion string `json:"resourceVersion,omitempty"`
+	} `json:"metadata"`
+	Spec struct {
+		HolderIdentity       string `json:"holderIdentity,omitempty"`
+		LeaseDurationSeconds int    `json:"leaseDurationSeconds,omitempty"`
+		AcquireTime          string `json:"acquireTime,omitempty"`
+		RenewTime            string `json:"renewTime,omitempty"`
+		LeaseTransitions     int    `json:"leaseTransitions,omitempty"`
+	} `json:"spec"`
+}
+
+// expired reports whether the lease's holder has let it lapse by now
+func (l *k8sLease) expired(now time.Time) bool {
+	if l.Spec.HolderIdentity == "" {
+		return true
+	}
+	renewed, err := time.Parse(k8sMicroTime, l.Spec.RenewTime)
+	if err != nil {
+		return true
+	}
+	return now.After(renewed.Add(time.Duration(l.Spec.LeaseDurationSeconds) * time.Second))
+}
+
+// leaseClient talks to the API server as the pod's service account
+type leaseClient struct {
+	http  *http.Client
+	url   string // the lease's URL
+	token string
+}
+
+var errLeaseConflict = errors.New("lease changed concurrently")
+
+// newLeaseElector campaigns for a coordination.k8s.io Lease through the API
+// server, as the pod's service account, which needs get, create and update
+// on leases
+func newLeaseElector(opts ElectionOptions) (Elector, error) {
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return nil, fmt.Errorf("k8s-lease election must run in a pod")
+	}
+	token, err := os.ReadFile(serviceAccountDir + "/token")
+	if err != nil {
+		return nil, fmt.Errorf("read service account token: %w", err)
+	}
+	ca, err := os.ReadFile(serviceAccountDir + "/ca.crt")
+	if err != nil {
+		return nil, fmt.Errorf("read service account ca: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(ca) {
+		return nil, fmt.Errorf("service account ca has no certificates")
+	}
+	ns := opts.Namespace
+	if ns == "" {
+		b, err := os.ReadFile(serviceAccountDir + "/namespace")
+		if err != nil {
+			return nil, fmt.Errorf("read service account namespace: %w", err)
+		}
+		ns = strings.TrimSpace(string(b))
+	}
+	c := &leaseClient{
+		http: &http.Client{
+			Timeout:   opts.TTL / 3,
+			Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}},
+		},
+		url:   fmt.Sprintf("https://%s/apis/coordination.k8s.io/v1/namespaces/%s/leases/%s", net.JoinHostPort(host, port), ns, opts.Name),
+		token: strings.TrimSpace(string(token)),
+	}
+	e := &lockElector{
+		name: ElectK8sLease,
+		ttl:  opts.TTL,
+		acquire: func(ctx context.Context) (bool, error) {
+			return c.acquire(ctx, ns, opts.Name, opts.Identity, opts.TTL)
+		},
+		release: func(ctx context.Context) error {
+			return c.release(ctx, opts.Identity)
+		},
+	}
+	e.start()
+	return e, nil
+}
+
+// acquire takes or renews the lease for identity. Losing a race to another
+// engine isn't an error: the lease is just not held.
+func (c *leaseClient) acquire(ctx context.Context, ns, name, identity string, ttl time.Duration) (bool, error) {
+	now := time.Now()
+	lease, err := c.get(ctx)
+	if err != nil {
+		return false, err
+	}
+	create := lease == nil
+	if create {
+		lease = &k8sLease{APIVersion: "coordination.k8s.io/v1", Kind: "Lease"}
+		lease.Metadata.Name, lease.Metadata.Namespace = name, ns
+	} else if lease.Spec.HolderIdentity != identity && !lease.expired(now) {
+		return false, nil
+	}
+	if lease.Spec.HolderIdentity != identity {
+		if !create {
+			lease.Spec.LeaseTransitions++
+		}
+		lease.Spec.HolderIdentity = identity
+		lease.Spec.AcquireTime = now.UTC().Format(k8sMicroTime)
+	}
+	lease.Spec.LeaseDurationSeconds = int((ttl + time.Second - 1) / time.Second)
+	lease.Spec.RenewTime = now.UTC().Format(k8sMicroTime)
+	err = c.put(ctx, lease, create)
+	if errors.Is(err, errLeaseConflict) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// release clears the lease if identity still holds it
+func (c *leaseClient) release(ctx context.Context, identity string) error {
+	lease, err := c.get(ctx)
+	if err != nil || lease == nil || lease.Spec.HolderIdentity != identity {
+		return err
+	}
+	lease.Spec.HolderIdentity = ""
+	if err := c.put(ctx, lease, false); err != nil && !errors.Is(err, errLeaseConflict) {
+		return err
+	}
+	return nil
+}
+
+// get returns the lease, or nil if there is none yet
+func (c *leaseClient) get(ctx context.Context) (*k8sLease, error) {
+	resp, err := c.do(ctx, http.MethodGet, c.url, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return nil, nil
+	default:
+		return nil, fmt.Errorf("get lease: %s", resp.Status)
+	}
+	var lease k8sLease
+	if err := json.NewDecoder(resp.Body).Decode(&lease); err != nil {
+		return nil, fmt.Errorf("decode lease: %w", err)
+	}
+	return &lease, nil
+}
+
+// put creates or updates the lease; the resource version makes an update
+// fail with errLeaseConflict if another engine got there first
+func (c *leaseClient) put(ctx context.Context, lease *k8sLease, create bool) error {
+	body, err := json.Marshal(lease)
+	if err != nil {
+		return fmt.Errorf("encode lease: %w", err)
+	}
+	method, url := http.MethodPut, c.url
+	if create {
+		method, url = http.MethodPost, c.url[:strings.LastIndex(c.url, "/")]
+	}
+	resp, err := c.do(ctx, method, url, body)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	switch {
+	case resp.StatusCode == http.StatusConflict:
+		return errLeaseConflict
+	case resp.StatusCode/100 != 2:
+		return fmt.Errorf("write lease: %s", resp.Status)
+	}
+	return nil
+}
+
+func (c *leaseClient) do(ctx context.Context, method, url string, body []byte) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+c.token)
+	req.Header.Set("Accept", "application/json")
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	return c.http.Do(req)
+}
@@ -0,0 +1,344 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The epss source scores the local vulnerability list by how likely each
+// is to be exploited. EPSS gives every published CVE the probability of
+// exploitation in the next 30 days; the score is the probability that none
+// of the listed CVEs is, the product of one less theirs. The list is any
+// file naming CVEs - a scanner's report, or one ID a line - reread on
+// every refresh. The EPSS scores are downloaded daily and kept on disk,
+// so the provider carries on offline with the last download until it is
+// MaxAge old.
+
+const (
+	defaultEPSSURL     = "https://epss.empiricalsecurity.com/epss_scores-current.csv.gz"
+	defaultEPSSName    = "exploitability"
+	defaultEPSSWeight  = 0.1
+	defaultEPSSEvery   = 5 * time.Minute
+	defaultEPSSRefetch = 24 * time.Hour
+	defaultEPSSMaxAge  = 7 * 24 * time.Hour
+	defaultEPSSTimeout = 5 * time.Minute
+)
+
+var cveID = regexp.MustCompile(`CVE-\d{4}-\d{4,}`)
+
+// EPSSConfig configures the epss source. Zero fields take their defaults.
+type EPSSConfig struct {
+	// Name is the provider's, exploitability by default, and Weight its
+	// registered weight, 0.1 by default
+	Name   string  `yaml:"name"`
+	Weight float64 `yaml:"weight"`
+
+	// Vulns is the local vulnerability list: every CVE ID in the file
+	// counts, once
+	Vulns string `yaml:"vulns"`
+
+	// URL is the gzipped EPSS scores CSV, and Cache the directory it is kept
+	// in; without a cache a restart waits for a download
+	URL   string `yaml:"url"`
+	Cache string `yaml:"cache"`
+
+	// Every is how often the list is rescored, 5m by default; Refetch how
+	// often the scores are downloaded, 24h by default. The provider fails
+	// once the scores it has are MaxAge old, 7 days by default.
+	Every   time.Duration `yaml:"every"`
+	Refetch time.Duration `yaml:"refetch"`
+	MaxAge  time.Duration `yaml:"max_age"`
+
+	// Timeout bounds a refresh, download included, 5m by default
+	Timeout time.Duration `yaml:"timeout"`
+}
+
+func (c *EPSSConfig) validate() error {
+	if c.Weight < 0 || math.IsNaN(c.Weight) || math.IsInf(c.Weight, 0) {
+		return fmt.Errorf("weight %v must be non-negative", c.Weight)
+	}
+	if c.Vulns == "" {
+		return fmt.Errorf("needs a vulns list")
+	}
+	if c.URL != "" {
+		u, err := url.Parse(c.URL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("url %q must be an http or https url", c.URL)
+		}
+	}
+	if c.Every < 0 || c.Refetch < 0 || c.MaxAge < 0 || c.Timeout < 0 {
+		return fmt.Errorf("every, refetch, max_age and timeout must be non-negative")
+	}
+	return nil
+}
+
+func (c *EPSSConfig) name() string {
+	if c.Name != "" {
+		return c.Name
+	}
+	return defaultEPSSName
+}
+
+// withDefaults returns c with its zero fields defaulted
+func (c EPSSConfig) withDefaults() EPSSConfig {
+	c.Name = c.name()
+	if c.Weight == 0 {
+		c.Weight = defaultEPSSWeight
+		if _, ok := builtinProvider(c.Name); ok {
+			c.Weight = builtinWeight(c.Name)
+		}
+	}
+	if c.URL == "" {
+		c.URL = defaultEPSSURL
+	}
+	if c.Every == 0 {
+		c.Every = defaultEPSSEvery
+	}
+	if c.Refetch == 0 {
+		c.Refetch = defaultEPSSRefetch
+	}
+	if c.MaxAge == 0 {
+		c.MaxAge = defaultEPSSMaxAge
+	}
+	if c.Timeout == 0 {
+		c.Timeout = defaultEPSSTimeout
+	}
+	return c
+}
+
+// epssProvider is the epss source's provider
+type epssProvider struct {
+	refreshedScore
+	src    EPSSConfig // as configured, to tell a changed config
+	cfg    EPSSConfig // defaulted
+	client *http.Client
+
+	mu      sync.Mutex // held by refresh, which is never concurrent
+	scores  map[string]float64
+	fetched time.Time // when scores were downloaded
+}
+
+func newEPSSProvider(src *EPSSConfig) *epssProvider {
+	cfg := src.withDefaults()
+	p := &epssProvider{src: *src, cfg: cfg, client: &http.Client{}}
+	p.refreshedScore = refreshedScore{
+		name:    cfg.Name,
+		weight:  cfg.Weight,
+		every:   cfg.Every,
+		timeout: cfg.Timeout,
+		maxAge:  cfg.MaxAge,
+		refresh: p.refresh,
+	}
+	return p
+}
+
+func (p *epssProvider) source() any { return p.src }
+
+func (p *epssProvider) refresh(ctx context.Context) (float64, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if err := p.update(ctx); err != nil {
+		return 0, err
+	}
+	data, err := os.ReadFile(p.cfg.Vulns)
+	if err != nil {
+		return 0, err
+	}
+	cves := map[string]bool{}
+	for _, id := range cveID.FindAllString(string(data), -1) {
+		cves[id] = true
+	}
+	score, expected, unscored := 1.0, 0.0, 0
+	for id := range cves {
+		e, ok := p.scores[id]
+		if !ok {
+			unscored++
+			continue
+		}
+		score *= 1 - e
+		expected += e
+	}
+	slog.Debug("exploitability refreshed", "cves", len(cves), "unscored", unscored,
+		"expected_exploited", expected, "scores_from", p.fetched, "score", score)
+	return score, nil
+}
+
+// update loads the EPSS scores: from the cache first, then downloading
+// them when they are Refetch old. A failed download keeps the scores
+// held until they are MaxAge old.
+func (p *epssProvider) update(ctx context.Context) error {
+	now := harmonyClock.Now()
+	if p.scores == nil && p.cfg.Cache != "" {
+		if err := p.loadCache(); err != nil && !errors.Is(err, os.ErrNotExist) {
+			slog.Warn("epss cache not loaded", "err", err)
+		}
+	}
+	if p.scores != nil && now.Sub(p.fetched) < p.cfg.Refetch {
+		return nil
+	}
+	err := p.download(ctx)
+	switch {
+	case err == nil:
+		return nil
+	case p.scores == nil:
+		return fmt.Errorf("epss scores: %w", err)
+	case now.Sub(p.fetched) > p.cfg.MaxAge:
+		return fmt.Errorf("epss scores from %s, over max_age %v: %w", p.fetched.Format(time.DateOnly), p.cfg.MaxAge, err)
+	}
+	slog.Warn("epss download failed, scoring with the last", "fetched", p.fetched, "err", err)
+	return nil
+}
+
+func (p *epssProvider) cachePath() string {
+	return filepath.Join(p.cfg.Cache, "epss_scores.csv.gz")
+}
+
+func (p *epssProvider) loadCache() error {
+	f, err := os.Open(p.cachePath())
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	scores, err := parseEPSS(f)
+	if err != nil {
+		return err
+	}
+	p.scores, p.fetched = scores, fi.ModTime()
+	return nil
+}
+
+// download fetches the scores, only if changed since the last download,
+// and caches them
+func (p *epssProvider) download(ctx context.Context) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, p.cfg.URL, nil)
+	if err != nil {
+		return err
+	}
+	if p.scores != nil {
+		req.Header.Set("If-Modified-Since", p.fetched.UTC().Format(http.TimeFormat))
+	}
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	now := harmonyClock.Now()
+	switch {
+	case resp.StatusCode == http.StatusNotModified && p.scores != nil:
+		p.fetched = now
+		p.touchCache(now)
+		return nil
+	case resp.StatusCode/100 != 2:
+		return fmt.Errorf("%s answered %s", p.cfg.URL, resp.Status)
+	}
+
+	body := io.Reader(resp.Body)
+	var tmp *os.File
+	if p.cfg.Cache != "" {
+		if err := os.MkdirAll(p.cfg.Cache, 0o700); err != nil {
+			return err
+		}
+		if tmp, err = os.CreateTemp(p.cfg.Cache, "epss-*.tmp"); err != nil {
+			return err
+		}
+		defer os.Remove(tmp.Name())
+		defer tmp.Close()
+		body = io.TeeReader(body, tmp)
+	}
+	scores, err := parseEPSS(body)
+	if err != nil {
+		return err
+	}
+	p.scores, p.fetched = scores, now
+	if tmp != nil {
+		if err := tmp.Close(); err == nil {
+			err = os.Rename(tmp.Name(), p.cachePath())
+		}
+		if err != nil {
+			slog.Warn("epss cache not written", "err", err)
+		}
+		p.touchCache(now)
+	}
+	slog.Info("epss scores downloaded", "cves", len(scores))
+	return nil
+}
+
+// touchCache dates the cache to when its contents were last confirmed
+func (p *epssProvider) touchCache(t time.Time) {
+	if p.cfg.Cache != "" {
+		os.Chtimes(p.cachePath(), t, t)
+	}
+}
+
+// parseEPSS reads the gzipped EPSS CSV: a #model_version comment line,
+// then cve,epss,percentile rows under a header
+func parseEPSS(r io.Reader) (map[string]float64, error) {
+	zr, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, fmt.Errorf("epss scores: %w", err)
+	}
+	defer zr.Close()
+	br := bufio.NewReader(zr)
+	if b, err := br.Peek(1); err == nil && b[0] == '#' {
+		if _, err := br.ReadString('\n'); err != nil {
+			return nil, fmt.Errorf("epss scores: %w", err)
+		}
+	}
+	cr := csv.NewReader(br)
+	cr.ReuseRecord = true
+	header, err := cr.Read()
+	if err != nil {
+		return nil, fmt.Errorf("epss scores: %w", err)
+	}
+	cveCol, epssCol := -1, -1
+	for i, h := range header {
+		switch strings.TrimSpace(h) {
+		case "cve":
+			cveCol = i
+		case "epss":
+			epssCol = i
+		}
+	}
+	if cveCol < 0 || epssCol < 0 {
+		return nil, fmt.Errorf("epss scores: no cve and epss columns in %v", header)
+	}
+	scores := make(map[string]float64, 1<<18)
+	for {
+		rec, err := cr.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("epss scores: %w", err)
+		}
+		e, err := strconv.ParseFloat(rec[epssCol], 64)
+		if err != nil || e < 0 || e > 1 {
+			continue
+		}
+		scores[rec[cveCol]] = e
+	}
+	if len(scores) == 0 {
+		return nil, fmt.Errorf("epss scores: none read")
+	}
+	return scores, nil
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"slices"
+	"sync"
+)
+
+// explainSteps is how many bisections find the score that crosses the
+// threshold, to well under a millionth
+const explainSteps = 40
+
+// ScoreExplanation is one score's part in a decision
+type ScoreExplanation struct {
+	Provider string  `json:"provider"`
+	Score    float64 `json:"score"`
+	Weight   float64 `json:"weight"` // normalized
+
+	// LogContribution is how much lower ln mu is for this score than were
+	// it 1; under the geometric mean, weight × ln score
+	LogContribution float64 `json:"log_contribution"`
+
+	// Needed is the score that alone would bring mu to the threshold, the
+	// rest unchanged; unset while mu is there or no score of 1 would do
+	Needed *float64 `json:"needed,omitempty"`
+}
+
+// ScoreImprovement is the smallest single score rise that crosses the
+// threshold
+type ScoreImprovement struct {
+	Provider string  `json:"provider"`
+	From     float64 `json:"from"`
+	To       float64 `json:"to"`
+}
+
+// Explanation says why a cycle decided as it did. Without Improvement, a
+// positive Gap can't be closed by any one score.
+type Explanation struct {
+	Cycle     uint64  `json:"cycle"`
+	Decision  string  `json:"decision"`
+	Mu        float64 `json:"mu"`
+	Threshold float64 `json:"threshold"` // the resume threshold while halted
+	// Gap is the threshold less mu: positive when mu falls short
+	Gap         float64            `json:"gap"`
+	Scores      []ScoreExplanation `json:"scores"`
+	Failed      []string           `json:"failed_checks,omitempty"`
+	Improvement *ScoreImprovement  `json:"improvement,omitempty"`
+}
+
+// explain explains the decision on ctx's scores under cfg
+func explain(cfg *HarmonyConfig, id uint64, ctx *CyberSecContext, mu float64, decision string, failed []string) *Explanation {
+	target := cfg.Threshold
+	if decision == DecisionHalt {
+		target = cfg.resumeThreshold()
+	}
+	e := &Explanation{Cycle: id, Decision: decision, Mu: mu, Threshold: target, Gap: target - mu, Failed: failed}
+	total := weightTotal(ctx.Weights)
+	for i, name := range ctx.Names {
+		s := ScoreExplanation{Provider: name, Score: ctx.Scores[i]}
+		if total > 0 {
+			s.Weight = ctx.Weights[i] / total
+		}
+		with := func(score float64) float64 {
+			c := *ctx
+			c.Scores = slices.Clone(ctx.Scores)
+			c.Scores[i] = score
+			return c.calculateMuWith(cfg)
+		}
+		perfect := with(1)
+		if mu > 0 && perfect > 0 {
+			s.LogContribution = math.Log(mu) - math.Log(perfect)
+		}
+		if e.Gap > 0 && perfect >= target {
+			lo, hi := ctx.Scores[i], 1.0
+			for range explainSteps {
+				mid := (lo + hi) / 2
+				if with(mid) >= target {
+					hi = mid
+				} else {
+					lo = mid
+				}
+			}
+			s.Needed = &hi
+			if e.Improvement == nil || hi-s.Score < e.Improvement.To-e.Improvement.From {
+				e.Improvement = &ScoreImprovement{Provider: name, From: s.Score, To: hi}
+			}
+		}
+		e.Scores = append(e.Scores, s)
+	}
+	return e
+}
+
+// lines renders e for logs and alerts
+func (e *Explanation) lines() []string {
+	var lines []string
+	if e.Gap > 0 {
+		lines = append(lines, fmt.Sprintf("mu %.6f is %.6f below threshold %v", e.Mu, e.Gap, e.Threshold))
+	} else {
+		lines = append(lines, fmt.Sprintf("mu %.6f is %.6f above threshold %v", e.Mu, -e.Gap, e.Threshold))
+	}
+	for _, s := range e.Scores {
+		lines = append(lines, fmt.Sprintf("%s score %.6f, weight %.3f: %+.6f to ln mu", s.Provider, s.Score, s.Weight, s.LogContribution))
+	}
+	for _, name := range e.Failed {
+		lines = append(lines, "check failed: "+name)
+	}
+	switch {
+	case e.Improvement != nil:
+		lines = append(lines, fmt.Sprintf("raising %s from %.6f to %.6f would reach the threshold",
+			e.Improvement.Provider, e.Improvement.From, e.Improvement.To))
+	case e.Gap > 0:
+		lines = append(lines, "no one score can reach the threshold")
+	}
+	return lines
+}
+
+// explanations holds the last cycle's explanation, for the status API
+type explanations struct {
+	mu   sync.Mutex
+	last *Explanation
+}
+
+var harmonyExplanation = &explanations{}
+
+// set records e and reports whether its decision differs from the last
+func (x *explanations) set(e *Explanation) bool {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	changed := x.last == nil || x.last.Decision != e.Decision
+	x.last = e
+	return changed
+}
+
+func (x *explanations) get() *Explanation {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	return x.last
+}
@@ -0,0 +1,428 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/falcosecurity/client-go/pkg/api/outputs"
+	"github.com/falcosecurity/client-go/pkg/client"
+)
+
+// The falco source scores the Falco rules that fired recently. Events come
+// from Falco's gRPC outputs API, and from anything posting Falco's JSON
+// output - its http_output, or falcosidekick - to POST /harmony/falco
+// with a ForgeToken granting harmony:falco:ingest.
+// Each event in the window costs its priority's penalty: the score is the
+// product of one minus each penalty, so a single emergency scores 0. With
+// Check set, a CH check also fails while a rule of CheckPriority or worse
+// has fired in the last CheckWindow. While the gRPC stream is down both
+// fail, since quiet is then no evidence of calm.
+
+const (
+	defaultFalcoName      = "runtime_threats"
+	defaultFalcoWeight    = 0.1
+	defaultFalcoWindow    = 10 * time.Minute
+	defaultFalcoPriority  = "critical"
+	falcoCheckName        = "no_critical_falco_event"
+	maxFalcoEvents        = 10000
+	falcoReconnectBackoff = time.Second
+	falcoReconnectMax     = 30 * time.Second
+)
+
+// falcoPriorities are Falco's rule priorities, most severe first
+var falcoPriorities = []string{"emergency", "alert", "critical", "error", "warning", "notice", "informational", "debug"}
+
+// defaultFalcoPenalties cost each priority's events
+var defaultFalcoPenalties = map[string]float64{
+	"emergency": 1,
+	"alert":     0.5,
+	"critical":  0.25,
+	"error":     0.1,
+	"warning":   0.02,
+}
+
+// falcoPriority returns the rank of a priority name, 0 the most severe
+func falcoPriority(name string) (int, bool) {
+	name = strings.ToLower(name)
+	if name == "info" {
+		name = "informational"
+	}
+	for i, p := range falcoPriorities {
+		if p == name {
+			return i, true
+		}
+	}
+	return 0, false
+}
+
+// FalcoConfig configures the falco source. Zero fields take their defaults.
+type FalcoConfig struct {
+	// Name is the provider's, runtime_threats by default, and Weight its
+	// registered weight, 0.1 by default
+	Name   string  `yaml:"name"`
+	Weight float64 `yaml:"weight"`
+
+	// GRPC is Falco's gRPC endpoint, unix:///run/falco/falco.sock or
+	// host:port with the mTLS files below; empty takes events only from
+	// POST /harmony/falco
+	GRPC     string `yaml:"grpc"`
+	CertFile string `yaml:"cert_file"`
+	KeyFile  string `yaml:"key_file"`
+	CAFile   string `yaml:"ca_file"`
+
+	// Window is how far back events are scored, 10m by default
+	Window time.Duration `yaml:"window"`
+
+	// Penalties by priority; priorities not listed cost nothing. None
+	// means emergency 1, alert 0.5, critical 0.25, error 0.1, warning 0.02.
+	Penalties map[string]float64 `yaml:"penalties"`
+
+	// Check adds the no_critical_falco_event CH check, failing while a
+	// rule of CheckPriority (critical) or worse fired in the last
+	// CheckWindow (Window)
+	Check         bool          `yaml:"check"`
+	CheckPriority string        `yaml:"check_priority"`
+	CheckWindow   time.Duration `yaml:"check_window"`
+}
+
+func (c *FalcoConfig) validate() error {
+	if c.Weight < 0 || math.IsNaN(c.Weight) || math.IsInf(c.Weight, 0) {
+		return fmt.Errorf("weight %v must be non-negative", c.Weight)
+	}
+	if c.GRPC != "" && !strings.HasPrefix(c.GRPC, "unix://") {
+		if _, port, err := splitHostPort(c.GRPC); err != nil || port == 0 {
+			return fmt.Errorf("grpc %q must be unix:///path or host:port", c.GRPC)
+		}
+	}
+	if c.Window < 0 || c.CheckWindow < 0 {
+		return fmt.Errorf("window and check_window must be non-negative")
+	}
+	for p, pen := range c.Penalties {
+		if _, ok := falcoPriority(p); !ok {
+			return fmt.Errorf("penalty for unknown priority %s", p)
+		}
+		if !(pen >= 0 && pen <= 1) {
+			return fmt.Errorf("penalty %v for %s must be in [0, 1]", pen, p)
+		}
+	}
+	if c.CheckPriority != "" {
+		if _, ok := falcoPriority(c.CheckPriority); !ok {
+			return fmt.Errorf("unknown check_priority %s", c.CheckPriority)
+		}
+	}
+	return nil
+}
+
+func splitHostPort(addr string) (string, uint16, error) {
+	i := strings.LastIndex(addr, ":")
+	if i < 0 {
+		return "", 0, fmt.Errorf("no port in %s", addr)
+	}
+	port, err := strconv.ParseUint(addr[i+1:], 10, 16)
+	if err != nil {
+		return "", 0, err
+	}
+	return strings.Trim(addr[:i], "[]"), uint16(port), nil
+}
+
+func (c *FalcoConfig) name() string {
+	if c.Name != "" {
+		return c.Name
+	}
+	return defaultFalcoName
+}
+
+// withDefaults returns c with its zero fields defaulted
+func (c FalcoConfig) withDefaults() FalcoConfig {
+	c.Name = c.name()
+	if c.Weight == 0 {
+		c.Weight = defaultFalcoWeight
+		if _, ok := builtinProvider(c.Name); ok {
+			c.Weight = builtinWeight(c.Name)
+		}
+	}
+	if c.Window == 0 {
+		c.Window = defaultFalcoWindow
+	}
+	penalties := c.Penalties
+	if len(penalties) == 0 {
+		penalties = defaultFalcoPenalties
+	}
+	c.Penalties = make(map[string]float64, len(penalties))
+	for p, pen := range penalties {
+		prio, _ := falcoPriority(p)
+		c.Penalties[falcoPriorities[prio]] = pen
+	}
+	if c.CheckPriority == "" {
+		c.CheckPriority = defaultFalcoPriority
+	}
+	if c.CheckWindow == 0 {
+		c.CheckWindow = c.Window
+	}
+	return c
+}
+
+// FalcoEvent is one rule firing, in Falco's JSON output format
+type FalcoEvent struct {
+	Time     time.Time `json:"time"`
+	Priority string    `json:"priority"`
+	Rule     string    `json:"rule"`
+	Output   string    `json:"output"`
+	Hostname string    `json:"hostname"`
+	Source   string    `json:"source"`
+}
+
+// falcoEvents keeps the recent events, from every input, oldest first
+type falcoEvents struct {
+	mu     sync.Mutex
+	events []FalcoEvent
+	keep   time.Duration // events older than this are dropped
+
+	// stream is the gRPC stream's state, while one is expected
+	streaming bool
+	connected bool
+	streamErr error
+}
+
+var harmonyFalco = &falcoEvents{keep: defaultFalcoWindow}
+
+func (f *falcoEvents) add(ev FalcoEvent) {
+	if ev.Time.IsZero() {
+		ev.Time = harmonyClock.Now()
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.events = append(f.events, ev)
+	for i := len(f.events) - 1; i > 0 && f.events[i].Time.Before(f.events[i-1].Time); i-- {
+		f.events[i], f.events[i-1] = f.events[i-1], f.events[i]
+	}
+	f.prune()
+}
+
+// prune drops events past keep, and the oldest past maxFalcoEvents
+func (f *falcoEvents) prune() {
+	cut := 0
+	if len(f.events) > maxFalcoEvents {
+		cut = len(f.events) - maxFalcoEvents
+	}
+	now := harmonyClock.Now()
+	for cut < len(f.events) && now.Sub(f.events[cut].Time) > f.keep {
+		cut++
+	}
+	f.events = f.events[cut:]
+}
+
+// since returns the events no older than d, and the stream's error while
+// it is down
+func (f *falcoEvents) since(d time.Duration) ([]FalcoEvent, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var err error
+	if f.streaming && !f.connected {
+		err = fmt.Errorf("falco stream down: %w", f.streamErr)
+	}
+	now := harmonyClock.Now()
+	i := len(f.events)
+	for i > 0 && now.Sub(f.events[i-1].Time) <= d {
+		i--
+	}
+	return append([]FalcoEvent(nil), f.events[i:]...), err
+}
+
+func (f *falcoEvents) setKeep(d time.Duration) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.keep = d
+}
+
+func (f *falcoEvents) setStream(streaming, connected bool, err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.streaming, f.connected, f.streamErr = streaming, connected, err
+}
+
+// falcoProvider is the falco source's provider
+type falcoProvider struct {
+	src FalcoConfig // as configured, to tell a changed config
+	cfg FalcoConfig // defaulted
+
+	mu      sync.Mutex
+	started bool
+	stop    context.CancelFunc
+	done    chan struct{}
+}
+
+func newFalcoProvider(src *FalcoConfig) *falcoProvider {
+	return &falcoProvider{src: *src, cfg: src.withDefaults()}
+}
+
+func (p *falcoProvider) Name() string    { return p.cfg.Name }
+func (p *falcoProvider) Weight() float64 { return p.cfg.Weight }
+func (p *falcoProvider) source() any     { return p.src }
+
+// Collect scores the events in the window. The first call starts the gRPC
+// stream, so a provider built only to validate a config opens nothing.
+func (p *falcoProvider) Collect(ctx context.Context) (float64, error) {
+	p.start()
+	events, err := harmonyFalco.since(p.cfg.Window)
+	if err != nil {
+		return 0, err
+	}
+	score := 1.0
+	for _, ev := range events {
+		score *= 1 - p.cfg.Penalties[ev.Priority]
+	}
+	return score, nil
+}
+
+func (p *falcoProvider) start() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.started {
+		return
+	}
+	p.started = true
+	harmonyFalco.setKeep(max(p.cfg.Window, p.cfg.CheckWindow))
+	if p.cfg.GRPC == "" {
+		harmonyFalco.setStream(false, false, nil)
+		return
+	}
+	harmonyFalco.setStream(true, false, errNoData)
+	ctx, cancel := context.WithCancel(context.Background())
+	p.stop, p.done = cancel, make(chan struct{})
+	go p.watch(ctx)
+}
+
+// watch streams Falco's outputs until ctx is done, reconnecting with
+// backoff
+func (p *falcoProvider) watch(ctx context.Context) {
+	defer close(p.done)
+	cfg := &client.Config{CertFile: p.cfg.CertFile, KeyFile: p.cfg.KeyFile, CARootFile: p.cfg.CAFile}
+	if strings.HasPrefix(p.cfg.GRPC, "unix://") {
+		cfg.UnixSocketPath = p.cfg.GRPC
+	} else {
+		cfg.Hostname, cfg.Port, _ = splitHostPort(p.cfg.GRPC)
+	}
+	backoff := falcoReconnectBackoff
+	for ctx.Err() == nil {
+		err := p.stream(ctx, cfg, &backoff)
+		if ctx.Err() != nil {
+			return
+		}
+		harmonyFalco.setStream(true, false, err)
+		slog.Warn("falco stream lost, reconnecting", "grpc", p.cfg.GRPC, "in", backoff, "err", err)
+		if sleepCtx(ctx, backoff) != nil {
+			return
+		}
+		backoff = min(2*backoff, falcoReconnectMax)
+	}
+}
+
+func (p *falcoProvider) stream(ctx context.Context, cfg *client.Config, backoff *time.Duration) error {
+	c, err := client.NewForConfig(ctx, cfg)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	harmonyFalco.setStream(true, true, nil)
+	return c.OutputsWatch(ctx, func(res *outputs.Response) error {
+		*backoff = falcoReconnectBackoff
+		harmonyFalco.add(FalcoEvent{
+			Time:     res.GetTime().AsTime(),
+			Priority: strings.ToLower(res.GetPriority().String()),
+			Rule:     res.GetRule(),
+			Output:   res.GetOutput(),
+			Hostname: res.GetHostname(),
+			Source:   res.GetSource(),
+		})
+		return nil
+	}, time.Second)
+}
+
+// Close stops the stream
+func (p *falcoProvider) Close() error {
+	p.mu.Lock()
+	stop, done := p.stop, p.done
+	p.mu.Unlock()
+	if stop != nil {
+		stop()
+		<-done
+	}
+	return nil
+}
+
+// falcoCheck is the no_critical_falco_event check
+type falcoCheck struct {
+	window   time.Duration
+	priority int
+}
+
+func newFalcoCheck(src *FalcoConfig) *falcoCheck {
+	cfg := src.withDefaults()
+	prio, _ := falcoPriority(cfg.CheckPriority)
+	return &falcoCheck{window: cfg.CheckWindow, priority: prio}
+}
+
+func (c *falcoCheck) Name() string   { return falcoCheckName }
+func (c *falcoCheck) Required() bool { return true }
+
+func (c *falcoCheck) Evaluate(context.Context) error {
+	events, err := harmonyFalco.since(c.window)
+	if err != nil {
+		return err
+	}
+	var latest *FalcoEvent
+	n := 0
+	for i := range events {
+		if prio, ok := falcoPriority(events[i].Priority); ok && prio <= c.priority {
+			latest = &events[i]
+			n++
+		}
+	}
+	if latest == nil {
+		return nil
+	}
+	return fmt.Errorf("%d falco events at %s or worse in the last %v, latest %s %q on %s",
+		n, falcoPriorities[c.priority], c.window, latest.Priority, latest.Rule, latest.Hostname)
+}
+
+// serveFalco answers POST /harmony/falco with one or more Falco JSON events
+func serveFalco(w http.ResponseWriter, r *http.Request) {
+	if activeConfig().Sources.Falco == nil {
+		http.Error(w, "no falco source", http.StatusNotFound)
+		return
+	}
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20))
+	n := 0
+	for {
+		var ev FalcoEvent
+		err := dec.Decode(&ev)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			http.Error(w, "bad falco event: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		prio, ok := falcoPriority(ev.Priority)
+		if !ok || ev.Rule == "" {
+			http.Error(w, "falco event needs a rule and a known priority", http.StatusBadRequest)
+			return
+		}
+		ev.Priority = falcoPriorities[prio]
+		harmonyFalco.add(ev)
+		n++
+	}
+	slog.Debug("falco events received", "count", n)
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,657 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kswhitlock9493-jpg/SR-AIbridge-/src/forgeauth"
+)
+
+// The firewall source scores firewall_rules_entropy from this host's
+// ruleset - nftables or iptables - and, optionally, the cloud security
+// groups in front of it. Each rule is one normalized line. The ruleset is
+// diffed against a reviewed baseline: every rule added or removed since,
+// and a reordering, is an unreviewed change, and each DriftHalfAt of them
+// halves the score. The ruleset's entropy, in bits, over the shapes of
+// its rules - each rule with its addresses, numbers and strings elided -
+// measures how little of it follows a pattern; each EntropyHalfAt bits
+// over EntropyBudget halves the score too. A new unreviewed ruleset is
+// logged and raised as a drift alert; GET /harmony/firewall shows the
+// changes and POST /harmony/firewall/review accepts them as the baseline.
+
+// Firewall backends
+const (
+	FirewallAuto     = "auto"
+	FirewallNftables = "nftables"
+	FirewallIptables = "iptables"
+	FirewallNone     = "none" // the security groups alone
+)
+
+const (
+	defaultFirewallDriftHalfAt   = 4
+	defaultFirewallEntropyBudget = 6
+	defaultFirewallEntropyHalfAt = 2
+	defaultFirewallEvery         = time.Minute
+	defaultFirewallTimeout       = 30 * time.Second
+	defaultFirewallMaxAge        = 10 * time.Minute
+)
+
+// FirewallConfig configures the firewall source. Zero fields take their
+// defaults.
+type FirewallConfig struct {
+	// Backend is auto (the default: nftables if nft is installed, else
+	// iptables), nftables, iptables or none
+	Backend string `yaml:"backend"`
+
+	// SecurityGroups is a file of `aws ec2 describe-security-groups` JSON,
+	// and SecurityGroupsCommand a command printing it; either adds the
+	// groups' rules to the ruleset
+	SecurityGroups        string   `yaml:"security_groups"`
+	SecurityGroupsCommand []string `yaml:"security_groups_command"`
+
+	// Baseline is the file the reviewed ruleset is kept in; without one, or
+	// while it doesn't exist, the first ruleset seen is taken as reviewed
+	Baseline string `yaml:"baseline"`
+
+	// DriftHalfAt is how many unreviewed changes halve the score, 4 by
+	// default
+	DriftHalfAt float64 `yaml:"drift_half_at"`
+
+	// EntropyBudget is the entropy, in bits, a ruleset may have and still
+	// score 1, 6 by default; each EntropyHalfAt bits over halves the
+	// score, 2 by default
+	EntropyBudget float64 `yaml:"entropy_budget"`
+	EntropyHalfAt float64 `yaml:"entropy_half_at"`
+
+	// Every paces the check, 1m by default, and Timeout bounds it, 30s by
+	// default; the provider fails once its last good check is MaxAge old,
+	// 10m by default
+	Every   time.Duration `yaml:"every"`
+	Timeout time.Duration `yaml:"timeout"`
+	MaxAge  time.Duration `yaml:"max_age"`
+}
+
+func (c *FirewallConfig) validate() error {
+	switch c.Backend {
+	case "", FirewallAuto, FirewallNftables, FirewallIptables:
+	case FirewallNone:
+		if c.SecurityGroups == "" && len(c.SecurityGroupsCommand) == 0 {
+			return fmt.Errorf("backend none needs security groups")
+		}
+	default:
+		return fmt.Errorf("unknown backend %q", c.Backend)
+	}
+	if c.SecurityGroups != "" && len(c.SecurityGroupsCommand) > 0 {
+		return fmt.Errorf("security_groups and security_groups_command are exclusive")
+	}
+	for _, v := range []float64{c.DriftHalfAt, c.EntropyBudget, c.EntropyHalfAt} {
+		if v < 0 || math.IsNaN(v) || math.IsInf(v, 0) {
+			return fmt.Errorf("drift_half_at, entropy_budget and entropy_half_at must be non-negative")
+		}
+	}
+	if c.Every < 0 || c.Timeout < 0 || c.MaxAge < 0 {
+		return fmt.Errorf("every, timeout and max_age must be non-negative")
+	}
+	return nil
+}
+
+// withDefaults returns c with its zero fields defaulted
+func (c FirewallConfig) withDefaults() FirewallConfig {
+	if c.Backend == "" || c.Backend == FirewallAuto {
+		c.Backend = FirewallIptables
+		if _, err := exec.LookPath("nft"); err == nil {
+			c.Backend = FirewallNftables
+		}
+	}
+	if c.DriftHalfAt == 0 {
+		c.DriftHalfAt = defaultFirewallDriftHalfAt
+	}
+	if c.EntropyBudget == 0 {
+		c.EntropyBudget = defaultFirewallEntropyBudget
+	}
+	if c.EntropyHalfAt == 0 {
+		c.EntropyHalfAt = defaultFirewallEntropyHalfAt
+	}
+	if c.Every == 0 {
+		c.Every = defaultFirewallEvery
+	}
+	if c.Timeout == 0 {
+		c.Timeout = defaultFirewallTimeout
+	}
+	if c.MaxAge == 0 {
+		c.MaxAge = defaultFirewallMaxAge
+	}
+	return c
+}
+
+// nftRules lists the nftables ruleset, one line a rule or chain header,
+// each prefixed with its family, table and chain:
+//
+//	nft inet filter input: tcp dport 22 accept
+//
+// Sets and maps are left out; their elements change with the traffic.
+func nftRules(ctx context.Context) ([]string, error) {
+	out, err := runSourceCommand(ctx, "nft", "-s", "list", "ruleset")
+	if err != nil {
+		return nil, err
+	}
+	return parseNftRules(out), nil
+}
+
+func parseNftRules(out []byte) []string {
+	var rules []string
+	var stack []string // the kinds of the blocks open: table, chain, set...
+	table, chain := "", ""
+	sc := bufio.NewScanner(bytes.NewReader(out))
+	sc.Buffer(nil, 1<<20)
+	for sc.Scan() {
+		line := strings.Join(strings.Fields(sc.Text()), " ")
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		net := strings.Count(line, "{") - strings.Count(line, "}")
+		f := strings.Fields(line)
+		switch {
+		case net > 0:
+			switch {
+			case len(stack) == 0 && f[0] == "table" && len(f) >= 3:
+				table = f[1] + " " + f[2]
+				if f[2] == "{" {
+					table = "ip " + f[1]
+				}
+			case len(stack) == 1 && f[0] == "chain" && len(f) >= 2:
+				chain = f[1]
+			}
+			for range net {
+				stack = append(stack, f[0])
+			}
+		case net < 0:
+			stack = stack[:max(0, len(stack)+net)]
+		case len(stack) == 2 && stack[1] == "chain":
+			rules = append(rules, "nft "+table+" "+chain+": "+strings.TrimSuffix(line, ";"))
+		}
+	}
+	return rules
+}
+
+// iptablesRules lists the iptables and ip6tables rulesets, one line a
+// rule or chain policy, each prefixed with its table and chain:
+//
+//	ip filter INPUT: -p tcp -m tcp --dport 22 -j ACCEPT
+func iptablesRules(ctx context.Context) ([]string, error) {
+	var rules []string
+	for _, family := range []string{"ip", "ip6"} {
+		out, err := runSourceCommand(ctx, family+"tables-save")
+		if err != nil {
+			if family == "ip6" && errors.Is(err, exec.ErrNotFound) {
+				continue
+			}
+			return nil, err
+		}
+		rules = append(rules, parseIptablesRules(family, out)...)
+	}
+	return rules, nil
+}
+
+func parseIptablesRules(family string, out []byte) []string {
+	var rules []string
+	table := ""
+	sc := bufio.NewScanner(bytes.NewReader(out))
+	sc.Buffer(nil, 1<<20)
+	for sc.Scan() {
+		f := strings.Fields(sc.Text())
+		if len(f) == 0 {
+			continue
+		}
+		switch {
+		case strings.HasPrefix(f[0], "*"):
+			table = f[0][1:]
+		case strings.HasPrefix(f[0], ":") && len(f) >= 2:
+			rules = append(rules, family+" "+table+" "+f[0][1:]+": policy "+f[1])
+		case f[0] == "-A" && len(f) >= 2:
+			rules = append(rules, family+" "+table+" "+f[1]+": "+strings.Join(f[2:], " "))
+		}
+	}
+	return rules
+}
+
+// awsSecurityGroups is the part of describe-security-groups read
+type awsSecurityGroups struct {
+	SecurityGroups []struct {
+		GroupID             string          `json:"GroupId"`
+		IPPermissions       []awsPermission `json:"IpPermissions"`
+		IPPermissionsEgress []awsPermission `json:"IpPermissionsEgress"`
+	} `json:"SecurityGroups"`
+}
+
+type awsPermission struct {
+	IPProtocol string `json:"IpProtocol"`
+	FromPort   *int   `json:"FromPort"`
+	ToPort     *int   `json:"ToPort"`
+	IPRanges   []struct {
+		CidrIP string `json:"CidrIp"`
+	} `json:"IpRanges"`
+	IPv6Ranges []struct {
+		CidrIPv6 string `json:"CidrIpv6"`
+	} `json:"Ipv6Ranges"`
+	PrefixListIDs []struct {
+		PrefixListID string `json:"PrefixListId"`
+	} `json:"PrefixListIds"`
+	UserIDGroupPairs []struct {
+		GroupID string `json:"GroupId"`
+	} `json:"UserIdGroupPairs"`
+}
+
+// parseSecurityGroups lists security group rules, one line a permission
+// and peer, sorted - their order doesn't matter:
+//
+//	sg sg-0abc ingress: tcp 22-22 0.0.0.0/0
+func parseSecurityGroups(data []byte) ([]string, error) {
+	var groups awsSecurityGroups
+	if err := json.Unmarshal(data, &groups); err != nil {
+		return nil, fmt.Errorf("security groups: %w", err)
+	}
+	var rules []string
+	for _, g := range groups.SecurityGroups {
+		for dir, perms := range map[string][]awsPermission{"ingress": g.IPPermissions, "egress": g.IPPermissionsEgress} {
+			for _, p := range perms {
+				proto, ports := p.IPProtocol, "all"
+				if proto == "-1" {
+					proto = "all"
+				}
+				if p.FromPort != nil && p.ToPort != nil && proto != "all" {
+					ports = strconv.Itoa(*p.FromPort) + "-" + strconv.Itoa(*p.ToPort)
+				}
+				var peers []string
+				for _, r := range p.IPRanges {
+					peers = append(peers, r.CidrIP)
+				}
+				for _, r := range p.IPv6Ranges {
+					peers = append(peers, r.CidrIPv6)
+				}
+				for _, r := range p.PrefixListIDs {
+					peers = append(peers, r.PrefixListID)
+				}
+				for _, r := range p.UserIDGroupPairs {
+					peers = append(peers, r.GroupID)
+				}
+				for _, peer := range peers {
+					rules = append(rules, "sg "+g.GroupID+" "+dir+": "+proto+" "+ports+" "+peer)
+				}
+			}
+		}
+	}
+	slices.Sort(rules)
+	return rules, nil
+}
+
+var (
+	ruleQuoted = regexp.MustCompile(`"[^"]*"`)
+	ruleIPv6   = regexp.MustCompile(`\b[0-9a-fA-F]{0,4}(:[0-9a-fA-F]{0,4}){2,}(/\d+)?\b`)
+	ruleIPv4   = regexp.MustCompile(`\b\d{1,3}(\.\d{1,3}){3}(/\d+)?\b`)
+	ruleNumber = regexp.MustCompile(`\b\d+([:-]\d+)?\b`)
+)
+
+// ruleShape is rule with its strings, addresses and numbers elided
+func ruleShape(rule string) string {
+	rule = ruleQuoted.ReplaceAllString(rule, `"S"`)
+	rule = ruleIPv6.ReplaceAllString(rule, "A")
+	rule = ruleIPv4.ReplaceAllString(rule, "A")
+	return ruleNumber.ReplaceAllString(rule, "N")
+}
+
+// ruleEntropy is the Shannon entropy, in bits, of the rules' shapes
+func ruleEntropy(rules []string) float64 {
+	counts := map[string]int{}
+	for _, r := range rules {
+		counts[ruleShape(r)]++
+	}
+	h, n := 0.0, float64(len(rules))
+	for _, c := range counts {
+		p := float64(c) / n
+		h -= p * math.Log2(p)
+	}
+	return h
+}
+
+func rulesetHash(rules []string) string {
+	sum := sha256.Sum256([]byte(strings.Join(rules, "\n")))
+	return hex.EncodeToString(sum[:8])
+}
+
+// FirewallBaseline is a reviewed ruleset, as kept in the baseline file
+type FirewallBaseline struct {
+	Hash     string    `json:"hash"`
+	Reviewed time.Time `json:"reviewed"`
+	By       string    `json:"by,omitempty"`
+	Rules    []string  `json:"rules"`
+}
+
+// FirewallDrift is the ruleset's changes since the baseline, the body of
+// GET /harmony/firewall
+type FirewallDrift struct {
+	Hash      string    `json:"hash"` // of the current ruleset
+	Time      time.Time `json:"time"`
+	Rules     int       `json:"rules"`
+	Entropy   float64   `json:"entropy"`
+	Baseline  string    `json:"baseline"`
+	Reviewed  time.Time `json:"reviewed"`
+	By        string    `json:"by,omitempty"`
+	Added     []string  `json:"added,omitempty"`
+	Removed   []string  `json:"removed,omitempty"`
+	Reordered bool      `json:"reordered,omitempty"`
+}
+
+// changes counts the unreviewed changes
+func (d *FirewallDrift) changes() int {
+	n := len(d.Added) + len(d.Removed)
+	if d.Reordered {
+		n++
+	}
+	return n
+}
+
+// diffRules returns the rules added and removed from base to cur, and
+// whether the rules in both are in another order
+func diffRules(base, cur []string) (added, removed []string, reordered bool) {
+	left := map[string]int{}
+	for _, r := range base {
+		left[r]++
+	}
+	var kept []string
+	for _, r := range cur {
+		if left[r] > 0 {
+			left[r]--
+			kept = append(kept, r)
+		} else {
+			added = append(added, r)
+		}
+	}
+	right := map[string]int{}
+	for _, r := range cur {
+		right[r]++
+	}
+	var was []string
+	for _, r := range base {
+		if right[r] > 0 {
+			right[r]--
+			was = append(was, r)
+		} else {
+			removed = append(removed, r)
+		}
+	}
+	return added, removed, !slices.Equal(kept, was)
+}
+
+// firewallState is the last ruleset seen and its baseline, kept across
+// reloads of the source
+type firewallState struct {
+	mu       sync.Mutex
+	path     string // the baseline file, if any
+	loaded   bool
+	baseline *FirewallBaseline
+	rules    []string
+	drift    *FirewallDrift
+	flagged  string // the hash of the last ruleset flagged
+}
+
+var harmonyFirewall = &firewallState{}
+
+// observe records rules and returns their drift from the baseline, and
+// whether the ruleset is newly unreviewed
+func (s *firewallState) observe(path string, rules []string, now time.Time) (FirewallDrift, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.loaded || s.path != path {
+		s.path, s.loaded, s.baseline = path, true, nil
+		if path != "" {
+			s.baseline = loadFirewallBaseline(path)
+		}
+	}
+	hash := rulesetHash(rules)
+	if s.baseline == nil {
+		slog.Info("firewall ruleset taken as the baseline", "rules", len(rules), "hash", hash)
+		s.setBaseline(rules, hash, now, "")
+	}
+	d := FirewallDrift{
+		Hash:     hash,
+		Time:     now,
+		Rules:    len(rules),
+		Entropy:  ruleEntropy(rules),
+		Baseline: s.baseline.Hash,
+		Reviewed: s.baseline.Reviewed,
+		By:       s.baseline.By,
+	}
+	d.Added, d.Removed, d.Reordered = diffRules(s.baseline.Rules, rules)
+	s.rules, s.drift = rules, &d
+	flag := d.changes() > 0 && s.flagged != hash
+	if flag {
+		s.flagged = hash
+	}
+	return d, flag
+}
+
+// review takes the ruleset of hash, which must be the last seen, as the
+// baseline
+func (s *firewallState) review(hash, by string, now time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.drift == nil {
+		return errNoData
+	}
+	if hash != s.drift.Hash {
+		return fmt.Errorf("ruleset %s is not the current one, %s", hash, s.drift.Hash)
+	}
+	s.setBaseline(s.rules, hash, now, by)
+	d := *s.drift
+	d.Baseline, d.Reviewed, d.By = hash, now, by
+	d.Added, d.Removed, d.Reordered = nil, nil, false
+	s.drift = &d
+	return nil
+}
+
+func (s *firewallState) setBaseline(rules []string, hash string, now time.Time, by string) {
+	s.baseline = &FirewallBaseline{Hash: hash, Reviewed: now, By: by, Rules: rules}
+	if s.path == "" {
+		return
+	}
+	data, err := json.MarshalIndent(s.baseline, "", "  ")
+	if err == nil {
+		err = os.MkdirAll(filepath.Dir(s.path), 0o700)
+	}
+	if err == nil {
+		err = os.WriteFile(s.path+".tmp", data, 0o600)
+	}
+	if err == nil {
+		err = os.Rename(s.path+".tmp", s.path)
+	}
+	if err != nil {
+		slog.Warn("firewall baseline not saved", "path", s.path, "err", err)
+	}
+}
+
+func (s *firewallState) last() *FirewallDrift {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.drift
+}
+
+// loadFirewallBaseline reads the baseline at path, nil if there is none.
+// An unreadable baseline is kept, not overwritten, and counts every rule
+// as unreviewed.
+func loadFirewallBaseline(path string) *FirewallBaseline {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	var b FirewallBaseline
+	if err == nil {
+		err = json.Unmarshal(data, &b)
+	}
+	if err != nil {
+		slog.Warn("firewall baseline not loaded", "path", path, "err", err)
+		return &FirewallBaseline{Hash: "unreadable"}
+	}
+	return &b
+}
+
+// firewallProvider is the firewall source's firewall_rules_entropy
+// provider
+type firewallProvider struct {
+	refreshedScore
+	src FirewallConfig // as configured, to tell a changed config
+	cfg FirewallConfig // defaulted
+}
+
+func newFirewallProvider(src *FirewallConfig) *firewallProvider {
+	cfg := src.withDefaults()
+	p := &firewallProvider{src: *src, cfg: cfg}
+	p.refreshedScore = refreshedScore{
+		name:    "firewall_rules_entropy",
+		weight:  builtinWeight("firewall_rules_entropy"),
+		every:   cfg.Every,
+		timeout: cfg.Timeout,
+		maxAge:  cfg.MaxAge,
+		refresh: p.refresh,
+	}
+	return p
+}
+
+func (p *firewallProvider) source() any { return p.src }
+
+func (p *firewallProvider) rules(ctx context.Context) ([]string, error) {
+	var rules []string
+	var err error
+	switch p.cfg.Backend {
+	case FirewallNftables:
+		rules, err = nftRules(ctx)
+	case FirewallIptables:
+		rules, err = iptablesRules(ctx)
+	}
+	if err != nil {
+		return nil, err
+	}
+	var groups []byte
+	switch {
+	case p.cfg.SecurityGroups != "":
+		groups, err = os.ReadFile(p.cfg.SecurityGroups)
+	case len(p.cfg.SecurityGroupsCommand) > 0:
+		groups, err = runSourceCommand(ctx, p.cfg.SecurityGroupsCommand[0], p.cfg.SecurityGroupsCommand[1:]...)
+	default:
+		return rules, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("security groups: %w", err)
+	}
+	sg, err := parseSecurityGroups(groups)
+	if err != nil {
+		return nil, err
+	}
+	return append(rules, sg...), nil
+}
+
+func (p *firewallProvider) refresh(ctx context.Context) (float64, error) {
+	rules, err := p.rules(ctx)
+	if err != nil {
+		return 0, err
+	}
+	if len(rules) == 0 {
+		return 0, fmt.Errorf("no firewall rules found with %s", p.cfg.Backend)
+	}
+	d, flag := harmonyFirewall.observe(p.cfg.Baseline, rules, harmonyClock.Now())
+	score := math.Pow(0.5, float64(d.changes())/p.cfg.DriftHalfAt)
+	if over := d.Entropy - p.cfg.EntropyBudget; over > 0 {
+		score *= math.Pow(0.5, over/p.cfg.EntropyHalfAt)
+	}
+	if flag {
+		slog.Warn("unreviewed firewall change", "hash", d.Hash, "baseline", d.Baseline,
+			"added", len(d.Added), "removed", len(d.Removed), "reordered", d.Reordered)
+		harmonyAlerts.raise(ctx, Alert{
+			Kind:     AlertDrift,
+			Subject:  "firewall_rules_entropy",
+			Severity: "warning",
+			Summary: fmt.Sprintf("firewall ruleset %s has %d unreviewed changes since %s",
+				d.Hash, d.changes(), d.Reviewed.Format(time.DateTime)),
+			Details: append(prefixed("+ ", d.Added), prefixed("- ", d.Removed)...),
+			Time:    d.Time,
+		})
+	}
+	slog.Debug("firewall rules refreshed", "rules", d.Rules, "entropy", d.Entropy,
+		"unreviewed", d.changes(), "score", score)
+	return score, nil
+}
+
+func prefixed(prefix string, lines []string) []string {
+	out := make([]string, len(lines))
+	for i, l := range lines {
+		out[i] = prefix + l
+	}
+	return out
+}
+
+// serveFirewall answers GET /harmony/firewall with the ruleset's drift
+func serveFirewall(w http.ResponseWriter, r *http.Request) {
+	if activeConfig().Sources.Firewall == nil {
+		http.Error(w, "no firewall source", http.StatusNotFound)
+		return
+	}
+	d := harmonyFirewall.last()
+	if d == nil {
+		http.Error(w, "no ruleset seen yet", http.StatusServiceUnavailable)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(d)
+}
+
+// serveFirewallReview answers POST /harmony/firewall/review, taking the
+// ruleset of the hash posted as reviewed by the token's holder. The score
+// follows at the next refresh.
+func serveFirewallReview(w http.ResponseWriter, r *http.Request) {
+	if activeConfig().Sources.Firewall == nil {
+		http.Error(w, "no firewall source", http.StatusNotFound)
+		return
+	}
+	t, ok := forgeauth.TokenFromContext(r.Context())
+	if !ok {
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return
+	}
+	var req struct {
+		Hash string `json:"hash"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<16)).Decode(&req); err != nil || req.Hash == "" {
+		http.Error(w, "review needs the hash of the ruleset reviewed", http.StatusBadRequest)
+		return
+	}
+	by := forgePrincipal(t)
+	err := harmonyFirewall.review(req.Hash, by, harmonyClock.Now())
+	switch {
+	case errors.Is(err, errNoData):
+		http.Error(w, "no ruleset seen yet", http.StatusServiceUnavailable)
+		return
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	slog.Info("firewall ruleset reviewed", "hash", req.Hash, "by", by)
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestFirewallReviewTakesTheTokensNode(t *testing.T) {
+	cfg := DefaultHarmonyConfig()
+	cfg.Sources.Firewall = &FirewallConfig{Backend: "iptables"}
+	old, oldState := harmonyConfig.Swap(cfg), harmonyFirewall
+	t.Cleanup(func() { harmonyConfig.Store(old); harmonyFirewall = oldState })
+	harmonyFirewall = &firewallState{}
+	now := time.Now()
+	harmonyFirewall.observe("", []string{"ip filter INPUT: policy DROP"}, now)
+	d, _ := harmonyFirewall.observe("", []string{"ip filter INPUT: policy DROP", "ip filter INPUT: -j ACCEPT"}, now)
+
+	f := newTestForge(t, HarmonyAPIScope, nil)
+	h := newHarmonyAPI(f.verifier)
+	body := fmt.Sprintf(`{"hash": %q, "by": "mallory"}`, d.Hash)
+	if rec := serveWithToken(h, http.MethodPost, "/harmony/firewall/review", f.token(t, "reader", HarmonyAPIScope), body); rec.Code != http.StatusForbidden {
+		t.Fatalf("with the read scope: status %d, want 403", rec.Code)
+	}
+	rec := serveWithToken(h, http.MethodPost, "/harmony/firewall/review", f.token(t, "sentinel", HarmonyFirewallReviewScope), body)
+	if rec.Code != http.StatusNoContent {
+		t.Fatalf("status %d, want 204: %s", rec.Code, rec.Body)
+	}
+	if got := harmonyFirewall.last(); got.By != "sentinel" || got.changes() != 0 {
+		t.Errorf("reviewed by %q with %d changes left, want sentinel and none", got.By, got.changes())
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"slices"
+)
+
+// floorBreach is a score below its configured floor
+type floorBreach struct {
+	name  string
+	score float64
+	floor float64
+	halts bool
+}
+
+// checkFloors compares each score to its floor, independently of mu. Every
+// breach is logged and counted; those listed in halt_on_floor are returned
+// as failed checks named "floor:<provider>", which halt like a CH failure.
+func checkFloors(ctx context.Context, c *CyberSecContext, cfg *HarmonyConfig) (breaches []floorBreach, failed []string) {
+	if len(cfg.Floors) == 0 {
+		return nil, nil
+	}
+	for i, name := range c.Names {
+		floor, ok := cfg.Floors[name]
+		if !ok || c.Scores[i] >= floor {
+			continue
+		}
+		b := floorBreach{name: name, score: c.Scores[i], floor: floor, halts: slices.Contains(cfg.HaltOnFloor, name)}
+		breaches = append(breaches, b)
+		harmonyMetrics.observeFloorBreach(name)
+		slog.WarnContext(ctx, "score below floor", "provider", name, "score", b.score, "floor", floor, "halts", b.halts)
+		if b.halts {
+			failed = append(failed, "floor:"+name)
+		}
+	}
+	return breaches, failed
+}
+
+// validateFloors checks floors name registered providers and lie in [0, 1]
+func (c *HarmonyConfig) validateFloors(r *ProviderRegistry) error {
+	registered := map[string]bool{}
+	for _, p := range r.Providers() {
+		registered[p.Name()] = true
+	}
+	for name, floor := range c.Floors {
+		if !registered[name] {
+			return fmt.Errorf("floor for unknown score provider %s", name)
+		}
+		if !(floor >= 0 && floor <= 1) {
+			return fmt.Errorf("floor %v for %s must be in [0, 1]", floor, name)
+		}
+	}
+	for _, name := range c.HaltOnFloor {
+		if _, ok := c.Floors[name]; !ok {
+			return fmt.Errorf("halt_on_floor names %s, which has no floor", name)
+		}
+	}
+	return nil
+}
+
+func breachNames(breaches []floorBreach) []string {
+	names := make([]string, len(breaches))
+	for i, b := range breaches {
+		names[i] = b.name
+	}
+	return names
+}
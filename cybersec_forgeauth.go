@@ -0,0 +1,160 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kswhitlock9493-jpg/SR-AIbridge-/src/forgeauth"
+)
+
+// The harmony engine is a separate program from the forge dominion, so it
+// verifies ForgeTokens the way a read-only node does: with a forgeauth
+// Validator, from a validator bundle the dominion exports and signs with a
+// key pinned here.
+
+const forgeTokenHeader = forgeauth.ForgeTokenHeader
+
+// forgeVerifier authenticates API requests with ForgeTokens. The bundle
+// file is re-read when it changes, so revocations pushed to it apply
+// without a restart.
+type forgeVerifier struct {
+	path      string
+	scope     string // what the read routes and the stream need
+	validator *forgeauth.Validator
+
+	mu      sync.Mutex
+	modTime time.Time
+}
+
+// newForgeVerifier loads the validator bundle at path, which must be signed
+// by trusted, a base64url Ed25519 public key. Read routes need tokens
+// granting scope. rolesPath, if set, is the forge dominion's roles file,
+// binding the roles tokens carry to scopes.
+func newForgeVerifier(path string, trusted string, scope string, rolesPath string) (*forgeVerifier, error) {
+	pub, err := base64.URLEncoding.DecodeString(trusted)
+	if err != nil || len(pub) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("trusted bundle key must be a base64url Ed25519 public key")
+	}
+	if err := forgeauth.ValidateScope(scope); err != nil || strings.TrimSpace(scope) == "" {
+		return nil, fmt.Errorf("api scope %q: must be a non-empty scope", scope)
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil, fmt.Errorf("stat validator bundle: %w", err)
+	}
+	bundle, err := forgeauth.ReadValidatorBundle(path)
+	if err != nil {
+		return nil, err
+	}
+	validator, err := forgeauth.NewValidator(bundle, pub)
+	if err != nil {
+		return nil, err
+	}
+	if rolesPath != "" {
+		roles, err := forgeauth.LoadRoles(rolesPath)
+		if err != nil {
+			return nil, err
+		}
+		if err := validator.SetRoles(roles); err != nil {
+			return nil, fmt.Errorf("roles %s: %w", rolesPath, err)
+		}
+	}
+	return &forgeVerifier{path: path, scope: scope, validator: validator, modTime: fi.ModTime()}, nil
+}
+
+// refresh reloads the bundle if its file changed
+func (v *forgeVerifier) refresh() error {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	fi, err := os.Stat(v.path)
+	if err != nil {
+		return fmt.Errorf("stat validator bundle: %w", err)
+	}
+	if fi.ModTime().Equal(v.modTime) {
+		return nil
+	}
+	bundle, err := forgeauth.ReadValidatorBundle(v.path)
+	if err != nil {
+		return err
+	}
+	if err := v.validator.Update(bundle); err != nil {
+		return err
+	}
+	v.modTime = fi.ModTime()
+	return nil
+}
+
+// authenticate checks the ForgeToken carried by r, and that it grants scope
+func (v *forgeVerifier) authenticate(r *http.Request, scope string) (*forgeauth.ForgeToken, error) {
+	t, err := forgeauth.TokenFromRequest(r)
+	if err != nil {
+		return nil, err
+	}
+	return v.check(t, r.RemoteAddr, scope)
+}
+
+// verify checks an encoded ForgeToken presented from remoteAddr, and that
+// it grants scope
+func (v *forgeVerifier) verify(encoded string, remoteAddr string, scope string) (*forgeauth.ForgeToken, error) {
+	t, err := forgeauth.DecodeToken(encoded)
+	if err != nil {
+		return nil, err
+	}
+	return v.check(t, remoteAddr, scope)
+}
+
+// check validates t as presented from remoteAddr. The errors wrap the
+// forgeauth failure classes, for forgeauth.HTTPStatus and GRPCCode.
+// Without a usage counter or session store the validator refuses
+// use-limited and idle tokens; key-bound tokens are refused here, as this
+// engine doesn't check proofs of possession.
+func (v *forgeVerifier) check(t *forgeauth.ForgeToken, remoteAddr string, scope string) (*forgeauth.ForgeToken, error) {
+	if err := v.refresh(); err != nil {
+		slog.Error("validator bundle refresh failed, using the loaded bundle", "err", err)
+	}
+	if err := v.validator.ValidateFrom(t, remoteAddr); err != nil {
+		return nil, err
+	}
+	if t.KeyBinding != "" {
+		return nil, fmt.Errorf("%w: key-bound tokens can't be checked here", forgeauth.ErrPolicyDenied)
+	}
+	if !v.validator.Allows(t, scope) {
+		return nil, fmt.Errorf("%w: token scope %q and roles %v don't grant %q", forgeauth.ErrScopeDenied, t.Scope, t.Roles, scope)
+	}
+	return t, nil
+}
+
+// forgePrincipal names who holds t: its node, within its tenant if any
+func forgePrincipal(t *forgeauth.ForgeToken) string {
+	if t.TenantID != "" {
+		return t.TenantID + "/" + t.NodeID
+	}
+	return t.NodeID
+}
+
+// requireForgeToken wraps next with ForgeToken authentication: 401 without
+// a valid token, 403 for a token not granting scope or from the wrong
+// network. next finds the token with forgeauth.TokenFromContext.
+func (v *forgeVerifier) requireForgeToken(scope string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t, err := v.authenticate(r, scope)
+		if err != nil {
+			status := forgeauth.HTTPStatus(err)
+			if status == http.StatusUnauthorized {
+				w.Header().Set("WWW-Authenticate", "Forge")
+			}
+			slog.WarnContext(r.Context(), "harmony api request rejected", "remote", r.RemoteAddr, "path", r.URL.Path, "err", err)
+			http.Error(w, http.StatusText(status), status)
+			return
+		}
+		slog.DebugContext(r.Context(), "harmony api request", "node", t.NodeID, "tenant", t.TenantID, "path", r.URL.Path)
+		next.ServeHTTP(w, r.WithContext(forgeauth.ContextWithToken(r.Context(), t)))
+	})
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kswhitlock9493-jpg/SR-AIbridge-/src/forgeauth"
+)
+
+// testForge is a dominion for issuing test tokens
+type testForge struct {
+	dominion *forgeauth.ForgeDominion
+	verifier *forgeVerifier
+}
+
+// newTestForge writes the validator bundle of a fresh dominion and returns
+// a verifier for it, requiring scope on read routes. roles, if set, is the
+// engine's roles file; the dominion itself binds operator and auditor.
+func newTestForge(t *testing.T, scope string, roles map[string][]string) *testForge {
+	t.Helper()
+	root := make([]byte, 32)
+	if _, err := rand.Read(root); err != nil {
+		t.Fatal(err)
+	}
+	fd := forgeauth.NewForgeDominionWithKeys(forgeauth.StaticKeyProvider{"": root})
+	if err := fd.SetSigningAlg(forgeauth.AlgEd25519); err != nil {
+		t.Fatal(err)
+	}
+	if err := fd.SetRoles(map[string][]string{"operator": {"harmony:*"}, "auditor": {"harmony:read"}}); err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	b, err := fd.ExportValidatorBundle(ctx, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	bundle := filepath.Join(dir, "bundle.json")
+	if err := forgeauth.WriteValidatorBundle(b, bundle); err != nil {
+		t.Fatal(err)
+	}
+	pub, err := fd.PublicKey(ctx, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rolesPath := ""
+	if roles != nil {
+		data, err := json.Marshal(map[string]any{"roles": roles})
+		if err != nil {
+			t.Fatal(err)
+		}
+		rolesPath = filepath.Join(dir, "roles.json")
+		if err := os.WriteFile(rolesPath, data, 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	v, err := newForgeVerifier(bundle, base64.URLEncoding.EncodeToString(pub), scope, rolesPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testForge{dominion: fd, verifier: v}
+}
+
+// token issues an encoded token for node with scope and roles
+func (f *testForge) token(t *testing.T, node, scope string, roles ...string) string {
+	t.Helper()
+	tokens, err := f.dominion.RequestTokens([]forgeauth.TokenSpec{{NodeID: node, Scope: scope, Roles: roles, TTL: time.Hour}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	encoded, err := forgeauth.EncodeToken(tokens[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return encoded
+}
+
+// serveWithToken sends a request to h with token
+func serveWithToken(h http.Handler, method, path, token, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	req.RemoteAddr = "192.0.2.1:1234"
+	if token != "" {
+		req.Header.Set(forgeTokenHeader, token)
+	}
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestRequireForgeToken(t *testing.T) {
+	f := newTestForge(t, HarmonyAPIScope, map[string][]string{"operator": {"harmony:*"}})
+	var seen string
+	h := f.verifier.requireForgeToken("harmony:redteam:write", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tok, ok := forgeauth.TokenFromContext(r.Context())
+		if !ok {
+			t.Error("no token on the request context")
+			return
+		}
+		seen = tok.NodeID
+	}))
+	tests := []struct {
+		name   string
+		token  string
+		status int
+	}{
+		{"no token", "", http.StatusUnauthorized},
+		{"garbage", "not-a-token", http.StatusUnauthorized},
+		{"read only", f.token(t, "reader", "harmony:read"), http.StatusForbidden},
+		{"exact scope", f.token(t, "writer", "harmony:redteam:write"), http.StatusOK},
+		{"wildcard scope", f.token(t, "admin", "harmony:*"), http.StatusOK},
+		{"by role", f.token(t, "operator", "", "operator"), http.StatusOK},
+		{"unbound role", f.token(t, "stranger", "", "auditor"), http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			seen = ""
+			if rec := serveWithToken(h, http.MethodPost, "/", tt.token, ""); rec.Code != tt.status {
+				t.Fatalf("status %d, want %d", rec.Code, tt.status)
+			}
+			if tt.status == http.StatusOK && seen == "" {
+				t.Error("handler didn't see the token's node")
+			}
+		})
+	}
+
+	other := newTestForge(t, HarmonyAPIScope, nil)
+	if rec := serveWithToken(h, http.MethodPost, "/", other.token(t, "forger", "harmony:*"), ""); rec.Code != http.StatusUnauthorized {
+		t.Errorf("token from another dominion: status %d, want 401", rec.Code)
+	}
+}
+
+func TestHarmonyAPIRouteScopes(t *testing.T) {
+	f := newTestForge(t, HarmonyAPIScope, nil)
+	h := newHarmonyAPI(f.verifier)
+	reader := f.token(t, "reader", HarmonyAPIScope)
+	tests := []struct {
+		method, path string
+		scope        string
+	}{
+		{http.MethodPost, "/harmony/falco", HarmonyFalcoScope},
+		{http.MethodPost, "/harmony/redteam/exercises", HarmonyRedTeamScope},
+		{http.MethodDelete, "/harmony/redteam/exercises/x", HarmonyRedTeamScope},
+		{http.MethodPost, "/harmony/firewall/review", HarmonyFirewallReviewScope},
+	}
+	for _, tt := range tests {
+		t.Run(tt.method+" "+tt.path, func(t *testing.T) {
+			if rec := serveWithToken(h, tt.method, tt.path, reader, ""); rec.Code != http.StatusForbidden {
+				t.Errorf("with the read scope: status %d, want 403", rec.Code)
+			}
+			if rec := serveWithToken(h, tt.method, tt.path, f.token(t, "writer", tt.scope), ""); rec.Code == http.StatusForbidden || rec.Code == http.StatusUnauthorized {
+				t.Errorf("with %s: status %d", tt.scope, rec.Code)
+			}
+		})
+	}
+}
@@ -2,69 +2,451 @@ package main
 
 import (
 	"context"
-	"log"
+	"flag"
+	"fmt"
+	"log/slog"
 	"math"
+	"os"
+	"os/signal"
+	"slices"
+	"strings"
+	"syscall"
 	"time"
 
-	"github.com/cilium/ebpf/rlimit"
-	"github.com/cilium/ebpf/link"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
+// Defaults, overridable from the config file (see HarmonyConfig)
 const harmonyThreshold = 0.9995
 const minScore = 1e-12
 
 type CyberSecContext struct {
+	Names   []string
 	Scores  []float64
 	Weights []float64
+
+	// Aggregate combines the scores; nil uses the configured aggregator
+	Aggregate Aggregator
+
+	// Degraded lists the providers scored by a stale policy this cycle, as
+	// provider:policy; skipped providers are absent from Names
+	Degraded []string
 }
 
 func (ctx *CyberSecContext) calculateMu() float64 {
-	logSum := 0.0
+	return ctx.calculateMuWith(activeConfig())
+}
+
+// calculateMuWith is calculateMu under cfg
+func (ctx *CyberSecContext) calculateMuWith(cfg *HarmonyConfig) float64 {
+	scores := make([]float64, len(ctx.Weights))
+	weightSum := 0.0
 	for i, w := range ctx.Weights {
-		s := math.Max(math.Min(ctx.Scores[i], 1.0), minScore)
-		logSum += w * math.Log(s)
+		scores[i] = math.Max(math.Min(ctx.Scores[i], 1.0), cfg.MinScore)
+		weightSum += w
+	}
+	// With no weighted inputs there is no evidence of harmony
+	if weightSum == 0 {
+		return 0
 	}
-	return math.Exp(logSum)
+	agg := ctx.Aggregate
+	if agg == nil {
+		var err error
+		if agg, err = cfg.aggregator(); err != nil {
+			agg = GeometricMean
+		}
+	}
+	return agg(scores, ctx.Weights)
 }
 
-func checkCH() bool {
-	return noActiveAPTBeacon() &&
-		ransomwareCanaryAlive() &&
-		backupImmutabilityVerified() &&
-		incidentResponseSLAGreen() &&
-		boardLevelCyberRiskSignOff()
+// checkCH runs every registered sub-check, without short-circuiting, so
+// each one's state is exported and traced. CH holds if every required one
+// passed.
+func checkCH(ctx context.Context) CheckResults {
+	ctx, span := harmonyTracer.Start(ctx, "harmony.ch")
+	defer span.End()
+	checks := harmonyCH.Checks()
+	results := make(CheckResults, 0, len(checks))
+	for _, c := range checks {
+		cctx, cspan := harmonyTracer.Start(ctx, "harmony.check",
+			trace.WithAttributes(attribute.String("harmony.check", c.Name())))
+		res := runCheck(cctx, c)
+		cspan.SetAttributes(attribute.Bool("harmony.passed", res.Passed), attribute.Bool("harmony.required", res.Required))
+		if !res.Passed {
+			cspan.SetAttributes(attribute.String("harmony.reason", res.Reason))
+		}
+		cspan.End()
+		harmonyMetrics.observeCheck(res)
+		results = append(results, res)
+	}
+	span.SetAttributes(attribute.Bool("harmony.passed", results.Passed()))
+	return results
 }
 
-func evaluateCyberSecHarmony(mu float64, ch bool) string {
-	if mu >= harmonyThreshold && ch {
-		return "CHANGE_GO"
-	}
-	triggerAutoheal()
-	logHarmonyFault(mu, ch)
-	return "CHANGE_HALT"
+// evaluateCyberSecHarmony grades the cycle under cfg and runs the actions
+// configured for its decision
+func evaluateCyberSecHarmony(ctx context.Context, cfg *HarmonyConfig, mu float64, ch bool) string {
+	prev := harmonyGate.last
+	decision := harmonyGate.decide(mu, ch, cfg)
+	harmonyGate.last = decision
+	cfg.runActions(ctx, ActionEvent{
+		Decision: decision,
+		Previous: prev,
+		Mu:       mu,
+		CH:       ch,
+		Cycle:    cycleID(ctx),
+	})
+	harmonyMetrics.observeDecision(decision)
+	return decision
 }
 
 func main() {
-	ctx := &CyberSecContext{
-		Scores:  []float64{0.98, 0.97, 1.0, 0.96, 0.99},
-		Weights: []float64{0.30, 0.25, 0.20, 0.15, 0.10},
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "tune":
+			runTune(os.Args[2:])
+			return
+		case "replay":
+			runReplay(os.Args[2:])
+			return
+		}
+	}
+	configPath := flag.String("config", os.Getenv("HARMONY_CONFIG"), "harmony config file (YAML)")
+	metricsAddr := flag.String("metrics-addr", os.Getenv("HARMONY_METRICS_ADDR"), "serve Prometheus metrics at /metrics, and the /healthz and /readyz probes, on this address")
+	apiAddr := flag.String("api-addr", os.Getenv("HARMONY_API_ADDR"), "serve the ForgeToken-authenticated /harmony/ status API on this address")
+	apiScope := flag.String("api-scope", envOr("HARMONY_API_SCOPE", HarmonyAPIScope), "ForgeToken scope the status API's read routes and the decision stream require")
+	streamAddr := flag.String("stream-addr", os.Getenv("HARMONY_STREAM_ADDR"), "serve the ForgeToken-authenticated gRPC decision stream on this address")
+	forgeBundle := flag.String("forge-bundle", os.Getenv("HARMONY_FORGE_BUNDLE"), "forge validator bundle used to verify API tokens")
+	forgeBundleKey := flag.String("forge-bundle-key", os.Getenv("HARMONY_FORGE_BUNDLE_KEY"), "base64url Ed25519 key the validator bundle must be signed with")
+	forgeRoles := flag.String("forge-roles", os.Getenv("HARMONY_FORGE_ROLES"), "forge roles file binding the roles API tokens carry to scopes")
+	ebpfObject := flag.String("ebpf-object", os.Getenv("HARMONY_EBPF_OBJECT"), "attach the compiled cybersec_ebpf.c probe and feed it each cycle's scores")
+	recordCycles := flag.String("record-cycles", os.Getenv("HARMONY_RECORD_CYCLES"), "append every cycle to this file as JSON lines, for harmony tune")
+	raftDir := flag.String("raft-dir", os.Getenv("HARMONY_RAFT_DIR"), "replicate harmony state over Raft, keeping this node's Raft state in this directory")
+	raftAddr := flag.String("raft-addr", envOr("HARMONY_RAFT_ADDR", "127.0.0.1:7946"), "address Raft listens on and the other nodes reach this one at")
+	raftID := flag.String("raft-id", os.Getenv("HARMONY_RAFT_ID"), "this node's Raft and leader election ID; empty means the hostname")
+	raftPeers := flag.String("raft-peers", os.Getenv("HARMONY_RAFT_PEERS"), "bootstrap a new Raft group of these nodes, as id=host:port,... including this one")
+	election := flag.String("election", envOr("HARMONY_ELECTION", ElectNone), "elect the engine that runs enforcement actions: none, raft, redis or k8s-lease")
+	electionName := flag.String("election-name", envOr("HARMONY_ELECTION_NAME", "harmony-enforcer"), "the redis lock key or k8s lease name engines elect through")
+	electionTTL := flag.Duration("election-ttl", defaultElectionTTL, "how long an election lock outlives an engine that stops renewing it")
+	electionRedis := flag.String("election-redis", os.Getenv("HARMONY_ELECTION_REDIS"), "redis URL for -election redis")
+	faultJournal := flag.String("fault-journal", os.Getenv("HARMONY_FAULT_JOURNAL"), "append faults to this durable, checksummed journal")
+	otlpEndpoint := flag.String("otlp-endpoint", os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT"), "export traces over OTLP/gRPC to this URL")
+	logFormat := flag.String("log-format", envOr("HARMONY_LOG_FORMAT", "text"), "log record format: text or json")
+	logLevel := flag.String("log-level", envOr("HARMONY_LOG_LEVEL", "info"), "minimum log level: debug, info, warn or error")
+	flag.Parse()
+
+	logger, err := newHarmonyLogger(os.Stderr, *logFormat, *logLevel)
+	if err != nil {
+		fatal("invalid logging flags", err)
+	}
+	slog.SetDefault(logger)
+	cfg, err := LoadHarmonyConfig(*configPath)
+	if err != nil {
+		fatal("load harmony config", err)
+	}
+	if err := cfg.Apply(harmonyProviders); err != nil {
+		fatal("apply harmony config", err)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	onShutdown("actions", harmonyActions.Release)
+	onShutdown("alerts", harmonyAlerts.flush)
+	onShutdown("quorum publisher", func(context.Context) error { return harmonyPublisher.Close() })
+
+	if *faultJournal != "" {
+		harmonyJournal, err = OpenFaultJournal(*faultJournal)
+		if err != nil {
+			fatal("open fault journal", err)
+		}
+		onShutdown("fault journal", func(context.Context) error { return harmonyJournal.Close() })
+	}
+
+	if *recordCycles != "" {
+		harmonyRecorder, err = openCycleRecorder(*recordCycles)
+		if err != nil {
+			fatal("open cycle recording", err)
+		}
+		onShutdown("cycle recording", func(context.Context) error { return harmonyRecorder.Close() })
+	}
+
+	if *raftDir != "" {
+		id := *raftID
+		if id == "" {
+			if id, err = os.Hostname(); err != nil {
+				fatal("raft id", err)
+			}
+		}
+		harmonyRaft, err = openRaft(*raftDir, id, *raftAddr, *raftPeers)
+		if err != nil {
+			fatal("join raft group", err)
+		}
+		onShutdown("raft", func(context.Context) error { return harmonyRaft.Close() })
+	}
+
+	harmonyElector, err = newElector(*election, ElectionOptions{
+		Identity: *raftID,
+		Name:     *electionName,
+		TTL:      *electionTTL,
+		RedisURL: *electionRedis,
+	})
+	if err != nil {
+		fatal("start leader election", err)
+	}
+	if harmonyElector != nil {
+		onShutdown("leader election", func(context.Context) error { return harmonyElector.Close() })
+	}
+
+	if *ebpfObject != "" {
+		harmonyProbe, err = loadEBPFProbe(*ebpfObject)
+		if err != nil {
+			fatal("load ebpf probe", err)
+		}
+		onShutdown("ebpf probe", func(context.Context) error { return harmonyProbe.Close() })
+	}
+
+	if *metricsAddr != "" {
+		stopMetrics, err := serveMetrics(*metricsAddr)
+		if err != nil {
+			fatal("serve metrics", err)
+		}
+		onShutdown("metrics server", stopMetrics)
+	}
+
+	if *apiAddr != "" || *streamAddr != "" {
+		if *forgeBundle == "" || *forgeBundleKey == "" {
+			fatal("serve harmony api", fmt.Errorf("-api-addr and -stream-addr need -forge-bundle and -forge-bundle-key"))
+		}
+		verifier, err := newForgeVerifier(*forgeBundle, *forgeBundleKey, *apiScope, *forgeRoles)
+		if err != nil {
+			fatal("load forge validator bundle", err)
+		}
+		if *apiAddr != "" {
+			stopAPI, err := serveHarmonyAPI(*apiAddr, verifier)
+			if err != nil {
+				fatal("serve harmony api", err)
+			}
+			onShutdown("harmony api", stopAPI)
+		}
+		if *streamAddr != "" {
+			stopStream, err := serveHarmonyStream(*streamAddr, verifier)
+			if err != nil {
+				fatal("serve harmony stream", err)
+			}
+			onShutdown("harmony stream", stopStream)
+		}
+	}
+
+	if *otlpEndpoint != "" {
+		stopTracing, err := setupTracing(context.Background(), *otlpEndpoint)
+		if err != nil {
+			fatal("set up tracing", err)
+		}
+		onShutdown("tracing", stopTracing)
+	}
+
+	var reloads <-chan *HarmonyConfig
+	if *configPath != "" {
+		w, err := WatchHarmonyConfig(*configPath, harmonyProviders)
+		if err != nil {
+			fatal("watch harmony config", err)
+		}
+		onShutdown("config watcher", func(context.Context) error { return w.Close() })
+		reloads = w.Updates()
+	}
+
+	tick, jitter := harmonySampler.interval(cfg), cfg.Jitter
+	ticker := harmonyClock.NewTicker(tick, jitter)
+	defer func() { ticker.Stop() }()
+	// retick rebuilds the ticker when c, or the sampler, changed the pace
+	retick := func(c *HarmonyConfig) {
+		if next := harmonySampler.interval(c); next != tick || c.Jitter != jitter {
+			ticker.Stop()
+			tick, jitter = next, c.Jitter
+			ticker = harmonyClock.NewTicker(tick, jitter)
+		}
+	}
+	harmonyHealth.start(harmonyClock.Now())
+
+	for {
+		select {
+		case <-ctx.Done():
+			slog.Info("shutting down", "cause", context.Cause(ctx))
+			shutdown()
+			return
+		case next, ok := <-reloads:
+			if !ok {
+				// The watcher stopped; carry on with the config we have
+				reloads = nil
+				continue
+			}
+			retick(next)
+			cfg = next
+			if harmonyRaft != nil {
+				harmonyRaft.replicateConfig(next)
+			}
+		case <-ticker.C():
+			// A follower may have been handed a new interval over Raft
+			retick(activeConfig())
+			runCycle(tick)
+			retick(activeConfig())
+		}
+	}
+}
+
+// runCycle collects, decides and acts once, traced as one span and logged
+// as one record. A cycle that takes longer than budget is marked as an
+// overrun.
+func runCycle(budget time.Duration) {
+	start := harmonyClock.Now()
+	if harmonyRaft != nil && !harmonyRaft.lead() {
+		harmonyHealth.tick(start)
+		return
+	}
+	cycle, id := withCycle(context.Background())
+	cycle, span := harmonyTracer.Start(cycle, "harmony.cycle",
+		trace.WithAttributes(attribute.Int64("harmony.cycle", int64(id))))
+	defer span.End()
+	observeLeadership(cycle)
+	// The whole cycle runs under one config, even if a reload lands
+	cfg := activeConfig()
+
+	ctx := harmonyProviders.Collect(cycle, cfg)
+	mu := ctx.calculateMuWith(cfg)
+	harmonyMetrics.observeTick(ctx, mu)
+	checks := checkCH(cycle)
+	failed := checks.Failed()
+	breaches, floorFailed := checkFloors(cycle, ctx, cfg)
+	anomalies, anomalyFailed := harmonyAnomalies.check(cycle, ctx, &cfg.Anomaly)
+	failed = append(append(failed, floorFailed...), anomalyFailed...)
+	var decision string
+	var contexts []contextResult
+	if len(cfg.Contexts) > 0 {
+		decision, contexts = evaluateContexts(cycle, cfg, ctx, len(failed) == 0)
+	} else {
+		decision = evaluateCyberSecHarmony(cycle, cfg, mu, len(failed) == 0)
 	}
-	ticker := time.NewTicker(100 * time.Millisecond) // 10 Hz
-	defer ticker.Stop()
+	harmonySampler.observe(cfg, mu, decision)
+	explained := explain(cfg, id, ctx, mu, decision, failed)
+	changed := harmonyExplanation.set(explained)
 
-	for range ticker.C {
-		ctx.Scores = []float64{
-			querySOCAlertCoherence(),
-			queryPatchLatencyScore(),
-			queryZeroDayExposureIndex(),
-			queryFirewallRulesEntropy(),
-			queryRedTeamDwellTime(),
+	rec := newCycleRecord(id, start, ctx, mu, failed, breachNames(breaches), decision)
+	rec.Checks = checks
+	rec.Anomalies = anomalyNames(anomalies)
+	rec.Degraded = ctx.Degraded
+	rec.Contexts = contextRecords(contexts)
+	if harmonyRaft != nil {
+		harmonyRaft.replicateCycle(rec)
+	} else {
+		harmonyHistory.Add(rec)
+	}
+	recordCycle(rec)
+	harmonyStream.publish(rec)
+	observeQuorum(cycle, cfg, rec)
+	if harmonyProbe != nil {
+		if err := harmonyProbe.publish(ctx); err != nil {
+			slog.WarnContext(cycle, "ebpf probe update failed", "err", err)
 		}
-		mu := ctx.calculateMu()
-		ch := checkCH()
-		decision := evaluateCyberSecHarmony(mu, ch)
-		if decision == "CHANGE_HALT" {
-			holdPrivilegedAccess()
+	}
+	var reasons []string
+	if decision == DecisionHalt {
+		reasons = faultReasons(cfg, mu, failed, breaches, anomalies, ctx.Degraded, contexts)
+	}
+	journalFault(rec, reasons, cfg)
+	var attributed []string
+	if changed && decision != DecisionGo {
+		if a := attributeRecent(cfg, rec, cfg.AttributionWindow); a != nil {
+			attributed = a.lines()
 		}
 	}
+	harmonyAlerts.observeCycle(cycle, rec, breaches, reasons, slices.Concat(attributed, explained.lines()))
+
+	end := harmonyClock.Now()
+	harmonyHealth.tick(end)
+	elapsed := end.Sub(start)
+	span.SetAttributes(
+		attribute.Float64("harmony.mu", mu),
+		attribute.String("harmony.decision", decision),
+		attribute.Bool("harmony.overrun", elapsed > budget),
+		attribute.StringSlice("harmony.degraded", ctx.Degraded),
+	)
+
+	attrs := []any{scoreAttrs(ctx), "mu", mu, "decision", decision, "elapsed", elapsed}
+	if len(ctx.Degraded) > 0 {
+		attrs = append(attrs, "degraded", ctx.Degraded)
+	}
+	// Advisory failures are logged with the rest
+	if a := checkAttrs(checks); len(a.Value.Group()) > 0 {
+		attrs = append(attrs, a)
+	}
+	if changed {
+		slog.InfoContext(cycle, "harmony decision explained", "decision", decision, "mu", mu,
+			"attribution", attributed, "explanation", explained.lines())
+	}
+	if decision == DecisionHalt {
+		attrs = append(attrs, "reasons", reasons)
+		slog.WarnContext(cycle, "harmony fault", attrs...)
+	} else {
+		if n := harmonyGate.pending(); n > 0 {
+			attrs = append(attrs, "pending_halt", n)
+		}
+		slog.DebugContext(cycle, "harmony cycle", attrs...)
+	}
+	if elapsed > budget {
+		slog.WarnContext(cycle, "harmony cycle overran its budget", "elapsed", elapsed, "budget", budget)
+	}
+}
+
+// faultReasons explains a CHANGE_HALT. With named contexts, the halting
+// contexts stand in for mu.
+func faultReasons(cfg *HarmonyConfig, mu float64, failed []string, breaches []floorBreach, anomalies []anomaly, degraded []string, contexts []contextResult) []string {
+	var reasons, latched []string
+	for _, c := range contexts {
+		switch {
+		case c.decision != DecisionHalt:
+		case c.mu < c.threshold:
+			reasons = append(reasons, fmt.Sprintf("context %s mu %.6f below threshold %v", c.name, c.mu, c.threshold))
+		default:
+			latched = append(latched, fmt.Sprintf("context %s halted until mu reaches %v", c.name, c.resume))
+		}
+	}
+	if len(contexts) == 0 && mu < cfg.Threshold {
+		reasons = append(reasons, fmt.Sprintf("mu %.6f below threshold %v", mu, cfg.Threshold))
+	}
+	for _, name := range failed {
+		// Floor and anomaly failures are explained below
+		if !strings.Contains(name, ":") {
+			reasons = append(reasons, "check failed: "+name)
+		}
+	}
+	for _, b := range breaches {
+		if b.halts {
+			reasons = append(reasons, fmt.Sprintf("%s score %.6f below floor %v", b.name, b.score, b.floor))
+		}
+	}
+	for _, a := range anomalies {
+		if a.halts {
+			reasons = append(reasons, fmt.Sprintf("%s score %.6f anomalous: %s (z=%.2f)", a.name, a.score, a.kind, a.z))
+		}
+	}
+	for _, d := range degraded {
+		name, policy, _ := strings.Cut(d, ":")
+		reasons = append(reasons, fmt.Sprintf("%s query failed, scored %s", name, policy))
+	}
+	if len(reasons) == 0 {
+		if len(contexts) > 0 {
+			return latched
+		}
+		reasons = append(reasons, fmt.Sprintf("halted until mu reaches %v", cfg.resumeThreshold()))
+	}
+	return reasons
+}
+
+// envOr returns the environment variable key, or def if it is unset
+func envOr(key string, def string) string {
+	if v, ok := os.LookupEnv(key); ok {
+		return v
+	}
+	return def
 }
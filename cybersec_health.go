@@ -0,0 +1,105 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// healthStallIntervals is how many intervals the loop may go without
+// finishing a cycle before it counts as wedged
+const healthStallIntervals = 3
+
+// harmonyHealth is the probe state behind /healthz and /readyz, served on
+// the metrics address
+var harmonyHealth = &healthState{}
+
+// healthState remembers when the loop last finished a cycle
+type healthState struct {
+	mu      sync.Mutex
+	started time.Time
+	ticked  time.Time
+}
+
+// start marks the loop as started, so a loop that never ticks is caught
+func (h *healthState) start(now time.Time) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.started = now
+}
+
+// tick records a finished cycle
+func (h *healthState) tick(now time.Time) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.ticked = now
+}
+
+// live lists what says the engine needs a restart: the loop has stopped
+// ticking on schedule, or the eBPF probe is unhealthy
+func (h *healthState) live(now time.Time, cfg *HarmonyConfig) []string {
+	var problems []string
+	h.mu.Lock()
+	last, what := h.ticked, "ticked"
+	if last.IsZero() {
+		last, what = h.started, "started"
+	}
+	h.mu.Unlock()
+	if stall := healthStallIntervals * harmonySampler.interval(cfg); !last.IsZero() && now.Sub(last) > stall {
+		problems = append(problems, fmt.Sprintf("loop last %s %v ago, over %v", what, now.Sub(last).Round(time.Millisecond), stall))
+	}
+	if harmonyProbe != nil {
+		if err := harmonyProbe.healthy(); err != nil {
+			problems = append(problems, err.Error())
+		}
+	}
+	return problems
+}
+
+// ready lists what says the engine shouldn't be relied on yet: it isn't
+// live, or a provider hasn't reported a good score lately. A provider may
+// go the longer of its max_age and healthStallIntervals intervals between
+// good scores. A Raft follower polls no providers, so only its liveness
+// counts.
+func (h *healthState) ready(now time.Time, cfg *HarmonyConfig, r *ProviderRegistry) []string {
+	problems := h.live(now, cfg)
+	if harmonyRaft != nil && harmonyRaft.standingBy() {
+		return problems
+	}
+	for _, p := range r.Providers() {
+		fresh := max(cfg.providerPolicy(p.Name()).MaxAge, healthStallIntervals*harmonySampler.interval(cfg))
+		at := r.lastGood(p.Name())
+		switch {
+		case at.IsZero():
+			problems = append(problems, fmt.Sprintf("provider %s has not reported", p.Name()))
+		case now.Sub(at) > fresh:
+			problems = append(problems, fmt.Sprintf("provider %s last reported %v ago", p.Name(), now.Sub(at).Round(time.Millisecond)))
+		}
+	}
+	return problems
+}
+
+// healthReport is the body of /healthz and /readyz
+type healthReport struct {
+	Status   string   `json:"status"`
+	Problems []string `json:"problems,omitempty"`
+}
+
+func serveHealthz(w http.ResponseWriter, r *http.Request) {
+	writeHealth(w, harmonyHealth.live(harmonyClock.Now(), activeConfig()))
+}
+
+func serveReadyz(w http.ResponseWriter, r *http.Request) {
+	writeHealth(w, harmonyHealth.ready(harmonyClock.Now(), activeConfig(), harmonyProviders))
+}
+
+func writeHealth(w http.ResponseWriter, problems []string) {
+	rep := healthReport{Status: "ok", Problems: problems}
+	if len(problems) > 0 {
+		rep.Status = "unavailable"
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	writeJSON(w, rep)
+}
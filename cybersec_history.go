@@ -0,0 +1,172 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// defaultHistoryDepth keeps a minute of cycles at 10 Hz
+const defaultHistoryDepth = 600
+
+// CycleRecord is what one cycle saw and decided
+type CycleRecord struct {
+	Cycle     uint64                   `json:"cycle"`
+	Time      time.Time                `json:"time"`
+	Scores    map[string]float64       `json:"scores"`
+	Mu        float64                  `json:"mu"`
+	CH        bool                     `json:"ch"`
+	Checks    CheckResults             `json:"checks,omitempty"`
+	Failed    []string                 `json:"failed_checks,omitempty"`
+	Floors    []string                 `json:"floor_breaches,omitempty"`
+	Anomalies []string                 `json:"anomalies,omitempty"`          // provider:kind
+	Degraded  []string                 `json:"degraded_providers,omitempty"` // provider:stale policy
+	Contexts  map[string]ContextRecord `json:"contexts,omitempty"`
+	Decision  string                   `json:"decision"`
+}
+
+// History is a ring buffer of the most recent cycles
+type History struct {
+	mu      sync.RWMutex
+	records []CycleRecord
+	next    int // slot the next record goes in
+	full    bool
+}
+
+var harmonyHistory = NewHistory(defaultHistoryDepth)
+
+func NewHistory(depth int) *History {
+	return &History{records: make([]CycleRecord, depth)}
+}
+
+// Add records a cycle, dropping the oldest once the buffer is full
+func (h *History) Add(rec CycleRecord) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.records[h.next] = rec
+	h.next = (h.next + 1) % len(h.records)
+	if h.next == 0 {
+		h.full = true
+	}
+}
+
+// Replace drops every cycle and records recs, oldest first, keeping the
+// most recent that fit
+func (h *History) Replace(recs []CycleRecord) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	clear(h.records)
+	h.next, h.full = 0, false
+	if n := len(h.records); len(recs) > n {
+		recs = recs[len(recs)-n:]
+	}
+	for _, rec := range recs {
+		h.records[h.next] = rec
+		h.next = (h.next + 1) % len(h.records)
+		if h.next == 0 {
+			h.full = true
+		}
+	}
+}
+
+// Last returns up to n of the most recent cycles, oldest first. n <= 0
+// returns them all.
+func (h *History) Last(n int) []CycleRecord {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return h.last(n)
+}
+
+func (h *History) last(n int) []CycleRecord {
+	size := h.next
+	if h.full {
+		size = len(h.records)
+	}
+	if n <= 0 || n > size {
+		n = size
+	}
+	out := make([]CycleRecord, n)
+	start := h.next - n
+	if start < 0 {
+		start += len(h.records)
+	}
+	for i := range out {
+		out[i] = h.records[(start+i)%len(h.records)]
+	}
+	return out
+}
+
+// Depth returns how many cycles the buffer holds
+func (h *History) Depth() int {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return len(h.records)
+}
+
+// Resize changes the depth, keeping the most recent cycles that fit
+func (h *History) Resize(depth int) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if depth == len(h.records) {
+		return
+	}
+	kept := h.last(depth)
+	h.records = make([]CycleRecord, depth)
+	copy(h.records, kept)
+	h.next = len(kept) % depth
+	h.full = len(kept) == depth
+}
+
+// ServeHTTP serves the history as JSON, oldest first, for
+// /harmony/history. ?last=N limits it to the N most recent cycles,
+// ?decision= to one decision.
+func (h *History) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	n := 0
+	if s := r.URL.Query().Get("last"); s != "" {
+		var err error
+		if n, err = strconv.Atoi(s); err != nil || n < 1 {
+			http.Error(w, "last must be a positive integer", http.StatusBadRequest)
+			return
+		}
+	}
+	cycles := h.Last(n)
+	if decision := r.URL.Query().Get("decision"); decision != "" {
+		filtered := cycles[:0]
+		for _, c := range cycles {
+			if c.Decision == decision {
+				filtered = append(filtered, c)
+			}
+		}
+		cycles = filtered
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Depth  int           `json:"depth"`
+		Cycles []CycleRecord `json:"cycles"`
+	}{h.Depth(), cycles})
+}
+
+// newCycleRecord builds the record of a cycle from its inputs and outcome
+func newCycleRecord(id uint64, at time.Time, ctx *CyberSecContext, mu float64, failed []string, breaches []string, decision string) CycleRecord {
+	scores := make(map[string]float64, len(ctx.Names))
+	for i, name := range ctx.Names {
+		scores[name] = ctx.Scores[i]
+	}
+	return CycleRecord{
+		Cycle:    id,
+		Time:     at,
+		Scores:   scores,
+		Mu:       mu,
+		CH:       len(failed) == 0,
+		Failed:   failed,
+		Floors:   breaches,
+		Decision: decision,
+	}
+}
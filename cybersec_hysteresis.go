@@ -0,0 +1,49 @@
+package main
+
+// haltGate debounces and latches CHANGE_HALT. It halts only after
+// HaltAfter consecutive halting cycles, then stays halted until a cycle
+// clears the resume threshold with CH holding, so noise around the
+// threshold doesn't flap privileged access. It is only touched by the
+// loop, and survives config reloads.
+type haltGate struct {
+	halted bool
+	bad    int    // consecutive halting cycles while not halted
+	last   string // the last decision
+}
+
+var harmonyGate = haltGate{last: DecisionGo}
+
+// decide returns this cycle's decision
+func (g *haltGate) decide(mu float64, ch bool, cfg *HarmonyConfig) string {
+	if g.halted {
+		if !ch || mu < cfg.resumeThreshold() {
+			return DecisionHalt
+		}
+		g.halted = false
+		g.bad = 0
+	}
+	d := cfg.level(mu, ch)
+	if d != DecisionHalt {
+		g.bad = 0
+		return d
+	}
+	g.bad++
+	if g.bad < cfg.HaltAfter {
+		return cfg.pendingLevel()
+	}
+	g.halted = true
+	return DecisionHalt
+}
+
+// pending returns the halting cycles seen toward a halt
+func (g *haltGate) pending() int {
+	return g.bad
+}
+
+// resumeThreshold is the mu that ends a halt, Threshold unless set higher
+func (c *HarmonyConfig) resumeThreshold() float64 {
+	if c.ResumeThreshold == 0 {
+		return c.Threshold
+	}
+	return c.ResumeThreshold
+}
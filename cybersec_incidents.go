@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"time"
+)
+
+const (
+	defaultAlertResolveAfter = 30 * time.Second
+
+	// incidentsKept is how many resolved incidents /harmony/incidents lists
+	incidentsKept = 50
+)
+
+// AlertIncident groups the consecutive alerts of one cause, by alert key.
+// Its first alert is sent; the rest only count, unless one is more
+// severe. It resolves once harmony has been at CHANGE_GO, and the cause
+// quiet, for the alerts' resolve_after.
+type AlertIncident struct {
+	ID        string    `json:"id"`
+	Kind      string    `json:"kind"`
+	Context   string    `json:"context,omitempty"`
+	Subject   string    `json:"subject"`
+	Severity  string    `json:"severity"` // the most severe alert's
+	Summary   string    `json:"summary"`  // the last alert's
+	FirstSeen time.Time `json:"first_seen"`
+	LastSeen  time.Time `json:"last_seen"`
+	Count     int       `json:"count"`
+	Resolved  time.Time `json:"resolved,omitzero"`
+}
+
+var severityRank = map[string]int{"info": 0, "warning": 1, "error": 2, "critical": 3}
+
+// group files a under its incident, opening one if need be, and reports
+// whether a opened it or is more severe than those before. d.mu is held.
+func (d *alertDispatcher) group(a *Alert, now time.Time) (opened, escalated bool) {
+	key := a.key()
+	inc, ok := d.incidents[key]
+	if !ok {
+		d.seq++
+		inc = &AlertIncident{
+			ID:        strconv.FormatUint(d.seq, 10),
+			Kind:      a.Kind,
+			Context:   a.Context,
+			Subject:   a.Subject,
+			Severity:  a.Severity,
+			FirstSeen: now,
+		}
+		d.incidents[key] = inc
+	}
+	inc.Summary, inc.LastSeen = a.Summary, now
+	inc.Count++
+	escalated = severityRank[a.Severity] > severityRank[inc.Severity]
+	if escalated {
+		inc.Severity = a.Severity
+	}
+	a.Incident, a.FirstSeen, a.Count = inc.ID, inc.FirstSeen, inc.Count
+	return !ok, escalated
+}
+
+// resolveQuiet resolves the incidents whose cause has been quiet for
+// resolve_after while harmony has been at CHANGE_GO as long, and raises
+// a resolution for each. The fleet's decisions resolve with its own
+// recovery instead.
+func (d *alertDispatcher) resolveQuiet(ctx context.Context, now time.Time) {
+	d.mu.Lock()
+	after := d.cfg.ResolveAfter
+	if d.last != DecisionGo || d.calm.IsZero() || now.Sub(d.calm) < after {
+		d.mu.Unlock()
+		return
+	}
+	var resolved []*AlertIncident
+	for key, inc := range d.incidents {
+		if inc.Kind == AlertDecision && inc.Context != "" {
+			continue
+		}
+		if now.Sub(inc.LastSeen) >= after {
+			inc.Resolved = now
+			resolved = append(resolved, inc)
+			delete(d.incidents, key)
+		}
+	}
+	d.keep(resolved)
+	d.mu.Unlock()
+
+	for _, inc := range resolved {
+		a := Alert{
+			Kind:      inc.Kind,
+			Context:   inc.Context,
+			Subject:   inc.Subject,
+			Severity:  "info",
+			Resolved:  true,
+			Summary:   fmt.Sprintf("resolved after %v: %s", now.Sub(inc.FirstSeen).Round(time.Second), inc.Summary),
+			Incident:  inc.ID,
+			FirstSeen: inc.FirstSeen,
+			Count:     inc.Count,
+			Cycle:     cycleID(ctx),
+			Time:      now,
+		}
+		if inc.Kind == AlertDecision {
+			// A recovery re-arms the decision alerts, so the next halt pages
+			// even within the dedup window
+			a.Subject, a.Previous = DecisionGo, inc.Subject
+			d.forget(AlertDecision)
+		}
+		d.raise(ctx, a)
+	}
+}
+
+// close resolves the open decision incidents of a recovery raised as
+// such, filing a under the one it recovers from. d.mu is held.
+func (d *alertDispatcher) close(a *Alert, now time.Time) {
+	var resolved []*AlertIncident
+	for key, inc := range d.incidents {
+		if inc.Kind != a.Kind || inc.Context != a.Context {
+			continue
+		}
+		if inc.Subject == a.Previous {
+			a.Incident, a.FirstSeen, a.Count = inc.ID, inc.FirstSeen, inc.Count
+		}
+		inc.Resolved = now
+		resolved = append(resolved, inc)
+		delete(d.incidents, key)
+	}
+	d.keep(resolved)
+}
+
+// keep records resolved incidents, up to incidentsKept. d.mu is held.
+func (d *alertDispatcher) keep(resolved []*AlertIncident) {
+	d.resolved = append(d.resolved, resolved...)
+	if n := len(d.resolved) - incidentsKept; n > 0 {
+		d.resolved = slices.Delete(d.resolved, 0, n)
+	}
+}
+
+// incidentList is the body of /harmony/incidents
+type incidentList struct {
+	Open     []AlertIncident `json:"open"`
+	Resolved []AlertIncident `json:"resolved"` // the latest, newest first
+}
+
+func (d *alertDispatcher) listIncidents() incidentList {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	l := incidentList{Open: []AlertIncident{}, Resolved: []AlertIncident{}}
+	for _, inc := range d.incidents {
+		l.Open = append(l.Open, *inc)
+	}
+	slices.SortFunc(l.Open, func(a, b AlertIncident) int { return a.FirstSeen.Compare(b.FirstSeen) })
+	for i := len(d.resolved) - 1; i >= 0; i-- {
+		l.Resolved = append(l.Resolved, *d.resolved[i])
+	}
+	return l
+}
+
+// serveIncidents answers GET /harmony/incidents
+func serveIncidents(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, harmonyAlerts.listIncidents())
+}
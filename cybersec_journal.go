@@ -0,0 +1,307 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+)
+
+// The fault journal is an append-only file of one entry per line:
+//
+//	<sha256 hex> <json>
+//
+// where the hash covers the previous entry's hash and this entry's JSON,
+// so an edited, dropped or reordered entry breaks the chain from there on.
+// Every append is synced before it returns. The chain carries on across
+// rotated files, which are named <path>.<time>.
+
+const (
+	defaultJournalMaxBytes = 64 << 20
+	defaultJournalKeep     = 10
+	journalRotatedFormat   = "20060102T150405.000000000"
+)
+
+// JournalConfig rotates the fault journal
+type JournalConfig struct {
+	// MaxBytes rotates the journal before it grows past this size
+	MaxBytes int64 `yaml:"max_bytes"`
+
+	// Keep is how many rotated journals are kept
+	Keep int `yaml:"keep"`
+}
+
+func defaultJournalConfig() JournalConfig {
+	return JournalConfig{MaxBytes: defaultJournalMaxBytes, Keep: defaultJournalKeep}
+}
+
+func (j *JournalConfig) validate() error {
+	if j.MaxBytes < 4096 {
+		return fmt.Errorf("journal max_bytes %d must be at least 4096", j.MaxBytes)
+	}
+	if j.Keep < 0 {
+		return fmt.Errorf("journal keep %d must be non-negative", j.Keep)
+	}
+	return nil
+}
+
+// FaultEntry is one journaled fault
+type FaultEntry struct {
+	Seq uint64 `json:"seq"`
+	CycleRecord
+	Reasons []string `json:"reasons,omitempty"`
+}
+
+// FaultJournal appends faults to path
+type FaultJournal struct {
+	mu   sync.Mutex
+	path string
+	f    *os.File
+	size int64
+	seq  uint64
+	prev string // hash of the last entry
+
+	broken int    // entries that failed verification on open
+	marked uint64 // the cycle log_fault last ran in
+}
+
+// harmonyJournal is nil unless -fault-journal is set
+var harmonyJournal *FaultJournal
+
+// OpenFaultJournal opens path for appending, creating it if need be. The
+// existing entries are verified; a broken chain is logged, and the journal
+// carries on from the last entry written.
+func OpenFaultJournal(path string) (*FaultJournal, error) {
+	j := &FaultJournal{path: path}
+	if err := j.recover(); err != nil {
+		return nil, err
+	}
+	if err := j.open(); err != nil {
+		return nil, err
+	}
+	return j, nil
+}
+
+// recover reads the chain state back from the newest rotated journal, then
+// the journal itself
+func (j *FaultJournal) recover() error {
+	paths := j.rotated()
+	if len(paths) > 0 {
+		paths = paths[len(paths)-1:]
+	}
+	for _, path := range append(paths, j.path) {
+		data, err := os.ReadFile(path)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("read fault journal: %w", err)
+		}
+		if len(data) > 0 {
+			var broken int
+			j.seq, j.prev, broken = verifyJournal(path, data, j.seq, j.prev)
+			j.broken += broken
+		}
+	}
+	return nil
+}
+
+// verifyJournal checks the chain in data from the entry seq with hash
+// prev, logging each broken entry, and returns the last entry's sequence
+// number and hash, and how many entries were broken
+func verifyJournal(path string, data []byte, seq uint64, prev string) (uint64, string, int) {
+	broken := 0
+	sc := bufio.NewScanner(bytes.NewReader(data))
+	sc.Buffer(nil, 1<<20)
+	first := true
+	for n := 1; sc.Scan(); n++ {
+		sum, body, ok := bytes.Cut(sc.Bytes(), []byte(" "))
+		var e FaultEntry
+		if !ok || json.Unmarshal(body, &e) != nil {
+			slog.Error("fault journal entry is unreadable", "path", path, "line", n)
+			broken++
+			continue
+		}
+		// The first entry of a file chains to the file before it, which may
+		// have been rotated away
+		known := !first || e.Seq == 1 || (seq > 0 && e.Seq == seq+1)
+		if known && chainHash(prev, body) != string(sum) {
+			slog.Error("fault journal chain is broken", "path", path, "line", n, "seq", e.Seq)
+			broken++
+		}
+		first = false
+		seq, prev = e.Seq, string(sum)
+	}
+	if len(data) > 0 && data[len(data)-1] != '\n' {
+		slog.Warn("fault journal ends in a torn entry", "path", path)
+	}
+	return seq, prev, broken
+}
+
+func chainHash(prev string, body []byte) string {
+	h := sha256.New()
+	io.WriteString(h, prev)
+	h.Write(body)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func (j *FaultJournal) open() error {
+	f, err := os.OpenFile(j.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return fmt.Errorf("open fault journal: %w", err)
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("open fault journal: %w", err)
+	}
+	j.f, j.size = f, fi.Size()
+	if j.size > 0 {
+		// Terminate a torn entry left by a crash, so the next one starts on
+		// its own line
+		last := make([]byte, 1)
+		if r, err := os.Open(j.path); err == nil {
+			r.ReadAt(last, j.size-1)
+			r.Close()
+		}
+		if last[0] != '\n' {
+			if err := j.write([]byte("\n")); err != nil {
+				return err
+			}
+		}
+	}
+	syncDir(filepath.Dir(j.path))
+	return nil
+}
+
+func (j *FaultJournal) write(line []byte) error {
+	n, err := j.f.Write(line)
+	j.size += int64(n)
+	if err != nil {
+		return fmt.Errorf("write fault journal: %w", err)
+	}
+	if err := j.f.Sync(); err != nil {
+		return fmt.Errorf("sync fault journal: %w", err)
+	}
+	return nil
+}
+
+// Append journals a fault, rotating first if it would take the journal
+// past cfg.MaxBytes
+func (j *FaultJournal) Append(rec CycleRecord, reasons []string, cfg *JournalConfig) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	body, err := json.Marshal(FaultEntry{Seq: j.seq + 1, CycleRecord: rec, Reasons: reasons})
+	if err != nil {
+		return fmt.Errorf("encode fault: %w", err)
+	}
+	sum := chainHash(j.prev, body)
+	line := fmt.Appendf(nil, "%s %s\n", sum, body)
+
+	if j.size > 0 && j.size+int64(len(line)) > cfg.MaxBytes {
+		if err := j.rotate(cfg.Keep); err != nil {
+			return err
+		}
+	}
+	if err := j.write(line); err != nil {
+		return err
+	}
+	j.seq, j.prev = j.seq+1, sum
+	return nil
+}
+
+// rotate moves the journal aside and starts a new one, keeping the newest
+// keep rotated journals
+func (j *FaultJournal) rotate(keep int) error {
+	if err := j.f.Close(); err != nil {
+		return fmt.Errorf("close fault journal: %w", err)
+	}
+	rotated := j.path + "." + harmonyClock.Now().UTC().Format(journalRotatedFormat)
+	if err := os.Rename(j.path, rotated); err != nil {
+		return fmt.Errorf("rotate fault journal: %w", err)
+	}
+	if err := j.open(); err != nil {
+		return err
+	}
+	old := j.rotated()
+	for len(old) > keep {
+		if err := os.Remove(old[0]); err != nil {
+			slog.Warn("remove rotated fault journal", "path", old[0], "err", err)
+		}
+		old = old[1:]
+	}
+	return nil
+}
+
+// rotated lists the rotated journals, oldest first
+func (j *FaultJournal) rotated() []string {
+	matches, _ := filepath.Glob(j.path + ".*")
+	slices.Sort(matches)
+	return matches
+}
+
+// Close closes the journal
+func (j *FaultJournal) Close() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.f.Close()
+}
+
+// syncDir makes a new or renamed file's directory entry durable
+func syncDir(dir string) {
+	if d, err := os.Open(dir); err == nil {
+		d.Sync()
+		d.Close()
+	}
+}
+
+// mark records that log_fault ran in cycle
+func (j *FaultJournal) mark(cycle uint64) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.marked = cycle
+}
+
+// takeMark reports whether log_fault ran in cycle, clearing the mark
+func (j *FaultJournal) takeMark(cycle uint64) bool {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	ok := j.marked == cycle
+	if ok {
+		j.marked = 0
+	}
+	return ok
+}
+
+// logHarmonyFault is the log_fault action. The cycle's record isn't
+// complete while actions run, so it marks the cycle for journalFault to
+// journal once it is.
+func logHarmonyFault(_ context.Context, ev ActionEvent) error {
+	if harmonyJournal != nil && ev.Cycle != 0 {
+		harmonyJournal.mark(ev.Cycle)
+	}
+	return nil
+}
+
+// journalFault journals a cycle that ran log_fault, in the composite
+// decision or any named context's. A journal that can't be written is
+// logged and counted but doesn't stop the loop.
+func journalFault(rec CycleRecord, reasons []string, cfg *HarmonyConfig) {
+	if harmonyJournal == nil || !harmonyJournal.takeMark(rec.Cycle) {
+		return
+	}
+	if err := harmonyJournal.Append(rec, reasons, &cfg.Journal); err != nil {
+		harmonyMetrics.observeJournalError()
+		slog.Error("fault journal append failed", "cycle", rec.Cycle, "err", err)
+	}
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+var testJournalConfig = JournalConfig{MaxBytes: 4096, Keep: 2}
+
+// openTestJournal opens path, closing it when the test ends
+func openTestJournal(t *testing.T, path string) *FaultJournal {
+	t.Helper()
+	j, err := OpenFaultJournal(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { j.Close() })
+	return j
+}
+
+func appendFaults(t *testing.T, j *FaultJournal, n int) {
+	t.Helper()
+	for range n {
+		rec := CycleRecord{Cycle: j.seq + 1, Mu: 0.5, Decision: DecisionHalt}
+		if err := j.Append(rec, []string{"mu 0.500000 below threshold 0.9"}, &testJournalConfig); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestFaultJournalChain(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "faults.log")
+	j := openTestJournal(t, path)
+	appendFaults(t, j, 3)
+	j.Close()
+
+	j = openTestJournal(t, path)
+	if j.broken != 0 || j.seq != 3 {
+		t.Fatalf("reopened at seq %d with %d broken, want 3 and 0", j.seq, j.broken)
+	}
+	j.Close()
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := bytes.SplitAfter(data, []byte("\n"))
+	edited := slices.Concat(lines[0], bytes.Replace(lines[1], []byte(`"mu":0.5`), []byte(`"mu":0.9`), 1), lines[2])
+	if bytes.Equal(edited, data) {
+		t.Fatal("entry 2 not found to edit")
+	}
+	if seq, _, broken := verifyJournal(path, edited, 0, ""); broken != 1 || seq != 3 {
+		t.Errorf("edited entry: seq %d with %d broken, want 3 and 1", seq, broken)
+	}
+	dropped := slices.Concat(lines[0], lines[2])
+	if _, _, broken := verifyJournal(path, dropped, 0, ""); broken != 1 {
+		t.Errorf("dropped entry: %d broken, want 1", broken)
+	}
+	reordered := slices.Concat(lines[0], lines[2], lines[1])
+	if _, _, broken := verifyJournal(path, reordered, 0, ""); broken == 0 {
+		t.Error("reordered entries verified")
+	}
+}
+
+func TestFaultJournalTornTail(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "faults.log")
+	j := openTestJournal(t, path)
+	appendFaults(t, j, 2)
+	j.Close()
+
+	// A crash part way through writing entry 2
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first := bytes.IndexByte(data, '\n') + 1
+	if err := os.Truncate(path, int64(first+20)); err != nil {
+		t.Fatal(err)
+	}
+
+	j = openTestJournal(t, path)
+	if j.seq != 1 {
+		t.Fatalf("recovered at seq %d, want the last whole entry, 1", j.seq)
+	}
+	appendFaults(t, j, 1)
+	j.Close()
+
+	data, err = os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("got %d lines, want the first entry, the torn one and the new one", len(lines))
+	}
+	if !strings.Contains(lines[2], `"seq":2`) {
+		t.Errorf("new entry %q doesn't carry on at seq 2", lines[2])
+	}
+	// The torn entry is unreadable, but the new one chains to entry 1
+	j = openTestJournal(t, path)
+	if j.broken != 1 || j.seq != 2 {
+		t.Errorf("reopened at seq %d with %d broken, want 2 and 1", j.seq, j.broken)
+	}
+}
+
+func TestFaultJournalRotation(t *testing.T) {
+	clock := useFakeClock(t, time.Date(2026, 1, 2, 0, 0, 0, 0, time.UTC))
+	path := filepath.Join(t.TempDir(), "faults.log")
+	j := openTestJournal(t, path)
+	const total = 100
+	for range total {
+		clock.Advance(time.Second)
+		appendFaults(t, j, 1)
+	}
+	j.Close()
+
+	rotated := j.rotated()
+	if len(rotated) != testJournalConfig.Keep {
+		t.Fatalf("kept %d rotated journals, want %d", len(rotated), testJournalConfig.Keep)
+	}
+	var seq uint64
+	var prev string
+	for _, p := range append(rotated, path) {
+		data, err := os.ReadFile(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if int64(len(data)) > testJournalConfig.MaxBytes {
+			t.Errorf("%s is %d bytes, past max_bytes %d", p, len(data), testJournalConfig.MaxBytes)
+		}
+		var broken int
+		if seq, prev, broken = verifyJournal(p, data, seq, prev); broken != 0 {
+			t.Errorf("%s: %d broken entries", p, broken)
+		}
+	}
+	if seq != total {
+		t.Errorf("chain ends at seq %d, want %d", seq, total)
+	}
+
+	// The chain carries on from the rotated journals after a restart
+	j = openTestJournal(t, path)
+	if j.seq != total || j.prev != prev || j.broken != 0 {
+		t.Errorf("reopened at seq %d with %d broken, want %d and 0", j.seq, j.broken, total)
+	}
+}
+
+func TestLogFaultJournalsItsCycle(t *testing.T) {
+	j := openTestJournal(t, filepath.Join(t.TempDir(), "faults.log"))
+	old := harmonyJournal
+	harmonyJournal = j
+	t.Cleanup(func() { harmonyJournal = old })
+	cfg := DefaultHarmonyConfig()
+
+	if err := logHarmonyFault(context.Background(), ActionEvent{Decision: DecisionHalt, Cycle: 7}); err != nil {
+		t.Fatal(err)
+	}
+	journalFault(CycleRecord{Cycle: 7, Decision: DecisionHalt}, nil, cfg)
+	journalFault(CycleRecord{Cycle: 8, Decision: DecisionHalt}, nil, cfg)
+	// and once only
+	journalFault(CycleRecord{Cycle: 7, Decision: DecisionHalt}, nil, cfg)
+	if j.seq != 1 {
+		t.Errorf("journaled %d entries, want only cycle 7's", j.seq)
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"sync/atomic"
+)
+
+// cycleKey carries the ID of the running cycle in a context
+type cycleKey struct{}
+
+var cycleSeq atomic.Uint64
+
+// withCycle numbers a new cycle; records logged with the returned context
+// carry its ID
+func withCycle(ctx context.Context) (context.Context, uint64) {
+	id := cycleSeq.Add(1)
+	return context.WithValue(ctx, cycleKey{}, id), id
+}
+
+// cycleID returns the ID of the cycle ctx belongs to, or 0 outside a cycle
+func cycleID(ctx context.Context) uint64 {
+	id, _ := ctx.Value(cycleKey{}).(uint64)
+	return id
+}
+
+// cycleHandler adds the cycle ID, if any, to each record
+type cycleHandler struct {
+	slog.Handler
+}
+
+func (h cycleHandler) Handle(ctx context.Context, r slog.Record) error {
+	if id := cycleID(ctx); id != 0 {
+		r.AddAttrs(slog.Uint64("cycle", id))
+	}
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h cycleHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return cycleHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h cycleHandler) WithGroup(name string) slog.Handler {
+	return cycleHandler{h.Handler.WithGroup(name)}
+}
+
+// newHarmonyLogger writes format ("text" or "json") records at level
+// ("debug", "info", "warn" or "error") and above to w. Every cycle is
+// logged at debug; faults at warn.
+func newHarmonyLogger(w io.Writer, format string, level string) (*slog.Logger, error) {
+	var lvl slog.Level
+	if err := lvl.UnmarshalText([]byte(level)); err != nil {
+		return nil, fmt.Errorf("log level %q: %w", level, err)
+	}
+	opts := &slog.HandlerOptions{Level: lvl}
+	var h slog.Handler
+	switch strings.ToLower(format) {
+	case "text":
+		h = slog.NewTextHandler(w, opts)
+	case "json":
+		h = slog.NewJSONHandler(w, opts)
+	default:
+		return nil, fmt.Errorf("log format %q must be text or json", format)
+	}
+	return slog.New(cycleHandler{h}).With("service", "harmony"), nil
+}
+
+// fatal logs err, runs the shutdown steps registered so far and exits
+func fatal(msg string, err error) {
+	slog.Error(msg, "err", err)
+	shutdown()
+	os.Exit(1)
+}
+
+// scoreAttrs groups a cycle's scores by provider name
+func scoreAttrs(ctx *CyberSecContext) slog.Attr {
+	attrs := make([]any, len(ctx.Names))
+	for i, name := range ctx.Names {
+		attrs[i] = slog.Float64(name, ctx.Scores[i])
+	}
+	return slog.Group("scores", attrs...)
+}
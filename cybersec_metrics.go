@@ -0,0 +1,336 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const metricsNamespace = "harmony"
+
+// metricSet exports the state of the last tick as gauges, and
+// decisions and autoheals as counters
+type metricSet struct {
+	decisions *prometheus.CounterVec
+	autoheals prometheus.Counter
+	healsHeld *prometheus.CounterVec
+	alerts    *prometheus.CounterVec
+	floors    *prometheus.CounterVec
+	anomalies *prometheus.CounterVec
+	drops     prometheus.Counter
+	notified  *prometheus.CounterVec
+	journal   prometheus.Counter
+	actions   *prometheus.CounterVec
+	degraded  *prometheus.CounterVec
+	contexts  *prometheus.CounterVec
+	failures  *prometheus.CounterVec
+	skipped   prometheus.Counter
+
+	muDesc     *prometheus.Desc
+	scoreDesc  *prometheus.Desc
+	weightDesc *prometheus.Desc
+	checkDesc  *prometheus.Desc
+	ctxMuDesc  *prometheus.Desc
+	fleetDesc  *prometheus.Desc
+
+	mu     sync.Mutex
+	ticked bool
+	lastMu float64
+	last   *CyberSecContext
+	checks map[string]bool
+	ctxMu  map[string]float64
+	fleet  *FleetStatus
+}
+
+var harmonyMetrics = newMetricSet()
+
+func newMetricSet() *metricSet {
+	return &metricSet{
+		decisions: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "decisions_total",
+			Help:      "Harmony decisions, by decision.",
+		}, []string{"decision"}),
+		autoheals: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "autoheal_triggers_total",
+			Help:      "Times autoheal was triggered.",
+		}),
+		healsHeld: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "autoheal_suppressed_total",
+			Help:      "Cycles autoheal was asked for but held back, by reason: backoff or limit.",
+		}, []string{"reason"}),
+		alerts: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "alerts_total",
+			Help:      "Alerts raised, by decision.",
+		}, []string{"decision"}),
+		floors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "floor_breaches_total",
+			Help:      "Cycles in which a score was below its floor, by provider.",
+		}, []string{"provider"}),
+		anomalies: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "score_anomalies_total",
+			Help:      "Scores that broke from their trend, by provider and kind.",
+		}, []string{"provider", "kind"}),
+		drops: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "stream_drops_total",
+			Help:      "Cycles not delivered to a decision stream subscriber that fell behind.",
+		}),
+		notified: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "notifications_total",
+			Help:      "Alert notifications, by notifier and result: sent, failed, grouped, deduplicated, rate_limited or dropped.",
+		}, []string{"notifier", "result"}),
+		journal: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "fault_journal_errors_total",
+			Help:      "Faults that could not be written to the fault journal.",
+		}),
+		actions: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "action_errors_total",
+			Help:      "Actions, including hooks, that failed, by action.",
+		}, []string{"action"}),
+		degraded: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "provider_degraded_total",
+			Help:      "Failed or timed out provider queries, by provider and the stale policy applied.",
+		}, []string{"provider", "policy"}),
+		failures: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "check_failures_total",
+			Help:      "Cycles in which each CH sub-check failed, by check.",
+		}, []string{"check"}),
+		skipped: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "ticks_skipped_total",
+			Help:      "Ticks skipped because the cycle before overran them.",
+		}),
+		contexts: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "context_decisions_total",
+			Help:      "Decisions of each named context, by context and decision.",
+		}, []string{"context", "decision"}),
+		muDesc: prometheus.NewDesc(
+			prometheus.BuildFQName(metricsNamespace, "", "mu"),
+			"Weighted geometric mean of the scores at the last tick.",
+			nil, nil,
+		),
+		scoreDesc: prometheus.NewDesc(
+			prometheus.BuildFQName(metricsNamespace, "", "score"),
+			"Score of each provider at the last tick.",
+			[]string{"provider"}, nil,
+		),
+		weightDesc: prometheus.NewDesc(
+			prometheus.BuildFQName(metricsNamespace, "", "weight"),
+			"Normalized weight of each provider at the last tick.",
+			[]string{"provider"}, nil,
+		),
+		checkDesc: prometheus.NewDesc(
+			prometheus.BuildFQName(metricsNamespace, "", "check"),
+			"Whether each CH sub-check passed at the last tick (1) or not (0).",
+			[]string{"check"}, nil,
+		),
+		ctxMuDesc: prometheus.NewDesc(
+			prometheus.BuildFQName(metricsNamespace, "", "context_mu"),
+			"Mu of each named context at the last tick.",
+			[]string{"context"}, nil,
+		),
+		fleetDesc: prometheus.NewDesc(
+			prometheus.BuildFQName(metricsNamespace, "", "quorum_nodes"),
+			"Nodes reporting to this quorum coordinator, by the decision they reported.",
+			[]string{"decision"}, nil,
+		),
+		checks: make(map[string]bool),
+		ctxMu:  make(map[string]float64),
+	}
+}
+
+func (m *metricSet) observeTick(ctx *CyberSecContext, mu float64) {
+	m.mu.Lock()
+	m.ticked = true
+	m.lastMu = mu
+	m.last = ctx
+	m.mu.Unlock()
+}
+
+func (m *metricSet) observeCheck(res CheckResult) {
+	if !res.Passed {
+		m.failures.WithLabelValues(res.Name).Inc()
+	}
+	m.mu.Lock()
+	m.checks[res.Name] = res.Passed
+	m.mu.Unlock()
+}
+
+func (m *metricSet) observeDecision(decision string) {
+	m.decisions.WithLabelValues(decision).Inc()
+}
+
+func (m *metricSet) observeContext(name string, mu float64, decision string) {
+	m.contexts.WithLabelValues(name, decision).Inc()
+	m.mu.Lock()
+	m.ctxMu[name] = mu
+	m.mu.Unlock()
+}
+
+func (m *metricSet) observeFleet(st FleetStatus) {
+	m.mu.Lock()
+	m.fleet = &st
+	m.mu.Unlock()
+}
+
+func (m *metricSet) observeAutoheal() {
+	m.autoheals.Inc()
+}
+
+func (m *metricSet) observeAutohealSuppressed(reason string) {
+	m.healsHeld.WithLabelValues(reason).Inc()
+}
+
+func (m *metricSet) observeAlert(decision string) {
+	m.alerts.WithLabelValues(decision).Inc()
+}
+
+func (m *metricSet) observeFloorBreach(provider string) {
+	m.floors.WithLabelValues(provider).Inc()
+}
+
+func (m *metricSet) observeAnomaly(provider string, kind string) {
+	m.anomalies.WithLabelValues(provider, kind).Inc()
+}
+
+func (m *metricSet) observeStreamDrop() {
+	m.drops.Inc()
+}
+
+func (m *metricSet) observeDegraded(provider string, policy string) {
+	m.degraded.WithLabelValues(provider, policy).Inc()
+}
+
+func (m *metricSet) observeActionError(action string) {
+	m.actions.WithLabelValues(action).Inc()
+}
+
+func (m *metricSet) observeJournalError() {
+	m.journal.Inc()
+}
+
+func (m *metricSet) observeNotification(notifier string, result string) {
+	m.notified.WithLabelValues(notifier, result).Inc()
+}
+
+func (m *metricSet) observeSkippedTicks(n int) {
+	m.skipped.Add(float64(n))
+}
+
+// Describe implements prometheus.Collector
+func (m *metricSet) Describe(ch chan<- *prometheus.Desc) {
+	m.decisions.Describe(ch)
+	m.autoheals.Describe(ch)
+	m.healsHeld.Describe(ch)
+	m.alerts.Describe(ch)
+	m.floors.Describe(ch)
+	m.anomalies.Describe(ch)
+	m.drops.Describe(ch)
+	m.notified.Describe(ch)
+	m.journal.Describe(ch)
+	m.actions.Describe(ch)
+	m.degraded.Describe(ch)
+	m.contexts.Describe(ch)
+	m.failures.Describe(ch)
+	m.skipped.Describe(ch)
+	ch <- m.muDesc
+	ch <- m.scoreDesc
+	ch <- m.weightDesc
+	ch <- m.checkDesc
+	ch <- m.ctxMuDesc
+	ch <- m.fleetDesc
+}
+
+// Collect implements prometheus.Collector. Scores are labelled from the
+// last tick, so a provider removed by a reload drops out on the next one.
+func (m *metricSet) Collect(ch chan<- prometheus.Metric) {
+	m.decisions.Collect(ch)
+	m.autoheals.Collect(ch)
+	m.healsHeld.Collect(ch)
+	m.alerts.Collect(ch)
+	m.floors.Collect(ch)
+	m.anomalies.Collect(ch)
+	m.drops.Collect(ch)
+	m.notified.Collect(ch)
+	m.journal.Collect(ch)
+	m.actions.Collect(ch)
+	m.degraded.Collect(ch)
+	m.contexts.Collect(ch)
+	m.failures.Collect(ch)
+	m.skipped.Collect(ch)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if !m.ticked {
+		return
+	}
+	ch <- prometheus.MustNewConstMetric(m.muDesc, prometheus.GaugeValue, m.lastMu)
+	for i, name := range m.last.Names {
+		ch <- prometheus.MustNewConstMetric(m.scoreDesc, prometheus.GaugeValue, m.last.Scores[i], name)
+		ch <- prometheus.MustNewConstMetric(m.weightDesc, prometheus.GaugeValue, m.last.Weights[i], name)
+	}
+	for name, passed := range m.checks {
+		v := 0.0
+		if passed {
+			v = 1
+		}
+		ch <- prometheus.MustNewConstMetric(m.checkDesc, prometheus.GaugeValue, v, name)
+	}
+	for name, mu := range m.ctxMu {
+		ch <- prometheus.MustNewConstMetric(m.ctxMuDesc, prometheus.GaugeValue, mu, name)
+	}
+	if m.fleet != nil {
+		nodes := map[string]int{DecisionGo: 0, DecisionCaution: 0, DecisionDegraded: 0, DecisionHalt: 0}
+		for _, r := range m.fleet.Reports {
+			nodes[r.Decision]++
+		}
+		for decision, n := range nodes {
+			ch <- prometheus.MustNewConstMetric(m.fleetDesc, prometheus.GaugeValue, float64(n), decision)
+		}
+	}
+}
+
+// serveMetrics exposes the harmony metrics at /metrics on addr, with the
+// /healthz and /readyz probes alongside. It returns once the listener is
+// bound, with a func that shuts the server down after in-flight scrapes;
+// serving errors are logged.
+func serveMetrics(addr string) (func(context.Context) error, error) {
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(harmonyMetrics)
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(reg, promhttp.HandlerOpts{}))
+	mux.HandleFunc("GET /healthz", serveHealthz)
+	mux.HandleFunc("GET /readyz", serveReadyz)
+
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("listen for metrics: %w", err)
+	}
+	srv := &http.Server{Handler: mux, ReadHeaderTimeout: 5 * time.Second}
+	go func() {
+		if err := srv.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			slog.Error("metrics server stopped", "err", err)
+		}
+	}()
+	return srv.Shutdown, nil
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/smtp"
+	"os"
+	"strings"
+	"time"
+)
+
+const pagerDutyEventsURL = "https://events.pagerduty.com/v2/enqueue"
+
+// Notifier delivers alerts somewhere a person will see them
+type Notifier interface {
+	Notify(ctx context.Context, a Alert) error
+}
+
+// NotifierConfig configures one notifier. Secrets may be set as
+// ${ENV_VAR} so they stay out of the file.
+type NotifierConfig struct {
+	// Type is slack, pagerduty or email
+	Type string `yaml:"type"`
+
+	// URL is the Slack incoming webhook, or overrides the PagerDuty
+	// Events API v2 endpoint
+	URL string `yaml:"url"`
+
+	// RoutingKey is the PagerDuty integration key
+	RoutingKey string `yaml:"routing_key"`
+
+	// SMTPAddr, From and To address email; Username and Password, if set,
+	// authenticate with PLAIN auth over STARTTLS
+	SMTPAddr string   `yaml:"smtp_addr"`
+	From     string   `yaml:"from"`
+	To       []string `yaml:"to"`
+	Username string   `yaml:"username"`
+	Password string   `yaml:"password"`
+}
+
+func newNotifier(c NotifierConfig) (Notifier, error) {
+	switch c.Type {
+	case "slack":
+		url := os.ExpandEnv(c.URL)
+		if url == "" {
+			return nil, fmt.Errorf("slack needs url")
+		}
+		return &slackNotifier{url: url}, nil
+	case "pagerduty":
+		key := os.ExpandEnv(c.RoutingKey)
+		if key == "" {
+			return nil, fmt.Errorf("pagerduty needs routing_key")
+		}
+		url := os.ExpandEnv(c.URL)
+		if url == "" {
+			url = pagerDutyEventsURL
+		}
+		return &pagerDutyNotifier{url: url, routingKey: key}, nil
+	case "email":
+		if c.SMTPAddr == "" || c.From == "" || len(c.To) == 0 {
+			return nil, fmt.Errorf("email needs smtp_addr, from and to")
+		}
+		host, _, err := net.SplitHostPort(c.SMTPAddr)
+		if err != nil {
+			return nil, fmt.Errorf("smtp_addr: %w", err)
+		}
+		return &emailNotifier{
+			addr:     c.SMTPAddr,
+			host:     host,
+			from:     c.From,
+			to:       c.To,
+			username: os.ExpandEnv(c.Username),
+			password: os.ExpandEnv(c.Password),
+		}, nil
+	}
+	return nil, fmt.Errorf("unknown notifier type %q", c.Type)
+}
+
+// alertText renders a for a message body
+func alertText(a Alert) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "[harmony] %s: %s", strings.ToUpper(a.Severity), a.Summary)
+	for _, d := range a.Details {
+		fmt.Fprintf(&b, "\n- %s", d)
+	}
+	switch {
+	case a.Count > 1:
+		fmt.Fprintf(&b, "\n- incident %s: %d alerts since %s", a.Incident, a.Count, a.FirstSeen.Format(time.RFC3339))
+	case a.Incident != "":
+		fmt.Fprintf(&b, "\n- incident %s", a.Incident)
+	}
+	return b.String()
+}
+
+// postJSON posts v to url, failing on a non-2xx status
+func postJSON(ctx context.Context, url string, v any) error {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("%s: %s", resp.Status, bytes.TrimSpace(msg))
+	}
+	return nil
+}
+
+// slackNotifier posts to a Slack incoming webhook
+type slackNotifier struct {
+	url string
+}
+
+func (n *slackNotifier) Notify(ctx context.Context, a Alert) error {
+	return postJSON(ctx, n.url, map[string]string{"text": alertText(a)})
+}
+
+// pagerDutyNotifier sends PagerDuty Events API v2 events. Each alert key
+// is one incident, resolved with harmony's, and the decisions share one.
+type pagerDutyNotifier struct {
+	url        string
+	routingKey string
+}
+
+func (n *pagerDutyNotifier) Notify(ctx context.Context, a Alert) error {
+	event := map[string]any{
+		"routing_key":  n.routingKey,
+		"event_action": "trigger",
+		"dedup_key":    "harmony:" + a.Kind,
+	}
+	if a.Kind != AlertDecision {
+		event["dedup_key"] = "harmony:" + a.key()
+	}
+	if a.Resolved {
+		event["event_action"] = "resolve"
+	} else {
+		event["payload"] = map[string]any{
+			"summary":   a.Summary,
+			"source":    "harmony",
+			"severity":  a.Severity,
+			"timestamp": a.Time.Format(time.RFC3339),
+			"component": a.Subject,
+			"custom_details": map[string]any{"cycle": a.Cycle, "details": a.Details,
+				"incident": a.Incident, "first_seen": a.FirstSeen, "count": a.Count},
+		}
+	}
+	return postJSON(ctx, n.url, event)
+}
+
+// emailNotifier sends mail over SMTP
+type emailNotifier struct {
+	addr, host         string
+	from               string
+	to                 []string
+	username, password string
+}
+
+func (n *emailNotifier) Notify(ctx context.Context, a Alert) error {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", n.addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	c, err := smtp.NewClient(conn, n.host)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		if err := c.StartTLS(&tls.Config{ServerName: n.host}); err != nil {
+			return err
+		}
+	}
+	if n.username != "" {
+		if err := c.Auth(smtp.PlainAuth("", n.username, n.password, n.host)); err != nil {
+			return err
+		}
+	}
+	if err := c.Mail(n.from); err != nil {
+		return err
+	}
+	for _, to := range n.to {
+		if err := c.Rcpt(to); err != nil {
+			return err
+		}
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "From: %s\r\nTo: %s\r\nSubject: [harmony] %s: %s\r\nDate: %s\r\n\r\n%s\r\n",
+		n.from, strings.Join(n.to, ", "), strings.ToUpper(a.Severity), a.Summary,
+		a.Time.Format(time.RFC1123Z), strings.ReplaceAll(alertText(a), "\n", "\r\n"))
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
@@ -0,0 +1,566 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// The nvd source scores zero_day_exposure from the CVEs that affect the
+// software in a local inventory. Each item's CVEs come from the NVD CVE
+// API by CPE; those CISA lists as known exploited weigh KEVFactor times
+// more. Exposure is the sum over the distinct CVEs of their CVSS base score
+// out of 10, and the score halves every HalfAt of exposure: no CVEs score
+// 1. Responses are cached on disk, so a restart scores from the cache
+// rather than waiting out NVD's rate limit.
+
+const (
+	defaultKEVURL       = "https://www.cisa.gov/sites/default/files/feeds/known_exploited_vulnerabilities.json"
+	defaultNVDURL       = "https://services.nvd.nist.gov/rest/json/cves/2.0"
+	defaultNVDEvery     = 6 * time.Hour
+	defaultNVDMaxAge    = 48 * time.Hour
+	defaultNVDTimeout   = 30 * time.Minute
+	defaultNVDHalfAt    = 5
+	defaultNVDKEVFactor = 3
+
+	// NVD allows 5 requests per 30s without an API key and 50 with one
+	nvdPace       = 6 * time.Second
+	nvdPaceKeyed  = 600 * time.Millisecond
+	nvdPageSize   = 2000
+	nvdRetries    = 3
+	nvdRetryAfter = 30 * time.Second
+)
+
+// NVDConfig configures the nvd source. Zero fields take their defaults.
+type NVDConfig struct {
+	// Inventory is a YAML file listing the software to score under
+	// software, each item a cpe or a vendor, product and version; it is
+	// reread on every refresh
+	Inventory string `yaml:"inventory"`
+
+	// KEVURL is the CISA known exploited vulnerabilities catalog
+	KEVURL string `yaml:"kev_url"`
+
+	// NVDURL is the NVD CVE API; APIKey raises its rate limit, and $VARS
+	// are expanded
+	NVDURL string `yaml:"nvd_url"`
+	APIKey string `yaml:"api_key"`
+
+	// KEVOnly skips NVD and scores the inventory's matches in the KEV
+	// catalog by vendor and product alone, each as a CVSS 10
+	KEVOnly bool `yaml:"kev_only"`
+
+	// Every is how often the data is refetched, 6h by default; Timeout
+	// bounds a refresh, 30m by default. Without an API key NVD takes 6s
+	// a request, so a large inventory needs a long one.
+	Every   time.Duration `yaml:"every"`
+	Timeout time.Duration `yaml:"timeout"`
+
+	// MaxAge is how old the last good refresh may be before the provider
+	// fails, 48h by default
+	MaxAge time.Duration `yaml:"max_age"`
+
+	// Cache is a directory responses are kept in; empty keeps none
+	Cache string `yaml:"cache"`
+
+	// HalfAt is the exposure at which the score is 0.5, 5 by default;
+	// KEVFactor weighs known exploited CVEs, 3 by default
+	HalfAt    float64 `yaml:"half_at"`
+	KEVFactor float64 `yaml:"kev_factor"`
+}
+
+func (c *NVDConfig) validate() error {
+	if c.Inventory == "" {
+		return fmt.Errorf("needs an inventory")
+	}
+	if _, err := loadInventory(c.Inventory); err != nil {
+		return err
+	}
+	for _, u := range []string{c.KEVURL, c.NVDURL} {
+		if u == "" {
+			continue
+		}
+		pu, err := url.Parse(u)
+		if err != nil || (pu.Scheme != "http" && pu.Scheme != "https") || pu.Host == "" {
+			return fmt.Errorf("%q must be an http or https url", u)
+		}
+	}
+	if c.Every < 0 || c.Timeout < 0 || c.MaxAge < 0 {
+		return fmt.Errorf("every, timeout and max_age must be non-negative")
+	}
+	if c.HalfAt < 0 || math.IsNaN(c.HalfAt) || math.IsInf(c.HalfAt, 0) {
+		return fmt.Errorf("half_at %v must be positive", c.HalfAt)
+	}
+	if c.KEVFactor != 0 && (!(c.KEVFactor >= 1) || math.IsInf(c.KEVFactor, 0)) {
+		return fmt.Errorf("kev_factor %v must be at least 1", c.KEVFactor)
+	}
+	return nil
+}
+
+// withDefaults returns c with its zero fields defaulted
+func (c NVDConfig) withDefaults() NVDConfig {
+	if c.KEVURL == "" {
+		c.KEVURL = defaultKEVURL
+	}
+	if c.NVDURL == "" {
+		c.NVDURL = defaultNVDURL
+	}
+	if c.Every == 0 {
+		c.Every = defaultNVDEvery
+	}
+	if c.Timeout == 0 {
+		c.Timeout = defaultNVDTimeout
+	}
+	if c.MaxAge == 0 {
+		c.MaxAge = defaultNVDMaxAge
+	}
+	if c.HalfAt == 0 {
+		c.HalfAt = defaultNVDHalfAt
+	}
+	if c.KEVFactor == 0 {
+		c.KEVFactor = defaultNVDKEVFactor
+	}
+	c.APIKey = os.ExpandEnv(c.APIKey)
+	return c
+}
+
+// SoftwareItem is one entry of the inventory
+type SoftwareItem struct {
+	Name    string `yaml:"name"`
+	CPE     string `yaml:"cpe"`
+	Vendor  string `yaml:"vendor"`
+	Product string `yaml:"product"`
+	Version string `yaml:"version"`
+}
+
+// cpe returns the item's CPE 2.3 name, built from its vendor, product and
+// version when it gives none
+func (s *SoftwareItem) cpe() string {
+	if s.CPE != "" {
+		return s.CPE
+	}
+	version := s.Version
+	if version == "" {
+		version = "*"
+	}
+	return fmt.Sprintf("cpe:2.3:a:%s:%s:%s:*:*:*:*:*:*:*", cpeField(s.Vendor), cpeField(s.Product), version)
+}
+
+// vendorProduct returns the item's vendor and product, from its CPE when
+// it gives them no other way
+func (s *SoftwareItem) vendorProduct() (string, string) {
+	if s.Vendor != "" || s.CPE == "" {
+		return cpeField(s.Vendor), cpeField(s.Product)
+	}
+	f := strings.Split(s.CPE, ":")
+	if len(f) < 5 {
+		return "", ""
+	}
+	return f[3], f[4]
+}
+
+func cpeField(s string) string {
+	return strings.ReplaceAll(strings.ToLower(strings.TrimSpace(s)), " ", "_")
+}
+
+func loadInventory(path string) ([]SoftwareItem, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var inv struct {
+		Software []SoftwareItem `yaml:"software"`
+	}
+	if err := yaml.Unmarshal(data, &inv); err != nil {
+		return nil, fmt.Errorf("parse inventory %s: %w", path, err)
+	}
+	items := inv.Software
+	for i, it := range items {
+		if it.CPE == "" && (it.Vendor == "" || it.Product == "") {
+			return nil, fmt.Errorf("inventory %s: item %d needs a cpe or a vendor and product", path, i+1)
+		}
+		if it.CPE != "" && !strings.HasPrefix(it.CPE, "cpe:2.3:") {
+			return nil, fmt.Errorf("inventory %s: item %d cpe %q is not a cpe 2.3 name", path, i+1, it.CPE)
+		}
+	}
+	return items, nil
+}
+
+// kevCatalog is the part of the CISA KEV feed scored
+type kevCatalog struct {
+	Vulnerabilities []struct {
+		CVE     string `json:"cveID"`
+		Vendor  string `json:"vendorProject"`
+		Product string `json:"product"`
+	} `json:"vulnerabilities"`
+}
+
+// nvdCVE is one CVE affecting an item, with its CVSS base score
+type nvdCVE struct {
+	ID    string  `json:"id"`
+	Score float64 `json:"score"`
+}
+
+// nvdPage is the part of an NVD CVE API response scored
+type nvdPage struct {
+	ResultsPerPage  int `json:"resultsPerPage"`
+	StartIndex      int `json:"startIndex"`
+	TotalResults    int `json:"totalResults"`
+	Vulnerabilities []struct {
+		CVE struct {
+			ID         string `json:"id"`
+			VulnStatus string `json:"vulnStatus"`
+			Metrics    struct {
+				V31 []nvdMetric `json:"cvssMetricV31"`
+				V30 []nvdMetric `json:"cvssMetricV30"`
+				V2  []nvdMetric `json:"cvssMetricV2"`
+			} `json:"metrics"`
+		} `json:"cve"`
+	} `json:"vulnerabilities"`
+}
+
+type nvdMetric struct {
+	Type     string `json:"type"`
+	CVSSData struct {
+		BaseScore float64 `json:"baseScore"`
+	} `json:"cvssData"`
+}
+
+// baseScore prefers CVSS 3.1 over 3.0 over 2, and NVD's own scoring over
+// a CNA's
+func baseScore(versions ...[]nvdMetric) (float64, bool) {
+	for _, ms := range versions {
+		for _, m := range ms {
+			if m.Type == "Primary" {
+				return m.CVSSData.BaseScore, true
+			}
+		}
+		if len(ms) > 0 {
+			return ms[0].CVSSData.BaseScore, true
+		}
+	}
+	return 0, false
+}
+
+// unscoredCVSS scores a CVE NVD hasn't scored yet: a new CVE is unknown,
+// not harmless
+const unscoredCVSS = 5.0
+
+// cached is a response kept on disk
+type cached[T any] struct {
+	Key     string    `json:"key"`
+	Fetched time.Time `json:"fetched"`
+	Data    T         `json:"data"`
+}
+
+// nvdProvider is the nvd source's zero_day_exposure provider
+type nvdProvider struct {
+	refreshedScore
+	src    NVDConfig // as configured, to tell a changed config
+	cfg    NVDConfig // defaulted
+	client *http.Client
+
+	paceMu sync.Mutex
+	next   time.Time // no NVD request before this
+}
+
+func newNVDProvider(src *NVDConfig) *nvdProvider {
+	cfg := src.withDefaults()
+	p := &nvdProvider{src: *src, cfg: cfg, client: &http.Client{Timeout: time.Minute}}
+	p.refreshedScore = refreshedScore{
+		name:    "zero_day_exposure",
+		weight:  builtinWeight("zero_day_exposure"),
+		every:   cfg.Every,
+		timeout: cfg.Timeout,
+		maxAge:  cfg.MaxAge,
+		refresh: p.refresh,
+	}
+	return p
+}
+
+func (p *nvdProvider) source() any { return p.src }
+
+func (p *nvdProvider) refresh(ctx context.Context) (float64, error) {
+	items, err := loadInventory(p.cfg.Inventory)
+	if err != nil {
+		return 0, err
+	}
+	kev, err := p.kev(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("kev catalog: %w", err)
+	}
+	exploited := make(map[string]bool, len(kev.Vulnerabilities))
+	for _, v := range kev.Vulnerabilities {
+		exploited[v.CVE] = true
+	}
+
+	scores := map[string]float64{} // by CVE, so items sharing a CVE count it once
+	for _, it := range items {
+		if p.cfg.KEVOnly {
+			vendor, product := it.vendorProduct()
+			for _, v := range kev.Vulnerabilities {
+				if cpeField(v.Vendor) == vendor && cpeField(v.Product) == product {
+					scores[v.CVE] = 10
+				}
+			}
+			continue
+		}
+		cves, err := p.cves(ctx, it.cpe())
+		if err != nil {
+			return 0, fmt.Errorf("nvd %s: %w", it.cpe(), err)
+		}
+		for _, c := range cves {
+			scores[c.ID] = math.Max(scores[c.ID], c.Score)
+		}
+	}
+
+	exposure, known := 0.0, 0
+	for id, s := range scores {
+		w := s / 10
+		if exploited[id] {
+			w *= p.cfg.KEVFactor
+			known++
+		}
+		exposure += w
+	}
+	score := math.Pow(0.5, exposure/p.cfg.HalfAt)
+	slog.Debug("zero day exposure refreshed", "items", len(items), "cves", len(scores),
+		"exploited", known, "exposure", exposure, "score", score)
+	return score, nil
+}
+
+// kev returns the KEV catalog, from the cache while it is younger than Every
+func (p *nvdProvider) kev(ctx context.Context) (kevCatalog, error) {
+	var c cached[kevCatalog]
+	if p.loadCache("kev", p.cfg.KEVURL, &c) && harmonyClock.Now().Sub(c.Fetched) < p.cfg.Every {
+		return c.Data, nil
+	}
+	var kev kevCatalog
+	err := p.get(ctx, p.cfg.KEVURL, false, &kev)
+	if err == nil {
+		p.saveCache("kev", cached[kevCatalog]{Key: p.cfg.KEVURL, Fetched: harmonyClock.Now(), Data: kev})
+		return kev, nil
+	}
+	if !c.Fetched.IsZero() && harmonyClock.Now().Sub(c.Fetched) < p.cfg.MaxAge {
+		slog.Warn("kev catalog fetch failed, using cache", "fetched", c.Fetched, "err", err)
+		return c.Data, nil
+	}
+	return kev, err
+}
+
+// cves returns the CVEs affecting cpe, from the cache while it is younger
+// than Every
+func (p *nvdProvider) cves(ctx context.Context, cpe string) ([]nvdCVE, error) {
+	name := "nvd-" + cacheKey(cpe)
+	var c cached[[]nvdCVE]
+	if p.loadCache(name, cpe, &c) && harmonyClock.Now().Sub(c.Fetched) < p.cfg.Every {
+		return c.Data, nil
+	}
+	cves, err := p.fetchCVEs(ctx, cpe)
+	if err == nil {
+		p.saveCache(name, cached[[]nvdCVE]{Key: cpe, Fetched: harmonyClock.Now(), Data: cves})
+		return cves, nil
+	}
+	if !c.Fetched.IsZero() && harmonyClock.Now().Sub(c.Fetched) < p.cfg.MaxAge {
+		slog.Warn("nvd fetch failed, using cache", "cpe", cpe, "fetched", c.Fetched, "err", err)
+		return c.Data, nil
+	}
+	return nil, err
+}
+
+func (p *nvdProvider) fetchCVEs(ctx context.Context, cpe string) ([]nvdCVE, error) {
+	cves := []nvdCVE{}
+	for start := 0; ; {
+		q := url.Values{}
+		q.Set("virtualMatchString", cpe)
+		q.Set("startIndex", strconv.Itoa(start))
+		q.Set("resultsPerPage", strconv.Itoa(nvdPageSize))
+		var page nvdPage
+		if err := p.get(ctx, p.cfg.NVDURL+"?"+q.Encode(), true, &page); err != nil {
+			return nil, err
+		}
+		for _, v := range page.Vulnerabilities {
+			if v.CVE.VulnStatus == "Rejected" {
+				continue
+			}
+			score, ok := baseScore(v.CVE.Metrics.V31, v.CVE.Metrics.V30, v.CVE.Metrics.V2)
+			if !ok {
+				score = unscoredCVSS
+			}
+			cves = append(cves, nvdCVE{ID: v.CVE.ID, Score: score})
+		}
+		start += len(page.Vulnerabilities)
+		if len(page.Vulnerabilities) == 0 || start >= page.TotalResults {
+			return cves, nil
+		}
+	}
+}
+
+// get decodes the JSON at u into v. NVD requests are paced under its rate
+// limit, and a request refused for the rate is retried after Retry-After.
+func (p *nvdProvider) get(ctx context.Context, u string, nvd bool, v any) error {
+	for attempt := 1; ; attempt++ {
+		if nvd {
+			if err := p.pace(ctx); err != nil {
+				return err
+			}
+		}
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+		if err != nil {
+			return err
+		}
+		if nvd && p.cfg.APIKey != "" {
+			req.Header.Set("apiKey", p.cfg.APIKey)
+		}
+		resp, err := p.client.Do(req)
+		if err != nil {
+			return err
+		}
+		switch {
+		case resp.StatusCode/100 == 2:
+			err := json.NewDecoder(io.LimitReader(resp.Body, 64<<20)).Decode(v)
+			resp.Body.Close()
+			if err != nil {
+				return fmt.Errorf("decode %s: %w", req.URL.Redacted(), err)
+			}
+			return nil
+		case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode == http.StatusForbidden ||
+			resp.StatusCode == http.StatusServiceUnavailable:
+			resp.Body.Close()
+			if attempt == nvdRetries {
+				return fmt.Errorf("rate limited: %s after %d attempts", resp.Status, attempt)
+			}
+			wait := retryAfter(resp.Header.Get("Retry-After"))
+			slog.Debug("rate limited, waiting", "url", req.URL.Redacted(), "status", resp.Status, "wait", wait)
+			if nvd {
+				p.deferNext(wait)
+			} else if err := sleepCtx(ctx, wait); err != nil {
+				return err
+			}
+		default:
+			resp.Body.Close()
+			return fmt.Errorf("%s answered %s", req.URL.Redacted(), resp.Status)
+		}
+	}
+}
+
+// pace waits out the gap NVD wants between requests
+func (p *nvdProvider) pace(ctx context.Context) error {
+	gap := nvdPace
+	if p.cfg.APIKey != "" {
+		gap = nvdPaceKeyed
+	}
+	p.paceMu.Lock()
+	now := time.Now()
+	at := p.next
+	if at.Before(now) {
+		at = now
+	}
+	p.next = at.Add(gap)
+	p.paceMu.Unlock()
+	return sleepCtx(ctx, at.Sub(now))
+}
+
+// deferNext holds the next NVD request back at least d
+func (p *nvdProvider) deferNext(d time.Duration) {
+	p.paceMu.Lock()
+	defer p.paceMu.Unlock()
+	if at := time.Now().Add(d); at.After(p.next) {
+		p.next = at
+	}
+}
+
+func retryAfter(h string) time.Duration {
+	if s, err := strconv.Atoi(strings.TrimSpace(h)); err == nil && s >= 0 {
+		return time.Duration(s) * time.Second
+	}
+	if t, err := http.ParseTime(h); err == nil {
+		if d := time.Until(t); d > 0 {
+			return d
+		}
+		return 0
+	}
+	return nvdRetryAfter
+}
+
+func sleepCtx(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return nil
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
+
+func cacheKey(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:8])
+}
+
+// loadCache reads the named cache entry into c, reporting whether there
+// was one for key
+func (p *nvdProvider) loadCache(name, key string, c any) bool {
+	if p.cfg.Cache == "" {
+		return false
+	}
+	data, err := os.ReadFile(filepath.Join(p.cfg.Cache, name+".json"))
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			slog.Warn("read nvd cache", "err", err)
+		}
+		return false
+	}
+	var k struct {
+		Key string `json:"key"`
+	}
+	if json.Unmarshal(data, &k) != nil || k.Key != key {
+		return false
+	}
+	return json.Unmarshal(data, c) == nil
+}
+
+// saveCache writes the named cache entry, through a rename so a crash
+// can't leave half of one
+func (p *nvdProvider) saveCache(name string, c any) {
+	if p.cfg.Cache == "" {
+		return
+	}
+	err := func() error {
+		if err := os.MkdirAll(p.cfg.Cache, 0o700); err != nil {
+			return err
+		}
+		data, err := json.Marshal(c)
+		if err != nil {
+			return err
+		}
+		path := filepath.Join(p.cfg.Cache, name+".json")
+		if err := os.WriteFile(path+".tmp", data, 0o600); err != nil {
+			return err
+		}
+		return os.Rename(path+".tmp", path)
+	}()
+	if err != nil {
+		slog.Warn("write nvd cache", "err", err)
+	}
+}
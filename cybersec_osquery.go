@@ -0,0 +1,310 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"math"
+	"runtime"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/osquery/osquery-go"
+)
+
+// The osquery source runs SQL against osqueryd over its extension socket
+// and scores what comes back. Each query names something that shouldn't be
+// there - an unsigned driver, a port listening to the world, a binary
+// anyone can overwrite - so its score is 1 while it returns no more than
+// Allow rows, and halves for every HalfAt rows over that. The provider
+// scores the product of its queries' scores. Queries share a small pool of
+// connections to osqueryd.
+
+const (
+	defaultOSQuerySocket  = "/var/osquery/osquery.em"
+	defaultOSQueryName    = "host_posture"
+	defaultOSQueryWeight  = 0.1
+	defaultOSQueryPool    = 2
+	defaultOSQueryTimeout = 5 * time.Second
+	defaultOSQueryEvery   = time.Minute
+	defaultOSQueryMaxAge  = 10 * time.Minute
+)
+
+// OSQueryConfig configures the osquery source. Zero fields take their
+// defaults.
+type OSQueryConfig struct {
+	// Name is the provider's, host_posture by default; naming a built-in
+	// provider replaces it
+	Name string `yaml:"name"`
+
+	// Weight is the provider's registered weight: the built-in's when Name
+	// is one, 0.1 otherwise. Weights, when set, must account for it.
+	Weight float64 `yaml:"weight"`
+
+	// Socket is osqueryd's extension socket
+	Socket string `yaml:"socket"`
+
+	// Pool is how many connections to osqueryd are kept, and so how many
+	// queries run at once; 2 by default
+	Pool int `yaml:"pool"`
+
+	// Timeout bounds connecting and each query, 5s by default
+	Timeout time.Duration `yaml:"timeout"`
+
+	// Every is how often the queries run, 1m by default; the provider
+	// fails once its last good run is MaxAge old, 10m by default
+	Every  time.Duration `yaml:"every"`
+	MaxAge time.Duration `yaml:"max_age"`
+
+	// Queries by name; none means the built-in queries for this platform
+	Queries map[string]OSQuery `yaml:"queries"`
+}
+
+// OSQuery is one scored query
+type OSQuery struct {
+	SQL string `yaml:"sql"`
+
+	// Allow is how many rows are expected; HalfAt is how many rows beyond
+	// that halve the score, 1 by default
+	Allow  int     `yaml:"allow"`
+	HalfAt float64 `yaml:"half_at"`
+}
+
+// defaultOSQueries are the built-in queries for GOOS
+func defaultOSQueries(goos string) map[string]OSQuery {
+	qs := map[string]OSQuery{
+		"public_listening_ports": {
+			SQL:    "SELECT DISTINCT port, protocol FROM listening_ports WHERE port != 0 AND address NOT IN ('127.0.0.1', '::1')",
+			Allow:  5,
+			HalfAt: 5,
+		},
+	}
+	switch goos {
+	case "darwin":
+		qs["unsigned_kernel_extensions"] = OSQuery{
+			SQL: "SELECT k.name FROM kernel_extensions k JOIN signature s ON s.path = k.path WHERE s.signed = 0",
+		}
+	case "windows":
+		qs["unsigned_kernel_extensions"] = OSQuery{
+			SQL: "SELECT description FROM drivers WHERE signed = 0",
+		}
+	}
+	if goos != "windows" {
+		qs["world_writable_binaries"] = OSQuery{
+			SQL: "SELECT path FROM file WHERE directory IN ('/bin', '/sbin', '/usr/bin', '/usr/sbin', '/usr/local/bin', '/usr/local/sbin') " +
+				"AND type = 'regular' AND (CAST(substr(mode, -1, 1) AS INTEGER) & 2) != 0",
+		}
+	}
+	return qs
+}
+
+func (c *OSQueryConfig) validate() error {
+	if c.Weight < 0 || math.IsNaN(c.Weight) || math.IsInf(c.Weight, 0) {
+		return fmt.Errorf("weight %v must be non-negative", c.Weight)
+	}
+	if c.Pool < 0 {
+		return fmt.Errorf("pool %d must be non-negative", c.Pool)
+	}
+	if c.Timeout < 0 || c.Every < 0 || c.MaxAge < 0 {
+		return fmt.Errorf("timeout, every and max_age must be non-negative")
+	}
+	for name, q := range c.Queries {
+		if q.SQL == "" {
+			return fmt.Errorf("query %s has no sql", name)
+		}
+		if q.Allow < 0 {
+			return fmt.Errorf("query %s allow %d must be non-negative", name, q.Allow)
+		}
+		if q.HalfAt < 0 || math.IsNaN(q.HalfAt) || math.IsInf(q.HalfAt, 0) {
+			return fmt.Errorf("query %s half_at %v must be positive", name, q.HalfAt)
+		}
+	}
+	return nil
+}
+
+func (c *OSQueryConfig) name() string {
+	if c.Name != "" {
+		return c.Name
+	}
+	return defaultOSQueryName
+}
+
+// withDefaults returns c with its zero fields defaulted
+func (c OSQueryConfig) withDefaults() OSQueryConfig {
+	c.Name = c.name()
+	if c.Weight == 0 {
+		c.Weight = defaultOSQueryWeight
+		if _, ok := builtinProvider(c.Name); ok {
+			c.Weight = builtinWeight(c.Name)
+		}
+	}
+	if c.Socket == "" {
+		c.Socket = defaultOSQuerySocket
+	}
+	if c.Pool == 0 {
+		c.Pool = defaultOSQueryPool
+	}
+	if c.Timeout == 0 {
+		c.Timeout = defaultOSQueryTimeout
+	}
+	if c.Every == 0 {
+		c.Every = defaultOSQueryEvery
+	}
+	if c.MaxAge == 0 {
+		c.MaxAge = defaultOSQueryMaxAge
+	}
+	if len(c.Queries) == 0 {
+		c.Queries = defaultOSQueries(runtime.GOOS)
+	}
+	return c
+}
+
+// score is the query's score for n rows
+func (q *OSQuery) score(n int) float64 {
+	over := n - q.Allow
+	if over <= 0 {
+		return 1
+	}
+	half := q.HalfAt
+	if half == 0 {
+		half = 1
+	}
+	return math.Pow(0.5, float64(over)/half)
+}
+
+// osqueryPool keeps up to size connections to osqueryd, dialed as needed.
+// A connection that fails a query is closed rather than reused.
+type osqueryPool struct {
+	socket  string
+	timeout time.Duration
+	slots   chan struct{} // one per connection checked out
+	idle    chan *osquery.ExtensionManagerClient
+
+	mu     sync.Mutex
+	closed bool
+}
+
+func newOSQueryPool(socket string, size int, timeout time.Duration) *osqueryPool {
+	return &osqueryPool{
+		socket:  socket,
+		timeout: timeout,
+		slots:   make(chan struct{}, size),
+		idle:    make(chan *osquery.ExtensionManagerClient, size),
+	}
+}
+
+// query runs sql on a pooled connection
+func (p *osqueryPool) query(ctx context.Context, sql string) ([]map[string]string, error) {
+	select {
+	case p.slots <- struct{}{}:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	defer func() { <-p.slots }()
+
+	var c *osquery.ExtensionManagerClient
+	select {
+	case c = <-p.idle:
+	default:
+		var err error
+		if c, err = osquery.NewClient(p.socket, p.timeout); err != nil {
+			return nil, fmt.Errorf("connect to osqueryd at %s: %w", p.socket, err)
+		}
+	}
+	ctx, cancel := context.WithTimeout(ctx, p.timeout)
+	defer cancel()
+	rows, err := c.QueryRowsContext(ctx, sql)
+	p.put(c, err == nil)
+	return rows, err
+}
+
+// put returns c to the pool, or closes it
+func (p *osqueryPool) put(c *osquery.ExtensionManagerClient, ok bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if ok && !p.closed {
+		select {
+		case p.idle <- c:
+			return
+		default:
+		}
+	}
+	c.Close()
+}
+
+// Close closes the idle connections, and the rest as they come back
+func (p *osqueryPool) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.closed = true
+	for {
+		select {
+		case c := <-p.idle:
+			c.Close()
+		default:
+			return nil
+		}
+	}
+}
+
+// osqueryProvider is the osquery source's provider
+type osqueryProvider struct {
+	refreshedScore
+	src  OSQueryConfig // as configured, to tell a changed config
+	cfg  OSQueryConfig // defaulted
+	pool *osqueryPool
+}
+
+func newOSQueryProvider(src *OSQueryConfig) *osqueryProvider {
+	cfg := src.withDefaults()
+	p := &osqueryProvider{src: *src, cfg: cfg, pool: newOSQueryPool(cfg.Socket, cfg.Pool, cfg.Timeout)}
+	p.refreshedScore = refreshedScore{
+		name:    cfg.Name,
+		weight:  cfg.Weight,
+		every:   cfg.Every,
+		timeout: cfg.Timeout * time.Duration(len(cfg.Queries)+1),
+		maxAge:  cfg.MaxAge,
+		refresh: p.refresh,
+	}
+	return p
+}
+
+func (p *osqueryProvider) source() any  { return p.src }
+func (p *osqueryProvider) Close() error { return p.pool.Close() }
+
+// refresh runs the queries, as many at once as the pool allows
+func (p *osqueryProvider) refresh(ctx context.Context) (float64, error) {
+	names := make([]string, 0, len(p.cfg.Queries))
+	for name := range p.cfg.Queries {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	counts := make([]int, len(names))
+	errs := make([]error, len(names))
+	var wg sync.WaitGroup
+	for i, name := range names {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			rows, err := p.pool.query(ctx, p.cfg.Queries[name].SQL)
+			counts[i], errs[i] = len(rows), err
+		}()
+	}
+	wg.Wait()
+
+	score := 1.0
+	for i, name := range names {
+		if errs[i] != nil {
+			return 0, fmt.Errorf("query %s: %w", name, errs[i])
+		}
+		q := p.cfg.Queries[name]
+		s := q.score(counts[i])
+		if s < 1 {
+			slog.Debug("osquery query over allowance", "provider", p.cfg.Name, "query", name,
+				"rows", counts[i], "allow", q.Allow, "score", s)
+		}
+		score *= s
+	}
+	return score, nil
+}
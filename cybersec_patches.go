@@ -0,0 +1,440 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The patches source scores patch_latency from the age of the oldest
+// security patch this host - and, with a fleet inventory, any host - has
+// yet to install. The local package manager is asked what security
+// updates are pending: apt, dnf or Windows Update. A patch's age runs from
+// its release when the manager says, else from when it was first seen
+// pending. The score is 1 while the oldest is within Grace, and halves for
+// every HalfAt beyond.
+
+// Package managers
+const (
+	PatchAuto    = "auto"
+	PatchApt     = "apt"
+	PatchDnf     = "dnf"
+	PatchWindows = "windows"
+	PatchNone    = "none" // the fleet inventory alone
+)
+
+const (
+	defaultPatchGrace   = 7 * 24 * time.Hour
+	defaultPatchHalfAt  = 7 * 24 * time.Hour
+	defaultPatchEvery   = time.Hour
+	defaultPatchMaxAge  = 6 * time.Hour
+	defaultPatchTimeout = 5 * time.Minute
+)
+
+// PatchConfig configures the patches source. Zero fields take their
+// defaults.
+type PatchConfig struct {
+	// Manager is auto (the default), apt, dnf, windows or none. apt reads
+	// the package lists as they are; keep them fresh with apt's timers.
+	Manager string `yaml:"manager"`
+
+	// Fleet is an inventory endpoint answering GET with the missing
+	// patches of each host; FleetAuth authenticates to it
+	Fleet     string     `yaml:"fleet"`
+	FleetAuth SourceAuth `yaml:"fleet_auth"`
+
+	// State is a file first-seen times are kept in across restarts
+	State string `yaml:"state"`
+
+	// Grace is how old the oldest missing patch may be and still score 1,
+	// 7 days by default; each HalfAt beyond halves the score, 7 days by
+	// default
+	Grace  time.Duration `yaml:"grace"`
+	HalfAt time.Duration `yaml:"half_at"`
+
+	// Every paces the check, 1h by default, and Timeout bounds it, 5m by
+	// default; the provider fails once its last good check is MaxAge old,
+	// 6h by default
+	Every   time.Duration `yaml:"every"`
+	Timeout time.Duration `yaml:"timeout"`
+	MaxAge  time.Duration `yaml:"max_age"`
+}
+
+func (c *PatchConfig) validate() error {
+	switch c.Manager {
+	case "", PatchAuto, PatchApt, PatchDnf, PatchWindows:
+	case PatchNone:
+		if c.Fleet == "" {
+			return fmt.Errorf("manager none needs a fleet inventory")
+		}
+	default:
+		return fmt.Errorf("unknown manager %q", c.Manager)
+	}
+	if c.Fleet != "" {
+		u, err := url.Parse(c.Fleet)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("fleet %q must be an http or https url", c.Fleet)
+		}
+	}
+	if err := c.FleetAuth.validate(); err != nil {
+		return err
+	}
+	if c.Grace < 0 || c.HalfAt < 0 || c.Every < 0 || c.Timeout < 0 || c.MaxAge < 0 {
+		return fmt.Errorf("grace, half_at, every, timeout and max_age must be non-negative")
+	}
+	return nil
+}
+
+// withDefaults returns c with its zero fields defaulted
+func (c PatchConfig) withDefaults() PatchConfig {
+	if c.Manager == "" || c.Manager == PatchAuto {
+		c.Manager = detectPatchManager()
+	}
+	if c.Grace == 0 {
+		c.Grace = defaultPatchGrace
+	}
+	if c.HalfAt == 0 {
+		c.HalfAt = defaultPatchHalfAt
+	}
+	if c.Every == 0 {
+		c.Every = defaultPatchEvery
+	}
+	if c.Timeout == 0 {
+		c.Timeout = defaultPatchTimeout
+	}
+	if c.MaxAge == 0 {
+		c.MaxAge = defaultPatchMaxAge
+	}
+	return c
+}
+
+// detectPatchManager picks the local package manager; none found is an
+// error at refresh, not here, so a config validates anywhere
+func detectPatchManager() string {
+	if runtime.GOOS == "windows" {
+		return PatchWindows
+	}
+	for _, m := range []string{PatchApt, PatchDnf} {
+		bin := m + "-get"
+		if m == PatchDnf {
+			bin = "dnf"
+		}
+		if _, err := exec.LookPath(bin); err == nil {
+			return m
+		}
+	}
+	return PatchAuto
+}
+
+// MissingPatch is a security patch a host hasn't installed
+type MissingPatch struct {
+	ID       string    `json:"id"`
+	Released time.Time `json:"released"` // zero when unknown
+}
+
+// FleetPatches is the body a fleet inventory answers with
+type FleetPatches struct {
+	Hosts []struct {
+		Host    string         `json:"host"`
+		Missing []MissingPatch `json:"missing"`
+	} `json:"hosts"`
+}
+
+// runSourceCommand runs a command a source queries; tests replace it
+var runSourceCommand = func(ctx context.Context, name string, args ...string) ([]byte, error) {
+	cmd := exec.CommandContext(ctx, name, args...)
+	cmd.Env = append(os.Environ(), "LC_ALL=C")
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			const max = 200
+			if len(msg) > max {
+				msg = msg[:max] + "..."
+			}
+			return out, fmt.Errorf("%s: %w: %s", name, err, msg)
+		}
+		return out, fmt.Errorf("%s: %w", name, err)
+	}
+	return out, nil
+}
+
+// aptMissing lists pending security upgrades from a simulated upgrade:
+//
+//	Inst openssl [3.0.11-1~deb12u1] (3.0.13-1~deb12u1 Debian-Security:12/stable-security [amd64])
+func aptMissing(ctx context.Context) ([]MissingPatch, error) {
+	out, err := runSourceCommand(ctx, "apt-get", "-s", "-o", "Debug::NoLocking=1", "dist-upgrade")
+	if err != nil {
+		return nil, err
+	}
+	var missing []MissingPatch
+	sc := bufio.NewScanner(bytes.NewReader(out))
+	for sc.Scan() {
+		line := sc.Text()
+		if !strings.HasPrefix(line, "Inst ") {
+			continue
+		}
+		f := strings.Fields(line)
+		open := strings.IndexByte(line, '(')
+		if len(f) < 2 || open < 0 || !strings.Contains(strings.ToLower(line[open:]), "security") {
+			continue
+		}
+		version, _, _ := strings.Cut(line[open+1:], " ")
+		missing = append(missing, MissingPatch{ID: f[1] + "=" + version})
+	}
+	return missing, sc.Err()
+}
+
+// dnfMissing lists pending security advisories, with their issue dates
+func dnfMissing(ctx context.Context) ([]MissingPatch, error) {
+	out, err := runSourceCommand(ctx, "dnf", "-q", "updateinfo", "info", "--security", "--available")
+	if err != nil {
+		return nil, err
+	}
+	var missing []MissingPatch
+	var cur *MissingPatch
+	sc := bufio.NewScanner(bytes.NewReader(out))
+	for sc.Scan() {
+		key, value, ok := strings.Cut(sc.Text(), ":")
+		if !ok {
+			continue
+		}
+		key, value = strings.TrimSpace(key), strings.TrimSpace(value)
+		switch key {
+		case "Update ID":
+			missing = append(missing, MissingPatch{ID: value})
+			cur = &missing[len(missing)-1]
+		case "Issued", "Updated":
+			if cur == nil || (key == "Updated" && !cur.Released.IsZero()) {
+				continue
+			}
+			if t, err := time.ParseInLocation("2006-01-02 15:04:05", value, time.Local); err == nil {
+				cur.Released = t
+			} else if t, err := time.ParseInLocation("2006-01-02", value, time.Local); err == nil {
+				cur.Released = t
+			}
+		}
+	}
+	return missing, sc.Err()
+}
+
+// windowsUpdateQuery lists pending security updates with the Windows
+// Update agent, as JSON
+const windowsUpdateQuery = `$ErrorActionPreference = 'Stop'
+$r = (New-Object -ComObject Microsoft.Update.Session).CreateUpdateSearcher().Search("IsInstalled=0 and IsHidden=0 and Type='Software'")
+$u = @($r.Updates | Where-Object { @($_.Categories | Where-Object { $_.Name -eq 'Security Updates' }).Count -gt 0 } |
+  ForEach-Object { [pscustomobject]@{ id = $_.Identity.UpdateID; released = $_.LastDeploymentChangeTime.ToUniversalTime().ToString('o') } })
+ConvertTo-Json -Compress -InputObject $u`
+
+func windowsMissing(ctx context.Context) ([]MissingPatch, error) {
+	out, err := runSourceCommand(ctx, "powershell.exe", "-NoProfile", "-NonInteractive", "-Command", windowsUpdateQuery)
+	if err != nil {
+		return nil, err
+	}
+	var missing []MissingPatch
+	if out = bytes.TrimSpace(out); len(out) > 0 {
+		if err := json.Unmarshal(out, &missing); err != nil {
+			return nil, fmt.Errorf("windows update: %w", err)
+		}
+	}
+	return missing, nil
+}
+
+// patchesSeen is when each patch was first seen missing, by host and ID,
+// kept across reloads of the source and, with State, restarts
+type patchesSeen struct {
+	mu     sync.Mutex
+	seen   map[string]time.Time
+	loaded string // the state file loaded, if any
+}
+
+var harmonyPatchesSeen = &patchesSeen{seen: make(map[string]time.Time)}
+
+// age returns how long each host's patches have been missing, forgetting
+// those no longer missing
+func (s *patchesSeen) age(state string, missing map[string][]MissingPatch, now time.Time) map[string]time.Duration {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if state != "" && s.loaded != state {
+		s.load(state)
+	}
+	ages := make(map[string]time.Duration, len(missing))
+	still := make(map[string]time.Time)
+	for host, patches := range missing {
+		for _, p := range patches {
+			key := host + "\x00" + p.ID
+			first, ok := s.seen[key]
+			if !ok {
+				first = now
+			}
+			still[key] = first
+			since := first
+			if !p.Released.IsZero() && p.Released.Before(since) {
+				since = p.Released
+			}
+			ages[host] = max(ages[host], now.Sub(since))
+		}
+	}
+	s.seen = still
+	if state != "" {
+		s.save(state)
+	}
+	return ages
+}
+
+func (s *patchesSeen) load(path string) {
+	s.loaded = path
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return
+	}
+	var seen map[string]time.Time
+	if err == nil {
+		err = json.Unmarshal(data, &seen)
+	}
+	if err != nil {
+		slog.Warn("patch state not loaded", "path", path, "err", err)
+		return
+	}
+	for k, t := range seen {
+		if old, ok := s.seen[k]; !ok || t.Before(old) {
+			s.seen[k] = t
+		}
+	}
+}
+
+func (s *patchesSeen) save(path string) {
+	data, err := json.Marshal(s.seen)
+	if err == nil {
+		err = os.MkdirAll(filepath.Dir(path), 0o700)
+	}
+	if err == nil {
+		err = os.WriteFile(path+".tmp", data, 0o600)
+	}
+	if err == nil {
+		err = os.Rename(path+".tmp", path)
+	}
+	if err != nil {
+		slog.Warn("patch state not saved", "path", path, "err", err)
+	}
+}
+
+// patchProvider is the patches source's patch_latency provider
+type patchProvider struct {
+	refreshedScore
+	src    PatchConfig // as configured, to tell a changed config
+	cfg    PatchConfig // defaulted
+	client *http.Client
+}
+
+func newPatchProvider(src *PatchConfig) *patchProvider {
+	cfg := src.withDefaults()
+	p := &patchProvider{src: *src, cfg: cfg, client: &http.Client{}}
+	p.refreshedScore = refreshedScore{
+		name:    "patch_latency",
+		weight:  builtinWeight("patch_latency"),
+		every:   cfg.Every,
+		timeout: cfg.Timeout,
+		maxAge:  cfg.MaxAge,
+		refresh: p.refresh,
+	}
+	return p
+}
+
+func (p *patchProvider) source() any { return p.src }
+
+func (p *patchProvider) refresh(ctx context.Context) (float64, error) {
+	missing := map[string][]MissingPatch{}
+	if p.cfg.Manager != PatchNone {
+		var local []MissingPatch
+		var err error
+		switch p.cfg.Manager {
+		case PatchApt:
+			local, err = aptMissing(ctx)
+		case PatchDnf:
+			local, err = dnfMissing(ctx)
+		case PatchWindows:
+			local, err = windowsMissing(ctx)
+		default:
+			err = fmt.Errorf("no apt, dnf or windows update found")
+		}
+		if err != nil {
+			return 0, err
+		}
+		missing[""] = local
+	}
+	if p.cfg.Fleet != "" {
+		fleet, err := p.fleet(ctx)
+		if err != nil {
+			return 0, fmt.Errorf("fleet inventory: %w", err)
+		}
+		for _, h := range fleet.Hosts {
+			if h.Host != "" {
+				missing[h.Host] = append(missing[h.Host], h.Missing...)
+			}
+		}
+	}
+
+	ages := harmonyPatchesSeen.age(p.cfg.State, missing, harmonyClock.Now())
+	var oldest time.Duration
+	worst := ""
+	for host, age := range ages {
+		if age > oldest {
+			oldest, worst = age, host
+		}
+	}
+	if worst == "" {
+		worst = "localhost"
+	}
+	score := 1.0
+	if over := oldest - p.cfg.Grace; over > 0 {
+		score = math.Pow(0.5, float64(over)/float64(p.cfg.HalfAt))
+	}
+	n := 0
+	for _, m := range missing {
+		n += len(m)
+	}
+	slog.Debug("patch latency refreshed", "hosts", len(missing), "missing", n,
+		"oldest", oldest.Round(time.Hour), "host", worst, "score", score)
+	return score, nil
+}
+
+func (p *patchProvider) fleet(ctx context.Context) (*FleetPatches, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, p.cfg.Fleet, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+	if err := p.cfg.FleetAuth.authorize(req, "Bearer"); err != nil {
+		return nil, err
+	}
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return nil, fmt.Errorf("answered %s", resp.Status)
+	}
+	var fleet FleetPatches
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 64<<20)).Decode(&fleet); err != nil {
+		return nil, err
+	}
+	return &fleet, nil
+}
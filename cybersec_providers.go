@@ -0,0 +1,284 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"sync"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// ScoreProvider supplies one weighted input to mu. Collect returns a score
+// in [0, 1], or a raw output the config calibrates to one; calculateMu
+// clamps anything outside.
+type ScoreProvider interface {
+	Name() string
+	Weight() float64
+	Collect(ctx context.Context) (float64, error)
+}
+
+// ScoreFunc adapts a plain query function to ScoreProvider
+type ScoreFunc struct {
+	name   string
+	weight float64
+	query  func() float64
+}
+
+func NewScoreFunc(name string, weight float64, query func() float64) *ScoreFunc {
+	return &ScoreFunc{name: name, weight: weight, query: query}
+}
+
+func (f *ScoreFunc) Name() string                             { return f.name }
+func (f *ScoreFunc) Weight() float64                          { return f.weight }
+func (f *ScoreFunc) Collect(context.Context) (float64, error) { return f.query(), nil }
+
+// reweighted overrides the weight of a registered provider
+type reweighted struct {
+	ScoreProvider
+	weight float64
+}
+
+func (r reweighted) Weight() float64 { return r.weight }
+
+// baseWeight is p's weight as registered, before any Reweight
+func baseWeight(p ScoreProvider) float64 {
+	if rw, ok := p.(reweighted); ok {
+		return rw.ScoreProvider.Weight()
+	}
+	return p.Weight()
+}
+
+// ProviderRegistry holds the providers polled on every tick, in
+// registration order
+type ProviderRegistry struct {
+	mu        sync.RWMutex
+	providers []ScoreProvider
+
+	stateMu sync.Mutex
+	states  map[string]*providerState
+}
+
+var harmonyProviders = newDefaultProviders()
+
+// newDefaultProviders registers the built-in providers. Each scores
+// nothing until its source is configured, so until then it fails and its
+// stale policy applies.
+func newDefaultProviders() *ProviderRegistry {
+	r := &ProviderRegistry{}
+	r.Register(unsourced{"soc_alert_coherence", 0.30, "siem"})
+	r.Register(unsourced{"patch_latency", 0.25, "patches"})
+	r.Register(unsourced{"zero_day_exposure", 0.20, "nvd"})
+	r.Register(unsourced{"firewall_rules_entropy", 0.15, "firewall"})
+	r.Register(unsourced{"red_team_dwell_time", 0.10, "redteam"})
+	return r
+}
+
+var errNoSource = errors.New("no source configured")
+
+// unsourced is a built-in provider whose source isn't configured
+type unsourced struct {
+	name   string
+	weight float64
+	source string // the kind of source that scores it
+}
+
+func (u unsourced) Name() string    { return u.name }
+func (u unsourced) Weight() float64 { return u.weight }
+func (u unsourced) Collect(context.Context) (float64, error) {
+	return 0, fmt.Errorf("%w: set sources.%s", errNoSource, u.source)
+}
+
+// Register adds p, replacing any provider with the same name in place
+func (r *ProviderRegistry) Register(p ScoreProvider) error {
+	if p.Name() == "" {
+		return fmt.Errorf("score provider needs a name")
+	}
+	if w := p.Weight(); w < 0 || math.IsNaN(w) || math.IsInf(w, 0) {
+		return fmt.Errorf("score provider %s: invalid weight %v", p.Name(), w)
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if i := r.index(p.Name()); i >= 0 {
+		r.providers[i] = p
+		return nil
+	}
+	r.providers = append(r.providers, p)
+	return nil
+}
+
+// Remove drops the named provider and reports whether it was registered
+func (r *ProviderRegistry) Remove(name string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	i := r.index(name)
+	if i < 0 {
+		return false
+	}
+	r.providers = append(r.providers[:i:i], r.providers[i+1:]...)
+	return true
+}
+
+// Reweight changes the weight of the named provider
+func (r *ProviderRegistry) Reweight(name string, weight float64) error {
+	if weight < 0 || math.IsNaN(weight) || math.IsInf(weight, 0) {
+		return fmt.Errorf("score provider %s: invalid weight %v", name, weight)
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	i := r.index(name)
+	if i < 0 {
+		return fmt.Errorf("no score provider %s", name)
+	}
+	p := r.providers[i]
+	if rw, ok := p.(reweighted); ok {
+		p = rw.ScoreProvider
+	}
+	r.providers[i] = reweighted{p, weight}
+	return nil
+}
+
+// setWeights overrides the weights of the named providers and restores
+// the registered weight of every other provider
+func (r *ProviderRegistry) setWeights(weights map[string]float64) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for name := range weights {
+		if r.index(name) < 0 {
+			return fmt.Errorf("no score provider %s", name)
+		}
+	}
+	for i, p := range r.providers {
+		if rw, ok := p.(reweighted); ok {
+			p = rw.ScoreProvider
+		}
+		if w, ok := weights[p.Name()]; ok {
+			r.providers[i] = reweighted{p, w}
+		} else {
+			r.providers[i] = p
+		}
+	}
+	return nil
+}
+
+// setProviders replaces the registered providers with providers
+func (r *ProviderRegistry) setProviders(providers []ScoreProvider) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.providers = providers
+}
+
+// Providers returns the registered providers in order
+func (r *ProviderRegistry) Providers() []ScoreProvider {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return append([]ScoreProvider(nil), r.providers...)
+}
+
+// weight returns the named provider's weight, 0 if it isn't registered
+func (r *ProviderRegistry) weight(name string) float64 {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if i := r.index(name); i >= 0 {
+		return r.providers[i].Weight()
+	}
+	return 0
+}
+
+func (r *ProviderRegistry) index(name string) int {
+	for i, p := range r.providers {
+		if p.Name() == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// Collect polls the providers concurrently under cfg, at most its
+// Parallelism at a time, each under its policy's deadline. Weights
+// are normalized to sum to 1 so removing a provider doesn't shift mu
+// against the threshold. A provider that fails or times out is scored by
+// its stale policy, 0 by default, which fails the tick closed, and listed
+// in Degraded. Each poll is traced as a child span of ctx.
+func (r *ProviderRegistry) Collect(ctx context.Context, cfg *HarmonyConfig) *CyberSecContext {
+	providers := r.Providers()
+	c := &CyberSecContext{
+		Names:   make([]string, 0, len(providers)),
+		Scores:  make([]float64, 0, len(providers)),
+		Weights: make([]float64, 0, len(providers)),
+	}
+	results := make([]collected, len(providers))
+	sem := make(chan struct{}, cfg.Parallelism)
+	var wg sync.WaitGroup
+	for i, p := range providers {
+		sem <- struct{}{}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+			results[i] = r.collectOne(ctx, p, cfg)
+		}()
+	}
+	wg.Wait()
+
+	total := 0.0
+	for i, p := range providers {
+		res := results[i]
+		if res.policy != "" {
+			c.Degraded = append(c.Degraded, p.Name()+":"+res.policy)
+		}
+		if res.skip {
+			continue
+		}
+		c.Names = append(c.Names, p.Name())
+		c.Scores = append(c.Scores, res.score)
+		c.Weights = append(c.Weights, p.Weight())
+		total += p.Weight()
+	}
+	if total > 0 {
+		for i := range c.Weights {
+			c.Weights[i] /= total
+		}
+	}
+	return c
+}
+
+// collected is one provider's part of a cycle
+type collected struct {
+	score  float64
+	policy string // the stale policy applied, if the query failed
+	skip   bool
+}
+
+// collectOne polls p, traced as a child span of ctx
+func (r *ProviderRegistry) collectOne(ctx context.Context, p ScoreProvider, cfg *HarmonyConfig) collected {
+	pctx, span := harmonyTracer.Start(ctx, "harmony.provider",
+		trace.WithAttributes(attribute.String("harmony.provider", p.Name())))
+	defer span.End()
+	s, err := r.query(pctx, p, cfg.queryTimeout(p.Name()))
+	now := harmonyClock.Now()
+	if err == nil {
+		if cal, ok := cfg.calibrate(p.Name(), s); ok {
+			span.SetAttributes(attribute.Float64("harmony.raw_score", s))
+			s = cal
+		}
+		r.good(p.Name(), s, now)
+		span.SetAttributes(attribute.Float64("harmony.score", s))
+		return collected{score: s}
+	}
+	s, keep, policy := r.stale(p.Name(), cfg.providerPolicy(p.Name()), now)
+	slog.WarnContext(ctx, "score provider failed", "provider", p.Name(), "err", err, "stale", policy, "score", s)
+	harmonyAlerts.providerError(ctx, p.Name(), err)
+	harmonyMetrics.observeDegraded(p.Name(), policy)
+	span.RecordError(err)
+	span.SetStatus(codes.Error, err.Error())
+	span.SetAttributes(attribute.String("harmony.stale", policy))
+	if keep {
+		span.SetAttributes(attribute.Float64("harmony.score", s))
+	}
+	return collected{score: s, policy: policy, skip: !keep}
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestBuiltinProvidersNeedSources(t *testing.T) {
+	r := newDefaultProviders()
+	for _, p := range r.Providers() {
+		if _, err := p.Collect(context.Background()); !errors.Is(err, errNoSource) {
+			t.Errorf("%s without a source: got %v, want %v", p.Name(), err, errNoSource)
+		}
+	}
+
+	src := &SourcesConfig{RedTeam: &RedTeamConfig{}}
+	if _, _, err := src.apply(r); err != nil {
+		t.Fatal(err)
+	}
+	p, _ := r.lookup("red_team_dwell_time")
+	if _, ok := p.(*redTeamProvider); !ok {
+		t.Fatalf("redteam source registered %T", p)
+	}
+	(&SourcesConfig{}).apply(r)
+	p, _ = r.lookup("red_team_dwell_time")
+	if _, ok := p.(unsourced); !ok {
+		t.Errorf("dropping the source left %T, want the unsourced built-in", p)
+	}
+}
@@ -0,0 +1,380 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kswhitlock9493-jpg/SR-AIbridge-/src/forgeauth"
+)
+
+// In a fleet every node publishes its decision to a coordinator, which
+// declares a fleet-wide decision only when enough nodes agree, so one
+// node's bad sensor doesn't halt the fleet. The coordinator counts itself
+// and its configured members, each reporting under its token's NodeID. The fleet decision is the most severe one held, at that
+// severity or worse, by at least Fraction of the nodes reporting; with
+// fewer than MinNodes reporting there is no quorum and the fleet halts.
+
+const (
+	defaultQuorumMaxAge  = 5 * time.Second
+	quorumPublishTimeout = 2 * time.Second
+)
+
+// QuorumConfig joins the node to a fleet
+type QuorumConfig struct {
+	// Node names this node to the coordinator, which takes the name only
+	// from the NodeID of Token; empty means the hostname
+	Node string `yaml:"node"`
+
+	// Coordinator is the status API URL of the coordinator this node
+	// publishes its decisions to; empty publishes nothing. Token is the
+	// ForgeToken it publishes with; $VARS are expanded.
+	Coordinator string `yaml:"coordinator"`
+	Token       string `yaml:"token"`
+
+	// Coordinate makes this node the coordinator, accepting reports on
+	// POST /harmony/quorum/report and serving GET /harmony/quorum
+	Coordinate bool `yaml:"coordinate"`
+
+	// Members are the other nodes the coordinator counts, by NodeID;
+	// reports from any other node are refused
+	Members []string `yaml:"members"`
+
+	// Fraction of the reporting nodes that must agree on a decision for
+	// the fleet to take it
+	Fraction float64 `yaml:"fraction"`
+
+	// MinNodes is how many nodes must be reporting for a quorum
+	MinNodes int `yaml:"min_nodes"`
+
+	// MaxAge is how long a node's last report counts for
+	MaxAge time.Duration `yaml:"max_age"`
+}
+
+func defaultQuorumConfig() QuorumConfig {
+	return QuorumConfig{Fraction: 0.5, MinNodes: 1, MaxAge: defaultQuorumMaxAge}
+}
+
+func (q *QuorumConfig) validate() error {
+	if q.Coordinator != "" {
+		u, err := url.Parse(q.Coordinator)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("quorum coordinator %q must be an http or https url", q.Coordinator)
+		}
+	}
+	if !(q.Fraction > 0 && q.Fraction <= 1) {
+		return fmt.Errorf("quorum fraction %v must be in (0, 1]", q.Fraction)
+	}
+	if q.MinNodes < 1 {
+		return fmt.Errorf("quorum min_nodes %d must be at least 1", q.MinNodes)
+	}
+	if q.MaxAge <= 0 {
+		return fmt.Errorf("quorum max_age %v must be positive", q.MaxAge)
+	}
+	seen := make(map[string]bool, len(q.Members))
+	for _, m := range q.Members {
+		if m == "" || seen[m] {
+			return fmt.Errorf("quorum members must be distinct node names, not %q", m)
+		}
+		seen[m] = true
+	}
+	if q.Coordinate && q.MinNodes > len(q.Members)+1 {
+		return fmt.Errorf("quorum min_nodes %d is more than the coordinator and its %d members", q.MinNodes, len(q.Members))
+	}
+	return nil
+}
+
+// counted returns the nodes the coordinator counts: its members and itself
+func (q *QuorumConfig) counted() map[string]bool {
+	nodes := make(map[string]bool, len(q.Members)+1)
+	for _, m := range q.Members {
+		nodes[m] = true
+	}
+	nodes[q.node()] = true
+	return nodes
+}
+
+// node returns the name the node reports under
+func (q *QuorumConfig) node() string {
+	if q.Node != "" {
+		return q.Node
+	}
+	host, err := os.Hostname()
+	if err != nil {
+		return "unknown"
+	}
+	return host
+}
+
+// QuorumReport is one node's decision for one cycle
+type QuorumReport struct {
+	Node     string    `json:"node"`
+	Cycle    uint64    `json:"cycle"`
+	Time     time.Time `json:"time"`
+	Mu       float64   `json:"mu"`
+	Decision string    `json:"decision"`
+	CH       bool      `json:"ch"`
+
+	// Received is when the coordinator got it, by the coordinator's clock
+	Received time.Time `json:"received"`
+}
+
+// FleetStatus is the body of GET /harmony/quorum
+type FleetStatus struct {
+	Decision string         `json:"decision"`
+	Quorum   bool           `json:"quorum"`   // enough nodes are reporting
+	Nodes    int            `json:"nodes"`    // nodes reporting
+	Halting  int            `json:"halting"`  // of those, nodes halting
+	Fraction float64        `json:"fraction"` // the fraction needed
+	Reports  []QuorumReport `json:"reports"`
+}
+
+// quorumCoordinator keeps the last report of each node
+type quorumCoordinator struct {
+	mu      sync.Mutex
+	reports map[string]QuorumReport
+	last    string // the last fleet decision
+}
+
+var harmonyQuorum = &quorumCoordinator{reports: make(map[string]QuorumReport), last: DecisionGo}
+
+func (q *quorumCoordinator) report(r QuorumReport) {
+	r.Received = harmonyClock.Now()
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.reports[r.Node] = r
+}
+
+// status decides for the fleet from the reports of counted nodes no older
+// than cfg.MaxAge, dropping the rest
+func (q *quorumCoordinator) status(cfg *QuorumConfig) FleetStatus {
+	now := harmonyClock.Now()
+	counted := cfg.counted()
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	st := FleetStatus{Decision: DecisionGo, Fraction: cfg.Fraction}
+	atLeast := make([]int, severity(DecisionHalt)+1)
+	for node, r := range q.reports {
+		if !counted[node] || now.Sub(r.Received) > cfg.MaxAge {
+			delete(q.reports, node)
+			continue
+		}
+		st.Reports = append(st.Reports, r)
+		for s := severity(r.Decision); s >= 0; s-- {
+			atLeast[s]++
+		}
+	}
+	sort.Slice(st.Reports, func(i, j int) bool { return st.Reports[i].Node < st.Reports[j].Node })
+	st.Nodes = len(st.Reports)
+	st.Halting = atLeast[severity(DecisionHalt)]
+	st.Quorum = st.Nodes >= cfg.MinNodes
+	if !st.Quorum {
+		st.Decision = DecisionHalt
+		return st
+	}
+	for _, d := range []string{DecisionHalt, DecisionDegraded, DecisionCaution} {
+		if float64(atLeast[severity(d)]) >= cfg.Fraction*float64(st.Nodes) {
+			st.Decision = d
+			break
+		}
+	}
+	return st
+}
+
+// observe counts the coordinator's own cycle and alerts on a change of
+// fleet decision. The loop calls it every cycle.
+func (q *quorumCoordinator) observe(ctx context.Context, rec CycleRecord, cfg *QuorumConfig) {
+	q.report(QuorumReport{Node: cfg.node(), Cycle: rec.Cycle, Time: rec.Time, Mu: rec.Mu, Decision: rec.Decision, CH: rec.CH})
+	st := q.status(cfg)
+	q.mu.Lock()
+	prev := q.last
+	q.last = st.Decision
+	q.mu.Unlock()
+	harmonyMetrics.observeFleet(st)
+	if st.Decision == prev {
+		return
+	}
+	summary := fmt.Sprintf("fleet %s (was %s), %d of %d nodes halting", st.Decision, prev, st.Halting, st.Nodes)
+	if !st.Quorum {
+		summary = fmt.Sprintf("fleet %s: no quorum, %d of %d nodes reporting", st.Decision, st.Nodes, cfg.MinNodes)
+	}
+	slog.WarnContext(ctx, "fleet decision changed", "decision", st.Decision, "previous", prev,
+		"nodes", st.Nodes, "halting", st.Halting, "quorum", st.Quorum)
+	harmonyAlerts.raise(ctx, Alert{
+		Kind:     AlertDecision,
+		Context:  "fleet",
+		Subject:  st.Decision,
+		Previous: prev,
+		Severity: decisionSeverity(st.Decision),
+		Resolved: st.Decision == DecisionGo,
+		Summary:  summary,
+		Cycle:    rec.Cycle,
+		Time:     rec.Time,
+	})
+}
+
+// serveQuorumReport answers POST /harmony/quorum/report, counting the
+// report for the token's node if it's a member. A report that names no
+// node is the token's.
+func serveQuorumReport(w http.ResponseWriter, r *http.Request) {
+	cfg := activeConfig().Quorum
+	if !cfg.Coordinate {
+		http.Error(w, "not a quorum coordinator", http.StatusNotFound)
+		return
+	}
+	t, ok := forgeauth.TokenFromContext(r.Context())
+	if !ok {
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return
+	}
+	var rep QuorumReport
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<16)).Decode(&rep); err != nil {
+		http.Error(w, "bad quorum report: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if rep.Node == "" {
+		rep.Node = t.NodeID
+	}
+	switch {
+	case rep.Node != t.NodeID:
+		http.Error(w, fmt.Sprintf("quorum report for node %q with a token of node %q", rep.Node, t.NodeID), http.StatusForbidden)
+		return
+	case rep.Node == cfg.node():
+		http.Error(w, fmt.Sprintf("node %q is the coordinator", rep.Node), http.StatusForbidden)
+		return
+	case !slices.Contains(cfg.Members, rep.Node):
+		http.Error(w, fmt.Sprintf("node %q is not a quorum member", rep.Node), http.StatusForbidden)
+		return
+	}
+	switch rep.Decision {
+	case DecisionGo, DecisionCaution, DecisionDegraded, DecisionHalt:
+	default:
+		http.Error(w, "unknown decision "+rep.Decision, http.StatusBadRequest)
+		return
+	}
+	harmonyQuorum.report(rep)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// serveQuorum answers GET /harmony/quorum
+func serveQuorum(w http.ResponseWriter, r *http.Request) {
+	cfg := activeConfig().Quorum
+	if !cfg.Coordinate {
+		http.Error(w, "not a quorum coordinator", http.StatusNotFound)
+		return
+	}
+	writeJSON(w, harmonyQuorum.status(&cfg))
+}
+
+// quorumPublisher sends each cycle's decision to the coordinator in the
+// background. Only the latest cycle waits to be sent: a node that can't
+// keep up skips cycles rather than falling behind.
+type quorumPublisher struct {
+	next    chan QuorumReport
+	done    chan struct{}
+	client  *http.Client
+	failing bool // only touched by run
+}
+
+var harmonyPublisher = newQuorumPublisher()
+
+func newQuorumPublisher() *quorumPublisher {
+	p := &quorumPublisher{
+		next:   make(chan QuorumReport, 1),
+		done:   make(chan struct{}),
+		client: &http.Client{Timeout: quorumPublishTimeout},
+	}
+	go p.run()
+	return p
+}
+
+// publish queues rec for the coordinator, replacing any cycle not yet sent
+func (p *quorumPublisher) publish(rec CycleRecord, cfg *QuorumConfig) {
+	if cfg.Coordinator == "" {
+		return
+	}
+	rep := QuorumReport{Node: cfg.node(), Cycle: rec.Cycle, Time: rec.Time, Mu: rec.Mu, Decision: rec.Decision, CH: rec.CH}
+	for {
+		select {
+		case p.next <- rep:
+			return
+		default:
+		}
+		select {
+		case <-p.next:
+		default:
+		}
+	}
+}
+
+func (p *quorumPublisher) run() {
+	for {
+		select {
+		case <-p.done:
+			return
+		case rep := <-p.next:
+			err := p.send(rep)
+			switch {
+			case err != nil && !p.failing:
+				slog.Warn("quorum report not delivered", "err", err)
+			case err == nil && p.failing:
+				slog.Info("quorum reports delivered again")
+			}
+			p.failing = err != nil
+		}
+	}
+}
+
+func (p *quorumPublisher) send(rep QuorumReport) error {
+	cfg := activeConfig().Quorum
+	if cfg.Coordinator == "" {
+		return nil
+	}
+	body, err := json.Marshal(rep)
+	if err != nil {
+		return fmt.Errorf("encode quorum report: %w", err)
+	}
+	req, err := http.NewRequest(http.MethodPost, strings.TrimSuffix(cfg.Coordinator, "/")+"/harmony/quorum/report", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if token := os.ExpandEnv(cfg.Token); token != "" {
+		req.Header.Set(forgeTokenHeader, token)
+	}
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("coordinator answered %s", resp.Status)
+	}
+	return nil
+}
+
+// Close stops publishing
+func (p *quorumPublisher) Close() error {
+	close(p.done)
+	return nil
+}
+
+// observeQuorum takes a cycle's part in the fleet: publishing it, and on
+// the coordinator counting it
+func observeQuorum(ctx context.Context, hcfg *HarmonyConfig, rec CycleRecord) {
+	cfg := hcfg.Quorum
+	harmonyPublisher.publish(rec, &cfg)
+	if cfg.Coordinate {
+		harmonyQuorum.observe(ctx, rec, &cfg)
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestQuorumReportTakesTheTokensNode(t *testing.T) {
+	cfg := DefaultHarmonyConfig()
+	cfg.Quorum.Node = "coordinator"
+	cfg.Quorum.Coordinate = true
+	cfg.Quorum.Members = []string{"edge-01", "edge-02"}
+	old, oldQuorum := harmonyConfig.Swap(cfg), harmonyQuorum
+	t.Cleanup(func() { harmonyConfig.Store(old); harmonyQuorum = oldQuorum })
+	harmonyQuorum = &quorumCoordinator{reports: make(map[string]QuorumReport), last: DecisionGo}
+
+	f := newTestForge(t, HarmonyAPIScope, nil)
+	h := newHarmonyAPI(f.verifier)
+	tests := []struct {
+		name   string
+		token  string
+		body   string
+		status int
+	}{
+		{"read scope", f.token(t, "edge-01", HarmonyAPIScope), `{"decision": "CHANGE_HALT"}`, http.StatusForbidden},
+		{"another node's name", f.token(t, "edge-01", HarmonyQuorumReportScope), `{"node": "edge-02", "decision": "CHANGE_HALT"}`, http.StatusForbidden},
+		{"not a member", f.token(t, "edge-99", HarmonyQuorumReportScope), `{"decision": "CHANGE_HALT"}`, http.StatusForbidden},
+		{"the coordinator's name", f.token(t, "coordinator", HarmonyQuorumReportScope), `{"decision": "CHANGE_HALT"}`, http.StatusForbidden},
+		{"unknown decision", f.token(t, "edge-01", HarmonyQuorumReportScope), `{"decision": "MAYBE"}`, http.StatusBadRequest},
+		{"named", f.token(t, "edge-01", HarmonyQuorumReportScope), `{"node": "edge-01", "decision": "CHANGE_HALT"}`, http.StatusNoContent},
+		{"unnamed", f.token(t, "edge-02", HarmonyQuorumReportScope), `{"decision": "CHANGE_GO"}`, http.StatusNoContent},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if rec := serveWithToken(h, http.MethodPost, "/harmony/quorum/report", tt.token, tt.body); rec.Code != tt.status {
+				t.Errorf("status %d, want %d: %s", rec.Code, tt.status, rec.Body)
+			}
+		})
+	}
+
+	st := harmonyQuorum.status(&cfg.Quorum)
+	if st.Nodes != 2 || st.Halting != 1 {
+		t.Fatalf("%d nodes with %d halting, want edge-01 halting and edge-02 going: %+v", st.Nodes, st.Halting, st.Reports)
+	}
+	// A node dropped from the members no longer counts
+	cfg.Quorum.Members = []string{"edge-02"}
+	if st := harmonyQuorum.status(&cfg.Quorum); st.Nodes != 1 || st.Halting != 0 {
+		t.Errorf("after dropping edge-01: %d nodes with %d halting, want 1 and 0", st.Nodes, st.Halting)
+	}
+}
+
+func TestQuorumMembersConfig(t *testing.T) {
+	for _, members := range [][]string{{"edge-01", ""}, {"edge-01", "edge-01"}} {
+		q := defaultQuorumConfig()
+		q.Members = members
+		if q.validate() == nil {
+			t.Errorf("members %q: want an error", members)
+		}
+	}
+	q := defaultQuorumConfig()
+	q.Coordinate, q.MinNodes, q.Members = true, 3, []string{"edge-01"}
+	if q.validate() == nil {
+		t.Error("min_nodes 3 with one member: want an error")
+	}
+	q.Members = append(q.Members, "edge-02")
+	if err := q.validate(); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,380 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/hashicorp/raft"
+	raftboltdb "github.com/hashicorp/raft-boltdb/v2"
+)
+
+// With -raft-dir, 3 to 5 harmony nodes form a Raft group. Only the leader
+// evaluates and acts; each of its cycles, with the gate state that latches
+// a halt, and each config it applies are replicated, so a follower that
+// takes over after the leader is lost resumes with the same history,
+// config and enforcement state instead of starting from CHANGE_GO.
+// Followers stand by and serve the replicated history. The Raft transport
+// is unauthenticated and belongs on a private network.
+
+const (
+	raftApplyTimeout = 2 * time.Second
+	raftRetainSnaps  = 2
+)
+
+// Raft log commands
+const (
+	raftOpCycle  = "cycle"
+	raftOpConfig = "config"
+)
+
+// raftCommand is one replicated change
+type raftCommand struct {
+	Op     string          `json:"op"`
+	Record *CycleRecord    `json:"record,omitempty"`
+	Gates  *gateStates     `json:"gates,omitempty"`
+	Config json.RawMessage `json:"config,omitempty"` // a HarmonyConfig as JSON
+}
+
+// gateState is a haltGate as replicated
+type gateState struct {
+	Halted bool   `json:"halted"`
+	Bad    int    `json:"bad"`
+	Last   string `json:"last"`
+}
+
+// gateStates is the enforcement state: the single gate and each context's
+type gateStates struct {
+	Gate     gateState            `json:"gate"`
+	Contexts map[string]gateState `json:"contexts,omitempty"`
+}
+
+func (g *haltGate) state() gateState {
+	return gateState{Halted: g.halted, Bad: g.bad, Last: g.last}
+}
+
+func (s gateState) gate() *haltGate {
+	return &haltGate{halted: s.Halted, bad: s.Bad, last: s.Last}
+}
+
+// currentGates captures the loop's gates. Only the loop may call it.
+func currentGates() *gateStates {
+	gs := &gateStates{Gate: harmonyGate.state()}
+	if len(harmonyContextGates) > 0 {
+		gs.Contexts = make(map[string]gateState, len(harmonyContextGates))
+		for name, g := range harmonyContextGates {
+			gs.Contexts[name] = g.state()
+		}
+	}
+	return gs
+}
+
+// restoreGates replaces the loop's gates with gs. Only the loop may call
+// it.
+func restoreGates(gs gateStates) {
+	harmonyGate = *gs.Gate.gate()
+	harmonyContextGates = make(map[string]*haltGate, len(gs.Contexts))
+	for name, s := range gs.Contexts {
+		harmonyContextGates[name] = s.gate()
+	}
+}
+
+// harmonyRaft is the node's Raft group membership; nil without -raft-dir
+var harmonyRaft *raftNode
+
+type raftNode struct {
+	id    string
+	r     *raft.Raft
+	fsm   *harmonyFSM
+	store *raftboltdb.BoltStore
+	trans *raft.NetworkTransport
+
+	leading atomic.Bool // set by the loop once it leads
+}
+
+// openRaft joins the Raft group with state in dir, serving Raft on addr.
+// peers, as id=host:port,..., bootstraps a new group and is ignored once
+// dir holds state.
+func openRaft(dir, id, addr, peers string) (*raftNode, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, fmt.Errorf("create raft dir: %w", err)
+	}
+	store, err := raftboltdb.NewBoltStore(filepath.Join(dir, "raft.db"))
+	if err != nil {
+		return nil, fmt.Errorf("open raft store: %w", err)
+	}
+	snaps, err := raft.NewFileSnapshotStore(dir, raftRetainSnaps, os.Stderr)
+	if err != nil {
+		store.Close()
+		return nil, fmt.Errorf("open raft snapshots: %w", err)
+	}
+	advertise, err := net.ResolveTCPAddr("tcp", addr)
+	if err != nil {
+		store.Close()
+		return nil, fmt.Errorf("raft address: %w", err)
+	}
+	trans, err := raft.NewTCPTransport(addr, advertise, 3, 10*time.Second, os.Stderr)
+	if err != nil {
+		store.Close()
+		return nil, fmt.Errorf("listen for raft: %w", err)
+	}
+
+	n := &raftNode{id: id, store: store, trans: trans}
+	n.fsm = &harmonyFSM{node: n}
+	conf := raft.DefaultConfig()
+	conf.LocalID = raft.ServerID(id)
+	conf.LogLevel = "WARN"
+	conf.LogOutput = os.Stderr
+	if n.r, err = raft.NewRaft(conf, n.fsm, store, store, snaps, trans); err != nil {
+		trans.Close()
+		store.Close()
+		return nil, fmt.Errorf("start raft: %w", err)
+	}
+
+	existing, err := raft.HasExistingState(store, store, snaps)
+	if err != nil {
+		n.Close()
+		return nil, fmt.Errorf("read raft state: %w", err)
+	}
+	if !existing && peers != "" {
+		servers, err := parseRaftPeers(peers, id)
+		if err != nil {
+			n.Close()
+			return nil, err
+		}
+		if err := n.r.BootstrapCluster(raft.Configuration{Servers: servers}).Error(); err != nil {
+			n.Close()
+			return nil, fmt.Errorf("bootstrap raft: %w", err)
+		}
+	}
+	return n, nil
+}
+
+// parseRaftPeers parses id=host:port,... which must name self
+func parseRaftPeers(peers, self string) ([]raft.Server, error) {
+	var servers []raft.Server
+	found := false
+	for _, p := range strings.Split(peers, ",") {
+		id, addr, ok := strings.Cut(strings.TrimSpace(p), "=")
+		if !ok || id == "" || addr == "" {
+			return nil, fmt.Errorf("raft peer %q must be id=host:port", p)
+		}
+		found = found || id == self
+		servers = append(servers, raft.Server{Suffrage: raft.Voter, ID: raft.ServerID(id), Address: raft.ServerAddress(addr)})
+	}
+	if !found {
+		return nil, fmt.Errorf("raft peers don't include this node, %s", self)
+	}
+	return servers, nil
+}
+
+// Close leaves the group
+func (n *raftNode) Close() error {
+	err := n.r.Shutdown().Error()
+	n.trans.Close()
+	n.store.Close()
+	return err
+}
+
+// lead reports whether this node should run the cycle: it is the leader.
+// On taking the lead it waits for the replicated state to be applied, then
+// resumes from it. Only the loop may call it.
+func (n *raftNode) lead() bool {
+	if n.r.State() != raft.Leader {
+		if n.leading.Swap(false) {
+			slog.Warn("lost raft leadership, standing by")
+		}
+		return false
+	}
+	if n.leading.Load() {
+		return true
+	}
+	if err := n.r.Barrier(raftApplyTimeout).Error(); err != nil {
+		slog.Warn("raft barrier failed, not taking the lead yet", "err", err)
+		return false
+	}
+	gates := n.fsm.gates()
+	restoreGates(gates)
+	// Number cycles on from the last leader's
+	if last := harmonyHistory.Last(1); len(last) > 0 && last[0].Cycle > cycleSeq.Load() {
+		cycleSeq.Store(last[0].Cycle)
+	}
+	harmonyAlerts.resume(gates.Gate.Last)
+	n.leading.Store(true)
+	n.replicateConfig(activeConfig())
+	slog.Info("took raft leadership", "decision", gates.Gate.Last, "halted", gates.Gate.Halted)
+	return true
+}
+
+// standingBy reports whether the node is a follower, which doesn't poll
+// providers. It is true too while a new leader catches up.
+func (n *raftNode) standingBy() bool {
+	return !n.leading.Load()
+}
+
+// replicateCycle replicates a cycle the leader ran, with its gates. The
+// record reaches the history once committed. Only the loop may call it.
+func (n *raftNode) replicateCycle(rec CycleRecord) {
+	n.apply(raftCommand{Op: raftOpCycle, Record: &rec, Gates: currentGates()})
+}
+
+// replicateConfig replicates a config the leader applied
+func (n *raftNode) replicateConfig(c *HarmonyConfig) {
+	if !n.leading.Load() {
+		return
+	}
+	body, err := json.Marshal(c)
+	if err != nil {
+		slog.Error("encode config for raft", "err", err)
+		return
+	}
+	n.apply(raftCommand{Op: raftOpConfig, Config: body})
+}
+
+// apply appends cmd to the log without waiting for it to commit
+func (n *raftNode) apply(cmd raftCommand) {
+	body, err := json.Marshal(cmd)
+	if err != nil {
+		slog.Error("encode raft command", "op", cmd.Op, "err", err)
+		return
+	}
+	f := n.r.Apply(body, raftApplyTimeout)
+	go func() {
+		if err := f.Error(); err != nil {
+			slog.Warn("raft apply failed", "op", cmd.Op, "err", err)
+		}
+	}()
+}
+
+// raftStatus is the body of /harmony/raft
+type raftStatus struct {
+	ID       string `json:"id"`
+	State    string `json:"state"`
+	LeaderID string `json:"leader_id,omitempty"`
+	Leader   string `json:"leader_addr,omitempty"`
+	Applied  uint64 `json:"applied_index"`
+}
+
+func serveRaft(w http.ResponseWriter, r *http.Request) {
+	if harmonyRaft == nil {
+		http.Error(w, "raft is not enabled", http.StatusNotFound)
+		return
+	}
+	addr, id := harmonyRaft.r.LeaderWithID()
+	writeJSON(w, raftStatus{
+		ID:       harmonyRaft.id,
+		State:    harmonyRaft.r.State().String(),
+		LeaderID: string(id),
+		Leader:   string(addr),
+		Applied:  harmonyRaft.r.AppliedIndex(),
+	})
+}
+
+// harmonyFSM applies the replicated log: cycles go to the history on every
+// node, and followers take the leader's config
+type harmonyFSM struct {
+	node *raftNode
+
+	mu     sync.Mutex
+	state  gateStates
+	config json.RawMessage
+}
+
+func (f *harmonyFSM) gates() gateStates {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.state
+}
+
+func (f *harmonyFSM) Apply(l *raft.Log) interface{} {
+	var cmd raftCommand
+	if err := json.Unmarshal(l.Data, &cmd); err != nil {
+		slog.Error("undecodable raft command", "index", l.Index, "err", err)
+		return err
+	}
+	switch cmd.Op {
+	case raftOpCycle:
+		if cmd.Record != nil {
+			harmonyHistory.Add(*cmd.Record)
+		}
+		if cmd.Gates != nil {
+			f.mu.Lock()
+			f.state = *cmd.Gates
+			f.mu.Unlock()
+		}
+	case raftOpConfig:
+		f.mu.Lock()
+		f.config = cmd.Config
+		f.mu.Unlock()
+		if f.node.standingBy() {
+			f.applyConfig(cmd.Config)
+		}
+	}
+	return nil
+}
+
+// applyConfig applies a replicated config on a follower
+func (f *harmonyFSM) applyConfig(body json.RawMessage) {
+	cfg := DefaultHarmonyConfig()
+	if err := json.Unmarshal(body, cfg); err != nil {
+		slog.Error("undecodable replicated config", "err", err)
+		return
+	}
+	if err := cfg.Validate(harmonyProviders); err != nil {
+		slog.Error("replicated config is invalid here", "err", err)
+		return
+	}
+	if err := cfg.Apply(harmonyProviders); err != nil {
+		slog.Error("apply replicated config", "err", err)
+		return
+	}
+	slog.Info("applied replicated config")
+}
+
+// fsmSnapshot is the replicated state at a point in the log
+type fsmSnapshot struct {
+	History []CycleRecord   `json:"history"`
+	Gates   gateStates      `json:"gates"`
+	Config  json.RawMessage `json:"config,omitempty"`
+}
+
+func (f *harmonyFSM) Snapshot() (raft.FSMSnapshot, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return &fsmSnapshot{History: harmonyHistory.Last(0), Gates: f.state, Config: f.config}, nil
+}
+
+func (f *harmonyFSM) Restore(rc io.ReadCloser) error {
+	defer rc.Close()
+	var snap fsmSnapshot
+	if err := json.NewDecoder(rc).Decode(&snap); err != nil {
+		return fmt.Errorf("decode raft snapshot: %w", err)
+	}
+	harmonyHistory.Replace(snap.History)
+	f.mu.Lock()
+	f.state, f.config = snap.Gates, snap.Config
+	f.mu.Unlock()
+	if len(snap.Config) > 0 && f.node.standingBy() {
+		f.applyConfig(snap.Config)
+	}
+	return nil
+}
+
+func (s *fsmSnapshot) Persist(sink raft.SnapshotSink) error {
+	if err := json.NewEncoder(sink).Encode(s); err != nil {
+		sink.Cancel()
+		return fmt.Errorf("write raft snapshot: %w", err)
+	}
+	return sink.Close()
+}
+
+func (s *fsmSnapshot) Release() {}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"sync"
+)
+
+// cycleRecorder appends every cycle to a file as a JSON line, for offline
+// tuning. Unlike the fault journal it isn't synced or chained: it is a
+// capture, not evidence.
+type cycleRecorder struct {
+	mu  sync.Mutex
+	f   *os.File
+	w   *bufio.Writer
+	enc *json.Encoder
+}
+
+// harmonyRecorder is nil unless -record-cycles is set
+var harmonyRecorder *cycleRecorder
+
+func openCycleRecorder(path string) (*cycleRecorder, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("open cycle recording: %w", err)
+	}
+	w := bufio.NewWriter(f)
+	return &cycleRecorder{f: f, w: w, enc: json.NewEncoder(w)}, nil
+}
+
+// Record appends rec
+func (r *cycleRecorder) Record(rec CycleRecord) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err := r.enc.Encode(rec); err != nil {
+		return fmt.Errorf("record cycle: %w", err)
+	}
+	if err := r.w.Flush(); err != nil {
+		return fmt.Errorf("record cycle: %w", err)
+	}
+	return nil
+}
+
+// Close closes the recording
+func (r *cycleRecorder) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err := r.w.Flush(); err != nil {
+		r.f.Close()
+		return fmt.Errorf("flush cycle recording: %w", err)
+	}
+	return r.f.Close()
+}
+
+// recordCycle records rec if -record-cycles is set. A failed write is
+// logged but doesn't stop the loop.
+func recordCycle(rec CycleRecord) {
+	if harmonyRecorder == nil {
+		return
+	}
+	if err := harmonyRecorder.Record(rec); err != nil {
+		slog.Error("cycle recording failed", "cycle", rec.Cycle, "err", err)
+	}
+}
+
+// readCycleRecords reads recorded cycles from path: a -record-cycles
+// recording, the JSON array /harmony/history serves, or a fault journal
+func readCycleRecords(path string) ([]CycleRecord, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read cycles: %w", err)
+	}
+	data = bytes.TrimSpace(data)
+	var recs []CycleRecord
+	if bytes.HasPrefix(data, []byte("[")) {
+		if err := json.Unmarshal(data, &recs); err != nil {
+			return nil, fmt.Errorf("parse cycles %s: %w", path, err)
+		}
+		return recs, nil
+	}
+	for n, line := range bytes.Split(data, []byte("\n")) {
+		line = bytes.TrimSpace(line)
+		if len(line) == 0 {
+			continue
+		}
+		// Fault journal entries are prefixed with their chain hash
+		if sum, body, ok := bytes.Cut(line, []byte(" ")); ok && len(sum) == 64 && !bytes.HasPrefix(line, []byte("{")) {
+			line = body
+		}
+		var rec CycleRecord
+		if err := json.Unmarshal(line, &rec); err != nil {
+			return nil, fmt.Errorf("parse cycles %s line %d: %w", path, n+1, err)
+		}
+		recs = append(recs, rec)
+	}
+	return recs, nil
+}
@@ -0,0 +1,348 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+)
+
+// The redteam source scores red_team_dwell_time from the red and purple
+// team exercises reported to POST /harmony/redteam/exercises, and
+// withdrawn with DELETE, by tokens granting harmony:redteam:write. An
+// exercise scores the share of its techniques the defenders detected,
+// halved for every DwellHalfAt the detections took on average. Exercises
+// weigh half as much every DecayHalfAt since they ended, and the score is
+// their weighted mean with Prior, weighing PriorWeight: as the last
+// exercises age, the score drifts back to Prior.
+
+const (
+	defaultRedTeamDwellHalfAt = 24 * time.Hour
+	defaultRedTeamDecayHalfAt = 30 * 24 * time.Hour
+	defaultRedTeamPrior       = 0.5
+	defaultRedTeamPriorWeight = 0.125
+
+	// redTeamForgetAfter is how many DecayHalfAt an exercise is kept
+	redTeamForgetAfter = 10
+)
+
+// RedTeamConfig configures the redteam source. Zero fields take their
+// defaults.
+type RedTeamConfig struct {
+	// State is the file exercises are kept in across restarts
+	State string `yaml:"state"`
+
+	// DwellHalfAt is the mean dwell that halves an exercise's score, 24h by
+	// default
+	DwellHalfAt time.Duration `yaml:"dwell_half_at"`
+
+	// DecayHalfAt is the age that halves an exercise's weight, 30 days by
+	// default
+	DecayHalfAt time.Duration `yaml:"decay_half_at"`
+
+	// Prior is the score without recent exercises, 0.5 by default, and
+	// PriorWeight its weight against them, 0.125 by default: that of an
+	// exercise three DecayHalfAt old
+	Prior       float64 `yaml:"prior"`
+	PriorWeight float64 `yaml:"prior_weight"`
+}
+
+func (c *RedTeamConfig) validate() error {
+	if c.DwellHalfAt < 0 || c.DecayHalfAt < 0 {
+		return fmt.Errorf("dwell_half_at and decay_half_at must be non-negative")
+	}
+	if c.Prior < 0 || c.Prior > 1 || math.IsNaN(c.Prior) {
+		return fmt.Errorf("prior %v must be within [0, 1]", c.Prior)
+	}
+	if c.PriorWeight < 0 || math.IsNaN(c.PriorWeight) || math.IsInf(c.PriorWeight, 0) {
+		return fmt.Errorf("prior_weight %v must be non-negative", c.PriorWeight)
+	}
+	return nil
+}
+
+// withDefaults returns c with its zero fields defaulted
+func (c RedTeamConfig) withDefaults() RedTeamConfig {
+	if c.DwellHalfAt == 0 {
+		c.DwellHalfAt = defaultRedTeamDwellHalfAt
+	}
+	if c.DecayHalfAt == 0 {
+		c.DecayHalfAt = defaultRedTeamDecayHalfAt
+	}
+	if c.Prior == 0 {
+		c.Prior = defaultRedTeamPrior
+	}
+	if c.PriorWeight == 0 {
+		c.PriorWeight = defaultRedTeamPriorWeight
+	}
+	return c
+}
+
+// RedTeamExercise is one exercise's results, as reported by purple-team
+// tooling. Reporting an ID again replaces the exercise.
+type RedTeamExercise struct {
+	ID   string `json:"id"`
+	Name string `json:"name,omitempty"`
+	Team string `json:"team,omitempty"` // red or purple
+
+	// Time is when the exercise ended, now if unset; it decays from then
+	Time time.Time `json:"time"`
+
+	// Techniques is how many techniques were run and Detected how many of
+	// them the defenders caught
+	Techniques int `json:"techniques"`
+	Detected   int `json:"detected"`
+
+	// DwellSeconds is the mean time from a detected technique's execution
+	// to its detection
+	DwellSeconds float64 `json:"dwell_seconds"`
+
+	Received time.Time `json:"received"`
+}
+
+func (e *RedTeamExercise) validate(now time.Time) error {
+	switch {
+	case e.ID == "":
+		return fmt.Errorf("exercise needs an id")
+	case e.Techniques < 1:
+		return fmt.Errorf("exercise %s ran no techniques", e.ID)
+	case e.Detected < 0 || e.Detected > e.Techniques:
+		return fmt.Errorf("exercise %s detected %d of %d techniques", e.ID, e.Detected, e.Techniques)
+	case e.DwellSeconds < 0 || math.IsNaN(e.DwellSeconds) || math.IsInf(e.DwellSeconds, 0):
+		return fmt.Errorf("exercise %s dwell_seconds %v must be non-negative", e.ID, e.DwellSeconds)
+	case e.Time.After(now.Add(time.Hour)):
+		return fmt.Errorf("exercise %s ends in the future, %s", e.ID, e.Time.Format(time.RFC3339))
+	}
+	return nil
+}
+
+// score is the exercise's own score under cfg
+func (e *RedTeamExercise) score(cfg *RedTeamConfig) float64 {
+	dwell := time.Duration(e.DwellSeconds * float64(time.Second))
+	return float64(e.Detected) / float64(e.Techniques) * math.Pow(0.5, float64(dwell)/float64(cfg.DwellHalfAt))
+}
+
+// redTeamExercises holds the exercises reported, kept across reloads of
+// the source and, with State, restarts
+type redTeamExercises struct {
+	mu     sync.Mutex
+	byID   map[string]RedTeamExercise
+	loaded string // the state file loaded, if any
+}
+
+var harmonyRedTeam = &redTeamExercises{byID: make(map[string]RedTeamExercise)}
+
+// use loads the state file, when it changed, and forgets exercises too
+// old to count
+func (s *redTeamExercises) use(cfg *RedTeamConfig, now time.Time) {
+	if cfg.State != "" && s.loaded != cfg.State {
+		s.load(cfg.State)
+	}
+	for id, e := range s.byID {
+		if now.Sub(e.Time) > redTeamForgetAfter*cfg.DecayHalfAt {
+			delete(s.byID, id)
+		}
+	}
+}
+
+func (s *redTeamExercises) add(cfg *RedTeamConfig, exs []RedTeamExercise, now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.use(cfg, now)
+	for _, e := range exs {
+		if e.Time.IsZero() {
+			e.Time = now
+		}
+		e.Received = now
+		s.byID[e.ID] = e
+	}
+	if cfg.State != "" {
+		s.save(cfg.State)
+	}
+}
+
+func (s *redTeamExercises) remove(cfg *RedTeamConfig, id string, now time.Time) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.use(cfg, now)
+	if _, ok := s.byID[id]; !ok {
+		return false
+	}
+	delete(s.byID, id)
+	if cfg.State != "" {
+		s.save(cfg.State)
+	}
+	return true
+}
+
+// RedTeamScore is the body of GET /harmony/redteam/exercises
+type RedTeamScore struct {
+	Score     float64             `json:"score"`
+	Exercises []RedTeamScoredItem `json:"exercises"`
+}
+
+// RedTeamScoredItem is an exercise with its score and current weight
+type RedTeamScoredItem struct {
+	RedTeamExercise
+	Score  float64 `json:"score"`
+	Weight float64 `json:"weight"`
+}
+
+// scored returns the exercises, newest first, and the score they make
+func (s *redTeamExercises) scored(cfg *RedTeamConfig, now time.Time) RedTeamScore {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.use(cfg, now)
+	out := RedTeamScore{Exercises: make([]RedTeamScoredItem, 0, len(s.byID))}
+	sum, weights := cfg.Prior*cfg.PriorWeight, cfg.PriorWeight
+	for _, e := range s.byID {
+		age := max(0, now.Sub(e.Time))
+		item := RedTeamScoredItem{
+			RedTeamExercise: e,
+			Score:           e.score(cfg),
+			Weight:          math.Pow(0.5, float64(age)/float64(cfg.DecayHalfAt)),
+		}
+		sum += item.Score * item.Weight
+		weights += item.Weight
+		out.Exercises = append(out.Exercises, item)
+	}
+	slices.SortFunc(out.Exercises, func(a, b RedTeamScoredItem) int { return b.Time.Compare(a.Time) })
+	out.Score = sum / weights
+	return out
+}
+
+func (s *redTeamExercises) load(path string) {
+	s.loaded = path
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return
+	}
+	var exs []RedTeamExercise
+	if err == nil {
+		err = json.Unmarshal(data, &exs)
+	}
+	if err != nil {
+		slog.Warn("red team state not loaded", "path", path, "err", err)
+		return
+	}
+	for _, e := range exs {
+		if old, ok := s.byID[e.ID]; !ok || e.Received.After(old.Received) {
+			s.byID[e.ID] = e
+		}
+	}
+}
+
+func (s *redTeamExercises) save(path string) {
+	exs := make([]RedTeamExercise, 0, len(s.byID))
+	for _, e := range s.byID {
+		exs = append(exs, e)
+	}
+	slices.SortFunc(exs, func(a, b RedTeamExercise) int { return a.Time.Compare(b.Time) })
+	data, err := json.Marshal(exs)
+	if err == nil {
+		err = os.MkdirAll(filepath.Dir(path), 0o700)
+	}
+	if err == nil {
+		err = os.WriteFile(path+".tmp", data, 0o600)
+	}
+	if err == nil {
+		err = os.Rename(path+".tmp", path)
+	}
+	if err != nil {
+		slog.Warn("red team state not saved", "path", path, "err", err)
+	}
+}
+
+// redTeamProvider is the redteam source's red_team_dwell_time provider
+type redTeamProvider struct {
+	src RedTeamConfig // as configured, to tell a changed config
+	cfg RedTeamConfig // defaulted
+}
+
+func newRedTeamProvider(src *RedTeamConfig) *redTeamProvider {
+	return &redTeamProvider{src: *src, cfg: src.withDefaults()}
+}
+
+func (p *redTeamProvider) Name() string    { return "red_team_dwell_time" }
+func (p *redTeamProvider) Weight() float64 { return builtinWeight("red_team_dwell_time") }
+func (p *redTeamProvider) source() any     { return p.src }
+
+func (p *redTeamProvider) Collect(ctx context.Context) (float64, error) {
+	return harmonyRedTeam.scored(&p.cfg, harmonyClock.Now()).Score, nil
+}
+
+// activeRedTeam returns the configured redteam source, defaulted, or
+// writes 404
+func activeRedTeam(w http.ResponseWriter) (*RedTeamConfig, bool) {
+	src := activeConfig().Sources.RedTeam
+	if src == nil {
+		http.Error(w, "no redteam source", http.StatusNotFound)
+		return nil, false
+	}
+	cfg := src.withDefaults()
+	return &cfg, true
+}
+
+// serveRedTeamReport answers POST /harmony/redteam/exercises, taking one
+// exercise or several, concatenated. None is kept if any is invalid.
+func serveRedTeamReport(w http.ResponseWriter, r *http.Request) {
+	cfg, ok := activeRedTeam(w)
+	if !ok {
+		return
+	}
+	now := harmonyClock.Now()
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20))
+	var exs []RedTeamExercise
+	for {
+		var e RedTeamExercise
+		err := dec.Decode(&e)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err == nil {
+			err = e.validate(now)
+		}
+		if err != nil {
+			http.Error(w, "bad exercise: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		exs = append(exs, e)
+	}
+	harmonyRedTeam.add(cfg, exs, now)
+	for _, e := range exs {
+		slog.Info("red team exercise reported", "id", e.ID, "team", e.Team,
+			"detected", e.Detected, "techniques", e.Techniques, "dwell_seconds", e.DwellSeconds)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// serveRedTeamExercises answers GET /harmony/redteam/exercises
+func serveRedTeamExercises(w http.ResponseWriter, r *http.Request) {
+	cfg, ok := activeRedTeam(w)
+	if !ok {
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(harmonyRedTeam.scored(cfg, harmonyClock.Now()))
+}
+
+// serveRedTeamDelete answers DELETE /harmony/redteam/exercises/{id}
+func serveRedTeamDelete(w http.ResponseWriter, r *http.Request) {
+	cfg, ok := activeRedTeam(w)
+	if !ok {
+		return
+	}
+	if !harmonyRedTeam.remove(cfg, r.PathValue("id"), harmonyClock.Now()) {
+		http.Error(w, "no such exercise", http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// configDebounce coalesces the burst of events one save produces into a
+// single reload
+const configDebounce = 50 * time.Millisecond
+
+// ConfigWatcher reloads the harmony config on SIGHUP or when the file
+// changes, so it can be retuned mid-incident without restarting the loop.
+// A config that fails to load or validate is logged and the running one
+// kept.
+type ConfigWatcher struct {
+	path     string
+	registry *ProviderRegistry
+	watcher  *fsnotify.Watcher
+	signals  chan os.Signal
+	updates  chan *HarmonyConfig
+
+	mu      sync.Mutex
+	lastErr error
+
+	done chan struct{}
+}
+
+// WatchHarmonyConfig watches path, applying each valid change to r. The
+// file's directory is watched rather than the file, so editors that save
+// by rename are picked up.
+func WatchHarmonyConfig(path string, r *ProviderRegistry) (*ConfigWatcher, error) {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, fmt.Errorf("create config watcher: %w", err)
+	}
+	if err := watcher.Add(filepath.Dir(path)); err != nil {
+		watcher.Close()
+		return nil, fmt.Errorf("watch %s: %w", path, err)
+	}
+
+	w := &ConfigWatcher{
+		path:     filepath.Clean(path),
+		registry: r,
+		watcher:  watcher,
+		signals:  make(chan os.Signal, 1),
+		updates:  make(chan *HarmonyConfig, 1),
+		done:     make(chan struct{}),
+	}
+	signal.Notify(w.signals, syscall.SIGHUP)
+	go w.run()
+	return w, nil
+}
+
+// Updates delivers each applied config. Only the latest is kept if the
+// receiver falls behind, and the channel is closed by Close.
+func (w *ConfigWatcher) Updates() <-chan *HarmonyConfig {
+	return w.updates
+}
+
+// LastError returns the most recent reload or watch error, nil after a
+// successful reload
+func (w *ConfigWatcher) LastError() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.lastErr
+}
+
+// Close stops watching
+func (w *ConfigWatcher) Close() error {
+	signal.Stop(w.signals)
+	err := w.watcher.Close()
+	<-w.done
+	return err
+}
+
+func (w *ConfigWatcher) run() {
+	defer close(w.done)
+	defer close(w.updates)
+
+	var reload <-chan time.Time
+	for {
+		select {
+		case event, ok := <-w.watcher.Events:
+			if !ok {
+				return
+			}
+			if filepath.Clean(event.Name) == w.path && !event.Has(fsnotify.Remove) {
+				reload = time.After(configDebounce)
+			}
+		case err, ok := <-w.watcher.Errors:
+			if !ok {
+				return
+			}
+			w.setError(err)
+		case <-w.signals:
+			reload = nil
+			w.reload()
+		case <-reload:
+			reload = nil
+			w.reload()
+		}
+	}
+}
+
+func (w *ConfigWatcher) reload() error {
+	cfg, err := LoadHarmonyConfig(w.path)
+	if err == nil {
+		err = cfg.Apply(w.registry)
+	}
+	w.setError(err)
+	if err != nil {
+		slog.Error("harmony config reload failed, keeping running config", "path", w.path, "err", err)
+		return err
+	}
+	slog.Info("harmony config reloaded", "path", w.path,
+		"threshold", cfg.Threshold, "interval", cfg.Interval, "jitter", cfg.Jitter, "weights", cfg.Weights)
+
+	// Replace an undelivered config rather than block the watch loop
+	select {
+	case <-w.updates:
+	default:
+	}
+	w.updates <- cfg
+	return nil
+}
+
+func (w *ConfigWatcher) setError(err error) {
+	w.mu.Lock()
+	w.lastErr = err
+	w.mu.Unlock()
+}
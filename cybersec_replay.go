@@ -0,0 +1,214 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strings"
+	"time"
+)
+
+// harmony replay feeds recorded cycles through the decision logic under a
+// config, as fast as it can or at a multiple of real time, and prints the
+// decision timeline. No action runs. Recorded CH checks and anomalies are
+// replayed as they were; floors are checked against the config, and mu is
+// recomputed from the recorded scores.
+
+// ReplayStep is one replayed cycle
+type ReplayStep struct {
+	Cycle    uint64                   `json:"cycle"`
+	Time     time.Time                `json:"time"`
+	Mu       float64                  `json:"mu"`
+	CH       bool                     `json:"ch"`
+	Decision string                   `json:"decision"`
+	Recorded string                   `json:"recorded,omitempty"` // the decision the cycle made live
+	Contexts map[string]ContextRecord `json:"contexts,omitempty"`
+}
+
+// replayer decides recorded cycles with gates of its own, so a replay
+// doesn't disturb the live loop's debouncing
+type replayer struct {
+	cfg   *HarmonyConfig
+	gate  haltGate
+	gates map[string]*haltGate
+}
+
+func newReplayer(cfg *HarmonyConfig) *replayer {
+	return &replayer{cfg: cfg, gate: haltGate{last: DecisionGo}, gates: map[string]*haltGate{}}
+}
+
+// recordContext rebuilds a cycle's CyberSecContext from rec, weighted as
+// r weights its providers now. Providers rec has no score for are left
+// out, as skipped providers are.
+func recordContext(rec CycleRecord, r *ProviderRegistry) *CyberSecContext {
+	c := &CyberSecContext{}
+	total := 0.0
+	for _, p := range r.Providers() {
+		s, ok := rec.Scores[p.Name()]
+		if !ok {
+			continue
+		}
+		c.Names = append(c.Names, p.Name())
+		c.Scores = append(c.Scores, s)
+		c.Weights = append(c.Weights, p.Weight())
+		total += p.Weight()
+	}
+	if total > 0 {
+		for i := range c.Weights {
+			c.Weights[i] /= total
+		}
+	}
+	return c
+}
+
+// replayCH reports whether CH holds for rec under cfg: its recorded checks
+// and anomalies, with its floors checked again
+func replayCH(rec CycleRecord, c *CyberSecContext, cfg *HarmonyConfig) bool {
+	for _, name := range rec.Failed {
+		if !strings.HasPrefix(name, "floor:") {
+			return false
+		}
+	}
+	for i, name := range c.Names {
+		if floor, ok := cfg.Floors[name]; ok && c.Scores[i] < floor && slices.Contains(cfg.HaltOnFloor, name) {
+			return false
+		}
+	}
+	return true
+}
+
+// step decides rec. cfg must be the active config, which calculateMu
+// reads.
+func (r *replayer) step(rec CycleRecord) ReplayStep {
+	c := recordContext(rec, harmonyProviders)
+	ch := replayCH(rec, c, r.cfg)
+	st := ReplayStep{Cycle: rec.Cycle, Time: rec.Time, Mu: c.calculateMu(), CH: ch, Recorded: rec.Decision}
+	if len(r.cfg.Contexts) == 0 {
+		st.Decision = r.gate.decide(st.Mu, ch, r.cfg)
+		return st
+	}
+	st.Decision = DecisionGo
+	st.Contexts = make(map[string]ContextRecord, len(r.cfg.Contexts))
+	for _, name := range r.cfg.contextNames() {
+		cc := r.cfg.Contexts[name]
+		mu := cc.subset(c, harmonyProviders.weight).calculateMu()
+		gate, ok := r.gates[name]
+		if !ok {
+			gate = &haltGate{last: DecisionGo}
+			r.gates[name] = gate
+		}
+		d := gate.decide(mu, ch, r.cfg.forContext(name))
+		st.Contexts[name] = ContextRecord{Mu: mu, Decision: d}
+		if severity(d) > severity(st.Decision) {
+			st.Decision = d
+		}
+	}
+	return st
+}
+
+// replaySummary totals a replay
+type replaySummary struct {
+	cycles    int
+	changes   int // decision changes in the replay
+	differ    int // cycles decided otherwise than recorded
+	decisions map[string]int
+}
+
+// replay steps through recs, calling emit with each step. With speed > 0
+// it waits out the recorded gaps between cycles, divided by speed.
+func replay(recs []CycleRecord, cfg *HarmonyConfig, speed float64, emit func(st ReplayStep, changed bool)) replaySummary {
+	r := newReplayer(cfg)
+	sum := replaySummary{decisions: map[string]int{}}
+	last := DecisionGo
+	for i, rec := range recs {
+		if speed > 0 && i > 0 {
+			if gap := rec.Time.Sub(recs[i-1].Time); gap > 0 {
+				time.Sleep(time.Duration(float64(gap) / speed))
+			}
+		}
+		st := r.step(rec)
+		changed := st.Decision != last
+		last = st.Decision
+		sum.cycles++
+		sum.decisions[st.Decision]++
+		if changed {
+			sum.changes++
+		}
+		if st.Recorded != "" && st.Recorded != st.Decision {
+			sum.differ++
+		}
+		emit(st, changed)
+	}
+	return sum
+}
+
+// runReplay is the harmony replay subcommand
+func runReplay(args []string) {
+	fs := flag.NewFlagSet("replay", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: harmony replay -cycles FILE [flags]")
+		fs.PrintDefaults()
+	}
+	configPath := fs.String("config", os.Getenv("HARMONY_CONFIG"), "harmony config file (YAML) to replay under")
+	cyclesPath := fs.String("cycles", "", "recorded cycles: a -record-cycles file, /harmony/history output or a fault journal")
+	speed := fs.Float64("speed", 0, "replay at this multiple of real time; 0 replays as fast as possible")
+	asJSON := fs.Bool("json", false, "print every cycle as a JSON line, not just decision changes")
+	check := fs.Bool("check", false, "exit 1 if any cycle is decided otherwise than it was recorded")
+	fs.Parse(args)
+
+	if *cyclesPath == "" {
+		fs.Usage()
+		os.Exit(2)
+	}
+	if *speed < 0 {
+		fatal("replay", fmt.Errorf("speed %v must be non-negative", *speed))
+	}
+	cfg, err := LoadHarmonyConfig(*configPath)
+	if err != nil {
+		fatal("load harmony config", err)
+	}
+	if err := harmonyProviders.setWeights(cfg.Weights); err != nil {
+		fatal("replay", err)
+	}
+	harmonyConfig.Store(cfg)
+	recs, err := readCycleRecords(*cyclesPath)
+	if err != nil {
+		fatal("replay", err)
+	}
+
+	enc := json.NewEncoder(os.Stdout)
+	sum := replay(recs, cfg, *speed, func(st ReplayStep, changed bool) {
+		switch {
+		case *asJSON:
+			enc.Encode(st)
+		case changed:
+			writeReplayChange(os.Stdout, st)
+		}
+	})
+	if !*asJSON {
+		writeReplaySummary(os.Stdout, sum)
+	}
+	if *check && sum.differ > 0 {
+		os.Exit(1)
+	}
+}
+
+func writeReplayChange(w io.Writer, st ReplayStep) {
+	fmt.Fprintf(w, "%s  cycle %d  %s  mu %.6f  ch %t", st.Time.Format(time.RFC3339Nano), st.Cycle, st.Decision, st.Mu, st.CH)
+	if st.Recorded != "" && st.Recorded != st.Decision {
+		fmt.Fprintf(w, "  (recorded %s)", st.Recorded)
+	}
+	fmt.Fprintln(w)
+}
+
+func writeReplaySummary(w io.Writer, sum replaySummary) {
+	fmt.Fprintf(w, "# %d cycles, %d decision changes, %d decided otherwise than recorded\n", sum.cycles, sum.changes, sum.differ)
+	for _, d := range []string{DecisionGo, DecisionCaution, DecisionDegraded, DecisionHalt} {
+		if n := sum.decisions[d]; n > 0 {
+			fmt.Fprintf(w, "# %-16s %d\n", d, n)
+		}
+	}
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"math"
+	"sync/atomic"
+	"time"
+)
+
+// samplingRelax is how much longer than the last the interval may grow
+// in one cycle; shortening it is immediate
+const samplingRelax = 1.25
+
+// samplingHold is the relative change the interval needs before the
+// ticker is rebuilt for it
+const samplingHold = 0.1
+
+// SamplingConfig adapts the tick interval to the state of the harmony. It
+// is off unless Adaptive is set, and the interval is fixed.
+type SamplingConfig struct {
+	Adaptive bool `yaml:"adaptive"`
+
+	// Min is the fastest interval, the configured interval by default, and
+	// Max the slowest, ten of them by default
+	Min time.Duration `yaml:"min"`
+	Max time.Duration `yaml:"max"`
+
+	// Margin is how far above the threshold mu samples slowest; at the
+	// threshold it samples fastest
+	Margin float64 `yaml:"margin"`
+
+	// Volatility is the standard deviation of mu that samples fastest,
+	// measured with an EWMA of factor Alpha
+	Volatility float64 `yaml:"volatility"`
+	Alpha      float64 `yaml:"alpha"`
+}
+
+func defaultSamplingConfig() SamplingConfig {
+	return SamplingConfig{Margin: 0.0005, Volatility: 0.0002, Alpha: 0.1}
+}
+
+func (s *SamplingConfig) validate(interval, jitter time.Duration) error {
+	if !s.Adaptive {
+		return nil
+	}
+	lo, hi := s.bounds(interval)
+	if lo < time.Millisecond {
+		return fmt.Errorf("sampling min %v must be at least 1ms", lo)
+	}
+	if hi < lo {
+		return fmt.Errorf("sampling max %v must be at least min %v", hi, lo)
+	}
+	if jitter >= lo {
+		return fmt.Errorf("jitter %v must be under sampling min %v", jitter, lo)
+	}
+	if !(s.Margin > 0) || math.IsInf(s.Margin, 0) {
+		return fmt.Errorf("sampling margin %v must be positive", s.Margin)
+	}
+	if !(s.Volatility > 0) || math.IsInf(s.Volatility, 0) {
+		return fmt.Errorf("sampling volatility %v must be positive", s.Volatility)
+	}
+	if !(s.Alpha > 0 && s.Alpha <= 1) {
+		return fmt.Errorf("sampling alpha %v must be in (0, 1]", s.Alpha)
+	}
+	return nil
+}
+
+// bounds returns the fastest and slowest intervals
+func (s *SamplingConfig) bounds(interval time.Duration) (time.Duration, time.Duration) {
+	lo, hi := s.Min, s.Max
+	if lo == 0 {
+		lo = interval
+	}
+	if hi == 0 {
+		hi = 10 * interval
+	}
+	return lo, hi
+}
+
+// sampler picks the interval from each cycle's mu and decision: fastest
+// when mu is at the threshold, jumps about or the decision isn't
+// CHANGE_GO, slowest when mu is steady Margin or more above it, and
+// geometrically between. Only the loop observes; health reads the
+// interval from its handlers.
+type sampler struct {
+	n        int
+	mean     float64
+	variance float64
+	current  atomic.Int64 // time.Duration; 0 before the first adaptive cycle
+}
+
+var harmonySampler = &sampler{}
+
+// interval is how often the loop should tick under cfg
+func (s *sampler) interval(cfg *HarmonyConfig) time.Duration {
+	if !cfg.Sampling.Adaptive {
+		return cfg.Interval
+	}
+	lo, hi := cfg.Sampling.bounds(cfg.Interval)
+	cur := time.Duration(s.current.Load())
+	if cur == 0 {
+		return lo
+	}
+	return min(max(cur, lo), hi)
+}
+
+// observe folds in a cycle and moves the interval
+func (s *sampler) observe(cfg *HarmonyConfig, mu float64, decision string) {
+	sc := &cfg.Sampling
+	if !sc.Adaptive || math.IsNaN(mu) {
+		return
+	}
+	if s.n == 0 {
+		s.mean = mu
+	} else {
+		diff := mu - s.mean
+		s.mean += sc.Alpha * diff
+		s.variance = (1 - sc.Alpha) * (s.variance + sc.Alpha*diff*diff)
+	}
+	s.n++
+
+	pressure := 1.0
+	if decision == DecisionGo {
+		near := (cfg.Threshold + sc.Margin - mu) / sc.Margin
+		volatile := math.Sqrt(s.variance) / sc.Volatility
+		pressure = min(1, max(0, near, volatile))
+	}
+	lo, hi := sc.bounds(cfg.Interval)
+	target := time.Duration(float64(hi) * math.Pow(float64(lo)/float64(hi), pressure))
+	cur := s.interval(cfg)
+	if target > cur {
+		target = min(target, time.Duration(float64(cur)*samplingRelax))
+	}
+	if math.Abs(float64(target-cur)) < samplingHold*float64(cur) && target != lo && target != hi {
+		return
+	}
+	target = target.Round(time.Millisecond)
+	if target != cur {
+		slog.Debug("sampling interval changed", "interval", target, "was", cur,
+			"pressure", pressure, "mu", mu, "stddev", math.Sqrt(s.variance))
+		s.current.Store(int64(target))
+	}
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"time"
+)
+
+// shutdownTimeout bounds a graceful shutdown
+const shutdownTimeout = 10 * time.Second
+
+// shutdownStep releases one resource when the loop stops
+type shutdownStep struct {
+	name string
+	fn   func(ctx context.Context) error
+}
+
+// harmonyShutdown holds the steps registered with onShutdown
+var harmonyShutdown []shutdownStep
+
+// onShutdown registers fn to run at shutdown. Steps run last registered
+// first, like deferred calls.
+func onShutdown(name string, fn func(ctx context.Context) error) {
+	harmonyShutdown = append(harmonyShutdown, shutdownStep{name, fn})
+}
+
+// shutdown runs every step within shutdownTimeout. A failed step is logged
+// and the rest still run.
+func shutdown() {
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	for i := len(harmonyShutdown) - 1; i >= 0; i-- {
+		step := harmonyShutdown[i]
+		if err := step.fn(ctx); err != nil {
+			slog.Error("shutdown step failed", "step", step.name, "err", err)
+			continue
+		}
+		slog.Debug("shutdown step done", "step", step.name)
+	}
+	harmonyShutdown = nil
+}
@@ -0,0 +1,425 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The siem source scores soc_alert_coherence from the alerts in a SIEM: a
+// SOC that keeps few alerts open and acknowledges them quickly is
+// coherent. A saved search - a Splunk saved search, or an Elastic or
+// OpenSearch query - returns the alerts opened in the last Window, each
+// with when it was opened and, once acknowledged, when that was. The
+// volume score halves every OpenHalfAt alerts still open; the latency
+// score halves every LatencyHalfAt of the 90th percentile ack latency,
+// counting open alerts by their age so far. The score is their product.
+
+// SIEM backends
+const (
+	SIEMSplunk     = "splunk"
+	SIEMElastic    = "elastic"
+	SIEMOpenSearch = "opensearch"
+)
+
+const (
+	defaultSIEMWindow        = 24 * time.Hour
+	defaultSIEMEvery         = time.Minute
+	defaultSIEMMaxAge        = 10 * time.Minute
+	defaultSIEMTimeout       = 2 * time.Minute
+	defaultSIEMOpenHalfAt    = 50
+	defaultSIEMLatencyHalfAt = time.Hour
+	defaultSIEMAckedField    = "acknowledged_at"
+	defaultSIEMPageSize      = 1000
+	defaultSIEMMaxAlerts     = 10000
+	splunkPollInterval       = 500 * time.Millisecond
+)
+
+// SIEMConfig configures the siem source. Zero fields take their defaults.
+type SIEMConfig struct {
+	// Backend is splunk, elastic or opensearch; URL is its REST API, the
+	// management port for Splunk
+	Backend string     `yaml:"backend"`
+	URL     string     `yaml:"url"`
+	Auth    SourceAuth `yaml:"auth"`
+
+	// SavedSearch is the Splunk saved search dispatched, owned by Owner
+	// in App ("nobody" and "search" by default)
+	SavedSearch string `yaml:"saved_search"`
+	Owner       string `yaml:"owner"`
+	App         string `yaml:"app"`
+
+	// Index and Query are the Elastic or OpenSearch index pattern searched
+	// and the query DSL, as JSON, matching alerts; no query matches all
+	Index string `yaml:"index"`
+	Query string `yaml:"query"`
+
+	// OpenedField and AckedField name the alert fields holding when it was
+	// opened - _time for Splunk, @timestamp otherwise - and acknowledged,
+	// acknowledged_at by default; an alert without the latter is open
+	OpenedField string `yaml:"opened_field"`
+	AckedField  string `yaml:"acked_field"`
+
+	// Window is how far back alerts are searched, 24h by default
+	Window time.Duration `yaml:"window"`
+
+	// PageSize is how many alerts are fetched a request, 1000 by default;
+	// MaxAlerts caps the alerts fetched, 10000 by default
+	PageSize  int `yaml:"page_size"`
+	MaxAlerts int `yaml:"max_alerts"`
+
+	// OpenHalfAt is how many open alerts halve the score, 50 by default;
+	// LatencyHalfAt is the ack latency that does, 1h by default
+	OpenHalfAt    float64       `yaml:"open_half_at"`
+	LatencyHalfAt time.Duration `yaml:"latency_half_at"`
+
+	// Every paces the search, 1m by default, and Timeout bounds it, 2m by
+	// default; the provider fails once its last good search is MaxAge
+	// old, 10m by default
+	Every   time.Duration `yaml:"every"`
+	Timeout time.Duration `yaml:"timeout"`
+	MaxAge  time.Duration `yaml:"max_age"`
+}
+
+func (c *SIEMConfig) validate() error {
+	u, err := url.Parse(c.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("url %q must be an http or https url", c.URL)
+	}
+	switch c.Backend {
+	case SIEMSplunk:
+		if c.SavedSearch == "" {
+			return fmt.Errorf("splunk needs a saved_search")
+		}
+	case SIEMElastic, SIEMOpenSearch:
+		if c.Index == "" {
+			return fmt.Errorf("%s needs an index", c.Backend)
+		}
+		if c.Query != "" && !json.Valid([]byte(c.Query)) {
+			return fmt.Errorf("query is not valid JSON")
+		}
+	default:
+		return fmt.Errorf("unknown backend %q", c.Backend)
+	}
+	if err := c.Auth.validate(); err != nil {
+		return err
+	}
+	if c.Window < 0 || c.Every < 0 || c.Timeout < 0 || c.MaxAge < 0 || c.LatencyHalfAt < 0 {
+		return fmt.Errorf("window, every, timeout, max_age and latency_half_at must be non-negative")
+	}
+	if c.PageSize < 0 || c.MaxAlerts < 0 {
+		return fmt.Errorf("page_size and max_alerts must be non-negative")
+	}
+	if c.OpenHalfAt < 0 || math.IsNaN(c.OpenHalfAt) || math.IsInf(c.OpenHalfAt, 0) {
+		return fmt.Errorf("open_half_at %v must be positive", c.OpenHalfAt)
+	}
+	return nil
+}
+
+// withDefaults returns c with its zero fields defaulted
+func (c SIEMConfig) withDefaults() SIEMConfig {
+	c.URL = strings.TrimSuffix(c.URL, "/")
+	if c.Owner == "" {
+		c.Owner = "nobody"
+	}
+	if c.App == "" {
+		c.App = "search"
+	}
+	if c.OpenedField == "" {
+		c.OpenedField = "@timestamp"
+		if c.Backend == SIEMSplunk {
+			c.OpenedField = "_time"
+		}
+	}
+	if c.AckedField == "" {
+		c.AckedField = defaultSIEMAckedField
+	}
+	if c.Window == 0 {
+		c.Window = defaultSIEMWindow
+	}
+	if c.PageSize == 0 {
+		c.PageSize = defaultSIEMPageSize
+	}
+	if c.MaxAlerts == 0 {
+		c.MaxAlerts = defaultSIEMMaxAlerts
+	}
+	if c.OpenHalfAt == 0 {
+		c.OpenHalfAt = defaultSIEMOpenHalfAt
+	}
+	if c.LatencyHalfAt == 0 {
+		c.LatencyHalfAt = defaultSIEMLatencyHalfAt
+	}
+	if c.Every == 0 {
+		c.Every = defaultSIEMEvery
+	}
+	if c.Timeout == 0 {
+		c.Timeout = defaultSIEMTimeout
+	}
+	if c.MaxAge == 0 {
+		c.MaxAge = defaultSIEMMaxAge
+	}
+	return c
+}
+
+// siemAlert is one alert's timing
+type siemAlert struct {
+	opened time.Time
+	acked  time.Time // zero while open
+}
+
+// siemProvider is the siem source's soc_alert_coherence provider
+type siemProvider struct {
+	refreshedScore
+	src    SIEMConfig // as configured, to tell a changed config
+	cfg    SIEMConfig // defaulted
+	client *http.Client
+}
+
+func newSIEMProvider(src *SIEMConfig) *siemProvider {
+	cfg := src.withDefaults()
+	p := &siemProvider{src: *src, cfg: cfg, client: &http.Client{}}
+	p.refreshedScore = refreshedScore{
+		name:    "soc_alert_coherence",
+		weight:  builtinWeight("soc_alert_coherence"),
+		every:   cfg.Every,
+		timeout: cfg.Timeout,
+		maxAge:  cfg.MaxAge,
+		refresh: p.refresh,
+	}
+	return p
+}
+
+func (p *siemProvider) source() any { return p.src }
+
+func (p *siemProvider) refresh(ctx context.Context) (float64, error) {
+	var rows []map[string]any
+	var err error
+	if p.cfg.Backend == SIEMSplunk {
+		rows, err = p.splunk(ctx)
+	} else {
+		rows, err = p.elastic(ctx)
+	}
+	if err != nil {
+		return 0, err
+	}
+	alerts := make([]siemAlert, 0, len(rows))
+	for _, row := range rows {
+		opened, ok := siemTime(field(row, p.cfg.OpenedField))
+		if !ok {
+			continue
+		}
+		acked, _ := siemTime(field(row, p.cfg.AckedField))
+		alerts = append(alerts, siemAlert{opened: opened, acked: acked})
+	}
+	score, open, p90 := p.coherence(alerts)
+	slog.Debug("soc alert coherence refreshed", "alerts", len(alerts), "skipped", len(rows)-len(alerts),
+		"open", open, "ack_p90", p90, "score", score)
+	return score, nil
+}
+
+// coherence scores alerts, returning the open count and the 90th
+// percentile ack latency it was scored from
+func (p *siemProvider) coherence(alerts []siemAlert) (score float64, open int, p90 time.Duration) {
+	now := harmonyClock.Now()
+	latencies := make([]time.Duration, 0, len(alerts))
+	for _, a := range alerts {
+		end := a.acked
+		if end.IsZero() {
+			open++
+			end = now
+		}
+		latencies = append(latencies, max(end.Sub(a.opened), 0))
+	}
+	if len(latencies) > 0 {
+		sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+		p90 = latencies[int(math.Ceil(0.9*float64(len(latencies))))-1]
+	}
+	volume := math.Pow(0.5, float64(open)/p.cfg.OpenHalfAt)
+	latency := math.Pow(0.5, float64(p90)/float64(p.cfg.LatencyHalfAt))
+	return volume * latency, open, p90
+}
+
+// splunk dispatches the saved search, waits for it and pages through its
+// results
+func (p *siemProvider) splunk(ctx context.Context) ([]map[string]any, error) {
+	form := url.Values{}
+	form.Set("dispatch.earliest_time", "-"+strconv.Itoa(int(p.cfg.Window.Seconds()))+"s")
+	form.Set("dispatch.latest_time", "now")
+	form.Set("output_mode", "json")
+	var job struct {
+		SID string `json:"sid"`
+	}
+	dispatch := fmt.Sprintf("/servicesNS/%s/%s/saved/searches/%s/dispatch",
+		url.PathEscape(p.cfg.Owner), url.PathEscape(p.cfg.App), url.PathEscape(p.cfg.SavedSearch))
+	if err := p.do(ctx, http.MethodPost, dispatch, "application/x-www-form-urlencoded", strings.NewReader(form.Encode()), &job); err != nil {
+		return nil, fmt.Errorf("dispatch %s: %w", p.cfg.SavedSearch, err)
+	}
+	jobPath := "/services/search/jobs/" + url.PathEscape(job.SID)
+	for {
+		var status struct {
+			Entry []struct {
+				Content struct {
+					DispatchState string `json:"dispatchState"`
+					IsDone        bool   `json:"isDone"`
+					IsFailed      bool   `json:"isFailed"`
+				} `json:"content"`
+			} `json:"entry"`
+		}
+		if err := p.do(ctx, http.MethodGet, jobPath+"?output_mode=json", "", nil, &status); err != nil {
+			return nil, fmt.Errorf("search job %s: %w", job.SID, err)
+		}
+		if len(status.Entry) > 0 {
+			st := status.Entry[0].Content
+			if st.IsFailed || st.DispatchState == "FAILED" {
+				return nil, fmt.Errorf("search job %s failed", job.SID)
+			}
+			if st.IsDone || st.DispatchState == "DONE" {
+				break
+			}
+		}
+		if err := sleepCtx(ctx, splunkPollInterval); err != nil {
+			return nil, err
+		}
+	}
+	var rows []map[string]any
+	for offset := 0; offset < p.cfg.MaxAlerts; {
+		count := min(p.cfg.PageSize, p.cfg.MaxAlerts-offset)
+		var page struct {
+			Results []map[string]any `json:"results"`
+		}
+		q := fmt.Sprintf("?output_mode=json&count=%d&offset=%d", count, offset)
+		if err := p.do(ctx, http.MethodGet, jobPath+"/results"+q, "", nil, &page); err != nil {
+			return nil, fmt.Errorf("search job %s results: %w", job.SID, err)
+		}
+		rows = append(rows, page.Results...)
+		offset += len(page.Results)
+		if len(page.Results) < count {
+			break
+		}
+	}
+	return rows, nil
+}
+
+// elastic pages through the alerts the query matches in the window, by
+// search_after on the opened field
+func (p *siemProvider) elastic(ctx context.Context) ([]map[string]any, error) {
+	query := json.RawMessage(`{"match_all":{}}`)
+	if p.cfg.Query != "" {
+		query = json.RawMessage(p.cfg.Query)
+	}
+	window := map[string]any{"range": map[string]any{p.cfg.OpenedField: map[string]any{
+		"gte": harmonyClock.Now().Add(-p.cfg.Window).UTC().Format(time.RFC3339),
+	}}}
+	var rows []map[string]any
+	var after []any
+	for len(rows) < p.cfg.MaxAlerts {
+		size := min(p.cfg.PageSize, p.cfg.MaxAlerts-len(rows))
+		body := map[string]any{
+			"size":    size,
+			"query":   map[string]any{"bool": map[string]any{"filter": []any{query, window}}},
+			"sort":    []any{map[string]any{p.cfg.OpenedField: "asc"}},
+			"_source": []string{p.cfg.OpenedField, p.cfg.AckedField},
+		}
+		if after != nil {
+			body["search_after"] = after
+		}
+		data, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		var page struct {
+			Hits struct {
+				Hits []struct {
+					Source map[string]any `json:"_source"`
+					Sort   []any          `json:"sort"`
+				} `json:"hits"`
+			} `json:"hits"`
+		}
+		if err := p.do(ctx, http.MethodPost, "/"+url.PathEscape(p.cfg.Index)+"/_search", "application/json", bytes.NewReader(data), &page); err != nil {
+			return nil, fmt.Errorf("search %s: %w", p.cfg.Index, err)
+		}
+		hits := page.Hits.Hits
+		for _, h := range hits {
+			rows = append(rows, h.Source)
+		}
+		if len(hits) < size {
+			break
+		}
+		after = hits[len(hits)-1].Sort
+	}
+	return rows, nil
+}
+
+// do sends a request to the backend and decodes its JSON answer into v
+func (p *siemProvider) do(ctx context.Context, method, path, contentType string, body io.Reader, v any) error {
+	req, err := http.NewRequestWithContext(ctx, method, p.cfg.URL+path, body)
+	if err != nil {
+		return err
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	scheme := "ApiKey"
+	if p.cfg.Backend == SIEMSplunk {
+		scheme = "Bearer"
+	}
+	if err := p.cfg.Auth.authorize(req, scheme); err != nil {
+		return err
+	}
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 200))
+		return fmt.Errorf("%s answered %s: %s", p.cfg.Backend, resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return json.NewDecoder(io.LimitReader(resp.Body, 256<<20)).Decode(v)
+}
+
+// field looks up a dotted field name, as a flat key first, then nested
+func field(row map[string]any, name string) any {
+	if v, ok := row[name]; ok {
+		return v
+	}
+	head, rest, ok := strings.Cut(name, ".")
+	if !ok {
+		return nil
+	}
+	if m, ok := row[head].(map[string]any); ok {
+		return field(m, rest)
+	}
+	return nil
+}
+
+// siemTime reads a time as RFC 3339, Splunk's ISO format or epoch seconds
+func siemTime(v any) (time.Time, bool) {
+	switch v := v.(type) {
+	case float64:
+		return time.Unix(0, int64(v*1e9)), v > 0
+	case string:
+		if v == "" {
+			return time.Time{}, false
+		}
+		for _, layout := range []string{time.RFC3339Nano, "2006-01-02T15:04:05.000-07:00", "2006-01-02 15:04:05"} {
+			if t, err := time.Parse(layout, v); err == nil {
+				return t, true
+			}
+		}
+		if f, err := strconv.ParseFloat(v, 64); err == nil && f > 0 {
+			return time.Unix(0, int64(f*1e9)), true
+		}
+	}
+	return time.Time{}, false
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// Contribution is one score's part in a simulated mu
+type Contribution struct {
+	Provider string  `json:"provider"`
+	Score    float64 `json:"score"`
+	Weight   float64 `json:"weight"` // normalized
+	// Cost is how much higher mu would be were this score 1
+	Cost float64 `json:"cost"`
+}
+
+// SimulatedContext is one named context's part in a simulation
+type SimulatedContext struct {
+	Mu        float64 `json:"mu"`
+	Threshold float64 `json:"threshold"`
+	Distance  float64 `json:"distance"`
+	Decision  string  `json:"decision"`
+}
+
+// SimulationResult is what a config would decide for one cycle
+type SimulationResult struct {
+	Decision  string  `json:"decision"`
+	Mu        float64 `json:"mu"`
+	Threshold float64 `json:"threshold"`
+	// Distance is mu less the threshold: how far above it mu is, or,
+	// negative, how far below
+	Distance      float64                     `json:"distance"`
+	CH            bool                        `json:"ch"`
+	Failed        []string                    `json:"failed_checks,omitempty"`
+	Contributions []Contribution              `json:"contributions"`
+	Contexts      map[string]SimulatedContext `json:"contexts,omitempty"`
+}
+
+// Simulate decides one cycle under the active config without touching the
+// live loop: no gate, history or action sees it.
+func Simulate(scores []float64, ch CheckResults) (SimulationResult, error) {
+	return activeConfig().Simulate(scores, ch)
+}
+
+// Simulate decides one cycle under c. scores are in provider registration
+// order. The decision is the cycle's grade before halt_after debouncing
+// and halt latching, which depend on the cycles before it; halting floors
+// count as failed checks, and anomalies, which need a trend, are left out.
+func (c *HarmonyConfig) Simulate(scores []float64, ch CheckResults) (SimulationResult, error) {
+	providers := harmonyProviders.Providers()
+	if len(scores) != len(providers) {
+		return SimulationResult{}, fmt.Errorf("simulate: %d scores for %d providers", len(scores), len(providers))
+	}
+	weight := func(name string) float64 {
+		if w, ok := c.Weights[name]; ok {
+			return w
+		}
+		for _, p := range providers {
+			if p.Name() == name {
+				return baseWeight(p)
+			}
+		}
+		return 0
+	}
+	cctx := &CyberSecContext{}
+	total := 0.0
+	for i, p := range providers {
+		cctx.Names = append(cctx.Names, p.Name())
+		cctx.Scores = append(cctx.Scores, scores[i])
+		cctx.Weights = append(cctx.Weights, weight(p.Name()))
+		total += weight(p.Name())
+	}
+	if total > 0 {
+		for i := range cctx.Weights {
+			cctx.Weights[i] /= total
+		}
+	}
+
+	res := SimulationResult{Failed: ch.Failed(), Threshold: c.Threshold}
+	for i, name := range cctx.Names {
+		if floor, ok := c.Floors[name]; ok && cctx.Scores[i] < floor && slices.Contains(c.HaltOnFloor, name) {
+			res.Failed = append(res.Failed, "floor:"+name)
+		}
+	}
+	res.CH = len(res.Failed) == 0
+	res.Mu = cctx.calculateMuWith(c)
+	res.Distance = res.Mu - res.Threshold
+	for i, name := range cctx.Names {
+		perfect := *cctx
+		perfect.Scores = slices.Clone(cctx.Scores)
+		perfect.Scores[i] = 1
+		res.Contributions = append(res.Contributions, Contribution{
+			Provider: name,
+			Score:    cctx.Scores[i],
+			Weight:   cctx.Weights[i],
+			Cost:     perfect.calculateMuWith(c) - res.Mu,
+		})
+	}
+
+	if len(c.Contexts) == 0 {
+		res.Decision = c.level(res.Mu, res.CH)
+		return res, nil
+	}
+	res.Decision = DecisionGo
+	res.Contexts = make(map[string]SimulatedContext, len(c.Contexts))
+	for _, name := range c.contextNames() {
+		cc := c.Contexts[name]
+		dcfg := c.forContext(name)
+		mu := cc.subset(cctx, weight).calculateMuWith(dcfg)
+		d := dcfg.level(mu, res.CH)
+		res.Contexts[name] = SimulatedContext{Mu: mu, Threshold: dcfg.Threshold, Distance: mu - dcfg.Threshold, Decision: d}
+		if severity(d) > severity(res.Decision) {
+			res.Decision = d
+		}
+	}
+	return res, nil
+}
+
+// simulateRequest is the body of POST /harmony/simulate
+type simulateRequest struct {
+	// Scores by provider; every registered provider needs one
+	Scores map[string]float64 `json:"scores"`
+
+	// Checks by CH sub-check name; those left out pass
+	Checks map[string]bool `json:"checks"`
+
+	// Config, if set, is a YAML config to simulate under instead of the
+	// active one
+	Config string `json:"config"`
+}
+
+// serveSimulate answers POST /harmony/simulate
+func serveSimulate(w http.ResponseWriter, r *http.Request) {
+	var req simulateRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&req); err != nil {
+		http.Error(w, "bad simulate request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	cfg := activeConfig()
+	if req.Config != "" {
+		var err error
+		if cfg, err = parseHarmonyConfig(strings.NewReader(req.Config), "in request"); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	var scores []float64
+	for _, p := range harmonyProviders.Providers() {
+		s, ok := req.Scores[p.Name()]
+		if !ok {
+			http.Error(w, "no score for provider "+p.Name(), http.StatusBadRequest)
+			return
+		}
+		scores = append(scores, s)
+	}
+	if len(req.Scores) != len(scores) {
+		http.Error(w, "scores name an unknown provider", http.StatusBadRequest)
+		return
+	}
+	var checks CheckResults
+	for _, c := range harmonyCH.Checks() {
+		passed, ok := req.Checks[c.Name()]
+		checks = append(checks, CheckResult{Name: c.Name(), Required: c.Required(), Passed: passed || !ok})
+	}
+	for name := range req.Checks {
+		if !slices.ContainsFunc(checks, func(c CheckResult) bool { return c.Name == name }) {
+			http.Error(w, "unknown check "+name, http.StatusBadRequest)
+			return
+		}
+	}
+
+	res, err := cfg.Simulate(scores, checks)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	writeJSON(w, res)
+}
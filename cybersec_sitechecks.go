@@ -0,0 +1,247 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Site check types
+const (
+	CheckFile    = "file"    // a file exists, is fresh, or is absent
+	CheckCommand = "command" // a command exits 0
+	CheckHTTP    = "http"    // a GET answers 2xx
+)
+
+const (
+	defaultCheckEvery   = 30 * time.Second
+	defaultCheckTimeout = 10 * time.Second
+)
+
+// CheckConfig is a site check added from the config. File checks run each
+// cycle; command and http checks are too slow for that, so they run in
+// the background every Every and each cycle sees the last result.
+type CheckConfig struct {
+	// Type is file, command or http
+	Type string `yaml:"type"`
+
+	// Advisory checks are reported but don't break CH
+	Advisory bool `yaml:"advisory"`
+
+	// Path is the file a file check looks at. With MaxAge it must have
+	// been modified that recently; with Absent it must not exist, as for
+	// a change freeze flag.
+	Path   string        `yaml:"path"`
+	MaxAge time.Duration `yaml:"max_age"`
+	Absent bool          `yaml:"absent"`
+
+	// Command is the argv of a command check
+	Command []string `yaml:"command"`
+
+	// URL is what an http check GETs
+	URL string `yaml:"url"`
+
+	// Every and Timeout pace command and http checks; 0 means 30s and 10s
+	Every   time.Duration `yaml:"every"`
+	Timeout time.Duration `yaml:"timeout"`
+}
+
+func (c *CheckConfig) validate(name string) error {
+	if c.Every < 0 || c.Timeout < 0 || c.MaxAge < 0 {
+		return fmt.Errorf("check %s: every, timeout and max_age must be non-negative", name)
+	}
+	switch c.Type {
+	case CheckFile:
+		if c.Path == "" {
+			return fmt.Errorf("file check %s needs a path", name)
+		}
+		if c.Absent && c.MaxAge > 0 {
+			return fmt.Errorf("file check %s can't be both absent and fresh", name)
+		}
+	case CheckCommand:
+		if len(c.Command) == 0 || c.Command[0] == "" {
+			return fmt.Errorf("command check %s names no command", name)
+		}
+	case CheckHTTP:
+		u, err := url.Parse(c.URL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("http check %s needs an http or https url", name)
+		}
+	default:
+		return fmt.Errorf("unknown type %q for check %s: want file, command or http", c.Type, name)
+	}
+	return nil
+}
+
+// validateChecks checks the site checks are well formed and don't shadow
+// a built-in check or one a source adds
+func (c *HarmonyConfig) validateChecks(r *CheckRegistry) error {
+	sourced := map[string]bool{}
+	for _, sc := range c.Sources.checks() {
+		sourced[sc.Name()] = true
+	}
+	for name, cc := range c.Checks {
+		if name == "" {
+			return fmt.Errorf("check needs a name")
+		}
+		if r.builtin(name) {
+			return fmt.Errorf("check %s shadows a built-in check", name)
+		}
+		if sourced[name] {
+			return fmt.Errorf("check %s shadows a check its source adds", name)
+		}
+		if err := cc.validate(name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// applyChecks registers c's site checks in r, then those its sources add.
+// A site check whose config is unchanged is kept, with its last result.
+func (c *HarmonyConfig) applyChecks(r *CheckRegistry) {
+	names := make([]string, 0, len(c.Checks))
+	for name := range c.Checks {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var checks []Check
+	for _, name := range names {
+		cc := c.Checks[name]
+		if old, ok := r.Lookup(name); ok {
+			if sc, ok := old.(*siteCheck); ok && reflect.DeepEqual(sc.cfg, cc) {
+				checks = append(checks, sc)
+				continue
+			}
+		}
+		checks = append(checks, &siteCheck{name: name, cfg: cc})
+	}
+	r.setConfigured(append(checks, c.Sources.checks()...))
+}
+
+// siteCheck is a Check built from a CheckConfig
+type siteCheck struct {
+	name string
+	cfg  CheckConfig
+
+	mu      sync.Mutex
+	ran     bool
+	running bool
+	at      time.Time // when the last run finished
+	last    error
+}
+
+func (s *siteCheck) Name() string   { return s.name }
+func (s *siteCheck) Required() bool { return !s.cfg.Advisory }
+
+func (s *siteCheck) Evaluate(ctx context.Context) error {
+	if s.cfg.Type == CheckFile {
+		return s.checkFile()
+	}
+	s.mu.Lock()
+	if !s.ran {
+		// Run the first time on the loop, so the first cycle doesn't fail
+		// for want of a result
+		s.mu.Unlock()
+		s.refresh()
+		s.mu.Lock()
+	} else if !s.running && harmonyClock.Now().Sub(s.at) >= s.every() {
+		s.running = true
+		go s.refresh()
+	}
+	defer s.mu.Unlock()
+	return s.last
+}
+
+func (s *siteCheck) every() time.Duration {
+	if s.cfg.Every > 0 {
+		return s.cfg.Every
+	}
+	return defaultCheckEvery
+}
+
+// refresh runs the check and records its result
+func (s *siteCheck) refresh() {
+	timeout := s.cfg.Timeout
+	if timeout == 0 {
+		timeout = defaultCheckTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	var err error
+	switch s.cfg.Type {
+	case CheckCommand:
+		err = s.checkCommand(ctx)
+	case CheckHTTP:
+		err = s.checkHTTP(ctx)
+	}
+	if err != nil {
+		slog.Debug("site check failed", "check", s.name, "err", err)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.ran, s.running, s.at, s.last = true, false, harmonyClock.Now(), err
+}
+
+func (s *siteCheck) checkFile() error {
+	fi, err := os.Stat(s.cfg.Path)
+	switch {
+	case s.cfg.Absent && err == nil:
+		return fmt.Errorf("%s exists", s.cfg.Path)
+	case s.cfg.Absent && errors.Is(err, os.ErrNotExist):
+		return nil
+	case err != nil:
+		return err
+	}
+	if s.cfg.MaxAge > 0 {
+		if age := harmonyClock.Now().Sub(fi.ModTime()); age > s.cfg.MaxAge {
+			return fmt.Errorf("%s last modified %v ago, over max_age %v", s.cfg.Path, age.Round(time.Second), s.cfg.MaxAge)
+		}
+	}
+	return nil
+}
+
+func (s *siteCheck) checkCommand(ctx context.Context) error {
+	cmd := exec.CommandContext(ctx, s.cfg.Command[0], s.cfg.Command[1:]...)
+	cmd.Env = append(os.Environ(), "HARMONY_CHECK="+s.name)
+	out, err := cmd.CombinedOutput()
+	if err == nil {
+		return nil
+	}
+	if msg := strings.TrimSpace(string(out)); msg != "" {
+		const max = 200
+		if len(msg) > max {
+			msg = msg[:max] + "..."
+		}
+		return fmt.Errorf("%w: %s", err, msg)
+	}
+	return err
+}
+
+func (s *siteCheck) checkHTTP(ctx context.Context) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.cfg.URL, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 1<<16))
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("GET %s: %s", s.cfg.URL, resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,423 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kswhitlock9493-jpg/SR-AIbridge-/src/forgeauth"
+)
+
+// Sources are the concrete integrations behind score providers. A source
+// for a built-in provider, such as nvd for zero_day_exposure, scores it
+// while configured; a source of a new kind registers a provider of its
+// own. Dropping a source from the config leaves the built-in unsourced,
+// or removes the provider.
+
+// SourcesConfig configures the sources, by kind; nil means not configured
+type SourcesConfig struct {
+	// NVD scores zero_day_exposure from NVD and CISA KEV data matched
+	// against a software inventory
+	NVD *NVDConfig `yaml:"nvd"`
+
+	// SIEM scores soc_alert_coherence from a Splunk, Elastic or OpenSearch
+	// saved search of the SOC's alerts
+	SIEM *SIEMConfig `yaml:"siem"`
+
+	// Patches scores patch_latency from the security patches pending on
+	// this host and, optionally, across a fleet inventory
+	Patches *PatchConfig `yaml:"patches"`
+
+	// Firewall scores firewall_rules_entropy from this host's nftables or
+	// iptables ruleset and, optionally, cloud security groups
+	Firewall *FirewallConfig `yaml:"firewall"`
+
+	// RedTeam scores red_team_dwell_time from the red and purple team
+	// exercises reported to the API
+	RedTeam *RedTeamConfig `yaml:"redteam"`
+
+	// OSQuery scores the results of osquery queries, under a provider of
+	// its own
+	OSQuery *OSQueryConfig `yaml:"osquery"`
+
+	// Falco scores recent Falco events, under a provider of its own, and
+	// can add a CH check on them
+	Falco *FalcoConfig `yaml:"falco"`
+
+	// Syslog listens for syslog and CEF from network appliances and scores
+	// the threats they report, under a provider of its own
+	Syslog *SyslogConfig `yaml:"syslog"`
+
+	// EPSS scores the local vulnerability list by EPSS exploitation
+	// probabilities, under a provider of its own
+	EPSS *EPSSConfig `yaml:"epss"`
+}
+
+// sourceSpec is one configured source: the provider it registers and the
+// config it was built from
+type sourceSpec struct {
+	provider string
+	cfg      any
+	build    func() ScoreProvider
+}
+
+// specs lists the configured sources
+func (s *SourcesConfig) specs() []sourceSpec {
+	var specs []sourceSpec
+	if s.NVD != nil {
+		cfg := s.NVD
+		specs = append(specs, sourceSpec{"zero_day_exposure", *cfg, func() ScoreProvider { return newNVDProvider(cfg) }})
+	}
+	if s.SIEM != nil {
+		cfg := s.SIEM
+		specs = append(specs, sourceSpec{"soc_alert_coherence", *cfg, func() ScoreProvider { return newSIEMProvider(cfg) }})
+	}
+	if s.Patches != nil {
+		cfg := s.Patches
+		specs = append(specs, sourceSpec{"patch_latency", *cfg, func() ScoreProvider { return newPatchProvider(cfg) }})
+	}
+	if s.Firewall != nil {
+		cfg := s.Firewall
+		specs = append(specs, sourceSpec{"firewall_rules_entropy", *cfg, func() ScoreProvider { return newFirewallProvider(cfg) }})
+	}
+	if s.RedTeam != nil {
+		cfg := s.RedTeam
+		specs = append(specs, sourceSpec{"red_team_dwell_time", *cfg, func() ScoreProvider { return newRedTeamProvider(cfg) }})
+	}
+	if s.OSQuery != nil {
+		cfg := s.OSQuery
+		specs = append(specs, sourceSpec{cfg.name(), *cfg, func() ScoreProvider { return newOSQueryProvider(cfg) }})
+	}
+	if s.Falco != nil {
+		cfg := s.Falco
+		specs = append(specs, sourceSpec{cfg.name(), *cfg, func() ScoreProvider { return newFalcoProvider(cfg) }})
+	}
+	if s.Syslog != nil {
+		cfg := s.Syslog
+		specs = append(specs, sourceSpec{cfg.name(), *cfg, func() ScoreProvider { return newSyslogProvider(cfg) }})
+	}
+	if s.EPSS != nil {
+		cfg := s.EPSS
+		specs = append(specs, sourceSpec{cfg.name(), *cfg, func() ScoreProvider { return newEPSSProvider(cfg) }})
+	}
+	return specs
+}
+
+// checks returns the CH checks the sources add
+func (s *SourcesConfig) checks() []Check {
+	var checks []Check
+	if s.Falco != nil && s.Falco.Check {
+		checks = append(checks, newFalcoCheck(s.Falco))
+	}
+	return checks
+}
+
+// validate checks each configured source
+func (s *SourcesConfig) validate() error {
+	if s.NVD != nil {
+		if err := s.NVD.validate(); err != nil {
+			return fmt.Errorf("sources nvd: %w", err)
+		}
+	}
+	if s.SIEM != nil {
+		if err := s.SIEM.validate(); err != nil {
+			return fmt.Errorf("sources siem: %w", err)
+		}
+	}
+	if s.Patches != nil {
+		if err := s.Patches.validate(); err != nil {
+			return fmt.Errorf("sources patches: %w", err)
+		}
+	}
+	if s.Firewall != nil {
+		if err := s.Firewall.validate(); err != nil {
+			return fmt.Errorf("sources firewall: %w", err)
+		}
+	}
+	if s.RedTeam != nil {
+		if err := s.RedTeam.validate(); err != nil {
+			return fmt.Errorf("sources redteam: %w", err)
+		}
+	}
+	if s.OSQuery != nil {
+		if err := s.OSQuery.validate(); err != nil {
+			return fmt.Errorf("sources osquery: %w", err)
+		}
+	}
+	if s.Falco != nil {
+		if err := s.Falco.validate(); err != nil {
+			return fmt.Errorf("sources falco: %w", err)
+		}
+	}
+	if s.Syslog != nil {
+		if err := s.Syslog.validate(); err != nil {
+			return fmt.Errorf("sources syslog: %w", err)
+		}
+	}
+	if s.EPSS != nil {
+		if err := s.EPSS.validate(); err != nil {
+			return fmt.Errorf("sources epss: %w", err)
+		}
+	}
+	seen := map[string]bool{}
+	for _, spec := range s.specs() {
+		if seen[spec.provider] {
+			return fmt.Errorf("sources: more than one source for provider %s", spec.provider)
+		}
+		seen[spec.provider] = true
+	}
+	return nil
+}
+
+// sourced is a provider built from a source
+type sourced interface {
+	ScoreProvider
+	source() any
+}
+
+// harmonyBuiltins are the providers as registered before any source
+// replaced them
+var harmonyBuiltins = newDefaultProviders().Providers()
+
+func builtinProvider(name string) (ScoreProvider, bool) {
+	for _, p := range harmonyBuiltins {
+		if p.Name() == name {
+			return p, true
+		}
+	}
+	return nil, false
+}
+
+// builtinWeight is the weight the named built-in provider registers with
+func builtinWeight(name string) float64 {
+	if b, ok := builtinProvider(name); ok {
+		return b.Weight()
+	}
+	return 0
+}
+
+// unwrapped is p without any weight override
+func unwrapped(p ScoreProvider) ScoreProvider {
+	if rw, ok := p.(reweighted); ok {
+		return rw.ScoreProvider
+	}
+	return p
+}
+
+// apply registers the configured sources in r and unregisters those no
+// longer configured, returning the providers they displaced. A source
+// whose config is unchanged keeps its provider, and what that provider
+// has cached.
+func (s *SourcesConfig) apply(r *ProviderRegistry) (added, dropped []ScoreProvider, err error) {
+	wanted := map[string]bool{}
+	for _, spec := range s.specs() {
+		wanted[spec.provider] = true
+		old, ok := r.lookup(spec.provider)
+		if ok {
+			if sp, ok := unwrapped(old).(sourced); ok && reflect.DeepEqual(sp.source(), spec.cfg) {
+				continue
+			}
+		}
+		p := spec.build()
+		if err := r.Register(p); err != nil {
+			return added, dropped, err
+		}
+		added = append(added, p)
+		if ok {
+			dropped = append(dropped, unwrapped(old))
+		}
+	}
+	for _, p := range r.Providers() {
+		if _, ok := unwrapped(p).(sourced); !ok || wanted[p.Name()] {
+			continue
+		}
+		if b, ok := builtinProvider(p.Name()); ok {
+			r.Register(b)
+		} else {
+			r.Remove(p.Name())
+		}
+		dropped = append(dropped, unwrapped(p))
+	}
+	return added, dropped, nil
+}
+
+// closeSources releases what displaced source providers hold open
+func closeSources(dropped []ScoreProvider) {
+	for _, p := range dropped {
+		if c, ok := p.(io.Closer); ok {
+			if err := c.Close(); err != nil {
+				slog.Warn("close score source", "provider", p.Name(), "err", err)
+			}
+		}
+	}
+}
+
+// preview returns a copy of r as it would be with the sources applied, for
+// validating a config against before it is applied. Source providers
+// connect lazily, so building them here opens nothing.
+func (s *SourcesConfig) preview(r *ProviderRegistry) *ProviderRegistry {
+	p := &ProviderRegistry{providers: r.Providers()}
+	s.apply(p)
+	return p
+}
+
+// lookup returns the named provider
+func (r *ProviderRegistry) lookup(name string) (ScoreProvider, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if i := r.index(name); i >= 0 {
+		return r.providers[i], true
+	}
+	return nil, false
+}
+
+var errNoData = errors.New("no data yet")
+
+// refreshedScore is a ScoreProvider for sources too slow to query every
+// cycle: refresh runs in the background every every, and each cycle scores
+// the last result. Collect fails until the first refresh succeeds, and
+// once the last success is older than maxAge, so the provider's stale
+// policy applies.
+type refreshedScore struct {
+	name    string
+	weight  float64
+	every   time.Duration
+	timeout time.Duration
+	maxAge  time.Duration
+	refresh func(ctx context.Context) (float64, error)
+
+	mu      sync.Mutex
+	running bool
+	tried   time.Time // when the last refresh began
+	score   float64
+	at      time.Time // when the last good refresh finished
+	err     error     // the last refresh's error
+}
+
+func (s *refreshedScore) Name() string    { return s.name }
+func (s *refreshedScore) Weight() float64 { return s.weight }
+
+func (s *refreshedScore) Collect(context.Context) (float64, error) {
+	now := harmonyClock.Now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.running && (s.tried.IsZero() || now.Sub(s.tried) >= s.every) {
+		s.running, s.tried = true, now
+		go s.run()
+	}
+	switch {
+	case s.at.IsZero() && s.err != nil:
+		return 0, s.err
+	case s.at.IsZero():
+		return 0, errNoData
+	case now.Sub(s.at) > s.maxAge:
+		err := fmt.Errorf("last refreshed %v ago, over max age %v", now.Sub(s.at).Round(time.Second), s.maxAge)
+		if s.err != nil {
+			err = fmt.Errorf("%w: %w", err, s.err)
+		}
+		return 0, err
+	}
+	return s.score, nil
+}
+
+func (s *refreshedScore) run() {
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+	defer cancel()
+	score, err := s.refresh(ctx)
+	if err != nil {
+		slog.Warn("score source refresh failed", "provider", s.name, "err", err)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.running, s.err = false, err
+	if err == nil {
+		s.score, s.at = score, harmonyClock.Now()
+	}
+}
+
+// SourceAuth is how a source authenticates to its backend. Credentials
+// kept in files - a token file the forge dominion rotates, or a ForgeToken
+// it issued - are reread on every request, so rotation needs no reload.
+type SourceAuth struct {
+	// Token is sent as "<Scheme> <token>"; $VARS are expanded.
+	// TokenFile holds the token instead.
+	Token     string `yaml:"token"`
+	TokenFile string `yaml:"token_file"`
+
+	// Scheme is the Authorization scheme Token is sent with; empty means
+	// the backend's usual one
+	Scheme string `yaml:"scheme"`
+
+	// ForgeToken is the path of a ForgeToken the dominion saved, sealed
+	// with this user's token store key or as plain JSON with
+	// file+plaintext://, sent with the Forge scheme for backends behind a
+	// forge-authenticating gateway
+	ForgeToken string `yaml:"forge_token"`
+
+	// Username and Password authenticate by basic auth; $VARS in Password
+	// are expanded
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+}
+
+func (a *SourceAuth) validate() error {
+	n := 0
+	for _, set := range []bool{a.Token != "", a.TokenFile != "", a.ForgeToken != "", a.Username != ""} {
+		if set {
+			n++
+		}
+	}
+	if n > 1 {
+		return fmt.Errorf("auth takes one of token, token_file, forge_token and username")
+	}
+	return nil
+}
+
+// authorize sets req's credentials, with scheme for a token unless Scheme
+// overrides it
+func (a *SourceAuth) authorize(req *http.Request, scheme string) error {
+	if a.Scheme != "" {
+		scheme = a.Scheme
+	}
+	switch {
+	case a.Token != "":
+		req.Header.Set("Authorization", scheme+" "+os.ExpandEnv(a.Token))
+	case a.TokenFile != "":
+		data, err := os.ReadFile(a.TokenFile)
+		if err != nil {
+			return fmt.Errorf("read token: %w", err)
+		}
+		req.Header.Set("Authorization", scheme+" "+strings.TrimSpace(string(data)))
+	case a.ForgeToken != "":
+		t, err := loadForgeToken(a.ForgeToken)
+		if err != nil {
+			return err
+		}
+		if err := forgeauth.SetRequestToken(req, t); err != nil {
+			return fmt.Errorf("forge token %s: %w", a.ForgeToken, err)
+		}
+	case a.Username != "":
+		req.SetBasicAuth(a.Username, os.ExpandEnv(a.Password))
+	}
+	return nil
+}
+
+// loadForgeToken loads a saved ForgeToken, refusing one already expired
+func loadForgeToken(path string) (*forgeauth.ForgeToken, error) {
+	t, err := forgeauth.LoadToken(path)
+	if err != nil {
+		return nil, fmt.Errorf("forge token %s: %w", path, err)
+	}
+	if now := harmonyClock.Now(); now.After(t.ExpiresAt) {
+		return nil, fmt.Errorf("forge token %s expired at %s", path, t.ExpiresAt)
+	}
+	return t, nil
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"time"
+)
+
+// Stale policies: what a provider whose query failed or timed out scores
+const (
+	StaleWorstCase = "worst_case" // score 0, failing the cycle closed
+	StaleDecay     = "decay"      // reuse the last good score, decayed each cycle
+	StaleSkip      = "skip"       // leave the provider out and reweight the rest
+)
+
+var errQueryRunning = errors.New("previous query still running")
+
+// ProviderPolicy bounds a provider's query and says how a failed one
+// scores
+type ProviderPolicy struct {
+	// Timeout is the query deadline; 0 means half the interval
+	Timeout time.Duration `yaml:"timeout"`
+
+	// Stale is worst_case, decay or skip
+	Stale string `yaml:"stale"`
+
+	// Decay multiplies the last good score once per failed cycle, in (0, 1]
+	Decay float64 `yaml:"decay"`
+
+	// MaxAge is how long after the last good score decay falls back to
+	// worst_case
+	MaxAge time.Duration `yaml:"max_age"`
+}
+
+func defaultProviderPolicy() ProviderPolicy {
+	return ProviderPolicy{Stale: StaleWorstCase, Decay: 0.9, MaxAge: 10 * time.Second}
+}
+
+func (p *ProviderPolicy) validate(what string) error {
+	switch p.Stale {
+	case StaleWorstCase, StaleDecay, StaleSkip:
+	default:
+		return fmt.Errorf("%s: unknown stale policy %q", what, p.Stale)
+	}
+	if p.Timeout < 0 || p.MaxAge < 0 {
+		return fmt.Errorf("%s: timeout and max_age must be non-negative", what)
+	}
+	if !(p.Decay > 0 && p.Decay <= 1) {
+		return fmt.Errorf("%s: decay %v must be in (0, 1]", what, p.Decay)
+	}
+	return nil
+}
+
+// providerPolicy returns name's policy: its override, with unset fields
+// taken from the default policy
+func (c *HarmonyConfig) providerPolicy(name string) ProviderPolicy {
+	pol := c.ProviderPolicy
+	o, ok := c.ProviderPolicies[name]
+	if !ok {
+		return pol
+	}
+	if o.Timeout != 0 {
+		pol.Timeout = o.Timeout
+	}
+	if o.Stale != "" {
+		pol.Stale = o.Stale
+	}
+	if o.Decay != 0 {
+		pol.Decay = o.Decay
+	}
+	if o.MaxAge != 0 {
+		pol.MaxAge = o.MaxAge
+	}
+	return pol
+}
+
+// queryTimeout is the deadline of name's query
+func (c *HarmonyConfig) queryTimeout(name string) time.Duration {
+	if t := c.providerPolicy(name).Timeout; t > 0 {
+		return t
+	}
+	return c.Interval / 2
+}
+
+// validateProviderPolicies checks the policies, and that overrides name
+// registered providers
+func (c *HarmonyConfig) validateProviderPolicies(r *ProviderRegistry) error {
+	if err := c.ProviderPolicy.validate("provider_policy"); err != nil {
+		return err
+	}
+	registered := map[string]bool{}
+	for _, p := range r.Providers() {
+		registered[p.Name()] = true
+	}
+	for name := range c.ProviderPolicies {
+		if !registered[name] {
+			return fmt.Errorf("provider policy for unknown score provider %s", name)
+		}
+		pol := c.providerPolicy(name)
+		if err := pol.validate("provider policy for " + name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// providerState is what the registry remembers of a provider between
+// cycles
+type providerState struct {
+	running bool      // a query is in flight
+	last    float64   // last good score
+	at      time.Time // when it was collected; zero if never
+	misses  int       // failed cycles since
+}
+
+// query runs p.Collect with a deadline. A query the deadline abandons
+// keeps running in the background, and p isn't queried again until it
+// returns.
+func (r *ProviderRegistry) query(ctx context.Context, p ScoreProvider, timeout time.Duration) (float64, error) {
+	st := r.state(p.Name())
+	r.stateMu.Lock()
+	if st.running {
+		r.stateMu.Unlock()
+		return 0, errQueryRunning
+	}
+	st.running = true
+	r.stateMu.Unlock()
+
+	qctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	type result struct {
+		score float64
+		err   error
+	}
+	done := make(chan result, 1)
+	go func() {
+		s, err := p.Collect(qctx)
+		r.stateMu.Lock()
+		st.running = false
+		r.stateMu.Unlock()
+		done <- result{s, err}
+	}()
+	select {
+	case res := <-done:
+		if res.err == nil && math.IsNaN(res.score) {
+			res.err = errors.New("score is NaN")
+		}
+		return res.score, res.err
+	case <-qctx.Done():
+		return 0, fmt.Errorf("query timed out after %v: %w", timeout, qctx.Err())
+	}
+}
+
+func (r *ProviderRegistry) state(name string) *providerState {
+	r.stateMu.Lock()
+	defer r.stateMu.Unlock()
+	if r.states == nil {
+		r.states = make(map[string]*providerState)
+	}
+	st, ok := r.states[name]
+	if !ok {
+		st = &providerState{}
+		r.states[name] = st
+	}
+	return st
+}
+
+// good records a score collected at now
+func (r *ProviderRegistry) good(name string, score float64, now time.Time) {
+	st := r.state(name)
+	r.stateMu.Lock()
+	defer r.stateMu.Unlock()
+	st.last, st.at, st.misses = score, now, 0
+}
+
+// stale scores a provider whose query failed at now under pol. It returns
+// the policy applied, which is worst_case when decay has no recent score
+// to decay; keep is false when the provider is skipped.
+func (r *ProviderRegistry) stale(name string, pol ProviderPolicy, now time.Time) (score float64, keep bool, applied string) {
+	st := r.state(name)
+	r.stateMu.Lock()
+	defer r.stateMu.Unlock()
+	st.misses++
+	switch pol.Stale {
+	case StaleSkip:
+		return 0, false, StaleSkip
+	case StaleDecay:
+		if !st.at.IsZero() && now.Sub(st.at) <= pol.MaxAge {
+			return st.last * math.Pow(pol.Decay, float64(st.misses)), true, StaleDecay
+		}
+	}
+	return 0, true, StaleWorstCase
+}
+
+// lastGood is when name last returned a good score; zero if never
+func (r *ProviderRegistry) lastGood(name string) time.Time {
+	st := r.state(name)
+	r.stateMu.Lock()
+	defer r.stateMu.Unlock()
+	return st.at
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+)
+
+// Decisions, mildest first. CAUTION and DEGRADED are only reached when
+// their thresholds are configured; otherwise any dip below the threshold
+// halts, as before.
+const (
+	DecisionGo       = "CHANGE_GO"
+	DecisionCaution  = "CHANGE_CAUTION"
+	DecisionDegraded = "CHANGE_DEGRADED"
+	DecisionHalt     = "CHANGE_HALT"
+)
+
+// defaultActions run for decisions the config doesn't list
+var defaultActions = map[string][]string{
+	DecisionGo:       nil,
+	DecisionCaution:  {"alert"},
+	DecisionDegraded: {"alert", "autoheal"},
+	DecisionHalt:     {"autoheal", "log_fault", "hold_privileged_access"},
+}
+
+// level grades one cycle, before debouncing. A failed CH check always halts.
+func (c *HarmonyConfig) level(mu float64, ch bool) string {
+	switch {
+	case !ch:
+		return DecisionHalt
+	case mu >= c.Threshold:
+		return DecisionGo
+	case c.CautionThreshold > 0 && mu >= c.CautionThreshold:
+		return DecisionCaution
+	case c.DegradedThreshold > 0 && mu >= c.DegradedThreshold:
+		return DecisionDegraded
+	}
+	return DecisionHalt
+}
+
+// pendingLevel is reported while a halt is being debounced: the most
+// severe state short of halting
+func (c *HarmonyConfig) pendingLevel() string {
+	switch {
+	case c.DegradedThreshold > 0:
+		return DecisionDegraded
+	case c.CautionThreshold > 0:
+		return DecisionCaution
+	}
+	return DecisionGo
+}
+
+// actionsFor returns the actions decision runs, in order
+func (c *HarmonyConfig) actionsFor(decision string) []string {
+	if names, ok := c.Actions[decision]; ok {
+		return names
+	}
+	return defaultActions[decision]
+}
+
+// validateStates checks the state thresholds descend from Threshold and
+// that actions name known decisions and actions
+func (c *HarmonyConfig) validateStates() error {
+	floor := c.Threshold
+	if c.CautionThreshold != 0 {
+		if !(c.CautionThreshold > 0 && c.CautionThreshold < floor) {
+			return fmt.Errorf("caution_threshold %v must be in (0, threshold)", c.CautionThreshold)
+		}
+		floor = c.CautionThreshold
+	}
+	if c.DegradedThreshold != 0 && !(c.DegradedThreshold > 0 && c.DegradedThreshold < floor) {
+		return fmt.Errorf("degraded_threshold %v must be in (0, caution_threshold or threshold)", c.DegradedThreshold)
+	}
+	for decision, names := range c.Actions {
+		if _, ok := defaultActions[decision]; !ok {
+			return fmt.Errorf("actions for unknown decision %s", decision)
+		}
+		for _, name := range names {
+			a, ok := c.action(name)
+			if !ok {
+				return fmt.Errorf("unknown action %s for %s", name, decision)
+			}
+			if h, ok := a.(hookAction); ok && len(c.hook(string(h))) == 0 {
+				return fmt.Errorf("action %s for %s needs a hook", name, decision)
+			}
+		}
+	}
+	return nil
+}
+
+// runActions runs the actions configured for ev's decision, in order. A
+// failed action is logged and counted, and the rest still run. Enforcement
+// actions run only on the elected leader.
+func (c *HarmonyConfig) runActions(ctx context.Context, ev ActionEvent) {
+	for _, name := range c.actionsFor(ev.Decision) {
+		a, ok := c.action(name)
+		if !ok {
+			continue
+		}
+		aev := ev
+		aev.cfg = c
+		if enforces(a) {
+			if !harmonyLeadership.leading {
+				continue
+			}
+			if harmonyLeadership.gained {
+				// Enforce the inherited decision as if just entered
+				aev.Previous = ""
+			}
+		}
+		if err := a.Run(ctx, aev); err != nil {
+			harmonyMetrics.observeActionError(name)
+			slog.WarnContext(ctx, "action failed", "action", name, "decision", ev.Decision, "err", err)
+		}
+	}
+}
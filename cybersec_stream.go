@@ -0,0 +1,188 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net"
+	"slices"
+	"sync"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/encoding"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+
+	"github.com/kswhitlock9493-jpg/SR-AIbridge-/src/forgeauth"
+)
+
+// The decision stream is a hand-written gRPC service, with no generated
+// code: messages are JSON, so clients must call with
+// grpc.CallContentSubtype("json"). The service is
+//
+//	service harmony.v1.Harmony {
+//	  rpc Subscribe(SubscribeRequest) returns (stream CycleRecord);
+//	}
+//
+// and authenticates with a ForgeToken in the "x-forge-token" metadata.
+
+const (
+	harmonyServiceName = "harmony.v1.Harmony"
+	forgeTokenMetadata = "x-forge-token"
+	subscriberBuffer   = 16
+)
+
+// SubscribeRequest opens a decision stream. Decisions, if set, filters the
+// stream to those decisions.
+type SubscribeRequest struct {
+	Decisions []string `json:"decisions,omitempty"`
+}
+
+// jsonCodec is the "json" gRPC content subtype
+type jsonCodec struct{}
+
+func (jsonCodec) Marshal(v any) ([]byte, error)      { return json.Marshal(v) }
+func (jsonCodec) Unmarshal(data []byte, v any) error { return json.Unmarshal(data, v) }
+func (jsonCodec) Name() string                       { return "json" }
+
+func init() {
+	encoding.RegisterCodec(jsonCodec{})
+}
+
+// decisionHub fans each cycle out to subscribers. A subscriber that falls
+// subscriberBuffer cycles behind misses cycles rather than slowing the loop.
+type decisionHub struct {
+	mu   sync.Mutex
+	subs map[chan CycleRecord]struct{}
+}
+
+var harmonyStream = &decisionHub{subs: make(map[chan CycleRecord]struct{})}
+
+func (h *decisionHub) subscribe() chan CycleRecord {
+	ch := make(chan CycleRecord, subscriberBuffer)
+	h.mu.Lock()
+	h.subs[ch] = struct{}{}
+	h.mu.Unlock()
+	return ch
+}
+
+func (h *decisionHub) unsubscribe(ch chan CycleRecord) {
+	h.mu.Lock()
+	delete(h.subs, ch)
+	h.mu.Unlock()
+}
+
+// publish never blocks
+func (h *decisionHub) publish(rec CycleRecord) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for ch := range h.subs {
+		select {
+		case ch <- rec:
+		default:
+			harmonyMetrics.observeStreamDrop()
+		}
+	}
+}
+
+// harmonyService is the handler type of harmony.v1.Harmony
+type harmonyService interface {
+	subscribe(req *SubscribeRequest, stream grpc.ServerStream) error
+}
+
+// harmonyServer implements harmonyService
+type harmonyServer struct {
+	hub  *decisionHub
+	done chan struct{} // closed at shutdown, ending every stream
+}
+
+func (s *harmonyServer) subscribe(req *SubscribeRequest, stream grpc.ServerStream) error {
+	ch := s.hub.subscribe()
+	defer s.hub.unsubscribe(ch)
+	for {
+		select {
+		case <-stream.Context().Done():
+			return nil
+		case <-s.done:
+			return nil
+		case rec := <-ch:
+			if len(req.Decisions) > 0 && !slices.Contains(req.Decisions, rec.Decision) {
+				continue
+			}
+			if err := stream.SendMsg(&rec); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+var harmonyServiceDesc = grpc.ServiceDesc{
+	ServiceName: harmonyServiceName,
+	HandlerType: (*harmonyService)(nil),
+	Streams: []grpc.StreamDesc{{
+		StreamName:    "Subscribe",
+		ServerStreams: true,
+		Handler: func(srv any, stream grpc.ServerStream) error {
+			var req SubscribeRequest
+			if err := stream.RecvMsg(&req); err != nil {
+				return err
+			}
+			return srv.(harmonyService).subscribe(&req, stream)
+		},
+	}},
+}
+
+// streamAuth is a stream interceptor requiring a ForgeToken
+func (v *forgeVerifier) streamAuth(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	ctx := ss.Context()
+	md, _ := metadata.FromIncomingContext(ctx)
+	encoded := md.Get(forgeTokenMetadata)
+	if len(encoded) == 0 {
+		return status.Error(codes.Unauthenticated, "no forge token in metadata")
+	}
+	remote := ""
+	if p, ok := peer.FromContext(ctx); ok && p.Addr != nil {
+		remote = p.Addr.String()
+	}
+	if _, err := v.verify(encoded[0], remote, v.scope); err != nil {
+		slog.WarnContext(ctx, "harmony stream rejected", "remote", remote, "method", info.FullMethod, "err", err)
+		return status.Error(forgeauth.GRPCCode(err), err.Error())
+	}
+	return handler(srv, ss)
+}
+
+// serveHarmonyStream serves the decision stream on addr. It returns once
+// the listener is bound, with a func that ends the streams and stops the
+// server; serving errors are logged.
+func serveHarmonyStream(addr string, verifier *forgeVerifier) (func(context.Context) error, error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("listen for harmony stream: %w", err)
+	}
+	srv := grpc.NewServer(grpc.ChainStreamInterceptor(verifier.streamAuth))
+	hs := &harmonyServer{hub: harmonyStream, done: make(chan struct{})}
+	srv.RegisterService(&harmonyServiceDesc, hs)
+	go func() {
+		if err := srv.Serve(ln); err != nil {
+			slog.Error("harmony stream server stopped", "err", err)
+		}
+	}()
+	return func(ctx context.Context) error {
+		close(hs.done)
+		stopped := make(chan struct{})
+		go func() {
+			srv.GracefulStop()
+			close(stopped)
+		}()
+		select {
+		case <-stopped:
+			return nil
+		case <-ctx.Done():
+			srv.Stop()
+			return fmt.Errorf("stop harmony stream: %w", ctx.Err())
+		}
+	}, nil
+}
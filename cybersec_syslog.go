@@ -0,0 +1,583 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The syslog source listens for syslog from network appliances, CEF or
+// plain, and scores the threat levels they report. Each event is
+// classified as it arrives by the first rule it matches, which sets its
+// penalty; the score is the product of one minus the penalties of the
+// events in the window. An event's severity is its CEF severity, 0 to 10,
+// or for plain syslog its priority's severity on the same scale.
+// Appliances' clocks can't be trusted, so events are timed on receipt.
+
+const (
+	defaultSyslogName   = "perimeter_threats"
+	defaultSyslogWeight = 0.1
+	defaultSyslogWindow = 10 * time.Minute
+	maxSyslogEvents     = 10000
+	maxSyslogMessage    = 64 << 10
+)
+
+// defaultSyslogRules classify by severity alone
+var defaultSyslogRules = []SyslogRule{
+	{Name: "very_high", MinSeverity: 9, Penalty: 0.25},
+	{Name: "high", MinSeverity: 7, Penalty: 0.1},
+	{Name: "medium", MinSeverity: 4, Penalty: 0.02},
+}
+
+// syslogSeverities puts syslog's severities, 0 emergency to 7 debug, on
+// CEF's 0 to 10 scale
+var syslogSeverities = [8]int{10, 9, 8, 6, 4, 2, 1, 0}
+
+// SyslogConfig configures the syslog source. Zero fields take their
+// defaults.
+type SyslogConfig struct {
+	// Name is the provider's, perimeter_threats by default, and Weight its
+	// registered weight, 0.1 by default
+	Name   string  `yaml:"name"`
+	Weight float64 `yaml:"weight"`
+
+	// Listen are the addresses listened on, as udp://host:port or
+	// tcp://host:port. TCP takes newline or octet-counted framing.
+	Listen []string `yaml:"listen"`
+
+	// Window is how far back events are scored, 10m by default
+	Window time.Duration `yaml:"window"`
+
+	// Rules classify events, first match first; an event no rule matches
+	// costs nothing. None means penalties of 0.25 from severity 9, 0.1
+	// from 7 and 0.02 from 4.
+	Rules []SyslogRule `yaml:"rules"`
+}
+
+// SyslogRule matches events and sets their penalty. Empty fields match
+// anything; a penalty of 0 lets matching events through unscored.
+type SyslogRule struct {
+	Name string `yaml:"name"`
+
+	// Vendor, Product and Signature match CEF's device vendor, device
+	// product and signature ID, ignoring case
+	Vendor    string `yaml:"vendor"`
+	Product   string `yaml:"product"`
+	Signature string `yaml:"signature"`
+
+	// Host matches the sending host, ignoring case
+	Host string `yaml:"host"`
+
+	// Match is a regexp on the CEF name, or the message of plain syslog
+	Match string `yaml:"match"`
+
+	// MinSeverity is the least severity matched, 0 to 10
+	MinSeverity int `yaml:"min_severity"`
+
+	Penalty float64 `yaml:"penalty"`
+}
+
+func (c *SyslogConfig) validate() error {
+	if c.Weight < 0 || math.IsNaN(c.Weight) || math.IsInf(c.Weight, 0) {
+		return fmt.Errorf("weight %v must be non-negative", c.Weight)
+	}
+	if len(c.Listen) == 0 {
+		return fmt.Errorf("needs an address to listen on")
+	}
+	for _, l := range c.Listen {
+		if _, _, err := parseSyslogListen(l); err != nil {
+			return err
+		}
+	}
+	if c.Window < 0 {
+		return fmt.Errorf("window %v must be non-negative", c.Window)
+	}
+	for i, r := range c.Rules {
+		if _, err := regexp.Compile(r.Match); err != nil {
+			return fmt.Errorf("rule %d match: %w", i+1, err)
+		}
+		if r.MinSeverity < 0 || r.MinSeverity > 10 {
+			return fmt.Errorf("rule %d min_severity %d must be in [0, 10]", i+1, r.MinSeverity)
+		}
+		if !(r.Penalty >= 0 && r.Penalty <= 1) {
+			return fmt.Errorf("rule %d penalty %v must be in [0, 1]", i+1, r.Penalty)
+		}
+	}
+	return nil
+}
+
+func parseSyslogListen(l string) (network, addr string, err error) {
+	network, addr, ok := strings.Cut(l, "://")
+	if !ok || (network != "udp" && network != "tcp") {
+		return "", "", fmt.Errorf("listen %q must be udp://host:port or tcp://host:port", l)
+	}
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		return "", "", fmt.Errorf("listen %q: %w", l, err)
+	}
+	return network, addr, nil
+}
+
+func (c *SyslogConfig) name() string {
+	if c.Name != "" {
+		return c.Name
+	}
+	return defaultSyslogName
+}
+
+// withDefaults returns c with its zero fields defaulted
+func (c SyslogConfig) withDefaults() SyslogConfig {
+	c.Name = c.name()
+	if c.Weight == 0 {
+		c.Weight = defaultSyslogWeight
+		if _, ok := builtinProvider(c.Name); ok {
+			c.Weight = builtinWeight(c.Name)
+		}
+	}
+	if c.Window == 0 {
+		c.Window = defaultSyslogWindow
+	}
+	if len(c.Rules) == 0 {
+		c.Rules = defaultSyslogRules
+	}
+	return c
+}
+
+// syslogEvent is one parsed message
+type syslogEvent struct {
+	Time      time.Time
+	Host      string
+	Vendor    string // CEF only, as are Product and Signature
+	Product   string
+	Signature string
+	Name      string // the CEF name, or the syslog message
+	Severity  int    // 0 to 10
+	Rule      string // the rule it matched
+	Penalty   float64
+}
+
+// parseSyslog parses an RFC 3164 or RFC 5424 message, with or without a
+// CEF payload
+func parseSyslog(msg string) (syslogEvent, error) {
+	msg = strings.TrimRight(msg, "\r\n\x00")
+	var ev syslogEvent
+	if !strings.HasPrefix(msg, "<") {
+		return ev, fmt.Errorf("no priority")
+	}
+	end := strings.IndexByte(msg, '>')
+	if end < 2 {
+		return ev, fmt.Errorf("bad priority")
+	}
+	pri, err := strconv.Atoi(msg[1:end])
+	if err != nil || pri < 0 || pri > 191 {
+		return ev, fmt.Errorf("bad priority %q", msg[1:end])
+	}
+	ev.Severity = syslogSeverities[pri%8]
+	rest := msg[end+1:]
+	if f := strings.SplitN(rest, " ", 7); len(f) == 7 && f[0] == "1" {
+		// RFC 5424: VERSION TIMESTAMP HOSTNAME APP-NAME PROCID MSGID SD MSG
+		ev.Host, rest = f[2], f[6]
+		if strings.HasPrefix(rest, "[") {
+			rest = skipStructuredData(rest)
+		} else if rest == "-" || strings.HasPrefix(rest, "- ") {
+			rest = strings.TrimPrefix(rest[1:], " ") // no structured data
+		}
+	} else if len(rest) > 16 && rest[3] == ' ' && rest[15] == ' ' {
+		// RFC 3164: Mmm dd hh:mm:ss HOSTNAME MSG
+		ev.Host, rest, _ = strings.Cut(rest[16:], " ")
+	}
+	if ev.Host == "-" {
+		ev.Host = ""
+	}
+	rest = strings.TrimPrefix(rest, "\ufeff") // a UTF-8 BOM
+	if i := strings.Index(rest, "CEF:"); i >= 0 {
+		return ev, parseCEF(rest[i:], &ev)
+	}
+	ev.Name = strings.TrimSpace(rest)
+	return ev, nil
+}
+
+// skipStructuredData returns what follows RFC 5424 structured data
+func skipStructuredData(s string) string {
+	for strings.HasPrefix(s, "[") {
+		i, esc, quoted := 1, false, false
+	scan:
+		for ; i < len(s); i++ {
+			switch {
+			case esc:
+				esc = false
+			case s[i] == '\\':
+				esc = true
+			case s[i] == '"':
+				quoted = !quoted
+			case s[i] == ']' && !quoted:
+				break scan
+			}
+		}
+		s = s[min(i+1, len(s)):]
+	}
+	return strings.TrimPrefix(s, " ")
+}
+
+// parseCEF parses CEF:Version|Vendor|Product|Version|Signature|Name|Severity|Extension.
+// Header fields escape | and \ with a backslash; \=, which only the
+// extension needs, is taken as = too, as some appliances escape it
+// everywhere.
+func parseCEF(s string, ev *syslogEvent) error {
+	var fields []string
+	var b strings.Builder
+	for i := 0; i < len(s) && len(fields) < 7; i++ {
+		switch {
+		case s[i] == '\\' && i+1 < len(s) && (s[i+1] == '|' || s[i+1] == '\\' || s[i+1] == '='):
+			i++
+			b.WriteByte(s[i])
+		case s[i] == '|':
+			fields = append(fields, b.String())
+			b.Reset()
+		default:
+			b.WriteByte(s[i])
+		}
+	}
+	if len(fields) == 6 {
+		fields = append(fields, b.String()) // no extension
+	}
+	if len(fields) < 7 {
+		return fmt.Errorf("cef header has %d of 8 fields", len(fields)+1)
+	}
+	ev.Vendor, ev.Product, ev.Signature, ev.Name = fields[1], fields[2], fields[4], fields[5]
+	sev, err := cefSeverity(fields[6])
+	if err != nil {
+		return err
+	}
+	ev.Severity = sev
+	return nil
+}
+
+func cefSeverity(s string) (int, error) {
+	if n, err := strconv.Atoi(strings.TrimSpace(s)); err == nil && n >= 0 && n <= 10 {
+		return n, nil
+	}
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "low":
+		return 2, nil
+	case "medium":
+		return 5, nil
+	case "high":
+		return 7, nil
+	case "very-high":
+		return 9, nil
+	}
+	return 0, fmt.Errorf("bad cef severity %q", s)
+}
+
+// syslogRule is a SyslogRule with its regexp compiled
+type syslogRule struct {
+	SyslogRule
+	match *regexp.Regexp
+}
+
+func (r *syslogRule) matches(ev *syslogEvent) bool {
+	return ev.Severity >= r.MinSeverity &&
+		(r.Vendor == "" || strings.EqualFold(r.Vendor, ev.Vendor)) &&
+		(r.Product == "" || strings.EqualFold(r.Product, ev.Product)) &&
+		(r.Signature == "" || strings.EqualFold(r.Signature, ev.Signature)) &&
+		(r.Host == "" || strings.EqualFold(r.Host, ev.Host)) &&
+		(r.match == nil || r.match.MatchString(ev.Name))
+}
+
+// syslogEvents keeps the recent classified events, oldest first, across
+// reloads of the source
+type syslogEvents struct {
+	mu     sync.Mutex
+	events []syslogEvent
+}
+
+var harmonySyslog = &syslogEvents{}
+
+func (s *syslogEvents) add(ev syslogEvent, keep time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.events = append(s.events, ev)
+	cut := 0
+	if len(s.events) > maxSyslogEvents {
+		cut = len(s.events) - maxSyslogEvents
+	}
+	for cut < len(s.events) && ev.Time.Sub(s.events[cut].Time) > keep {
+		cut++
+	}
+	s.events = s.events[cut:]
+}
+
+// score is the product of one less the penalties of the events no older
+// than d
+func (s *syslogEvents) score(d time.Duration) float64 {
+	now := harmonyClock.Now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	score := 1.0
+	for i := len(s.events) - 1; i >= 0 && now.Sub(s.events[i].Time) <= d; i-- {
+		score *= 1 - s.events[i].Penalty
+	}
+	return score
+}
+
+// syslogProvider is the syslog source's provider
+type syslogProvider struct {
+	src   SyslogConfig // as configured, to tell a changed config
+	cfg   SyslogConfig // defaulted
+	rules []syslogRule
+
+	mu        sync.Mutex
+	started   bool
+	listeners []io.Closer
+	err       error // why a listener couldn't be opened
+	wg        sync.WaitGroup
+}
+
+func newSyslogProvider(src *SyslogConfig) *syslogProvider {
+	p := &syslogProvider{src: *src, cfg: src.withDefaults()}
+	for _, r := range p.cfg.Rules {
+		sr := syslogRule{SyslogRule: r}
+		if r.Match != "" {
+			sr.match = regexp.MustCompile(r.Match)
+		}
+		p.rules = append(p.rules, sr)
+	}
+	return p
+}
+
+func (p *syslogProvider) Name() string    { return p.cfg.Name }
+func (p *syslogProvider) Weight() float64 { return p.cfg.Weight }
+func (p *syslogProvider) source() any     { return p.src }
+
+// Collect scores the events in the window. The first call opens the
+// listeners, so a provider built only to validate a config opens nothing.
+func (p *syslogProvider) Collect(context.Context) (float64, error) {
+	if err := p.start(); err != nil {
+		return 0, err
+	}
+	return harmonySyslog.score(p.cfg.Window), nil
+}
+
+func (p *syslogProvider) start() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.started {
+		return p.err
+	}
+	p.started = true
+	for _, l := range p.cfg.Listen {
+		network, addr, _ := parseSyslogListen(l)
+		var err error
+		if network == "udp" {
+			err = p.listenUDP(addr)
+		} else {
+			err = p.listenTCP(addr)
+		}
+		if err != nil {
+			p.err = fmt.Errorf("syslog listen %s: %w", l, err)
+			slog.Error("syslog listener not started", "listen", l, "err", err)
+			return p.err
+		}
+		slog.Info("syslog listening", "listen", l)
+	}
+	return nil
+}
+
+func (p *syslogProvider) listenUDP(addr string) error {
+	conn, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return err
+	}
+	p.listeners = append(p.listeners, conn)
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		buf := make([]byte, maxSyslogMessage)
+		for {
+			n, from, err := conn.ReadFrom(buf)
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			if err != nil {
+				slog.Debug("syslog read", "err", err)
+				continue
+			}
+			p.ingest(string(buf[:n]), from)
+		}
+	}()
+	return nil
+}
+
+func (p *syslogProvider) listenTCP(addr string) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	p.listeners = append(p.listeners, ln)
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		var conns sync.WaitGroup
+		defer conns.Wait()
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				if errors.Is(err, net.ErrClosed) {
+					return
+				}
+				slog.Debug("syslog accept", "err", err)
+				continue
+			}
+			p.track(conn)
+			conns.Add(1)
+			go func() {
+				defer conns.Done()
+				defer p.untrack(conn)
+				p.readTCP(conn)
+			}()
+		}
+	}()
+	return nil
+}
+
+// track keeps conn to be closed along with the listeners
+func (p *syslogProvider) track(conn net.Conn) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.listeners = append(p.listeners, conn)
+}
+
+func (p *syslogProvider) untrack(conn net.Conn) {
+	conn.Close()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for i, l := range p.listeners {
+		if l == conn {
+			p.listeners = append(p.listeners[:i:i], p.listeners[i+1:]...)
+			return
+		}
+	}
+}
+
+// readTCP reads messages until the stream ends or can't be framed
+func (p *syslogProvider) readTCP(conn net.Conn) {
+	r := bufio.NewReaderSize(conn, maxSyslogMessage)
+	for {
+		msg, err := readSyslogFrame(r)
+		if errors.Is(err, errSyslogOversized) {
+			slog.Debug("syslog message dropped", "from", conn.RemoteAddr(), "err", err)
+			continue
+		}
+		if err != nil {
+			if !errors.Is(err, io.EOF) {
+				slog.Debug("syslog stream dropped", "from", conn.RemoteAddr(), "err", err)
+			}
+			return
+		}
+		p.ingest(msg, conn.RemoteAddr())
+	}
+}
+
+var errSyslogOversized = fmt.Errorf("message over %d bytes", maxSyslogMessage)
+
+// readSyslogFrame reads one message from r, a reader of maxSyslogMessage,
+// framed by a newline or, when the frame starts with a digit, by an octet
+// count. A newline-framed message too long to keep is skipped with
+// errSyslogOversized; any other error leaves the stream unframeable.
+func readSyslogFrame(r *bufio.Reader) (string, error) {
+	b, err := r.Peek(1)
+	if err != nil {
+		return "", err
+	}
+	if b[0] >= '0' && b[0] <= '9' {
+		count, err := r.ReadSlice(' ')
+		if errors.Is(err, io.EOF) && len(count) > 0 {
+			err = io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return "", fmt.Errorf("octet count: %w", err)
+		}
+		n, err := strconv.Atoi(string(count[:len(count)-1]))
+		if err != nil || n <= 0 || n > maxSyslogMessage {
+			return "", fmt.Errorf("bad octet count %q", count)
+		}
+		buf := make([]byte, n)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			if errors.Is(err, io.EOF) {
+				err = io.ErrUnexpectedEOF
+			}
+			return "", fmt.Errorf("message of %d octets: %w", n, err)
+		}
+		return string(buf), nil
+	}
+	line, err := r.ReadSlice('\n')
+	if errors.Is(err, bufio.ErrBufferFull) {
+		for errors.Is(err, bufio.ErrBufferFull) {
+			_, err = r.ReadSlice('\n')
+		}
+		if err != nil && !errors.Is(err, io.EOF) {
+			return "", err
+		}
+		return "", errSyslogOversized
+	}
+	if err != nil && !errors.Is(err, io.EOF) {
+		return "", err
+	}
+	// A sender may close after its last message without a newline
+	if len(line) == 0 {
+		return "", io.EOF
+	}
+	return string(line), nil
+}
+
+// ingest parses and classifies msg, and keeps it if it is scored
+func (p *syslogProvider) ingest(msg string, from net.Addr) {
+	if strings.TrimSpace(msg) == "" {
+		return
+	}
+	ev, err := parseSyslog(msg)
+	if err != nil {
+		slog.Debug("syslog message dropped", "from", from, "err", err)
+		return
+	}
+	if ev.Host == "" {
+		if host, _, err := net.SplitHostPort(from.String()); err == nil {
+			ev.Host = host
+		}
+	}
+	for i := range p.rules {
+		if p.rules[i].matches(&ev) {
+			ev.Rule, ev.Penalty = p.rules[i].Name, p.rules[i].Penalty
+			break
+		}
+	}
+	if ev.Penalty == 0 {
+		return
+	}
+	ev.Time = harmonyClock.Now()
+	slog.Debug("syslog threat", "host", ev.Host, "vendor", ev.Vendor, "product", ev.Product,
+		"signature", ev.Signature, "name", ev.Name, "severity", ev.Severity, "rule", ev.Rule, "penalty", ev.Penalty)
+	harmonySyslog.add(ev, p.cfg.Window)
+}
+
+// Close stops listening, and waits for the readers to finish
+func (p *syslogProvider) Close() error {
+	p.mu.Lock()
+	listeners := append([]io.Closer(nil), p.listeners...)
+	p.mu.Unlock()
+	for _, l := range listeners {
+		l.Close()
+	}
+	p.wg.Wait()
+	return nil
+}
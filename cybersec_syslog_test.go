@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestParseSyslog(t *testing.T) {
+	tests := []struct {
+		name string
+		msg  string
+		want syslogEvent
+		ok   bool
+	}{
+		{"rfc 3164", "<10>Oct 14 10:00:00 ids1 port scan detected\n",
+			syslogEvent{Host: "ids1", Name: "port scan detected", Severity: 8}, true},
+		{"rfc 3164 cef", "<134>Oct 14 10:00:00 fw1 CEF:0|Palo Alto Networks|PAN-OS|10.1|threat|Spyware phone home|8|src=192.0.2.4",
+			syslogEvent{Host: "fw1", Vendor: "Palo Alto Networks", Product: "PAN-OS", Signature: "threat", Name: "Spyware phone home", Severity: 8}, true},
+		{"rfc 3164 without a header", "<13>exploit attempt",
+			syslogEvent{Name: "exploit attempt", Severity: 2}, true},
+		{"rfc 5424", `<10>1 2026-10-14T10:00:00Z ids1 snort 12 - - something bad`,
+			syslogEvent{Host: "ids1", Name: "something bad", Severity: 8}, true},
+		{"rfc 5424 structured data", `<10>1 2026-10-14T10:00:00Z ids1 snort 12 - [meta x="]y" z="\"]"][origin ip="192.0.2.1"] something bad`,
+			syslogEvent{Host: "ids1", Name: "something bad", Severity: 8}, true},
+		{"rfc 5424 nil host and bom", "<14>1 - - - - - - \ufeffCEF:0|v|p|1|s|n|Very-High",
+			syslogEvent{Vendor: "v", Product: "p", Signature: "s", Name: "n", Severity: 9}, true},
+		{"cef escaped pipe", `<134>Oct 14 10:00:00 fw1 CEF:0|v|p|1|threat\|x|a \| b|8|`,
+			syslogEvent{Host: "fw1", Vendor: "v", Product: "p", Signature: "threat|x", Name: "a | b", Severity: 8}, true},
+		{"cef escaped backslash", `<134>Oct 14 10:00:00 fw1 CEF:0|v|p|1|s|C:\\temp\\x.exe|5|`,
+			syslogEvent{Host: "fw1", Vendor: "v", Product: "p", Signature: "s", Name: `C:\temp\x.exe`, Severity: 5}, true},
+		{"cef escaped equals", `<134>Oct 14 10:00:00 fw1 CEF:0|v|p|1|s|a\=b|5|msg=x\=y`,
+			syslogEvent{Host: "fw1", Vendor: "v", Product: "p", Signature: "s", Name: "a=b", Severity: 5}, true},
+		{"cef pipes in the extension", `<134>Oct 14 10:00:00 fw1 CEF:0|v|p|1|s|n|3|msg=a|b|c`,
+			syslogEvent{Host: "fw1", Vendor: "v", Product: "p", Signature: "s", Name: "n", Severity: 3}, true},
+		{"cef without an extension", "<134>Oct 14 10:00:00 fw1 CEF:0|v|p|1|s|n|High",
+			syslogEvent{Host: "fw1", Vendor: "v", Product: "p", Signature: "s", Name: "n", Severity: 7}, true},
+		{"no priority", "Oct 14 10:00:00 fw1 hello", syslogEvent{}, false},
+		{"empty priority", "<>hello", syslogEvent{}, false},
+		{"priority out of range", "<192>hello", syslogEvent{}, false},
+		{"truncated priority", "<13", syslogEvent{}, false},
+		{"truncated cef header", "<134>Oct 14 10:00:00 fw1 CEF:0|v|p|1|s", syslogEvent{}, false},
+		{"escaped pipe short of a header", `<134>Oct 14 10:00:00 fw1 CEF:0|v|p|1|s|n\|8`, syslogEvent{}, false},
+		{"cef severity out of range", "<134>Oct 14 10:00:00 fw1 CEF:0|v|p|1|s|n|11|", syslogEvent{}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ev, err := parseSyslog(tt.msg)
+			if (err == nil) != tt.ok {
+				t.Fatalf("got %+v, %v; want ok %t", ev, err, tt.ok)
+			}
+			if tt.ok && ev != tt.want {
+				t.Errorf("got %+v, want %+v", ev, tt.want)
+			}
+		})
+	}
+}
+
+// readFrames frames stream as readTCP does, returning the messages read,
+// the oversized ones skipped, and the error that ended the stream
+func readFrames(stream string) (msgs []string, skipped int, err error) {
+	r := bufio.NewReaderSize(strings.NewReader(stream), maxSyslogMessage)
+	for {
+		msg, err := readSyslogFrame(r)
+		if errors.Is(err, errSyslogOversized) {
+			skipped++
+			continue
+		}
+		if err != nil {
+			return msgs, skipped, err
+		}
+		msgs = append(msgs, msg)
+	}
+}
+
+func TestReadSyslogFrame(t *testing.T) {
+	long := "<13>" + strings.Repeat("x", maxSyslogMessage)
+	tests := []struct {
+		name    string
+		stream  string
+		msgs    []string
+		skipped int
+		eof     bool // the stream ended cleanly
+	}{
+		{"newlines", "<13>a\n<13>b\n", []string{"<13>a\n", "<13>b\n"}, 0, true},
+		{"last without a newline", "<13>a\n<13>b", []string{"<13>a\n", "<13>b"}, 0, true},
+		{"octet counted", "5 <13>a6 <13>bc", []string{"<13>a", "<13>bc"}, 0, true},
+		{"octet counted with newlines inside", "8 <13>a\nb\n", []string{"<13>a\nb\n"}, 0, true},
+		{"mixed", "5 <13>a<13>b\n5 <13>c", []string{"<13>a", "<13>b\n", "<13>c"}, 0, true},
+		{"oversized line skipped", long + "\n<13>next\n", []string{"<13>next\n"}, 1, true},
+		{"oversized line at the end", long, nil, 1, true},
+		{"oversized octet count", "70000 <13>a", nil, 0, false},
+		{"zero octet count", "0 <13>a", nil, 0, false},
+		{"octet count without a message", "12", nil, 0, false},
+		{"digits past the buffer", strings.Repeat("1", maxSyslogMessage+1), nil, 0, false},
+		{"truncated octet-counted message", "5 <13>a9 <13>b", []string{"<13>a"}, 0, false},
+		{"octet count with nothing after", "5 <13>a9 ", []string{"<13>a"}, 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			msgs, skipped, err := readFrames(tt.stream)
+			if !slices.Equal(msgs, tt.msgs) || skipped != tt.skipped {
+				t.Errorf("read %q skipping %d, want %q skipping %d", msgs, skipped, tt.msgs, tt.skipped)
+			}
+			if errors.Is(err, io.EOF) != tt.eof {
+				t.Errorf("stream ended with %v, want a clean end %t", err, tt.eof)
+			}
+		})
+	}
+}
+
+func FuzzParseSyslog(f *testing.F) {
+	for _, seed := range []string{
+		"<10>Oct 14 10:00:00 ids1 port scan detected",
+		"<134>Oct 14 10:00:00 fw1 CEF:0|v|p|1|threat\\|x|a\\=b|8|src=192.0.2.4",
+		`<10>1 2026-10-14T10:00:00Z ids1 snort 12 - [meta x="]y"] something bad`,
+		"<14>1 - - - - - - \ufeffCEF:0|v|p|1|s|n|Very-High",
+		"5 <13>a<13>b\n",
+	} {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, msg string) {
+		if ev, err := parseSyslog(msg); err == nil && (ev.Severity < 0 || ev.Severity > 10) {
+			t.Errorf("%q parsed to severity %d", msg, ev.Severity)
+		}
+		msgs, _, _ := readFrames(msg)
+		for _, m := range msgs {
+			if len(m) > maxSyslogMessage {
+				t.Errorf("framed a message of %d bytes", len(m))
+			}
+		}
+	})
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+)
+
+// harmonyTracer follows the global tracer provider, so spans are dropped
+// until setupTracing installs an exporter
+var harmonyTracer = otel.Tracer("harmony")
+
+// setupTracing exports spans over OTLP/gRPC to endpoint, e.g.
+// "http://collector:4317". The returned function flushes and stops the
+// exporter.
+func setupTracing(ctx context.Context, endpoint string) (func(context.Context) error, error) {
+	exp, err := otlptracegrpc.New(ctx, otlptracegrpc.WithEndpointURL(endpoint))
+	if err != nil {
+		return nil, fmt.Errorf("create otlp exporter: %w", err)
+	}
+	tp := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exp),
+		sdktrace.WithResource(resource.NewSchemaless(attribute.String("service.name", "harmony"))),
+	)
+	otel.SetTracerProvider(tp)
+	return tp.Shutdown, nil
+}
@@ -0,0 +1,336 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"slices"
+	"sort"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// harmony tune replays recorded cycles against labeled incidents and
+// suggests the weights and threshold that would have halted best. Every
+// weighting on a grid over the simplex is tried, each with the threshold
+// that scores best for it; a halt is scored per cycle, before halt_after
+// debouncing.
+
+// Incident is a labeled period the engine should have halted in
+type Incident struct {
+	Name  string `yaml:"name"`
+	Start string `yaml:"start"` // RFC 3339
+	End   string `yaml:"end"`
+}
+
+type incidentFile struct {
+	Incidents []Incident `yaml:"incidents"`
+}
+
+// incidentWindow is an incident's period, widened by the lead
+type incidentWindow struct {
+	start, end time.Time
+}
+
+func readIncidents(path string, lead time.Duration) ([]incidentWindow, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("open incidents: %w", err)
+	}
+	defer f.Close()
+	var file incidentFile
+	dec := yaml.NewDecoder(f)
+	dec.KnownFields(true)
+	if err := dec.Decode(&file); err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("parse incidents %s: %w", path, err)
+	}
+	var windows []incidentWindow
+	for i, inc := range file.Incidents {
+		start, err := time.Parse(time.RFC3339, inc.Start)
+		if err != nil {
+			return nil, fmt.Errorf("incident %d (%s): start: %w", i, inc.Name, err)
+		}
+		end, err := time.Parse(time.RFC3339, inc.End)
+		if err != nil {
+			return nil, fmt.Errorf("incident %d (%s): end: %w", i, inc.Name, err)
+		}
+		if end.Before(start) {
+			return nil, fmt.Errorf("incident %d (%s) ends before it starts", i, inc.Name)
+		}
+		windows = append(windows, incidentWindow{start.Add(-lead), end})
+	}
+	return windows, nil
+}
+
+// labeled reports whether t falls in an incident
+func labeled(t time.Time, windows []incidentWindow) bool {
+	for _, w := range windows {
+		if !t.Before(w.start) && !t.After(w.end) {
+			return true
+		}
+	}
+	return false
+}
+
+// tuneResult is how one weighting and threshold would have done
+type tuneResult struct {
+	weights   []float64
+	threshold float64
+	tp, fp    int
+	fn, tn    int
+	score     float64 // F-beta
+}
+
+func (r *tuneResult) precision() float64 { return ratio(r.tp, r.tp+r.fp) }
+func (r *tuneResult) recall() float64    { return ratio(r.tp, r.tp+r.fn) }
+
+func ratio(a, b int) float64 {
+	if b == 0 {
+		return 0
+	}
+	return float64(a) / float64(b)
+}
+
+// fBeta weighs recall beta times as much as precision
+func fBeta(tp, fp, fn int, beta float64) float64 {
+	b2 := beta * beta
+	d := (1+b2)*float64(tp) + b2*float64(fn) + float64(fp)
+	if d == 0 {
+		return 0
+	}
+	return (1 + b2) * float64(tp) / d
+}
+
+// tuner scores weightings of recorded cycles
+type tuner struct {
+	names  []string
+	scores [][]float64 // by cycle, in names order, clamped as calculateMu does
+	labels []bool
+	agg    Aggregator
+	beta   float64
+}
+
+func newTuner(recs []CycleRecord, windows []incidentWindow, cfg *HarmonyConfig, beta float64) (*tuner, error) {
+	agg, err := cfg.aggregator()
+	if err != nil {
+		return nil, err
+	}
+	t := &tuner{agg: agg, beta: beta}
+	for _, p := range harmonyProviders.Providers() {
+		t.names = append(t.names, p.Name())
+	}
+	for _, rec := range recs {
+		row := make([]float64, len(t.names))
+		for i, name := range t.names {
+			// A score missing from a cycle was skipped or never collected;
+			// score it worst case, as the loop does by default
+			row[i] = math.Max(math.Min(rec.Scores[name], 1), cfg.MinScore)
+		}
+		t.scores = append(t.scores, row)
+		t.labels = append(t.labels, labeled(rec.Time, windows))
+	}
+	if !slices.Contains(t.labels, true) {
+		return nil, errors.New("no recorded cycle falls in an incident")
+	}
+	return t, nil
+}
+
+// evaluate scores weights at threshold
+func (t *tuner) evaluate(weights []float64, threshold float64) tuneResult {
+	r := tuneResult{weights: weights, threshold: threshold}
+	for i, row := range t.scores {
+		halted := t.agg(row, weights) < threshold
+		switch {
+		case halted && t.labels[i]:
+			r.tp++
+		case halted:
+			r.fp++
+		case t.labels[i]:
+			r.fn++
+		default:
+			r.tn++
+		}
+	}
+	r.score = fBeta(r.tp, r.fp, r.fn, t.beta)
+	return r
+}
+
+// best finds the threshold that scores weights best: halting the k
+// lowest-mu cycles, for each k, with the threshold just above the k-th
+func (t *tuner) best(weights []float64) tuneResult {
+	type cycle struct {
+		mu    float64
+		label bool
+	}
+	cycles := make([]cycle, len(t.scores))
+	positives := 0
+	for i, row := range t.scores {
+		cycles[i] = cycle{t.agg(row, weights), t.labels[i]}
+		if t.labels[i] {
+			positives++
+		}
+	}
+	sort.Slice(cycles, func(i, j int) bool { return cycles[i].mu < cycles[j].mu })
+
+	bestK, bestScore := 0, -1.0
+	tp, fp := 0, 0
+	for k := 0; k <= len(cycles); k++ {
+		// Only cut between distinct mu, which a threshold can separate
+		if k == 0 || k == len(cycles) || cycles[k].mu > cycles[k-1].mu {
+			if s := fBeta(tp, fp, positives-tp, t.beta); s > bestScore {
+				bestK, bestScore = k, s
+			}
+		}
+		if k < len(cycles) {
+			if cycles[k].label {
+				tp++
+			} else {
+				fp++
+			}
+		}
+	}
+	var threshold float64
+	switch {
+	case bestK == 0:
+		threshold = math.Min(cycles[0].mu, 1)
+	case bestK == len(cycles):
+		threshold = 1
+	default:
+		threshold = (cycles[bestK-1].mu + cycles[bestK].mu) / 2
+	}
+	return t.evaluate(weights, threshold)
+}
+
+// simplex calls fn with every weighting of n providers in steps of 1/steps
+func simplex(n, steps int, fn func(weights []float64)) {
+	units := make([]int, n)
+	var walk func(i, left int)
+	walk = func(i, left int) {
+		if i == n-1 {
+			units[i] = left
+			weights := make([]float64, n)
+			for j, u := range units {
+				weights[j] = float64(u) / float64(steps)
+			}
+			fn(weights)
+			return
+		}
+		for u := 0; u <= left; u++ {
+			units[i] = u
+			walk(i+1, left-u)
+		}
+	}
+	walk(0, steps)
+}
+
+// search tries every weighting on the grid and returns the best, ties
+// going to the weighting closest to current
+func (t *tuner) search(step float64, current []float64) tuneResult {
+	steps := int(math.Round(1 / step))
+	best := tuneResult{score: -1}
+	bestDist := math.Inf(1)
+	simplex(len(t.names), steps, func(weights []float64) {
+		r := t.best(weights)
+		d := 0.0
+		for i := range weights {
+			d += math.Abs(weights[i] - current[i])
+		}
+		if r.score > best.score || (r.score == best.score && d < bestDist) {
+			best, bestDist = r, d
+		}
+	})
+	return best
+}
+
+// currentWeights is the weighting cfg runs with, normalized like Collect
+func (t *tuner) currentWeights(cfg *HarmonyConfig) []float64 {
+	weights := make([]float64, len(t.names))
+	total := 0.0
+	for i, p := range harmonyProviders.Providers() {
+		w, ok := cfg.Weights[p.Name()]
+		if !ok {
+			w = baseWeight(p)
+		}
+		weights[i] = w
+		total += w
+	}
+	if total > 0 {
+		for i := range weights {
+			weights[i] /= total
+		}
+	}
+	return weights
+}
+
+// runTune is the harmony tune subcommand
+func runTune(args []string) {
+	fs := flag.NewFlagSet("tune", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: harmony tune -cycles FILE -incidents FILE [flags]")
+		fs.PrintDefaults()
+	}
+	configPath := fs.String("config", os.Getenv("HARMONY_CONFIG"), "harmony config file (YAML) to tune from")
+	cyclesPath := fs.String("cycles", "", "recorded cycles: a -record-cycles file, /harmony/history output or a fault journal")
+	incidentsPath := fs.String("incidents", "", "labeled incidents (YAML)")
+	lead := fs.Duration("lead", 0, "also count this long before each incident as one, to reward early halts")
+	step := fs.Float64("step", 0.1, "weight grid step; each halving multiplies the search by about 2^(providers-1)")
+	beta := fs.Float64("beta", 2, "weigh recall this many times as much as precision")
+	fs.Parse(args)
+
+	if *cyclesPath == "" || *incidentsPath == "" {
+		fs.Usage()
+		os.Exit(2)
+	}
+	if !(*step > 0 && *step <= 0.5) {
+		fatal("tune", fmt.Errorf("step %v must be in (0, 0.5]", *step))
+	}
+	if !(*beta > 0) {
+		fatal("tune", fmt.Errorf("beta %v must be positive", *beta))
+	}
+	cfg, err := LoadHarmonyConfig(*configPath)
+	if err != nil {
+		fatal("load harmony config", err)
+	}
+	recs, err := readCycleRecords(*cyclesPath)
+	if err != nil {
+		fatal("tune", err)
+	}
+	windows, err := readIncidents(*incidentsPath, *lead)
+	if err != nil {
+		fatal("tune", err)
+	}
+	t, err := newTuner(recs, windows, cfg, *beta)
+	if err != nil {
+		fatal("tune", err)
+	}
+
+	current := t.evaluate(t.currentWeights(cfg), cfg.Threshold)
+	suggested := t.search(*step, current.weights)
+	writeTuneReport(os.Stdout, t, len(recs), &current, &suggested)
+}
+
+func writeTuneReport(w io.Writer, t *tuner, n int, current, suggested *tuneResult) {
+	positives := 0
+	for _, l := range t.labels {
+		if l {
+			positives++
+		}
+	}
+	fmt.Fprintf(w, "# %d cycles, %d in incidents\n", n, positives)
+	for _, r := range []struct {
+		what string
+		res  *tuneResult
+	}{{"current", current}, {"suggested", suggested}} {
+		fmt.Fprintf(w, "# %-9s  F%.3g %.4f  precision %.4f  recall %.4f  (tp %d fp %d fn %d tn %d)\n",
+			r.what, t.beta, r.res.score, r.res.precision(), r.res.recall(), r.res.tp, r.res.fp, r.res.fn, r.res.tn)
+	}
+	fmt.Fprintf(w, "threshold: %.6g\n", suggested.threshold)
+	fmt.Fprintln(w, "weights:")
+	for i, name := range t.names {
+		fmt.Fprintf(w, "  %s: %.4g\n", name, suggested.weights[i])
+	}
+}
@@ -0,0 +1,920 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/kswhitlock9493-jpg/SR-AIbridge-/src/forgeauth"
+)
+
+// CLI exit codes, stable for scripting
+const (
+	exitOK      = 0
+	exitError   = 1 // runtime failure, e.g. missing key or unreadable file
+	exitUsage   = 2 // bad command line or configuration
+	exitInvalid = 3 // token failed validation
+	exitExpired = 4 // token expired
+	exitRevoked = 5 // token revoked
+)
+
+const cliUsage = `usage: forge-auth <command> [flags]
+
+commands:
+  issue     issue a token        --node --scope [--ttl] [--tenant] [--audience]
+                                 [--claim name=value]... [--role name]... [--out]
+                                 [--wrap ttl] [--bind-key pem]
+                                 or --profile [--node] [--out], with --profiles
+  validate  validate a token     --file
+  renew     renew a token        --file [--ttl] [--out] [--refresh]
+  delegate  issue a refresher    --file --ttl --out
+  revoke    revoke a token       --file | --id --expires, with --ledger or --store
+  sessions  list active sessions [--node] [--tenant], with --ledger or --store
+  kill      end a session        --session [--tenant], with --ledger or --store
+  enroll    create a node code   --node --scope [--tenant] [--ttl] [--code-ttl],
+                                 with --store
+  redeem    redeem a node code   --code [--out], with --store
+  unwrap    unwrap a token       --file [--out], with --store
+  migrate   rewrite a token      --from --to [--allow-expired]
+
+Every command accepts --config, --output json|table, --ledger or --store,
+--roles and --profiles; renewals follow the renewal policy of the token's
+profile. With a webhook configured, issue, renew and revoke are also
+POSTed to it, signed with $FORGE_AUTH_WEBHOOK_SECRET.
+Settings are taken from flags, then FORGE_AUTH_* environment variables,
+then the config file (--config, $FORGE_AUTH_CONFIG or
+~/.config/forge-auth/config.json).
+`
+
+// cliDefaultTTL is the lifetime of tokens issued without a configured TTL
+const cliDefaultTTL = time.Hour
+
+// cliConfig holds settings shared by the subcommands. Field names double
+// as config file keys; env names are FORGE_AUTH_ plus the upper-cased key.
+type cliConfig struct {
+	Node     string `json:"node"`
+	Scope    string `json:"scope"`
+	Tenant   string `json:"tenant"`
+	Audience string `json:"audience"`
+	TTL      string `json:"ttl"`
+	Token    string `json:"token"`
+	Output   string `json:"output"`
+	Ledger   string `json:"ledger"`
+	Profiles string `json:"profiles"`
+	Profile  string `json:"profile"`
+	Webhook  string `json:"webhook"`
+	Store    string `json:"store"`
+	Roles    string `json:"roles"`
+}
+
+// cliError carries the exit code for a failure
+type cliError struct {
+	code int
+	err  error
+}
+
+func (e *cliError) Error() string { return e.err.Error() }
+func (e *cliError) Unwrap() error { return e.err }
+
+func usageError(format string, args ...any) error {
+	return &cliError{code: exitUsage, err: fmt.Errorf(format, args...)}
+}
+
+func main() {
+	os.Exit(runCLI(os.Args[1:], os.Stdout, os.Stderr))
+}
+
+// runCLI runs the forge-auth command line and returns the exit code
+func runCLI(args []string, stdout, stderr io.Writer) int {
+	if len(args) == 0 || args[0] == "-h" || args[0] == "--help" || args[0] == "help" {
+		fmt.Fprint(stderr, cliUsage)
+		if len(args) == 0 {
+			return exitUsage
+		}
+		return exitOK
+	}
+
+	commands := map[string]func(*cliContext) error{
+		"issue":    cmdIssue,
+		"validate": cmdValidate,
+		"renew":    cmdRenew,
+		"delegate": cmdDelegate,
+		"revoke":   cmdRevoke,
+		"sessions": cmdSessions,
+		"kill":     cmdKill,
+		"enroll":   cmdEnroll,
+		"redeem":   cmdRedeem,
+		"unwrap":   cmdUnwrap,
+		"migrate":  cmdMigrate,
+	}
+	cmd, ok := commands[args[0]]
+	if !ok {
+		fmt.Fprintf(stderr, "forge-auth: unknown command %q\n\n%s", args[0], cliUsage)
+		return exitUsage
+	}
+
+	c := &cliContext{name: args[0], args: args[1:], stdout: stdout, stderr: stderr}
+	err := cmd(c)
+	if err == nil {
+		return exitOK
+	}
+	if errors.Is(err, flag.ErrHelp) {
+		return exitOK
+	}
+	fmt.Fprintf(stderr, "forge-auth %s: %v\n", c.name, err)
+	return exitCode(err)
+}
+
+// exitCode maps an error to the CLI exit code for its class
+func exitCode(err error) int {
+	var ce *cliError
+	switch {
+	case errors.As(err, &ce):
+		return ce.code
+	case errors.Is(err, forgeauth.ErrExpired):
+		return exitExpired
+	case errors.Is(err, forgeauth.ErrRevoked):
+		return exitRevoked
+	case errors.Is(err, forgeauth.ErrMalformed), errors.Is(err, forgeauth.ErrBadSignature), errors.Is(err, forgeauth.ErrClockSkew),
+		errors.Is(err, forgeauth.ErrTenantMismatch), errors.Is(err, forgeauth.ErrAudienceMismatch):
+		return exitInvalid
+	}
+	return exitError
+}
+
+// cliContext is the state of one subcommand invocation
+type cliContext struct {
+	name   string
+	args   []string
+	stdout io.Writer
+	stderr io.Writer
+
+	fs         *flag.FlagSet
+	flags      cliConfig
+	configPath string
+	cfg        cliConfig
+}
+
+// flagSet returns a flag set with the shared flags registered
+func (c *cliContext) flagSet() *flag.FlagSet {
+	fs := flag.NewFlagSet("forge-auth "+c.name, flag.ContinueOnError)
+	fs.SetOutput(c.stderr)
+	fs.StringVar(&c.configPath, "config", "", "config file")
+	fs.StringVar(&c.flags.Output, "output", "", "output format: json or table")
+	fs.StringVar(&c.flags.Ledger, "ledger", "", "issuance ledger file")
+	fs.StringVar(&c.flags.Profiles, "profiles", "", "token profiles file")
+	fs.StringVar(&c.flags.Store, "store", "", "SQLite state file, instead of --ledger")
+	fs.StringVar(&c.flags.Roles, "roles", "", "role bindings file")
+	c.fs = fs
+	return fs
+}
+
+// parse parses the command line and resolves the configuration with flag,
+// then environment, then config file precedence
+func (c *cliContext) parse() error {
+	if err := c.fs.Parse(c.args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return err
+		}
+		return &cliError{code: exitUsage, err: err}
+	}
+	if c.fs.NArg() > 0 {
+		return usageError("unexpected argument %q", c.fs.Arg(0))
+	}
+
+	cfg, err := loadCLIConfig(c.configPath)
+	if err != nil {
+		return err
+	}
+	overlay(&cfg, envCLIConfig())
+	overlay(&cfg, c.flags)
+	if cfg.Output == "" {
+		cfg.Output = "table"
+	}
+	if cfg.Output != "json" && cfg.Output != "table" {
+		return usageError("unknown output format %q", cfg.Output)
+	}
+	c.cfg = cfg
+	return nil
+}
+
+func loadCLIConfig(path string) (cliConfig, error) {
+	explicit := path != ""
+	if path == "" {
+		path = os.Getenv("FORGE_AUTH_CONFIG")
+		explicit = path != ""
+	}
+	if path == "" {
+		if dir, err := os.UserConfigDir(); err == nil {
+			path = filepath.Join(dir, "forge-auth", "config.json")
+		}
+	}
+
+	var cfg cliConfig
+	if path == "" {
+		return cfg, nil
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) && !explicit {
+		return cfg, nil
+	}
+	if err != nil {
+		return cfg, usageError("failed to read config: %v", err)
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&cfg); err != nil {
+		return cfg, usageError("invalid config %s: %v", path, err)
+	}
+	return cfg, nil
+}
+
+func envCLIConfig() cliConfig {
+	return cliConfig{
+		Node:     os.Getenv("FORGE_AUTH_NODE"),
+		Scope:    os.Getenv("FORGE_AUTH_SCOPE"),
+		Tenant:   os.Getenv("FORGE_AUTH_TENANT"),
+		Audience: os.Getenv("FORGE_AUTH_AUDIENCE"),
+		TTL:      os.Getenv("FORGE_AUTH_TTL"),
+		Token:    os.Getenv("FORGE_AUTH_TOKEN"),
+		Output:   os.Getenv("FORGE_AUTH_OUTPUT"),
+		Ledger:   os.Getenv("FORGE_AUTH_LEDGER"),
+		Profiles: os.Getenv("FORGE_AUTH_PROFILES"),
+		Profile:  os.Getenv("FORGE_AUTH_PROFILE"),
+		Webhook:  os.Getenv("FORGE_AUTH_WEBHOOK"),
+		Store:    os.Getenv("FORGE_AUTH_STORE"),
+		Roles:    os.Getenv("FORGE_AUTH_ROLES"),
+	}
+}
+
+// overlay copies the non-empty settings of src over dst
+func overlay(dst *cliConfig, src cliConfig) {
+	for _, f := range []struct{ dst, src *string }{
+		{&dst.Node, &src.Node},
+		{&dst.Scope, &src.Scope},
+		{&dst.Tenant, &src.Tenant},
+		{&dst.Audience, &src.Audience},
+		{&dst.TTL, &src.TTL},
+		{&dst.Token, &src.Token},
+		{&dst.Output, &src.Output},
+		{&dst.Ledger, &src.Ledger},
+		{&dst.Profiles, &src.Profiles},
+		{&dst.Profile, &src.Profile},
+		{&dst.Webhook, &src.Webhook},
+		{&dst.Store, &src.Store},
+		{&dst.Roles, &src.Roles},
+	} {
+		if *f.src != "" {
+			*f.dst = *f.src
+		}
+	}
+}
+
+// ttl parses the configured TTL; zero defers to the dominion's TTL policy
+func (c *cliContext) ttl() (time.Duration, error) {
+	if c.cfg.TTL == "" {
+		return 0, nil
+	}
+	ttl, err := time.ParseDuration(c.cfg.TTL)
+	if err != nil {
+		return 0, usageError("invalid ttl %q: %v", c.cfg.TTL, err)
+	}
+	return ttl, nil
+}
+
+// dominion returns a dominion using the environment's root keys and the
+// configured roles, ledger or store, profiles and webhook, if any
+func (c *cliContext) dominion() (*forgeauth.ForgeDominion, func(), error) {
+	fd, err := forgeauth.NewForgeDominion()
+	if err != nil {
+		return nil, nil, err
+	}
+	if c.cfg.Roles != "" {
+		roles, err := forgeauth.LoadRoles(c.cfg.Roles)
+		if err == nil {
+			err = fd.SetRoles(roles)
+		}
+		if err != nil {
+			fd.Close()
+			return nil, nil, &cliError{code: exitUsage, err: err}
+		}
+	}
+	if c.cfg.Profiles != "" {
+		profiles, err := forgeauth.LoadProfiles(c.cfg.Profiles)
+		if err == nil {
+			err = fd.SetProfiles(profiles)
+		}
+		if err != nil {
+			fd.Close()
+			return nil, nil, &cliError{code: exitUsage, err: err}
+		}
+	}
+	if c.cfg.Webhook != "" {
+		err := fd.AddWebhook(forgeauth.WebhookConfig{
+			URL:    c.cfg.Webhook,
+			Secret: []byte(os.Getenv("FORGE_AUTH_WEBHOOK_SECRET")),
+		})
+		if err != nil {
+			fd.Close()
+			return nil, nil, &cliError{code: exitUsage, err: err}
+		}
+	}
+	if c.cfg.Store != "" {
+		if c.cfg.Ledger != "" {
+			fd.Close()
+			return nil, nil, usageError("--ledger and --store are mutually exclusive")
+		}
+		s, err := forgeauth.OpenSQLiteStore(c.cfg.Store)
+		if err == nil {
+			if err = fd.SetStore(s); err != nil {
+				s.Close()
+			}
+		}
+		if err != nil {
+			fd.Close()
+			return nil, nil, err
+		}
+		return fd, func() {
+			fd.Close()
+			s.Close()
+		}, nil
+	}
+	if c.cfg.Ledger == "" {
+		return fd, func() { fd.Close() }, nil
+	}
+	l, err := forgeauth.OpenLedger(c.cfg.Ledger)
+	if err != nil {
+		fd.Close()
+		return nil, nil, err
+	}
+	fd.SetLedger(l)
+	return fd, func() {
+		l.Close()
+		fd.Close()
+	}, nil
+}
+
+// printToken writes a token, plus its encoded form, in the output format
+func (c *cliContext) printToken(token *forgeauth.ForgeToken, status string) error {
+	encoded, err := forgeauth.EncodeToken(token)
+	if err != nil {
+		return err
+	}
+
+	if c.cfg.Output == "json" {
+		enc := json.NewEncoder(c.stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(struct {
+			Status  string                `json:"status"`
+			Token   *forgeauth.ForgeToken `json:"token"`
+			Encoded string                `json:"encoded"`
+		}{status, token, encoded})
+	}
+
+	rows := [][2]string{
+		{"STATUS", status},
+		{"ID", token.ID},
+		{"TENANT", token.TenantID},
+		{"NODE", token.NodeID},
+		{"SCOPE", token.Scope},
+		{"AUDIENCE", token.Audience},
+		{"PROFILE", token.Profile},
+		{"ROLES", strings.Join(token.Roles, ",")},
+		{"SESSION", token.SessionID},
+		{"ATTESTATION", token.Attestation},
+		{"KEY BINDING", token.KeyBinding},
+		{"CLAIMS", forgeauth.FormatClaims(token.Claims)},
+		{"NETWORKS", strings.Join(token.Networks, ",")},
+		{"ISSUED", token.IssuedAt.Format(time.RFC3339)},
+		{"EXPIRES", token.ExpiresAt.Format(time.RFC3339)},
+		{"ALG", forgeauth.TokenAlg(token)},
+		{"ENCODED", encoded},
+	}
+	w := tabwriter.NewWriter(c.stdout, 0, 4, 2, ' ', 0)
+	for _, r := range rows {
+		if r[1] != "" {
+			fmt.Fprintf(w, "%s\t%s\n", r[0], r[1])
+		}
+	}
+	return w.Flush()
+}
+
+// loadCLIToken reads the token named by --file or the configured token URI
+func (c *cliContext) loadCLIToken() (*forgeauth.ForgeToken, error) {
+	if c.cfg.Token == "" {
+		return nil, usageError("--file is required")
+	}
+	return forgeauth.LoadTokenFrom(c.cfg.Token)
+}
+
+func cmdIssue(c *cliContext) error {
+	fs := c.flagSet()
+	fs.StringVar(&c.flags.Node, "node", "", "node ID")
+	fs.StringVar(&c.flags.Scope, "scope", "", "token scope")
+	fs.StringVar(&c.flags.Tenant, "tenant", "", "tenant ID")
+	fs.StringVar(&c.flags.Audience, "audience", "", "token audience")
+	fs.StringVar(&c.flags.TTL, "ttl", "", "token lifetime, e.g. 1h")
+	fs.StringVar(&c.flags.Token, "out", "", "storage URI to save the token to")
+	fs.StringVar(&c.flags.Profile, "profile", "", "token profile to issue from")
+	wrap := fs.Duration("wrap", 0, "print the token wrapped for delivery, unwrappable once within this lifetime")
+	bindKey := fs.String("bind-key", "", "PEM public key file the token is bound to; requests then need a proof signed with its private key")
+	var roles []string
+	fs.Func("role", "role bound in --roles, repeatable", func(s string) error {
+		roles = append(roles, s)
+		return nil
+	})
+	claims := make(map[string]any)
+	fs.Func("claim", "custom claim name=value, repeatable", func(s string) error {
+		name, value, ok := strings.Cut(s, "=")
+		if !ok || name == "" {
+			return fmt.Errorf("expected name=value")
+		}
+		claims[name] = value
+		return nil
+	})
+	if err := c.parse(); err != nil {
+		return err
+	}
+	if c.cfg.Profile != "" {
+		if len(claims) > 0 || len(roles) > 0 {
+			return usageError("--claim and --role can't be combined with --profile")
+		}
+		return issueFromProfile(c)
+	}
+	if c.cfg.Node == "" {
+		return usageError("--node is required")
+	}
+	if *wrap != 0 && c.cfg.Token != "" {
+		return usageError("--wrap can't be combined with --out")
+	}
+	ttl, err := c.ttl()
+	if err != nil {
+		return err
+	}
+	if ttl == 0 {
+		ttl = cliDefaultTTL
+	}
+	binding := ""
+	if *bindKey != "" {
+		if binding, err = readKeyThumbprint(*bindKey); err != nil {
+			return err
+		}
+	}
+	spec := forgeauth.TokenSpec{TenantID: c.cfg.Tenant, NodeID: c.cfg.Node, Scope: c.cfg.Scope, Audience: c.cfg.Audience, TTL: ttl, Claims: claims, Roles: roles, KeyBinding: binding}
+
+	fd, done, err := c.dominion()
+	if err != nil {
+		return err
+	}
+	defer done()
+
+	if *wrap != 0 {
+		wrapped, err := fd.RequestWrappedToken(context.Background(), spec, *wrap)
+		if err != nil {
+			return err
+		}
+		enc := json.NewEncoder(c.stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(wrapped)
+	}
+
+	tokens, err := fd.RequestTokens([]forgeauth.TokenSpec{spec})
+	if err != nil {
+		return err
+	}
+	token := tokens[0]
+	if c.cfg.Token != "" {
+		if err := forgeauth.SaveTokenTo(token, c.cfg.Token); err != nil {
+			return err
+		}
+	}
+	return c.printToken(token, "issued")
+}
+
+// readKeyThumbprint returns the key binding for the PEM public key at path
+func readKeyThumbprint(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to read bind key: %w", err)
+	}
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "PUBLIC KEY" {
+		return "", usageError("%s is not a PEM public key", path)
+	}
+	pub, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return "", usageError("invalid bind key %s: %v", path, err)
+	}
+	return forgeauth.KeyThumbprint(pub)
+}
+
+// issueFromProfile issues a token whose parameters come from the profile;
+// only --node may override it
+func issueFromProfile(c *cliContext) error {
+	fd, done, err := c.dominion()
+	if err != nil {
+		return err
+	}
+	defer done()
+
+	token, err := fd.RequestProfileToken(context.Background(), c.cfg.Profile, c.cfg.Node)
+	if err != nil {
+		return err
+	}
+	if c.cfg.Token != "" {
+		if err := forgeauth.SaveTokenTo(token, c.cfg.Token); err != nil {
+			return err
+		}
+	}
+	return c.printToken(token, "issued")
+}
+
+func cmdValidate(c *cliContext) error {
+	fs := c.flagSet()
+	fs.StringVar(&c.flags.Token, "file", "", "storage URI of the token")
+	if err := c.parse(); err != nil {
+		return err
+	}
+	token, err := c.loadCLIToken()
+	if err != nil {
+		return err
+	}
+
+	fd, done, err := c.dominion()
+	if err != nil {
+		return err
+	}
+	defer done()
+
+	if err := fd.ValidateToken(token); err != nil {
+		if c.cfg.Output == "json" {
+			c.printToken(token, forgeauth.FailureReason(err))
+		}
+		return err
+	}
+	return c.printToken(token, "valid")
+}
+
+func cmdRenew(c *cliContext) error {
+	fs := c.flagSet()
+	fs.StringVar(&c.flags.Token, "file", "", "storage URI of the token")
+	fs.StringVar(&c.flags.TTL, "ttl", "", "lifetime of the new token, e.g. 1h")
+	out := fs.String("out", "", "storage URI for the renewed token (default: --file)")
+	refreshURI := fs.String("refresh", "", "storage URI of a refresh credential to renew with; the token may have expired")
+	if err := c.parse(); err != nil {
+		return err
+	}
+	token, err := c.loadCLIToken()
+	if err != nil {
+		return err
+	}
+	var refresh *forgeauth.ForgeToken
+	if *refreshURI != "" {
+		if refresh, err = forgeauth.LoadTokenFrom(*refreshURI); err != nil {
+			return err
+		}
+	}
+	ttl, err := c.ttl()
+	if err != nil {
+		return err
+	}
+	if ttl == 0 {
+		ttl = token.ExpiresAt.Sub(token.IssuedAt)
+	}
+
+	fd, done, err := c.dominion()
+	if err != nil {
+		return err
+	}
+	defer done()
+
+	var renewed *forgeauth.ForgeToken
+	if refresh != nil {
+		renewed, err = fd.RefreshToken(context.Background(), refresh, token, ttl)
+	} else {
+		renewed, err = fd.RenewToken(token, ttl)
+	}
+	if err != nil {
+		return err
+	}
+	dest := *out
+	if dest == "" {
+		dest = c.cfg.Token
+	}
+	if err := forgeauth.SaveTokenTo(renewed, dest); err != nil {
+		return err
+	}
+	return c.printToken(renewed, "renewed")
+}
+
+func cmdDelegate(c *cliContext) error {
+	fs := c.flagSet()
+	fs.StringVar(&c.flags.Token, "file", "", "storage URI of the token to delegate renewal of")
+	fs.StringVar(&c.flags.TTL, "ttl", "", "lifetime of the refresh credential, e.g. 720h")
+	out := fs.String("out", "", "storage URI to save the refresh credential to")
+	if err := c.parse(); err != nil {
+		return err
+	}
+	if *out == "" {
+		return usageError("--out is required")
+	}
+	token, err := c.loadCLIToken()
+	if err != nil {
+		return err
+	}
+	ttl, err := c.ttl()
+	if err != nil {
+		return err
+	}
+	if ttl == 0 {
+		return usageError("--ttl is required")
+	}
+
+	fd, done, err := c.dominion()
+	if err != nil {
+		return err
+	}
+	defer done()
+
+	refresh, err := fd.IssueRefreshCredential(context.Background(), token, ttl)
+	if err != nil {
+		return err
+	}
+	if err := forgeauth.SaveTokenTo(refresh, *out); err != nil {
+		return err
+	}
+	return c.printToken(refresh, "issued")
+}
+
+func cmdRevoke(c *cliContext) error {
+	fs := c.flagSet()
+	fs.StringVar(&c.flags.Token, "file", "", "storage URI of the token")
+	id := fs.String("id", "", "token ID to revoke instead of --file")
+	expires := fs.String("expires", "", "expiry of the token named by --id (RFC 3339)")
+	if err := c.parse(); err != nil {
+		return err
+	}
+	if c.cfg.Ledger == "" && c.cfg.Store == "" {
+		return usageError("--ledger or --store is required so the revocation persists")
+	}
+
+	fd, done, err := c.dominion()
+	if err != nil {
+		return err
+	}
+	defer done()
+
+	if *id != "" {
+		expiresAt, err := time.Parse(time.RFC3339, *expires)
+		if err != nil {
+			return usageError("--id requires --expires in RFC 3339 form")
+		}
+		if err := fd.RevokeID(*id, expiresAt); err != nil {
+			return err
+		}
+		fmt.Fprintf(c.stdout, "revoked %s\n", *id)
+		return nil
+	}
+
+	token, err := c.loadCLIToken()
+	if err != nil {
+		return err
+	}
+	// Only revoke tokens this dominion signed, so a forged file can't be
+	// used to revoke arbitrary IDs
+	if err := fd.VerifySignature(context.Background(), token); err != nil {
+		return err
+	}
+	if err := fd.Revoke(token); err != nil {
+		return err
+	}
+	return c.printToken(token, "revoked")
+}
+
+func cmdSessions(c *cliContext) error {
+	fs := c.flagSet()
+	fs.StringVar(&c.flags.Node, "node", "", "list only this node's sessions")
+	fs.StringVar(&c.flags.Tenant, "tenant", "", "tenant ID")
+	if err := c.parse(); err != nil {
+		return err
+	}
+	if c.cfg.Ledger == "" && c.cfg.Store == "" {
+		return usageError("--ledger or --store is required to list sessions")
+	}
+
+	fd, done, err := c.dominion()
+	if err != nil {
+		return err
+	}
+	defer done()
+
+	sessions, err := fd.Sessions(c.cfg.Tenant, c.cfg.Node)
+	if err != nil {
+		return err
+	}
+	if c.cfg.Output == "json" {
+		enc := json.NewEncoder(c.stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(struct {
+			Sessions []forgeauth.SessionInfo `json:"sessions"`
+		}{sessions})
+	}
+
+	w := tabwriter.NewWriter(c.stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "SESSION\tNODE\tSCOPE\tSTARTED\tRENEWED\tEXPIRES\tTOKENS")
+	for _, s := range sessions {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%d\n", s.ID, s.NodeID, s.Scope,
+			s.StartedAt.Format(time.RFC3339), s.RenewedAt.Format(time.RFC3339), s.ExpiresAt.Format(time.RFC3339), len(s.Tokens))
+	}
+	return w.Flush()
+}
+
+func cmdKill(c *cliContext) error {
+	fs := c.flagSet()
+	sid := fs.String("session", "", "ID of the session to end")
+	fs.StringVar(&c.flags.Tenant, "tenant", "", "tenant ID")
+	if err := c.parse(); err != nil {
+		return err
+	}
+	if *sid == "" {
+		return usageError("--session is required")
+	}
+	if c.cfg.Ledger == "" && c.cfg.Store == "" {
+		return usageError("--ledger or --store is required so the revocations persist")
+	}
+
+	fd, done, err := c.dominion()
+	if err != nil {
+		return err
+	}
+	defer done()
+
+	n, err := fd.KillSession(c.cfg.Tenant, *sid)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(c.stdout, "killed %s, revoked %d tokens\n", *sid, n)
+	return nil
+}
+
+func cmdEnroll(c *cliContext) error {
+	fs := c.flagSet()
+	fs.StringVar(&c.flags.Node, "node", "", "node ID")
+	fs.StringVar(&c.flags.Scope, "scope", "", "token scope")
+	fs.StringVar(&c.flags.Tenant, "tenant", "", "tenant ID")
+	fs.StringVar(&c.flags.TTL, "ttl", "", "lifetime of the enrolled token, e.g. 1h")
+	codeTTL := fs.Duration("code-ttl", forgeauth.DefaultEnrollmentTTL, "how long the code can be redeemed")
+	if err := c.parse(); err != nil {
+		return err
+	}
+	if c.cfg.Node == "" {
+		return usageError("--node is required")
+	}
+	if c.cfg.Store == "" {
+		return usageError("--store is required so the code can be redeemed later")
+	}
+	ttl, err := c.ttl()
+	if err != nil {
+		return err
+	}
+	if ttl == 0 {
+		ttl = cliDefaultTTL
+	}
+
+	fd, done, err := c.dominion()
+	if err != nil {
+		return err
+	}
+	defer done()
+
+	code, err := fd.NewEnrollmentCode(context.Background(), forgeauth.TokenSpec{TenantID: c.cfg.Tenant, NodeID: c.cfg.Node, Scope: c.cfg.Scope, TTL: ttl}, *codeTTL)
+	if err != nil {
+		return err
+	}
+	if c.cfg.Output == "json" {
+		enc := json.NewEncoder(c.stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(code)
+	}
+
+	w := tabwriter.NewWriter(c.stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(w, "CODE\t%s\n", code.Code)
+	fmt.Fprintf(w, "URI\t%s\n", code.URI)
+	fmt.Fprintf(w, "NODE\t%s\n", code.NodeID)
+	fmt.Fprintf(w, "EXPIRES\t%s\n", code.ExpiresAt.Format(time.RFC3339))
+	return w.Flush()
+}
+
+func cmdRedeem(c *cliContext) error {
+	fs := c.flagSet()
+	code := fs.String("code", "", "enrollment code or FORGE-ENROLL: URI")
+	fs.StringVar(&c.flags.Token, "out", "", "storage URI to save the token to")
+	if err := c.parse(); err != nil {
+		return err
+	}
+	if *code == "" {
+		return usageError("--code is required")
+	}
+	if c.cfg.Store == "" {
+		return usageError("--store is required to look up the code")
+	}
+
+	fd, done, err := c.dominion()
+	if err != nil {
+		return err
+	}
+	defer done()
+
+	token, err := fd.RedeemEnrollmentCode(context.Background(), *code)
+	if err != nil {
+		return err
+	}
+	if c.cfg.Token != "" {
+		if err := forgeauth.SaveTokenTo(token, c.cfg.Token); err != nil {
+			return err
+		}
+	}
+	return c.printToken(token, "enrolled")
+}
+
+func cmdUnwrap(c *cliContext) error {
+	fs := c.flagSet()
+	file := fs.String("file", "", "file holding the wrapped token, or - for stdin")
+	fs.StringVar(&c.flags.Token, "out", "", "storage URI to save the unwrapped token to")
+	if err := c.parse(); err != nil {
+		return err
+	}
+	if *file == "" {
+		return usageError("--file is required")
+	}
+	if c.cfg.Store == "" {
+		return usageError("--store is required so the wrapping token is spent only once")
+	}
+	var data []byte
+	var err error
+	if *file == "-" {
+		data, err = io.ReadAll(os.Stdin)
+	} else {
+		data, err = os.ReadFile(*file)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read wrapped token: %w", err)
+	}
+	var wrapped forgeauth.WrappedToken
+	if err := json.Unmarshal(data, &wrapped); err != nil {
+		return fmt.Errorf("%w: invalid wrapped token: %v", forgeauth.ErrMalformed, err)
+	}
+
+	fd, done, err := c.dominion()
+	if err != nil {
+		return err
+	}
+	defer done()
+
+	token, err := fd.UnwrapToken(context.Background(), &wrapped)
+	if err != nil {
+		return err
+	}
+	if c.cfg.Token != "" {
+		if err := forgeauth.SaveTokenTo(token, c.cfg.Token); err != nil {
+			return err
+		}
+	}
+	return c.printToken(token, "unwrapped")
+}
+
+func cmdMigrate(c *cliContext) error {
+	fs := c.flagSet()
+	from := fs.String("from", "", "storage URI of the existing token")
+	to := fs.String("to", "", "storage URI to write the migrated token to")
+	allowExpired := fs.Bool("allow-expired", false, "migrate expired or revoked tokens whose signature is valid")
+	if err := c.parse(); err != nil {
+		return err
+	}
+	if *from == "" || *to == "" {
+		return usageError("both --from and --to are required")
+	}
+
+	fd, done, err := c.dominion()
+	if err != nil {
+		return err
+	}
+	defer done()
+
+	token, err := fd.MigrateStoredToken(*from, *to, forgeauth.MigrateOptions{AllowExpired: *allowExpired})
+	if err != nil {
+		return err
+	}
+	return c.printToken(token, "migrated")
+}
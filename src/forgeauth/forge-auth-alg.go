@@ -0,0 +1,96 @@
+package forgeauth
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/sha512"
+	"fmt"
+	"hash"
+	"slices"
+
+	"golang.org/x/crypto/blake2b"
+)
+
+// Token signing algorithms. A token with an empty alg claim uses AlgHS256,
+// which is also how HS256 tokens are issued so validators older than the
+// alg claim keep accepting them.
+const (
+	AlgHS256     = "HS256"     // HMAC-SHA256
+	AlgHS512_256 = "HS512_256" // HMAC-SHA512/256
+	AlgBLAKE2b   = "BLAKE2B"   // keyed BLAKE2b-256
+	AlgEd25519   = "EdDSA"     // Ed25519 with a per-tenant key pair
+)
+
+// supportedAlgs lists every algorithm this build can verify
+var supportedAlgs = []string{AlgHS256, AlgHS512_256, AlgBLAKE2b, AlgEd25519}
+
+// SupportedAlgs returns every built-in algorithm this build can verify
+func SupportedAlgs() []string {
+	return slices.Clone(supportedAlgs)
+}
+
+// newMAC returns a keyed MAC for alg
+func newMAC(alg string, key []byte) (hash.Hash, error) {
+	switch alg {
+	case "", AlgHS256:
+		return hmac.New(sha256.New, key), nil
+	case AlgHS512_256:
+		return hmac.New(sha512.New512_256, key), nil
+	case AlgBLAKE2b:
+		return blake2b.New256(key)
+	}
+	return nil, fmt.Errorf("unsupported token alg %q", alg)
+}
+
+// TokenAlg returns a token's alg claim, with the empty claim as AlgHS256
+func TokenAlg(token *ForgeToken) string {
+	if token.Alg == "" {
+		return AlgHS256
+	}
+	return token.Alg
+}
+
+// SetSigningAlg selects the algorithm for newly issued tokens, built in or
+// added with RegisterSigner
+func (fd *ForgeDominion) SetSigningAlg(alg string) error {
+	if !fd.knownAlg(alg) {
+		return fmt.Errorf("unsupported token alg %q", alg)
+	}
+	if err := fd.checkFIPSAlg(alg); err != nil {
+		return err
+	}
+	fd.signingAlg = alg
+	return nil
+}
+
+// SetAllowedAlgs restricts which algorithms ValidateToken accepts. During a
+// migration allow both the old and new algorithm until every outstanding
+// old-algorithm token has expired, then drop the old one.
+func (fd *ForgeDominion) SetAllowedAlgs(algs ...string) error {
+	if len(algs) == 0 {
+		return fmt.Errorf("at least one algorithm must be allowed")
+	}
+	for _, alg := range algs {
+		if !fd.knownAlg(alg) {
+			return fmt.Errorf("unsupported token alg %q", alg)
+		}
+		if err := fd.checkFIPSAlg(alg); err != nil {
+			return err
+		}
+	}
+	fd.allowedAlgs = slices.Clone(algs)
+	return nil
+}
+
+// checkAlg enforces the validation-side allow list
+func (fd *ForgeDominion) checkAlg(token *ForgeToken) error {
+	alg := TokenAlg(token)
+	if fd.allowedAlgs == nil {
+		if fd.knownAlg(alg) {
+			return nil
+		}
+	} else if slices.Contains(fd.allowedAlgs, alg) {
+		return nil
+	}
+	return fmt.Errorf("%w: alg %q is not allowed", ErrBadSignature, alg)
+}
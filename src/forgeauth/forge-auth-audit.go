@@ -0,0 +1,96 @@
+package forgeauth
+
+import (
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+)
+
+// Audit event names
+const (
+	AuditIssue      = "issue"
+	AuditIssueBatch = "issue_batch"
+	AuditRenew      = "renew"
+	AuditExchange   = "exchange"
+
+	AuditRevoke        = "revoke"
+	AuditRetireKey     = "retire_key"
+	AuditBundleApplied = "revocation_bundle_applied"
+	AuditPolicyDenied  = "policy_denied"
+	AuditSessionKilled = "session_killed"
+	AuditLockout       = "lockout"
+
+	AuditEnrollmentCreated = "enrollment_created"
+
+	AuditTrustUpdated = "trust_updated"
+	AuditTrustRemoved = "trust_removed"
+
+	// AuditValidationFailures is recorded when validation failures reach
+	// the threshold set with SetFailureAlert
+	AuditValidationFailures = "validation_failure_threshold"
+)
+
+// AuditEntry records a single dominion operation
+type AuditEntry struct {
+	Time      time.Time `json:"time"`
+	Event     string    `json:"event"`
+	TenantID  string    `json:"tenant_id,omitempty"`
+	NodeID    string    `json:"node_id,omitempty"`
+	Scope     string    `json:"scope,omitempty"`
+	Audience  string    `json:"audience,omitempty"`
+	ExpiresAt time.Time `json:"expires_at,omitzero"`
+	Count     int       `json:"count,omitempty"`
+	Nodes     []string  `json:"nodes,omitempty"`
+	Detail    string    `json:"detail,omitempty"`
+}
+
+// AuditSink receives audit entries from a ForgeDominion
+type AuditSink interface {
+	Record(entry AuditEntry)
+}
+
+// AuditFunc adapts a plain function to AuditSink
+type AuditFunc func(entry AuditEntry)
+
+// Record calls f(entry)
+func (f AuditFunc) Record(entry AuditEntry) {
+	f(entry)
+}
+
+// JSONAuditSink writes one JSON object per line to an io.Writer
+type JSONAuditSink struct {
+	mu  sync.Mutex
+	enc *json.Encoder
+}
+
+// NewJSONAuditSink creates an audit sink writing JSON lines to w
+func NewJSONAuditSink(w io.Writer) *JSONAuditSink {
+	return &JSONAuditSink{enc: json.NewEncoder(w)}
+}
+
+// Record writes the entry; write errors are dropped so auditing never
+// blocks issuance
+func (s *JSONAuditSink) Record(entry AuditEntry) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_ = s.enc.Encode(entry)
+}
+
+// SetAuditSink directs the dominion's audit entries to sink. A nil sink
+// disables auditing.
+func (fd *ForgeDominion) SetAuditSink(sink AuditSink) {
+	fd.audit = sink
+}
+
+// record sends an entry to the configured audit sink, if any, and to any
+// webhooks
+func (fd *ForgeDominion) record(entry AuditEntry) {
+	if entry.Time.IsZero() {
+		entry.Time = fd.now()
+	}
+	if fd.audit != nil {
+		fd.audit.Record(entry)
+	}
+	fd.notifyWebhooks(entry)
+}
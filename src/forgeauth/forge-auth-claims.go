@@ -0,0 +1,62 @@
+package forgeauth
+
+import (
+	"encoding/json"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+)
+
+// maxClaimsSize bounds the JSON encoding of a token's custom claims, which
+// travel in every request
+const maxClaimsSize = 2048
+
+// normalizeClaims checks custom claims and returns them as every token
+// decoder will reproduce them: values must be JSON values and come back
+// in encoding/json form, so numbers are float64 and structs become maps.
+// Issuing the normalized form keeps the signature stable across
+// encodings.
+func normalizeClaims(claims map[string]any) (map[string]any, error) {
+	if len(claims) == 0 {
+		return nil, nil
+	}
+	for name := range claims {
+		if name == "" {
+			return nil, fmt.Errorf("custom claim name is empty")
+		}
+	}
+	data, err := json.Marshal(claims)
+	if err != nil {
+		return nil, fmt.Errorf("custom claims must be JSON values: %w", err)
+	}
+	if len(data) > maxClaimsSize {
+		return nil, fmt.Errorf("custom claims encode to %d bytes, more than %d", len(data), maxClaimsSize)
+	}
+	var normalized map[string]any
+	if err := json.Unmarshal(data, &normalized); err != nil {
+		return nil, fmt.Errorf("custom claims must be JSON values: %w", err)
+	}
+	return normalized, nil
+}
+
+// Claim returns the named custom claim
+func (t *ForgeToken) Claim(name string) (any, bool) {
+	v, ok := t.Claims[name]
+	return v, ok
+}
+
+// ClaimString returns the named custom claim if it is a string, or ""
+func (t *ForgeToken) ClaimString(name string) string {
+	s, _ := t.Claims[name].(string)
+	return s
+}
+
+// FormatClaims renders custom claims as sorted name=value pairs
+func FormatClaims(claims map[string]any) string {
+	pairs := make([]string, 0, len(claims))
+	for _, name := range slices.Sorted(maps.Keys(claims)) {
+		pairs = append(pairs, fmt.Sprintf("%s=%v", name, claims[name]))
+	}
+	return strings.Join(pairs, ",")
+}
@@ -0,0 +1,489 @@
+package forgeauth
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"math"
+	"time"
+)
+
+// Compact token encoding for constrained transports (e.g. LoRa sensors).
+// A token is a CBOR map with small integer keys written in ascending order,
+// so the encoding of a given token is always byte-for-byte identical. The
+// signature is carried as raw bytes rather than base64. A typical token
+// encodes to well under 200 bytes.
+const (
+	compactKeyNodeID    = 1
+	compactKeyScope     = 2
+	compactKeyIssuedAt  = 3
+	compactKeyExpiresAt = 4
+	compactKeySignature = 5
+	compactKeySigning   = 6
+	compactKeyTenantID  = 7
+	compactKeyAudience  = 8
+	compactKeyID        = 9
+	compactKeyAlg       = 10
+	compactKeyVersion   = 11
+	compactKeyNetworks  = 12
+	compactKeyMaxUses   = 13
+	compactKeyIdle      = 14
+	compactKeyProfile   = 15
+	compactKeyClaims    = 16 // canonical JSON, as text
+	compactKeyRoles     = 17
+	compactKeySessionID = 18 // raw bytes, like the ID
+	compactKeyAttest    = 19
+	compactKeyCnf       = 20 // raw bytes, like the ID
+)
+
+// CBOR major types used by the compact encoding
+const (
+	cborUint  = 0
+	cborBytes = 2
+	cborText  = 3
+	cborArray = 4
+	cborMap   = 5
+)
+
+// MarshalCompact encodes a token in the compact binary format
+func MarshalCompact(token *ForgeToken) ([]byte, error) {
+	sig, err := base64.URLEncoding.DecodeString(token.Signature)
+	if err != nil {
+		return nil, fmt.Errorf("invalid token signature encoding: %w", err)
+	}
+	if token.IssuedAt.Unix() < 0 || token.ExpiresAt.Unix() < 0 {
+		return nil, fmt.Errorf("token timestamps before 1970 cannot be encoded")
+	}
+	if token.SigningVersion < 0 || token.Version < 0 {
+		return nil, fmt.Errorf("invalid token version")
+	}
+
+	fields := uint64(6)
+	if token.TenantID != "" {
+		fields++
+	}
+	if token.Audience != "" {
+		fields++
+	}
+	if token.ID != "" {
+		fields++
+	}
+	if token.Alg != "" {
+		fields++
+	}
+	if token.Version != 0 {
+		fields++
+	}
+	if len(token.Networks) > 0 {
+		fields++
+	}
+	if token.MaxUses < 0 {
+		return nil, fmt.Errorf("invalid token max uses")
+	}
+	if token.MaxUses > 0 {
+		fields++
+	}
+	if validateIdleTimeout(token.IdleTimeout) != nil {
+		return nil, fmt.Errorf("invalid token idle timeout")
+	}
+	if token.IdleTimeout > 0 {
+		fields++
+	}
+	if token.Profile != "" {
+		fields++
+	}
+	var claims []byte
+	if len(token.Roles) > 0 {
+		fields++
+	}
+	var sid []byte
+	if token.SessionID != "" {
+		var err error
+		if sid, err = base64.RawURLEncoding.DecodeString(token.SessionID); err != nil {
+			return nil, fmt.Errorf("invalid session ID encoding: %w", err)
+		}
+		fields++
+	}
+	if token.Attestation != "" {
+		fields++
+	}
+	var cnf []byte
+	if token.KeyBinding != "" {
+		var err error
+		if cnf, err = base64.RawURLEncoding.DecodeString(token.KeyBinding); err != nil {
+			return nil, fmt.Errorf("invalid key binding encoding: %w", err)
+		}
+		fields++
+	}
+	if len(token.Claims) > 0 {
+		var err error
+		if claims, err = json.Marshal(token.Claims); err != nil {
+			return nil, fmt.Errorf("invalid token claims: %w", err)
+		}
+		fields++
+	}
+
+	buf := make([]byte, 0, 128)
+	buf = appendCBORHead(buf, cborMap, fields)
+	buf = appendCBORHead(buf, cborUint, compactKeyNodeID)
+	buf = appendCBORString(buf, cborText, []byte(token.NodeID))
+	buf = appendCBORHead(buf, cborUint, compactKeyScope)
+	buf = appendCBORString(buf, cborText, []byte(token.Scope))
+	buf = appendCBORHead(buf, cborUint, compactKeyIssuedAt)
+	buf = appendCBORHead(buf, cborUint, uint64(token.IssuedAt.Unix()))
+	buf = appendCBORHead(buf, cborUint, compactKeyExpiresAt)
+	buf = appendCBORHead(buf, cborUint, uint64(token.ExpiresAt.Unix()))
+	buf = appendCBORHead(buf, cborUint, compactKeySignature)
+	buf = appendCBORString(buf, cborBytes, sig)
+	buf = appendCBORHead(buf, cborUint, compactKeySigning)
+	buf = appendCBORHead(buf, cborUint, uint64(token.SigningVersion))
+	if token.TenantID != "" {
+		buf = appendCBORHead(buf, cborUint, compactKeyTenantID)
+		buf = appendCBORString(buf, cborText, []byte(token.TenantID))
+	}
+	if token.Audience != "" {
+		buf = appendCBORHead(buf, cborUint, compactKeyAudience)
+		buf = appendCBORString(buf, cborText, []byte(token.Audience))
+	}
+	if token.ID != "" {
+		id, err := base64.RawURLEncoding.DecodeString(token.ID)
+		if err != nil {
+			return nil, fmt.Errorf("invalid token ID encoding: %w", err)
+		}
+		buf = appendCBORHead(buf, cborUint, compactKeyID)
+		buf = appendCBORString(buf, cborBytes, id)
+	}
+	if token.Alg != "" {
+		buf = appendCBORHead(buf, cborUint, compactKeyAlg)
+		buf = appendCBORString(buf, cborText, []byte(token.Alg))
+	}
+	if token.Version != 0 {
+		buf = appendCBORHead(buf, cborUint, compactKeyVersion)
+		buf = appendCBORHead(buf, cborUint, uint64(token.Version))
+	}
+	if len(token.Networks) > 0 {
+		buf = appendCBORHead(buf, cborUint, compactKeyNetworks)
+		buf = appendCBORHead(buf, cborArray, uint64(len(token.Networks)))
+		for _, n := range token.Networks {
+			buf = appendCBORString(buf, cborText, []byte(n))
+		}
+	}
+	if token.MaxUses > 0 {
+		buf = appendCBORHead(buf, cborUint, compactKeyMaxUses)
+		buf = appendCBORHead(buf, cborUint, uint64(token.MaxUses))
+	}
+	if token.IdleTimeout > 0 {
+		buf = appendCBORHead(buf, cborUint, compactKeyIdle)
+		buf = appendCBORHead(buf, cborUint, uint64(token.IdleTimeout/time.Second))
+	}
+	if token.Profile != "" {
+		buf = appendCBORHead(buf, cborUint, compactKeyProfile)
+		buf = appendCBORString(buf, cborText, []byte(token.Profile))
+	}
+	if claims != nil {
+		buf = appendCBORHead(buf, cborUint, compactKeyClaims)
+		buf = appendCBORString(buf, cborText, claims)
+	}
+	if len(token.Roles) > 0 {
+		buf = appendCBORHead(buf, cborUint, compactKeyRoles)
+		buf = appendCBORHead(buf, cborArray, uint64(len(token.Roles)))
+		for _, r := range token.Roles {
+			buf = appendCBORString(buf, cborText, []byte(r))
+		}
+	}
+	if sid != nil {
+		buf = appendCBORHead(buf, cborUint, compactKeySessionID)
+		buf = appendCBORString(buf, cborBytes, sid)
+	}
+	if token.Attestation != "" {
+		buf = appendCBORHead(buf, cborUint, compactKeyAttest)
+		buf = appendCBORString(buf, cborText, []byte(token.Attestation))
+	}
+	if cnf != nil {
+		buf = appendCBORHead(buf, cborUint, compactKeyCnf)
+		buf = appendCBORString(buf, cborBytes, cnf)
+	}
+	return buf, nil
+}
+
+// UnmarshalCompact decodes a token produced by MarshalCompact. Unknown keys
+// are rejected rather than skipped, since they may be signed claims this
+// build doesn't understand.
+func UnmarshalCompact(data []byte) (*ForgeToken, error) {
+	d := cborDecoder{data: data}
+
+	major, count, err := d.head()
+	if err != nil {
+		return nil, err
+	}
+	if major != cborMap {
+		return nil, fmt.Errorf("compact token: expected map, got major type %d", major)
+	}
+
+	var token ForgeToken
+	lastKey := uint64(0)
+	for i := uint64(0); i < count; i++ {
+		key, err := d.uint()
+		if err != nil {
+			return nil, err
+		}
+		if key <= lastKey {
+			return nil, fmt.Errorf("compact token: key %d out of order", key)
+		}
+		lastKey = key
+
+		switch key {
+		case compactKeyNodeID:
+			v, err := d.str(cborText)
+			if err != nil {
+				return nil, err
+			}
+			token.NodeID = string(v)
+		case compactKeyScope:
+			v, err := d.str(cborText)
+			if err != nil {
+				return nil, err
+			}
+			token.Scope = string(v)
+		case compactKeyIssuedAt:
+			v, err := d.uint()
+			if err != nil {
+				return nil, err
+			}
+			token.IssuedAt = time.Unix(int64(v), 0)
+		case compactKeyExpiresAt:
+			v, err := d.uint()
+			if err != nil {
+				return nil, err
+			}
+			token.ExpiresAt = time.Unix(int64(v), 0)
+		case compactKeySignature:
+			v, err := d.str(cborBytes)
+			if err != nil {
+				return nil, err
+			}
+			token.Signature = base64.URLEncoding.EncodeToString(v)
+		case compactKeySigning:
+			v, err := d.uint()
+			if err != nil {
+				return nil, err
+			}
+			token.SigningVersion = int(v)
+		case compactKeyTenantID:
+			v, err := d.str(cborText)
+			if err != nil {
+				return nil, err
+			}
+			token.TenantID = string(v)
+		case compactKeyAudience:
+			v, err := d.str(cborText)
+			if err != nil {
+				return nil, err
+			}
+			token.Audience = string(v)
+		case compactKeyID:
+			v, err := d.str(cborBytes)
+			if err != nil {
+				return nil, err
+			}
+			token.ID = base64.RawURLEncoding.EncodeToString(v)
+		case compactKeyAlg:
+			v, err := d.str(cborText)
+			if err != nil {
+				return nil, err
+			}
+			token.Alg = string(v)
+		case compactKeyVersion:
+			v, err := d.uint()
+			if err != nil {
+				return nil, err
+			}
+			if v > currentTokenSchema {
+				return nil, fmt.Errorf("compact token: schema version %d is not supported by this build", v)
+			}
+			token.Version = int(v)
+		case compactKeyNetworks:
+			major, n, err := d.head()
+			if err != nil {
+				return nil, err
+			}
+			// Each element takes at least one byte
+			if major != cborArray || n == 0 || n > uint64(len(d.data)-d.pos) {
+				return nil, fmt.Errorf("compact token: invalid network list")
+			}
+			token.Networks = make([]string, 0, n)
+			for range n {
+				v, err := d.str(cborText)
+				if err != nil {
+					return nil, err
+				}
+				token.Networks = append(token.Networks, string(v))
+			}
+		case compactKeyMaxUses:
+			v, err := d.uint()
+			if err != nil {
+				return nil, err
+			}
+			if v == 0 || v > math.MaxInt32 {
+				return nil, fmt.Errorf("compact token: invalid max uses")
+			}
+			token.MaxUses = int(v)
+		case compactKeyIdle:
+			v, err := d.uint()
+			if err != nil {
+				return nil, err
+			}
+			if v == 0 || v > uint64(math.MaxInt64/time.Second) {
+				return nil, fmt.Errorf("compact token: invalid idle timeout")
+			}
+			token.IdleTimeout = time.Duration(v) * time.Second
+		case compactKeyProfile:
+			v, err := d.str(cborText)
+			if err != nil {
+				return nil, err
+			}
+			token.Profile = string(v)
+		case compactKeyClaims:
+			v, err := d.str(cborText)
+			if err != nil {
+				return nil, err
+			}
+			if err := json.Unmarshal(v, &token.Claims); err != nil || len(token.Claims) == 0 {
+				return nil, fmt.Errorf("compact token: invalid custom claims")
+			}
+		case compactKeyRoles:
+			major, n, err := d.head()
+			if err != nil {
+				return nil, err
+			}
+			if major != cborArray || n == 0 || n > uint64(len(d.data)-d.pos) {
+				return nil, fmt.Errorf("compact token: invalid role list")
+			}
+			token.Roles = make([]string, 0, n)
+			for range n {
+				v, err := d.str(cborText)
+				if err != nil {
+					return nil, err
+				}
+				token.Roles = append(token.Roles, string(v))
+			}
+		case compactKeySessionID:
+			v, err := d.str(cborBytes)
+			if err != nil {
+				return nil, err
+			}
+			token.SessionID = base64.RawURLEncoding.EncodeToString(v)
+		case compactKeyAttest:
+			v, err := d.str(cborText)
+			if err != nil {
+				return nil, err
+			}
+			token.Attestation = string(v)
+		case compactKeyCnf:
+			v, err := d.str(cborBytes)
+			if err != nil {
+				return nil, err
+			}
+			token.KeyBinding = base64.RawURLEncoding.EncodeToString(v)
+		default:
+			return nil, fmt.Errorf("compact token: unknown key %d", key)
+		}
+	}
+
+	if len(d.data) != d.pos {
+		return nil, fmt.Errorf("compact token: %d trailing bytes", len(d.data)-d.pos)
+	}
+	return &token, nil
+}
+
+// appendCBORHead appends a CBOR initial byte and argument in shortest form
+func appendCBORHead(buf []byte, major byte, arg uint64) []byte {
+	m := major << 5
+	switch {
+	case arg < 24:
+		return append(buf, m|byte(arg))
+	case arg <= 0xff:
+		return append(buf, m|24, byte(arg))
+	case arg <= 0xffff:
+		return binary.BigEndian.AppendUint16(append(buf, m|25), uint16(arg))
+	case arg <= 0xffffffff:
+		return binary.BigEndian.AppendUint32(append(buf, m|26), uint32(arg))
+	}
+	return binary.BigEndian.AppendUint64(append(buf, m|27), arg)
+}
+
+func appendCBORString(buf []byte, major byte, s []byte) []byte {
+	return append(appendCBORHead(buf, major, uint64(len(s))), s...)
+}
+
+// cborDecoder reads the subset of CBOR written by MarshalCompact
+type cborDecoder struct {
+	data []byte
+	pos  int
+}
+
+func (d *cborDecoder) head() (byte, uint64, error) {
+	if d.pos >= len(d.data) {
+		return 0, 0, fmt.Errorf("compact token: unexpected end of data")
+	}
+	b := d.data[d.pos]
+	d.pos++
+	major, info := b>>5, b&0x1f
+
+	size := 0
+	switch {
+	case info < 24:
+		return major, uint64(info), nil
+	case info == 24:
+		size = 1
+	case info == 25:
+		size = 2
+	case info == 26:
+		size = 4
+	case info == 27:
+		size = 8
+	default:
+		return 0, 0, fmt.Errorf("compact token: unsupported additional info %d", info)
+	}
+
+	if len(d.data)-d.pos < size {
+		return 0, 0, fmt.Errorf("compact token: unexpected end of data")
+	}
+	var arg uint64
+	for _, c := range d.data[d.pos : d.pos+size] {
+		arg = arg<<8 | uint64(c)
+	}
+	d.pos += size
+	return major, arg, nil
+}
+
+func (d *cborDecoder) uint() (uint64, error) {
+	major, arg, err := d.head()
+	if err != nil {
+		return 0, err
+	}
+	if major != cborUint {
+		return 0, fmt.Errorf("compact token: expected unsigned integer, got major type %d", major)
+	}
+	if arg > 1<<63-1 {
+		return 0, fmt.Errorf("compact token: integer overflows int64")
+	}
+	return arg, nil
+}
+
+func (d *cborDecoder) str(want byte) ([]byte, error) {
+	major, n, err := d.head()
+	if err != nil {
+		return nil, err
+	}
+	if major != want {
+		return nil, fmt.Errorf("compact token: expected major type %d, got %d", want, major)
+	}
+	if uint64(len(d.data)-d.pos) < n {
+		return nil, fmt.Errorf("compact token: string length %d exceeds data", n)
+	}
+	s := d.data[d.pos : d.pos+int(n)]
+	d.pos += int(n)
+	return s, nil
+}
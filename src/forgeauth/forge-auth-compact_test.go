@@ -0,0 +1,216 @@
+package forgeauth
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"encoding/base64"
+	"errors"
+	"testing"
+	"time"
+)
+
+// compactTestTokens issues, with both HS256 and Ed25519, a bare token and
+// one carrying every optional claim
+func compactTestTokens(t testing.TB) (map[string]*ForgeToken, map[string]*ForgeDominion) {
+	t.Helper()
+	binding, err := KeyThumbprint(ed25519.NewKeyFromSeed(make([]byte, ed25519.SeedSize)).Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+	tokens := make(map[string]*ForgeToken)
+	dominions := make(map[string]*ForgeDominion)
+	for _, alg := range []string{AlgHS256, AlgEd25519} {
+		fd := NewForgeDominionWithKeys(StaticKeyProvider{
+			"":     bytes.Clone(testRootKey),
+			"acme": bytes.Repeat([]byte{0x43}, minRootKeyLen),
+		})
+		fd.SetClock(NewFakeClock(testEpoch))
+		if err := fd.SetSigningAlg(alg); err != nil {
+			t.Fatal(err)
+		}
+		if err := fd.SetRoles(map[string][]string{"reader": {"runtime:read"}}); err != nil {
+			t.Fatal(err)
+		}
+		for name, spec := range map[string]TokenSpec{
+			"bare": {NodeID: "node-1", Scope: "runtime:read", TTL: time.Hour},
+			"full": {
+				TenantID:    "acme",
+				NodeID:      "node-ü",
+				Scope:       "runtime:read,runtime:execute",
+				Audience:    "bridge",
+				Networks:    []string{"10.0.0.0/8", "2001:db8::/32"},
+				MaxUses:     300,
+				TTL:         12 * time.Hour,
+				IdleTimeout: 90 * time.Minute,
+				Profile:     "worker",
+				Claims:      map[string]any{"rack": "r1", "slots": []any{1.0, 2.5}, "nested": map[string]any{"z": true, "a": nil}},
+				Roles:       []string{"reader"},
+				KeyBinding:  binding,
+				attestation: "tpm2:sha256:0,7:00ff",
+			},
+		} {
+			token, err := fd.requestToken(context.Background(), spec, "")
+			if err != nil {
+				t.Fatalf("%s %s: %v", alg, name, err)
+			}
+			tokens[alg+" "+name] = token
+			dominions[alg+" "+name] = fd
+		}
+	}
+	return tokens, dominions
+}
+
+func TestCompactRoundTrip(t *testing.T) {
+	tokens, dominions := compactTestTokens(t)
+	for name, token := range tokens {
+		t.Run(name, func(t *testing.T) {
+			want, err := signingPayload(token)
+			if err != nil {
+				t.Fatal(err)
+			}
+			data, err := MarshalCompact(token)
+			if err != nil {
+				t.Fatal(err)
+			}
+			decoded, err := UnmarshalCompact(data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := signingPayload(decoded)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, want) {
+				t.Errorf("round trip changed the v2 payload:\n%s\nwant\n%s", got, want)
+			}
+			sig, err := decodeSignature(decoded.Signature)
+			if err != nil {
+				t.Fatal(err)
+			}
+			fd := dominions[name]
+			if err := fd.verifyWith(context.Background(), fd.currentKeys(), decoded, sig); err != nil {
+				t.Errorf("decoded token doesn't verify: %v", err)
+			}
+			again, err := MarshalCompact(decoded)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(again, data) {
+				t.Errorf("re-encoding isn't byte-for-byte identical:\n%x\nwant\n%x", again, data)
+			}
+		})
+	}
+	if n := len(mustMarshalCompact(t, tokens[AlgEd25519+" bare"])); n >= 200 {
+		t.Errorf("bare Ed25519 token encodes to %d bytes, want under 200", n)
+	}
+}
+
+func mustMarshalCompact(t testing.TB, token *ForgeToken) []byte {
+	t.Helper()
+	data, err := MarshalCompact(token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestCompactDetectsTampering(t *testing.T) {
+	tokens, dominions := compactTestTokens(t)
+	token := tokens[AlgHS256+" full"]
+	data := mustMarshalCompact(t, token)
+	// "node-ü" is encoded once, as a text string
+	i := bytes.Index(data, []byte("node-\xc3\xbc"))
+	if i < 0 {
+		t.Fatal("node ID not found to edit")
+	}
+	edited := bytes.Clone(data)
+	edited[i+len("node-")+1] = 0xb6 // node-ö
+	decoded, err := UnmarshalCompact(edited)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := dominions[AlgHS256+" full"].ValidateToken(decoded); !errors.Is(err, ErrBadSignature) {
+		t.Errorf("edited node ID: got %v, want %v", err, ErrBadSignature)
+	}
+}
+
+func TestUnmarshalCompactRejects(t *testing.T) {
+	tokens, _ := compactTestTokens(t)
+	good := mustMarshalCompact(t, tokens[AlgHS256+" bare"])
+	sig, _ := base64.URLEncoding.DecodeString(tokens[AlgHS256+" bare"].Signature)
+
+	// head appends a map of n entries, then kv's raw key-value bytes
+	head := func(n uint64, kv ...[]byte) []byte {
+		return append(appendCBORHead(nil, cborMap, n), bytes.Join(kv, nil)...)
+	}
+	text := func(key uint64, s string) []byte {
+		return appendCBORString(appendCBORHead(nil, cborUint, key), cborText, []byte(s))
+	}
+	num := func(key, v uint64) []byte {
+		return appendCBORHead(appendCBORHead(nil, cborUint, key), cborUint, v)
+	}
+	signature := appendCBORString(appendCBORHead(nil, cborUint, compactKeySignature), cborBytes, sig)
+
+	tests := map[string][]byte{
+		"empty":                 nil,
+		"not a map":             appendCBORHead(nil, cborArray, 0),
+		"truncated":             good[:len(good)-1],
+		"trailing bytes":        append(bytes.Clone(good), 0),
+		"more entries claimed":  append([]byte{good[0] + 1}, good[1:]...),
+		"keys out of order":     head(2, text(compactKeyScope, "s"), text(compactKeyNodeID, "n")),
+		"duplicate key":         head(2, text(compactKeyNodeID, "n"), text(compactKeyNodeID, "m")),
+		"unknown key":           head(2, text(compactKeyNodeID, "n"), text(99, "x")),
+		"wrong type":            head(1, num(compactKeyNodeID, 1)),
+		"future schema":         head(2, text(compactKeyNodeID, "n"), num(compactKeyVersion, currentTokenSchema+1)),
+		"zero max uses":         head(2, text(compactKeyNodeID, "n"), num(compactKeyMaxUses, 0)),
+		"huge max uses":         head(2, text(compactKeyNodeID, "n"), num(compactKeyMaxUses, 1<<40)),
+		"zero idle timeout":     head(2, text(compactKeyNodeID, "n"), num(compactKeyIdle, 0)),
+		"integer overflow":      head(1, num(compactKeyIssuedAt, 1<<63)),
+		"empty claims":          head(2, signature, text(compactKeyClaims, "{}")),
+		"claims not json":       head(2, signature, text(compactKeyClaims, "{")),
+		"empty network list":    head(1, appendCBORHead(appendCBORHead(nil, cborUint, compactKeyNetworks), cborArray, 0)),
+		"network list too long": head(1, appendCBORHead(appendCBORHead(nil, cborUint, compactKeyNetworks), cborArray, 1000)),
+		"indefinite length":     {cborMap<<5 | 31},
+		"string past the end":   head(1, appendCBORHead(appendCBORHead(nil, cborUint, compactKeyNodeID), cborText, 1<<32)),
+	}
+	for name, data := range tests {
+		if token, err := UnmarshalCompact(data); err == nil {
+			t.Errorf("%s: decoded %+v", name, token)
+		}
+	}
+}
+
+func FuzzUnmarshalCompact(f *testing.F) {
+	tokens, _ := compactTestTokens(f)
+	for _, token := range tokens {
+		f.Add(mustMarshalCompact(f, token))
+	}
+	f.Add([]byte{})
+	f.Add([]byte{0xa1, 0x01, 0x61})
+	f.Fuzz(func(t *testing.T, data []byte) {
+		token, err := UnmarshalCompact(data)
+		if err != nil {
+			return
+		}
+		again, err := MarshalCompact(token)
+		if err != nil {
+			return
+		}
+		decoded, err := UnmarshalCompact(again)
+		if err != nil {
+			t.Fatalf("re-encoded token no longer decodes: %v", err)
+		}
+		// The encoding is canonical, so it survives another trip unchanged
+		if third, err := MarshalCompact(decoded); err != nil || !bytes.Equal(third, again) {
+			t.Fatalf("re-encoding isn't stable: %x then %x (%v)", again, third, err)
+		}
+		want, err := signingPayload(token)
+		if err != nil {
+			return
+		}
+		if got, err := signingPayload(decoded); err != nil || !bytes.Equal(got, want) {
+			t.Errorf("re-encode changed the v2 payload:\n%s\nwant\n%s", got, want)
+		}
+	})
+}
@@ -0,0 +1,56 @@
+package forgeauth
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/hkdf"
+	"crypto/sha256"
+	"fmt"
+	"slices"
+)
+
+// ed25519KeyInfo is the HKDF info prefix for a tenant's Ed25519 seed
+const ed25519KeyInfo = "forge-dominion/ed25519-signing/v1:"
+
+// Ed25519 tokens are signed with one key pair per tenant, derived from the
+// tenant's root key. Unlike the MAC algorithms this lets read-only nodes
+// verify tokens from the public key alone (see Validator), at the cost of
+// a leaked signing key forging tokens for every node of the tenant.
+
+// signingKey derives tenantID's Ed25519 private key from keys
+func signingKey(ctx context.Context, keys KeyProvider, tenantID string) (ed25519.PrivateKey, error) {
+	rootKey, err := rootKey(ctx, keys, tenantID)
+	if err != nil {
+		return nil, err
+	}
+	seed, err := hkdf.Key(sha256.New, rootKey, nil, ed25519KeyInfo+tenantID, ed25519.SeedSize)
+	if err != nil {
+		return nil, fmt.Errorf("failed to derive signing key: %w", err)
+	}
+	defer clear(seed)
+	return ed25519.NewKeyFromSeed(seed), nil
+}
+
+// PublicKey returns the Ed25519 public key that verifies tenantID's tokens
+// signed with AlgEd25519
+func (fd *ForgeDominion) PublicKey(ctx context.Context, tenantID string) (ed25519.PublicKey, error) {
+	return publicKey(ctx, fd.currentKeys(), tenantID)
+}
+
+func publicKey(ctx context.Context, keys KeyProvider, tenantID string) (ed25519.PublicKey, error) {
+	priv, err := signingKey(ctx, keys, tenantID)
+	if err != nil {
+		return nil, err
+	}
+	defer clear(priv)
+	return slices.Clone(priv.Public().(ed25519.PublicKey)), nil
+}
+
+// verifyEd25519 checks an Ed25519 token signature against pub
+func verifyEd25519(pub ed25519.PublicKey, token *ForgeToken, sig []byte) error {
+	payload, err := signingPayload(token)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrBadSignature, err)
+	}
+	return Ed25519Verifier{Key: pub}.Verify(context.Background(), payload, sig)
+}
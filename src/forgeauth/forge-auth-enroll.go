@@ -0,0 +1,240 @@
+package forgeauth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Enrollment codes let an operator bootstrap a node without carrying root
+// key material to it: the dominion prints a short code, the operator types
+// or scans it on the node, and the node redeems it once for its first
+// token. Only a digest of each code is stored.
+
+// Enrollment code lifetimes
+const (
+	DefaultEnrollmentTTL = 15 * time.Minute
+	maxEnrollmentTTL     = 24 * time.Hour
+)
+
+// enrollmentAlphabet is Crockford's base32, which leaves out I, L, O and U
+// so codes survive being read aloud or retyped
+const enrollmentAlphabet = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+
+// enrollmentCodeLen is the number of code characters, 100 bits of entropy,
+// printed in groups of four
+const enrollmentCodeLen = 20
+
+// EnrollmentURIScheme prefixes codes in URI form. The URI uses only
+// characters of the QR code alphanumeric mode, so it encodes compactly.
+const EnrollmentURIScheme = "FORGE-ENROLL:"
+
+// errInvalidEnrollment covers unknown, used and expired codes alike, so a
+// failed redemption tells the caller nothing about which codes exist
+var errInvalidEnrollment = errors.New("invalid, used or expired enrollment code")
+
+// Enrollment is a pending enrollment: the token its code redeems for
+type Enrollment struct {
+	Digest    string // SHA-256 of the normalized code, hex
+	TenantID  string
+	NodeID    string
+	Scope     string
+	TTL       time.Duration
+	ExpiresAt time.Time // of the code, not the token
+}
+
+// EnrollmentStore keeps pending enrollments. The store shared with the
+// dominion's ledger (see SetStore) survives restarts, so codes printed by
+// one CLI invocation can be redeemed by the next.
+type EnrollmentStore interface {
+	PutEnrollment(ctx context.Context, e Enrollment) error
+
+	// TakeEnrollment removes and returns the enrollment with digest. It
+	// must be atomic so that a code redeems at most once.
+	TakeEnrollment(ctx context.Context, digest string) (Enrollment, bool, error)
+}
+
+// EnrollmentCode is a freshly generated code. Code is shown only once.
+type EnrollmentCode struct {
+	Code      string    `json:"code"`
+	URI       string    `json:"uri"`
+	TenantID  string    `json:"tenant_id,omitempty"`
+	NodeID    string    `json:"node_id"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// SetEnrollmentStore replaces the store of pending enrollments
+func (fd *ForgeDominion) SetEnrollmentStore(s EnrollmentStore) {
+	fd.enrollments = s
+}
+
+// NewEnrollmentCode creates a single-use code that redeems, until
+// codeTTL from now, for a token issued from spec. A zero codeTTL uses the
+// default of 15 minutes. The spec is checked now, so a bad spec fails
+// at the console rather than on the node.
+func (fd *ForgeDominion) NewEnrollmentCode(ctx context.Context, spec TokenSpec, codeTTL time.Duration) (*EnrollmentCode, error) {
+	if codeTTL == 0 {
+		codeTTL = DefaultEnrollmentTTL
+	}
+	if codeTTL < 0 || codeTTL > maxEnrollmentTTL {
+		return nil, fmt.Errorf("enrollment code lifetime must be between 0 and %s", maxEnrollmentTTL)
+	}
+	if spec.NodeID == "" {
+		return nil, fmt.Errorf("enrollment requires a node ID")
+	}
+	if err := validateTenantID(spec.TenantID); err != nil {
+		return nil, err
+	}
+	if err := ValidateScope(spec.Scope); err != nil {
+		return nil, err
+	}
+	ttl, err := fd.effectiveTTL(spec.Scope, spec.TTL, true)
+	if err != nil {
+		return nil, err
+	}
+
+	raw, err := newEnrollmentCode()
+	if err != nil {
+		return nil, err
+	}
+	now := fd.now()
+	e := Enrollment{
+		Digest:    enrollmentDigest(raw),
+		TenantID:  spec.TenantID,
+		NodeID:    spec.NodeID,
+		Scope:     spec.Scope,
+		TTL:       ttl,
+		ExpiresAt: now.Add(codeTTL),
+	}
+	if err := fd.enrollments.PutEnrollment(ctx, e); err != nil {
+		return nil, fmt.Errorf("failed to store enrollment: %w", err)
+	}
+
+	fd.record(AuditEntry{
+		Time:      now,
+		Event:     AuditEnrollmentCreated,
+		TenantID:  e.TenantID,
+		NodeID:    e.NodeID,
+		Scope:     e.Scope,
+		ExpiresAt: e.ExpiresAt,
+	})
+	code := formatEnrollmentCode(raw)
+	return &EnrollmentCode{Code: code, URI: EnrollmentURIScheme + code, TenantID: e.TenantID, NodeID: e.NodeID, ExpiresAt: e.ExpiresAt}, nil
+}
+
+// RedeemEnrollmentCode exchanges a code, or its URI form, for the node's
+// first token. The code is spent even if issuance then fails.
+func (fd *ForgeDominion) RedeemEnrollmentCode(ctx context.Context, code string) (*ForgeToken, error) {
+	normalized, ok := normalizeEnrollmentCode(code)
+	if !ok {
+		return nil, errInvalidEnrollment
+	}
+	e, ok, err := fd.enrollments.TakeEnrollment(ctx, enrollmentDigest(normalized))
+	if err != nil {
+		return nil, fmt.Errorf("failed to redeem enrollment: %w", err)
+	}
+	if !ok {
+		return nil, errInvalidEnrollment
+	}
+	if !fd.now().Before(e.ExpiresAt) {
+		// Only the node's own code names it, so this is the node's failure
+		fd.observeNodeLockout(ctx, e.TenantID, e.NodeID, "expired enrollments")
+		return nil, errInvalidEnrollment
+	}
+	return fd.requestToken(ctx, TokenSpec{TenantID: e.TenantID, NodeID: e.NodeID, Scope: e.Scope, TTL: e.TTL}, "enrollment")
+}
+
+// newEnrollmentCode returns a random code in normalized form
+func newEnrollmentCode() (string, error) {
+	b := make([]byte, enrollmentCodeLen)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("failed to generate enrollment code: %w", err)
+	}
+	for i := range b {
+		b[i] = enrollmentAlphabet[b[i]%32]
+	}
+	return string(b), nil
+}
+
+// formatEnrollmentCode groups a normalized code as XXXX-XXXX-...
+func formatEnrollmentCode(raw string) string {
+	var b strings.Builder
+	for i, r := range raw {
+		if i > 0 && i%4 == 0 {
+			b.WriteByte('-')
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// normalizeEnrollmentCode strips the URI prefix, separators and case, and
+// maps the characters Crockford's base32 treats as misreadings
+func normalizeEnrollmentCode(code string) (string, bool) {
+	code = strings.ToUpper(strings.TrimSpace(code))
+	code = strings.TrimPrefix(code, EnrollmentURIScheme)
+	var b strings.Builder
+	for _, r := range code {
+		switch r {
+		case '-', ' ':
+			continue
+		case 'O':
+			r = '0'
+		case 'I', 'L':
+			r = '1'
+		}
+		if !strings.ContainsRune(enrollmentAlphabet, r) {
+			return "", false
+		}
+		b.WriteRune(r)
+	}
+	if b.Len() != enrollmentCodeLen {
+		return "", false
+	}
+	return b.String(), true
+}
+
+func enrollmentDigest(normalized string) string {
+	sum := sha256.Sum256([]byte(normalized))
+	return hex.EncodeToString(sum[:])
+}
+
+// memoryEnrollmentStore keeps pending enrollments in memory
+type memoryEnrollmentStore struct {
+	now         func() time.Time
+	mu          sync.Mutex
+	enrollments map[string]Enrollment
+}
+
+func newMemoryEnrollmentStore(now func() time.Time) *memoryEnrollmentStore {
+	return &memoryEnrollmentStore{now: now, enrollments: make(map[string]Enrollment)}
+}
+
+// PutEnrollment implements EnrollmentStore
+func (s *memoryEnrollmentStore) PutEnrollment(ctx context.Context, e Enrollment) error {
+	now := s.now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for k, pending := range s.enrollments {
+		if !now.Before(pending.ExpiresAt) {
+			delete(s.enrollments, k)
+		}
+	}
+	s.enrollments[e.Digest] = e
+	return nil
+}
+
+// TakeEnrollment implements EnrollmentStore
+func (s *memoryEnrollmentStore) TakeEnrollment(ctx context.Context, digest string) (Enrollment, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e, ok := s.enrollments[digest]
+	delete(s.enrollments, digest)
+	return e, ok, nil
+}
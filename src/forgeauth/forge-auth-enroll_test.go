@@ -0,0 +1,114 @@
+package forgeauth
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func newTestEnrollment(t *testing.T, fd *ForgeDominion) *EnrollmentCode {
+	t.Helper()
+	code, err := fd.NewEnrollmentCode(context.Background(), TokenSpec{NodeID: "node-1", Scope: "runtime:read", TTL: time.Hour}, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return code
+}
+
+func TestEnrollmentRedeemsOnce(t *testing.T) {
+	fd, _ := newTestDominion(t, AlgHS256)
+	ctx := context.Background()
+	code := newTestEnrollment(t, fd)
+	token, err := fd.RedeemEnrollmentCode(ctx, code.Code)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token.NodeID != "node-1" || token.Scope != "runtime:read" {
+		t.Errorf("redeemed %s for %q, want node-1 for runtime:read", token.NodeID, token.Scope)
+	}
+	if err := fd.ValidateToken(token); err != nil {
+		t.Errorf("enrolled token: %v", err)
+	}
+	for _, again := range []string{code.Code, code.URI} {
+		if _, err := fd.RedeemEnrollmentCode(ctx, again); err == nil {
+			t.Errorf("%s redeemed a second time", again)
+		}
+	}
+}
+
+func TestEnrollmentConcurrentRedemption(t *testing.T) {
+	fd, _ := newTestDominion(t, AlgHS256)
+	code := newTestEnrollment(t, fd)
+	var redeemed atomic.Int32
+	var wg sync.WaitGroup
+	for range 16 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := fd.RedeemEnrollmentCode(context.Background(), code.Code); err == nil {
+				redeemed.Add(1)
+			}
+		}()
+	}
+	wg.Wait()
+	if n := redeemed.Load(); n != 1 {
+		t.Errorf("code redeemed %d times, want once", n)
+	}
+}
+
+func TestEnrollmentExpires(t *testing.T) {
+	fd, clock := newTestDominion(t, AlgHS256)
+	ctx := context.Background()
+	code := newTestEnrollment(t, fd)
+	clock.Set(code.ExpiresAt)
+	if _, err := fd.RedeemEnrollmentCode(ctx, code.Code); err == nil {
+		t.Fatal("code redeemed at its expiry")
+	}
+	// and an expired code is spent, so winding the clock back doesn't help
+	clock.Set(testEpoch)
+	if _, err := fd.RedeemEnrollmentCode(ctx, code.Code); err == nil {
+		t.Error("expired code redeemed later")
+	}
+}
+
+func TestEnrollmentCodeForms(t *testing.T) {
+	fd, _ := newTestDominion(t, AlgHS256)
+	for name, form := range map[string]func(string) string{
+		"uri":       func(c string) string { return EnrollmentURIScheme + c },
+		"lowercase": strings.ToLower,
+		"ungrouped": func(c string) string { return strings.ReplaceAll(c, "-", "") },
+		"misread": func(c string) string {
+			return strings.NewReplacer("0", "O", "1", "l").Replace(c)
+		},
+	} {
+		code := newTestEnrollment(t, fd)
+		if _, err := fd.RedeemEnrollmentCode(context.Background(), form(code.Code)); err != nil {
+			t.Errorf("%s form: %v", name, err)
+		}
+	}
+	for _, bad := range []string{"", "FORGE-ENROLL:", "0000-0000", "UUUU-UUUU-UUUU-UUUU-UUUU"} {
+		if _, ok := normalizeEnrollmentCode(bad); ok {
+			t.Errorf("%q normalized", bad)
+		}
+	}
+}
+
+func TestEnrollmentCodeTTLBounds(t *testing.T) {
+	fd, _ := newTestDominion(t, AlgHS256)
+	spec := TokenSpec{NodeID: "node-1", Scope: "runtime:read", TTL: time.Hour}
+	for _, ttl := range []time.Duration{-time.Second, maxEnrollmentTTL + time.Second} {
+		if _, err := fd.NewEnrollmentCode(context.Background(), spec, ttl); err == nil {
+			t.Errorf("code lifetime %v accepted", ttl)
+		}
+	}
+	code, err := fd.NewEnrollmentCode(context.Background(), spec, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := testEpoch.Add(DefaultEnrollmentTTL); !code.ExpiresAt.Equal(want) {
+		t.Errorf("default code expiry %v, want %v", code.ExpiresAt, want)
+	}
+}
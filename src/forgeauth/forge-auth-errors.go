@@ -0,0 +1,86 @@
+package forgeauth
+
+import (
+	"errors"
+	"net/http"
+	"time"
+)
+
+// Authentication failure classes. Errors returned by the dominion wrap one
+// of these, so callers can branch with errors.Is and map failures to
+// protocol status codes with HTTPStatus or GRPCCode.
+var (
+	ErrMalformed        = errors.New("malformed token")
+	ErrExpired          = errors.New("token expired")
+	ErrClockSkew        = errors.New("token issued in the future")
+	ErrBadSignature     = errors.New("invalid token signature")
+	ErrRevoked          = errors.New("token revoked")
+	ErrExhausted        = errors.New("token use limit reached")
+	ErrScopeDenied      = errors.New("scope denied")
+	ErrTenantMismatch   = errors.New("token belongs to another tenant")
+	ErrAudienceMismatch = errors.New("token addressed to another audience")
+	ErrNetworkMismatch  = errors.New("token presented from outside its networks")
+	ErrPolicyDenied     = errors.New("denied by policy")
+	ErrLockedOut        = errors.New("locked out after repeated failures")
+)
+
+// MaxClockSkew is how far in the future a token's issue time may be before
+// validation treats the issuer's or validator's clock as wrong
+const MaxClockSkew = time.Minute
+
+// HTTPStatus maps an authentication error to an HTTP status code:
+// 403 for authorization failures, 429 for lockouts, 401 for everything
+// else
+func HTTPStatus(err error) int {
+	switch {
+	case err == nil:
+		return http.StatusOK
+	case errors.Is(err, ErrLockedOut):
+		return http.StatusTooManyRequests
+	case errors.Is(err, ErrScopeDenied), errors.Is(err, ErrTenantMismatch),
+		errors.Is(err, ErrAudienceMismatch), errors.Is(err, ErrNetworkMismatch),
+		errors.Is(err, ErrPolicyDenied):
+		return http.StatusForbidden
+	}
+	return http.StatusUnauthorized
+}
+
+// errorClasses pairs each failure class with its metrics label
+var errorClasses = []struct {
+	err    error
+	reason string
+}{
+	{ErrMalformed, "malformed"},
+	{ErrExpired, "expired"},
+	{ErrClockSkew, "clock_skew"},
+	{ErrBadSignature, "bad_signature"},
+	{ErrRevoked, "revoked"},
+	{ErrExhausted, "exhausted"},
+	{ErrScopeDenied, "scope_denied"},
+	{ErrTenantMismatch, "tenant_mismatch"},
+	{ErrAudienceMismatch, "audience_mismatch"},
+	{ErrNetworkMismatch, "network_mismatch"},
+	{ErrPolicyDenied, "policy_denied"},
+	{ErrLockedOut, "locked_out"},
+}
+
+// authFailureMessage returns the failure class of err for response bodies,
+// without details such as token IDs or key retirement times
+func authFailureMessage(err error) string {
+	for _, c := range errorClasses {
+		if errors.Is(err, c.err) {
+			return c.err.Error()
+		}
+	}
+	return "invalid forge token"
+}
+
+// FailureReason returns the failure class of err as a short label
+func FailureReason(err error) string {
+	for _, c := range errorClasses {
+		if errors.Is(err, c.err) {
+			return c.reason
+		}
+	}
+	return "other"
+}
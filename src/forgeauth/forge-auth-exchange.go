@@ -0,0 +1,103 @@
+package forgeauth
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// maxExchangeTTL caps the lifetime of tokens obtained through exchange
+const maxExchangeTTL = 15 * time.Minute
+
+// ExchangeToken trades a valid subject token for a narrower token aimed at
+// a single downstream component, following RFC 8693 token exchange
+// semantics. The new token keeps the subject's node and tenant, carries
+// targetScope (which the subject's scope or roles must allow) and
+// targetAudience, and never outlives the subject token. Roles are not
+// carried over, so the new token holds targetScope alone.
+func (fd *ForgeDominion) ExchangeToken(subjectToken *ForgeToken, targetScope string, targetAudience string) (*ForgeToken, error) {
+	if subjectToken != nil && subjectToken.MaxUses > 0 {
+		return nil, fmt.Errorf("%w: usage-limited tokens cannot be exchanged", ErrPolicyDenied)
+	}
+	if err := fd.ValidateToken(subjectToken); err != nil {
+		return nil, fmt.Errorf("cannot exchange invalid token: %w", err)
+	}
+	if targetAudience == "" {
+		return nil, fmt.Errorf("target audience is required")
+	}
+	if effective := fd.EffectiveScope(subjectToken); targetScope == "" || !scopeAllows(effective, targetScope) {
+		return nil, fmt.Errorf("%w: %q is not within subject scope %q", ErrScopeDenied, targetScope, effective)
+	}
+
+	ttl, err := fd.effectiveTTL(targetScope, maxExchangeTTL, true)
+	if err != nil {
+		return nil, err
+	}
+
+	now := fd.now()
+	expiresAt := now.Add(ttl)
+	if subjectToken.ExpiresAt.Before(expiresAt) {
+		expiresAt = subjectToken.ExpiresAt
+	}
+
+	spec := TokenSpec{
+		TenantID:    subjectToken.TenantID,
+		NodeID:      subjectToken.NodeID,
+		Scope:       targetScope,
+		Audience:    targetAudience,
+		Networks:    subjectToken.Networks,
+		TTL:         expiresAt.Sub(now),
+		IdleTimeout: subjectToken.IdleTimeout,
+		Profile:     subjectToken.Profile,
+		Claims:      subjectToken.Claims,
+		SessionID:   sessionOf(subjectToken),
+		KeyBinding:  subjectToken.KeyBinding,
+		attestation: subjectToken.Attestation,
+	}
+	if err := fd.checkPolicy(PolicyRequest{
+		Operation: PolicyExchange,
+		TenantID:  spec.TenantID,
+		NodeID:    spec.NodeID,
+		Scope:     spec.Scope,
+		Audience:  spec.Audience,
+		TTL:       spec.TTL,
+		Time:      now,
+		Previous:  subjectToken,
+	}); err != nil {
+		return nil, err
+	}
+
+	token, err := fd.issue(context.Background(), spec, now, expiresAt)
+	if err != nil {
+		return nil, err
+	}
+	if err := fd.ledgerIssued(token); err != nil {
+		return nil, err
+	}
+
+	fd.record(AuditEntry{
+		Time:      now,
+		Event:     AuditExchange,
+		TenantID:  token.TenantID,
+		NodeID:    token.NodeID,
+		Scope:     token.Scope,
+		Audience:  token.Audience,
+		ExpiresAt: token.ExpiresAt,
+		Detail:    fmt.Sprintf("subject scope %q", subjectToken.Scope),
+	})
+
+	return token, nil
+}
+
+// ValidateTokenForAudience validates a token and requires it to be addressed
+// to audience. Tokens without an audience are accepted by any component, so
+// callers that only trust exchanged tokens should check Audience themselves.
+func (fd *ForgeDominion) ValidateTokenForAudience(token *ForgeToken, audience string) error {
+	if err := fd.ValidateToken(token); err != nil {
+		return err
+	}
+	if token.Audience != "" && token.Audience != audience {
+		return fmt.Errorf("%w: %q, not %q", ErrAudienceMismatch, token.Audience, audience)
+	}
+	return nil
+}
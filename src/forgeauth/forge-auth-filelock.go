@@ -0,0 +1,104 @@
+package forgeauth
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Token files may be shared by several processes, e.g. an agent renewing a
+// token and the services reading it. Writers take an exclusive advisory
+// lock and replace the file by rename; readers take a shared lock and retry
+// when they still see a partial file written by a tool that doesn't.
+const (
+	tokenReadAttempts = 5
+	tokenReadBackoff  = 20 * time.Millisecond
+)
+
+// lockPath is the lock file guarding path. Locking a sidecar rather than the
+// token file itself keeps the lock valid across rename-based replacement.
+func lockPath(path string) string {
+	return path + ".lock"
+}
+
+// withFileLock runs fn holding an advisory lock on path's lock file
+func withFileLock(path string, exclusive bool, fn func() error) error {
+	f, err := os.OpenFile(lockPath(path), os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to open lock file: %w", err)
+	}
+	defer f.Close()
+
+	if err := lockFile(f, exclusive); err != nil {
+		return fmt.Errorf("failed to lock %s: %w", path, err)
+	}
+	defer unlockFile(f)
+
+	return fn()
+}
+
+// writeFileAtomic replaces path with data so readers see either the old or
+// the new contents, never a partial write
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	dir := filepath.Dir(path)
+	tmp, err := os.CreateTemp(dir, "."+filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if err := tmp.Chmod(perm); err != nil {
+		tmp.Close()
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return err
+	}
+
+	// Persist the rename itself
+	if d, err := os.Open(dir); err == nil {
+		d.Sync()
+		d.Close()
+	}
+	return nil
+}
+
+// readTokenFile reads and decodes a token file under a shared lock,
+// retrying decode failures in case the file is mid-write
+func readTokenFile(path string, decode func(raw []byte) (*ForgeToken, error)) (*ForgeToken, error) {
+	var token *ForgeToken
+	var lastErr error
+	for attempt := range tokenReadAttempts {
+		if attempt > 0 {
+			time.Sleep(tokenReadBackoff << (attempt - 1))
+		}
+
+		err := withFileLock(path, false, func() error {
+			raw, err := os.ReadFile(path)
+			if err != nil {
+				return fmt.Errorf("failed to read token file: %w", err)
+			}
+			token, lastErr = decode(raw)
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		if lastErr == nil {
+			return token, nil
+		}
+	}
+	return nil, lastErr
+}
@@ -0,0 +1,10 @@
+//go:build !unix && !windows
+
+package forgeauth
+
+import "os"
+
+// Platforms without advisory locks rely on atomic replacement alone
+func lockFile(f *os.File, exclusive bool) error { return nil }
+
+func unlockFile(f *os.File) error { return nil }
@@ -0,0 +1,137 @@
+package forgeauth
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/fips140"
+	"crypto/hkdf"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"sync"
+)
+
+// ErrNotFIPSApproved is returned when FIPS mode is on and a configuration
+// needs a primitive or key size outside the approved set
+var ErrNotFIPSApproved = errors.New("not FIPS-approved")
+
+// fipsAlgs are the token algorithms built only from FIPS-approved
+// primitives: HMAC (FIPS 198-1) over SHA-256 or SHA-512/256 (FIPS 180-4),
+// and Ed25519 (FIPS 186-5). Keys are derived with HKDF-SHA256 (SP 800-56C).
+// Keyed BLAKE2b is not approved.
+var fipsAlgs = []string{AlgHS256, AlgHS512_256, AlgEd25519}
+
+// fipsMinRSABits is the smallest RSA modulus accepted for federated ID
+// tokens in FIPS mode (SP 800-131A)
+const fipsMinRSABits = 2048
+
+// fipsRequired reports whether FIPS mode is forced for every dominion, by
+// the forgefips build tag, FORGE_DOMINION_FIPS=1 or Go's own FIPS 140 mode
+// (GODEBUG=fips140=on)
+func fipsRequired() bool {
+	return fipsBuild || os.Getenv("FORGE_DOMINION_FIPS") == "1" || fips140.Enabled()
+}
+
+func init() {
+	// Power-up self-tests: a failure leaves every FIPS dominion refusing
+	// to sign or verify
+	if fipsRequired() {
+		fipsSelfTest()
+	}
+}
+
+// EnableFIPS restricts the dominion to FIPS-approved primitives after
+// running the known-answer self-tests. It fails if the current signing or
+// allowed algorithms aren't approved; with no explicit allow list,
+// validation is restricted to the approved algorithms.
+func (fd *ForgeDominion) EnableFIPS() error {
+	if err := fipsSelfTest(); err != nil {
+		return err
+	}
+	if !slices.Contains(fipsAlgs, fd.signingAlg) {
+		return fmt.Errorf("%w: signing alg %q", ErrNotFIPSApproved, fd.signingAlg)
+	}
+	for _, alg := range fd.allowedAlgs {
+		if !slices.Contains(fipsAlgs, alg) {
+			return fmt.Errorf("%w: allowed alg %q", ErrNotFIPSApproved, alg)
+		}
+	}
+	if fd.allowedAlgs == nil {
+		fd.allowedAlgs = slices.Clone(fipsAlgs)
+	}
+	fd.fips = true
+	return nil
+}
+
+// FIPSEnabled reports whether the dominion is in FIPS mode
+func (fd *ForgeDominion) FIPSEnabled() bool {
+	return fd.fips
+}
+
+// checkFIPSAlg rejects alg in FIPS mode unless it is approved
+func (fd *ForgeDominion) checkFIPSAlg(alg string) error {
+	if fd.fips && !slices.Contains(fipsAlgs, alg) {
+		return fmt.Errorf("%w: alg %q", ErrNotFIPSApproved, alg)
+	}
+	return nil
+}
+
+// fipsReady returns the self-test result in FIPS mode, nil otherwise
+func (fd *ForgeDominion) fipsReady() error {
+	if !fd.fips {
+		return nil
+	}
+	return fipsSelfTest()
+}
+
+// fipsSelfTest runs the known-answer tests once and caches the result
+var fipsSelfTest = sync.OnceValue(func() error {
+	for _, kat := range fipsKATs {
+		got, err := kat.run()
+		if err != nil {
+			return fmt.Errorf("FIPS self-test %s failed: %w", kat.name, err)
+		}
+		if hex.EncodeToString(got) != kat.want {
+			return fmt.Errorf("FIPS self-test %s failed: wrong answer", kat.name)
+		}
+	}
+	return nil
+})
+
+// fipsKATs are known-answer tests from RFC 4231, RFC 5869 and RFC 8032 for
+// every primitive FIPS mode relies on
+var fipsKATs = []struct {
+	name string
+	run  func() ([]byte, error)
+	want string
+}{
+	{"HMAC-SHA256", func() ([]byte, error) {
+		h := hmac.New(sha256.New, []byte("Jefe"))
+		h.Write([]byte("what do ya want for nothing?"))
+		return h.Sum(nil), nil
+	}, "5bdcc146bf60754e6a042426089575c75a003f089d2739839dec58b964ec3843"},
+	{"HMAC-SHA512/256", func() ([]byte, error) {
+		h := hmac.New(sha512.New512_256, []byte("Jefe"))
+		h.Write([]byte("what do ya want for nothing?"))
+		return h.Sum(nil), nil
+	}, "6df7b24630d5ccb2ee335407081a87188c221489768fa2020513b2d593359456"},
+	{"HKDF-SHA256", func() ([]byte, error) {
+		salt, _ := hex.DecodeString("000102030405060708090a0b0c")
+		info, _ := hex.DecodeString("f0f1f2f3f4f5f6f7f8f9")
+		return hkdf.Key(sha256.New, bytes.Repeat([]byte{0x0b}, 22), salt, string(info), 42)
+	}, "3cb25f25faacd57a90434f64d0362f2a2d2d0a90cf1a5a4c5db02d56ecc4c5bf34007208d5b887185865"},
+	{"Ed25519", func() ([]byte, error) {
+		seed, _ := hex.DecodeString("9d61b19deffd5a60ba844af492ec2cc44449c5697b326919703bac031cae7f60")
+		priv := ed25519.NewKeyFromSeed(seed)
+		sig := ed25519.Sign(priv, nil)
+		if !ed25519.Verify(priv.Public().(ed25519.PublicKey), nil, sig) {
+			return nil, fmt.Errorf("signature does not verify")
+		}
+		return sig, nil
+	}, "e5564300c360ac729086e2cc806e828a84877f1eb8e5d974d873e065224901555fb8821590a33bacc61e39701cf9b46bd25bf5f0595bbe24655141438e7a100b"},
+}
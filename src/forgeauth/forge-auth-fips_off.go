@@ -0,0 +1,6 @@
+//go:build !forgefips
+
+package forgeauth
+
+// fipsBuild forces FIPS mode; see fipsRequired
+const fipsBuild = false
@@ -0,0 +1,186 @@
+package forgeauth
+
+import (
+	"context"
+	"crypto"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// forgeTokenMetadataKey carries the encoded ForgeToken in gRPC metadata
+const forgeTokenMetadataKey = "x-forge-token"
+
+// MethodScopes maps gRPC methods to the scope a caller's token must hold.
+// Keys are full method names ("/pkg.Service/Method"), service wildcards
+// ("/pkg.Service/*") or "*" for every method not otherwise listed. Methods
+// with no matching entry only require a valid token.
+type MethodScopes map[string]string
+
+// required returns the scope needed to call fullMethod
+func (m MethodScopes) required(fullMethod string) string {
+	if scope, ok := m[fullMethod]; ok {
+		return scope
+	}
+	if i := strings.LastIndex(fullMethod, "/"); i > 0 {
+		if scope, ok := m[fullMethod[:i+1]+"*"]; ok {
+			return scope
+		}
+	}
+	return m["*"]
+}
+
+// UnaryServerInterceptor validates ForgeTokens on unary RPCs and injects the
+// token into the handler context
+func UnaryServerInterceptor(fd *ForgeDominion, scopes MethodScopes) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		token, err := authenticateRPC(ctx, fd, info.FullMethod, scopes.required(info.FullMethod))
+		if err != nil {
+			return nil, err
+		}
+		return handler(ContextWithToken(ctx, token), req)
+	}
+}
+
+// StreamServerInterceptor validates ForgeTokens when a stream is opened and
+// injects the token into the stream context
+func StreamServerInterceptor(fd *ForgeDominion, scopes MethodScopes) grpc.StreamServerInterceptor {
+	return func(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		token, err := authenticateRPC(ss.Context(), fd, info.FullMethod, scopes.required(info.FullMethod))
+		if err != nil {
+			return err
+		}
+		return handler(srv, &tokenServerStream{ServerStream: ss, ctx: ContextWithToken(ss.Context(), token)})
+	}
+}
+
+// tokenServerStream overrides the stream context with one carrying the token
+type tokenServerStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *tokenServerStream) Context() context.Context {
+	return s.ctx
+}
+
+// authenticateRPC extracts and validates the token in incoming metadata,
+// and the proof for fullMethod if the token is key-bound
+func authenticateRPC(ctx context.Context, fd *ForgeDominion, fullMethod string, requiredScope string) (*ForgeToken, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+
+	encoded := ""
+	if values := md.Get(forgeTokenMetadataKey); len(values) > 0 {
+		encoded = values[0]
+	} else if values := md.Get("authorization"); len(values) > 0 {
+		if scheme, rest, ok := strings.Cut(values[0], " "); ok && (strings.EqualFold(scheme, authScheme) || strings.EqualFold(scheme, "Bearer")) {
+			encoded = strings.TrimSpace(rest)
+		}
+	}
+	if encoded == "" {
+		return nil, status.Error(codes.Unauthenticated, "missing forge token")
+	}
+
+	remote := ""
+	if p, ok := peer.FromContext(ctx); ok && p.Addr != nil {
+		remote = p.Addr.String()
+	}
+	token, err := fd.ValidateBearer(ContextWithRemoteAddr(ctx, remote), encoded)
+	if err == nil && token.KeyBinding != "" {
+		var p *Proof
+		if values := md.Get(proofMetadataKey); len(values) > 0 {
+			p, err = DecodeProof(values[0])
+		}
+		if err == nil {
+			err = fd.ValidateProof(ctx, token, p, ProofMethodRPC, fullMethod)
+		}
+	}
+	if err == nil && len(token.Networks) > 0 {
+		err = checkNetwork(token, remote)
+	}
+	if err == nil && !fd.allows(token, requiredScope) {
+		err = fmt.Errorf("%w: %q required", ErrScopeDenied, requiredScope)
+	}
+	if err != nil {
+		return nil, status.Error(GRPCCode(err), authFailureMessage(err))
+	}
+	return token, nil
+}
+
+// GRPCCode maps an authentication error to a gRPC status code, following
+// the same split as HTTPStatus
+func GRPCCode(err error) codes.Code {
+	switch HTTPStatus(err) {
+	case http.StatusOK:
+		return codes.OK
+	case http.StatusForbidden:
+		return codes.PermissionDenied
+	case http.StatusTooManyRequests:
+		return codes.ResourceExhausted
+	}
+	return codes.Unauthenticated
+}
+
+// TokenCredentials attaches a ForgeToken to every outgoing RPC. It
+// implements credentials.PerRPCCredentials for use with
+// grpc.WithPerRPCCredentials.
+type TokenCredentials struct {
+	source      func(ctx context.Context) (*ForgeToken, error)
+	allowNonTLS bool
+	proofKey    crypto.Signer
+}
+
+var _ credentials.PerRPCCredentials = (*TokenCredentials)(nil)
+
+// NewTokenCredentials returns per-RPC credentials that fetch the current
+// token from source on each call. Tokens are bearer credentials, so TLS is
+// required unless allowNonTLS is set (e.g. for a local unix socket).
+func NewTokenCredentials(source func(ctx context.Context) (*ForgeToken, error), allowNonTLS bool) *TokenCredentials {
+	return &TokenCredentials{source: source, allowNonTLS: allowNonTLS}
+}
+
+// WithProofKey makes the credentials sign a proof of possession for every
+// RPC, as key-bound tokens need, and returns c
+func (c *TokenCredentials) WithProofKey(key crypto.Signer) *TokenCredentials {
+	c.proofKey = key
+	return c
+}
+
+// GetRequestMetadata returns the metadata carrying the current token
+func (c *TokenCredentials) GetRequestMetadata(ctx context.Context, uri ...string) (map[string]string, error) {
+	token, err := c.source(ctx)
+	if err != nil {
+		return nil, err
+	}
+	encoded, err := EncodeToken(token)
+	if err != nil {
+		return nil, err
+	}
+	md := map[string]string{forgeTokenMetadataKey: encoded}
+	if c.proofKey != nil {
+		ri, ok := credentials.RequestInfoFromContext(ctx)
+		if !ok {
+			return nil, fmt.Errorf("no RPC method to sign a proof for")
+		}
+		p, err := NewProof(c.proofKey, token, ProofMethodRPC, ri.Method)
+		if err != nil {
+			return nil, err
+		}
+		if md[proofMetadataKey], err = EncodeProof(p); err != nil {
+			return nil, err
+		}
+	}
+	return md, nil
+}
+
+// RequireTransportSecurity reports whether the credentials need TLS
+func (c *TokenCredentials) RequireTransportSecurity() bool {
+	return !c.allowNonTLS
+}
@@ -0,0 +1,75 @@
+package forgeauth
+
+import (
+	"context"
+	"fmt"
+)
+
+// PreIssueHook runs before every token is signed, whether issued directly,
+// in a batch, or by renewal or exchange. It may change spec, e.g. to add
+// custom claims, and the result is validated as if the caller had asked for
+// it; the lifetime is already fixed and changing TTL has no effect.
+// Returning an error vetoes the token; wrap ErrPolicyDenied to have it
+// reported as a denial.
+type PreIssueHook func(ctx context.Context, spec *TokenSpec) error
+
+// PostIssueHook runs once a token is signed, before it is recorded or
+// returned, e.g. to mirror it to an external system. An error fails the
+// issuance and revokes the token, so a mirror never misses a token the
+// caller holds. Hooks must not modify token.
+type PostIssueHook func(ctx context.Context, token *ForgeToken) error
+
+// AddPreIssueHook registers h to run before signing. Hooks run in the
+// order they were added, each seeing the previous one's changes.
+func (fd *ForgeDominion) AddPreIssueHook(h PreIssueHook) {
+	fd.hooksMu.Lock()
+	fd.preIssue = append(fd.preIssue, h)
+	fd.hooksMu.Unlock()
+}
+
+// AddPostIssueHook registers h to run after signing, in the order added
+func (fd *ForgeDominion) AddPostIssueHook(h PostIssueHook) {
+	fd.hooksMu.Lock()
+	fd.postIssue = append(fd.postIssue, h)
+	fd.hooksMu.Unlock()
+}
+
+func (fd *ForgeDominion) runPreIssueHooks(ctx context.Context, spec *TokenSpec) error {
+	fd.hooksMu.RLock()
+	hooks := fd.preIssue
+	fd.hooksMu.RUnlock()
+	for _, h := range hooks {
+		if err := h(ctx, spec); err != nil {
+			return fmt.Errorf("pre-issue hook: %w", err)
+		}
+	}
+	return nil
+}
+
+func (fd *ForgeDominion) runPostIssueHooks(ctx context.Context, token *ForgeToken) error {
+	fd.hooksMu.RLock()
+	hooks := fd.postIssue
+	fd.hooksMu.RUnlock()
+	for _, h := range hooks {
+		if err := h(ctx, token); err != nil {
+			fd.discard(token)
+			return fmt.Errorf("post-issue hook: %w", err)
+		}
+	}
+	return nil
+}
+
+// discard revokes tokens that were signed and shown to post-issue hooks
+// but are not being returned. Revocation failures are ignored: the caller
+// is already failing, and without hooks nothing else holds the tokens.
+func (fd *ForgeDominion) discard(tokens ...*ForgeToken) {
+	fd.hooksMu.RLock()
+	mirrored := len(fd.postIssue) > 0
+	fd.hooksMu.RUnlock()
+	if !mirrored {
+		return
+	}
+	for _, t := range tokens {
+		_ = fd.RevokeID(t.ID, t.ExpiresAt)
+	}
+}
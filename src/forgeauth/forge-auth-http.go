@@ -0,0 +1,125 @@
+package forgeauth
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// ForgeTokenHeader is an alternative to "Authorization: Forge <token>" for
+// clients that already use the Authorization header for something else
+const ForgeTokenHeader = "X-Forge-Token"
+
+// authScheme is the Authorization header scheme for ForgeTokens
+const authScheme = "Forge"
+
+type tokenContextKey struct{}
+
+// EncodeToken serializes a token for transport in a header
+func EncodeToken(token *ForgeToken) (string, error) {
+	data, err := MarshalToken(token)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(data), nil
+}
+
+// DecodeToken parses a token produced by EncodeToken
+func DecodeToken(encoded string) (*ForgeToken, error) {
+	data, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(encoded, "="))
+	if err != nil {
+		return nil, fmt.Errorf("%w: invalid encoding: %v", ErrMalformed, err)
+	}
+	return UnmarshalToken(data)
+}
+
+// TokenFromRequest extracts the ForgeToken carried by an HTTP request
+func TokenFromRequest(r *http.Request) (*ForgeToken, error) {
+	if encoded := r.Header.Get(ForgeTokenHeader); encoded != "" {
+		return DecodeToken(encoded)
+	}
+
+	scheme, encoded, ok := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !ok || !strings.EqualFold(scheme, authScheme) {
+		return nil, fmt.Errorf("%w: no forge token in request", ErrMalformed)
+	}
+	return DecodeToken(strings.TrimSpace(encoded))
+}
+
+// credentialFromRequest returns the raw bearer credential of a request:
+// an encoded ForgeToken, or an OIDC ID token sent as "Bearer"
+func credentialFromRequest(r *http.Request) (string, error) {
+	if encoded := r.Header.Get(ForgeTokenHeader); encoded != "" {
+		return encoded, nil
+	}
+
+	scheme, credential, ok := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !ok || (!strings.EqualFold(scheme, authScheme) && !strings.EqualFold(scheme, "Bearer")) {
+		return "", fmt.Errorf("%w: no forge token in request", ErrMalformed)
+	}
+	return strings.TrimSpace(credential), nil
+}
+
+// SetRequestToken attaches a token to an outgoing HTTP request
+func SetRequestToken(r *http.Request, token *ForgeToken) error {
+	encoded, err := EncodeToken(token)
+	if err != nil {
+		return err
+	}
+	r.Header.Set("Authorization", authScheme+" "+encoded)
+	return nil
+}
+
+// ContextWithToken returns a copy of ctx carrying the validated token
+func ContextWithToken(ctx context.Context, token *ForgeToken) context.Context {
+	return context.WithValue(ctx, tokenContextKey{}, token)
+}
+
+// TokenFromContext returns the validated token injected by Middleware
+func TokenFromContext(ctx context.Context) (*ForgeToken, bool) {
+	token, ok := ctx.Value(tokenContextKey{}).(*ForgeToken)
+	return token, ok
+}
+
+// Middleware authenticates requests with ForgeTokens, or federated OIDC ID
+// tokens when federation is enabled. Requests without a valid token get
+// 401, tokens lacking requiredScope or presented from outside their
+// networks get 403, and accepted tokens are available to handlers through
+// TokenFromContext. Network claims are checked against r.RemoteAddr, so
+// behind a proxy they must be enforced at the proxy's layer instead.
+// Key-bound tokens also need a proof in ProofHeader, see SetRequestProof.
+func Middleware(fd *ForgeDominion, requiredScope string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			credential, err := credentialFromRequest(r)
+			if err != nil {
+				w.Header().Set("WWW-Authenticate", authScheme)
+				http.Error(w, "missing or malformed forge token", http.StatusUnauthorized)
+				return
+			}
+
+			token, err := fd.ValidateBearer(ContextWithRemoteAddr(r.Context(), r.RemoteAddr), credential)
+			if err == nil {
+				err = fd.validateRequestProof(r, token)
+			}
+			if err == nil {
+				err = checkNetwork(token, r.RemoteAddr)
+			}
+			if err == nil && !fd.allows(token, requiredScope) {
+				err = fmt.Errorf("%w: %q required", ErrScopeDenied, requiredScope)
+			}
+			if err != nil {
+				status := HTTPStatus(err)
+				if status == http.StatusUnauthorized {
+					w.Header().Set("WWW-Authenticate", authScheme)
+				}
+				http.Error(w, authFailureMessage(err), status)
+				return
+			}
+
+			next.ServeHTTP(w, r.WithContext(ContextWithToken(r.Context(), token)))
+		})
+	}
+}
@@ -0,0 +1,119 @@
+package forgeauth
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// Storage URI schemes accepted by SaveTokenTo and LoadTokenFrom:
+//
+//	/path/to/token.json                  encrypted file (same as file://)
+//	file:///path/to/token.json           encrypted file
+//	file+plaintext:///path/to/token.json plaintext JSON file (opt-in)
+//	keychain://<service>/<account>       OS keychain / credential store
+const (
+	schemeFile          = "file"
+	schemeFilePlaintext = "file+plaintext"
+	schemeKeychain      = "keychain"
+)
+
+// keychainStore is implemented per platform by the OS credential store:
+// macOS Keychain, Linux Secret Service and Windows Credential Manager.
+type keychainStore interface {
+	set(service, account string, secret []byte) error
+	get(service, account string) ([]byte, error)
+}
+
+// SaveTokenTo saves a token to the backend selected by the storage URI
+func SaveTokenTo(token *ForgeToken, storageURI string) error {
+	scheme, target, err := parseStorageURI(storageURI)
+	if err != nil {
+		return err
+	}
+
+	switch scheme {
+	case schemeFile:
+		return SaveToken(token, target)
+	case schemeFilePlaintext:
+		return SaveTokenPlaintext(token, target)
+	case schemeKeychain:
+		service, account, err := splitKeychainTarget(target)
+		if err != nil {
+			return err
+		}
+		data, err := MarshalToken(token)
+		if err != nil {
+			return err
+		}
+		// Store base64 so the secret survives tools that treat it as text
+		secret := []byte(base64.URLEncoding.EncodeToString(data))
+		if err := osKeychain().set(service, account, secret); err != nil {
+			return fmt.Errorf("failed to store token in keychain: %w", err)
+		}
+		return nil
+	}
+	return fmt.Errorf("unsupported storage scheme %q", scheme)
+}
+
+// LoadTokenFrom loads a token from the backend selected by the storage URI
+func LoadTokenFrom(storageURI string) (*ForgeToken, error) {
+	scheme, target, err := parseStorageURI(storageURI)
+	if err != nil {
+		return nil, err
+	}
+
+	switch scheme {
+	case schemeFile, schemeFilePlaintext:
+		// LoadToken detects sealed files itself
+		return LoadToken(target)
+	case schemeKeychain:
+		service, account, err := splitKeychainTarget(target)
+		if err != nil {
+			return nil, err
+		}
+		secret, err := osKeychain().get(service, account)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read token from keychain: %w", err)
+		}
+		data, err := base64.URLEncoding.DecodeString(strings.TrimSpace(string(secret)))
+		if err != nil {
+			return nil, fmt.Errorf("invalid keychain token encoding: %w", err)
+		}
+		return UnmarshalToken(data)
+	}
+	return nil, fmt.Errorf("unsupported storage scheme %q", scheme)
+}
+
+// parseStorageURI returns the scheme and backend-specific target of a
+// storage URI. Bare paths are treated as encrypted files.
+func parseStorageURI(storageURI string) (string, string, error) {
+	if !strings.Contains(storageURI, "://") {
+		return schemeFile, storageURI, nil
+	}
+
+	u, err := url.Parse(storageURI)
+	if err != nil {
+		return "", "", fmt.Errorf("invalid storage URI %q: %w", storageURI, err)
+	}
+
+	switch u.Scheme {
+	case schemeFile, schemeFilePlaintext:
+		if u.Path == "" {
+			return "", "", fmt.Errorf("storage URI %q has no path", storageURI)
+		}
+		return u.Scheme, u.Path, nil
+	case schemeKeychain:
+		return u.Scheme, u.Host + u.Path, nil
+	}
+	return "", "", fmt.Errorf("unsupported storage scheme %q", u.Scheme)
+}
+
+func splitKeychainTarget(target string) (string, string, error) {
+	service, account, ok := strings.Cut(strings.Trim(target, "/"), "/")
+	if !ok || service == "" || account == "" {
+		return "", "", fmt.Errorf("keychain URI must be keychain://<service>/<account>")
+	}
+	return service, account, nil
+}
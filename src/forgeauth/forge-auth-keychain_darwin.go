@@ -0,0 +1,32 @@
+package forgeauth
+
+import (
+	"bytes"
+	"fmt"
+	"os/exec"
+)
+
+// macKeychain stores tokens as generic passwords via the security(1) tool
+type macKeychain struct{}
+
+func osKeychain() keychainStore { return macKeychain{} }
+
+func (macKeychain) set(service, account string, secret []byte) error {
+	// Run in interactive mode so the secret is read from stdin instead of
+	// appearing in the process list
+	cmd := exec.Command("security", "-i")
+	cmd.Stdin = bytes.NewBufferString(fmt.Sprintf(
+		"add-generic-password -U -s %q -a %q -w %q\n", service, account, secret))
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("security add-generic-password: %w: %s", err, bytes.TrimSpace(out))
+	}
+	return nil
+}
+
+func (macKeychain) get(service, account string) ([]byte, error) {
+	out, err := exec.Command("security", "find-generic-password", "-s", service, "-a", account, "-w").Output()
+	if err != nil {
+		return nil, fmt.Errorf("security find-generic-password: %w", err)
+	}
+	return bytes.TrimSpace(out), nil
+}
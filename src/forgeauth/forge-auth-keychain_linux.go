@@ -0,0 +1,35 @@
+package forgeauth
+
+import (
+	"bytes"
+	"fmt"
+	"os/exec"
+)
+
+// secretService stores tokens in the freedesktop Secret Service (GNOME
+// Keyring, KWallet) via secret-tool(1)
+type secretService struct{}
+
+func osKeychain() keychainStore { return secretService{} }
+
+func (secretService) set(service, account string, secret []byte) error {
+	cmd := exec.Command("secret-tool", "store",
+		"--label", fmt.Sprintf("Forge token (%s/%s)", service, account),
+		"service", service, "account", account)
+	cmd.Stdin = bytes.NewReader(secret)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("secret-tool store: %w: %s", err, bytes.TrimSpace(out))
+	}
+	return nil
+}
+
+func (secretService) get(service, account string) ([]byte, error) {
+	out, err := exec.Command("secret-tool", "lookup", "service", service, "account", account).Output()
+	if err != nil {
+		return nil, fmt.Errorf("secret-tool lookup: %w", err)
+	}
+	if len(out) == 0 {
+		return nil, fmt.Errorf("no token stored for %s/%s", service, account)
+	}
+	return bytes.TrimSpace(out), nil
+}
@@ -0,0 +1,18 @@
+//go:build !darwin && !linux && !windows
+
+package forgeauth
+
+import "fmt"
+
+// unsupportedKeychain is used on platforms without a supported credential store
+type unsupportedKeychain struct{}
+
+func osKeychain() keychainStore { return unsupportedKeychain{} }
+
+func (unsupportedKeychain) set(service, account string, secret []byte) error {
+	return fmt.Errorf("keychain storage is not supported on this platform")
+}
+
+func (unsupportedKeychain) get(service, account string) ([]byte, error) {
+	return nil, fmt.Errorf("keychain storage is not supported on this platform")
+}
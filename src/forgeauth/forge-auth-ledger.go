@@ -0,0 +1,362 @@
+package forgeauth
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// Ledger record kinds
+const (
+	LedgerIssue  = "issue"
+	LedgerRevoke = "revoke"
+	LedgerRetire = "retire_key"
+)
+
+// LedgerEntry is one ledger record. Issue records carry the token's claims
+// but never its signature, so the ledger can't be used to replay tokens.
+type LedgerEntry struct {
+	Kind      string    `json:"kind"`
+	Time      time.Time `json:"time"`
+	ID        string    `json:"jti,omitempty"`
+	TenantID  string    `json:"tenant_id,omitempty"`
+	NodeID    string    `json:"node_id,omitempty"`
+	Scope     string    `json:"scope,omitempty"`
+	Audience  string    `json:"audience,omitempty"`
+	IssuedAt  time.Time `json:"issued_at,omitzero"`
+	ExpiresAt time.Time `json:"expires_at,omitzero"`
+	SessionID string    `json:"sid,omitempty"`
+}
+
+// ledgerTable is the CRC-32C table used to checksum ledger records
+var ledgerTable = crc32.MakeTable(crc32.Castagnoli)
+
+// Ledger is an append-only on-disk record of issued tokens and revocations.
+// Each line is a hex CRC-32C of the record followed by the record as JSON,
+// and every append is fsynced before the operation that caused it returns.
+type Ledger struct {
+	mu      sync.Mutex
+	path    string
+	f       *os.File
+	entries []LedgerEntry
+}
+
+// OpenLedger opens or creates the ledger at path and replays its records.
+// A torn final record, left by a crash mid-append before its newline, is
+// truncated away; a whole record that fails its checksum, even the last,
+// is reported as corruption.
+func OpenLedger(path string) (*Ledger, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open ledger: %w", err)
+	}
+
+	entries, valid, err := readLedger(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	if err := f.Truncate(valid); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("failed to truncate torn ledger record: %w", err)
+	}
+	if _, err := f.Seek(valid, io.SeekStart); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("failed to seek ledger: %w", err)
+	}
+
+	return &Ledger{path: path, f: f, entries: entries}, nil
+}
+
+// readLedger decodes every record and returns the length of the valid
+// prefix of the file
+func readLedger(r io.Reader) ([]LedgerEntry, int64, error) {
+	var entries []LedgerEntry
+	var valid int64
+
+	br := bufio.NewReader(r)
+	for line := 1; ; line++ {
+		raw, err := br.ReadBytes('\n')
+		if errors.Is(err, io.EOF) {
+			// Anything after the last newline is a torn append
+			return entries, valid, nil
+		}
+		if err != nil {
+			return nil, 0, fmt.Errorf("failed to read ledger: %w", err)
+		}
+
+		// A record is written whole with its newline, so one that is
+		// terminated but doesn't decode was damaged after the fact
+		entry, err := decodeLedgerRecord(raw)
+		if err != nil {
+			return nil, 0, fmt.Errorf("ledger corrupt at record %d: %w", line, err)
+		}
+		entries = append(entries, entry)
+		valid += int64(len(raw))
+	}
+}
+
+func encodeLedgerRecord(entry LedgerEntry) ([]byte, error) {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode ledger record: %w", err)
+	}
+	sum := crc32.Checksum(data, ledgerTable)
+	line := fmt.Appendf(nil, "%08x ", sum)
+	line = append(line, data...)
+	return append(line, '\n'), nil
+}
+
+func decodeLedgerRecord(raw []byte) (LedgerEntry, error) {
+	var entry LedgerEntry
+	sumHex, data, ok := bytes.Cut(bytes.TrimSuffix(raw, []byte("\n")), []byte(" "))
+	if !ok {
+		return entry, fmt.Errorf("missing checksum")
+	}
+	sum, err := hex.DecodeString(string(sumHex))
+	if err != nil || len(sum) != 4 {
+		return entry, fmt.Errorf("invalid checksum")
+	}
+	want := uint32(sum[0])<<24 | uint32(sum[1])<<16 | uint32(sum[2])<<8 | uint32(sum[3])
+	if crc32.Checksum(data, ledgerTable) != want {
+		return entry, fmt.Errorf("checksum mismatch")
+	}
+	if err := json.Unmarshal(data, &entry); err != nil {
+		return entry, fmt.Errorf("invalid record: %w", err)
+	}
+	return entry, nil
+}
+
+// Append writes entries as one fsynced write
+func (l *Ledger) Append(entries ...LedgerEntry) error {
+	var buf []byte
+	for _, entry := range entries {
+		line, err := encodeLedgerRecord(entry)
+		if err != nil {
+			return err
+		}
+		buf = append(buf, line...)
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.f == nil {
+		return fmt.Errorf("ledger is closed")
+	}
+	if _, err := l.f.Write(buf); err != nil {
+		return fmt.Errorf("failed to append to ledger: %w", err)
+	}
+	if err := l.f.Sync(); err != nil {
+		return fmt.Errorf("failed to sync ledger: %w", err)
+	}
+	l.entries = append(l.entries, entries...)
+	return nil
+}
+
+// Entries returns every record in the ledger
+func (l *Ledger) Entries() []LedgerEntry {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return append([]LedgerEntry(nil), l.entries...)
+}
+
+// Outstanding returns the issue records of tokens that have not expired
+// and have not been revoked, individually or by key retirement
+func (l *Ledger) Outstanding() []LedgerEntry {
+	return outstanding(l.Entries(), time.Now())
+}
+
+func outstanding(entries []LedgerEntry, now time.Time) []LedgerEntry {
+	revoked := make(map[string]bool)
+	retired := make(map[string]time.Time)
+	for _, e := range entries {
+		switch e.Kind {
+		case LedgerRevoke:
+			revoked[e.ID] = true
+		case LedgerRetire:
+			key := retirementKey(e.TenantID, e.NodeID)
+			if e.Time.After(retired[key]) {
+				retired[key] = e.Time
+			}
+		}
+	}
+
+	var out []LedgerEntry
+	for _, e := range entries {
+		if e.Kind != LedgerIssue || !e.ExpiresAt.After(now) || revoked[e.ID] {
+			continue
+		}
+		if at, ok := retired[retirementKey(e.TenantID, e.NodeID)]; ok && e.IssuedAt.Before(at) {
+			continue
+		}
+		if at, ok := retired[retirementKey(e.TenantID, "")]; ok && e.IssuedAt.Before(at) {
+			continue
+		}
+		out = append(out, e)
+	}
+	return out
+}
+
+// Compact atomically rewrites the ledger keeping only outstanding tokens
+// and the revocations and retirements that still affect unexpired tokens
+func (l *Ledger) Compact() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.f == nil {
+		return fmt.Errorf("ledger is closed")
+	}
+
+	now := time.Now()
+	var kept []LedgerEntry
+	var buf []byte
+	for _, e := range l.entries {
+		if !e.ExpiresAt.IsZero() && !e.ExpiresAt.After(now) {
+			continue
+		}
+		line, err := encodeLedgerRecord(e)
+		if err != nil {
+			return err
+		}
+		kept = append(kept, e)
+		buf = append(buf, line...)
+	}
+
+	if err := writeFileAtomic(l.path, buf, 0600); err != nil {
+		return fmt.Errorf("failed to compact ledger: %w", err)
+	}
+	f, err := os.OpenFile(l.path, os.O_RDWR|os.O_APPEND, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to reopen ledger: %w", err)
+	}
+	l.f.Close()
+	l.f = f
+	l.entries = kept
+	return nil
+}
+
+// Close closes the ledger file
+func (l *Ledger) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.f == nil {
+		return nil
+	}
+	err := l.f.Close()
+	l.f = nil
+	return err
+}
+
+// ledgerBackend persists issue, revoke and retirement records; Ledger and
+// SQLiteStore implement it
+type ledgerBackend interface {
+	Append(entries ...LedgerEntry) error
+	records() ([]LedgerEntry, error)
+}
+
+func (l *Ledger) records() ([]LedgerEntry, error) {
+	return l.Entries(), nil
+}
+
+// SetLedger records every token issued by fd, and every revocation, in l.
+// Revocations and key retirements already in the ledger are restored so
+// they survive a dominion restart.
+func (fd *ForgeDominion) SetLedger(l *Ledger) {
+	fd.restoreRevocations(l.Entries())
+	fd.ledger = l
+}
+
+// restoreRevocations loads the revoke and retirement records of a ledger
+// into the revocation list
+func (fd *ForgeDominion) restoreRevocations(entries []LedgerEntry) {
+	now := fd.now()
+	rl := fd.revocations
+	rl.mu.Lock()
+	for _, e := range entries {
+		switch e.Kind {
+		case LedgerRevoke:
+			if e.ExpiresAt.After(now) {
+				rl.revoked[e.ID] = e.ExpiresAt
+			}
+		case LedgerRetire:
+			key := retirementKey(e.TenantID, e.NodeID)
+			if e.Time.After(rl.retired[key]) {
+				rl.retired[key] = e.Time
+			}
+		}
+	}
+	rl.version++
+	rl.mu.Unlock()
+}
+
+// OutstandingTokens lists tokens issued by fd that are still live according
+// to its ledger
+func (fd *ForgeDominion) OutstandingTokens() ([]LedgerEntry, error) {
+	if fd.ledger == nil {
+		return nil, fmt.Errorf("no ledger configured")
+	}
+	entries, err := fd.ledger.records()
+	if err != nil {
+		return nil, err
+	}
+	return outstanding(entries, fd.now()), nil
+}
+
+// RevokeOutstanding revokes, by token ID, every outstanding token the ledger
+// holds for the node (or the whole tenant when nodeID is empty). Unlike
+// RetireNodeKey it leaves tokens issued later unaffected.
+func (fd *ForgeDominion) RevokeOutstanding(tenantID string, nodeID string) (int, error) {
+	live, err := fd.OutstandingTokens()
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	for _, e := range live {
+		if e.TenantID != tenantID || (nodeID != "" && e.NodeID != nodeID) {
+			continue
+		}
+		if err := fd.RevokeID(e.ID, e.ExpiresAt); err != nil {
+			return n, err
+		}
+		n++
+	}
+	return n, nil
+}
+
+// ledgerIssued appends issue records for tokens; without a ledger it is a
+// no-op
+func (fd *ForgeDominion) ledgerIssued(tokens ...*ForgeToken) error {
+	if fd.ledger == nil {
+		return nil
+	}
+	entries := make([]LedgerEntry, 0, len(tokens))
+	for _, t := range tokens {
+		entries = append(entries, LedgerEntry{
+			Kind:      LedgerIssue,
+			Time:      t.IssuedAt,
+			ID:        t.ID,
+			TenantID:  t.TenantID,
+			NodeID:    t.NodeID,
+			Scope:     t.Scope,
+			Audience:  t.Audience,
+			IssuedAt:  t.IssuedAt,
+			ExpiresAt: t.ExpiresAt,
+			SessionID: t.SessionID,
+		})
+	}
+	return fd.ledger.Append(entries...)
+}
+
+func (fd *ForgeDominion) ledgerAppend(entry LedgerEntry) error {
+	if fd.ledger == nil {
+		return nil
+	}
+	return fd.ledger.Append(entry)
+}
@@ -0,0 +1,191 @@
+package forgeauth
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// openTestLedger opens the ledger at path, closing it when the test ends
+func openTestLedger(t *testing.T, path string) *Ledger {
+	t.Helper()
+	l, err := OpenLedger(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	return l
+}
+
+// restart opens the ledger at path again under a new dominion on clock,
+// as a restarted process would
+func restart(t *testing.T, path string, clock Clock) (*ForgeDominion, *Ledger) {
+	t.Helper()
+	fd := NewForgeDominionWithKeys(StaticKeyProvider{"": bytes.Clone(testRootKey)})
+	fd.SetClock(clock)
+	l := openTestLedger(t, path)
+	fd.SetLedger(l)
+	return fd, l
+}
+
+func TestLedgerReplayAfterRestart(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ledger")
+	fd, clock := newTestDominion(t, AlgHS256)
+	l := openTestLedger(t, path)
+	fd.SetLedger(l)
+	kept, err := fd.RequestToken("node-1", "runtime:read", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	revoked, err := fd.RequestToken("node-2", "runtime:read", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := fd.Revoke(revoked); err != nil {
+		t.Fatal(err)
+	}
+	want := l.Entries()
+	l.Close()
+
+	fd, l = restart(t, path, clock)
+	got := l.Entries()
+	if len(got) != len(want) {
+		t.Fatalf("replayed %d records, want %d", len(got), len(want))
+	}
+	for i := range want {
+		if got[i].Kind != want[i].Kind || got[i].ID != want[i].ID || !got[i].ExpiresAt.Equal(want[i].ExpiresAt) {
+			t.Errorf("record %d replayed as %+v, want %+v", i, got[i], want[i])
+		}
+	}
+	live, err := fd.OutstandingTokens()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(live) != 1 || live[0].ID != kept.ID {
+		t.Errorf("outstanding after restart: %v, want only %s", live, kept.ID)
+	}
+	if err := fd.ValidateToken(kept); err != nil {
+		t.Errorf("live token after restart: %v", err)
+	}
+}
+
+func TestLedgerTornTail(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ledger")
+	l := openTestLedger(t, path)
+	now := time.Now()
+	if err := l.Append(LedgerEntry{Kind: LedgerRevoke, Time: now, ID: "a", ExpiresAt: now.Add(time.Hour)}); err != nil {
+		t.Fatal(err)
+	}
+	l.Close()
+	whole, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A crash part way through appending the second record
+	line, err := encodeLedgerRecord(LedgerEntry{Kind: LedgerRevoke, Time: now, ID: "b", ExpiresAt: now.Add(time.Hour)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, append(bytes.Clone(whole), line[:len(line)/2]...), 0600); err != nil {
+		t.Fatal(err)
+	}
+	l = openTestLedger(t, path)
+	if got := l.Entries(); len(got) != 1 || got[0].ID != "a" {
+		t.Fatalf("replayed %v, want only the whole record", got)
+	}
+	if data, _ := os.ReadFile(path); !bytes.Equal(data, whole) {
+		t.Errorf("torn record left in place: %q", data)
+	}
+
+	// Appends carry on from the last whole record
+	if err := l.Append(LedgerEntry{Kind: LedgerRevoke, Time: now, ID: "c", ExpiresAt: now.Add(time.Hour)}); err != nil {
+		t.Fatal(err)
+	}
+	l.Close()
+	l = openTestLedger(t, path)
+	if got := l.Entries(); len(got) != 2 || got[1].ID != "c" {
+		t.Errorf("replayed %v after appending past a torn record, want a then c", got)
+	}
+}
+
+func TestLedgerRejectsCorruption(t *testing.T) {
+	now := time.Now()
+	var ledger []byte
+	for _, id := range []string{"a", "b", "c"} {
+		line, err := encodeLedgerRecord(LedgerEntry{Kind: LedgerRevoke, Time: now, ID: id, ExpiresAt: now.Add(time.Hour)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ledger = append(ledger, line...)
+	}
+	lines := bytes.SplitAfter(ledger, []byte("\n"))
+
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"edited record", bytes.Join([][]byte{lines[0], bytes.Replace(lines[1], []byte(`"b"`), []byte(`"x"`), 1), lines[2]}, nil)},
+		{"edited last record", bytes.Join([][]byte{lines[0], lines[1], bytes.Replace(lines[2], []byte(`"c"`), []byte(`"x"`), 1)}, nil)},
+		{"truncated last record", bytes.Join([][]byte{lines[0], lines[1], lines[2][:len(lines[2])/2], []byte("\n")}, nil)},
+		{"missing checksum", bytes.Join([][]byte{lines[0], []byte("{}\n"), lines[2]}, nil)},
+		{"bad checksum", bytes.Join([][]byte{lines[0], []byte("zzzzzzzz {}\n"), lines[2]}, nil)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "ledger")
+			if err := os.WriteFile(path, tt.data, 0600); err != nil {
+				t.Fatal(err)
+			}
+			if l, err := OpenLedger(path); err == nil {
+				l.Close()
+				t.Fatal("corrupt ledger opened")
+			}
+			// and is left as it was, for inspection
+			if data, _ := os.ReadFile(path); !bytes.Equal(data, tt.data) {
+				t.Error("corrupt ledger rewritten")
+			}
+		})
+	}
+}
+
+func TestLedgerRevocationsSurviveReopen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ledger")
+	// Compact drops records by the wall clock, so this dominion runs on it
+	fd, l := restart(t, path, nil)
+	revoked, err := fd.RequestToken("node-1", "runtime:read", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	retired, err := fd.RequestToken("node-2", "runtime:read", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := fd.Revoke(revoked); err != nil {
+		t.Fatal(err)
+	}
+	if err := fd.RetireNodeKey("", "node-2", time.Now().Add(time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	l.Close()
+
+	for _, compact := range []bool{false, true} {
+		fd, l = restart(t, path, nil)
+		if err := fd.ValidateToken(revoked); !errors.Is(err, ErrRevoked) {
+			t.Errorf("revoked token after reopening (compacted %t): got %v, want %v", compact, err, ErrRevoked)
+		}
+		if err := fd.ValidateToken(retired); err == nil {
+			t.Errorf("token of a retired key validated after reopening (compacted %t)", compact)
+		}
+		if compact {
+			break
+		}
+		if err := l.Compact(); err != nil {
+			t.Fatal(err)
+		}
+		l.Close()
+	}
+}
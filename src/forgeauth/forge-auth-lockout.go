@@ -0,0 +1,203 @@
+package forgeauth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// LockoutPolicy temporarily refuses principals that keep presenting badly
+// signed tokens, which is what guessing keys or replaying stolen,
+// re-signed tokens looks like. Principals are source addresses, when the
+// caller's address is known, and nodes (by tenant and node ID); either one
+// failing Threshold times within Window locks it for Duration.
+//
+// A badly signed token's claims are unauthenticated, so its failures
+// count against the source alone: anyone could name a victim node in
+// them. A node's failures are counted only from evidence that proves who
+// it is, such as a valid refresh credential presented with a forged token
+// or a real, expired enrollment code.
+type LockoutPolicy struct {
+	Threshold int
+	Window    time.Duration
+	Duration  time.Duration
+}
+
+// maxLockoutPrincipals bounds the failure tracking table. Once full, stale
+// principals are swept; if none are stale, new ones go untracked rather
+// than growing the table without limit.
+const maxLockoutPrincipals = 1 << 16
+
+// lockoutState counts one principal's failures over a fixed window
+type lockoutState struct {
+	start       time.Time
+	failures    int
+	lockedUntil time.Time
+}
+
+// lockoutTable tracks failures and lockouts per principal
+type lockoutTable struct {
+	mu         sync.Mutex
+	policy     LockoutPolicy
+	principals map[string]*lockoutState
+}
+
+// SetLockout enables lockout with policy. A zero Threshold disables it and
+// lifts every current lockout.
+func (fd *ForgeDominion) SetLockout(policy LockoutPolicy) error {
+	if policy.Threshold < 0 || (policy.Threshold > 0 && (policy.Window <= 0 || policy.Duration <= 0)) {
+		return fmt.Errorf("lockout needs a positive threshold, window and duration")
+	}
+	t := &fd.lockout
+	t.mu.Lock()
+	t.policy = policy
+	t.principals = nil
+	t.mu.Unlock()
+	return nil
+}
+
+// Unlock lifts the lockout of a node and clears its failures
+func (fd *ForgeDominion) Unlock(tenantID string, nodeID string) {
+	t := &fd.lockout
+	t.mu.Lock()
+	delete(t.principals, nodePrincipal(tenantID, nodeID))
+	t.mu.Unlock()
+}
+
+type remoteAddrContextKey struct{}
+
+// ContextWithRemoteAddr records the address a token was presented from
+// (as in http.Request.RemoteAddr), so validation failures count against
+// the source as well as the node. Middleware and the gRPC interceptors do
+// this for their requests.
+func ContextWithRemoteAddr(ctx context.Context, remoteAddr string) context.Context {
+	return context.WithValue(ctx, remoteAddrContextKey{}, remoteAddr)
+}
+
+func nodePrincipal(tenantID, nodeID string) string {
+	return "node " + retirementKey(tenantID, nodeID)
+}
+
+// sourcePrincipal returns the principal for the address recorded in ctx,
+// or "" when there is none. Ports are dropped so reconnecting doesn't
+// reset the count.
+func sourcePrincipal(ctx context.Context) string {
+	remoteAddr, _ := ctx.Value(remoteAddrContextKey{}).(string)
+	if remoteAddr == "" {
+		return ""
+	}
+	addr, err := parseRemoteAddr(remoteAddr)
+	if err != nil {
+		return ""
+	}
+	return "source " + addr.String()
+}
+
+// checkLockout refuses tokens for, and requests from, locked principals
+func (fd *ForgeDominion) checkLockout(ctx context.Context, tenantID string, nodeID string) error {
+	t := &fd.lockout
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.policy.Threshold == 0 {
+		return nil
+	}
+
+	now := fd.now()
+	for _, p := range []string{nodePrincipal(tenantID, nodeID), sourcePrincipal(ctx)} {
+		if s, ok := t.principals[p]; ok && now.Before(s.lockedUntil) {
+			return fmt.Errorf("%w: %s until %s", ErrLockedOut, p, s.lockedUntil.Format(time.RFC3339))
+		}
+	}
+	return nil
+}
+
+// observeLockout counts a signature failure against the caller's source,
+// never against the node token names, which nothing has vouched for
+func (fd *ForgeDominion) observeLockout(ctx context.Context, token *ForgeToken, err error) {
+	if token == nil || !errors.Is(err, ErrBadSignature) {
+		return
+	}
+	fd.failLockout(ctx, token.TenantID, token.NodeID, "signature failures", sourcePrincipal(ctx))
+}
+
+// observeNodeLockout counts a failure against a node that proved who it is,
+// and against the caller's source
+func (fd *ForgeDominion) observeNodeLockout(ctx context.Context, tenantID string, nodeID string, what string) {
+	fd.failLockout(ctx, tenantID, nodeID, what, nodePrincipal(tenantID, nodeID), sourcePrincipal(ctx))
+}
+
+// failLockout records a failure for each principal, locking and alerting
+// on those that reach the threshold. The audit entries name tenantID and
+// nodeID as claimed; what describes the failures.
+func (fd *ForgeDominion) failLockout(ctx context.Context, tenantID string, nodeID string, what string, principals ...string) {
+	now := fd.now()
+	t := &fd.lockout
+	t.mu.Lock()
+	policy := t.policy
+	if policy.Threshold == 0 {
+		t.mu.Unlock()
+		return
+	}
+	var locked []string
+	for _, p := range principals {
+		if p != "" && t.fail(p, now) {
+			locked = append(locked, p)
+		}
+	}
+	t.mu.Unlock()
+
+	for _, p := range locked {
+		fd.record(AuditEntry{
+			Time:      now,
+			Event:     AuditLockout,
+			TenantID:  tenantID,
+			NodeID:    nodeID,
+			ExpiresAt: now.Add(policy.Duration),
+			Count:     policy.Threshold,
+			Detail:    fmt.Sprintf("%s locked after %d %s within %s", p, policy.Threshold, what, policy.Window),
+		})
+	}
+}
+
+// fail records a failure for principal and reports whether it just became
+// locked. t.mu must be held.
+func (t *lockoutTable) fail(principal string, now time.Time) bool {
+	s, ok := t.principals[principal]
+	if !ok {
+		if len(t.principals) >= maxLockoutPrincipals {
+			t.sweep(now)
+			if len(t.principals) >= maxLockoutPrincipals {
+				return false
+			}
+		}
+		if t.principals == nil {
+			t.principals = make(map[string]*lockoutState)
+		}
+		s = &lockoutState{}
+		t.principals[principal] = s
+	}
+	if now.Before(s.lockedUntil) {
+		return false
+	}
+	if s.failures == 0 || now.Sub(s.start) > t.policy.Window {
+		s.start, s.failures = now, 0
+	}
+	s.failures++
+	if s.failures < t.policy.Threshold {
+		return false
+	}
+	s.failures = 0
+	s.lockedUntil = now.Add(t.policy.Duration)
+	return true
+}
+
+// sweep drops principals that are neither locked nor within a window
+func (t *lockoutTable) sweep(now time.Time) {
+	for p, s := range t.principals {
+		if !now.Before(s.lockedUntil) && now.Sub(s.start) > t.policy.Window {
+			delete(t.principals, p)
+		}
+	}
+}
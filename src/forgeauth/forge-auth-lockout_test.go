@@ -0,0 +1,133 @@
+package forgeauth
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+var testLockout = LockoutPolicy{Threshold: 3, Window: time.Minute, Duration: time.Hour}
+
+// newLockoutDominion returns a test dominion with testLockout
+func newLockoutDominion(t *testing.T) *ForgeDominion {
+	t.Helper()
+	fd, _ := newTestDominion(t, AlgHS256)
+	if err := fd.SetLockout(testLockout); err != nil {
+		t.Fatal(err)
+	}
+	return fd
+}
+
+// forged returns a token naming nodeID whose signature doesn't verify
+func forged(t *testing.T, fd *ForgeDominion, nodeID string) *ForgeToken {
+	t.Helper()
+	token, err := fd.RequestToken("attacker", "runtime:read", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	token.NodeID = nodeID
+	return token
+}
+
+func TestLockoutForgedNodeFloodLocksOnlyTheSource(t *testing.T) {
+	fd := newLockoutDominion(t)
+	victim, err := fd.RequestToken("victim", "runtime:read", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	attacker := ContextWithRemoteAddr(context.Background(), "198.51.100.7:4000")
+	for i := range testLockout.Threshold + 2 {
+		if err := fd.ValidateTokenContext(attacker, forged(t, fd, "victim")); err == nil {
+			t.Fatalf("forgery %d validated", i)
+		}
+	}
+
+	// The flood's source is locked, whatever token it presents next
+	if err := fd.ValidateTokenContext(ContextWithRemoteAddr(context.Background(), "198.51.100.7:4001"), victim); !errors.Is(err, ErrLockedOut) {
+		t.Errorf("genuine token from the flooding source: got %v, want %v", err, ErrLockedOut)
+	}
+	// but the node it named isn't
+	if err := fd.ValidateTokenContext(ContextWithRemoteAddr(context.Background(), "192.0.2.1:5000"), victim); err != nil {
+		t.Errorf("victim's token from its own source: %v", err)
+	}
+	if err := fd.ValidateToken(victim); err != nil {
+		t.Errorf("victim's token without a source: %v", err)
+	}
+	if _, err := fd.RequestToken("victim", "runtime:read", time.Hour); err != nil {
+		t.Errorf("issuing to the victim: %v", err)
+	}
+}
+
+func TestLockoutForgedNodeFloodWithoutSource(t *testing.T) {
+	fd := newLockoutDominion(t)
+	victim, err := fd.RequestToken("victim", "runtime:read", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for range testLockout.Threshold * 3 {
+		fd.ValidateToken(forged(t, fd, "victim"))
+	}
+	if err := fd.ValidateToken(victim); err != nil {
+		t.Errorf("victim locked out by anonymous forgeries: %v", err)
+	}
+}
+
+func TestLockoutForgedRenewalsLockTheNode(t *testing.T) {
+	fd := newLockoutDominion(t)
+	ctx := context.Background()
+	token, err := fd.RequestToken("node-1", "runtime:read", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	refresh, err := fd.IssueRefreshCredential(ctx, token, 24*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bad := *token
+	bad.Scope = "runtime:*"
+	for i := range testLockout.Threshold {
+		if _, err := fd.RefreshToken(ctx, refresh, &bad, 0); err == nil {
+			t.Fatalf("forged renewal %d succeeded", i)
+		}
+	}
+
+	other := ContextWithRemoteAddr(ctx, "192.0.2.9:1")
+	if err := fd.ValidateTokenContext(other, token); !errors.Is(err, ErrLockedOut) {
+		t.Errorf("node's token after forged renewals: got %v, want %v", err, ErrLockedOut)
+	}
+	if _, err := fd.RequestToken("node-1", "runtime:read", time.Hour); !errors.Is(err, ErrLockedOut) {
+		t.Errorf("issuing to the node: got %v, want %v", err, ErrLockedOut)
+	}
+
+	fd.Unlock("", "node-1")
+	if err := fd.ValidateTokenContext(other, token); err != nil {
+		t.Errorf("after Unlock: %v", err)
+	}
+}
+
+func TestLockoutExpiredEnrollmentLocksTheNode(t *testing.T) {
+	fd, clock := newTestDominion(t, AlgHS256)
+	if err := fd.SetLockout(LockoutPolicy{Threshold: 1, Window: time.Minute, Duration: time.Hour}); err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	code, err := fd.NewEnrollmentCode(ctx, TokenSpec{NodeID: "node-1", Scope: "runtime:read", TTL: time.Hour}, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fd.RedeemEnrollmentCode(ctx, "not-a-code"); err == nil {
+		t.Fatal("bogus code redeemed")
+	}
+	if _, err := fd.RequestToken("node-1", "runtime:read", time.Hour); err != nil {
+		t.Fatalf("a bogus code locked the node: %v", err)
+	}
+
+	clock.Advance(2 * time.Minute)
+	if _, err := fd.RedeemEnrollmentCode(ctx, code.Code); err == nil {
+		t.Fatal("expired code redeemed")
+	}
+	if _, err := fd.RequestToken("node-1", "runtime:read", time.Hour); !errors.Is(err, ErrLockedOut) {
+		t.Errorf("issuing after the node's expired code: got %v, want %v", err, ErrLockedOut)
+	}
+}
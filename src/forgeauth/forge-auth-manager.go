@@ -0,0 +1,178 @@
+package forgeauth
+
+import (
+	"context"
+	"fmt"
+	"math/rand/v2"
+	"sync"
+	"time"
+)
+
+// RenewFunc exchanges a still-valid token for a fresh one
+type RenewFunc func(ctx context.Context, token *ForgeToken) (*ForgeToken, error)
+
+// Renewal schedule defaults
+const (
+	// renewAtFraction of a token's lifetime elapses before renewal starts
+	renewAtFraction = 2.0 / 3.0
+	// renewJitterFraction of the lifetime is randomly subtracted from the
+	// renewal time so a fleet doesn't renew in lockstep
+	renewJitterFraction = 0.1
+
+	renewInitialBackoff = time.Second
+	renewMaxBackoff     = time.Minute
+)
+
+// TokenManager holds a current token and renews it in the background before
+// it expires, retrying failures with jittered exponential backoff
+type TokenManager struct {
+	renew RenewFunc
+	clock Clock
+
+	mu      sync.RWMutex
+	token   *ForgeToken
+	lastErr error
+	updated chan struct{} // closed and replaced whenever token changes
+
+	stop     chan struct{}
+	done     chan struct{}
+	stopOnce sync.Once
+}
+
+// NewTokenManager starts managing token, renewing it through fd with the
+// given TTL for each new token. Renewals are scheduled by fd's clock.
+func NewTokenManager(fd *ForgeDominion, token *ForgeToken, ttl time.Duration) *TokenManager {
+	clock := fd.clock
+	if clock == nil {
+		clock = systemClock{}
+	}
+	return NewTokenManagerClock(token, func(ctx context.Context, t *ForgeToken) (*ForgeToken, error) {
+		return fd.RenewTokenContext(ctx, t, ttl)
+	}, clock)
+}
+
+// NewTokenManagerFunc starts managing token using a custom renewal function,
+// e.g. one that calls a remote dominion
+func NewTokenManagerFunc(token *ForgeToken, renew RenewFunc) *TokenManager {
+	return NewTokenManagerClock(token, renew, systemClock{})
+}
+
+// NewTokenManagerClock is like NewTokenManagerFunc but schedules renewals,
+// and decides when the held token has expired, by clock
+func NewTokenManagerClock(token *ForgeToken, renew RenewFunc, clock Clock) *TokenManager {
+	m := &TokenManager{
+		renew:   renew,
+		clock:   clock,
+		token:   token,
+		updated: make(chan struct{}),
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	go m.run()
+	return m
+}
+
+// Current returns the managed token. If the held token has expired it waits
+// for a successful renewal until ctx is done.
+func (m *TokenManager) Current(ctx context.Context) (*ForgeToken, error) {
+	for {
+		m.mu.RLock()
+		token, lastErr, updated := m.token, m.lastErr, m.updated
+		m.mu.RUnlock()
+
+		if m.clock.Now().Before(token.ExpiresAt) {
+			return token, nil
+		}
+
+		select {
+		case <-updated:
+		case <-m.done:
+			return nil, fmt.Errorf("token manager closed with expired token")
+		case <-ctx.Done():
+			if lastErr != nil {
+				return nil, fmt.Errorf("token expired and renewal failing: %w", lastErr)
+			}
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// LastError returns the most recent renewal error, nil after a success
+func (m *TokenManager) LastError() error {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.lastErr
+}
+
+// Close stops background renewal
+func (m *TokenManager) Close() {
+	m.stopOnce.Do(func() { close(m.stop) })
+	<-m.done
+}
+
+func (m *TokenManager) run() {
+	defer close(m.done)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-m.stop:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	backoff := renewInitialBackoff
+	for {
+		m.mu.RLock()
+		token := m.token
+		m.mu.RUnlock()
+
+		now := m.clock.Now()
+		wait := renewalTime(token, now).Sub(now)
+		if m.LastError() != nil {
+			wait = jitter(backoff)
+		}
+
+		select {
+		case <-m.stop:
+			return
+		case <-m.clock.After(wait):
+		}
+
+		renewed, err := m.renew(ctx, token)
+		if err == nil && renewed == nil {
+			err = fmt.Errorf("renewal returned no token")
+		}
+
+		m.mu.Lock()
+		if err != nil {
+			m.lastErr = err
+			backoff = min(backoff*2, renewMaxBackoff)
+		} else {
+			m.token = renewed
+			m.lastErr = nil
+			backoff = renewInitialBackoff
+			close(m.updated)
+			m.updated = make(chan struct{})
+		}
+		m.mu.Unlock()
+	}
+}
+
+// renewalTime picks when to renew token: two thirds into its lifetime,
+// brought forward by up to a tenth of the lifetime of random jitter
+func renewalTime(token *ForgeToken, now time.Time) time.Time {
+	lifetime := token.ExpiresAt.Sub(token.IssuedAt)
+	if lifetime <= 0 {
+		return now
+	}
+	at := token.IssuedAt.Add(time.Duration(float64(lifetime) * renewAtFraction))
+	return at.Add(-time.Duration(rand.Float64() * renewJitterFraction * float64(lifetime)))
+}
+
+// jitter returns a random duration in [d/2, d)
+func jitter(d time.Duration) time.Duration {
+	return d/2 + time.Duration(rand.Int64N(int64(d/2)+1))
+}
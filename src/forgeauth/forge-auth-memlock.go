@@ -0,0 +1,124 @@
+package forgeauth
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// errKeysClosed is returned for key lookups after the dominion is closed
+var errKeysClosed = errors.New("root keys have been zeroized")
+
+// lockedKey holds root key material in memory kept out of swap and core
+// dumps where the platform allows (see allocLocked). It never formats its
+// contents, so it can't leak through logging.
+type lockedKey struct {
+	b      []byte
+	unlock func()
+}
+
+func newLockedKey(src []byte) *lockedKey {
+	b, unlock := allocLocked(len(src))
+	copy(b, src)
+	return &lockedKey{b: b, unlock: unlock}
+}
+
+// destroy zeroes the key and unlocks its memory. Callers still holding
+// the key's bytes see zeros rather than faulting.
+func (k *lockedKey) destroy() {
+	clear(k.b)
+	k.unlock()
+}
+
+// Format implements fmt.Formatter
+func (k *lockedKey) Format(f fmt.State, verb rune) {
+	io.WriteString(f, "[redacted]")
+}
+
+// lockedEnvKeys loads EnvKeyProvider keys once into locked memory, so the
+// dominion holds a single protected copy of each root key rather than a
+// fresh heap copy per signature
+type lockedEnvKeys struct {
+	mu     sync.Mutex
+	keys   map[string]*lockedKey
+	closed bool
+}
+
+func newLockedEnvKeys() *lockedEnvKeys {
+	return &lockedEnvKeys{keys: make(map[string]*lockedKey)}
+}
+
+// RootKey implements KeyProvider
+func (p *lockedEnvKeys) RootKey(tenantID string) ([]byte, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		return nil, errKeysClosed
+	}
+	if k, ok := p.keys[tenantID]; ok {
+		return k.b, nil
+	}
+
+	key, err := EnvKeyProvider{}.RootKey(tenantID)
+	if err != nil {
+		return nil, err
+	}
+	k := newLockedKey(key)
+	clear(key)
+	p.keys[tenantID] = k
+	return k.b, nil
+}
+
+// Close zeroizes every loaded key
+func (p *lockedEnvKeys) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, k := range p.keys {
+		k.destroy()
+	}
+	p.keys = nil
+	p.closed = true
+	return nil
+}
+
+// Format implements fmt.Formatter
+func (p *lockedEnvKeys) Format(f fmt.State, verb rune) {
+	io.WriteString(f, "lockedEnvKeys{[redacted]}")
+}
+
+// closedKeys replaces a dominion's key provider once it is closed
+type closedKeys struct{}
+
+func (closedKeys) RootKey(string) ([]byte, error) {
+	return nil, errKeysClosed
+}
+
+// Close zeroizes the root key material held by the dominion and, if it
+// implements io.Closer, its key provider; StaticKeyProvider and the
+// environment keys loaded by NewForgeDominion both do. Every later
+// signature or validation fails, so Close is for process shutdown. Queued
+// webhook events are flushed first.
+func (fd *ForgeDominion) Close() error {
+	fd.closeWebhooks()
+
+	fd.keyMu.Lock()
+	providers := []KeyProvider{fd.keys, fd.previousKeys}
+	fd.keys = closedKeys{}
+	fd.previousKeys = nil
+	fd.keyMu.Unlock()
+
+	var errs []error
+	for _, p := range providers {
+		if c, ok := p.(io.Closer); ok {
+			errs = append(errs, c.Close())
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Format implements fmt.Formatter so logging a dominion never prints its
+// key material
+func (fd *ForgeDominion) Format(f fmt.State, verb rune) {
+	io.WriteString(f, "ForgeDominion{[redacted]}")
+}
@@ -0,0 +1,12 @@
+package forgeauth
+
+import "syscall"
+
+// madvDontDump is MADV_DONTDUMP, which the syscall package doesn't define
+const madvDontDump = 0x10
+
+func init() {
+	excludeFromCoreDump = func(mem []byte) {
+		syscall.Madvise(mem, madvDontDump)
+	}
+}
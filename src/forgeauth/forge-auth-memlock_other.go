@@ -0,0 +1,8 @@
+//go:build !linux && !darwin && !windows
+
+package forgeauth
+
+// allocLocked returns plain heap memory; this platform can't lock pages
+func allocLocked(n int) ([]byte, func()) {
+	return make([]byte, n), func() {}
+}
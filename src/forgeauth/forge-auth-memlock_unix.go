@@ -0,0 +1,31 @@
+//go:build linux || darwin
+
+package forgeauth
+
+import (
+	"os"
+	"syscall"
+)
+
+// excludeFromCoreDump is set on platforms that can drop pages from dumps
+var excludeFromCoreDump = func(mem []byte) {}
+
+// allocLocked returns n bytes mapped outside the Go heap and locked out of
+// swap. It falls back to unlocked or heap memory when the process is over
+// its memlock limit, so protection is best effort.
+func allocLocked(n int) ([]byte, func()) {
+	page := os.Getpagesize()
+	size := (n + page - 1) / page * page
+	if size == 0 {
+		size = page
+	}
+	mem, err := syscall.Mmap(-1, 0, size, syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_ANON|syscall.MAP_PRIVATE)
+	if err != nil {
+		return make([]byte, n), func() {}
+	}
+	excludeFromCoreDump(mem)
+	if syscall.Mlock(mem) != nil {
+		return mem[:n:n], func() {}
+	}
+	return mem[:n:n], func() { syscall.Munlock(mem) }
+}
@@ -0,0 +1,20 @@
+package forgeauth
+
+import (
+	"syscall"
+	"unsafe"
+)
+
+// allocLocked returns n bytes locked into the working set so they aren't
+// written to the page file. Locking is best effort.
+func allocLocked(n int) ([]byte, func()) {
+	b := make([]byte, n)
+	if n == 0 {
+		return b, func() {}
+	}
+	addr := uintptr(unsafe.Pointer(&b[0]))
+	if syscall.VirtualLock(addr, uintptr(n)) != nil {
+		return b, func() {}
+	}
+	return b, func() { syscall.VirtualUnlock(addr, uintptr(n)) }
+}
@@ -0,0 +1,128 @@
+package forgeauth
+
+import (
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// metricsNamespace prefixes every metric exported by the dominion
+const metricsNamespace = "forge_dominion"
+
+// forgeMetrics instruments issuance and validation. It is always collected;
+// exporting it is opt-in through Collector.
+type forgeMetrics struct {
+	issued      prometheus.Counter
+	issueTime   prometheus.Histogram
+	validated   prometheus.Counter
+	failed      *prometheus.CounterVec
+	previousKey prometheus.Counter
+	activeDesc  *prometheus.Desc
+
+	mu     sync.Mutex
+	active map[string]time.Time // token ID -> expiry
+}
+
+func newForgeMetrics() *forgeMetrics {
+	return &forgeMetrics{
+		issued: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "tokens_issued_total",
+			Help:      "Tokens issued, including renewals and exchanges.",
+		}),
+		issueTime: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "token_issue_duration_seconds",
+			Help:      "Time to build and sign a token.",
+			Buckets:   prometheus.ExponentialBuckets(0.00001, 4, 10),
+		}),
+		validated: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "tokens_validated_total",
+			Help:      "Tokens that passed validation.",
+		}),
+		failed: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "token_validation_failures_total",
+			Help:      "Tokens that failed validation, by failure class.",
+		}, []string{"reason"}),
+		previousKey: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "previous_key_validations_total",
+			Help:      "Tokens accepted with the pre-rotation keys during a rotation grace period.",
+		}),
+		activeDesc: prometheus.NewDesc(
+			prometheus.BuildFQName(metricsNamespace, "", "active_tokens"),
+			"Tokens issued by this dominion that have not expired or been revoked.",
+			nil, nil,
+		),
+		active: make(map[string]time.Time),
+	}
+}
+
+// Collector returns the dominion's metrics for registration with a
+// prometheus.Registerer
+func (fd *ForgeDominion) Collector() prometheus.Collector {
+	return fd.metrics
+}
+
+func (m *forgeMetrics) observeIssue(token *ForgeToken, elapsed time.Duration) {
+	m.issued.Inc()
+	m.issueTime.Observe(elapsed.Seconds())
+
+	m.mu.Lock()
+	m.active[token.ID] = token.ExpiresAt
+	m.mu.Unlock()
+}
+
+func (m *forgeMetrics) observeValidation(err error) {
+	if err != nil {
+		m.failed.WithLabelValues(FailureReason(err)).Inc()
+		return
+	}
+	m.validated.Inc()
+}
+
+func (m *forgeMetrics) observePreviousKey() {
+	m.previousKey.Inc()
+}
+
+func (m *forgeMetrics) observeRevoke(id string) {
+	m.mu.Lock()
+	delete(m.active, id)
+	m.mu.Unlock()
+}
+
+// activeTokens prunes expired entries and returns the remaining count
+func (m *forgeMetrics) activeTokens() int {
+	now := time.Now()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for id, expiresAt := range m.active {
+		if !expiresAt.After(now) {
+			delete(m.active, id)
+		}
+	}
+	return len(m.active)
+}
+
+// Describe implements prometheus.Collector
+func (m *forgeMetrics) Describe(ch chan<- *prometheus.Desc) {
+	m.issued.Describe(ch)
+	m.issueTime.Describe(ch)
+	m.validated.Describe(ch)
+	m.failed.Describe(ch)
+	m.previousKey.Describe(ch)
+	ch <- m.activeDesc
+}
+
+// Collect implements prometheus.Collector
+func (m *forgeMetrics) Collect(ch chan<- prometheus.Metric) {
+	m.issued.Collect(ch)
+	m.issueTime.Collect(ch)
+	m.validated.Collect(ch)
+	m.failed.Collect(ch)
+	m.previousKey.Collect(ch)
+	ch <- prometheus.MustNewConstMetric(m.activeDesc, prometheus.GaugeValue, float64(m.activeTokens()))
+}
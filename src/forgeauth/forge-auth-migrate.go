@@ -0,0 +1,55 @@
+package forgeauth
+
+import (
+	"context"
+	"fmt"
+)
+
+// MigrateOptions controls MigrateStoredToken
+type MigrateOptions struct {
+	// AllowExpired migrates tokens whose signature is valid but which have
+	// expired or been revoked, e.g. to archive them
+	AllowExpired bool
+}
+
+// MigrateStoredToken reads the token stored at from (any storage URI
+// accepted by LoadTokenFrom, in any supported document schema), verifies
+// it, upgrades it to the current schema and writes it to to. The copy is
+// read back and compared before MigrateStoredToken returns; the source is
+// left in place.
+func (fd *ForgeDominion) MigrateStoredToken(from string, to string, opts MigrateOptions) (*ForgeToken, error) {
+	token, err := LoadTokenFrom(from)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load %s: %w", from, err)
+	}
+
+	if opts.AllowExpired {
+		err = fd.VerifySignature(context.Background(), token)
+	} else {
+		err = fd.ValidateToken(token)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("token at %s failed verification: %w", from, err)
+	}
+
+	migrated, err := MigrateToken(token, currentTokenSchema)
+	if err != nil {
+		return nil, err
+	}
+	if err := fd.VerifySignature(context.Background(), migrated); err != nil {
+		return nil, fmt.Errorf("migrated token failed verification: %w", err)
+	}
+
+	if err := SaveTokenTo(migrated, to); err != nil {
+		return nil, fmt.Errorf("failed to save %s: %w", to, err)
+	}
+
+	written, err := LoadTokenFrom(to)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read back %s: %w", to, err)
+	}
+	if written.Signature != migrated.Signature || written.ID != migrated.ID {
+		return nil, fmt.Errorf("token read back from %s does not match", to)
+	}
+	return migrated, nil
+}
@@ -0,0 +1,79 @@
+package forgeauth
+
+import (
+	"context"
+	"fmt"
+	"net/netip"
+	"time"
+)
+
+// normalizeNetworks parses network claims into canonical prefix form. A
+// bare address binds the token to that single host.
+func normalizeNetworks(networks []string) ([]string, error) {
+	if len(networks) == 0 {
+		return nil, nil
+	}
+	out := make([]string, 0, len(networks))
+	for _, n := range networks {
+		prefix, err := netip.ParsePrefix(n)
+		if err != nil {
+			addr, addrErr := netip.ParseAddr(n)
+			if addrErr != nil {
+				return nil, fmt.Errorf("invalid network %q: %w", n, err)
+			}
+			prefix = netip.PrefixFrom(addr, addr.BitLen())
+		}
+		out = append(out, prefix.Masked().String())
+	}
+	return out, nil
+}
+
+// RequestNetworkToken issues a token that only validates through
+// ValidateTokenFrom (and Middleware) when presented from one of networks
+func (fd *ForgeDominion) RequestNetworkToken(nodeID string, scope string, ttl time.Duration, networks []string) (*ForgeToken, error) {
+	if len(networks) == 0 {
+		return nil, fmt.Errorf("at least one network is required")
+	}
+	return fd.requestToken(context.Background(), TokenSpec{NodeID: nodeID, Scope: scope, TTL: ttl, Networks: networks}, "")
+}
+
+// ValidateTokenFrom validates a token presented by remoteAddr ("host:port"
+// or a bare address, such as http.Request.RemoteAddr). Tokens carrying
+// network claims are rejected unless remoteAddr lies within one of them;
+// tokens without network claims validate from anywhere.
+func (fd *ForgeDominion) ValidateTokenFrom(token *ForgeToken, remoteAddr string) error {
+	if err := fd.ValidateToken(token); err != nil {
+		return err
+	}
+	return checkNetwork(token, remoteAddr)
+}
+
+// checkNetwork enforces a token's network claims for remoteAddr
+func checkNetwork(token *ForgeToken, remoteAddr string) error {
+	if len(token.Networks) == 0 {
+		return nil
+	}
+
+	addr, err := parseRemoteAddr(remoteAddr)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrNetworkMismatch, err)
+	}
+	for _, n := range token.Networks {
+		prefix, err := netip.ParsePrefix(n)
+		if err == nil && prefix.Contains(addr) {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: %s is outside %v", ErrNetworkMismatch, addr, token.Networks)
+}
+
+func parseRemoteAddr(remoteAddr string) (netip.Addr, error) {
+	if ap, err := netip.ParseAddrPort(remoteAddr); err == nil {
+		return ap.Addr().Unmap(), nil
+	}
+	addr, err := netip.ParseAddr(remoteAddr)
+	if err != nil {
+		return netip.Addr{}, fmt.Errorf("cannot determine client address from %q", remoteAddr)
+	}
+	return addr.Unmap(), nil
+}
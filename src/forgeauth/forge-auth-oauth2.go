@@ -0,0 +1,46 @@
+package forgeauth
+
+import (
+	"context"
+
+	"golang.org/x/oauth2"
+)
+
+// forgeTokenSource adapts a ForgeToken source to oauth2.TokenSource
+type forgeTokenSource struct {
+	ctx    context.Context
+	source func(ctx context.Context) (*ForgeToken, error)
+}
+
+// NewOAuth2TokenSource exposes the manager's current token as an
+// oauth2.TokenSource, so oauth2.NewClient and SDKs that accept a
+// TokenSource send "Authorization: Forge <token>" on every request
+func NewOAuth2TokenSource(ctx context.Context, m *TokenManager) oauth2.TokenSource {
+	return NewOAuth2TokenSourceFunc(ctx, m.Current)
+}
+
+// NewOAuth2TokenSourceFunc is like NewOAuth2TokenSource for any function
+// returning the current ForgeToken. ctx bounds each token fetch.
+func NewOAuth2TokenSourceFunc(ctx context.Context, source func(ctx context.Context) (*ForgeToken, error)) oauth2.TokenSource {
+	return &forgeTokenSource{ctx: ctx, source: source}
+}
+
+// Token returns the current ForgeToken in oauth2 form
+func (s *forgeTokenSource) Token() (*oauth2.Token, error) {
+	token, err := s.source(s.ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	encoded, err := EncodeToken(token)
+	if err != nil {
+		return nil, err
+	}
+
+	// Renewal is handled by the source, so no refresh token is exposed
+	return &oauth2.Token{
+		AccessToken: encoded,
+		TokenType:   authScheme,
+		Expiry:      token.ExpiresAt,
+	}, nil
+}
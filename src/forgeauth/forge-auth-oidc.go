@@ -0,0 +1,454 @@
+package forgeauth
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/sync/singleflight"
+)
+
+// JWKS caching limits
+const (
+	jwksCacheTTL       = time.Hour
+	jwksMinRefresh     = time.Minute
+	defaultOIDCSkew    = time.Minute
+	maxOIDCResponseLen = 1 << 20
+)
+
+// FederationConfig describes an external OIDC issuer whose ID tokens are
+// accepted in place of ForgeTokens
+type FederationConfig struct {
+	// Issuer is the exact "iss" value and the base for discovery
+	Issuer string
+
+	// Audience is the client ID tokens must be issued to
+	Audience string
+
+	// NodeClaim names the claim mapped to NodeID; defaults to "sub"
+	NodeClaim string
+
+	// ScopeClaim names the claim holding scopes or groups; defaults to
+	// "scope". Space-separated strings and string arrays are accepted.
+	ScopeClaim string
+
+	// ScopeMap translates IdP scopes or groups to forge scopes. When set,
+	// values without an entry are dropped; otherwise IdP values containing
+	// wildcard or denial syntax are.
+	ScopeMap map[string]string
+
+	// TenantID is stamped on every federated token
+	TenantID string
+
+	// HTTPClient is used for discovery and JWKS fetches
+	HTTPClient *http.Client
+
+	// ClockSkew tolerated on exp/nbf/iat; defaults to one minute
+	ClockSkew time.Duration
+}
+
+// oidcFederation verifies ID tokens from one issuer, caching its JWKS
+type oidcFederation struct {
+	cfg FederationConfig
+	now func() time.Time
+
+	mu          sync.Mutex
+	keys        map[string]crypto.PublicKey
+	fetchedAt   time.Time // of the cached keys
+	attemptedAt time.Time // of the last fetch, failed or not
+
+	fetches singleflight.Group
+}
+
+// EnableFederation makes ValidateBearer and Middleware accept OIDC ID
+// tokens from the configured issuer
+func (fd *ForgeDominion) EnableFederation(cfg FederationConfig) error {
+	if cfg.Issuer == "" || cfg.Audience == "" {
+		return fmt.Errorf("federation requires an issuer and audience")
+	}
+	if cfg.NodeClaim == "" {
+		cfg.NodeClaim = "sub"
+	}
+	if cfg.ScopeClaim == "" {
+		cfg.ScopeClaim = "scope"
+	}
+	if cfg.HTTPClient == nil {
+		cfg.HTTPClient = &http.Client{Timeout: 10 * time.Second}
+	}
+	if cfg.ClockSkew == 0 {
+		cfg.ClockSkew = defaultOIDCSkew
+	}
+	fd.federation = &oidcFederation{cfg: cfg, now: fd.now}
+	return nil
+}
+
+// ValidateBearer validates a raw bearer credential: either an encoded
+// ForgeToken or, with federation enabled, an OIDC ID token. Federated
+// tokens are mapped into ForgeToken form but carry no forge signature, so
+// they can't be passed off as dominion-issued tokens elsewhere. The same
+// holds for tokens issued by a dominion trusted with TrustDominion.
+func (fd *ForgeDominion) ValidateBearer(ctx context.Context, raw string) (*ForgeToken, error) {
+	if fd.federation != nil && strings.Count(raw, ".") == 2 {
+		token, err := fd.federation.validate(ctx, raw, fd.fips)
+		fd.observeValidation(ctx, token, err)
+		return token, err
+	}
+
+	token, err := DecodeToken(raw)
+	if err != nil {
+		fd.observeValidation(ctx, nil, err)
+		return nil, err
+	}
+	err = fd.validateToken(ctx, token)
+	if errors.Is(err, ErrBadSignature) {
+		var peerToken *ForgeToken
+		if peerToken, err = fd.validatePeer(token, err); err == nil {
+			token = peerToken
+		}
+	}
+	fd.observeValidation(ctx, token, err)
+	if err != nil {
+		return nil, err
+	}
+	return token, nil
+}
+
+type jwtHeader struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+}
+
+func (f *oidcFederation) validate(ctx context.Context, raw string, fips bool) (*ForgeToken, error) {
+	parts := strings.Split(raw, ".")
+	headerJSON, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, fmt.Errorf("%w: invalid ID token header encoding: %v", ErrMalformed, err)
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, fmt.Errorf("%w: invalid ID token payload encoding: %v", ErrMalformed, err)
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("%w: invalid ID token signature encoding: %v", ErrMalformed, err)
+	}
+
+	var header jwtHeader
+	if err := json.Unmarshal(headerJSON, &header); err != nil {
+		return nil, fmt.Errorf("%w: invalid ID token header: %v", ErrMalformed, err)
+	}
+
+	key, err := f.key(ctx, header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if err := verifyJWTSignature(header.Alg, key, digest[:], sig, fips); err != nil {
+		return nil, err
+	}
+
+	var claims map[string]any
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return nil, fmt.Errorf("%w: invalid ID token claims: %v", ErrMalformed, err)
+	}
+	return f.mapClaims(claims)
+}
+
+// verifyJWTSignature checks an RS256 or ES256 signature over digest. In
+// FIPS mode RSA keys must be at least fipsMinRSABits.
+func verifyJWTSignature(alg string, key crypto.PublicKey, digest, sig []byte, fips bool) error {
+	switch alg {
+	case "RS256":
+		pub, ok := key.(*rsa.PublicKey)
+		if !ok {
+			return fmt.Errorf("%w: ID token alg RS256 does not match key type", ErrBadSignature)
+		}
+		if fips && pub.N.BitLen() < fipsMinRSABits {
+			return fmt.Errorf("%w: %d-bit RSA key is %v", ErrBadSignature, pub.N.BitLen(), ErrNotFIPSApproved)
+		}
+		if err := rsa.VerifyPKCS1v15(pub, crypto.SHA256, digest, sig); err != nil {
+			return ErrBadSignature
+		}
+		return nil
+	case "ES256":
+		pub, ok := key.(*ecdsa.PublicKey)
+		if !ok || len(sig) != 64 {
+			return fmt.Errorf("%w: ID token alg ES256 does not match key", ErrBadSignature)
+		}
+		r, s := new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:])
+		if !ecdsa.Verify(pub, digest, r, s) {
+			return ErrBadSignature
+		}
+		return nil
+	}
+	return fmt.Errorf("%w: unsupported ID token alg %q", ErrBadSignature, alg)
+}
+
+// mapClaims checks the standard claims and converts them to ForgeToken form
+func (f *oidcFederation) mapClaims(claims map[string]any) (*ForgeToken, error) {
+	now := f.now()
+	skew := f.cfg.ClockSkew
+
+	if iss, _ := claims["iss"].(string); iss != f.cfg.Issuer {
+		return nil, fmt.Errorf("%w: ID token issuer %q is not trusted", ErrBadSignature, iss)
+	}
+	if !audienceContains(claims["aud"], f.cfg.Audience) {
+		return nil, fmt.Errorf("%w: ID token not issued to %q", ErrAudienceMismatch, f.cfg.Audience)
+	}
+
+	exp, ok := numericClaim(claims, "exp")
+	if !ok {
+		return nil, fmt.Errorf("%w: ID token has no exp claim", ErrMalformed)
+	}
+	if now.After(exp.Add(skew)) {
+		return nil, fmt.Errorf("%w at %s", ErrExpired, exp)
+	}
+	if nbf, ok := numericClaim(claims, "nbf"); ok && now.Add(skew).Before(nbf) {
+		return nil, fmt.Errorf("%w: ID token not valid before %s", ErrClockSkew, nbf)
+	}
+	iat, ok := numericClaim(claims, "iat")
+	if !ok {
+		iat = now
+	} else if iat.After(now.Add(skew)) {
+		return nil, fmt.Errorf("%w: ID token issued at %s", ErrClockSkew, iat)
+	}
+
+	nodeID, _ := claims[f.cfg.NodeClaim].(string)
+	if nodeID == "" {
+		return nil, fmt.Errorf("%w: ID token has no %q claim", ErrMalformed, f.cfg.NodeClaim)
+	}
+
+	var scopes []string
+	switch v := claims[f.cfg.ScopeClaim].(type) {
+	case string:
+		scopes = strings.Fields(v)
+	case []any:
+		for _, s := range v {
+			if str, ok := s.(string); ok {
+				scopes = append(scopes, str)
+			}
+		}
+	}
+	if f.cfg.ScopeMap != nil {
+		mapped := scopes[:0]
+		for _, s := range scopes {
+			if m, ok := f.cfg.ScopeMap[s]; ok {
+				mapped = append(mapped, m)
+			}
+		}
+		scopes = mapped
+	} else {
+		// Scope syntax from the IdP must not widen into wildcards or
+		// denials; only a configured ScopeMap may produce those
+		literal := scopes[:0]
+		for _, s := range scopes {
+			if isLiteralScope(s) {
+				literal = append(literal, s)
+			}
+		}
+		scopes = literal
+	}
+
+	return &ForgeToken{
+		NodeID:    nodeID,
+		IssuedAt:  iat,
+		ExpiresAt: exp,
+		Scope:     strings.Join(scopes, ","),
+		TenantID:  f.cfg.TenantID,
+		Audience:  f.cfg.Audience,
+	}, nil
+}
+
+func audienceContains(aud any, want string) bool {
+	switch v := aud.(type) {
+	case string:
+		return v == want
+	case []any:
+		for _, a := range v {
+			if a == want {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func numericClaim(claims map[string]any, name string) (time.Time, bool) {
+	v, ok := claims[name].(float64)
+	if !ok {
+		return time.Time{}, false
+	}
+	return time.Unix(int64(v), 0), true
+}
+
+// key returns the issuer's verification key for kid, refreshing the JWKS
+// when the cache is stale or the kid is unknown. Fetches run outside f.mu,
+// so validations with cached keys never wait on the IdP.
+func (f *oidcFederation) key(ctx context.Context, kid string) (crypto.PublicKey, error) {
+	f.mu.Lock()
+	key, known := f.keys[kid]
+	fresh := f.now().Sub(f.fetchedAt) < jwksCacheTTL
+	f.mu.Unlock()
+	if known && fresh {
+		return key, nil
+	}
+
+	// Misses share the fetch in flight, if any
+	_, err, _ := f.fetches.Do("jwks", func() (any, error) { return nil, f.refresh(ctx) })
+	if err != nil {
+		if known {
+			return key, nil // serve stale keys while the IdP is unreachable
+		}
+		return nil, err
+	}
+
+	f.mu.Lock()
+	key, ok := f.keys[kid]
+	f.mu.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("%w: unknown ID token signing key %q", ErrBadSignature, kid)
+	}
+	return key, nil
+}
+
+// refresh fetches the JWKS unless another fetch was attempted within
+// jwksMinRefresh. Failed attempts count too, so unknown kids can't be used
+// to hammer the IdP, least of all while it is down.
+func (f *oidcFederation) refresh(ctx context.Context) error {
+	f.mu.Lock()
+	if f.now().Sub(f.attemptedAt) < jwksMinRefresh {
+		f.mu.Unlock()
+		return nil
+	}
+	f.attemptedAt = f.now()
+	f.mu.Unlock()
+
+	keys, err := f.fetchJWKS(ctx)
+	if err != nil {
+		return err
+	}
+	f.mu.Lock()
+	f.keys, f.fetchedAt = keys, f.now()
+	f.mu.Unlock()
+	return nil
+}
+
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+func (f *oidcFederation) fetchJWKS(ctx context.Context) (map[string]crypto.PublicKey, error) {
+	var discovery struct {
+		Issuer  string `json:"issuer"`
+		JWKSURI string `json:"jwks_uri"`
+	}
+	wellKnown := strings.TrimSuffix(f.cfg.Issuer, "/") + "/.well-known/openid-configuration"
+	if err := f.getJSON(ctx, wellKnown, &discovery); err != nil {
+		return nil, fmt.Errorf("OIDC discovery failed: %w", err)
+	}
+	if discovery.Issuer != f.cfg.Issuer || discovery.JWKSURI == "" {
+		return nil, fmt.Errorf("OIDC discovery document does not match issuer %q", f.cfg.Issuer)
+	}
+
+	var set struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err := f.getJSON(ctx, discovery.JWKSURI, &set); err != nil {
+		return nil, fmt.Errorf("JWKS fetch failed: %w", err)
+	}
+
+	keys := make(map[string]crypto.PublicKey, len(set.Keys))
+	for _, jwk := range set.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+		key, err := jwk.publicKey()
+		if err != nil {
+			continue // skip key types we don't verify with
+		}
+		keys[jwk.Kid] = key
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("JWKS contains no usable signing keys")
+	}
+	return keys, nil
+}
+
+func (k jsonWebKey) publicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+	case "EC":
+		if k.Crv != "P-256" {
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := base64.RawURLEncoding.DecodeString(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		x, y = leftPad(x, 32), leftPad(y, 32)
+		// Parsing the uncompressed point checks that it is on the curve
+		if _, err := ecdh.P256().NewPublicKey(append(append([]byte{4}, x...), y...)); err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}, nil
+	}
+	return nil, fmt.Errorf("unsupported key type %q", k.Kty)
+}
+
+func leftPad(b []byte, n int) []byte {
+	if len(b) >= n {
+		return b
+	}
+	return append(make([]byte, n-len(b)), b...)
+}
+
+func (f *oidcFederation) getJSON(ctx context.Context, url string, v any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := f.cfg.HTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: %s", url, resp.Status)
+	}
+	return json.NewDecoder(io.LimitReader(resp.Body, maxOIDCResponseLen)).Decode(v)
+}
@@ -0,0 +1,347 @@
+package forgeauth
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// testIdP is a fake OIDC issuer serving a JWKS of its current keys
+type testIdP struct {
+	srv     *httptest.Server
+	fetches atomic.Int32
+
+	mu   sync.Mutex
+	keys map[string]*ecdsa.PrivateKey // served, by kid
+	down bool
+	hold chan struct{} // when set, JWKS requests wait for it to close
+}
+
+func newTestIdP(t *testing.T, kids ...string) *testIdP {
+	t.Helper()
+	idp := &testIdP{keys: make(map[string]*ecdsa.PrivateKey)}
+	for _, kid := range kids {
+		idp.rotate(t, kid)
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{"issuer": idp.srv.URL, "jwks_uri": idp.srv.URL + "/jwks"})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		idp.fetches.Add(1)
+		idp.mu.Lock()
+		hold, down := idp.hold, idp.down
+		var keys []jsonWebKey
+		for kid, k := range idp.keys {
+			keys = append(keys, jsonWebKey{
+				Kty: "EC", Kid: kid, Use: "sig", Crv: "P-256",
+				X: base64.RawURLEncoding.EncodeToString(k.X.FillBytes(make([]byte, 32))),
+				Y: base64.RawURLEncoding.EncodeToString(k.Y.FillBytes(make([]byte, 32))),
+			})
+		}
+		idp.mu.Unlock()
+		if hold != nil {
+			<-hold
+		}
+		if down {
+			http.Error(w, "down", http.StatusServiceUnavailable)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]any{"keys": keys})
+	})
+	idp.srv = httptest.NewServer(mux)
+	t.Cleanup(idp.srv.Close)
+	return idp
+}
+
+// rotate adds a key under kid and returns it
+func (idp *testIdP) rotate(t *testing.T, kid string) *ecdsa.PrivateKey {
+	t.Helper()
+	k, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	idp.mu.Lock()
+	idp.keys[kid] = k
+	idp.mu.Unlock()
+	return k
+}
+
+// retire stops serving kid, returning its key for signing stale tokens
+func (idp *testIdP) retire(kid string) *ecdsa.PrivateKey {
+	idp.mu.Lock()
+	defer idp.mu.Unlock()
+	k := idp.keys[kid]
+	delete(idp.keys, kid)
+	return k
+}
+
+func (idp *testIdP) setDown(down bool) {
+	idp.mu.Lock()
+	idp.down = down
+	idp.mu.Unlock()
+}
+
+// sign returns an ES256 ID token with claims, signed by kid's key
+func (idp *testIdP) sign(t *testing.T, kid string, claims map[string]any) string {
+	t.Helper()
+	idp.mu.Lock()
+	k := idp.keys[kid]
+	idp.mu.Unlock()
+	return signIDToken(t, k, kid, claims)
+}
+
+func signIDToken(t *testing.T, k *ecdsa.PrivateKey, kid string, claims map[string]any) string {
+	t.Helper()
+	header, _ := json.Marshal(jwtHeader{Alg: "ES256", Kid: kid})
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(signed))
+	r, s, err := ecdsa.Sign(rand.Reader, k, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	sig := append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+// newFederatedDominion returns a test dominion federated with idp
+func newFederatedDominion(t *testing.T, idp *testIdP, scopes map[string]string) (*ForgeDominion, *FakeClock) {
+	t.Helper()
+	fd, clock := newTestDominion(t, AlgHS256)
+	if err := fd.EnableFederation(FederationConfig{Issuer: idp.srv.URL, Audience: "forge", ScopeMap: scopes}); err != nil {
+		t.Fatal(err)
+	}
+	return fd, clock
+}
+
+// idClaims returns valid claims for node issued at now
+func idClaims(idp *testIdP, now time.Time, node string) map[string]any {
+	return map[string]any{
+		"iss":   idp.srv.URL,
+		"aud":   "forge",
+		"sub":   node,
+		"iat":   now.Unix(),
+		"exp":   now.Add(time.Hour).Unix(),
+		"scope": "runtime:read",
+	}
+}
+
+func TestOIDCClaims(t *testing.T) {
+	idp := newTestIdP(t, "k1")
+	fd, clock := newFederatedDominion(t, idp, nil)
+	now := clock.Now()
+	ctx := context.Background()
+
+	tests := []struct {
+		name   string
+		change func(map[string]any)
+		want   error
+	}{
+		{"valid", func(map[string]any) {}, nil},
+		{"audience list", func(c map[string]any) { c["aud"] = []string{"other", "forge"} }, nil},
+		{"wrong audience", func(c map[string]any) { c["aud"] = "other" }, ErrAudienceMismatch},
+		{"no audience", func(c map[string]any) { delete(c, "aud") }, ErrAudienceMismatch},
+		{"wrong issuer", func(c map[string]any) { c["iss"] = "https://evil.example" }, ErrBadSignature},
+		{"expired", func(c map[string]any) { c["exp"] = now.Add(-2 * time.Minute).Unix() }, ErrExpired},
+		{"expired within skew", func(c map[string]any) { c["exp"] = now.Add(-30 * time.Second).Unix() }, nil},
+		{"no exp", func(c map[string]any) { delete(c, "exp") }, ErrMalformed},
+		{"not yet valid", func(c map[string]any) { c["nbf"] = now.Add(2 * time.Minute).Unix() }, ErrClockSkew},
+		{"nbf within skew", func(c map[string]any) { c["nbf"] = now.Add(30 * time.Second).Unix() }, nil},
+		{"issued in the future", func(c map[string]any) { c["iat"] = now.Add(2 * time.Minute).Unix() }, ErrClockSkew},
+		{"iat within skew", func(c map[string]any) { c["iat"] = now.Add(30 * time.Second).Unix() }, nil},
+		{"no subject", func(c map[string]any) { delete(c, "sub") }, ErrMalformed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			claims := idClaims(idp, now, "node-1")
+			tt.change(claims)
+			token, err := fd.ValidateBearer(ctx, idp.sign(t, "k1", claims))
+			if tt.want == nil {
+				if err != nil {
+					t.Fatal(err)
+				}
+				if token.NodeID != "node-1" || token.Audience != "forge" || token.Signature != "" {
+					t.Errorf("mapped token %+v", token)
+				}
+				return
+			}
+			if !errors.Is(err, tt.want) {
+				t.Errorf("got %v, want %v", err, tt.want)
+			}
+		})
+	}
+
+	forged, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fd.ValidateBearer(ctx, signIDToken(t, forged, "k1", idClaims(idp, now, "node-1"))); !errors.Is(err, ErrBadSignature) {
+		t.Errorf("token signed with another key under k1: got %v, want %v", err, ErrBadSignature)
+	}
+}
+
+func TestOIDCScopeMapping(t *testing.T) {
+	idp := newTestIdP(t, "k1")
+	ctx := context.Background()
+	tests := []struct {
+		name   string
+		scopes map[string]string
+		claim  any
+		want   string
+	}{
+		{"literal scopes pass", nil, "runtime:read bridge:write", "runtime:read,bridge:write"},
+		{"wildcards dropped", nil, "runtime:* runtime:read", "runtime:read"},
+		{"denials dropped", nil, []any{"!runtime:read", "bridge:read"}, "bridge:read"},
+		{"mapped", map[string]string{"ops": "runtime:*", "dev": "runtime:read"}, []any{"ops", "other"}, "runtime:*"},
+		{"mapped drops unmapped", map[string]string{"ops": "runtime:*"}, "runtime:read", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fd, clock := newFederatedDominion(t, idp, tt.scopes)
+			claims := idClaims(idp, clock.Now(), "node-1")
+			claims["scope"] = tt.claim
+			token, err := fd.ValidateBearer(ctx, idp.sign(t, "k1", claims))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if token.Scope != tt.want {
+				t.Errorf("scope %q, want %q", token.Scope, tt.want)
+			}
+		})
+	}
+}
+
+func TestOIDCKeyRotation(t *testing.T) {
+	idp := newTestIdP(t, "k1")
+	fd, clock := newFederatedDominion(t, idp, nil)
+	ctx := context.Background()
+	validate := func(kid string, k *ecdsa.PrivateKey) error {
+		_, err := fd.ValidateBearer(ctx, signIDToken(t, k, kid, idClaims(idp, clock.Now(), "node-1")))
+		return err
+	}
+
+	k1 := idp.keys["k1"]
+	if err := validate("k1", k1); err != nil {
+		t.Fatal(err)
+	}
+	k2 := idp.rotate(t, "k2")
+	idp.retire("k1")
+
+	// An unknown kid refetches at most once per jwksMinRefresh
+	if err := validate("k2", k2); !errors.Is(err, ErrBadSignature) {
+		t.Fatalf("new kid right after a fetch: got %v, want %v", err, ErrBadSignature)
+	}
+	if n := idp.fetches.Load(); n != 1 {
+		t.Errorf("%d JWKS fetches, want 1", n)
+	}
+	clock.Advance(jwksMinRefresh)
+	if err := validate("k2", k2); err != nil {
+		t.Fatalf("new kid after the refresh interval: %v", err)
+	}
+	// The refetched set replaced the cache, so the retired key is gone
+	if err := validate("k1", k1); !errors.Is(err, ErrBadSignature) {
+		t.Errorf("retired kid: got %v, want %v", err, ErrBadSignature)
+	}
+}
+
+func TestOIDCServesStaleKeysWhileTheIdPIsDown(t *testing.T) {
+	idp := newTestIdP(t, "k1")
+	fd, clock := newFederatedDominion(t, idp, nil)
+	ctx := context.Background()
+	k1 := idp.keys["k1"]
+	validate := func(kid string) error {
+		_, err := fd.ValidateBearer(ctx, signIDToken(t, k1, kid, idClaims(idp, clock.Now(), "node-1")))
+		return err
+	}
+	if err := validate("k1"); err != nil {
+		t.Fatal(err)
+	}
+
+	idp.setDown(true)
+	clock.Advance(jwksCacheTTL)
+	if err := validate("k1"); err != nil {
+		t.Fatalf("cached key past its TTL with the IdP down: %v", err)
+	}
+
+	// A failed fetch still counts towards the rate limit
+	before := idp.fetches.Load()
+	for range 10 {
+		if err := validate("unknown"); err == nil {
+			t.Fatal("unknown kid validated")
+		}
+	}
+	if n := idp.fetches.Load() - before; n != 0 {
+		t.Errorf("%d JWKS fetches within a minute of a failed one, want 0", n)
+	}
+	clock.Advance(jwksMinRefresh)
+	validate("unknown")
+	if n := idp.fetches.Load() - before; n != 1 {
+		t.Errorf("%d JWKS fetches after the refresh interval, want 1", n)
+	}
+}
+
+func TestOIDCFetchDoesNotBlockCachedKeys(t *testing.T) {
+	idp := newTestIdP(t, "k1")
+	fd, clock := newFederatedDominion(t, idp, nil)
+	ctx := context.Background()
+	if _, err := fd.ValidateBearer(ctx, idp.sign(t, "k1", idClaims(idp, clock.Now(), "node-1"))); err != nil {
+		t.Fatal(err)
+	}
+
+	hold := make(chan struct{})
+	idp.mu.Lock()
+	idp.hold = hold
+	idp.mu.Unlock()
+	k2 := idp.rotate(t, "k2")
+	clock.Advance(jwksMinRefresh)
+
+	const waiters = 4
+	var wg sync.WaitGroup
+	for range waiters {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := fd.ValidateBearer(ctx, signIDToken(t, k2, "k2", idClaims(idp, clock.Now(), "node-2"))); err != nil {
+				t.Errorf("new kid once the fetch finished: %v", err)
+			}
+		}()
+	}
+	for idp.fetches.Load() == 1 {
+		time.Sleep(time.Millisecond)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := fd.ValidateBearer(ctx, idp.sign(t, "k1", idClaims(idp, clock.Now(), "node-1")))
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("cached kid during a fetch: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("a JWKS fetch blocked validation with a cached key")
+	}
+
+	close(hold)
+	wg.Wait()
+	if n := idp.fetches.Load(); n != 2 {
+		t.Errorf("%d JWKS fetches, want 2: concurrent misses should share one", n)
+	}
+}
@@ -0,0 +1,103 @@
+package forgeauth
+
+import (
+	"fmt"
+	"time"
+)
+
+// Policy operations
+const (
+	PolicyIssue    = "issue"
+	PolicyRenew    = "renew"
+	PolicyExchange = "exchange"
+)
+
+// PolicyRequest describes an issuance the dominion is about to perform
+type PolicyRequest struct {
+	Operation string
+	TenantID  string
+	NodeID    string
+	Scope     string
+	Roles     []string
+	Audience  string
+	TTL       time.Duration
+	Time      time.Time
+
+	// Previous is the token being renewed or exchanged, nil for fresh
+	// issuance
+	Previous *ForgeToken
+}
+
+// Policy decides whether an issuance may proceed. Returning an error denies
+// it. Adapters for CEL programs or OPA/rego queries implement this by
+// evaluating the request fields as input.
+type Policy interface {
+	Evaluate(req PolicyRequest) error
+}
+
+// PolicyFunc adapts a plain function to Policy
+type PolicyFunc func(req PolicyRequest) error
+
+// Evaluate calls f(req)
+func (f PolicyFunc) Evaluate(req PolicyRequest) error {
+	return f(req)
+}
+
+// AllPolicies combines policies; the first denial wins
+func AllPolicies(policies ...Policy) Policy {
+	return PolicyFunc(func(req PolicyRequest) error {
+		for _, p := range policies {
+			if err := p.Evaluate(req); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// BusinessHoursPolicy denies tokens that could exercise any of the given
+// scopes outside [start, end) hours, Monday to Friday, in loc
+func BusinessHoursPolicy(scopes []string, start, end int, loc *time.Location) Policy {
+	return PolicyFunc(func(req PolicyRequest) error {
+		restricted := false
+		for _, s := range scopes {
+			if scopeIntersects(req.Scope, s) {
+				restricted = true
+				break
+			}
+		}
+		if !restricted {
+			return nil
+		}
+		t := req.Time.In(loc)
+		if t.Weekday() == time.Saturday || t.Weekday() == time.Sunday || t.Hour() < start || t.Hour() >= end {
+			return fmt.Errorf("%s tokens are only issued during business hours", req.Scope)
+		}
+		return nil
+	})
+}
+
+// SetPolicy installs the policy consulted before every issuance and renewal.
+// A nil policy allows everything.
+func (fd *ForgeDominion) SetPolicy(p Policy) {
+	fd.policy = p
+}
+
+// checkPolicy evaluates the configured policy and audits denials
+func (fd *ForgeDominion) checkPolicy(req PolicyRequest) error {
+	if fd.policy == nil {
+		return nil
+	}
+	if err := fd.policy.Evaluate(req); err != nil {
+		fd.record(AuditEntry{
+			Time:     req.Time,
+			Event:    AuditPolicyDenied,
+			TenantID: req.TenantID,
+			NodeID:   req.NodeID,
+			Scope:    req.Scope,
+			Detail:   err.Error(),
+		})
+		return fmt.Errorf("%w: %s of %s for %s: %w", ErrPolicyDenied, req.Operation, req.Scope, req.NodeID, err)
+	}
+	return nil
+}
@@ -0,0 +1,276 @@
+package forgeauth
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// Proof of possession, in the style of DPoP (RFC 9449): a client binds its
+// public key to a token at issuance, then signs a fresh proof for every
+// request. Middleware and the gRPC interceptors reject a key-bound token
+// presented without a matching proof, so a stolen token is useless without
+// the client's private key.
+
+// ProofHeader carries the encoded proof of an HTTP request
+const ProofHeader = "Forge-PoP"
+
+// proofMetadataKey carries the encoded proof of an RPC
+const proofMetadataKey = "forge-pop"
+
+// ProofMethodRPC is the method of proofs for gRPC calls, whose URI is the
+// full method name, e.g. "/forge.Runtime/Execute"
+const ProofMethodRPC = "RPC"
+
+// proofDomain prefixes the payload signed by a proof
+const proofDomain = "forge-dominion/pop-proof/v1\n"
+
+// maxProofAge bounds how far a proof's issue time may be from the
+// validator's clock in either direction
+const maxProofAge = time.Minute
+
+// Proof is a client's signed statement that it holds the key a token is
+// bound to, made for a single request
+type Proof struct {
+	Key       string    `json:"key"` // PKIX public key, base64url
+	Method    string    `json:"htm"`
+	URI       string    `json:"htu"` // request path, without the query
+	IssuedAt  time.Time `json:"iat"`
+	ID        string    `json:"jti"`
+	TokenID   string    `json:"ath"` // the token the proof is made for
+	Signature string    `json:"sig"`
+}
+
+// KeyThumbprint returns the key binding for pub, an ed25519.PublicKey or
+// *ecdsa.PublicKey: the base64url SHA-256 of its PKIX encoding
+func KeyThumbprint(pub crypto.PublicKey) (string, error) {
+	switch pub.(type) {
+	case ed25519.PublicKey, *ecdsa.PublicKey:
+	default:
+		return "", fmt.Errorf("unsupported proof key type %T", pub)
+	}
+	der, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		return "", fmt.Errorf("invalid proof key: %w", err)
+	}
+	sum := sha256.Sum256(der)
+	return base64.RawURLEncoding.EncodeToString(sum[:]), nil
+}
+
+// validateKeyBinding checks that a non-empty binding is a thumbprint
+func validateKeyBinding(binding string) error {
+	if binding == "" {
+		return nil
+	}
+	if b, err := base64.RawURLEncoding.DecodeString(binding); err != nil || len(b) != sha256.Size {
+		return fmt.Errorf("key binding must be a key thumbprint, see KeyThumbprint")
+	}
+	return nil
+}
+
+// NewProof signs a proof that the holder of key is making a method request
+// for uri with token
+func NewProof(key crypto.Signer, token *ForgeToken, method string, uri string) (*Proof, error) {
+	der, err := x509.MarshalPKIXPublicKey(key.Public())
+	if err != nil {
+		return nil, fmt.Errorf("invalid proof key: %w", err)
+	}
+	id, err := newTokenID()
+	if err != nil {
+		return nil, err
+	}
+	p := &Proof{
+		Key:      base64.RawURLEncoding.EncodeToString(der),
+		Method:   method,
+		URI:      uri,
+		IssuedAt: time.Now().UTC(),
+		ID:       id,
+		TokenID:  token.ID,
+	}
+	payload, err := p.signingPayload()
+	if err != nil {
+		return nil, err
+	}
+
+	var sig []byte
+	switch key.Public().(type) {
+	case ed25519.PublicKey:
+		sig, err = key.Sign(rand.Reader, payload, crypto.Hash(0))
+	case *ecdsa.PublicKey:
+		digest := sha256.Sum256(payload)
+		sig, err = key.Sign(rand.Reader, digest[:], crypto.SHA256)
+	default:
+		return nil, fmt.Errorf("unsupported proof key type %T", key.Public())
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to sign proof: %w", err)
+	}
+	p.Signature = base64.RawURLEncoding.EncodeToString(sig)
+	return p, nil
+}
+
+func (p *Proof) signingPayload() ([]byte, error) {
+	unsigned := *p
+	unsigned.Signature = ""
+	data, err := json.Marshal(unsigned)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode proof: %w", err)
+	}
+	return append([]byte(proofDomain), data...), nil
+}
+
+// EncodeProof encodes a proof for ProofHeader
+func EncodeProof(p *Proof) (string, error) {
+	data, err := json.Marshal(p)
+	if err != nil {
+		return "", fmt.Errorf("failed to encode proof: %w", err)
+	}
+	return base64.RawURLEncoding.EncodeToString(data), nil
+}
+
+// DecodeProof decodes a proof encoded with EncodeProof
+func DecodeProof(encoded string) (*Proof, error) {
+	data, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("%w: invalid proof encoding", ErrMalformed)
+	}
+	var p Proof
+	if err := json.Unmarshal(data, &p); err != nil {
+		return nil, fmt.Errorf("%w: invalid proof: %v", ErrMalformed, err)
+	}
+	return &p, nil
+}
+
+// SetRequestProof signs a proof for r with key and attaches it. Call it
+// after SetRequestToken, once per request; proofs can't be replayed.
+func SetRequestProof(r *http.Request, token *ForgeToken, key crypto.Signer) error {
+	p, err := NewProof(key, token, r.Method, r.URL.Path)
+	if err != nil {
+		return err
+	}
+	encoded, err := EncodeProof(p)
+	if err != nil {
+		return err
+	}
+	r.Header.Set(ProofHeader, encoded)
+	return nil
+}
+
+// ValidateProof checks that p proves possession of the key token is bound
+// to, for a method request for uri. The token itself must be validated
+// separately. Each proof is accepted once, tracked by the usage counter,
+// which should be shared across the fleet like it is for MaxUses.
+func (fd *ForgeDominion) ValidateProof(ctx context.Context, token *ForgeToken, p *Proof, method string, uri string) error {
+	return checkProof(ctx, fd.uses, fd.now(), token, p, method, uri)
+}
+
+// ValidateProof is like ForgeDominion.ValidateProof. Without a usage
+// counter, see SetUsageCounter, proofs are rejected.
+func (v *Validator) ValidateProof(token *ForgeToken, p *Proof, method string, uri string) error {
+	v.mu.RLock()
+	uses := v.uses
+	clock := v.clock
+	v.mu.RUnlock()
+	now := time.Now()
+	if clock != nil {
+		now = clock.Now()
+	}
+	return checkProof(context.Background(), uses, now, token, p, method, uri)
+}
+
+// validateRequestProof checks the proof of r if token is key-bound
+func (fd *ForgeDominion) validateRequestProof(r *http.Request, token *ForgeToken) error {
+	if token.KeyBinding == "" {
+		return nil
+	}
+	var p *Proof
+	if encoded := r.Header.Get(ProofHeader); encoded != "" {
+		var err error
+		if p, err = DecodeProof(encoded); err != nil {
+			return err
+		}
+	}
+	return fd.ValidateProof(r.Context(), token, p, r.Method, r.URL.Path)
+}
+
+func checkProof(ctx context.Context, uses UsageCounter, now time.Time, token *ForgeToken, p *Proof, method string, uri string) error {
+	if token == nil {
+		return fmt.Errorf("%w: token is nil", ErrMalformed)
+	}
+	if token.KeyBinding == "" {
+		return fmt.Errorf("%w: token is not bound to a key", ErrMalformed)
+	}
+	if p == nil {
+		return fmt.Errorf("%w: token is bound to a key and requires a proof of possession", ErrBadSignature)
+	}
+
+	der, err := base64.RawURLEncoding.DecodeString(p.Key)
+	if err != nil {
+		return fmt.Errorf("%w: invalid proof key", ErrMalformed)
+	}
+	sum := sha256.Sum256(der)
+	if subtle.ConstantTimeCompare([]byte(base64.RawURLEncoding.EncodeToString(sum[:])), []byte(token.KeyBinding)) != 1 {
+		return fmt.Errorf("%w: proof is signed with a key the token is not bound to", ErrBadSignature)
+	}
+	if p.TokenID != token.ID || p.Method != method || p.URI != uri {
+		return fmt.Errorf("%w: proof was made for another request", ErrBadSignature)
+	}
+	if p.IssuedAt.Before(now.Add(-maxProofAge)) {
+		return fmt.Errorf("%w: proof made at %s", ErrExpired, p.IssuedAt)
+	}
+	if p.IssuedAt.After(now.Add(maxProofAge)) {
+		return fmt.Errorf("%w: proof made at %s", ErrClockSkew, p.IssuedAt)
+	}
+
+	sig, err := base64.RawURLEncoding.DecodeString(p.Signature)
+	if err != nil {
+		return ErrBadSignature
+	}
+	payload, err := p.signingPayload()
+	if err != nil {
+		return err
+	}
+	pub, err := x509.ParsePKIXPublicKey(der)
+	if err != nil {
+		return fmt.Errorf("%w: invalid proof key", ErrMalformed)
+	}
+	switch pub := pub.(type) {
+	case ed25519.PublicKey:
+		if !ed25519.Verify(pub, payload, sig) {
+			return fmt.Errorf("%w: invalid proof signature", ErrBadSignature)
+		}
+	case *ecdsa.PublicKey:
+		digest := sha256.Sum256(payload)
+		if !ecdsa.VerifyASN1(pub, digest[:], sig) {
+			return fmt.Errorf("%w: invalid proof signature", ErrBadSignature)
+		}
+	default:
+		return fmt.Errorf("%w: unsupported proof key type %T", ErrBadSignature, pub)
+	}
+
+	// Only authentic proofs are counted, so forged ones can't burn IDs
+	if uses == nil {
+		return fmt.Errorf("%w: no usage counter to track proofs", ErrExhausted)
+	}
+	if p.ID == "" {
+		return fmt.Errorf("%w: proof has no ID", ErrMalformed)
+	}
+	n, err := uses.Use(ctx, "pop:"+token.KeyBinding+":"+p.ID, p.IssuedAt.Add(maxProofAge))
+	if err != nil {
+		return fmt.Errorf("failed to count proof use: %w", err)
+	}
+	if n > 1 {
+		return fmt.Errorf("%w: proof %s was already used", ErrBadSignature, p.ID)
+	}
+	return nil
+}
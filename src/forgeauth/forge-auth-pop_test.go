@@ -0,0 +1,188 @@
+package forgeauth
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"testing"
+	"time"
+)
+
+// newBoundToken issues a token bound to key, on a dominion whose clock
+// reads the wall clock's time, which NewProof stamps proofs with
+func newBoundToken(t *testing.T, key crypto.Signer) (*ForgeDominion, *FakeClock, *ForgeToken) {
+	t.Helper()
+	fd, clock := newTestDominion(t, AlgHS256)
+	clock.Set(time.Now())
+	binding, err := KeyThumbprint(key.Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := fd.requestToken(context.Background(), TokenSpec{NodeID: "node-1", Scope: "runtime:read", TTL: time.Hour, KeyBinding: binding}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fd, clock, token
+}
+
+func newProofKey(t *testing.T) ed25519.PrivateKey {
+	t.Helper()
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+// resign signs p again with key, after a test has changed its claims
+func resign(t *testing.T, key ed25519.PrivateKey, p *Proof) {
+	t.Helper()
+	payload, err := p.signingPayload()
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.Signature = base64.RawURLEncoding.EncodeToString(ed25519.Sign(key, payload))
+}
+
+func TestProofOfPossession(t *testing.T) {
+	key := newProofKey(t)
+	ctx := context.Background()
+	tests := []struct {
+		name string
+		make func(t *testing.T, token *ForgeToken) *Proof
+		want error
+	}{
+		{"valid", func(t *testing.T, token *ForgeToken) *Proof {
+			p, _ := NewProof(key, token, "POST", "/runtime/execute")
+			return p
+		}, nil},
+		{"no proof", func(*testing.T, *ForgeToken) *Proof { return nil }, ErrBadSignature},
+		{"wrong key", func(t *testing.T, token *ForgeToken) *Proof {
+			p, _ := NewProof(newProofKey(t), token, "POST", "/runtime/execute")
+			return p
+		}, ErrBadSignature},
+		{"bound key claimed, other key signed", func(t *testing.T, token *ForgeToken) *Proof {
+			p, _ := NewProof(key, token, "POST", "/runtime/execute")
+			resign(t, newProofKey(t), p)
+			return p
+		}, ErrBadSignature},
+		{"wrong method", func(t *testing.T, token *ForgeToken) *Proof {
+			p, _ := NewProof(key, token, "GET", "/runtime/execute")
+			return p
+		}, ErrBadSignature},
+		{"wrong uri", func(t *testing.T, token *ForgeToken) *Proof {
+			p, _ := NewProof(key, token, "POST", "/runtime/status")
+			return p
+		}, ErrBadSignature},
+		{"method changed after signing", func(t *testing.T, token *ForgeToken) *Proof {
+			p, _ := NewProof(key, token, "GET", "/runtime/execute")
+			p.Method = "POST"
+			return p
+		}, ErrBadSignature},
+		{"another token", func(t *testing.T, token *ForgeToken) *Proof {
+			other := *token
+			other.ID = "another"
+			p, _ := NewProof(key, &other, "POST", "/runtime/execute")
+			return p
+		}, ErrBadSignature},
+		{"stale iat", func(t *testing.T, token *ForgeToken) *Proof {
+			p, _ := NewProof(key, token, "POST", "/runtime/execute")
+			p.IssuedAt = p.IssuedAt.Add(-maxProofAge - time.Second)
+			resign(t, key, p)
+			return p
+		}, ErrExpired},
+		{"future iat", func(t *testing.T, token *ForgeToken) *Proof {
+			p, _ := NewProof(key, token, "POST", "/runtime/execute")
+			p.IssuedAt = p.IssuedAt.Add(maxProofAge + time.Second)
+			resign(t, key, p)
+			return p
+		}, ErrClockSkew},
+		{"no jti", func(t *testing.T, token *ForgeToken) *Proof {
+			p, _ := NewProof(key, token, "POST", "/runtime/execute")
+			p.ID = ""
+			resign(t, key, p)
+			return p
+		}, ErrMalformed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fd, _, token := newBoundToken(t, key)
+			err := fd.ValidateProof(ctx, token, tt.make(t, token), "POST", "/runtime/execute")
+			if tt.want == nil && err != nil || tt.want != nil && !errors.Is(err, tt.want) {
+				t.Errorf("got %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestProofReplay(t *testing.T) {
+	key := newProofKey(t)
+	fd, clock, token := newBoundToken(t, key)
+	ctx := context.Background()
+	p, err := NewProof(key, token, "POST", "/runtime/execute")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A forgery reusing the proof's jti doesn't spend it
+	forged := *p
+	resign(t, newProofKey(t), &forged)
+	if err := fd.ValidateProof(ctx, token, &forged, "POST", "/runtime/execute"); !errors.Is(err, ErrBadSignature) {
+		t.Fatalf("forged proof: got %v, want %v", err, ErrBadSignature)
+	}
+	if err := fd.ValidateProof(ctx, token, p, "POST", "/runtime/execute"); err != nil {
+		t.Fatalf("first use: %v", err)
+	}
+	clock.Advance(maxProofAge / 2)
+	if err := fd.ValidateProof(ctx, token, p, "POST", "/runtime/execute"); !errors.Is(err, ErrBadSignature) {
+		t.Errorf("replayed proof: got %v, want %v", err, ErrBadSignature)
+	}
+	// and once its count is forgotten, the proof is too old to pass
+	clock.Advance(maxProofAge)
+	if err := fd.ValidateProof(ctx, token, p, "POST", "/runtime/execute"); !errors.Is(err, ErrExpired) {
+		t.Errorf("replayed late: got %v, want %v", err, ErrExpired)
+	}
+}
+
+func TestProofECDSAKey(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fd, _, token := newBoundToken(t, key)
+	p, err := NewProof(key, token, ProofMethodRPC, "/forge.Runtime/Execute")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := fd.ValidateProof(context.Background(), token, p, ProofMethodRPC, "/forge.Runtime/Execute"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestProofEncoding(t *testing.T) {
+	key := newProofKey(t)
+	fd, _, token := newBoundToken(t, key)
+	p, err := NewProof(key, token, "POST", "/runtime/execute")
+	if err != nil {
+		t.Fatal(err)
+	}
+	encoded, err := EncodeProof(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := DecodeProof(encoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := fd.ValidateProof(context.Background(), token, decoded, "POST", "/runtime/execute"); err != nil {
+		t.Errorf("decoded proof: %v", err)
+	}
+	if _, err := DecodeProof("not base64!"); !errors.Is(err, ErrMalformed) {
+		t.Errorf("bad encoding: got %v, want %v", err, ErrMalformed)
+	}
+}
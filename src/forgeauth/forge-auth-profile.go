@@ -0,0 +1,205 @@
+package forgeauth
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+)
+
+// TokenProfile is a named set of issuance parameters, so services request
+// "ci-runner" rather than repeating its scope, TTL and audience
+type TokenProfile struct {
+	// NodeID is used by RequestTokenFromProfile; RequestProfileToken takes
+	// the node from the caller instead
+	NodeID string
+
+	TenantID    string
+	Scope       string
+	Audience    string
+	Networks    []string
+	TTL         time.Duration
+	MaxUses     int
+	IdleTimeout time.Duration
+	Claims      map[string]any
+	Roles       []string
+
+	Renewal ProfileRenewal
+}
+
+// ProfileRenewal controls RenewToken for tokens issued from a profile
+type ProfileRenewal struct {
+	// Disabled rejects every renewal
+	Disabled bool
+
+	// TTL, when set, replaces the TTL requested on renewal
+	TTL time.Duration
+
+	// Window, when set, only allows renewal within this long of expiry
+	Window time.Duration
+}
+
+// profileFile is the on-disk form read by LoadProfiles. Durations are Go
+// duration strings such as "15m".
+type profileFile struct {
+	Profiles map[string]struct {
+		Node        string         `json:"node"`
+		Tenant      string         `json:"tenant"`
+		Scope       string         `json:"scope"`
+		Audience    string         `json:"audience"`
+		Networks    []string       `json:"networks"`
+		TTL         string         `json:"ttl"`
+		MaxUses     int            `json:"max_uses"`
+		IdleTimeout string         `json:"idle_timeout"`
+		Claims      map[string]any `json:"claims"`
+		Roles       []string       `json:"roles"`
+		Renewal     struct {
+			Disabled bool   `json:"disabled"`
+			TTL      string `json:"ttl"`
+			Window   string `json:"window"`
+		} `json:"renewal"`
+	} `json:"profiles"`
+}
+
+// LoadProfiles reads token profiles from a JSON config file:
+//
+//	{"profiles": {"ci-runner": {"scope": "runtime:execute", "ttl": "15m",
+//	  "audience": "bridge", "renewal": {"disabled": true}}}}
+func LoadProfiles(path string) (map[string]TokenProfile, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read profiles: %w", err)
+	}
+	var file profileFile
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&file); err != nil {
+		return nil, fmt.Errorf("invalid profiles file %s: %w", path, err)
+	}
+
+	profiles := make(map[string]TokenProfile, len(file.Profiles))
+	for name, p := range file.Profiles {
+		var durations [4]time.Duration
+		for i, s := range []string{p.TTL, p.IdleTimeout, p.Renewal.TTL, p.Renewal.Window} {
+			if s == "" {
+				continue
+			}
+			if durations[i], err = time.ParseDuration(s); err != nil {
+				return nil, fmt.Errorf("profile %q: %w", name, err)
+			}
+		}
+		profiles[name] = TokenProfile{
+			NodeID:      p.Node,
+			TenantID:    p.Tenant,
+			Scope:       p.Scope,
+			Audience:    p.Audience,
+			Networks:    p.Networks,
+			TTL:         durations[0],
+			MaxUses:     p.MaxUses,
+			IdleTimeout: durations[1],
+			Claims:      p.Claims,
+			Roles:       p.Roles,
+			Renewal: ProfileRenewal{
+				Disabled: p.Renewal.Disabled,
+				TTL:      durations[2],
+				Window:   durations[3],
+			},
+		}
+	}
+	return profiles, nil
+}
+
+// SetProfiles replaces the dominion's token profiles. Profiles are checked
+// up front so a bad entry fails here rather than at issuance.
+func (fd *ForgeDominion) SetProfiles(profiles map[string]TokenProfile) error {
+	for name, p := range profiles {
+		if name == "" {
+			return fmt.Errorf("profile name is empty")
+		}
+		if err := validateTenantID(p.TenantID); err != nil {
+			return fmt.Errorf("profile %q: %w", name, err)
+		}
+		if err := ValidateScope(p.Scope); err != nil {
+			return fmt.Errorf("profile %q: %w", name, err)
+		}
+		if _, err := normalizeNetworks(p.Networks); err != nil {
+			return fmt.Errorf("profile %q: %w", name, err)
+		}
+		if err := validateIdleTimeout(p.IdleTimeout); err != nil {
+			return fmt.Errorf("profile %q: %w", name, err)
+		}
+		if _, err := normalizeClaims(p.Claims); err != nil {
+			return fmt.Errorf("profile %q: %w", name, err)
+		}
+		if err := fd.checkRoles(p.Roles); err != nil {
+			return fmt.Errorf("profile %q: %w", name, err)
+		}
+		if p.TTL < 0 || p.MaxUses < 0 || p.Renewal.TTL < 0 || p.Renewal.Window < 0 {
+			return fmt.Errorf("profile %q: durations and max uses must not be negative", name)
+		}
+	}
+	fd.profiles = profiles
+	return nil
+}
+
+// RequestTokenFromProfile issues a token for the profile's own node
+func (fd *ForgeDominion) RequestTokenFromProfile(name string) (*ForgeToken, error) {
+	return fd.RequestProfileToken(context.Background(), name, "")
+}
+
+// RequestProfileToken issues a token from the named profile for nodeID, or
+// for the profile's node when nodeID is empty. The token carries the
+// profile name, which RenewToken uses to apply the profile's renewal
+// policy.
+func (fd *ForgeDominion) RequestProfileToken(ctx context.Context, name string, nodeID string) (*ForgeToken, error) {
+	p, ok := fd.profiles[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown token profile %q", name)
+	}
+	if nodeID == "" {
+		nodeID = p.NodeID
+	}
+	if nodeID == "" {
+		return nil, fmt.Errorf("profile %q has no node; a node ID is required", name)
+	}
+
+	spec := TokenSpec{
+		TenantID:    p.TenantID,
+		NodeID:      nodeID,
+		Scope:       p.Scope,
+		Audience:    p.Audience,
+		Networks:    p.Networks,
+		MaxUses:     p.MaxUses,
+		TTL:         p.TTL,
+		IdleTimeout: p.IdleTimeout,
+		Claims:      p.Claims,
+		Roles:       p.Roles,
+		Profile:     name,
+	}
+	return fd.requestToken(ctx, spec, "profile "+name)
+}
+
+// profileRenewal applies the renewal policy of the profile token was
+// issued from and returns the TTL to renew with. Tokens naming a profile
+// that no longer exists can't be renewed.
+func (fd *ForgeDominion) profileRenewal(token *ForgeToken, ttl time.Duration, now time.Time) (time.Duration, error) {
+	if token.Profile == "" {
+		return ttl, nil
+	}
+	p, ok := fd.profiles[token.Profile]
+	if !ok {
+		return 0, fmt.Errorf("%w: token profile %q is not configured", ErrPolicyDenied, token.Profile)
+	}
+	if p.Renewal.Disabled {
+		return 0, fmt.Errorf("%w: profile %q tokens cannot be renewed", ErrPolicyDenied, token.Profile)
+	}
+	if p.Renewal.Window > 0 && token.ExpiresAt.Sub(now) > p.Renewal.Window {
+		return 0, fmt.Errorf("%w: profile %q tokens can only be renewed within %s of expiry", ErrPolicyDenied, token.Profile, p.Renewal.Window)
+	}
+	if p.Renewal.TTL > 0 {
+		ttl = p.Renewal.TTL
+	}
+	return ttl, nil
+}
@@ -0,0 +1,152 @@
+package forgeauth
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+)
+
+// Roles name sets of scopes, bound centrally so that granting "operator"
+// to a node doesn't mean spelling out, and later updating, its scopes in
+// every issuer. A token's effective permissions are its scope plus the
+// bindings of its roles, looked up when the token is checked, so changing
+// a binding applies to outstanding tokens at once. Denials in any binding
+// or in the scope apply to the whole token.
+
+// roleFile is the on-disk form read by LoadRoles
+type roleFile struct {
+	Roles map[string][]string `json:"roles"`
+}
+
+// LoadRoles reads role bindings from a JSON config file:
+//
+//	{"roles": {"operator": ["runtime:execute", "runtime:*:read"],
+//	  "auditor": ["runtime:*:read", "!runtime:secrets:read"]}}
+func LoadRoles(path string) (map[string][]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read roles: %w", err)
+	}
+	var file roleFile
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&file); err != nil {
+		return nil, fmt.Errorf("invalid roles file %s: %w", path, err)
+	}
+	return file.Roles, nil
+}
+
+// SetRoles replaces the dominion's role bindings. Tokens can only be issued
+// with bound roles; a token whose role has since been removed keeps
+// validating but gains nothing from it.
+func (fd *ForgeDominion) SetRoles(roles map[string][]string) error {
+	bindings, err := roleBindings(roles)
+	if err != nil {
+		return err
+	}
+
+	fd.rolesMu.Lock()
+	fd.roles = bindings
+	fd.rolesMu.Unlock()
+	return nil
+}
+
+// roleBindings checks roles and joins each role's scopes into one scope
+func roleBindings(roles map[string][]string) (map[string]string, error) {
+	bindings := make(map[string]string, len(roles))
+	for role, scopes := range roles {
+		if err := validateRoleName(role); err != nil {
+			return nil, err
+		}
+		scope := strings.Join(scopes, ",")
+		if err := ValidateScope(scope); err != nil {
+			return nil, fmt.Errorf("role %q: %w", role, err)
+		}
+		bindings[role] = scope
+	}
+	return bindings, nil
+}
+
+func validateRoleName(role string) error {
+	if role == "" || strings.ContainsAny(role, ", \t\n") {
+		return fmt.Errorf("invalid role name %q", role)
+	}
+	return nil
+}
+
+// checkRoles rejects roles that are not bound, so a misspelt role fails at
+// issuance instead of silently granting nothing
+func (fd *ForgeDominion) checkRoles(roles []string) error {
+	fd.rolesMu.RLock()
+	defer fd.rolesMu.RUnlock()
+	for _, role := range roles {
+		if _, ok := fd.roles[role]; !ok {
+			return fmt.Errorf("unknown role %q", role)
+		}
+	}
+	return nil
+}
+
+// normalizeRoles sorts and deduplicates roles so equal sets sign the same
+func normalizeRoles(roles []string) []string {
+	if len(roles) == 0 {
+		return nil
+	}
+	out := slices.Clone(roles)
+	slices.Sort(out)
+	return slices.Compact(out)
+}
+
+// EffectiveScope returns token's scope together with the scopes bound to
+// its roles
+func (fd *ForgeDominion) EffectiveScope(token *ForgeToken) string {
+	fd.rolesMu.RLock()
+	defer fd.rolesMu.RUnlock()
+	return effectiveScope(token, fd.roles)
+}
+
+// effectiveScope joins token's scope with the bindings of its roles
+func effectiveScope(token *ForgeToken, bindings map[string]string) string {
+	if len(token.Roles) == 0 {
+		return token.Scope
+	}
+	terms := make([]string, 0, len(token.Roles)+1)
+	if token.Scope != "" {
+		terms = append(terms, token.Scope)
+	}
+	for _, role := range token.Roles {
+		if scope := bindings[role]; scope != "" {
+			terms = append(terms, scope)
+		}
+	}
+	return strings.Join(terms, ",")
+}
+
+// allows reports whether token's effective scope grants required
+func (fd *ForgeDominion) allows(token *ForgeToken, required string) bool {
+	return scopeAllows(fd.EffectiveScope(token), required)
+}
+
+// Authorize checks whether token may perform action on resource, i.e.
+// whether its scope or roles grant "resource:action"; a resource of
+// "runtime:jobs" and action "cancel" need "runtime:jobs:cancel". The token
+// must already have been validated.
+func (fd *ForgeDominion) Authorize(token *ForgeToken, action string, resource string) error {
+	if token == nil {
+		return fmt.Errorf("%w: token is nil", ErrMalformed)
+	}
+	if action == "" || resource == "" {
+		return fmt.Errorf("%w: action and resource are required", ErrScopeDenied)
+	}
+	required := resource + ":" + action
+	if !isLiteralScope(required) {
+		return fmt.Errorf("%w: %q is not a literal permission", ErrScopeDenied, required)
+	}
+	if !fd.allows(token, required) {
+		return fmt.Errorf("%w: %q required", ErrScopeDenied, required)
+	}
+	return nil
+}
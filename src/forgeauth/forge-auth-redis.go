@@ -0,0 +1,166 @@
+package forgeauth
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// defaultRedisPrefix namespaces the keys written by RedisStore
+const defaultRedisPrefix = "forge-dominion:"
+
+// redisUse counts one use, setting the key to expire with the token
+var redisUse = redis.NewScript(`
+local n = redis.call('INCR', KEYS[1])
+if n == 1 then redis.call('PEXPIREAT', KEYS[1], ARGV[1]) end
+return n
+`)
+
+// redisExtend mirrors memorySessionStore.Extend. ARGV: now, initial
+// deadline, idle and expiry, all in milliseconds. Returns the new deadline,
+// or 0 once the session has idled out.
+var redisExtend = redis.NewScript(`
+local now, idle, exp = tonumber(ARGV[1]), tonumber(ARGV[3]), tonumber(ARGV[4])
+local deadline = tonumber(redis.call('GET', KEYS[1]) or ARGV[2])
+if deadline == 0 or now > deadline then
+	redis.call('SET', KEYS[1], 0, 'PXAT', exp)
+	return 0
+end
+deadline = math.min(now + idle, exp)
+redis.call('SET', KEYS[1], deadline, 'PXAT', exp)
+return deadline
+`)
+
+// redisRetire raises a retirement time, never lowering it. ARGV: retired
+// at in nanoseconds and the expiry in milliseconds, 0 for none.
+var redisRetire = redis.NewScript(`
+if tonumber(redis.call('GET', KEYS[1]) or '0') >= tonumber(ARGV[1]) then return 0 end
+if ARGV[2] == '0' then
+	redis.call('SET', KEYS[1], ARGV[1])
+else
+	redis.call('SET', KEYS[1], ARGV[1], 'PXAT', ARGV[2])
+end
+return 1
+`)
+
+// RedisStore shares revocations, usage counts and session deadlines
+// between dominion instances through Redis. Every key expires when the
+// token it describes does, so the store needs no pruning. Attach it with
+// SetRevocationStore, SetUsageCounter and SetSessionStore, on every
+// instance and validator.
+type RedisStore struct {
+	client *redis.Client
+	prefix string
+}
+
+// OpenRedisStore connects to the Redis server at url, e.g.
+// "rediss://:password@redis:6380/0", and checks it is reachable. prefix
+// namespaces the keys; empty uses "forge-dominion:".
+func OpenRedisStore(ctx context.Context, url string, prefix string) (*RedisStore, error) {
+	opts, err := redis.ParseURL(url)
+	if err != nil {
+		return nil, fmt.Errorf("invalid redis URL: %w", err)
+	}
+	if prefix == "" {
+		prefix = defaultRedisPrefix
+	}
+	s := &RedisStore{client: redis.NewClient(opts), prefix: prefix}
+	if err := s.Health(ctx); err != nil {
+		s.client.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// Health pings the server, for readiness probes
+func (s *RedisStore) Health(ctx context.Context) error {
+	if err := s.client.Ping(ctx).Err(); err != nil {
+		return fmt.Errorf("redis store unavailable: %w", err)
+	}
+	return nil
+}
+
+// Close closes the connection pool
+func (s *RedisStore) Close() error {
+	return s.client.Close()
+}
+
+func (s *RedisStore) key(kind, id string) string {
+	return s.prefix + kind + ":" + id
+}
+
+// Revoke implements RevocationStore
+func (s *RedisStore) Revoke(ctx context.Context, id string, expiresAt time.Time) error {
+	ttl := time.Until(expiresAt)
+	if ttl <= 0 {
+		return nil
+	}
+	return s.client.Set(ctx, s.key("revoked", id), 1, ttl).Err()
+}
+
+// Retire implements RevocationStore
+func (s *RedisStore) Retire(ctx context.Context, tenantID, nodeID string, retiredAt, until time.Time) error {
+	var exp int64
+	if !until.IsZero() {
+		exp = until.UnixMilli()
+	}
+	return redisRetire.Run(ctx, s.client, []string{s.key("retired", retirementKey(tenantID, nodeID))},
+		retiredAt.UnixNano(), exp).Err()
+}
+
+// Check implements RevocationStore
+func (s *RedisStore) Check(ctx context.Context, token *ForgeToken) error {
+	keys := []string{
+		s.key("retired", retirementKey(token.TenantID, token.NodeID)),
+		s.key("retired", retirementKey(token.TenantID, "")),
+	}
+	if token.ID != "" {
+		keys = append(keys, s.key("revoked", token.ID))
+	}
+	values, err := s.client.MGet(ctx, keys...).Result()
+	if err != nil {
+		return err
+	}
+	if len(values) == 3 && values[2] != nil {
+		return fmt.Errorf("%w: %s", ErrRevoked, token.ID)
+	}
+	for _, v := range values[:2] {
+		str, ok := v.(string)
+		if !ok {
+			continue
+		}
+		n, err := strconv.ParseInt(str, 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid key retirement in redis: %q", str)
+		}
+		if at := time.Unix(0, n); token.IssuedAt.Before(at) {
+			return fmt.Errorf("%w: signed with a key retired at %s", ErrRevoked, at.Format(time.RFC3339))
+		}
+	}
+	return nil
+}
+
+// Use implements UsageCounter
+func (s *RedisStore) Use(ctx context.Context, id string, expiresAt time.Time) (int, error) {
+	n, err := redisUse.Run(ctx, s.client, []string{s.key("uses", id)}, expiresAt.UnixMilli()).Int64()
+	if err != nil {
+		return 0, err
+	}
+	return int(n), nil
+}
+
+// Extend implements SessionStore
+func (s *RedisStore) Extend(ctx context.Context, id string, start time.Time, idle time.Duration, expiresAt time.Time) (time.Time, error) {
+	deadline, err := redisExtend.Run(ctx, s.client, []string{s.key("session", id)},
+		time.Now().UnixMilli(), start.Add(idle).UnixMilli(), idle.Milliseconds(), expiresAt.UnixMilli()).Int64()
+	if err != nil {
+		return time.Time{}, err
+	}
+	if deadline == 0 {
+		return time.Time{}, nil
+	}
+	return time.UnixMilli(deadline), nil
+}
@@ -0,0 +1,65 @@
+package forgeauth
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// RefreshScope is the scope of refresh credentials. It grants nothing but
+// renewing the tokens of one session.
+const RefreshScope = "forge:refresh"
+
+// IssueRefreshCredential issues a companion credential that can renew
+// token, and its renewals, until ttl from now, so a long-running agent can
+// hold a short-lived token and a low-privilege renewer instead of a
+// long-lived token. The credential is bound to token's tenant, node and
+// session; killing the session (see KillSession) revokes it along with the
+// tokens, while revoking a single token does not.
+func (fd *ForgeDominion) IssueRefreshCredential(ctx context.Context, token *ForgeToken, ttl time.Duration) (*ForgeToken, error) {
+	if err := fd.ValidateTokenContext(ctx, token); err != nil {
+		return nil, fmt.Errorf("cannot delegate renewal of invalid token: %w", err)
+	}
+	if token.Scope == RefreshScope || token.Scope == UnwrapScope || token.MaxUses > 0 {
+		return nil, fmt.Errorf("%w: token %s cannot be renewed", ErrPolicyDenied, token.ID)
+	}
+	sid := sessionOf(token)
+	return fd.requestToken(ctx, TokenSpec{TenantID: token.TenantID, NodeID: token.NodeID, Scope: RefreshScope, TTL: ttl, SessionID: sid}, "refreshes="+sid)
+}
+
+// RefreshToken renews token using a credential from IssueRefreshCredential.
+// Unlike RenewToken, token may already have expired, as long as it is
+// authentic, not revoked, and belongs to the credential's session. A zero
+// ttl reuses token's lifetime.
+func (fd *ForgeDominion) RefreshToken(ctx context.Context, refresh *ForgeToken, token *ForgeToken, ttl time.Duration) (*ForgeToken, error) {
+	if refresh == nil || token == nil {
+		return nil, fmt.Errorf("%w: token is nil", ErrMalformed)
+	}
+	if refresh.Scope != RefreshScope {
+		return nil, fmt.Errorf("%w: not a refresh credential", ErrScopeDenied)
+	}
+	if err := fd.ValidateTokenContext(ctx, refresh); err != nil {
+		return nil, fmt.Errorf("invalid refresh credential: %w", err)
+	}
+	if token.Scope == RefreshScope || token.MaxUses > 0 {
+		return nil, fmt.Errorf("%w: token %s cannot be renewed", ErrPolicyDenied, token.ID)
+	}
+	if token.TenantID != refresh.TenantID || token.NodeID != refresh.NodeID || sessionOf(token) != refresh.SessionID {
+		return nil, fmt.Errorf("%w: refresh credential does not cover token %s", ErrScopeDenied, token.ID)
+	}
+
+	// The token's expiry is not checked, but its claims must be authentic
+	// before they are copied into the renewal
+	if err := fd.VerifySignature(ctx, token); err != nil {
+		// The credential proved the node, so the forgery counts against it
+		fd.observeNodeLockout(ctx, refresh.TenantID, refresh.NodeID, "forged renewals")
+		return nil, fmt.Errorf("cannot refresh invalid token: %w", err)
+	}
+	if err := fd.checkRevoked(ctx, token); err != nil {
+		return nil, fmt.Errorf("cannot refresh invalid token: %w", err)
+	}
+	if ttl == 0 {
+		ttl = token.ExpiresAt.Sub(token.IssuedAt)
+	}
+	return fd.renew(ctx, token, ttl, "refresh="+refresh.ID)
+}
@@ -0,0 +1,175 @@
+package forgeauth
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+)
+
+// A session is a token together with everything derived from it: each
+// renewal and exchange carries the session ID of the token it came from, so
+// the ledger can list a node's sessions and KillSession can end one without
+// touching the node's other tokens.
+
+// SessionAdminScope is required by SessionHandler
+const SessionAdminScope = "forge:sessions:manage"
+
+// errNoSession is returned by KillSession for unknown or ended sessions
+var errNoSession = errors.New("no active session")
+
+// SessionInfo describes an active session
+type SessionInfo struct {
+	ID        string    `json:"sid"`
+	TenantID  string    `json:"tenant_id,omitempty"`
+	NodeID    string    `json:"node_id"`
+	Scope     string    `json:"scope"`      // of the latest token, not counting refresh credentials
+	StartedAt time.Time `json:"started_at"` // issue time of the first token
+	RenewedAt time.Time `json:"renewed_at"` // issue time of the latest token, as for Scope
+	ExpiresAt time.Time `json:"expires_at"` // when the last live token expires
+	Tokens    []string  `json:"tokens"`     // IDs of the live tokens
+}
+
+// sessionOf returns the session token belongs to; tokens issued before
+// session IDs existed are their own session
+func sessionOf(token *ForgeToken) string {
+	if token.SessionID != "" {
+		return token.SessionID
+	}
+	return token.ID
+}
+
+func entrySession(e LedgerEntry) string {
+	if e.SessionID != "" {
+		return e.SessionID
+	}
+	return e.ID
+}
+
+// Sessions lists the tenant's active sessions according to the ledger,
+// those of nodeID only when it is non-empty, oldest first. A session is
+// active while any of its tokens is outstanding.
+func (fd *ForgeDominion) Sessions(tenantID string, nodeID string) ([]SessionInfo, error) {
+	if fd.ledger == nil {
+		return nil, fmt.Errorf("no ledger configured")
+	}
+	entries, err := fd.ledger.records()
+	if err != nil {
+		return nil, err
+	}
+
+	byID := make(map[string]*SessionInfo)
+	for _, e := range outstanding(entries, fd.now()) {
+		if e.TenantID != tenantID || (nodeID != "" && e.NodeID != nodeID) {
+			continue
+		}
+		sid := entrySession(e)
+		s, ok := byID[sid]
+		if !ok {
+			s = &SessionInfo{ID: sid, TenantID: e.TenantID, NodeID: e.NodeID, StartedAt: e.IssuedAt}
+			byID[sid] = s
+		}
+		if !e.IssuedAt.Before(s.RenewedAt) && e.Scope != RefreshScope {
+			s.RenewedAt = e.IssuedAt
+			s.Scope = e.Scope
+		}
+		if e.ExpiresAt.After(s.ExpiresAt) {
+			s.ExpiresAt = e.ExpiresAt
+		}
+		s.Tokens = append(s.Tokens, e.ID)
+	}
+	// Tokens of the session that have already expired still date its start
+	for _, e := range entries {
+		if s, ok := byID[entrySession(e)]; ok && e.Kind == LedgerIssue && e.IssuedAt.Before(s.StartedAt) {
+			s.StartedAt = e.IssuedAt
+		}
+	}
+
+	sessions := make([]SessionInfo, 0, len(byID))
+	for _, s := range byID {
+		sessions = append(sessions, *s)
+	}
+	slices.SortFunc(sessions, func(a, b SessionInfo) int {
+		if c := a.StartedAt.Compare(b.StartedAt); c != 0 {
+			return c
+		}
+		return strings.Compare(a.ID, b.ID)
+	})
+	return sessions, nil
+}
+
+// KillSession ends one of the tenant's sessions by revoking every
+// outstanding token in it, which also stops further renewals and exchanges.
+// It returns the number of tokens revoked.
+func (fd *ForgeDominion) KillSession(tenantID string, sessionID string) (int, error) {
+	live, err := fd.OutstandingTokens()
+	if err != nil {
+		return 0, err
+	}
+	var killed []LedgerEntry
+	for _, e := range live {
+		if e.TenantID == tenantID && entrySession(e) == sessionID {
+			killed = append(killed, e)
+		}
+	}
+	if len(killed) == 0 {
+		return 0, fmt.Errorf("%w %q", errNoSession, sessionID)
+	}
+
+	for i, e := range killed {
+		if err := fd.RevokeID(e.ID, e.ExpiresAt); err != nil {
+			return i, err
+		}
+	}
+	last := killed[len(killed)-1]
+	fd.record(AuditEntry{
+		Event:    AuditSessionKilled,
+		TenantID: tenantID,
+		NodeID:   last.NodeID,
+		Scope:    last.Scope,
+		Count:    len(killed),
+		Detail:   "sid=" + sessionID,
+	})
+	return len(killed), nil
+}
+
+// SessionHandler serves the session registry to callers holding
+// SessionAdminScope, within their own tenant:
+//
+//	GET    /sessions?node=<id>  list active sessions, optionally of one node
+//	DELETE /sessions/<sid>      kill a session
+func SessionHandler(fd *ForgeDominion) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /sessions", func(w http.ResponseWriter, r *http.Request) {
+		caller, _ := TokenFromContext(r.Context())
+		sessions, err := fd.Sessions(caller.TenantID, r.URL.Query().Get("node"))
+		if err != nil {
+			http.Error(w, "session registry unavailable", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(struct {
+			Sessions []SessionInfo `json:"sessions"`
+		}{sessions})
+	})
+	mux.HandleFunc("DELETE /sessions/{sid}", func(w http.ResponseWriter, r *http.Request) {
+		caller, _ := TokenFromContext(r.Context())
+		n, err := fd.KillSession(caller.TenantID, r.PathValue("sid"))
+		switch {
+		case errors.Is(err, errNoSession):
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		case err != nil:
+			http.Error(w, "failed to kill session", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(struct {
+			Revoked int `json:"revoked"`
+		}{n})
+	})
+	return Middleware(fd, SessionAdminScope)(mux)
+}
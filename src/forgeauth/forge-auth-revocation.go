@@ -0,0 +1,349 @@
+package forgeauth
+
+import (
+	"context"
+	"crypto/hkdf"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// revocationBundleInfo is the HKDF info string for the bundle signing key
+const revocationBundleInfo = "forge-dominion/revocation-bundle/v1"
+
+// RevokedToken identifies a revoked token. ExpiresAt lets validators prune
+// the entry once the token could no longer validate anyway.
+type RevokedToken struct {
+	ID        string    `json:"jti"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// KeyRetirement rejects every token for a node's derived key issued before
+// RetiredAt, e.g. after that node's key leaked. An empty NodeID retires all
+// node keys of the tenant.
+type KeyRetirement struct {
+	TenantID  string    `json:"tenant_id,omitempty"`
+	NodeID    string    `json:"node_id,omitempty"`
+	RetiredAt time.Time `json:"retired_at"`
+}
+
+// RevocationBundle is a signed, versioned snapshot of revocation state for
+// validators that can't reach the dominion, analogous to a CRL
+type RevocationBundle struct {
+	Version     uint64          `json:"version"`
+	IssuedAt    time.Time       `json:"issued_at"`
+	Revoked     []RevokedToken  `json:"revoked"`
+	RetiredKeys []KeyRetirement `json:"retired_keys"`
+	Signature   string          `json:"signature"`
+}
+
+// revocationList is the dominion's in-memory revocation state
+type revocationList struct {
+	mu      sync.RWMutex
+	version uint64
+	revoked map[string]time.Time
+	retired map[string]time.Time // keyed by tenant + "/" + node
+}
+
+func newRevocationList() *revocationList {
+	return &revocationList{
+		revoked: make(map[string]time.Time),
+		retired: make(map[string]time.Time),
+	}
+}
+
+func retirementKey(tenantID, nodeID string) string {
+	return tenantID + "/" + nodeID
+}
+
+// check rejects tokens that are revoked or signed with a retired node key
+func (l *revocationList) check(token *ForgeToken) error {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	if token.ID != "" {
+		if _, ok := l.revoked[token.ID]; ok {
+			return fmt.Errorf("%w: %s", ErrRevoked, token.ID)
+		}
+	}
+	for _, key := range []string{retirementKey(token.TenantID, token.NodeID), retirementKey(token.TenantID, "")} {
+		if at, ok := l.retired[key]; ok && token.IssuedAt.Before(at) {
+			return fmt.Errorf("%w: signed with a key retired at %s", ErrRevoked, at.Format(time.RFC3339))
+		}
+	}
+	return nil
+}
+
+// RevocationStore shares revocations between dominion instances, e.g.
+// several behind a load balancer. Revocations are still kept in memory;
+// the store makes those made by other instances visible.
+type RevocationStore interface {
+	// Revoke rejects the token id until expiresAt
+	Revoke(ctx context.Context, id string, expiresAt time.Time) error
+
+	// Retire rejects tokens for the node, or the tenant when nodeID is
+	// empty, issued before retiredAt. Once until has passed no such token
+	// can still validate; a zero until keeps the retirement forever.
+	Retire(ctx context.Context, tenantID, nodeID string, retiredAt, until time.Time) error
+
+	// Check returns an ErrRevoked error for revoked or retired tokens
+	Check(ctx context.Context, token *ForgeToken) error
+}
+
+// SetRevocationStore shares the dominion's revocations through s. Tokens are
+// also checked against s, so a store outage fails validation closed.
+func (fd *ForgeDominion) SetRevocationStore(s RevocationStore) {
+	fd.revocationStore = s
+}
+
+// checkRevoked checks token against the in-memory list and then the shared
+// store, if any
+func (fd *ForgeDominion) checkRevoked(ctx context.Context, token *ForgeToken) error {
+	return checkRevoked(ctx, fd.revocations, fd.revocationStore, token)
+}
+
+func checkRevoked(ctx context.Context, l *revocationList, store RevocationStore, token *ForgeToken) error {
+	if err := l.check(token); err != nil {
+		return err
+	}
+	if store == nil {
+		return nil
+	}
+	if err := store.Check(ctx, token); err != nil {
+		if errors.Is(err, ErrRevoked) {
+			return err
+		}
+		return fmt.Errorf("failed to check revocation: %w", err)
+	}
+	return nil
+}
+
+// snapshot returns the revocation state, omitting tokens expired by now
+func (l *revocationList) snapshot(now time.Time) (uint64, []RevokedToken, []KeyRetirement) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	revoked := []RevokedToken{}
+	for id, expiresAt := range l.revoked {
+		if expiresAt.After(now) {
+			revoked = append(revoked, RevokedToken{ID: id, ExpiresAt: expiresAt})
+		}
+	}
+	retired := []KeyRetirement{}
+	for key, at := range l.retired {
+		tenantID, nodeID := splitRetirementKey(key)
+		retired = append(retired, KeyRetirement{TenantID: tenantID, NodeID: nodeID, RetiredAt: at})
+	}
+	return l.version, revoked, retired
+}
+
+// merge adds revocations and retirements to the list
+func (l *revocationList) merge(revoked []RevokedToken, retired []KeyRetirement) {
+	for _, r := range revoked {
+		l.revoked[r.ID] = r.ExpiresAt
+	}
+	for _, k := range retired {
+		key := retirementKey(k.TenantID, k.NodeID)
+		if k.RetiredAt.After(l.retired[key]) {
+			l.retired[key] = k.RetiredAt
+		}
+	}
+}
+
+// Revoke revokes a single token by its ID
+func (fd *ForgeDominion) Revoke(token *ForgeToken) error {
+	if token.ID == "" {
+		return fmt.Errorf("token has no ID and can only be revoked by retiring its node key")
+	}
+	if err := fd.RevokeID(token.ID, token.ExpiresAt); err != nil {
+		return err
+	}
+	fd.record(AuditEntry{
+		Event:     AuditRevoke,
+		TenantID:  token.TenantID,
+		NodeID:    token.NodeID,
+		Scope:     token.Scope,
+		ExpiresAt: token.ExpiresAt,
+		Detail:    "jti=" + token.ID,
+	})
+	return nil
+}
+
+// RevokeID revokes a token ID until expiresAt. With a ledger configured the
+// revocation is persisted first and fails if it can't be.
+func (fd *ForgeDominion) RevokeID(id string, expiresAt time.Time) error {
+	if err := fd.ledgerAppend(LedgerEntry{Kind: LedgerRevoke, Time: fd.now(), ID: id, ExpiresAt: expiresAt}); err != nil {
+		return err
+	}
+	if fd.revocationStore != nil {
+		if err := fd.revocationStore.Revoke(context.Background(), id, expiresAt); err != nil {
+			return fmt.Errorf("failed to share revocation: %w", err)
+		}
+	}
+
+	l := fd.revocations
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.revoked[id] = expiresAt
+	l.version++
+	fd.metrics.observeRevoke(id)
+	return nil
+}
+
+// RetireNodeKey rejects every token for the node (or for the whole tenant
+// when nodeID is empty) issued before retiredAt
+func (fd *ForgeDominion) RetireNodeKey(tenantID string, nodeID string, retiredAt time.Time) error {
+	if err := fd.ledgerAppend(LedgerEntry{Kind: LedgerRetire, Time: retiredAt, TenantID: tenantID, NodeID: nodeID}); err != nil {
+		return err
+	}
+	if fd.revocationStore != nil {
+		// Tokens issued before retiredAt are gone once the longest
+		// allowed TTL has passed
+		var until time.Time
+		if fd.ttlPolicy.Max > 0 {
+			until = retiredAt.Add(fd.ttlPolicy.Max + MaxClockSkew)
+		}
+		if err := fd.revocationStore.Retire(context.Background(), tenantID, nodeID, retiredAt, until); err != nil {
+			return fmt.Errorf("failed to share key retirement: %w", err)
+		}
+	}
+
+	l := fd.revocations
+	l.mu.Lock()
+	key := retirementKey(tenantID, nodeID)
+	if retiredAt.After(l.retired[key]) {
+		l.retired[key] = retiredAt
+		l.version++
+	}
+	l.mu.Unlock()
+
+	fd.record(AuditEntry{
+		Event:    AuditRetireKey,
+		TenantID: tenantID,
+		NodeID:   nodeID,
+		Detail:   "retired_at=" + retiredAt.Format(time.RFC3339),
+	})
+	return nil
+}
+
+// ExportRevocationBundle snapshots the current revocation state into a
+// signed bundle. Entries for tokens that have already expired are omitted.
+func (fd *ForgeDominion) ExportRevocationBundle() (*RevocationBundle, error) {
+	l := fd.revocations
+	now := fd.now()
+
+	bundle := &RevocationBundle{IssuedAt: now}
+	bundle.Version, bundle.Revoked, bundle.RetiredKeys = l.snapshot(now)
+
+	mac, err := bundleMAC(fd.currentKeys(), bundle)
+	if err != nil {
+		return nil, err
+	}
+	bundle.Signature = base64.URLEncoding.EncodeToString(mac)
+	return bundle, nil
+}
+
+// ApplyRevocationBundle verifies a bundle and merges it into local state.
+// Bundles older than the last applied version are rejected so a stale
+// bundle can't un-revoke tokens.
+func (fd *ForgeDominion) ApplyRevocationBundle(bundle *RevocationBundle) error {
+	sig, err := base64.URLEncoding.DecodeString(bundle.Signature)
+	if err != nil {
+		return fmt.Errorf("invalid revocation bundle signature")
+	}
+	expected, err := bundleMAC(fd.currentKeys(), bundle)
+	if err != nil {
+		return err
+	}
+	if !hmac.Equal(sig, expected) {
+		// Peers that haven't rotated yet still sign with the previous key
+		previous := fd.graceKeys(fd.now())
+		if previous == nil {
+			return fmt.Errorf("invalid revocation bundle signature")
+		}
+		if expected, err = bundleMAC(previous, bundle); err != nil || !hmac.Equal(sig, expected) {
+			return fmt.Errorf("invalid revocation bundle signature")
+		}
+	}
+
+	l := fd.revocations
+	l.mu.Lock()
+	if bundle.Version < l.version {
+		current := l.version
+		l.mu.Unlock()
+		return fmt.Errorf("revocation bundle version %d is older than applied version %d", bundle.Version, current)
+	}
+	l.merge(bundle.Revoked, bundle.RetiredKeys)
+	l.version = bundle.Version
+	l.mu.Unlock()
+
+	fd.record(AuditEntry{
+		Event:  AuditBundleApplied,
+		Count:  len(bundle.Revoked) + len(bundle.RetiredKeys),
+		Detail: fmt.Sprintf("version=%d", bundle.Version),
+	})
+	return nil
+}
+
+// bundleMAC signs the bundle contents with a key derived from the default
+// root key, which every validator of this dominion already holds
+func bundleMAC(keys KeyProvider, bundle *RevocationBundle) ([]byte, error) {
+	rootKey, err := rootKey(context.Background(), keys, "")
+	if err != nil {
+		return nil, err
+	}
+	key, err := hkdf.Key(sha256.New, rootKey, nil, revocationBundleInfo, sha256.Size)
+	if err != nil {
+		return nil, fmt.Errorf("failed to derive bundle key: %w", err)
+	}
+	defer clear(key)
+
+	unsigned := *bundle
+	unsigned.Signature = ""
+	payload, err := json.Marshal(unsigned)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode revocation bundle: %w", err)
+	}
+
+	h := hmac.New(sha256.New, key)
+	h.Write(payload)
+	return h.Sum(nil), nil
+}
+
+func splitRetirementKey(key string) (string, string) {
+	tenantID, nodeID, _ := strings.Cut(key, "/")
+	return tenantID, nodeID
+}
+
+// WriteRevocationBundle saves a bundle for transfer to air-gapped validators
+func WriteRevocationBundle(bundle *RevocationBundle, path string) error {
+	data, err := json.MarshalIndent(bundle, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal revocation bundle: %w", err)
+	}
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		return fmt.Errorf("failed to write revocation bundle: %w", err)
+	}
+	return nil
+}
+
+// ReadRevocationBundle loads a bundle written by WriteRevocationBundle. The
+// bundle must still be passed to ApplyRevocationBundle, which verifies it.
+func ReadRevocationBundle(path string) (*RevocationBundle, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read revocation bundle: %w", err)
+	}
+	var bundle RevocationBundle
+	if err := json.Unmarshal(data, &bundle); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal revocation bundle: %w", err)
+	}
+	return &bundle, nil
+}
@@ -0,0 +1,266 @@
+package forgeauth
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// newUntrustedDominion is a dominion with a root key of its own
+func newUntrustedDominion(t *testing.T) *ForgeDominion {
+	t.Helper()
+	fd := NewForgeDominionWithKeys(StaticKeyProvider{"": bytes.Repeat([]byte{0x66}, minRootKeyLen)})
+	fd.SetClock(NewFakeClock(testEpoch))
+	if err := fd.SetSigningAlg(AlgEd25519); err != nil {
+		t.Fatal(err)
+	}
+	return fd
+}
+
+func TestRevocationBundle(t *testing.T) {
+	issuer, _ := newTestDominion(t, AlgHS256)
+	revoked, err := issuer.RequestToken("node-1", "runtime:read", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	retired, err := issuer.RequestToken("node-2", "runtime:read", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kept, err := issuer.RequestToken("node-3", "runtime:read", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := issuer.Revoke(revoked); err != nil {
+		t.Fatal(err)
+	}
+	if err := issuer.RetireNodeKey("", "node-2", testEpoch.Add(time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	bundle, err := issuer.ExportRevocationBundle()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The bundle survives the trip to an air-gapped validator
+	path := filepath.Join(t.TempDir(), "revocations.json")
+	if err := WriteRevocationBundle(bundle, path); err != nil {
+		t.Fatal(err)
+	}
+	if bundle, err = ReadRevocationBundle(path); err != nil {
+		t.Fatal(err)
+	}
+	validator, _ := newTestDominion(t, AlgHS256)
+	if err := validator.ApplyRevocationBundle(bundle); err != nil {
+		t.Fatal(err)
+	}
+	if err := validator.ValidateToken(revoked); !errors.Is(err, ErrRevoked) {
+		t.Errorf("revoked token: got %v, want %v", err, ErrRevoked)
+	}
+	if err := validator.ValidateToken(retired); !errors.Is(err, ErrRevoked) {
+		t.Errorf("token of a retired key: got %v, want %v", err, ErrRevoked)
+	}
+	if err := validator.ValidateToken(kept); err != nil {
+		t.Errorf("token not in the bundle: %v", err)
+	}
+}
+
+func TestRevocationBundleUntrusted(t *testing.T) {
+	issuer, _ := newTestDominion(t, AlgHS256)
+	if err := issuer.RevokeID("jti-1", testEpoch.Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	bundle, err := issuer.ExportRevocationBundle()
+	if err != nil {
+		t.Fatal(err)
+	}
+	forged, err := newUntrustedDominion(t).ExportRevocationBundle()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		bundle func() *RevocationBundle
+	}{
+		{"signed by another root key", func() *RevocationBundle { return forged }},
+		{"revocation dropped", func() *RevocationBundle {
+			b := *bundle
+			b.Revoked = nil
+			return &b
+		}},
+		{"version raised", func() *RevocationBundle {
+			b := *bundle
+			b.Version += 100
+			return &b
+		}},
+		{"unsigned", func() *RevocationBundle {
+			b := *bundle
+			b.Signature = ""
+			return &b
+		}},
+		{"signature not base64", func() *RevocationBundle {
+			b := *bundle
+			b.Signature = "!"
+			return &b
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			validator, _ := newTestDominion(t, AlgHS256)
+			if err := validator.ApplyRevocationBundle(tt.bundle()); err == nil {
+				t.Fatal("bundle applied")
+			}
+			if validator.revocations.version != 0 {
+				t.Errorf("rejected bundle moved the version to %d", validator.revocations.version)
+			}
+		})
+	}
+}
+
+func TestRevocationBundleRollback(t *testing.T) {
+	issuer, _ := newTestDominion(t, AlgHS256)
+	token, err := issuer.RequestToken("node-1", "runtime:read", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	old, err := issuer.ExportRevocationBundle()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := issuer.Revoke(token); err != nil {
+		t.Fatal(err)
+	}
+	current, err := issuer.ExportRevocationBundle()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	validator, _ := newTestDominion(t, AlgHS256)
+	if err := validator.ApplyRevocationBundle(current); err != nil {
+		t.Fatal(err)
+	}
+	if err := validator.ApplyRevocationBundle(old); err == nil {
+		t.Error("older bundle applied")
+	}
+	if err := validator.ValidateToken(token); !errors.Is(err, ErrRevoked) {
+		t.Errorf("after a rollback attempt: got %v, want %v", err, ErrRevoked)
+	}
+	// Reapplying the current bundle is harmless
+	if err := validator.ApplyRevocationBundle(current); err != nil {
+		t.Errorf("current bundle reapplied: %v", err)
+	}
+}
+
+func TestValidatorBundleRevocations(t *testing.T) {
+	ctx := context.Background()
+	issuer, clock := newTestDominion(t, AlgEd25519)
+	pub, err := issuer.PublicKey(ctx, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	revoked := issueTestToken(t, issuer)
+	bundle, err := issuer.ExportValidatorBundle(ctx, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v, err := NewValidator(bundle, pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v.SetClock(clock)
+	if err := v.Validate(revoked); err != nil {
+		t.Fatalf("before the revocation: %v", err)
+	}
+
+	if err := issuer.Revoke(revoked); err != nil {
+		t.Fatal(err)
+	}
+	clock.Advance(time.Minute)
+	retired, err := issuer.RequestToken("node-2", "runtime:read", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kept := issueTestToken(t, issuer)
+	if err := issuer.RetireNodeKey("", "node-2", clock.Now().Add(time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	updated, err := issuer.ExportValidatorBundle(ctx, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := v.Update(updated); err != nil {
+		t.Fatal(err)
+	}
+	if err := v.Validate(revoked); !errors.Is(err, ErrRevoked) {
+		t.Errorf("revoked token: got %v, want %v", err, ErrRevoked)
+	}
+	if err := v.Validate(retired); !errors.Is(err, ErrRevoked) {
+		t.Errorf("token of a retired key: got %v, want %v", err, ErrRevoked)
+	}
+	if err := v.Validate(kept); err != nil {
+		t.Errorf("token not in the bundle: %v", err)
+	}
+
+	// Rolling back to the bundle from before the revocation is refused
+	if err := v.Update(bundle); err == nil {
+		t.Error("older validator bundle applied")
+	}
+	if err := v.Validate(revoked); !errors.Is(err, ErrRevoked) {
+		t.Errorf("after a rollback attempt: got %v, want %v", err, ErrRevoked)
+	}
+}
+
+func TestValidatorBundleUntrusted(t *testing.T) {
+	ctx := context.Background()
+	issuer, clock := newTestDominion(t, AlgEd25519)
+	pub, err := issuer.PublicKey(ctx, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := issuer.RevokeID("jti-1", testEpoch.Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	bundle, err := issuer.ExportValidatorBundle(ctx, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v, err := NewValidator(bundle, pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v.SetClock(clock)
+
+	untrusted := newUntrustedDominion(t)
+	forged, err := untrusted.ExportValidatorBundle(ctx, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewValidator(forged, pub); err == nil {
+		t.Error("validator created from a bundle signed by an untrusted key")
+	}
+	if err := v.Update(forged); err == nil {
+		t.Error("bundle signed by an untrusted key applied")
+	}
+	dropped := *bundle
+	dropped.Version = 2
+	dropped.Revoked = nil
+	if err := v.Update(&dropped); err == nil {
+		t.Error("edited bundle applied")
+	}
+
+	// Tokens of the untrusted dominion still fail against the pinned bundle
+	if err := v.Validate(issueTestToken(t, untrusted)); !errors.Is(err, ErrBadSignature) {
+		t.Errorf("untrusted dominion's token: got %v, want %v", err, ErrBadSignature)
+	}
+	other, err := untrusted.PublicKey(ctx, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewValidator(bundle, other); err == nil {
+		t.Error("validator pinned to the wrong key accepted the bundle")
+	}
+}
@@ -0,0 +1,61 @@
+package forgeauth
+
+import (
+	"fmt"
+	"time"
+)
+
+// RotateKeys switches the dominion to next for signing. Tokens signed with
+// the current keys keep validating for grace, and each one seen during the
+// window is counted in the previous_key_validations_total metric; once that
+// stops rising the old keys can be retired safely. A zero grace retires the
+// current keys immediately.
+//
+// Validator bundles exported afterwards are signed with the new default
+// key, so validators must be given the new trusted key along with them.
+func (fd *ForgeDominion) RotateKeys(next KeyProvider, grace time.Duration) error {
+	if next == nil {
+		return fmt.Errorf("next key provider is nil")
+	}
+	if grace < 0 {
+		return fmt.Errorf("grace period must not be negative")
+	}
+
+	fd.keyMu.Lock()
+	defer fd.keyMu.Unlock()
+	fd.previousKeys = fd.keys
+	fd.previousUntil = fd.now().Add(grace)
+	fd.keys = next
+	return nil
+}
+
+// RetirePreviousKeys ends the rotation grace period early
+func (fd *ForgeDominion) RetirePreviousKeys() {
+	fd.keyMu.Lock()
+	defer fd.keyMu.Unlock()
+	fd.previousKeys = nil
+	fd.previousUntil = time.Time{}
+}
+
+// currentKeys returns the keys used for signing
+func (fd *ForgeDominion) currentKeys() KeyProvider {
+	fd.keyMu.RLock()
+	defer fd.keyMu.RUnlock()
+	return fd.keys
+}
+
+// graceKeys returns the pre-rotation keys while they are still accepted at
+// now, otherwise nil
+func (fd *ForgeDominion) graceKeys(now time.Time) KeyProvider {
+	keys, until := fd.previousKeyWindow()
+	if keys == nil || !now.Before(until) {
+		return nil
+	}
+	return keys
+}
+
+func (fd *ForgeDominion) previousKeyWindow() (KeyProvider, time.Time) {
+	fd.keyMu.RLock()
+	defer fd.keyMu.RUnlock()
+	return fd.previousKeys, fd.previousUntil
+}
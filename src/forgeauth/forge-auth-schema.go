@@ -0,0 +1,206 @@
+package forgeauth
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// Token document schema versions. Version 1 is the unversioned layout of
+// tokens issued before the version field existed. The version describes the
+// document layout rather than any claim, so it is not covered by the
+// signature and MigrateToken can rewrite it without re-signing.
+const (
+	tokenSchemaV1 = 1
+	tokenSchemaV2 = 2
+
+	currentTokenSchema = tokenSchemaV2
+)
+
+// TokenCodec reads and writes one schema version of the JSON token document
+type TokenCodec interface {
+	Version() int
+	Marshal(token *ForgeToken) ([]byte, error)
+	Unmarshal(data []byte) (*ForgeToken, error)
+}
+
+// TokenMigration upgrades a token in place from one schema version to the
+// next
+type TokenMigration func(token *ForgeToken) error
+
+var (
+	codecMu        sync.RWMutex
+	tokenCodecs    = map[int]TokenCodec{}
+	tokenMigration = map[int]TokenMigration{}
+)
+
+func init() {
+	RegisterTokenCodec(legacyTokenCodec{})
+	RegisterTokenCodec(strictTokenCodec{version: tokenSchemaV2})
+	RegisterTokenMigration(tokenSchemaV1, func(token *ForgeToken) error {
+		// v2 only adds the version field itself
+		return nil
+	})
+}
+
+// RegisterTokenCodec adds or replaces the codec for c.Version()
+func RegisterTokenCodec(c TokenCodec) {
+	codecMu.Lock()
+	defer codecMu.Unlock()
+	tokenCodecs[c.Version()] = c
+}
+
+// RegisterTokenMigration sets the migration from schema version from to
+// from+1
+func RegisterTokenMigration(from int, m TokenMigration) {
+	codecMu.Lock()
+	defer codecMu.Unlock()
+	tokenMigration[from] = m
+}
+
+func tokenCodec(version int) (TokenCodec, error) {
+	codecMu.RLock()
+	defer codecMu.RUnlock()
+	if c, ok := tokenCodecs[version]; ok {
+		return c, nil
+	}
+
+	known := make([]int, 0, len(tokenCodecs))
+	for v := range tokenCodecs {
+		known = append(known, v)
+	}
+	sort.Ints(known)
+	return nil, fmt.Errorf("token schema version %d is not supported by this build (known: %v)", version, known)
+}
+
+// MarshalToken encodes a token as JSON using the codec for its schema
+// version
+func MarshalToken(token *ForgeToken) ([]byte, error) {
+	version := token.Version
+	if version == 0 {
+		version = tokenSchemaV1
+	}
+	c, err := tokenCodec(version)
+	if err != nil {
+		return nil, err
+	}
+	return c.Marshal(token)
+}
+
+// UnmarshalToken decodes a JSON token with the codec matching its version
+// field. Documents from a newer schema fail with an explicit error instead
+// of silently losing the claims this build doesn't know.
+func UnmarshalToken(data []byte) (*ForgeToken, error) {
+	var probe struct {
+		Version int `json:"version"`
+	}
+	if err := json.Unmarshal(data, &probe); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrMalformed, err)
+	}
+	version := probe.Version
+	if version == 0 {
+		version = tokenSchemaV1
+	}
+
+	c, err := tokenCodec(version)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrMalformed, err)
+	}
+	token, err := c.Unmarshal(data)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrMalformed, err)
+	}
+	return token, nil
+}
+
+// MigrateToken returns a copy of token upgraded to the target schema
+// version by applying each registered migration in turn
+func MigrateToken(token *ForgeToken, targetVersion int) (*ForgeToken, error) {
+	migrated := *token
+	if migrated.Version == 0 {
+		migrated.Version = tokenSchemaV1
+	}
+	if targetVersion < migrated.Version {
+		return nil, fmt.Errorf("cannot migrate token from schema %d down to %d", migrated.Version, targetVersion)
+	}
+
+	for migrated.Version < targetVersion {
+		codecMu.RLock()
+		m, ok := tokenMigration[migrated.Version]
+		codecMu.RUnlock()
+		if !ok {
+			return nil, fmt.Errorf("no migration from token schema %d", migrated.Version)
+		}
+		if err := m(&migrated); err != nil {
+			return nil, fmt.Errorf("migrating token from schema %d: %w", migrated.Version, err)
+		}
+		migrated.Version++
+	}
+
+	if migrated.Version == tokenSchemaV1 {
+		migrated.Version = 0 // v1 documents carry no version field
+	}
+	return &migrated, nil
+}
+
+// legacyTokenCodec reads unversioned documents, ignoring unknown fields as
+// the validators of that era did
+type legacyTokenCodec struct{}
+
+func (legacyTokenCodec) Version() int {
+	return tokenSchemaV1
+}
+
+func (legacyTokenCodec) Marshal(token *ForgeToken) ([]byte, error) {
+	if token.Version != 0 && token.Version != tokenSchemaV1 {
+		return nil, fmt.Errorf("token has schema version %d, not %d", token.Version, tokenSchemaV1)
+	}
+	data, err := json.Marshal(token)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal token: %w", err)
+	}
+	return data, nil
+}
+
+func (legacyTokenCodec) Unmarshal(data []byte) (*ForgeToken, error) {
+	var token ForgeToken
+	if err := json.Unmarshal(data, &token); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal token: %w", err)
+	}
+	token.Version = 0
+	return &token, nil
+}
+
+// strictTokenCodec handles versioned documents whose layout exactly matches
+// ForgeToken; unknown fields are an error
+type strictTokenCodec struct {
+	version int
+}
+
+func (c strictTokenCodec) Version() int {
+	return c.version
+}
+
+func (c strictTokenCodec) Marshal(token *ForgeToken) ([]byte, error) {
+	if token.Version != c.version {
+		return nil, fmt.Errorf("token has schema version %d, not %d", token.Version, c.version)
+	}
+	data, err := json.Marshal(token)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal token: %w", err)
+	}
+	return data, nil
+}
+
+func (c strictTokenCodec) Unmarshal(data []byte) (*ForgeToken, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+
+	var token ForgeToken
+	if err := dec.Decode(&token); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal schema %d token: %w", c.version, err)
+	}
+	return &token, nil
+}
@@ -0,0 +1,181 @@
+package forgeauth
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Scope grammar. A scope is a comma-separated set of terms:
+//
+//	runtime:execute                  a single permission
+//	runtime:execute,runtime:read     several permissions
+//	runtime:*                        everything under runtime:
+//	runtime:*:read                   read on every runtime component
+//	runtime:*,!runtime:shutdown      everything under runtime: except shutdown
+//
+// Terms are split on ':' into segments, which must not be empty and are
+// compared case-sensitively. A '*' segment matches exactly one segment,
+// except as the last segment where it matches one or more; '*' on its own
+// therefore matches every scope. Wildcards must be whole segments. A term
+// prefixed with '!' denies what it matches, and denials win over grants
+// regardless of order.
+
+// scopeTerm is one parsed term of a scope set
+type scopeTerm struct {
+	deny bool
+	segs []string
+}
+
+// parseScope parses a scope set. The empty scope is the empty set.
+func parseScope(scope string) ([]scopeTerm, error) {
+	if strings.TrimSpace(scope) == "" {
+		return nil, nil
+	}
+
+	var terms []scopeTerm
+	for _, raw := range strings.Split(scope, ",") {
+		raw = strings.TrimSpace(raw)
+		term := scopeTerm{}
+		if rest, ok := strings.CutPrefix(raw, "!"); ok {
+			term.deny = true
+			raw = rest
+		}
+		if raw == "" {
+			return nil, fmt.Errorf("invalid scope %q: empty term", scope)
+		}
+
+		term.segs = strings.Split(raw, ":")
+		for _, seg := range term.segs {
+			if seg == "" {
+				return nil, fmt.Errorf("invalid scope %q: empty segment in %q", scope, raw)
+			}
+			if seg != "*" && strings.ContainsAny(seg, "*!") {
+				return nil, fmt.Errorf("invalid scope %q: %q is not a literal or a whole-segment wildcard", scope, seg)
+			}
+		}
+		terms = append(terms, term)
+	}
+	return terms, nil
+}
+
+// ValidateScope rejects scopes that don't follow the grammar
+func ValidateScope(scope string) error {
+	_, err := parseScope(scope)
+	return err
+}
+
+// isLiteralScope reports whether scope names permissions without any
+// wildcard or denial
+func isLiteralScope(scope string) bool {
+	return !strings.ContainsAny(scope, "*!,")
+}
+
+// scopeAllows reports whether every permission of the required scope is
+// granted: each required grant must be covered by a granted term, and each
+// granted denial overlapping it must be denied by the requirement too. An
+// empty requirement accepts any valid token; unparseable scopes allow
+// nothing.
+func scopeAllows(granted, required string) bool {
+	if strings.TrimSpace(required) == "" {
+		return true
+	}
+	g, err := parseScope(granted)
+	if err != nil {
+		return false
+	}
+	r, err := parseScope(required)
+	if err != nil {
+		return false
+	}
+
+	for _, want := range r {
+		if want.deny {
+			continue
+		}
+		covered := false
+		for _, have := range g {
+			if !have.deny && segmentsCover(have.segs, want.segs) {
+				covered = true
+				break
+			}
+		}
+		if !covered {
+			return false
+		}
+
+		for _, have := range g {
+			if !have.deny || !segmentsIntersect(have.segs, want.segs) {
+				continue
+			}
+			excluded := false
+			for _, not := range r {
+				if not.deny && segmentsCover(not.segs, have.segs) {
+					excluded = true
+					break
+				}
+			}
+			if !excluded {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// scopeIntersects reports whether a token with scope a could exercise any
+// permission named by scope b
+func scopeIntersects(a, b string) bool {
+	at, err := parseScope(a)
+	if err != nil {
+		return false
+	}
+	bt, err := parseScope(b)
+	if err != nil {
+		return false
+	}
+	for _, x := range at {
+		for _, y := range bt {
+			if !x.deny && !y.deny && segmentsIntersect(x.segs, y.segs) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// segmentsRest reports whether p ends here in a trailing wildcard
+func segmentsRest(p []string) bool {
+	return len(p) == 1 && p[0] == "*"
+}
+
+// segmentsCover reports whether every scope matched by q is matched by p
+func segmentsCover(p, q []string) bool {
+	for {
+		switch {
+		case len(p) == 0:
+			return len(q) == 0
+		case segmentsRest(p):
+			return len(q) > 0
+		case len(q) == 0 || segmentsRest(q):
+			return false
+		case p[0] != "*" && p[0] != q[0]:
+			return false
+		}
+		p, q = p[1:], q[1:]
+	}
+}
+
+// segmentsIntersect reports whether some scope is matched by both p and q
+func segmentsIntersect(p, q []string) bool {
+	for {
+		switch {
+		case len(p) == 0 || len(q) == 0:
+			return len(p) == 0 && len(q) == 0
+		case segmentsRest(p) || segmentsRest(q):
+			return true
+		case p[0] != "*" && q[0] != "*" && p[0] != q[0]:
+			return false
+		}
+		p, q = p[1:], q[1:]
+	}
+}
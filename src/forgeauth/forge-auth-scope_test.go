@@ -0,0 +1,150 @@
+package forgeauth
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestScopeAllows(t *testing.T) {
+	tests := []struct {
+		granted, required string
+		want              bool
+	}{
+		// Literals
+		{"harmony:read", "harmony:read", true},
+		{"harmony:read", "harmony:write", false},
+		{"harmony:read,harmony:write", "harmony:write", true},
+		{"harmony:read", "harmony:read,harmony:write", false},
+		{" harmony:read , harmony:write ", "harmony:write,harmony:read", true},
+
+		// A prefix is not a grant, in either direction
+		{"harmony:readx", "harmony:read", false},
+		{"harmony:read", "harmony:readx", false},
+		{"harmony", "harmony:read", false},
+		{"harmony:read", "harmony", false},
+		{"harmony:read:all", "harmony:read", false},
+
+		// '*' as the first, a middle and the last segment
+		{"*", "harmony:read", true},
+		{"*", "harmony", true},
+		{"*:read", "harmony:read", true},
+		{"*:read", "runtime:read", true},
+		{"*:read", "harmony:write", false},
+		{"*:read", "harmony:quorum:read", false},
+		{"harmony:*:write", "harmony:redteam:write", true},
+		{"harmony:*:write", "harmony:redteam:read", false},
+		{"harmony:*:write", "harmony:write", false},
+		{"harmony:*:write", "harmony:a:b:write", false},
+		{"harmony:*", "harmony:read", true},
+		{"harmony:*", "harmony:quorum:report", true},
+		{"harmony:*", "harmony", false},
+		{"harmony:*", "runtime:read", false},
+
+		// Requiring a wildcard needs a grant at least as wide
+		{"harmony:*", "harmony:*", true},
+		{"*", "harmony:*", true},
+		{"harmony:read", "harmony:*", false},
+		{"harmony:*:write", "harmony:*", false},
+		{"harmony:*", "harmony:*:write", true},
+
+		// Denials win over grants, unless the requirement denies them too
+		{"harmony:*,!harmony:shutdown", "harmony:read", true},
+		{"harmony:*,!harmony:shutdown", "harmony:shutdown", false},
+		{"!harmony:shutdown,harmony:*", "harmony:shutdown", false},
+		{"harmony:*,!harmony:shutdown", "harmony:*", false},
+		{"harmony:*,!harmony:shutdown", "harmony:*,!harmony:shutdown", true},
+		{"harmony:*,!*:shutdown", "harmony:shutdown", false},
+		{"!harmony:read", "harmony:read", false},
+
+		// Segments are case-sensitive
+		{"Harmony:read", "harmony:read", false},
+		{"harmony:READ", "harmony:read", false},
+		{"harmony:*", "HARMONY:read", false},
+
+		// Empty requirements accept, empty grants and bad scopes allow nothing
+		{"", "", true},
+		{"harmony:read", "", true},
+		{"", "harmony:read", false},
+		{"harmony::read", "harmony::read", false},
+		{"harmony:", "harmony:read", false},
+		{":read", "harmony:read", false},
+		{"harmony:read,", "harmony:read", false},
+		{"harmony:re*d", "harmony:read", false},
+		{"harmony:**", "harmony:read", false},
+		{"harmony:!read", "harmony:read", false},
+		{"harmony:*", "harmony::read", false},
+	}
+	for _, tt := range tests {
+		if got := scopeAllows(tt.granted, tt.required); got != tt.want {
+			t.Errorf("scopeAllows(%q, %q) = %v, want %v", tt.granted, tt.required, got, tt.want)
+		}
+	}
+}
+
+func TestSegmentsCover(t *testing.T) {
+	tests := []struct {
+		p, q string
+		want bool
+	}{
+		{"a:b", "a:b", true},
+		{"a:b", "a:c", false},
+		{"a:b", "a", false},
+		{"a", "a:b", false},
+		{"ab", "a", false},
+		{"a", "ab", false},
+
+		// '*' at each position
+		{"*", "a", true},
+		{"*", "a:b:c", true},
+		{"*:b", "a:b", true},
+		{"*:b", "a:c", false},
+		{"*:b", "a:b:c", false},
+		{"a:*:c", "a:b:c", true},
+		{"a:*:c", "a:c", false},
+		{"a:*:c", "a:b:b:c", false},
+		{"a:*", "a:b", true},
+		{"a:*", "a:b:c", true},
+		{"a:*", "a", false},
+
+		// A wildcard covers a wildcard no wider than itself
+		{"a:*", "a:*", true},
+		{"*", "a:*", true},
+		{"a:*", "*", false},
+		{"a:b", "a:*", false},
+		{"*:b", "a:b", true},
+		{"a:*:c", "a:*:c", true},
+		{"a:*:c", "a:*", false},
+		{"a:*", "a:*:c", true},
+
+		// Empty segments only match themselves literally; parseScope refuses them
+		{"a::b", "a::b", true},
+		{"a:*:b", "a::b", true},
+		{"a:b", "a::b", false},
+
+		// Case matters
+		{"a:B", "a:b", false},
+		{"A:*", "a:b", false},
+	}
+	for _, tt := range tests {
+		p, q := strings.Split(tt.p, ":"), strings.Split(tt.q, ":")
+		if got := segmentsCover(p, q); got != tt.want {
+			t.Errorf("segmentsCover(%q, %q) = %v, want %v", tt.p, tt.q, got, tt.want)
+		}
+	}
+	if !segmentsCover(nil, nil) || segmentsCover(nil, []string{"a"}) || segmentsCover([]string{"*"}, nil) {
+		t.Error("segmentsCover of no segments: only nothing covers nothing")
+	}
+}
+
+func TestParseScope(t *testing.T) {
+	for _, scope := range []string{"", "  ", "a", "a:b,c:*", "*", "!a:b,a:*", " a:b , !a:b:c "} {
+		if err := ValidateScope(scope); err != nil {
+			t.Errorf("ValidateScope(%q) = %v, want nil", scope, err)
+		}
+	}
+	for _, scope := range []string{",", "a,", "!", "a:", ":a", "a::b", "a:b*", "a:*b", "a:!b", "!!a", "a,,b"} {
+		if err := ValidateScope(scope); err == nil {
+			t.Errorf("ValidateScope(%q) = nil, want an error", scope)
+		}
+	}
+}
@@ -0,0 +1,113 @@
+package forgeauth
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// SessionStore tracks the activity of sliding-session tokens. A store
+// shared by every validator keeps a session alive wherever it is used; the
+// default store only sees validations in this process.
+type SessionStore interface {
+	// Extend records activity on the session id if it has been idle for
+	// less than idle, counting from start when the session has not been
+	// seen before, and returns the new idle deadline. It returns the zero
+	// time once the session has gone idle; such a session must never be
+	// revived. After expiresAt the session may be forgotten.
+	Extend(ctx context.Context, id string, start time.Time, idle time.Duration, expiresAt time.Time) (time.Time, error)
+}
+
+// SetSessionStore replaces the store tracking sliding sessions
+func (fd *ForgeDominion) SetSessionStore(s SessionStore) {
+	fd.sessions = s
+}
+
+// RequestSession issues a sliding session for an interactive operator.
+// Every successful validation pushes the session's expiry out to idle from
+// now, and it expires for good after idle without use or after maxLifetime,
+// whichever comes first.
+func (fd *ForgeDominion) RequestSession(ctx context.Context, nodeID string, scope string, idle time.Duration, maxLifetime time.Duration) (*ForgeToken, error) {
+	return fd.requestToken(ctx, TokenSpec{NodeID: nodeID, Scope: scope, TTL: maxLifetime, IdleTimeout: idle}, "sliding session")
+}
+
+// validateIdleTimeout rejects idle timeouts that can't be signed exactly,
+// since the signed claim is in whole seconds
+func validateIdleTimeout(idle time.Duration) error {
+	if idle < 0 || idle%time.Second != 0 {
+		return fmt.Errorf("idle timeout must be a whole number of seconds")
+	}
+	return nil
+}
+
+// extendSession slides the expiry of a session token, failing closed if the
+// store is unavailable
+func extendSession(ctx context.Context, sessions SessionStore, token *ForgeToken) error {
+	if token.IdleTimeout == 0 {
+		return nil
+	}
+	if token.ID == "" {
+		return fmt.Errorf("%w: session token has no ID", ErrMalformed)
+	}
+	if sessions == nil {
+		return fmt.Errorf("%w: no session store configured", ErrExpired)
+	}
+
+	deadline, err := sessions.Extend(ctx, token.ID, token.IssuedAt, token.IdleTimeout, token.ExpiresAt)
+	if err != nil {
+		return fmt.Errorf("failed to extend session: %w", err)
+	}
+	if deadline.IsZero() {
+		return fmt.Errorf("%w: session %s idle for more than %s", ErrExpired, token.ID, token.IdleTimeout)
+	}
+	return nil
+}
+
+func (fd *ForgeDominion) extendSession(ctx context.Context, token *ForgeToken) error {
+	return extendSession(ctx, fd.sessions, token)
+}
+
+// memorySessionStore tracks session deadlines in memory
+type memorySessionStore struct {
+	now      func() time.Time
+	mu       sync.Mutex
+	sessions map[string]*sessionState
+}
+
+type sessionState struct {
+	deadline  time.Time // zero once idled out
+	expiresAt time.Time
+}
+
+func newMemorySessionStore(now func() time.Time) *memorySessionStore {
+	return &memorySessionStore{now: now, sessions: make(map[string]*sessionState)}
+}
+
+// Extend implements SessionStore
+func (s *memorySessionStore) Extend(ctx context.Context, id string, start time.Time, idle time.Duration, expiresAt time.Time) (time.Time, error) {
+	now := s.now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for k, st := range s.sessions {
+		if !st.expiresAt.After(now) {
+			delete(s.sessions, k)
+		}
+	}
+
+	st, ok := s.sessions[id]
+	if !ok {
+		st = &sessionState{deadline: start.Add(idle), expiresAt: expiresAt}
+		s.sessions[id] = st
+	}
+	if st.deadline.IsZero() || now.After(st.deadline) {
+		st.deadline = time.Time{}
+		return time.Time{}, nil
+	}
+
+	st.deadline = now.Add(idle)
+	if st.deadline.After(expiresAt) {
+		st.deadline = expiresAt
+	}
+	return st.deadline, nil
+}
@@ -0,0 +1,90 @@
+package forgeauth
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func requestTestSession(t *testing.T, fd *ForgeDominion, idle, maxLifetime time.Duration) *ForgeToken {
+	t.Helper()
+	token, err := fd.RequestSession(context.Background(), "operator-1", "runtime:read", idle, maxLifetime)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+func TestSessionSlides(t *testing.T) {
+	fd, clock := newTestDominion(t, AlgHS256)
+	token := requestTestSession(t, fd, 10*time.Minute, time.Hour)
+	// Each use buys another idle timeout, well past the first deadline
+	for i := range 5 {
+		clock.Advance(9 * time.Minute)
+		if err := fd.ValidateToken(token); err != nil {
+			t.Fatalf("use %d, %v in: %v", i+1, clock.Now().Sub(testEpoch), err)
+		}
+	}
+}
+
+func TestSessionIdleExpiry(t *testing.T) {
+	fd, clock := newTestDominion(t, AlgHS256)
+	token := requestTestSession(t, fd, 10*time.Minute, time.Hour)
+	if err := fd.ValidateToken(token); err != nil {
+		t.Fatal(err)
+	}
+	clock.Advance(10*time.Minute + time.Second)
+	if err := fd.ValidateToken(token); !errors.Is(err, ErrExpired) {
+		t.Fatalf("after idling: got %v, want %v", err, ErrExpired)
+	}
+	// An idled-out session stays dead, even used again at once
+	if err := fd.ValidateToken(token); !errors.Is(err, ErrExpired) {
+		t.Errorf("idled-out session revived: %v", err)
+	}
+}
+
+func TestSessionIdlesFromIssue(t *testing.T) {
+	fd, clock := newTestDominion(t, AlgHS256)
+	token := requestTestSession(t, fd, 10*time.Minute, time.Hour)
+	clock.Advance(11 * time.Minute)
+	if err := fd.ValidateToken(token); !errors.Is(err, ErrExpired) {
+		t.Errorf("session first used after idling: got %v, want %v", err, ErrExpired)
+	}
+}
+
+func TestSessionLifetimeCap(t *testing.T) {
+	fd, clock := newTestDominion(t, AlgHS256)
+	token := requestTestSession(t, fd, 10*time.Minute, 30*time.Minute)
+	for clock.Now().Before(token.ExpiresAt) {
+		if err := fd.ValidateToken(token); err != nil {
+			t.Fatalf("%v in: %v", clock.Now().Sub(testEpoch), err)
+		}
+		clock.Advance(5 * time.Minute)
+	}
+	clock.Set(token.ExpiresAt.Add(time.Second))
+	if err := fd.ValidateToken(token); !errors.Is(err, ErrExpired) {
+		t.Errorf("past the lifetime of an active session: got %v, want %v", err, ErrExpired)
+	}
+}
+
+func TestSessionDeadlineCappedAtLifetime(t *testing.T) {
+	clock := NewFakeClock(testEpoch)
+	s := newMemorySessionStore(clock.Now)
+	expiresAt := testEpoch.Add(15 * time.Minute)
+	clock.Advance(10 * time.Minute)
+	deadline, err := s.Extend(context.Background(), "s", testEpoch, 10*time.Minute, expiresAt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !deadline.Equal(expiresAt) {
+		t.Errorf("deadline %v, want it capped at the lifetime, %v", deadline, expiresAt)
+	}
+}
+
+func TestSessionIdleTimeoutWholeSeconds(t *testing.T) {
+	fd, _ := newTestDominion(t, AlgHS256)
+	if _, err := fd.RequestSession(context.Background(), "operator-1", "runtime:read", 1500*time.Millisecond, time.Hour); err == nil {
+		t.Error("idle timeout of a fraction of a second accepted")
+	}
+}
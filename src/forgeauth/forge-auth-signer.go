@@ -0,0 +1,180 @@
+package forgeauth
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"errors"
+	"fmt"
+	"slices"
+)
+
+// Signer signs token payloads. Besides the built-in algorithms, which sign
+// with keys derived from the dominion's KeyProvider, a Signer can delegate
+// to a KMS or HSM, or be a fake in tests; see RegisterSigner.
+type Signer interface {
+	Sign(ctx context.Context, payload []byte) ([]byte, error)
+}
+
+// Verifier checks signatures made by the matching Signer. A mismatch must
+// be reported with an error wrapping ErrBadSignature; other errors are
+// treated as one too.
+type Verifier interface {
+	Verify(ctx context.Context, payload, sig []byte) error
+}
+
+// MACSigner signs and verifies with a symmetric key, using one of the MAC
+// algorithms (AlgHS256, AlgHS512_256 or AlgBLAKE2b)
+type MACSigner struct {
+	Alg string
+	Key []byte
+}
+
+// Sign implements Signer
+func (s MACSigner) Sign(ctx context.Context, payload []byte) ([]byte, error) {
+	h, err := newMAC(s.Alg, s.Key)
+	if err != nil {
+		return nil, err
+	}
+	h.Write(payload)
+	return h.Sum(nil), nil
+}
+
+// Verify implements Verifier
+func (s MACSigner) Verify(ctx context.Context, payload, sig []byte) error {
+	expected, err := s.Sign(ctx, payload)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrBadSignature, err)
+	}
+	if !hmac.Equal(sig, expected) {
+		return ErrBadSignature
+	}
+	return nil
+}
+
+// Ed25519Signer signs with an Ed25519 private key
+type Ed25519Signer struct {
+	Key ed25519.PrivateKey
+}
+
+// Sign implements Signer
+func (s Ed25519Signer) Sign(ctx context.Context, payload []byte) ([]byte, error) {
+	if len(s.Key) != ed25519.PrivateKeySize {
+		return nil, fmt.Errorf("invalid Ed25519 private key")
+	}
+	return ed25519.Sign(s.Key, payload), nil
+}
+
+// Ed25519Verifier verifies with an Ed25519 public key
+type Ed25519Verifier struct {
+	Key ed25519.PublicKey
+}
+
+// Verify implements Verifier
+func (v Ed25519Verifier) Verify(ctx context.Context, payload, sig []byte) error {
+	if len(v.Key) != ed25519.PublicKeySize || !ed25519.Verify(v.Key, payload, sig) {
+		return ErrBadSignature
+	}
+	return nil
+}
+
+// registeredSigner is an algorithm added with RegisterSigner
+type registeredSigner struct {
+	signer   Signer
+	verifier Verifier
+}
+
+// RegisterSigner adds alg as a token algorithm backed by s and v, e.g.
+// "KMS-ES256". Select it for issuance with SetSigningAlg; tokens carrying
+// it as their alg claim are verified with v. A nil s registers alg for
+// verification only. The tokens' claims are covered exactly as for the
+// built-in algorithms; only the signature primitive changes.
+//
+// Registered algorithms can't replace the built-in ones and are not
+// available in FIPS mode, since the dominion can't vouch for them.
+func (fd *ForgeDominion) RegisterSigner(alg string, s Signer, v Verifier) error {
+	if alg == "" || slices.Contains(supportedAlgs, alg) {
+		return fmt.Errorf("alg %q is reserved", alg)
+	}
+	if v == nil {
+		return fmt.Errorf("alg %q needs a verifier", alg)
+	}
+	if err := fd.checkFIPSAlg(alg); err != nil {
+		return err
+	}
+	if fd.signers == nil {
+		fd.signers = make(map[string]registeredSigner)
+	}
+	fd.signers[alg] = registeredSigner{signer: s, verifier: v}
+	return nil
+}
+
+// knownAlg reports whether alg is built in or registered
+func (fd *ForgeDominion) knownAlg(alg string) bool {
+	_, ok := fd.signers[alg]
+	return ok || slices.Contains(supportedAlgs, alg)
+}
+
+// signerFor returns the signer and verifier for token's alg. The built-in
+// algorithms use keys; a nil Signer means alg is verify-only.
+func (fd *ForgeDominion) signerFor(keys KeyProvider, token *ForgeToken) (Signer, Verifier) {
+	if r, ok := fd.signers[TokenAlg(token)]; ok {
+		return r.signer, r.verifier
+	}
+	d := derivedSigner{keys: keys, alg: TokenAlg(token), tenantID: token.TenantID, nodeID: token.NodeID}
+	return d, d
+}
+
+// derivedSigner implements the built-in algorithms: MACs keyed per node and
+// Ed25519 keyed per tenant, derived from keys on each call and cleared
+// afterwards
+type derivedSigner struct {
+	keys     KeyProvider
+	alg      string
+	tenantID string
+	nodeID   string
+}
+
+func (d derivedSigner) Sign(ctx context.Context, payload []byte) ([]byte, error) {
+	if d.alg == AlgEd25519 {
+		priv, err := signingKey(ctx, d.keys, d.tenantID)
+		if err != nil {
+			return nil, err
+		}
+		defer clear(priv)
+		return Ed25519Signer{Key: priv}.Sign(ctx, payload)
+	}
+
+	key, err := deriveNodeKey(ctx, d.keys, d.tenantID, d.nodeID)
+	if err != nil {
+		return nil, err
+	}
+	defer clear(key)
+	return MACSigner{Alg: d.alg, Key: key}.Sign(ctx, payload)
+}
+
+func (d derivedSigner) Verify(ctx context.Context, payload, sig []byte) error {
+	if d.alg == AlgEd25519 {
+		pub, err := publicKey(ctx, d.keys, d.tenantID)
+		if err != nil {
+			return fmt.Errorf("%w: %v", ErrBadSignature, err)
+		}
+		return Ed25519Verifier{Key: pub}.Verify(ctx, payload, sig)
+	}
+
+	key, err := deriveNodeKey(ctx, d.keys, d.tenantID, d.nodeID)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrBadSignature, err)
+	}
+	defer clear(key)
+	return MACSigner{Alg: d.alg, Key: key}.Verify(ctx, payload, sig)
+}
+
+// verifyPayload runs v, classing every failure as ErrBadSignature
+func verifyPayload(ctx context.Context, v Verifier, payload, sig []byte) error {
+	err := v.Verify(ctx, payload, sig)
+	if err != nil && !errors.Is(err, ErrBadSignature) {
+		return fmt.Errorf("%w: %v", ErrBadSignature, err)
+	}
+	return err
+}
@@ -0,0 +1,106 @@
+package forgeauth
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// SVIDVerifier checks SPIFFE X.509 SVIDs presented as proof of node
+// identity, so nodes can bootstrap tokens from the workload identity mesh
+// instead of a shared secret
+type SVIDVerifier struct {
+	// TrustDomain is the only SPIFFE trust domain accepted, e.g.
+	// "bridge.example.org"
+	TrustDomain string
+
+	// Roots is the trust domain's X.509 bundle
+	Roots *x509.CertPool
+
+	// MapID converts a verified SPIFFE ID to a NodeID. The default uses the
+	// ID path without its leading slash, so
+	// spiffe://bridge.example.org/runtime/node-001 becomes
+	// "runtime/node-001".
+	MapID func(id *url.URL) (string, error)
+
+	// TenantID, if set, is stamped on every token issued via this verifier
+	TenantID string
+}
+
+// Verify checks an SVID chain (leaf first) and returns its SPIFFE ID
+func (v *SVIDVerifier) Verify(chain []*x509.Certificate) (*url.URL, error) {
+	if len(chain) == 0 {
+		return nil, fmt.Errorf("no SVID presented")
+	}
+	if v.Roots == nil {
+		return nil, fmt.Errorf("SVID verifier has no trust bundle")
+	}
+
+	leaf := chain[0]
+	if leaf.IsCA {
+		return nil, fmt.Errorf("SVID leaf must not be a CA certificate")
+	}
+	if len(leaf.URIs) != 1 {
+		return nil, fmt.Errorf("SVID must carry exactly one URI SAN, found %d", len(leaf.URIs))
+	}
+
+	id := leaf.URIs[0]
+	if id.Scheme != "spiffe" || id.Host == "" || id.User != nil || id.RawQuery != "" || id.Fragment != "" {
+		return nil, fmt.Errorf("invalid SPIFFE ID %q", id)
+	}
+	if !strings.EqualFold(id.Host, v.TrustDomain) {
+		return nil, fmt.Errorf("SPIFFE ID %q is not in trust domain %q", id, v.TrustDomain)
+	}
+
+	intermediates := x509.NewCertPool()
+	for _, cert := range chain[1:] {
+		intermediates.AddCert(cert)
+	}
+	if _, err := leaf.Verify(x509.VerifyOptions{
+		Roots:         v.Roots,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}); err != nil {
+		return nil, fmt.Errorf("SVID chain verification failed: %w", err)
+	}
+
+	return id, nil
+}
+
+// nodeID maps a verified SPIFFE ID to a NodeID
+func (v *SVIDVerifier) nodeID(id *url.URL) (string, error) {
+	if v.MapID != nil {
+		return v.MapID(id)
+	}
+	nodeID := strings.TrimPrefix(id.Path, "/")
+	if nodeID == "" {
+		return "", fmt.Errorf("SPIFFE ID %q has no path to map to a node", id)
+	}
+	return nodeID, nil
+}
+
+// RequestTokenWithSVID issues a token to the node identified by an SVID
+// chain (leaf first), verified against v
+func (fd *ForgeDominion) RequestTokenWithSVID(v *SVIDVerifier, chain []*x509.Certificate, scope string, ttl time.Duration) (*ForgeToken, error) {
+	id, err := v.Verify(chain)
+	if err != nil {
+		return nil, err
+	}
+
+	nodeID, err := v.nodeID(id)
+	if err != nil {
+		return nil, err
+	}
+
+	return fd.requestToken(context.Background(), TokenSpec{TenantID: v.TenantID, NodeID: nodeID, Scope: scope, TTL: ttl}, "spiffe_id="+id.String())
+}
+
+// RequestTokenForPeer issues a token to the client of an mTLS connection
+// whose certificate is an SVID
+func (fd *ForgeDominion) RequestTokenForPeer(v *SVIDVerifier, state tls.ConnectionState, scope string, ttl time.Duration) (*ForgeToken, error) {
+	return fd.RequestTokenWithSVID(v, state.PeerCertificates, scope, ttl)
+}
@@ -0,0 +1,309 @@
+package forgeauth
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	_ "modernc.org/sqlite"
+)
+
+// sqliteSchema creates the store's tables. Times are Unix nanoseconds so
+// they compare as integers; zero means unset.
+const sqliteSchema = `
+CREATE TABLE IF NOT EXISTS ledger (
+	seq        INTEGER PRIMARY KEY,
+	kind       TEXT NOT NULL,
+	time       INTEGER NOT NULL,
+	jti        TEXT NOT NULL DEFAULT '',
+	tenant_id  TEXT NOT NULL DEFAULT '',
+	node_id    TEXT NOT NULL DEFAULT '',
+	scope      TEXT NOT NULL DEFAULT '',
+	audience   TEXT NOT NULL DEFAULT '',
+	issued_at  INTEGER NOT NULL DEFAULT 0,
+	expires_at INTEGER NOT NULL DEFAULT 0,
+	sid        TEXT NOT NULL DEFAULT ''
+);
+CREATE INDEX IF NOT EXISTS ledger_expires_at ON ledger (expires_at);
+CREATE TABLE IF NOT EXISTS token_uses (
+	jti        TEXT PRIMARY KEY,
+	uses       INTEGER NOT NULL,
+	expires_at INTEGER NOT NULL
+);
+CREATE TABLE IF NOT EXISTS sessions (
+	jti        TEXT PRIMARY KEY,
+	deadline   INTEGER NOT NULL,
+	expires_at INTEGER NOT NULL
+);
+CREATE TABLE IF NOT EXISTS enrollments (
+	digest     TEXT PRIMARY KEY,
+	tenant_id  TEXT NOT NULL,
+	node_id    TEXT NOT NULL,
+	scope      TEXT NOT NULL,
+	ttl        INTEGER NOT NULL,
+	expires_at INTEGER NOT NULL
+);
+CREATE TABLE IF NOT EXISTS audit (
+	seq   INTEGER PRIMARY KEY,
+	time  INTEGER NOT NULL,
+	event TEXT NOT NULL,
+	entry TEXT NOT NULL
+);
+CREATE INDEX IF NOT EXISTS audit_time ON audit (time);
+`
+
+// SQLiteStore keeps a single-node dominion's state in one SQLite file: the
+// issuance ledger and revocations, the usage counts and session deadlines
+// that stop replays of limited tokens, pending enrollments and the audit
+// trail. Attach it with SetStore.
+type SQLiteStore struct {
+	db *sql.DB
+}
+
+// OpenSQLiteStore opens or creates the store at path
+func OpenSQLiteStore(path string) (*SQLiteStore, error) {
+	db, err := sql.Open("sqlite", "file:"+path+"?_pragma=journal_mode(WAL)&_pragma=busy_timeout(5000)&_pragma=synchronous(FULL)")
+	if err != nil {
+		return nil, fmt.Errorf("failed to open store: %w", err)
+	}
+	// One connection serializes writers, so the read-modify-write of
+	// sessions needs no SQLite-level locking
+	db.SetMaxOpenConns(1)
+	if _, err := db.Exec(sqliteSchema); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to initialize store %s: %w", path, err)
+	}
+	return &SQLiteStore{db: db}, nil
+}
+
+// Close closes the database
+func (s *SQLiteStore) Close() error {
+	return s.db.Close()
+}
+
+// SetStore makes s the dominion's ledger, usage counter, session store,
+// enrollment store and audit sink, restoring its revocations and key
+// retirements
+func (fd *ForgeDominion) SetStore(s *SQLiteStore) error {
+	entries, err := s.Entries()
+	if err != nil {
+		return err
+	}
+	fd.restoreRevocations(entries)
+	fd.ledger = s
+	fd.uses = s
+	fd.sessions = s
+	fd.enrollments = s
+	fd.audit = s
+	return nil
+}
+
+func unixNano(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.UnixNano()
+}
+
+func fromUnixNano(n int64) time.Time {
+	if n == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, n)
+}
+
+// Append writes ledger entries in one transaction
+func (s *SQLiteStore) Append(entries ...LedgerEntry) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to append to store: %w", err)
+	}
+	defer tx.Rollback()
+	for _, e := range entries {
+		_, err := tx.Exec(`INSERT INTO ledger (kind, time, jti, tenant_id, node_id, scope, audience, issued_at, expires_at, sid)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+			e.Kind, unixNano(e.Time), e.ID, e.TenantID, e.NodeID, e.Scope, e.Audience, unixNano(e.IssuedAt), unixNano(e.ExpiresAt), e.SessionID)
+		if err != nil {
+			return fmt.Errorf("failed to append to store: %w", err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to append to store: %w", err)
+	}
+	return nil
+}
+
+// Entries returns every ledger record in the store
+func (s *SQLiteStore) Entries() ([]LedgerEntry, error) {
+	rows, err := s.db.Query(`SELECT kind, time, jti, tenant_id, node_id, scope, audience, issued_at, expires_at, sid
+		FROM ledger ORDER BY seq`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read store: %w", err)
+	}
+	defer rows.Close()
+
+	var entries []LedgerEntry
+	for rows.Next() {
+		var e LedgerEntry
+		var at, issuedAt, expiresAt int64
+		if err := rows.Scan(&e.Kind, &at, &e.ID, &e.TenantID, &e.NodeID, &e.Scope, &e.Audience, &issuedAt, &expiresAt, &e.SessionID); err != nil {
+			return nil, fmt.Errorf("failed to read store: %w", err)
+		}
+		e.Time, e.IssuedAt, e.ExpiresAt = fromUnixNano(at), fromUnixNano(issuedAt), fromUnixNano(expiresAt)
+		entries = append(entries, e)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read store: %w", err)
+	}
+	return entries, nil
+}
+
+// Outstanding returns the issue records of tokens that have not expired
+// and have not been revoked, as Ledger.Outstanding does
+func (s *SQLiteStore) Outstanding() ([]LedgerEntry, error) {
+	entries, err := s.Entries()
+	if err != nil {
+		return nil, err
+	}
+	return outstanding(entries, time.Now()), nil
+}
+
+func (s *SQLiteStore) records() ([]LedgerEntry, error) {
+	return s.Entries()
+}
+
+// Use implements UsageCounter
+func (s *SQLiteStore) Use(ctx context.Context, id string, expiresAt time.Time) (int, error) {
+	var n int
+	err := s.db.QueryRowContext(ctx, `INSERT INTO token_uses (jti, uses, expires_at) VALUES (?, 1, ?)
+		ON CONFLICT (jti) DO UPDATE SET uses = uses + 1 RETURNING uses`, id, unixNano(expiresAt)).Scan(&n)
+	if err != nil {
+		return 0, fmt.Errorf("failed to count use: %w", err)
+	}
+	return n, nil
+}
+
+// Extend implements SessionStore
+func (s *SQLiteStore) Extend(ctx context.Context, id string, start time.Time, idle time.Duration, expiresAt time.Time) (time.Time, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return time.Time{}, err
+	}
+	defer tx.Rollback()
+
+	now := time.Now()
+	deadline := start.Add(idle)
+	var stored int64
+	err = tx.QueryRowContext(ctx, `SELECT deadline FROM sessions WHERE jti = ?`, id).Scan(&stored)
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+	case err != nil:
+		return time.Time{}, err
+	default:
+		deadline = fromUnixNano(stored)
+	}
+
+	if deadline.IsZero() || now.After(deadline) {
+		deadline = time.Time{}
+	} else {
+		deadline = now.Add(idle)
+		if deadline.After(expiresAt) {
+			deadline = expiresAt
+		}
+	}
+	_, err = tx.ExecContext(ctx, `INSERT INTO sessions (jti, deadline, expires_at) VALUES (?, ?, ?)
+		ON CONFLICT (jti) DO UPDATE SET deadline = excluded.deadline`, id, unixNano(deadline), unixNano(expiresAt))
+	if err != nil {
+		return time.Time{}, err
+	}
+	if err := tx.Commit(); err != nil {
+		return time.Time{}, err
+	}
+	return deadline, nil
+}
+
+// PutEnrollment implements EnrollmentStore
+func (s *SQLiteStore) PutEnrollment(ctx context.Context, e Enrollment) error {
+	_, err := s.db.ExecContext(ctx, `INSERT INTO enrollments (digest, tenant_id, node_id, scope, ttl, expires_at) VALUES (?, ?, ?, ?, ?, ?)`,
+		e.Digest, e.TenantID, e.NodeID, e.Scope, int64(e.TTL), unixNano(e.ExpiresAt))
+	return err
+}
+
+// TakeEnrollment implements EnrollmentStore
+func (s *SQLiteStore) TakeEnrollment(ctx context.Context, digest string) (Enrollment, bool, error) {
+	e := Enrollment{Digest: digest}
+	var ttl, expiresAt int64
+	err := s.db.QueryRowContext(ctx, `DELETE FROM enrollments WHERE digest = ? RETURNING tenant_id, node_id, scope, ttl, expires_at`, digest).
+		Scan(&e.TenantID, &e.NodeID, &e.Scope, &ttl, &expiresAt)
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		return Enrollment{}, false, nil
+	case err != nil:
+		return Enrollment{}, false, err
+	}
+	e.TTL, e.ExpiresAt = time.Duration(ttl), fromUnixNano(expiresAt)
+	return e, true, nil
+}
+
+// Record implements AuditSink. Write errors are dropped so auditing never
+// blocks issuance.
+func (s *SQLiteStore) Record(entry AuditEntry) {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return
+	}
+	_, _ = s.db.Exec(`INSERT INTO audit (time, event, entry) VALUES (?, ?, ?)`, unixNano(entry.Time), entry.Event, string(data))
+}
+
+// AuditEntries returns the audit records made at or after since, oldest
+// first
+func (s *SQLiteStore) AuditEntries(since time.Time) ([]AuditEntry, error) {
+	rows, err := s.db.Query(`SELECT entry FROM audit WHERE time >= ? ORDER BY seq`, unixNano(since))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read audit records: %w", err)
+	}
+	defer rows.Close()
+
+	var entries []AuditEntry
+	for rows.Next() {
+		var data string
+		var entry AuditEntry
+		if err := rows.Scan(&data); err != nil {
+			return nil, fmt.Errorf("failed to read audit records: %w", err)
+		}
+		if err := json.Unmarshal([]byte(data), &entry); err != nil {
+			return nil, fmt.Errorf("invalid audit record: %w", err)
+		}
+		entries = append(entries, entry)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read audit records: %w", err)
+	}
+	return entries, nil
+}
+
+// Prune deletes ledger records, usage counts and sessions of tokens that
+// expired before now, as Ledger.Compact does, and expired enrollments. Audit records older than
+// auditBefore are deleted too; a zero auditBefore keeps them all.
+func (s *SQLiteStore) Prune(now time.Time, auditBefore time.Time) error {
+	cutoff := unixNano(now)
+	for _, stmt := range []string{
+		`DELETE FROM ledger WHERE expires_at != 0 AND expires_at <= ?`,
+		`DELETE FROM token_uses WHERE expires_at <= ?`,
+		`DELETE FROM sessions WHERE expires_at <= ?`,
+		`DELETE FROM enrollments WHERE expires_at <= ?`,
+	} {
+		if _, err := s.db.Exec(stmt, cutoff); err != nil {
+			return fmt.Errorf("failed to prune store: %w", err)
+		}
+	}
+	if !auditBefore.IsZero() {
+		if _, err := s.db.Exec(`DELETE FROM audit WHERE time < ?`, unixNano(auditBefore)); err != nil {
+			return fmt.Errorf("failed to prune audit records: %w", err)
+		}
+	}
+	return nil
+}
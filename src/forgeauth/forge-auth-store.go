@@ -0,0 +1,265 @@
+package forgeauth
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// sealedTokenFormat identifies an encrypted token file. Files of
+// legacySealedTokenFormat were sealed with a key derived from the machine ID
+// and are only opened, never written.
+const (
+	sealedTokenFormat       = "forge-token-sealed/v2"
+	legacySealedTokenFormat = "forge-token-sealed/v1"
+)
+
+// storeKeyInfo is the HKDF info string for the legacy machine-bound key
+const storeKeyInfo = "forge-dominion/token-store/v1"
+
+// storeKeySize is the size of the storage key, for AES-256
+const storeKeySize = 32
+
+// sealedToken is the on-disk envelope for an encrypted token
+type sealedToken struct {
+	Format     string `json:"format"`
+	Nonce      string `json:"nonce"`
+	Ciphertext string `json:"ciphertext"`
+}
+
+// machineIDPaths are checked in order for the legacy machine-bound key
+var machineIDPaths = []string{
+	"/etc/machine-id",
+	"/var/lib/dbus/machine-id",
+}
+
+// storageKey returns the AES-256 key used for token files. It is read from
+// FORGE_TOKEN_STORE_KEY if set, e.g. for containers without a persistent
+// config dir, and otherwise from the user's key file, which is created with
+// a random key on first use.
+func storageKey() ([]byte, error) {
+	if override := os.Getenv("FORGE_TOKEN_STORE_KEY"); override != "" {
+		key, err := decodeStoreKey(override)
+		if err != nil {
+			return nil, fmt.Errorf("invalid FORGE_TOKEN_STORE_KEY: %w", err)
+		}
+		return key, nil
+	}
+
+	path, err := storeKeyPath()
+	if err != nil {
+		return nil, err
+	}
+	key, err := readStoreKey(path)
+	if errors.Is(err, os.ErrNotExist) {
+		key, err = createStoreKey(path)
+	}
+	return key, err
+}
+
+// storeKeyPath returns where the storage key is kept. FORGE_TOKEN_STORE_KEY_FILE
+// overrides the default under the user config dir.
+func storeKeyPath() (string, error) {
+	if path := os.Getenv("FORGE_TOKEN_STORE_KEY_FILE"); path != "" {
+		return path, nil
+	}
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", fmt.Errorf("no config dir for the token store key; set FORGE_TOKEN_STORE_KEY: %w", err)
+	}
+	return filepath.Join(dir, "forge-auth", "store.key"), nil
+}
+
+// readStoreKey reads the key file at path, refusing one that others can read
+func readStoreKey(path string) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return nil, fmt.Errorf("failed to stat token store key: %w", err)
+	}
+	if info.Mode().Perm()&0o077 != 0 {
+		return nil, fmt.Errorf("token store key %s has mode %v; it must not be readable by others (chmod 600)", path, info.Mode().Perm())
+	}
+	data, err := io.ReadAll(io.LimitReader(f, 1<<10))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read token store key: %w", err)
+	}
+	key, err := decodeStoreKey(strings.TrimSpace(string(data)))
+	if err != nil {
+		return nil, fmt.Errorf("invalid token store key %s: %w", path, err)
+	}
+	return key, nil
+}
+
+// createStoreKey writes a new random key to path. The key is written to a
+// temporary file and linked into place, so a concurrent caller either reads
+// the whole key or creates none; whichever link loses reads the winner's.
+func createStoreKey(path string) ([]byte, error) {
+	key := make([]byte, storeKeySize)
+	if _, err := rand.Read(key); err != nil {
+		return nil, fmt.Errorf("failed to generate token store key: %w", err)
+	}
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create token store key dir: %w", err)
+	}
+	tmp, err := os.CreateTemp(dir, ".store.key-*")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create token store key: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	_, err = tmp.WriteString(base64.URLEncoding.EncodeToString(key) + "\n")
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to write token store key: %w", err)
+	}
+	if err := os.Link(tmp.Name(), path); err != nil {
+		if errors.Is(err, os.ErrExist) {
+			return readStoreKey(path)
+		}
+		return nil, fmt.Errorf("failed to install token store key: %w", err)
+	}
+	return key, nil
+}
+
+func decodeStoreKey(encoded string) ([]byte, error) {
+	key, err := base64.URLEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, err
+	}
+	if len(key) != storeKeySize {
+		return nil, fmt.Errorf("key must decode to %d bytes, got %d", storeKeySize, len(key))
+	}
+	return key, nil
+}
+
+// legacyStorageKey derives the key token files of legacySealedTokenFormat
+// were sealed with, from the machine ID and uid. Both are readable by any
+// local user, which is why new files use storageKey instead.
+func legacyStorageKey() ([]byte, error) {
+	machineID, err := machineIdentity()
+	if err != nil {
+		return nil, err
+	}
+	secret := machineID + ":" + strconv.Itoa(os.Getuid())
+	key, err := hkdf.Key(sha256.New, []byte(secret), nil, storeKeyInfo, storeKeySize)
+	if err != nil {
+		return nil, fmt.Errorf("failed to derive legacy storage key: %w", err)
+	}
+	return key, nil
+}
+
+// machineIdentity returns a stable identifier for the current host
+func machineIdentity() (string, error) {
+	for _, path := range machineIDPaths {
+		data, err := os.ReadFile(path)
+		if err == nil {
+			if id := strings.TrimSpace(string(data)); id != "" {
+				return id, nil
+			}
+		}
+	}
+
+	hostname, err := os.Hostname()
+	if err != nil || hostname == "" {
+		return "", fmt.Errorf("no machine identity available for the legacy token file")
+	}
+	return hostname, nil
+}
+
+// sealTokenData encrypts serialized token JSON into a sealed envelope
+func sealTokenData(plaintext []byte) ([]byte, error) {
+	key, err := storageKey()
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err := newStoreAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, fmt.Errorf("failed to generate nonce: %w", err)
+	}
+
+	envelope := sealedToken{
+		Format:     sealedTokenFormat,
+		Nonce:      base64.URLEncoding.EncodeToString(nonce),
+		Ciphertext: base64.URLEncoding.EncodeToString(aead.Seal(nil, nonce, plaintext, []byte(sealedTokenFormat))),
+	}
+	return json.MarshalIndent(envelope, "", "  ")
+}
+
+// openTokenData returns the token JSON held in data, decrypting it if the
+// file is a sealed envelope and passing plaintext files through untouched.
+func openTokenData(data []byte) ([]byte, error) {
+	var envelope sealedToken
+	if err := json.Unmarshal(data, &envelope); err != nil || envelope.Format == "" {
+		return data, nil
+	}
+	keyFor := storageKey
+	switch envelope.Format {
+	case sealedTokenFormat:
+	case legacySealedTokenFormat:
+		keyFor = legacyStorageKey
+	default:
+		return nil, fmt.Errorf("unsupported token file format %q", envelope.Format)
+	}
+
+	nonce, err := base64.URLEncoding.DecodeString(envelope.Nonce)
+	if err != nil {
+		return nil, fmt.Errorf("invalid token file nonce: %w", err)
+	}
+	ciphertext, err := base64.URLEncoding.DecodeString(envelope.Ciphertext)
+	if err != nil {
+		return nil, fmt.Errorf("invalid token file ciphertext: %w", err)
+	}
+
+	key, err := keyFor()
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newStoreAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(nonce) != aead.NonceSize() {
+		return nil, fmt.Errorf("invalid token file nonce length %d", len(nonce))
+	}
+
+	plaintext, err := aead.Open(nil, nonce, ciphertext, []byte(envelope.Format))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt token file (sealed with another store key?): %w", err)
+	}
+	return plaintext, nil
+}
+
+func newStoreAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to initialize token cipher: %w", err)
+	}
+	return cipher.NewGCM(block)
+}
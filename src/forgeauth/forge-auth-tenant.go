@@ -0,0 +1,162 @@
+package forgeauth
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// KeyProvider supplies root key material. The empty tenant ID names the
+// dominion's default root key; every other tenant must have its own key so
+// tokens can never validate across tenants.
+type KeyProvider interface {
+	RootKey(tenantID string) ([]byte, error)
+}
+
+// ContextKeyProvider is implemented by key providers backed by a network
+// service such as a KMS or Vault. The dominion prefers RootKeyContext so
+// slow lookups honour the caller's cancellation and deadline.
+type ContextKeyProvider interface {
+	KeyProvider
+	RootKeyContext(ctx context.Context, tenantID string) ([]byte, error)
+}
+
+// rootKey fetches tenantID's root key from keys, passing ctx through to
+// providers that accept one, and enforces minRootKeyLen whatever the
+// provider
+func rootKey(ctx context.Context, keys KeyProvider, tenantID string) ([]byte, error) {
+	var key []byte
+	var err error
+	if p, ok := keys.(ContextKeyProvider); ok {
+		key, err = p.RootKeyContext(ctx, tenantID)
+	} else if err = ctx.Err(); err == nil {
+		key, err = keys.RootKey(tenantID)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(key) < minRootKeyLen {
+		return nil, fmt.Errorf("root key for tenant %q must be at least %d bytes, got %d", tenantID, minRootKeyLen, len(key))
+	}
+	return key, nil
+}
+
+// EnvKeyProvider reads root keys from the environment: FORGE_DOMINION_ROOT
+// for the default tenant and FORGE_DOMINION_ROOT_<TENANT> for others, with
+// the tenant ID upper-cased and '-' replaced by '_'. So that no two tenants
+// share a variable, it refuses tenant IDs other than lower-case letters,
+// digits and '-'; tenants named otherwise need another KeyProvider. Each
+// call decodes a fresh copy; NewForgeDominion instead keeps one copy per
+// tenant in locked memory that Close zeroizes.
+type EnvKeyProvider struct{}
+
+// RootKey returns the decoded root key for tenantID
+func (EnvKeyProvider) RootKey(tenantID string) ([]byte, error) {
+	name, err := envRootKeyName(tenantID)
+	if err != nil {
+		return nil, err
+	}
+
+	encoded := os.Getenv(name)
+	if encoded == "" {
+		return nil, fmt.Errorf("%s not set", name)
+	}
+
+	key, err := base64.URLEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s: %w", name, err)
+	}
+	if len(key) < minRootKeyLen {
+		return nil, fmt.Errorf("%s must decode to at least %d bytes, got %d", name, minRootKeyLen, len(key))
+	}
+	return key, nil
+}
+
+// envRootKeyName returns the variable holding tenantID's root key, for
+// tenant IDs that map to one no other tenant ID maps to
+func envRootKeyName(tenantID string) (string, error) {
+	if tenantID == "" {
+		return "FORGE_DOMINION_ROOT", nil
+	}
+	for _, r := range tenantID {
+		switch {
+		case r >= 'a' && r <= 'z', r >= '0' && r <= '9', r == '-':
+		default:
+			return "", fmt.Errorf("tenant ID %q has no environment variable of its own: only lower-case letters, digits and '-' map one-to-one", tenantID)
+		}
+	}
+	return "FORGE_DOMINION_ROOT_" + strings.ToUpper(strings.ReplaceAll(tenantID, "-", "_")), nil
+}
+
+// StaticKeyProvider holds root keys in memory, keyed by tenant ID
+type StaticKeyProvider map[string][]byte
+
+// Close zeroizes and removes every key. Dominions sharing the provider
+// stop working with it.
+func (p StaticKeyProvider) Close() error {
+	for tenantID, key := range p {
+		clear(key)
+		delete(p, tenantID)
+	}
+	return nil
+}
+
+// Format implements fmt.Formatter so logging the provider never prints
+// its keys
+func (p StaticKeyProvider) Format(f fmt.State, verb rune) {
+	fmt.Fprintf(f, "StaticKeyProvider{%d keys}", len(p))
+}
+
+// RootKey returns the root key registered for tenantID
+func (p StaticKeyProvider) RootKey(tenantID string) ([]byte, error) {
+	key, ok := p[tenantID]
+	if !ok {
+		if tenantID == "" {
+			return nil, fmt.Errorf("no default root key configured")
+		}
+		return nil, fmt.Errorf("unknown tenant %q", tenantID)
+	}
+	if len(key) < minRootKeyLen {
+		return nil, fmt.Errorf("root key for tenant %q must be at least %d bytes, got %d", tenantID, minRootKeyLen, len(key))
+	}
+	return key, nil
+}
+
+// validateTenantID restricts tenant IDs to characters that can't collide
+// with the separators used in key derivation and audit records
+func validateTenantID(tenantID string) error {
+	for _, r := range tenantID {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '-', r == '_', r == '.':
+		default:
+			return fmt.Errorf("invalid tenant ID %q: only letters, digits, '-', '_' and '.' are allowed", tenantID)
+		}
+	}
+	return nil
+}
+
+// RequestTenantToken issues a token bound to tenantID and signed with that
+// tenant's key material
+func (fd *ForgeDominion) RequestTenantToken(tenantID string, nodeID string, scope string, ttl time.Duration) (*ForgeToken, error) {
+	if tenantID == "" {
+		return nil, fmt.Errorf("tenant ID is empty")
+	}
+	return fd.requestToken(context.Background(), TokenSpec{TenantID: tenantID, NodeID: nodeID, Scope: scope, TTL: ttl}, "")
+}
+
+// ValidateTokenForTenant validates a token and additionally requires that it
+// was issued to tenantID. Services acting for one tenant should use this so
+// a multi-tenant dominion never accepts another tenant's token on their
+// behalf.
+func (fd *ForgeDominion) ValidateTokenForTenant(token *ForgeToken, tenantID string) error {
+	if err := fd.ValidateToken(token); err != nil {
+		return err
+	}
+	if token.TenantID != tenantID {
+		return fmt.Errorf("%w: %q, not %q", ErrTenantMismatch, token.TenantID, tenantID)
+	}
+	return nil
+}
@@ -0,0 +1,43 @@
+package forgeauth
+
+import "testing"
+
+func TestEnvRootKeyName(t *testing.T) {
+	tests := []struct {
+		tenantID string
+		want     string // empty for a refused tenant ID
+	}{
+		{"", "FORGE_DOMINION_ROOT"},
+		{"acme", "FORGE_DOMINION_ROOT_ACME"},
+		{"acme-eu2", "FORGE_DOMINION_ROOT_ACME_EU2"},
+		// Each of these would share a variable with one of the above
+		{"ACME", ""},
+		{"acme_eu2", ""},
+		{"acme.eu2", ""},
+		{"Acme-EU2", ""},
+	}
+	for _, tt := range tests {
+		got, err := envRootKeyName(tt.tenantID)
+		if tt.want == "" {
+			if err == nil {
+				t.Errorf("envRootKeyName(%q) = %q, want an error", tt.tenantID, got)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("envRootKeyName(%q) = %q, %v, want %q", tt.tenantID, got, err, tt.want)
+		}
+	}
+}
+
+func TestEnvKeyProviderRefusesCollidingTenants(t *testing.T) {
+	t.Setenv("FORGE_DOMINION_ROOT_ACME_EU", "MDEyMzQ1Njc4OWFiY2RlZjAxMjM0NTY3ODlhYmNkZWY=")
+	if _, err := (EnvKeyProvider{}).RootKey("acme-eu"); err != nil {
+		t.Fatal(err)
+	}
+	for _, other := range []string{"acme_eu", "acme.eu", "ACME-EU"} {
+		if _, err := (EnvKeyProvider{}).RootKey(other); err == nil {
+			t.Errorf("tenant %q got acme-eu's key", other)
+		}
+	}
+}
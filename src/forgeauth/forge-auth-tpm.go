@@ -0,0 +1,320 @@
+package forgeauth
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TPM 2.0 constants used when parsing quotes (TPM 2.0 Part 2)
+const (
+	tpmGeneratedValue = 0xff544347 // TPM_GENERATED_VALUE
+	tpmSTAttestQuote  = 0x8018     // TPM_ST_ATTEST_QUOTE
+	tpmAlgSHA256      = 0x000b     // TPM_ALG_SHA256
+)
+
+// tpmNonceTTL bounds how long a challenge from TPMVerifier.Challenge can be
+// answered
+const tpmNonceTTL = 2 * time.Minute
+
+// TPMQuote is a node's answer to a TPMVerifier challenge, as produced by
+// TPM2_Quote with its attestation key over SHA-256 PCRs
+type TPMQuote struct {
+	// Quote is the TPMS_ATTEST structure the TPM signed
+	Quote []byte `json:"quote"`
+
+	// Signature is the attestation key's signature over SHA-256(Quote):
+	// PKCS #1 v1.5 for RSA keys, ASN.1 DER for ECDSA keys
+	Signature []byte `json:"signature"`
+
+	// PCRs holds the SHA-256 value of every quoted PCR, so they can be
+	// checked against the quote's digest and the golden values
+	PCRs map[int][]byte `json:"pcrs"`
+}
+
+// TPMVerifier checks TPM 2.0 quotes presented as proof that a node is in a
+// known-good state. Nodes are identified by their enrolled attestation
+// keys, and a quote is accepted only if it answers a fresh challenge and
+// its PCRs hold the golden values.
+type TPMVerifier struct {
+	// AttestationKeys maps each enrolled NodeID to the public part of its
+	// TPM attestation key (an *rsa.PublicKey or *ecdsa.PublicKey)
+	AttestationKeys map[string]crypto.PublicKey
+
+	// GoldenPCRs holds the known-good SHA-256 value of each PCR that must
+	// be quoted, e.g. the firmware, boot loader and secure boot policy
+	// measurements
+	GoldenPCRs map[int][]byte
+
+	// TenantID, if set, is stamped on every token issued via this verifier
+	TenantID string
+
+	mu     sync.Mutex
+	nonces map[string]tpmNonce
+}
+
+type tpmNonce struct {
+	value     []byte
+	expiresAt time.Time
+}
+
+// Challenge returns a fresh nonce for nodeID to include as the quote's
+// qualifying data. Each nonce answers one quote; a new challenge replaces
+// the node's previous one.
+func (v *TPMVerifier) Challenge(nodeID string) ([]byte, error) {
+	if _, ok := v.AttestationKeys[nodeID]; !ok {
+		return nil, fmt.Errorf("node %q has no enrolled attestation key", nodeID)
+	}
+	nonce := make([]byte, 32)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, fmt.Errorf("failed to generate TPM nonce: %w", err)
+	}
+
+	now := time.Now()
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if v.nonces == nil {
+		v.nonces = make(map[string]tpmNonce)
+	}
+	for id, n := range v.nonces {
+		if !now.Before(n.expiresAt) {
+			delete(v.nonces, id)
+		}
+	}
+	v.nonces[nodeID] = tpmNonce{value: nonce, expiresAt: now.Add(tpmNonceTTL)}
+	return nonce, nil
+}
+
+// consumeNonce returns and forgets nodeID's outstanding nonce
+func (v *TPMVerifier) consumeNonce(nodeID string) ([]byte, bool) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	n, ok := v.nonces[nodeID]
+	delete(v.nonces, nodeID)
+	if !ok || !time.Now().Before(n.expiresAt) {
+		return nil, false
+	}
+	return n.value, true
+}
+
+// Verify checks nodeID's quote and returns the attestation claim for its
+// tokens. The challenge is consumed whether or not the quote verifies.
+func (v *TPMVerifier) Verify(nodeID string, q TPMQuote) (string, error) {
+	nonce, ok := v.consumeNonce(nodeID)
+	if !ok {
+		return "", fmt.Errorf("no outstanding TPM challenge for node %q", nodeID)
+	}
+	ak, ok := v.AttestationKeys[nodeID]
+	if !ok {
+		return "", fmt.Errorf("node %q has no enrolled attestation key", nodeID)
+	}
+	if err := verifyQuoteSignature(ak, q.Quote, q.Signature); err != nil {
+		return "", err
+	}
+
+	quote, err := parseTPMQuote(q.Quote)
+	if err != nil {
+		return "", err
+	}
+	if subtle.ConstantTimeCompare(quote.extraData, nonce) != 1 {
+		return "", fmt.Errorf("TPM quote does not answer the challenge")
+	}
+
+	h := sha256.New()
+	for _, pcr := range quote.pcrs {
+		value, ok := q.PCRs[pcr]
+		if !ok || len(value) != sha256.Size {
+			return "", fmt.Errorf("TPM quote covers PCR %d but no SHA-256 value was presented for it", pcr)
+		}
+		h.Write(value)
+	}
+	if subtle.ConstantTimeCompare(h.Sum(nil), quote.pcrDigest) != 1 {
+		return "", fmt.Errorf("presented PCR values do not match the quoted digest")
+	}
+
+	for _, pcr := range slices.Sorted(maps.Keys(v.GoldenPCRs)) {
+		if !slices.Contains(quote.pcrs, pcr) {
+			return "", fmt.Errorf("TPM quote does not cover PCR %d", pcr)
+		}
+		if !bytes.Equal(q.PCRs[pcr], v.GoldenPCRs[pcr]) {
+			return "", fmt.Errorf("PCR %d does not hold its known-good value", pcr)
+		}
+	}
+
+	pcrs := make([]string, len(quote.pcrs))
+	for i, pcr := range quote.pcrs {
+		pcrs[i] = fmt.Sprint(pcr)
+	}
+	return fmt.Sprintf("tpm2:sha256:%s:%s", strings.Join(pcrs, ","), hex.EncodeToString(quote.pcrDigest)), nil
+}
+
+// verifyQuoteSignature checks an attestation key's signature over quote
+func verifyQuoteSignature(ak crypto.PublicKey, quote, sig []byte) error {
+	digest := sha256.Sum256(quote)
+	switch pub := ak.(type) {
+	case *rsa.PublicKey:
+		if rsa.VerifyPKCS1v15(pub, crypto.SHA256, digest[:], sig) != nil {
+			return fmt.Errorf("invalid TPM quote signature")
+		}
+	case *ecdsa.PublicKey:
+		if !ecdsa.VerifyASN1(pub, digest[:], sig) {
+			return fmt.Errorf("invalid TPM quote signature")
+		}
+	default:
+		return fmt.Errorf("unsupported attestation key type %T", ak)
+	}
+	return nil
+}
+
+// tpmQuote holds the fields of a TPMS_ATTEST quote that are checked
+type tpmQuote struct {
+	extraData []byte
+	pcrs      []int // in the order they were hashed into pcrDigest
+	pcrDigest []byte
+}
+
+// tpmReader decodes the big-endian TPM wire format
+type tpmReader struct {
+	data []byte
+	err  error
+}
+
+func (r *tpmReader) take(n int) []byte {
+	if r.err != nil {
+		return nil
+	}
+	if n > len(r.data) {
+		r.err = fmt.Errorf("truncated TPM quote")
+		return nil
+	}
+	b := r.data[:n]
+	r.data = r.data[n:]
+	return b
+}
+
+func (r *tpmReader) u8() uint8 {
+	if b := r.take(1); b != nil {
+		return b[0]
+	}
+	return 0
+}
+
+func (r *tpmReader) u16() uint16 {
+	if b := r.take(2); b != nil {
+		return binary.BigEndian.Uint16(b)
+	}
+	return 0
+}
+
+func (r *tpmReader) u32() uint32 {
+	if b := r.take(4); b != nil {
+		return binary.BigEndian.Uint32(b)
+	}
+	return 0
+}
+
+// sized reads a TPM2B structure: a 16-bit length and that many bytes
+func (r *tpmReader) sized() []byte {
+	return r.take(int(r.u16()))
+}
+
+// parseTPMQuote decodes a TPMS_ATTEST of type TPM_ST_ATTEST_QUOTE
+func parseTPMQuote(data []byte) (*tpmQuote, error) {
+	r := &tpmReader{data: data}
+	if r.u32() != tpmGeneratedValue || r.u16() != tpmSTAttestQuote {
+		if r.err != nil {
+			return nil, r.err
+		}
+		return nil, fmt.Errorf("not a TPM-generated quote")
+	}
+	r.sized() // qualifiedSigner
+	q := &tpmQuote{extraData: r.sized()}
+	r.take(17) // clockInfo
+	r.take(8)  // firmwareVersion
+
+	count := r.u32()
+	if count > 16 {
+		return nil, fmt.Errorf("TPM quote has %d PCR selections", count)
+	}
+	for range count {
+		alg := r.u16()
+		bitmap := r.take(int(r.u8()))
+		if r.err != nil {
+			break
+		}
+		if alg != tpmAlgSHA256 {
+			return nil, fmt.Errorf("TPM quote selects non-SHA-256 PCR bank %#04x", alg)
+		}
+		for i, b := range bitmap {
+			for bit := range 8 {
+				if b&(1<<bit) != 0 {
+					q.pcrs = append(q.pcrs, i*8+bit)
+				}
+			}
+		}
+	}
+	q.pcrDigest = r.sized()
+	if r.err != nil {
+		return nil, r.err
+	}
+	if len(r.data) != 0 {
+		return nil, fmt.Errorf("trailing data after TPM quote")
+	}
+	if len(q.pcrs) == 0 || len(q.pcrDigest) != sha256.Size {
+		return nil, fmt.Errorf("TPM quote covers no SHA-256 PCRs")
+	}
+	return q, nil
+}
+
+// RequireAttestation makes issuing any token whose scope or roles grant
+// one of permissions, e.g. "runtime:execute", require a verified TPM quote
+// (see RequestTokenWithTPM). Renewals and exchanges of attested tokens
+// keep their attestation.
+func (fd *ForgeDominion) RequireAttestation(permissions ...string) error {
+	for _, p := range permissions {
+		if !isLiteralScope(p) {
+			return fmt.Errorf("%q is not a literal permission", p)
+		}
+	}
+	fd.attestedScopes = slices.Clone(permissions)
+	return nil
+}
+
+// checkAttestation rejects unattested specs that need attestation
+func (fd *ForgeDominion) checkAttestation(spec TokenSpec) error {
+	if spec.attestation != "" || len(fd.attestedScopes) == 0 {
+		return nil
+	}
+	effective := fd.EffectiveScope(&ForgeToken{Scope: spec.Scope, Roles: spec.Roles})
+	for _, p := range fd.attestedScopes {
+		if scopeAllows(effective, p) {
+			return fmt.Errorf("%w: %q requires TPM attestation", ErrPolicyDenied, p)
+		}
+	}
+	return nil
+}
+
+// RequestTokenWithTPM issues a token to nodeID after verifying its answer
+// to a TPMVerifier challenge. The token carries the verified PCR state in
+// its signed Attestation claim.
+func (fd *ForgeDominion) RequestTokenWithTPM(v *TPMVerifier, nodeID string, q TPMQuote, scope string, ttl time.Duration) (*ForgeToken, error) {
+	attestation, err := v.Verify(nodeID, q)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrPolicyDenied, err)
+	}
+	spec := TokenSpec{TenantID: v.TenantID, NodeID: nodeID, Scope: scope, TTL: ttl, attestation: attestation}
+	return fd.requestToken(context.Background(), spec, "attestation="+attestation)
+}
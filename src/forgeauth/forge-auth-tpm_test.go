@@ -0,0 +1,269 @@
+package forgeauth
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testPCRs are the measured values of PCRs 0, 4 and 7
+var testPCRs = map[int][]byte{
+	0: bytes.Repeat([]byte{0x10}, sha256.Size),
+	4: bytes.Repeat([]byte{0x14}, sha256.Size),
+	7: bytes.Repeat([]byte{0x17}, sha256.Size),
+}
+
+// encodeTPMQuote builds the TPMS_ATTEST a TPM returns from TPM2_Quote of
+// the SHA-256 bank's pcrs, in order, answering nonce
+func encodeTPMQuote(nonce []byte, pcrs []int, values map[int][]byte) []byte {
+	var b []byte
+	sized := func(data []byte) {
+		b = binary.BigEndian.AppendUint16(b, uint16(len(data)))
+		b = append(b, data...)
+	}
+	b = binary.BigEndian.AppendUint32(b, tpmGeneratedValue)
+	b = binary.BigEndian.AppendUint16(b, tpmSTAttestQuote)
+	sized([]byte("signer"))
+	sized(nonce)
+	b = append(b, make([]byte, 17+8)...) // clockInfo, firmwareVersion
+
+	bitmap := make([]byte, 3)
+	h := sha256.New()
+	for _, pcr := range pcrs {
+		bitmap[pcr/8] |= 1 << (pcr % 8)
+		h.Write(values[pcr])
+	}
+	b = binary.BigEndian.AppendUint32(b, 1)
+	b = binary.BigEndian.AppendUint16(b, tpmAlgSHA256)
+	b = append(b, byte(len(bitmap)))
+	b = append(b, bitmap...)
+	sized(h.Sum(nil))
+	return b
+}
+
+// signTPMQuote signs quote as the attestation key ak would
+func signTPMQuote(t *testing.T, ak crypto.Signer, quote []byte) []byte {
+	t.Helper()
+	digest := sha256.Sum256(quote)
+	sig, err := ak.Sign(rand.Reader, digest[:], crypto.SHA256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sig
+}
+
+func newTestAttestationKey(t *testing.T) *ecdsa.PrivateKey {
+	t.Helper()
+	ak, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ak
+}
+
+// newTestVerifier enrolls node-1 with ak and expects testPCRs
+func newTestVerifier(ak crypto.Signer) *TPMVerifier {
+	return &TPMVerifier{
+		AttestationKeys: map[string]crypto.PublicKey{"node-1": ak.Public()},
+		GoldenPCRs:      testPCRs,
+	}
+}
+
+// answer quotes PCRs 0, 4 and 7 holding values in answer to nonce
+func answer(t *testing.T, ak crypto.Signer, nonce []byte, values map[int][]byte) TPMQuote {
+	t.Helper()
+	quote := encodeTPMQuote(nonce, []int{0, 4, 7}, values)
+	return TPMQuote{Quote: quote, Signature: signTPMQuote(t, ak, quote), PCRs: values}
+}
+
+func TestTPMQuote(t *testing.T) {
+	ak := newTestAttestationKey(t)
+	bad := map[int][]byte{0: testPCRs[0], 4: bytes.Repeat([]byte{0x66}, sha256.Size), 7: testPCRs[7]}
+	tests := []struct {
+		name  string
+		quote func(v *TPMVerifier, nonce []byte) TPMQuote
+		err   string
+	}{
+		{"known-good", func(v *TPMVerifier, nonce []byte) TPMQuote {
+			return answer(t, ak, nonce, testPCRs)
+		}, ""},
+		{"rsa attestation key", func(v *TPMVerifier, nonce []byte) TPMQuote {
+			rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+			if err != nil {
+				t.Fatal(err)
+			}
+			v.AttestationKeys["node-1"] = rsaKey.Public()
+			return answer(t, rsaKey, nonce, testPCRs)
+		}, ""},
+		{"wrong nonce", func(v *TPMVerifier, nonce []byte) TPMQuote {
+			return answer(t, ak, bytes.Repeat([]byte{1}, len(nonce)), testPCRs)
+		}, "does not answer the challenge"},
+		{"no nonce", func(v *TPMVerifier, nonce []byte) TPMQuote {
+			return answer(t, ak, nil, testPCRs)
+		}, "does not answer the challenge"},
+		{"stale nonce", func(v *TPMVerifier, nonce []byte) TPMQuote {
+			v.nonces["node-1"] = tpmNonce{value: nonce, expiresAt: time.Now()}
+			return answer(t, ak, nonce, testPCRs)
+		}, "no outstanding TPM challenge"},
+		{"superseded nonce", func(v *TPMVerifier, nonce []byte) TPMQuote {
+			if _, err := v.Challenge("node-1"); err != nil {
+				t.Fatal(err)
+			}
+			return answer(t, ak, nonce, testPCRs)
+		}, "does not answer the challenge"},
+		{"pcr mismatch", func(v *TPMVerifier, nonce []byte) TPMQuote {
+			return answer(t, ak, nonce, bad)
+		}, "PCR 4 does not hold its known-good value"},
+		{"presented pcrs not quoted", func(v *TPMVerifier, nonce []byte) TPMQuote {
+			q := answer(t, ak, nonce, bad)
+			q.PCRs = testPCRs
+			return q
+		}, "do not match the quoted digest"},
+		{"pcr missing", func(v *TPMVerifier, nonce []byte) TPMQuote {
+			q := answer(t, ak, nonce, testPCRs)
+			q.PCRs = map[int][]byte{0: testPCRs[0], 4: testPCRs[4]}
+			return q
+		}, "no SHA-256 value was presented"},
+		{"golden pcr not quoted", func(v *TPMVerifier, nonce []byte) TPMQuote {
+			quote := encodeTPMQuote(nonce, []int{0, 4}, testPCRs)
+			return TPMQuote{Quote: quote, Signature: signTPMQuote(t, ak, quote), PCRs: testPCRs}
+		}, "does not cover PCR 7"},
+		{"another key", func(v *TPMVerifier, nonce []byte) TPMQuote {
+			return answer(t, newTestAttestationKey(t), nonce, testPCRs)
+		}, "invalid TPM quote signature"},
+		{"edited quote", func(v *TPMVerifier, nonce []byte) TPMQuote {
+			q := answer(t, ak, nonce, testPCRs)
+			q.Quote = encodeTPMQuote(nonce, []int{0, 4, 7}, bad)
+			return q
+		}, "invalid TPM quote signature"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v := newTestVerifier(ak)
+			nonce, err := v.Challenge("node-1")
+			if err != nil {
+				t.Fatal(err)
+			}
+			attestation, err := v.Verify("node-1", tt.quote(v, nonce))
+			if tt.err == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !strings.HasPrefix(attestation, "tpm2:sha256:0,4,7:") {
+					t.Errorf("attestation %q, want PCRs 0, 4 and 7", attestation)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("got %v, want %q", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestTPMNonceAnswersOnce(t *testing.T) {
+	ak := newTestAttestationKey(t)
+	v := newTestVerifier(ak)
+	nonce, err := v.Challenge("node-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	q := answer(t, ak, nonce, testPCRs)
+	if _, err := v.Verify("node-1", q); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := v.Verify("node-1", q); err == nil {
+		t.Error("quote replayed")
+	}
+
+	// A failed answer spends the challenge too
+	nonce, err = v.Challenge("node-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := v.Verify("node-1", TPMQuote{}); err == nil {
+		t.Fatal("empty quote verified")
+	}
+	if _, err := v.Verify("node-1", answer(t, ak, nonce, testPCRs)); err == nil {
+		t.Error("challenge answered after a failed answer")
+	}
+
+	if _, err := v.Challenge("node-2"); err == nil {
+		t.Error("unenrolled node challenged")
+	}
+}
+
+func TestParseTPMQuote(t *testing.T) {
+	good := encodeTPMQuote([]byte("nonce"), []int{0, 4, 7}, testPCRs)
+	if q, err := parseTPMQuote(good); err != nil {
+		t.Fatal(err)
+	} else if string(q.extraData) != "nonce" || len(q.pcrs) != 3 {
+		t.Errorf("parsed %+v", q)
+	}
+	sha1Bank := bytes.Clone(good)
+	i := bytes.Index(sha1Bank, []byte{0, tpmAlgSHA256, 3})
+	sha1Bank[i+1] = 0x04
+	tests := map[string][]byte{
+		"empty":       nil,
+		"truncated":   good[:len(good)-1],
+		"trailing":    append(bytes.Clone(good), 0),
+		"not a quote": append(binary.BigEndian.AppendUint32(nil, tpmGeneratedValue), 0x80, 0x17),
+		"sha-1 bank":  sha1Bank,
+		"no pcrs":     encodeTPMQuote([]byte("nonce"), nil, nil),
+	}
+	for name, data := range tests {
+		if _, err := parseTPMQuote(data); err == nil {
+			t.Errorf("%s quote parsed", name)
+		}
+	}
+}
+
+func TestRequestTokenWithTPM(t *testing.T) {
+	fd, _ := newTestDominion(t, AlgHS256)
+	if err := fd.RequireAttestation("runtime:execute"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fd.RequestToken("node-1", "runtime:execute", time.Hour); !errors.Is(err, ErrPolicyDenied) {
+		t.Fatalf("unattested token: got %v, want %v", err, ErrPolicyDenied)
+	}
+
+	ak := newTestAttestationKey(t)
+	v := newTestVerifier(ak)
+	nonce, err := v.Challenge("node-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bad := map[int][]byte{0: testPCRs[0], 4: testPCRs[4], 7: bytes.Repeat([]byte{0x66}, sha256.Size)}
+	if _, err := fd.RequestTokenWithTPM(v, "node-1", answer(t, ak, nonce, bad), "runtime:execute", time.Hour); !errors.Is(err, ErrPolicyDenied) {
+		t.Fatalf("token for a mismatched PCR: got %v, want %v", err, ErrPolicyDenied)
+	}
+
+	nonce, err = v.Challenge("node-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := fd.RequestTokenWithTPM(v, "node-1", answer(t, ak, nonce, testPCRs), "runtime:execute", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(token.Attestation, "tpm2:sha256:") {
+		t.Errorf("token attestation %q", token.Attestation)
+	}
+	if err := fd.ValidateToken(token); err != nil {
+		t.Fatal(err)
+	}
+	// The attestation is signed
+	token.Attestation = "tpm2:sha256:0:00"
+	if err := fd.ValidateToken(token); !errors.Is(err, ErrBadSignature) {
+		t.Errorf("edited attestation: got %v, want %v", err, ErrBadSignature)
+	}
+}
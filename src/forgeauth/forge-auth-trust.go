@@ -0,0 +1,173 @@
+package forgeauth
+
+import (
+	"crypto/ed25519"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// TrustConfig describes a peer dominion, e.g. staging during a migration,
+// whose Ed25519 tokens this dominion accepts
+type TrustConfig struct {
+	// Name identifies the peer in audit entries and later updates
+	Name string
+
+	// Bundle is the peer's validator bundle and TrustedKey the peer's
+	// default-tenant public key it is signed with
+	Bundle     *ValidatorBundle
+	TrustedKey ed25519.PublicKey
+
+	// ScopeMap grants a local scope for each peer scope the token allows.
+	// Peer scopes without an entry are dropped, so a peer can never grant
+	// more than the map names.
+	ScopeMap map[string]string
+
+	// TenantID is the local tenant accepted peer tokens belong to, whatever
+	// tenant the peer named; empty is the default tenant
+	TenantID string
+}
+
+// trustedPeer is a peer dominion accepted by ValidateBearer
+type trustedPeer struct {
+	cfg       TrustConfig
+	validator *Validator
+	patterns  []string // ScopeMap keys in a stable order
+}
+
+// TrustDominion makes ValidateBearer and Middleware accept tokens issued by
+// a peer dominion, down-scoped through cfg.ScopeMap. Accepted peer tokens
+// are returned without a signature, so they can't be passed off as tokens
+// issued by this dominion. Trusting a peer again under the same name
+// replaces its configuration.
+func (fd *ForgeDominion) TrustDominion(cfg TrustConfig) error {
+	if cfg.Name == "" {
+		return fmt.Errorf("trusted dominion requires a name")
+	}
+	if cfg.Bundle == nil {
+		return fmt.Errorf("trusted dominion %q requires a validator bundle", cfg.Name)
+	}
+	if len(cfg.ScopeMap) == 0 {
+		return fmt.Errorf("trusted dominion %q requires a scope map", cfg.Name)
+	}
+	for from, to := range cfg.ScopeMap {
+		if err := ValidateScope(from); err != nil {
+			return fmt.Errorf("trusted dominion %q: %w", cfg.Name, err)
+		}
+		if err := ValidateScope(to); err != nil {
+			return fmt.Errorf("trusted dominion %q: %w", cfg.Name, err)
+		}
+	}
+	if err := validateTenantID(cfg.TenantID); err != nil {
+		return err
+	}
+	v, err := NewValidator(cfg.Bundle, cfg.TrustedKey)
+	if err != nil {
+		return fmt.Errorf("trusted dominion %q: %w", cfg.Name, err)
+	}
+
+	patterns := make([]string, 0, len(cfg.ScopeMap))
+	for from := range cfg.ScopeMap {
+		patterns = append(patterns, from)
+	}
+	slices.Sort(patterns)
+
+	fd.trustMu.Lock()
+	if fd.peers == nil {
+		fd.peers = make(map[string]*trustedPeer)
+	}
+	fd.peers[cfg.Name] = &trustedPeer{cfg: cfg, validator: v, patterns: patterns}
+	fd.trustMu.Unlock()
+
+	fd.record(AuditEntry{
+		Time:     fd.now(),
+		Event:    AuditTrustUpdated,
+		TenantID: cfg.TenantID,
+		Detail:   fmt.Sprintf("peer=%s version=%d", cfg.Name, cfg.Bundle.Version),
+	})
+	return nil
+}
+
+// UpdateTrustedBundle replaces a trusted peer's validator bundle, e.g.
+// after it revokes tokens or rotates keys
+func (fd *ForgeDominion) UpdateTrustedBundle(name string, bundle *ValidatorBundle) error {
+	fd.trustMu.RLock()
+	peer, ok := fd.peers[name]
+	fd.trustMu.RUnlock()
+	if !ok {
+		return fmt.Errorf("dominion %q is not trusted", name)
+	}
+	if err := peer.validator.Update(bundle); err != nil {
+		return fmt.Errorf("trusted dominion %q: %w", name, err)
+	}
+
+	fd.record(AuditEntry{
+		Time:   fd.now(),
+		Event:  AuditTrustUpdated,
+		Detail: fmt.Sprintf("peer=%s version=%d", name, bundle.Version),
+	})
+	return nil
+}
+
+// UntrustDominion stops accepting a peer's tokens, e.g. once a migration
+// is complete
+func (fd *ForgeDominion) UntrustDominion(name string) {
+	fd.trustMu.Lock()
+	_, ok := fd.peers[name]
+	delete(fd.peers, name)
+	fd.trustMu.Unlock()
+
+	if ok {
+		fd.record(AuditEntry{
+			Time:   fd.now(),
+			Event:  AuditTrustRemoved,
+			Detail: fmt.Sprintf("peer=%s", name),
+		})
+	}
+}
+
+// validatePeer accepts a token that failed local signature verification if
+// a trusted peer issued it, returning the down-scoped local view. It
+// returns localErr when no peer recognizes the token.
+func (fd *ForgeDominion) validatePeer(token *ForgeToken, localErr error) (*ForgeToken, error) {
+	fd.trustMu.RLock()
+	peers := make([]*trustedPeer, 0, len(fd.peers))
+	for _, p := range fd.peers {
+		peers = append(peers, p)
+	}
+	fd.trustMu.RUnlock()
+
+	for _, p := range peers {
+		err := p.validator.Validate(token)
+		if errors.Is(err, ErrBadSignature) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("token from trusted dominion %q: %w", p.cfg.Name, err)
+		}
+		return p.localToken(token)
+	}
+	return nil, localErr
+}
+
+// localToken maps a verified peer token into this dominion's scopes
+func (p *trustedPeer) localToken(token *ForgeToken) (*ForgeToken, error) {
+	var scopes []string
+	for _, from := range p.patterns {
+		if scopeAllows(token.Scope, from) && !slices.Contains(scopes, p.cfg.ScopeMap[from]) {
+			scopes = append(scopes, p.cfg.ScopeMap[from])
+		}
+	}
+	if len(scopes) == 0 {
+		return nil, fmt.Errorf("%w: no scope of the token from trusted dominion %q is mapped", ErrScopeDenied, p.cfg.Name)
+	}
+
+	local := *token
+	local.Scope = strings.Join(scopes, ",")
+	local.Signature = ""
+	local.Roles = nil // bound by the peer, not here
+	// The peer names tenants of its own, never ours
+	local.TenantID = p.cfg.TenantID
+	return &local, nil
+}
@@ -0,0 +1,168 @@
+package forgeauth
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// testPeer is a peer dominion issuing Ed25519 tokens for the default
+// tenant and acme
+type testPeer struct {
+	fd     *ForgeDominion
+	bundle *ValidatorBundle
+	key    []byte
+}
+
+func newTestPeer(t *testing.T, seed byte) *testPeer {
+	t.Helper()
+	fd := NewForgeDominionWithKeys(StaticKeyProvider{
+		"":     bytes.Repeat([]byte{seed}, minRootKeyLen),
+		"acme": bytes.Repeat([]byte{seed + 1}, minRootKeyLen),
+	})
+	if err := fd.SetSigningAlg(AlgEd25519); err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	bundle, err := fd.ExportValidatorBundle(ctx, 1, "acme")
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := fd.PublicKey(ctx, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testPeer{fd: fd, bundle: bundle, key: key}
+}
+
+func (p *testPeer) trust(t *testing.T, fd *ForgeDominion, name string, tenantID string, scopes map[string]string) {
+	t.Helper()
+	if err := fd.TrustDominion(TrustConfig{Name: name, Bundle: p.bundle, TrustedKey: p.key, ScopeMap: scopes, TenantID: tenantID}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// bearer issues an encoded peer token
+func (p *testPeer) bearer(t *testing.T, spec TokenSpec) string {
+	t.Helper()
+	spec.TTL = time.Hour
+	tokens, err := p.fd.RequestTokens([]TokenSpec{spec})
+	if err != nil {
+		t.Fatal(err)
+	}
+	encoded, err := EncodeToken(tokens[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return encoded
+}
+
+// newTrustingDominion returns a dominion on the real clock, as the peers
+// are
+func newTrustingDominion() *ForgeDominion {
+	return NewForgeDominionWithKeys(StaticKeyProvider{"": bytes.Clone(testRootKey)})
+}
+
+var testScopeMap = map[string]string{
+	"runtime:read":    "bridge:read",
+	"runtime:execute": "bridge:execute",
+	"admin:*":         "bridge:admin",
+}
+
+func TestTrustScopeMap(t *testing.T) {
+	fd := newTrustingDominion()
+	peer := newTestPeer(t, 0x50)
+	peer.trust(t, fd, "staging", "", testScopeMap)
+	ctx := context.Background()
+
+	tests := []struct {
+		scope string
+		want  string // the local scope, or "" for ErrScopeDenied
+	}{
+		{"runtime:read", "bridge:read"},
+		{"runtime:*", "bridge:execute,bridge:read"},
+		{"runtime:*,!runtime:execute", "bridge:read"},
+		{"runtime:read:logs", ""},
+		{"other:thing", ""},
+		{"*", "bridge:admin,bridge:execute,bridge:read"},
+	}
+	for _, tt := range tests {
+		token, err := fd.ValidateBearer(ctx, peer.bearer(t, TokenSpec{NodeID: "node-1", Scope: tt.scope}))
+		if tt.want == "" {
+			if !errors.Is(err, ErrScopeDenied) {
+				t.Errorf("peer scope %q: got %v, want %v", tt.scope, err, ErrScopeDenied)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("peer scope %q: %v", tt.scope, err)
+			continue
+		}
+		if token.Scope != tt.want {
+			t.Errorf("peer scope %q mapped to %q, want %q", tt.scope, token.Scope, tt.want)
+		}
+		if token.Signature != "" {
+			t.Errorf("peer scope %q: local view kept the peer's signature", tt.scope)
+		}
+		if err := fd.ValidateToken(token); err == nil {
+			t.Errorf("peer scope %q: local view validates as a local token", tt.scope)
+		}
+	}
+}
+
+func TestTrustTenant(t *testing.T) {
+	peer := newTestPeer(t, 0x50)
+	ctx := context.Background()
+	for _, tenantID := range []string{"", "staging"} {
+		fd := newTrustingDominion()
+		peer.trust(t, fd, "staging", tenantID, testScopeMap)
+		for _, peerTenant := range []string{"", "acme"} {
+			token, err := fd.ValidateBearer(ctx, peer.bearer(t, TokenSpec{TenantID: peerTenant, NodeID: "node-1", Scope: "runtime:read"}))
+			if err != nil {
+				t.Errorf("trusted into %q, peer tenant %q: %v", tenantID, peerTenant, err)
+				continue
+			}
+			if token.TenantID != tenantID {
+				t.Errorf("trusted into %q, peer tenant %q: accepted into tenant %q", tenantID, peerTenant, token.TenantID)
+			}
+		}
+	}
+}
+
+func TestTrustPeerBadSignatureFallsThrough(t *testing.T) {
+	fd := newTrustingDominion()
+	staging, other := newTestPeer(t, 0x50), newTestPeer(t, 0x60)
+	ctx := context.Background()
+
+	otherToken := other.bearer(t, TokenSpec{NodeID: "node-1", Scope: "runtime:read"})
+	staging.trust(t, fd, "a-staging", "", testScopeMap)
+	if _, err := fd.ValidateBearer(ctx, otherToken); !errors.Is(err, ErrBadSignature) {
+		t.Fatalf("token of an untrusted peer: got %v, want %v", err, ErrBadSignature)
+	}
+
+	// Peers are tried in turn: staging's bad signature moves on to other
+	other.trust(t, fd, "b-other", "", testScopeMap)
+	if token, err := fd.ValidateBearer(ctx, otherToken); err != nil || token.Scope != "bridge:read" {
+		t.Fatalf("token of the second peer: %v, %v", token, err)
+	}
+
+	tampered, err := DecodeToken(otherToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tampered.Scope = "admin:*"
+	encoded, err := EncodeToken(tampered)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fd.ValidateBearer(ctx, encoded); !errors.Is(err, ErrBadSignature) {
+		t.Errorf("tampered peer token: got %v, want %v", err, ErrBadSignature)
+	}
+
+	fd.UntrustDominion("b-other")
+	if _, err := fd.ValidateBearer(ctx, otherToken); !errors.Is(err, ErrBadSignature) {
+		t.Errorf("after untrusting: got %v, want %v", err, ErrBadSignature)
+	}
+}
@@ -0,0 +1,67 @@
+package forgeauth
+
+import (
+	"fmt"
+	"time"
+)
+
+// defaultMaxTTL is the ceiling applied to every token until SetTTLPolicy
+// configures another
+const defaultMaxTTL = 24 * time.Hour
+
+// TTLPolicy bounds the lifetime of issued and renewed tokens
+type TTLPolicy struct {
+	// Default is used when a caller asks for a zero TTL
+	Default time.Duration
+
+	// Max caps every token; zero means no global cap
+	Max time.Duration
+
+	// ScopeMax caps tokens whose scope could exercise a key of the map
+	// (see scopeIntersects), e.g. {"runtime:admin": 5 * time.Minute}. The
+	// tightest matching cap applies.
+	ScopeMax map[string]time.Duration
+
+	// Clamp shortens over-long requests to the cap instead of rejecting
+	// them. Batches with a shared expiry are always rejected, since
+	// clamping would break the shared expiry.
+	Clamp bool
+}
+
+// SetTTLPolicy replaces the dominion's TTL policy. The default policy
+// rejects TTLs above 24 hours.
+func (fd *ForgeDominion) SetTTLPolicy(p TTLPolicy) {
+	fd.ttlPolicy = p
+}
+
+// maxTTL returns the cap for scope, or zero when uncapped
+func (p TTLPolicy) maxTTL(scope string) time.Duration {
+	limit := p.Max
+	for pattern, max := range p.ScopeMax {
+		if max > 0 && (limit == 0 || max < limit) && scopeIntersects(scope, pattern) {
+			limit = max
+		}
+	}
+	return limit
+}
+
+// effectiveTTL applies the TTL policy to a requested TTL. clamp is false
+// where the caller's expiry can't be changed.
+func (fd *ForgeDominion) effectiveTTL(scope string, ttl time.Duration, clamp bool) (time.Duration, error) {
+	p := fd.ttlPolicy
+	if ttl == 0 {
+		ttl = p.Default
+	}
+	if ttl <= 0 {
+		return 0, fmt.Errorf("TTL must be positive")
+	}
+
+	limit := p.maxTTL(scope)
+	if limit == 0 || ttl <= limit {
+		return ttl, nil
+	}
+	if p.Clamp && clamp {
+		return limit, nil
+	}
+	return 0, fmt.Errorf("%w: TTL %s exceeds the maximum of %s for scope %q", ErrPolicyDenied, ttl, limit, scope)
+}
@@ -0,0 +1,87 @@
+package forgeauth
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// UsageCounter counts validations of usage-limited tokens. A counter shared
+// by every validator, e.g. one backed by a database, makes a token's
+// MaxUses hold across a fleet; the default counter only sees validations in
+// this process.
+type UsageCounter interface {
+	// Use records one use of the token and returns how many times it has
+	// been used, including this one. After expiresAt the token can no
+	// longer validate, so its count may be discarded.
+	Use(ctx context.Context, id string, expiresAt time.Time) (int, error)
+}
+
+// SetUsageCounter replaces the counter enforcing MaxUses
+func (fd *ForgeDominion) SetUsageCounter(c UsageCounter) {
+	fd.uses = c
+}
+
+// consumeUse counts one use of a usage-limited token, failing closed if the
+// counter is unavailable
+func consumeUse(ctx context.Context, uses UsageCounter, token *ForgeToken) error {
+	if token.MaxUses == 0 {
+		return nil
+	}
+	if token.ID == "" {
+		return fmt.Errorf("%w: usage-limited token has no ID", ErrMalformed)
+	}
+	if uses == nil {
+		return fmt.Errorf("%w: no usage counter configured", ErrExhausted)
+	}
+
+	n, err := uses.Use(ctx, token.ID, token.ExpiresAt)
+	if err != nil {
+		return fmt.Errorf("failed to count token use: %w", err)
+	}
+	if n > token.MaxUses {
+		return fmt.Errorf("%w: token %s allows %d uses", ErrExhausted, token.ID, token.MaxUses)
+	}
+	return nil
+}
+
+func (fd *ForgeDominion) consumeUse(ctx context.Context, token *ForgeToken) error {
+	return consumeUse(ctx, fd.uses, token)
+}
+
+// memoryUsageCounter counts uses in memory, forgetting tokens once expired
+type memoryUsageCounter struct {
+	now    func() time.Time
+	mu     sync.Mutex
+	counts map[string]*usageCount
+}
+
+type usageCount struct {
+	n         int
+	expiresAt time.Time
+}
+
+func newMemoryUsageCounter(now func() time.Time) *memoryUsageCounter {
+	return &memoryUsageCounter{now: now, counts: make(map[string]*usageCount)}
+}
+
+// Use implements UsageCounter
+func (c *memoryUsageCounter) Use(ctx context.Context, id string, expiresAt time.Time) (int, error) {
+	now := c.now()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for k, u := range c.counts {
+		if !u.expiresAt.After(now) {
+			delete(c.counts, k)
+		}
+	}
+
+	u, ok := c.counts[id]
+	if !ok {
+		u = &usageCount{expiresAt: expiresAt}
+		c.counts[id] = u
+	}
+	u.n++
+	return u.n, nil
+}
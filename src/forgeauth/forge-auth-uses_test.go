@@ -0,0 +1,115 @@
+package forgeauth
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// issueLimited issues a token that validates at most maxUses times
+func issueLimited(t *testing.T, fd *ForgeDominion, maxUses int) *ForgeToken {
+	t.Helper()
+	token, err := fd.requestToken(context.Background(), TokenSpec{NodeID: "node-1", Scope: "runtime:read", TTL: time.Hour, MaxUses: maxUses}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+func TestMaxUses(t *testing.T) {
+	fd, _ := newTestDominion(t, AlgHS256)
+	token := issueLimited(t, fd, 3)
+	for i := range 3 {
+		if err := fd.ValidateToken(token); err != nil {
+			t.Fatalf("use %d: %v", i+1, err)
+		}
+	}
+	for i := range 2 {
+		if err := fd.ValidateToken(token); !errors.Is(err, ErrExhausted) {
+			t.Errorf("use %d of 3: got %v, want %v", i+4, err, ErrExhausted)
+		}
+	}
+	if err := fd.ValidateToken(issueLimited(t, fd, 3)); err != nil {
+		t.Errorf("another token's uses were spent: %v", err)
+	}
+}
+
+func TestMaxUsesForgeryDoesNotConsume(t *testing.T) {
+	fd, _ := newTestDominion(t, AlgHS256)
+	token := issueLimited(t, fd, 1)
+	forged := *token
+	forged.Scope = "runtime:*"
+	for range 3 {
+		if err := fd.ValidateToken(&forged); !errors.Is(err, ErrBadSignature) {
+			t.Fatalf("forgery: got %v, want %v", err, ErrBadSignature)
+		}
+	}
+	if err := fd.ValidateToken(token); err != nil {
+		t.Fatalf("the genuine token's one use: %v", err)
+	}
+	if err := fd.ValidateToken(token); !errors.Is(err, ErrExhausted) {
+		t.Errorf("second use: got %v, want %v", err, ErrExhausted)
+	}
+}
+
+func TestMaxUsesRevokedDoesNotConsume(t *testing.T) {
+	fd, _ := newTestDominion(t, AlgHS256)
+	token := issueLimited(t, fd, 1)
+	counter := &countingUses{UsageCounter: fd.uses}
+	fd.SetUsageCounter(counter)
+	if err := fd.Revoke(token); err != nil {
+		t.Fatal(err)
+	}
+	if err := fd.ValidateToken(token); !errors.Is(err, ErrRevoked) {
+		t.Fatalf("revoked token: got %v, want %v", err, ErrRevoked)
+	}
+	if counter.n != 0 {
+		t.Errorf("a revoked token was counted %d times", counter.n)
+	}
+}
+
+type countingUses struct {
+	UsageCounter
+	n int
+}
+
+func (c *countingUses) Use(ctx context.Context, id string, expiresAt time.Time) (int, error) {
+	c.n++
+	return c.UsageCounter.Use(ctx, id, expiresAt)
+}
+
+type brokenUses struct{}
+
+func (brokenUses) Use(context.Context, string, time.Time) (int, error) {
+	return 0, errors.New("counter down")
+}
+
+func TestMaxUsesFailsClosed(t *testing.T) {
+	fd, _ := newTestDominion(t, AlgHS256)
+	token := issueLimited(t, fd, 5)
+	fd.SetUsageCounter(brokenUses{})
+	if err := fd.ValidateToken(token); err == nil {
+		t.Error("usage-limited token validated with its counter down")
+	}
+	fd.SetUsageCounter(nil)
+	if err := fd.ValidateToken(token); !errors.Is(err, ErrExhausted) {
+		t.Errorf("without a counter: got %v, want %v", err, ErrExhausted)
+	}
+	if err := fd.ValidateToken(issueTestToken(t, fd)); err != nil {
+		t.Errorf("unlimited token without a counter: %v", err)
+	}
+}
+
+func TestMemoryUsageCounterForgetsExpired(t *testing.T) {
+	clock := NewFakeClock(testEpoch)
+	c := newMemoryUsageCounter(clock.Now)
+	ctx := context.Background()
+	c.Use(ctx, "a", testEpoch.Add(time.Minute))
+	c.Use(ctx, "a", testEpoch.Add(time.Minute))
+	clock.Advance(2 * time.Minute)
+	c.Use(ctx, "b", testEpoch.Add(time.Hour))
+	if _, ok := c.counts["a"]; ok {
+		t.Error("expired token's count kept")
+	}
+}
@@ -0,0 +1,353 @@
+package forgeauth
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"slices"
+	"sync"
+	"time"
+)
+
+// validatorBundleDomain prefixes the payload signed by a validator bundle
+const validatorBundleDomain = "forge-dominion/validator-bundle/v1\n"
+
+// ValidatorKey is an Ed25519 public key verifying one tenant's tokens.
+// Keys from before a rotation carry NotAfter, the end of the grace period.
+type ValidatorKey struct {
+	TenantID  string    `json:"tenant_id,omitempty"`
+	PublicKey string    `json:"public_key"`
+	NotAfter  time.Time `json:"not_after,omitzero"`
+}
+
+// ValidatorBundle carries everything a read-only node needs to verify
+// Ed25519 tokens without root key material: per-tenant public keys, the
+// accepted algorithms, the revocation state and a digest of the issuing
+// dominion's validation policy. It is signed with the default tenant's
+// Ed25519 key, which validators pin out of band.
+type ValidatorBundle struct {
+	Version           uint64          `json:"version"`
+	IssuedAt          time.Time       `json:"issued_at"`
+	Keys              []ValidatorKey  `json:"keys"`
+	AllowedAlgs       []string        `json:"allowed_algs"`
+	RevocationVersion uint64          `json:"revocation_version"`
+	Revoked           []RevokedToken  `json:"revoked"`
+	RetiredKeys       []KeyRetirement `json:"retired_keys"`
+	PolicyDigest      string          `json:"policy_digest"`
+	Signature         string          `json:"signature"`
+}
+
+// ExportValidatorBundle builds a signed bundle with the public keys of the
+// default tenant and tenantIDs. Version orders bundles; validators refuse
+// to replace a bundle with an older one.
+func (fd *ForgeDominion) ExportValidatorBundle(ctx context.Context, version uint64, tenantIDs ...string) (*ValidatorBundle, error) {
+	now := fd.now()
+	bundle := &ValidatorBundle{
+		Version:      version,
+		IssuedAt:     now,
+		AllowedAlgs:  []string{AlgEd25519},
+		PolicyDigest: fd.PolicyDigest(),
+	}
+	bundle.RevocationVersion, bundle.Revoked, bundle.RetiredKeys = fd.revocations.snapshot(now)
+
+	previous, previousUntil := fd.previousKeyWindow()
+	for _, tenantID := range append([]string{""}, tenantIDs...) {
+		pub, err := fd.PublicKey(ctx, tenantID)
+		if err != nil {
+			return nil, fmt.Errorf("failed to export key for tenant %q: %w", tenantID, err)
+		}
+		bundle.Keys = append(bundle.Keys, ValidatorKey{TenantID: tenantID, PublicKey: base64.URLEncoding.EncodeToString(pub)})
+
+		if previous == nil || !now.Before(previousUntil) {
+			continue
+		}
+		old, err := publicKey(ctx, previous, tenantID)
+		if err != nil {
+			return nil, fmt.Errorf("failed to export previous key for tenant %q: %w", tenantID, err)
+		}
+		bundle.Keys = append(bundle.Keys, ValidatorKey{TenantID: tenantID, PublicKey: base64.URLEncoding.EncodeToString(old), NotAfter: previousUntil})
+	}
+
+	payload, err := bundle.signingPayload()
+	if err != nil {
+		return nil, err
+	}
+	priv, err := signingKey(ctx, fd.currentKeys(), "")
+	if err != nil {
+		return nil, err
+	}
+	defer clear(priv)
+	bundle.Signature = base64.URLEncoding.EncodeToString(ed25519.Sign(priv, payload))
+	return bundle, nil
+}
+
+// PolicyDigest summarizes the dominion's validation-relevant settings so
+// operators can confirm every validator runs with the same policy
+func (fd *ForgeDominion) PolicyDigest() string {
+	data, _ := json.Marshal(struct {
+		AllowedAlgs  []string                 `json:"allowed_algs"`
+		MaxClockSkew time.Duration            `json:"max_clock_skew"`
+		MaxTTL       time.Duration            `json:"max_ttl"`
+		ScopeMaxTTL  map[string]time.Duration `json:"scope_max_ttl"`
+	}{fd.allowedAlgs, MaxClockSkew, fd.ttlPolicy.Max, fd.ttlPolicy.ScopeMax})
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func (b *ValidatorBundle) signingPayload() ([]byte, error) {
+	unsigned := *b
+	unsigned.Signature = ""
+	data, err := json.Marshal(unsigned)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode validator bundle: %w", err)
+	}
+	return append([]byte(validatorBundleDomain), data...), nil
+}
+
+// WriteValidatorBundle saves a bundle for distribution to validators
+func WriteValidatorBundle(bundle *ValidatorBundle, path string) error {
+	data, err := json.MarshalIndent(bundle, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal validator bundle: %w", err)
+	}
+	if err := writeFileAtomic(path, data, 0644); err != nil {
+		return fmt.Errorf("failed to write validator bundle: %w", err)
+	}
+	return nil
+}
+
+// ReadValidatorBundle loads a bundle written by WriteValidatorBundle. It is
+// verified when passed to NewValidator or Validator.Update.
+func ReadValidatorBundle(path string) (*ValidatorBundle, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read validator bundle: %w", err)
+	}
+	var bundle ValidatorBundle
+	if err := json.Unmarshal(data, &bundle); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal validator bundle: %w", err)
+	}
+	return &bundle, nil
+}
+
+// validatorKey is a decoded ValidatorKey
+type validatorKey struct {
+	pub      ed25519.PublicKey
+	notAfter time.Time
+}
+
+// Validator verifies Ed25519 tokens using only a validator bundle. It holds
+// no secrets and reads no environment variables.
+type Validator struct {
+	trusted ed25519.PublicKey
+
+	mu          sync.RWMutex
+	version     uint64
+	keys        map[string][]validatorKey
+	allowedAlgs []string
+	revocations *revocationList
+	digest      string
+	uses        UsageCounter
+	sessions    SessionStore
+	shared      RevocationStore
+	clock       Clock
+	roles       map[string]string
+}
+
+// NewValidator creates a validator from a bundle signed by trusted, the
+// issuing dominion's default-tenant public key
+func NewValidator(bundle *ValidatorBundle, trusted ed25519.PublicKey) (*Validator, error) {
+	if len(trusted) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("trusted key must be an Ed25519 public key")
+	}
+	v := &Validator{trusted: trusted}
+	if err := v.Update(bundle); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+// Update verifies bundle and replaces the validator's state with it.
+// Bundles older than the current one are rejected.
+func (v *Validator) Update(bundle *ValidatorBundle) error {
+	if bundle == nil {
+		return fmt.Errorf("validator bundle is nil")
+	}
+	sig, err := base64.URLEncoding.DecodeString(bundle.Signature)
+	if err != nil {
+		return fmt.Errorf("invalid validator bundle signature")
+	}
+	payload, err := bundle.signingPayload()
+	if err != nil {
+		return err
+	}
+	if !ed25519.Verify(v.trusted, payload, sig) {
+		return fmt.Errorf("invalid validator bundle signature")
+	}
+
+	keys := make(map[string][]validatorKey, len(bundle.Keys))
+	for _, k := range bundle.Keys {
+		pub, err := base64.URLEncoding.DecodeString(k.PublicKey)
+		if err != nil || len(pub) != ed25519.PublicKeySize {
+			return fmt.Errorf("invalid public key for tenant %q", k.TenantID)
+		}
+		keys[k.TenantID] = append(keys[k.TenantID], validatorKey{pub: pub, notAfter: k.NotAfter})
+	}
+	revocations := newRevocationList()
+	revocations.version = bundle.RevocationVersion
+	revocations.merge(bundle.Revoked, bundle.RetiredKeys)
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if v.keys != nil && bundle.Version < v.version {
+		return fmt.Errorf("validator bundle version %d is older than current version %d", bundle.Version, v.version)
+	}
+	v.version = bundle.Version
+	v.keys = keys
+	v.allowedAlgs = slices.Clone(bundle.AllowedAlgs)
+	v.revocations = revocations
+	v.digest = bundle.PolicyDigest
+	return nil
+}
+
+// SetUsageCounter sets the counter enforcing MaxUses. It should be shared
+// with the issuing dominion and every other validator; without one,
+// usage-limited tokens are rejected.
+func (v *Validator) SetUsageCounter(c UsageCounter) {
+	v.mu.Lock()
+	v.uses = c
+	v.mu.Unlock()
+}
+
+// SetSessionStore sets the store tracking sliding sessions. Like the usage
+// counter it should be shared with the issuing dominion; without one,
+// session tokens are rejected.
+func (v *Validator) SetSessionStore(s SessionStore) {
+	v.mu.Lock()
+	v.sessions = s
+	v.mu.Unlock()
+}
+
+// SetRevocationStore checks tokens against a store shared with the issuing
+// dominions, in addition to the bundle's revocations
+func (v *Validator) SetRevocationStore(s RevocationStore) {
+	v.mu.Lock()
+	v.shared = s
+	v.mu.Unlock()
+}
+
+// SetClock replaces the validator's clock, as ForgeDominion.SetClock does
+func (v *Validator) SetClock(c Clock) {
+	v.mu.Lock()
+	v.clock = c
+	v.mu.Unlock()
+}
+
+// SetRoles sets the role bindings EffectiveScope and Allows apply, as
+// ForgeDominion.SetRoles does. Bindings don't travel in the bundle, so a
+// validator honoring roles needs the issuer's roles file, see LoadRoles.
+func (v *Validator) SetRoles(roles map[string][]string) error {
+	bindings, err := roleBindings(roles)
+	if err != nil {
+		return err
+	}
+	v.mu.Lock()
+	v.roles = bindings
+	v.mu.Unlock()
+	return nil
+}
+
+// EffectiveScope returns token's scope together with the scopes bound to
+// its roles
+func (v *Validator) EffectiveScope(token *ForgeToken) string {
+	v.mu.RLock()
+	defer v.mu.RUnlock()
+	return effectiveScope(token, v.roles)
+}
+
+// Allows reports whether token's effective scope grants required. The
+// token must already have been validated.
+func (v *Validator) Allows(token *ForgeToken, required string) bool {
+	return scopeAllows(v.EffectiveScope(token), required)
+}
+
+// PolicyDigest returns the policy digest of the current bundle
+func (v *Validator) PolicyDigest() string {
+	v.mu.RLock()
+	defer v.mu.RUnlock()
+	return v.digest
+}
+
+// Validate checks a token's expiry, signature and revocation status
+func (v *Validator) Validate(token *ForgeToken) error {
+	if token == nil {
+		return fmt.Errorf("%w: token is nil", ErrMalformed)
+	}
+
+	v.mu.RLock()
+	clock := v.clock
+	v.mu.RUnlock()
+	now := time.Now()
+	if clock != nil {
+		now = clock.Now()
+	}
+	if now.After(token.ExpiresAt) {
+		return fmt.Errorf("%w at %s", ErrExpired, token.ExpiresAt)
+	}
+	if token.IssuedAt.After(now.Add(MaxClockSkew)) {
+		return fmt.Errorf("%w: issued at %s", ErrClockSkew, token.IssuedAt)
+	}
+
+	v.mu.RLock()
+	allowed := slices.Contains(v.allowedAlgs, TokenAlg(token))
+	keys, ok := v.keys[token.TenantID]
+	revocations := v.revocations
+	uses := v.uses
+	sessions := v.sessions
+	shared := v.shared
+	v.mu.RUnlock()
+
+	if !allowed || TokenAlg(token) != AlgEd25519 {
+		return fmt.Errorf("%w: alg %q is not allowed", ErrBadSignature, TokenAlg(token))
+	}
+	if !ok {
+		return fmt.Errorf("%w: no key for tenant %q", ErrBadSignature, token.TenantID)
+	}
+	sig, err := decodeSignature(token.Signature)
+	if err != nil {
+		return err
+	}
+	err = ErrBadSignature
+	for _, k := range keys {
+		if !k.notAfter.IsZero() && !now.Before(k.notAfter) {
+			continue
+		}
+		if err = verifyEd25519(k.pub, token, sig); err == nil {
+			break
+		}
+	}
+	if err != nil {
+		return err
+	}
+	if err := checkRevoked(context.Background(), revocations, shared, token); err != nil {
+		return err
+	}
+	if err := extendSession(context.Background(), sessions, token); err != nil {
+		return err
+	}
+	return consumeUse(context.Background(), uses, token)
+}
+
+// ValidateFrom is like Validate but also enforces the token's network
+// claims for remoteAddr, as ForgeDominion.ValidateTokenFrom does
+func (v *Validator) ValidateFrom(token *ForgeToken, remoteAddr string) error {
+	if err := v.Validate(token); err != nil {
+		return err
+	}
+	return checkNetwork(token, remoteAddr)
+}
@@ -0,0 +1,141 @@
+package forgeauth
+
+import (
+	"fmt"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// watchDebounce coalesces the burst of events a single rotation produces
+// (create temp, write, chmod, rename) into one reload
+const watchDebounce = 50 * time.Millisecond
+
+// TokenWatcher reloads a token file whenever it changes on disk, e.g. when
+// an external agent rotates it
+type TokenWatcher struct {
+	path    string
+	watcher *fsnotify.Watcher
+	updates chan *ForgeToken
+
+	mu      sync.RWMutex
+	token   *ForgeToken
+	lastErr error
+
+	done chan struct{}
+}
+
+// WatchToken loads the token at path and watches it for replacement. The
+// file's directory is watched rather than the file, so rename-based writers
+// such as SaveToken are picked up.
+func WatchToken(path string) (*TokenWatcher, error) {
+	token, err := LoadToken(path)
+	if err != nil {
+		return nil, err
+	}
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create file watcher: %w", err)
+	}
+	if err := watcher.Add(filepath.Dir(path)); err != nil {
+		watcher.Close()
+		return nil, fmt.Errorf("failed to watch %s: %w", path, err)
+	}
+
+	w := &TokenWatcher{
+		path:    filepath.Clean(path),
+		watcher: watcher,
+		updates: make(chan *ForgeToken, 1),
+		token:   token,
+		done:    make(chan struct{}),
+	}
+	go w.run()
+	return w, nil
+}
+
+// Updates delivers each newly loaded token. Only the latest token is kept
+// if the receiver falls behind, and the channel is closed by Close.
+func (w *TokenWatcher) Updates() <-chan *ForgeToken {
+	return w.updates
+}
+
+// Current returns the most recently loaded token
+func (w *TokenWatcher) Current() *ForgeToken {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	return w.token
+}
+
+// LastError returns the most recent reload or watch error, nil after a
+// successful reload
+func (w *TokenWatcher) LastError() error {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	return w.lastErr
+}
+
+// Close stops watching
+func (w *TokenWatcher) Close() error {
+	err := w.watcher.Close()
+	<-w.done
+	return err
+}
+
+func (w *TokenWatcher) run() {
+	defer close(w.done)
+	defer close(w.updates)
+
+	var reload <-chan time.Time
+	for {
+		select {
+		case event, ok := <-w.watcher.Events:
+			if !ok {
+				return
+			}
+			if filepath.Clean(event.Name) == w.path && !event.Has(fsnotify.Remove) {
+				reload = time.After(watchDebounce)
+			}
+		case err, ok := <-w.watcher.Errors:
+			if !ok {
+				return
+			}
+			w.setError(err)
+		case <-reload:
+			reload = nil
+			w.reload()
+		}
+	}
+}
+
+func (w *TokenWatcher) reload() {
+	token, err := LoadToken(w.path)
+	if err != nil {
+		w.setError(err)
+		return
+	}
+
+	w.mu.Lock()
+	changed := token.Signature != w.token.Signature
+	w.token = token
+	w.lastErr = nil
+	w.mu.Unlock()
+	if !changed {
+		return
+	}
+
+	// Replace an undelivered token rather than block the watch loop
+	select {
+	case <-w.updates:
+	default:
+	}
+	w.updates <- token
+}
+
+func (w *TokenWatcher) setError(err error) {
+	w.mu.Lock()
+	w.lastErr = err
+	w.mu.Unlock()
+}
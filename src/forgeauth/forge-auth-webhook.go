@@ -0,0 +1,291 @@
+package forgeauth
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// WebhookSignatureHeader carries a webhook payload's signature in the form
+// "t=<unix seconds>,v1=<hex HMAC-SHA256 of "<t>.<body>">"
+const WebhookSignatureHeader = "X-Forge-Signature"
+
+// Webhook delivery limits
+const (
+	webhookQueueSize = 256
+	webhookAttempts  = 3
+	webhookBackoff   = 500 * time.Millisecond
+)
+
+// defaultWebhookEvents are delivered when WebhookConfig.Events is empty
+var defaultWebhookEvents = []string{AuditIssue, AuditIssueBatch, AuditRenew, AuditExchange, AuditRevoke, AuditValidationFailures}
+
+// WebhookConfig describes an HTTP endpoint notified of dominion events
+type WebhookConfig struct {
+	// URL receives a JSON POST per event
+	URL string
+
+	// Secret signs every payload, see VerifyWebhook
+	Secret []byte
+
+	// Events selects the audit events delivered; defaults to token
+	// issuance, renewal, exchange, revocation and failure alerts
+	Events []string
+
+	// HTTPClient is used for delivery
+	HTTPClient *http.Client
+}
+
+// WebhookPayload is the body POSTed to a webhook. ID is unique per event
+// and repeated across retries, so receivers can drop duplicates.
+type WebhookPayload struct {
+	ID string `json:"id"`
+	AuditEntry
+}
+
+// webhook delivers events to one endpoint from a background goroutine so
+// a slow receiver never delays issuance
+type webhook struct {
+	cfg    WebhookConfig
+	queue  chan WebhookPayload
+	done   chan struct{}
+	cancel context.CancelFunc
+}
+
+// AddWebhook starts delivering dominion events to cfg.URL. Events are
+// queued and retried a few times; if the queue is full they are dropped.
+func (fd *ForgeDominion) AddWebhook(cfg WebhookConfig) error {
+	if !strings.HasPrefix(cfg.URL, "https://") && !strings.HasPrefix(cfg.URL, "http://") {
+		return fmt.Errorf("webhook URL must be http or https: %q", cfg.URL)
+	}
+	if len(cfg.Secret) < minRootKeyLen {
+		return fmt.Errorf("webhook secret must be at least %d bytes", minRootKeyLen)
+	}
+	if len(cfg.Events) == 0 {
+		cfg.Events = defaultWebhookEvents
+	}
+	if cfg.HTTPClient == nil {
+		cfg.HTTPClient = &http.Client{Timeout: 10 * time.Second}
+	}
+	cfg.Secret = bytes.Clone(cfg.Secret)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	w := &webhook{
+		cfg:    cfg,
+		queue:  make(chan WebhookPayload, webhookQueueSize),
+		done:   make(chan struct{}),
+		cancel: cancel,
+	}
+	go w.run(ctx)
+
+	fd.webhookMu.Lock()
+	fd.webhooks = append(fd.webhooks, w)
+	fd.webhookMu.Unlock()
+	return nil
+}
+
+// notifyWebhooks queues entry for every webhook subscribed to its event
+func (fd *ForgeDominion) notifyWebhooks(entry AuditEntry) {
+	fd.webhookMu.Lock()
+	defer fd.webhookMu.Unlock()
+	if len(fd.webhooks) == 0 {
+		return
+	}
+
+	id := make([]byte, 16)
+	rand.Read(id)
+	payload := WebhookPayload{ID: base64.RawURLEncoding.EncodeToString(id), AuditEntry: entry}
+	for _, w := range fd.webhooks {
+		if !slices.Contains(w.cfg.Events, entry.Event) {
+			continue
+		}
+		select {
+		case w.queue <- payload:
+		default:
+		}
+	}
+}
+
+// closeWebhooks stops delivery, waiting briefly for queued events to go out
+func (fd *ForgeDominion) closeWebhooks() {
+	fd.webhookMu.Lock()
+	webhooks := fd.webhooks
+	fd.webhooks = nil
+	fd.webhookMu.Unlock()
+
+	for _, w := range webhooks {
+		close(w.queue)
+	}
+	for _, w := range webhooks {
+		select {
+		case <-w.done:
+		case <-time.After(5 * time.Second):
+			w.cancel()
+			<-w.done
+		}
+	}
+}
+
+func (w *webhook) run(ctx context.Context) {
+	defer close(w.done)
+	defer w.cancel()
+	for payload := range w.queue {
+		body, err := json.Marshal(payload)
+		if err != nil {
+			continue
+		}
+		for attempt := 0; attempt < webhookAttempts; attempt++ {
+			if attempt > 0 {
+				select {
+				case <-time.After(webhookBackoff << (attempt - 1)):
+				case <-ctx.Done():
+					return
+				}
+			}
+			if w.deliver(ctx, body) == nil {
+				break
+			}
+		}
+	}
+}
+
+// deliver POSTs one signed payload; any 2xx response counts as delivered
+func (w *webhook) deliver(ctx context.Context, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.cfg.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(WebhookSignatureHeader, signWebhook(w.cfg.Secret, time.Now(), body))
+
+	resp, err := w.cfg.HTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("webhook %s returned %s", w.cfg.URL, resp.Status)
+	}
+	return nil
+}
+
+func signWebhook(secret []byte, t time.Time, body []byte) string {
+	ts := strconv.FormatInt(t.Unix(), 10)
+	return "t=" + ts + ",v1=" + hex.EncodeToString(webhookMAC(secret, ts, body))
+}
+
+func webhookMAC(secret []byte, ts string, body []byte) []byte {
+	h := hmac.New(sha256.New, secret)
+	h.Write([]byte(ts))
+	h.Write([]byte("."))
+	h.Write(body)
+	return h.Sum(nil)
+}
+
+// VerifyWebhook checks a webhook request's signature header against the
+// shared secret, rejecting signatures older than tolerance to limit
+// replays. Receivers should call it on the raw request body.
+func VerifyWebhook(secret []byte, header string, body []byte, tolerance time.Duration) error {
+	var ts, sig string
+	for _, part := range strings.Split(header, ",") {
+		k, v, _ := strings.Cut(part, "=")
+		switch k {
+		case "t":
+			ts = v
+		case "v1":
+			sig = v
+		}
+	}
+	unix, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil || sig == "" {
+		return fmt.Errorf("malformed webhook signature header")
+	}
+	mac, err := hex.DecodeString(sig)
+	if err != nil || !hmac.Equal(mac, webhookMAC(secret, ts, body)) {
+		return fmt.Errorf("invalid webhook signature")
+	}
+	if age := time.Since(time.Unix(unix, 0)); age > tolerance || age < -tolerance {
+		return fmt.Errorf("webhook signature timestamp is outside the %s tolerance", tolerance)
+	}
+	return nil
+}
+
+// failureAlert counts validation failures over a fixed window
+type failureAlert struct {
+	mu        sync.Mutex
+	threshold int
+	window    time.Duration
+	start     time.Time
+	count     int
+	reasons   map[string]int
+}
+
+// SetFailureAlert records an AuditValidationFailures event, delivered to
+// the audit sink and webhooks, whenever threshold validations fail within
+// window. Counting restarts after each alert. A zero threshold disables
+// alerting.
+func (fd *ForgeDominion) SetFailureAlert(threshold int, window time.Duration) error {
+	if threshold < 0 || (threshold > 0 && window <= 0) {
+		return fmt.Errorf("failure alert needs a positive threshold and window")
+	}
+	a := &fd.failureAlert
+	a.mu.Lock()
+	a.threshold, a.window = threshold, window
+	a.count, a.reasons = 0, nil
+	a.mu.Unlock()
+	return nil
+}
+
+// observeValidation updates the validation metrics, the failure alert and
+// the lockout table
+func (fd *ForgeDominion) observeValidation(ctx context.Context, token *ForgeToken, err error) {
+	fd.metrics.observeValidation(err)
+	if err == nil {
+		return
+	}
+	fd.observeLockout(ctx, token, err)
+
+	now := fd.now()
+	a := &fd.failureAlert
+	a.mu.Lock()
+	if a.threshold == 0 {
+		a.mu.Unlock()
+		return
+	}
+	if a.count == 0 || now.Sub(a.start) > a.window {
+		a.start, a.count, a.reasons = now, 0, make(map[string]int)
+	}
+	a.count++
+	a.reasons[FailureReason(err)]++
+	if a.count < a.threshold {
+		a.mu.Unlock()
+		return
+	}
+	count, reasons, window := a.count, a.reasons, a.window
+	a.count, a.reasons = 0, nil
+	a.mu.Unlock()
+
+	var detail []string
+	for _, reason := range slices.Sorted(maps.Keys(reasons)) {
+		detail = append(detail, fmt.Sprintf("%s=%d", reason, reasons[reason]))
+	}
+	fd.record(AuditEntry{
+		Time:   now,
+		Event:  AuditValidationFailures,
+		Count:  count,
+		Detail: fmt.Sprintf("%d failures within %s: %s", count, window, strings.Join(detail, " ")),
+	})
+}
@@ -0,0 +1,149 @@
+package forgeauth
+
+import (
+	"context"
+	"crypto/cipher"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Response wrapping seals an issued token under a single-use wrapping
+// token, so systems that carry tokens to nodes, e.g. a provisioning
+// pipeline or a chat message, only ever see a credential that unwraps
+// once. If an intermediary unwraps it first the node's unwrap fails,
+// which exposes the interception.
+
+// UnwrapScope is the scope of wrapping tokens. It grants nothing but
+// unwrapping.
+const UnwrapScope = "forge:unwrap"
+
+// wrappingKeyInfo is the HKDF info prefix for the key sealing a wrapped
+// token, followed by the wrapping token's ID
+const wrappingKeyInfo = "forge-dominion/response-wrapping/v1:"
+
+// defaultWrapTTL is how long a wrapped token can be unwrapped by default
+const defaultWrapTTL = 5 * time.Minute
+
+// WrappedToken is a token sealed for delivery. Sealed can only be opened
+// by the issuing dominion, and only while Wrapping validates.
+type WrappedToken struct {
+	Wrapping *ForgeToken `json:"wrapping_token"`
+	Sealed   string      `json:"sealed"`
+}
+
+// WrapToken seals token under a new single-use wrapping token for the same
+// node that expires after wrapTTL, or 5 minutes if zero. Rotating the root
+// keys invalidates outstanding wrapped tokens.
+func (fd *ForgeDominion) WrapToken(ctx context.Context, token *ForgeToken, wrapTTL time.Duration) (*WrappedToken, error) {
+	if token == nil {
+		return nil, fmt.Errorf("%w: token is nil", ErrMalformed)
+	}
+	if wrapTTL == 0 {
+		wrapTTL = defaultWrapTTL
+	}
+	if remaining := token.ExpiresAt.Sub(fd.now()); wrapTTL > remaining {
+		wrapTTL = remaining
+	}
+	if wrapTTL <= 0 {
+		return nil, fmt.Errorf("%w: can't wrap a token that has expired", ErrExpired)
+	}
+
+	wrapping, err := fd.requestToken(ctx, TokenSpec{TenantID: token.TenantID, NodeID: token.NodeID, Scope: UnwrapScope, TTL: wrapTTL, MaxUses: 1}, "wraps="+token.ID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to issue wrapping token: %w", err)
+	}
+	plaintext, err := json.Marshal(token)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode token: %w", err)
+	}
+	defer clear(plaintext)
+
+	aead, err := fd.wrappingAEAD(ctx, wrapping)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, fmt.Errorf("failed to generate nonce: %w", err)
+	}
+	sealed := aead.Seal(nonce, nonce, plaintext, []byte(wrapping.ID))
+	return &WrappedToken{Wrapping: wrapping, Sealed: base64.URLEncoding.EncodeToString(sealed)}, nil
+}
+
+// RequestWrappedToken issues a token from spec and wraps it, so the token
+// itself never leaves the dominion unsealed
+func (fd *ForgeDominion) RequestWrappedToken(ctx context.Context, spec TokenSpec, wrapTTL time.Duration) (*WrappedToken, error) {
+	token, err := fd.requestToken(ctx, spec, "wrapped")
+	if err != nil {
+		return nil, err
+	}
+	return fd.WrapToken(ctx, token, wrapTTL)
+}
+
+// UnwrapToken validates and spends w's wrapping token and returns the
+// token sealed under it. An ErrExhausted error means the token was already
+// unwrapped, by an intermediary if not by the caller, and should be
+// revoked.
+func (fd *ForgeDominion) UnwrapToken(ctx context.Context, w *WrappedToken) (*ForgeToken, error) {
+	if w == nil || w.Wrapping == nil {
+		return nil, fmt.Errorf("%w: wrapped token is nil", ErrMalformed)
+	}
+	if w.Wrapping.Scope != UnwrapScope {
+		return nil, fmt.Errorf("%w: not a wrapping token", ErrScopeDenied)
+	}
+	if err := fd.ValidateTokenContext(ctx, w.Wrapping); err != nil {
+		if errors.Is(err, ErrExhausted) {
+			return nil, fmt.Errorf("wrapped token was already unwrapped: %w", err)
+		}
+		return nil, err
+	}
+
+	sealed, err := base64.URLEncoding.DecodeString(w.Sealed)
+	if err != nil {
+		return nil, fmt.Errorf("%w: invalid sealed token", ErrMalformed)
+	}
+	aead, err := fd.wrappingAEAD(ctx, w.Wrapping)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < aead.NonceSize() {
+		return nil, fmt.Errorf("%w: invalid sealed token", ErrMalformed)
+	}
+	nonce, ciphertext := sealed[:aead.NonceSize()], sealed[aead.NonceSize():]
+	plaintext, err := aead.Open(nil, nonce, ciphertext, []byte(w.Wrapping.ID))
+	if err != nil {
+		return nil, fmt.Errorf("%w: sealed token does not belong to its wrapping token", ErrBadSignature)
+	}
+	defer clear(plaintext)
+
+	var token ForgeToken
+	if err := json.Unmarshal(plaintext, &token); err != nil {
+		return nil, fmt.Errorf("%w: invalid sealed token: %v", ErrMalformed, err)
+	}
+	// WrapToken only wraps a token for its own tenant and node
+	if token.TenantID != w.Wrapping.TenantID || token.NodeID != w.Wrapping.NodeID {
+		return nil, fmt.Errorf("%w: sealed token is for another node", ErrBadSignature)
+	}
+	return &token, nil
+}
+
+// wrappingAEAD returns the cipher sealing the token wrapped by wrapping,
+// keyed from its tenant's root key and its ID
+func (fd *ForgeDominion) wrappingAEAD(ctx context.Context, wrapping *ForgeToken) (cipher.AEAD, error) {
+	rootKey, err := rootKey(ctx, fd.currentKeys(), wrapping.TenantID)
+	if err != nil {
+		return nil, err
+	}
+	key, err := hkdf.Key(sha256.New, rootKey, nil, wrappingKeyInfo+wrapping.ID, 32)
+	if err != nil {
+		return nil, fmt.Errorf("failed to derive wrapping key: %w", err)
+	}
+	defer clear(key)
+	return newStoreAEAD(key)
+}
@@ -0,0 +1,147 @@
+package forgeauth
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func wrapTestToken(t *testing.T, fd *ForgeDominion, tenantID, nodeID string) *WrappedToken {
+	t.Helper()
+	w, err := fd.RequestWrappedToken(context.Background(), TokenSpec{TenantID: tenantID, NodeID: nodeID, Scope: "runtime:read", TTL: time.Hour}, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return w
+}
+
+func TestWrapUnwrapsOnce(t *testing.T) {
+	fd, _ := newTestDominion(t, AlgHS256)
+	ctx := context.Background()
+	w := wrapTestToken(t, fd, "", "node-1")
+	token, err := fd.UnwrapToken(ctx, w)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token.NodeID != "node-1" || token.Scope != "runtime:read" {
+		t.Errorf("unwrapped %s for %q, want node-1 for runtime:read", token.NodeID, token.Scope)
+	}
+	if err := fd.ValidateToken(token); err != nil {
+		t.Errorf("unwrapped token: %v", err)
+	}
+	if _, err := fd.UnwrapToken(ctx, w); !errors.Is(err, ErrExhausted) {
+		t.Errorf("second unwrap: got %v, want %v", err, ErrExhausted)
+	}
+}
+
+func TestWrapConcurrentUnwrap(t *testing.T) {
+	fd, _ := newTestDominion(t, AlgHS256)
+	w := wrapTestToken(t, fd, "", "node-1")
+	var unwrapped atomic.Int32
+	var wg sync.WaitGroup
+	for range 16 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := fd.UnwrapToken(context.Background(), w); err == nil {
+				unwrapped.Add(1)
+			}
+		}()
+	}
+	wg.Wait()
+	if n := unwrapped.Load(); n != 1 {
+		t.Errorf("unwrapped %d times, want once", n)
+	}
+}
+
+func TestWrapExpires(t *testing.T) {
+	fd, clock := newTestDominion(t, AlgHS256)
+	w := wrapTestToken(t, fd, "", "node-1")
+	clock.Advance(time.Minute + time.Second)
+	if _, err := fd.UnwrapToken(context.Background(), w); !errors.Is(err, ErrExpired) {
+		t.Errorf("unwrap after the wrapping expired: got %v, want %v", err, ErrExpired)
+	}
+}
+
+func TestWrapRefusesAnotherTenantOrNode(t *testing.T) {
+	fd := NewForgeDominionWithKeys(StaticKeyProvider{
+		"":     bytes.Clone(testRootKey),
+		"acme": bytes.Repeat([]byte{0x43}, minRootKeyLen),
+	})
+	fd.SetClock(NewFakeClock(testEpoch))
+	ctx := context.Background()
+	tests := []struct {
+		name string
+		make func() *WrappedToken
+	}{
+		{"wrapping moved to another tenant", func() *WrappedToken {
+			w := wrapTestToken(t, fd, "acme", "node-1")
+			moved := *w.Wrapping
+			moved.TenantID = ""
+			return &WrappedToken{Wrapping: &moved, Sealed: w.Sealed}
+		}},
+		{"wrapping moved to another node", func() *WrappedToken {
+			w := wrapTestToken(t, fd, "", "node-1")
+			moved := *w.Wrapping
+			moved.NodeID = "node-2"
+			return &WrappedToken{Wrapping: &moved, Sealed: w.Sealed}
+		}},
+		{"sealed token under another node's wrapping", func() *WrappedToken {
+			w := wrapTestToken(t, fd, "", "node-1")
+			return &WrappedToken{Wrapping: wrapTestToken(t, fd, "", "node-2").Wrapping, Sealed: w.Sealed}
+		}},
+		{"sealed token under another tenant's wrapping", func() *WrappedToken {
+			w := wrapTestToken(t, fd, "acme", "node-1")
+			return &WrappedToken{Wrapping: wrapTestToken(t, fd, "", "node-1").Wrapping, Sealed: w.Sealed}
+		}},
+		{"not a wrapping token", func() *WrappedToken {
+			w := wrapTestToken(t, fd, "", "node-1")
+			token, err := fd.RequestToken("node-1", "runtime:read", time.Hour)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return &WrappedToken{Wrapping: token, Sealed: w.Sealed}
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if token, err := fd.UnwrapToken(ctx, tt.make()); err == nil {
+				t.Errorf("unwrapped %s's token of tenant %q", token.NodeID, token.TenantID)
+			}
+		})
+	}
+}
+
+func TestWrapRefusesMismatchedSealedToken(t *testing.T) {
+	fd, _ := newTestDominion(t, AlgHS256)
+	ctx := context.Background()
+	token, err := fd.RequestToken("node-2", "runtime:read", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// node-2's token sealed under a wrapping token issued to node-1
+	wrapping, err := fd.requestToken(ctx, TokenSpec{NodeID: "node-1", Scope: UnwrapScope, TTL: time.Minute, MaxUses: 1}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	aead, err := fd.wrappingAEAD(ctx, wrapping)
+	if err != nil {
+		t.Fatal(err)
+	}
+	plaintext, err := json.Marshal(token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nonce := make([]byte, aead.NonceSize())
+	sealed := aead.Seal(nonce, nonce, plaintext, []byte(wrapping.ID))
+	w := &WrappedToken{Wrapping: wrapping, Sealed: base64.URLEncoding.EncodeToString(sealed)}
+	if _, err := fd.UnwrapToken(ctx, w); !errors.Is(err, ErrBadSignature) {
+		t.Errorf("node-2's token under node-1's wrapping: got %v, want %v", err, ErrBadSignature)
+	}
+}
@@ -0,0 +1,774 @@
+// Package forgeauth issues and validates ForgeTokens: short-lived, scoped
+// runtime tokens signed with keys derived from a dominion's root key. The
+// forge-auth command and the harmony engine are built on it.
+package forgeauth
+
+import (
+"bytes"
+"context"
+"crypto/hkdf"
+"crypto/rand"
+"crypto/sha256"
+"encoding/base64"
+"encoding/json"
+"errors"
+"fmt"
+"slices"
+"sync"
+"time"
+)
+
+// ForgeToken represents an ephemeral runtime token
+type ForgeToken struct {
+// Version is the document schema version, see MarshalToken
+Version int `json:"version,omitempty"`
+
+ID        string    `json:"jti,omitempty"`
+NodeID    string    `json:"node_id"`
+IssuedAt  time.Time `json:"issued_at"`
+ExpiresAt time.Time `json:"expires_at"`
+Scope     string    `json:"scope"`
+TenantID  string    `json:"tenant_id,omitempty"`
+Audience  string    `json:"audience,omitempty"`
+
+// Networks restricts where the token may be presented from, as CIDR
+// prefixes; see ValidateTokenFrom
+Networks []string `json:"networks,omitempty"`
+
+// MaxUses limits how many times the token validates; zero means no limit
+MaxUses int `json:"max_uses,omitempty"`
+
+// IdleTimeout makes the token a sliding session: it stops validating once
+// unused for this long, while ExpiresAt caps its total lifetime
+IdleTimeout time.Duration `json:"idle_timeout,omitempty"`
+
+// Profile names the token profile the token was issued from
+Profile string `json:"profile,omitempty"`
+
+// Claims holds signed deployment-specific data such as a rack ID, see
+// Claim. Values are JSON values.
+Claims map[string]any `json:"claims,omitempty"`
+
+// Roles grant the scopes bound to them with SetRoles, in addition to
+// Scope
+Roles []string `json:"roles,omitempty"`
+
+// SessionID links a token to the one that started its session: it is
+// the first token's ID, carried through renewals and exchanges so the
+// whole chain can be listed and killed (see KillSession)
+SessionID string `json:"sid,omitempty"`
+
+// Attestation records the verified TPM state of the node the token was
+// issued to, see RequestTokenWithTPM
+Attestation string `json:"attestation,omitempty"`
+
+// KeyBinding is the thumbprint of a client key the token is bound to, see
+// KeyThumbprint. Requests must then carry a proof signed with that key,
+// see ValidateProof.
+KeyBinding string `json:"cnf,omitempty"`
+
+// SigningVersion selects the payload layout covered by Signature, and Alg
+// the MAC algorithm (empty means HS256)
+SigningVersion int    `json:"sig_version"`
+Alg            string `json:"alg,omitempty"`
+Signature      string `json:"signature"`
+}
+
+// minRootKeyLen is the shortest root key accepted, matching the HMAC-SHA256
+// output size
+const minRootKeyLen = 32
+
+// ForgeDominion handles Forge authentication and token management
+type ForgeDominion struct {
+// keys signs new tokens; previousKeys still verifies tokens until
+// previousUntil after a rotation (see RotateKeys)
+keyMu         sync.RWMutex
+keys          KeyProvider
+previousKeys  KeyProvider
+previousUntil time.Time
+
+audit      AuditSink
+policy     Policy
+federation *oidcFederation
+
+// peers are the dominions trusted by TrustDominion
+trustMu sync.RWMutex
+peers   map[string]*trustedPeer
+
+revocations *revocationList
+metrics     *forgeMetrics
+ledger      ledgerBackend
+ttlPolicy   TTLPolicy
+uses        UsageCounter
+sessions    SessionStore
+enrollments EnrollmentStore
+profiles    map[string]TokenProfile
+
+// roles maps each role to its bound scope, see SetRoles
+rolesMu sync.RWMutex
+roles   map[string]string
+
+// signers are the algorithms added with RegisterSigner
+signers map[string]registeredSigner
+
+// revocationStore shares revocations across instances, see
+// SetRevocationStore
+revocationStore RevocationStore
+
+// webhooks are notified of audit events, see AddWebhook
+webhookMu    sync.Mutex
+webhooks     []*webhook
+failureAlert failureAlert
+
+// lockout refuses principals after repeated failures, see SetLockout
+lockout lockoutTable
+
+// attestedScopes need a TPM quote to be issued, see RequireAttestation
+attestedScopes []string
+
+// preIssue and postIssue are the issuance hooks, see AddPreIssueHook
+hooksMu   sync.RWMutex
+preIssue  []PreIssueHook
+postIssue []PostIssueHook
+
+// signingAlg is used for new tokens; allowedAlgs restricts validation
+// (nil allows every supported algorithm)
+signingAlg  string
+allowedAlgs []string
+
+// fips restricts the dominion to approved primitives, see EnableFIPS
+fips bool
+
+// clock is the time source, see SetClock
+clock Clock
+}
+
+// NewForgeDominion creates a new Forge Dominion auth handler
+func NewForgeDominion() (*ForgeDominion, error) {
+keys := newLockedEnvKeys()
+
+// Fail fast on a missing or weak default root key
+if _, err := keys.RootKey(""); err != nil {
+return nil, err
+}
+
+fd := NewForgeDominionWithKeys(keys)
+if err := fd.fipsReady(); err != nil {
+return nil, err
+}
+return fd, nil
+}
+
+// NewForgeDominionWithKeys creates a dominion using the given root key
+// material, e.g. a StaticKeyProvider holding one key per tenant. When FIPS
+// mode is required (see EnableFIPS) the dominion starts in it.
+func NewForgeDominionWithKeys(keys KeyProvider) *ForgeDominion {
+fd := &ForgeDominion{
+keys:        keys,
+revocations: newRevocationList(),
+metrics:     newForgeMetrics(),
+signingAlg:  AlgHS256,
+ttlPolicy:   TTLPolicy{Max: defaultMaxTTL},
+}
+fd.uses = newMemoryUsageCounter(fd.now)
+fd.sessions = newMemorySessionStore(fd.now)
+fd.enrollments = newMemoryEnrollmentStore(fd.now)
+if fipsRequired() {
+fd.fips = true
+fd.allowedAlgs = slices.Clone(fipsAlgs)
+}
+return fd
+}
+
+// TokenSpec describes a single token to issue
+type TokenSpec struct {
+TenantID string
+NodeID   string
+Scope    string
+Audience string
+Networks []string
+MaxUses  int
+TTL      time.Duration
+
+// IdleTimeout issues a sliding session, see ForgeToken.IdleTimeout. TTL
+// is then the absolute lifetime cap.
+IdleTimeout time.Duration
+
+// Profile is recorded in the token, see RequestProfileToken
+Profile string
+
+// Claims are signed custom claims, see ForgeToken.Claims
+Claims map[string]any
+
+// Roles must be bound with SetRoles, see ForgeToken.Roles
+Roles []string
+
+// SessionID continues an existing session; empty starts a new one
+SessionID string
+
+// KeyBinding binds the token to a client key, see ForgeToken.KeyBinding
+KeyBinding string
+
+// attestation is set only from a verified TPM quote, so callers can't
+// claim one
+attestation string
+}
+
+// RequestToken generates a new ephemeral token for runtime operations
+func (fd *ForgeDominion) RequestToken(nodeID string, scope string, ttl time.Duration) (*ForgeToken, error) {
+return fd.RequestTokenContext(context.Background(), nodeID, scope, ttl)
+}
+
+// RequestTokenContext is like RequestToken; ctx bounds any key provider
+// calls made while signing
+func (fd *ForgeDominion) RequestTokenContext(ctx context.Context, nodeID string, scope string, ttl time.Duration) (*ForgeToken, error) {
+return fd.requestToken(ctx, TokenSpec{NodeID: nodeID, Scope: scope, TTL: ttl}, "")
+}
+
+// requestToken issues and audits a single token; detail is added to the
+// audit entry, e.g. to record how the node proved its identity
+func (fd *ForgeDominion) requestToken(ctx context.Context, spec TokenSpec, detail string) (*ForgeToken, error) {
+ttl, err := fd.effectiveTTL(spec.Scope, spec.TTL, true)
+if err != nil {
+return nil, err
+}
+spec.TTL = ttl
+
+now := fd.now()
+if err := fd.checkPolicy(PolicyRequest{Operation: PolicyIssue, TenantID: spec.TenantID, NodeID: spec.NodeID, Scope: spec.Scope, Roles: spec.Roles, TTL: spec.TTL, Time: now}); err != nil {
+return nil, err
+}
+
+token, err := fd.issue(ctx, spec, now, now.Add(spec.TTL))
+if err != nil {
+return nil, err
+}
+if err := fd.ledgerIssued(token); err != nil {
+return nil, err
+}
+
+fd.record(AuditEntry{
+Time:      now,
+Event:     AuditIssue,
+TenantID:  token.TenantID,
+NodeID:    token.NodeID,
+Scope:     token.Scope,
+Audience:  token.Audience,
+ExpiresAt: token.ExpiresAt,
+Detail:    detail,
+})
+
+return token, nil
+}
+
+// RequestTokens mints one token per spec in a single call, e.g. for fleet
+// bootstrap. Either every token is issued or none are, and the batch is
+// recorded as one audit entry.
+func (fd *ForgeDominion) RequestTokens(specs []TokenSpec) ([]*ForgeToken, error) {
+return fd.requestTokens(context.Background(), specs, time.Time{})
+}
+
+// RequestTokensUntil is like RequestTokens but gives every token the same
+// expiry, ignoring the per-spec TTL
+func (fd *ForgeDominion) RequestTokensUntil(specs []TokenSpec, expiresAt time.Time) ([]*ForgeToken, error) {
+if expiresAt.IsZero() {
+return nil, fmt.Errorf("shared expiry must be set")
+}
+return fd.requestTokens(context.Background(), specs, expiresAt)
+}
+
+func (fd *ForgeDominion) requestTokens(ctx context.Context, specs []TokenSpec, sharedExpiry time.Time) ([]*ForgeToken, error) {
+now := fd.now()
+if !sharedExpiry.IsZero() && !sharedExpiry.After(now) {
+return nil, fmt.Errorf("shared expiry %s is in the past", sharedExpiry.Format(time.RFC3339))
+}
+
+// Check every spec before signing anything so a bad entry fails the batch
+specs = slices.Clone(specs)
+for i, spec := range specs {
+if spec.NodeID == "" {
+return nil, fmt.Errorf("token spec %d: node ID is empty", i)
+}
+
+ttl := spec.TTL
+if !sharedExpiry.IsZero() {
+ttl = sharedExpiry.Sub(now)
+}
+ttl, err := fd.effectiveTTL(spec.Scope, ttl, sharedExpiry.IsZero())
+if err != nil {
+return nil, fmt.Errorf("token spec %d (%s): %w", i, spec.NodeID, err)
+}
+specs[i].TTL = ttl
+
+if err := fd.checkPolicy(PolicyRequest{Operation: PolicyIssue, TenantID: spec.TenantID, NodeID: spec.NodeID, Scope: spec.Scope, Roles: spec.Roles, TTL: ttl, Time: now}); err != nil {
+return nil, fmt.Errorf("token spec %d: %w", i, err)
+}
+}
+
+tokens := make([]*ForgeToken, 0, len(specs))
+nodes := make([]string, 0, len(specs))
+for _, spec := range specs {
+expiresAt := sharedExpiry
+if expiresAt.IsZero() {
+expiresAt = now.Add(spec.TTL)
+}
+
+token, err := fd.issue(ctx, spec, now, expiresAt)
+if err != nil {
+fd.discard(tokens...)
+return nil, fmt.Errorf("failed to issue token for %s: %w", spec.NodeID, err)
+}
+tokens = append(tokens, token)
+if spec.TenantID != "" {
+nodes = append(nodes, spec.TenantID+"/"+spec.NodeID)
+} else {
+nodes = append(nodes, spec.NodeID)
+}
+}
+if err := fd.ledgerIssued(tokens...); err != nil {
+return nil, err
+}
+
+fd.record(AuditEntry{
+Time:      now,
+Event:     AuditIssueBatch,
+ExpiresAt: sharedExpiry,
+Count:     len(tokens),
+Nodes:     nodes,
+})
+
+return tokens, nil
+}
+
+// issue builds and signs a token without auditing it
+func (fd *ForgeDominion) issue(ctx context.Context, spec TokenSpec, issuedAt time.Time, expiresAt time.Time) (*ForgeToken, error) {
+start := time.Now()
+if err := fd.fipsReady(); err != nil {
+return nil, err
+}
+if err := fd.runPreIssueHooks(ctx, &spec); err != nil {
+return nil, err
+}
+if err := fd.checkLockout(ctx, spec.TenantID, spec.NodeID); err != nil {
+return nil, err
+}
+if err := validateTenantID(spec.TenantID); err != nil {
+return nil, err
+}
+if err := ValidateScope(spec.Scope); err != nil {
+return nil, err
+}
+networks, err := normalizeNetworks(spec.Networks)
+if err != nil {
+return nil, err
+}
+if spec.MaxUses < 0 {
+return nil, fmt.Errorf("max uses must not be negative")
+}
+if err := validateIdleTimeout(spec.IdleTimeout); err != nil {
+return nil, err
+}
+claims, err := normalizeClaims(spec.Claims)
+if err != nil {
+return nil, err
+}
+if err := fd.checkRoles(spec.Roles); err != nil {
+return nil, err
+}
+if err := fd.checkAttestation(spec); err != nil {
+return nil, err
+}
+if err := validateKeyBinding(spec.KeyBinding); err != nil {
+return nil, err
+}
+
+id, err := newTokenID()
+if err != nil {
+return nil, err
+}
+
+token := &ForgeToken{
+Version:        currentTokenSchema,
+ID:             id,
+NodeID:         spec.NodeID,
+IssuedAt:       issuedAt,
+ExpiresAt:      expiresAt,
+Scope:          spec.Scope,
+TenantID:       spec.TenantID,
+Audience:       spec.Audience,
+Networks:       networks,
+MaxUses:        spec.MaxUses,
+IdleTimeout:    spec.IdleTimeout,
+Profile:        spec.Profile,
+Claims:         claims,
+Roles:          normalizeRoles(spec.Roles),
+SessionID:      spec.SessionID,
+Attestation:    spec.attestation,
+KeyBinding:     spec.KeyBinding,
+SigningVersion: signingVersion,
+}
+if token.SessionID == "" {
+token.SessionID = id
+}
+
+// HS256 is left implicit so validators that predate the alg claim keep
+// accepting default tokens
+if fd.signingAlg != AlgHS256 {
+token.Alg = fd.signingAlg
+}
+
+sig, err := fd.sign(ctx, token)
+if err != nil {
+return nil, err
+}
+token.Signature = sig
+if err := fd.runPostIssueHooks(ctx, token); err != nil {
+return nil, err
+}
+
+fd.metrics.observeIssue(token, time.Since(start))
+return token, nil
+}
+
+// ValidateToken checks if a token is valid and not expired
+func (fd *ForgeDominion) ValidateToken(token *ForgeToken) error {
+return fd.ValidateTokenContext(context.Background(), token)
+}
+
+// ValidateTokenContext is like ValidateToken; ctx bounds any key provider
+// calls made while checking the signature
+func (fd *ForgeDominion) ValidateTokenContext(ctx context.Context, token *ForgeToken) error {
+err := fd.validateToken(ctx, token)
+fd.observeValidation(ctx, token, err)
+return err
+}
+
+func (fd *ForgeDominion) validateToken(ctx context.Context, token *ForgeToken) error {
+if token == nil {
+return fmt.Errorf("%w: token is nil", ErrMalformed)
+}
+if err := fd.checkLockout(ctx, token.TenantID, token.NodeID); err != nil {
+return err
+}
+
+// Check expiration and that the issuer's clock agrees with ours
+now := fd.now()
+if now.After(token.ExpiresAt) {
+return fmt.Errorf("%w at %s", ErrExpired, token.ExpiresAt)
+}
+if token.IssuedAt.After(now.Add(MaxClockSkew)) {
+return fmt.Errorf("%w: issued at %s", ErrClockSkew, token.IssuedAt)
+}
+
+if err := fd.VerifySignature(ctx, token); err != nil {
+return err
+}
+
+// Only trust revocation data once the claims are known to be authentic
+if err := fd.checkRevoked(ctx, token); err != nil {
+return err
+}
+
+// Only extend sessions and count uses once the token is known to be
+// authentic and live
+if err := fd.extendSession(ctx, token); err != nil {
+return err
+}
+return fd.consumeUse(ctx, token)
+}
+
+// VerifySignature checks the token's alg and signature against the key
+// derived for its node, ignoring expiry and revocation
+func (fd *ForgeDominion) VerifySignature(ctx context.Context, token *ForgeToken) error {
+if err := fd.fipsReady(); err != nil {
+return err
+}
+if err := fd.checkAlg(token); err != nil {
+return err
+}
+
+sig, err := decodeSignature(token.Signature)
+if err != nil {
+return err
+}
+
+err = fd.verifyWith(ctx, fd.currentKeys(), token, sig)
+if errors.Is(err, ErrBadSignature) {
+if previous := fd.graceKeys(fd.now()); previous != nil && fd.verifyWith(ctx, previous, token, sig) == nil {
+fd.metrics.observePreviousKey()
+return nil
+}
+}
+return err
+}
+
+// decodeSignature decodes an encoded token signature. Only the canonical
+// encoding is accepted: the decoder skips newlines, so one signature would
+// otherwise have many spellings, and a token many that validate.
+func decodeSignature(encoded string) ([]byte, error) {
+sig, err := base64.URLEncoding.DecodeString(encoded)
+if err != nil || len(sig) == 0 || base64.URLEncoding.EncodeToString(sig) != encoded {
+return nil, ErrBadSignature
+}
+return sig, nil
+}
+
+// verifyWith checks a decoded signature with the verifier for the token's
+// alg, using the key material in keys for the built-in algorithms
+func (fd *ForgeDominion) verifyWith(ctx context.Context, keys KeyProvider, token *ForgeToken, sig []byte) error {
+payload, err := signingPayload(token)
+if err != nil {
+return fmt.Errorf("%w: %v", ErrBadSignature, err)
+}
+_, verifier := fd.signerFor(keys, token)
+return verifyPayload(ctx, verifier, payload, sig)
+}
+
+// newTokenID returns a random token identifier for revocation
+func newTokenID() (string, error) {
+b := make([]byte, 16)
+if _, err := rand.Read(b); err != nil {
+return "", fmt.Errorf("failed to generate token ID: %w", err)
+}
+return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// nodeKeyInfo is the HKDF info prefix for per-node signing keys
+const nodeKeyInfo = "forge-dominion/node-key/v1:"
+
+// tenantNodeKeyInfo is the HKDF info prefix for nodes belonging to a tenant
+const tenantNodeKeyInfo = "forge-dominion/tenant-node-key/v1:"
+
+// deriveNodeKey derives the signing key for a single node from its tenant's
+// root key. A leaked node key only allows forging tokens for that NodeID.
+func deriveNodeKey(ctx context.Context, keys KeyProvider, tenantID string, nodeID string) ([]byte, error) {
+rootKey, err := rootKey(ctx, keys, tenantID)
+if err != nil {
+return nil, err
+}
+
+info := nodeKeyInfo + nodeID
+if tenantID != "" {
+info = tenantNodeKeyInfo + tenantID + "/" + nodeID
+}
+
+key, err := hkdf.Key(sha256.New, rootKey, nil, info, sha256.Size)
+if err != nil {
+return nil, fmt.Errorf("failed to derive node key: %w", err)
+}
+return key, nil
+}
+
+// signingVersion is the signing scheme used for newly issued tokens.
+// Version 1 was an unversioned colon-delimited string in which a scope
+// containing ':' could alias another token's payload; it is no longer
+// accepted.
+const signingVersion = 2
+
+// signingDomain prefixes every v2 payload so signatures can't be replayed
+// against other HMAC uses of the same key
+const signingDomain = "forge-dominion/token/v2\n"
+
+// signedClaims is the canonical v2 serialization of a token's claims. It is
+// encoded as JSON, whose field order follows the struct, and timestamps are
+// whole Unix seconds so every wire encoding reproduces the same bytes.
+//
+// New claims must be appended with omitempty: tokens issued before a claim
+// existed then keep their signature, and validators that don't know a
+// claim drop it when decoding and fail closed on the signature.
+type signedClaims struct {
+Version   int            `json:"v"`
+NodeID    string         `json:"node_id"`
+Scope     string         `json:"scope"`
+IssuedAt  int64          `json:"iat"`
+ExpiresAt int64          `json:"exp"`
+TenantID  string         `json:"tid,omitempty"`
+Audience  string         `json:"aud,omitempty"`
+ID        string         `json:"jti,omitempty"`
+Alg       string         `json:"alg,omitempty"`
+Networks  []string       `json:"net,omitempty"`
+MaxUses   int            `json:"uses,omitempty"`
+Idle      int64          `json:"idle,omitempty"`
+Profile   string         `json:"prof,omitempty"`
+Claims    map[string]any `json:"ext,omitempty"`
+Roles     []string       `json:"roles,omitempty"`
+SessionID string         `json:"sid,omitempty"`
+Attest    string         `json:"att,omitempty"`
+Cnf       string         `json:"cnf,omitempty"`
+}
+
+// signingPayload returns the bytes covered by the token signature
+func signingPayload(token *ForgeToken) ([]byte, error) {
+if token.SigningVersion != signingVersion {
+return nil, fmt.Errorf("unsupported token signing version %d; token must be reissued", token.SigningVersion)
+}
+
+claims, err := json.Marshal(signedClaims{
+Version:   token.SigningVersion,
+NodeID:    token.NodeID,
+Scope:     token.Scope,
+IssuedAt:  token.IssuedAt.Unix(),
+ExpiresAt: token.ExpiresAt.Unix(),
+TenantID:  token.TenantID,
+Audience:  token.Audience,
+ID:        token.ID,
+Alg:       token.Alg,
+Networks:  token.Networks,
+MaxUses:   token.MaxUses,
+Idle:      int64(token.IdleTimeout / time.Second),
+Profile:   token.Profile,
+Claims:    token.Claims,
+Roles:     token.Roles,
+SessionID: token.SessionID,
+Attest:    token.Attestation,
+Cnf:       token.KeyBinding,
+})
+if err != nil {
+return nil, fmt.Errorf("failed to encode token claims: %w", err)
+}
+
+return append([]byte(signingDomain), claims...), nil
+}
+
+// sign computes the encoded token signature
+func (fd *ForgeDominion) sign(ctx context.Context, token *ForgeToken) (string, error) {
+payload, err := signingPayload(token)
+if err != nil {
+return "", err
+}
+signer, _ := fd.signerFor(fd.currentKeys(), token)
+if signer == nil {
+return "", fmt.Errorf("alg %q is registered for verification only", TokenAlg(token))
+}
+sig, err := signer.Sign(ctx, payload)
+if err != nil {
+return "", fmt.Errorf("failed to sign token: %w", err)
+}
+return base64.URLEncoding.EncodeToString(sig), nil
+}
+
+// RenewToken creates a new token based on an existing valid token
+func (fd *ForgeDominion) RenewToken(oldToken *ForgeToken, ttl time.Duration) (*ForgeToken, error) {
+return fd.RenewTokenContext(context.Background(), oldToken, ttl)
+}
+
+// RenewTokenContext is like RenewToken; ctx bounds any key provider calls
+// made while validating the old token and signing the new one
+func (fd *ForgeDominion) RenewTokenContext(ctx context.Context, oldToken *ForgeToken, ttl time.Duration) (*ForgeToken, error) {
+// A renewal would reset the use count under a new token ID
+if oldToken != nil && oldToken.MaxUses > 0 {
+return nil, fmt.Errorf("%w: usage-limited tokens cannot be renewed", ErrPolicyDenied)
+}
+if oldToken != nil && oldToken.Scope == RefreshScope {
+return nil, fmt.Errorf("%w: refresh credentials cannot be renewed", ErrPolicyDenied)
+}
+
+// Validate old token first
+if err := fd.ValidateTokenContext(ctx, oldToken); err != nil {
+return nil, fmt.Errorf("cannot renew invalid token: %w", err)
+}
+return fd.renew(ctx, oldToken, ttl, "")
+}
+
+// renew issues the successor of an authenticated oldToken; detail is
+// added to the audit entry
+func (fd *ForgeDominion) renew(ctx context.Context, oldToken *ForgeToken, ttl time.Duration, detail string) (*ForgeToken, error) {
+// Create new token with same scope
+now := fd.now()
+ttl, err := fd.profileRenewal(oldToken, ttl, now)
+if err != nil {
+return nil, err
+}
+ttl, err = fd.effectiveTTL(oldToken.Scope, ttl, true)
+if err != nil {
+return nil, err
+}
+
+if err := fd.checkPolicy(PolicyRequest{Operation: PolicyRenew, TenantID: oldToken.TenantID, NodeID: oldToken.NodeID, Scope: oldToken.Scope, Roles: oldToken.Roles, TTL: ttl, Time: now, Previous: oldToken}); err != nil {
+return nil, err
+}
+
+spec := TokenSpec{TenantID: oldToken.TenantID, NodeID: oldToken.NodeID, Scope: oldToken.Scope, Audience: oldToken.Audience, Networks: oldToken.Networks, TTL: ttl, IdleTimeout: oldToken.IdleTimeout, Profile: oldToken.Profile, Claims: oldToken.Claims, Roles: oldToken.Roles, SessionID: sessionOf(oldToken), KeyBinding: oldToken.KeyBinding, attestation: oldToken.Attestation}
+token, err := fd.issue(ctx, spec, now, now.Add(ttl))
+if err != nil {
+return nil, err
+}
+if err := fd.ledgerIssued(token); err != nil {
+return nil, err
+}
+
+fd.record(AuditEntry{
+Time:      now,
+Event:     AuditRenew,
+TenantID:  token.TenantID,
+NodeID:    token.NodeID,
+Scope:     token.Scope,
+Audience:  token.Audience,
+ExpiresAt: token.ExpiresAt,
+Detail:    detail,
+})
+
+return token, nil
+}
+
+// SaveToken saves a token to a file for runtime use, encrypted with the
+// user's token store key
+func SaveToken(token *ForgeToken, filepath string) error {
+data, err := marshalTokenIndent(token)
+if err != nil {
+return err
+}
+
+sealed, err := sealTokenData(data)
+if err != nil {
+return fmt.Errorf("failed to encrypt token: %w", err)
+}
+
+return writeTokenFile(sealed, filepath)
+}
+
+// SaveTokenPlaintext saves a token as plaintext JSON. Only use this when the
+// consumer cannot decrypt token files; anyone who can read the file holds
+// the bearer token.
+func SaveTokenPlaintext(token *ForgeToken, filepath string) error {
+data, err := marshalTokenIndent(token)
+if err != nil {
+return err
+}
+
+return writeTokenFile(data, filepath)
+}
+
+func marshalTokenIndent(token *ForgeToken) ([]byte, error) {
+data, err := MarshalToken(token)
+if err != nil {
+return nil, err
+}
+
+var out bytes.Buffer
+if err := json.Indent(&out, data, "", "  "); err != nil {
+return nil, fmt.Errorf("failed to marshal token: %w", err)
+}
+return out.Bytes(), nil
+}
+
+// writeTokenFile atomically replaces the token file while holding its lock
+func writeTokenFile(data []byte, filepath string) error {
+return withFileLock(filepath, true, func() error {
+if err := writeFileAtomic(filepath, data, 0600); err != nil {
+return fmt.Errorf("failed to write token file: %w", err)
+}
+return nil
+})
+}
+
+// LoadToken loads a token from a file, decrypting it if it was sealed
+func LoadToken(filepath string) (*ForgeToken, error) {
+return readTokenFile(filepath, func(raw []byte) (*ForgeToken, error) {
+data, err := openTokenData(raw)
+if err != nil {
+return nil, err
+}
+return UnmarshalToken(data)
+})
+}
@@ -0,0 +1,327 @@
+package forgeauth
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"testing"
+	"time"
+)
+
+// testRootKey is a valid default root key for tests
+var testRootKey = bytes.Repeat([]byte{0x42}, minRootKeyLen)
+
+var testEpoch = time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+
+// newTestDominion returns a dominion on a fake clock at testEpoch signing
+// with alg
+func newTestDominion(t *testing.T, alg string) (*ForgeDominion, *FakeClock) {
+	t.Helper()
+	fd := NewForgeDominionWithKeys(StaticKeyProvider{"": bytes.Clone(testRootKey)})
+	clock := NewFakeClock(testEpoch)
+	fd.SetClock(clock)
+	if err := fd.SetSigningAlg(alg); err != nil {
+		t.Fatal(err)
+	}
+	return fd, clock
+}
+
+// issueTestToken issues a token carrying every signed claim
+func issueTestToken(t *testing.T, fd *ForgeDominion) *ForgeToken {
+	t.Helper()
+	token, err := fd.requestToken(context.Background(), TokenSpec{
+		NodeID:   "node-1",
+		Scope:    "runtime:read,runtime:execute",
+		Audience: "bridge",
+		Networks: []string{"10.0.0.0/8"},
+		TTL:      time.Hour,
+		Profile:  "worker",
+		Claims:   map[string]any{"rack": "r1"},
+	}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+func TestValidateTokenTamperedClaims(t *testing.T) {
+	tests := []struct {
+		name   string
+		tamper func(*ForgeToken)
+	}{
+		{"node", func(tok *ForgeToken) { tok.NodeID = "node-2" }},
+		{"scope widened", func(tok *ForgeToken) { tok.Scope = "runtime:*" }},
+		{"scope reordered", func(tok *ForgeToken) { tok.Scope = "runtime:execute,runtime:read" }},
+		{"expiry extended", func(tok *ForgeToken) { tok.ExpiresAt = tok.ExpiresAt.Add(time.Hour) }},
+		{"issued earlier", func(tok *ForgeToken) { tok.IssuedAt = tok.IssuedAt.Add(-time.Second) }},
+		{"tenant", func(tok *ForgeToken) { tok.TenantID = "acme" }},
+		{"audience dropped", func(tok *ForgeToken) { tok.Audience = "" }},
+		{"id", func(tok *ForgeToken) { tok.ID = "forged" }},
+		{"networks dropped", func(tok *ForgeToken) { tok.Networks = nil }},
+		{"uses", func(tok *ForgeToken) { tok.MaxUses = 1 }},
+		{"idle timeout", func(tok *ForgeToken) { tok.IdleTimeout = time.Minute }},
+		{"profile", func(tok *ForgeToken) { tok.Profile = "admin" }},
+		{"claim changed", func(tok *ForgeToken) { tok.Claims = map[string]any{"rack": "r2"} }},
+		{"claim added", func(tok *ForgeToken) { tok.Claims = map[string]any{"rack": "r1", "root": true} }},
+		{"roles added", func(tok *ForgeToken) { tok.Roles = []string{"admin"} }},
+		{"session", func(tok *ForgeToken) { tok.SessionID = "other" }},
+		{"attestation", func(tok *ForgeToken) { tok.Attestation = "pcr0=00" }},
+		{"key binding", func(tok *ForgeToken) { tok.KeyBinding = "thumb" }},
+		{"signing version", func(tok *ForgeToken) { tok.SigningVersion = 1 }},
+		{"unknown signing version", func(tok *ForgeToken) { tok.SigningVersion = 3 }},
+	}
+	for _, alg := range []string{AlgHS256, AlgHS512_256, AlgBLAKE2b, AlgEd25519} {
+		fd, _ := newTestDominion(t, alg)
+		original := issueTestToken(t, fd)
+		if err := fd.ValidateToken(original); err != nil {
+			t.Fatalf("%s: untampered token: %v", alg, err)
+		}
+		for _, tt := range tests {
+			t.Run(alg+"/"+tt.name, func(t *testing.T) {
+				tok := *original
+				tt.tamper(&tok)
+				if err := fd.ValidateToken(&tok); !errors.Is(err, ErrBadSignature) {
+					t.Errorf("ValidateToken = %v, want %v", err, ErrBadSignature)
+				}
+			})
+		}
+	}
+}
+
+func TestValidateTokenAlgConfusion(t *testing.T) {
+	fd, _ := newTestDominion(t, AlgHS256)
+	original := issueTestToken(t, fd)
+	for _, alg := range []string{AlgHS512_256, AlgBLAKE2b, AlgEd25519, "none", "hs256"} {
+		tok := *original
+		tok.Alg = alg
+		if err := fd.ValidateToken(&tok); err == nil {
+			t.Errorf("HS256 token relabelled %q validated", alg)
+		}
+	}
+}
+
+func TestValidateTokenSignatureEncoding(t *testing.T) {
+	for _, alg := range []string{AlgHS256, AlgEd25519} {
+		fd, _ := newTestDominion(t, alg)
+		original := issueTestToken(t, fd)
+		sig, err := base64.URLEncoding.DecodeString(original.Signature)
+		if err != nil {
+			t.Fatal(err)
+		}
+		other := issueTestToken(t, fd)
+
+		flipped := bytes.Clone(sig)
+		flipped[len(flipped)/2] ^= 1
+		tests := []struct {
+			name      string
+			signature string
+		}{
+			{"empty", ""},
+			{"padding only", "===="},
+			{"truncated by a byte", base64.URLEncoding.EncodeToString(sig[:len(sig)-1])},
+			{"truncated to half", base64.URLEncoding.EncodeToString(sig[:len(sig)/2])},
+			{"extended by a byte", base64.URLEncoding.EncodeToString(append(bytes.Clone(sig), 0))},
+			{"doubled", base64.URLEncoding.EncodeToString(append(bytes.Clone(sig), sig...))},
+			{"one bit flipped", base64.URLEncoding.EncodeToString(flipped)},
+			{"zeroed", base64.URLEncoding.EncodeToString(make([]byte, len(sig)))},
+			{"another token's", other.Signature},
+			{"unpadded", base64.RawURLEncoding.EncodeToString(sig)},
+			{"hex", hex.EncodeToString(sig)},
+			{"string truncated", original.Signature[:len(original.Signature)-2]},
+			{"leading space", " " + original.Signature},
+			{"trailing newline", original.Signature + "\n"},
+		}
+		for _, tt := range tests {
+			t.Run(alg+"/"+tt.name, func(t *testing.T) {
+				tok := *original
+				tok.Signature = tt.signature
+				if err := fd.ValidateToken(&tok); !errors.Is(err, ErrBadSignature) {
+					t.Errorf("ValidateToken = %v, want %v", err, ErrBadSignature)
+				}
+			})
+		}
+	}
+}
+
+func TestValidateTokenRootKeySize(t *testing.T) {
+	fd, _ := newTestDominion(t, AlgHS256)
+	token := issueTestToken(t, fd)
+	for _, key := range [][]byte{nil, {}, testRootKey[:1], testRootKey[:minRootKeyLen-1]} {
+		weak := NewForgeDominionWithKeys(StaticKeyProvider{"": bytes.Clone(key)})
+		weak.SetClock(NewFakeClock(testEpoch))
+		if _, err := weak.RequestToken("node-1", "runtime:read", time.Hour); err == nil {
+			t.Errorf("%d-byte root key issued a token", len(key))
+		}
+		if err := weak.ValidateToken(token); !errors.Is(err, ErrBadSignature) {
+			t.Errorf("%d-byte root key: ValidateToken = %v, want %v", len(key), err, ErrBadSignature)
+		}
+	}
+
+	// A longer key is fine, but is a different key
+	long := NewForgeDominionWithKeys(StaticKeyProvider{"": append(bytes.Clone(testRootKey), 0x42)})
+	long.SetClock(NewFakeClock(testEpoch))
+	if err := long.ValidateToken(token); !errors.Is(err, ErrBadSignature) {
+		t.Errorf("another root key: ValidateToken = %v, want %v", err, ErrBadSignature)
+	}
+}
+
+func TestEd25519VerifierKeySize(t *testing.T) {
+	fd, _ := newTestDominion(t, AlgEd25519)
+	token := issueTestToken(t, fd)
+	pub, err := fd.PublicKey(context.Background(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sig, _ := base64.URLEncoding.DecodeString(token.Signature)
+	if err := verifyEd25519(pub, token, sig); err != nil {
+		t.Fatalf("right key: %v", err)
+	}
+	for _, key := range []ed25519.PublicKey{nil, {}, pub[:ed25519.PublicKeySize-1], append(bytes.Clone(pub), 0), make(ed25519.PublicKey, ed25519.PrivateKeySize)} {
+		if err := verifyEd25519(key, token, sig); !errors.Is(err, ErrBadSignature) {
+			t.Errorf("%d-byte public key: %v, want %v", len(key), err, ErrBadSignature)
+		}
+	}
+
+	bundle, err := fd.ExportValidatorBundle(context.Background(), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, trusted := range []ed25519.PublicKey{nil, pub[:16], append(bytes.Clone(pub), 0)} {
+		if _, err := NewValidator(bundle, trusted); err == nil {
+			t.Errorf("validator pinned to a %d-byte key", len(trusted))
+		}
+	}
+	v, err := NewValidator(bundle, pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A bundle whose tenant key is the wrong size is refused even when
+	// properly signed
+	priv, err := signingKey(context.Background(), fd.currentKeys(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bad := *bundle
+	bad.Version = 2
+	bad.Keys = []ValidatorKey{{PublicKey: base64.URLEncoding.EncodeToString(pub[:31])}}
+	payload, err := bad.signingPayload()
+	if err != nil {
+		t.Fatal(err)
+	}
+	bad.Signature = base64.URLEncoding.EncodeToString(ed25519.Sign(priv, payload))
+	if err := v.Update(&bad); err == nil {
+		t.Error("bundle with a 31-byte tenant key accepted")
+	}
+}
+
+func TestValidateTokenExpiryAndSkew(t *testing.T) {
+	tests := []struct {
+		name     string
+		issuerAt time.Duration // the issuer's clock, from the validator's
+		validate time.Duration // when the token is validated, from issue
+		want     error
+	}{
+		{"fresh", 0, 0, nil},
+		{"just before expiry", 0, time.Hour - time.Second, nil},
+		{"at expiry", 0, time.Hour, nil},
+		{"just after expiry", 0, time.Hour + time.Second, ErrExpired},
+		{"long expired", 0, 48 * time.Hour, ErrExpired},
+		{"issuer slightly ahead", 30 * time.Second, 0, nil},
+		{"issuer ahead by the allowed skew", MaxClockSkew, 0, nil},
+		{"issuer too far ahead", MaxClockSkew + time.Second, 0, ErrClockSkew},
+		{"issuer a day ahead", 24 * time.Hour, 0, ErrClockSkew},
+		{"issuer behind", -30 * time.Minute, 0, nil},
+		{"issuer behind past expiry", -2 * time.Hour, 0, ErrExpired},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			issuer, _ := newTestDominion(t, AlgEd25519)
+			issuer.SetClock(NewFakeClock(testEpoch.Add(tt.issuerAt)))
+			token := issueTestToken(t, issuer)
+
+			validator, clock := newTestDominion(t, AlgEd25519)
+			clock.Advance(tt.validate)
+			if err := validator.ValidateToken(token); !errors.Is(err, tt.want) || (tt.want == nil && err != nil) {
+				t.Errorf("ValidateToken = %v, want %v", err, tt.want)
+			}
+
+			// A read-only validator from the issuer's bundle agrees
+			pub, err := issuer.PublicKey(context.Background(), "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			bundle, err := issuer.ExportValidatorBundle(context.Background(), 1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			v, err := NewValidator(bundle, pub)
+			if err != nil {
+				t.Fatal(err)
+			}
+			v.SetClock(clock)
+			if err := v.Validate(token); !errors.Is(err, tt.want) || (tt.want == nil && err != nil) {
+				t.Errorf("Validator.Validate = %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestSigningPayloadCanonical(t *testing.T) {
+	token := &ForgeToken{
+		ID:             "jti-1",
+		NodeID:         "node-1",
+		Scope:          "runtime:read",
+		IssuedAt:       testEpoch.Add(999 * time.Millisecond),
+		ExpiresAt:      testEpoch.Add(time.Hour),
+		TenantID:       "acme",
+		Claims:         map[string]any{"z": 1, "a": "x"},
+		SigningVersion: signingVersion,
+	}
+	payload, err := signingPayload(token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := signingDomain + `{"v":2,"node_id":"node-1","scope":"runtime:read","iat":1767323045,"exp":1767326645,"tid":"acme","jti":"jti-1","ext":{"a":"x","z":1}}`
+	if string(payload) != want {
+		t.Fatalf("payload\n%s\nwant\n%s", payload, want)
+	}
+
+	// Every wire encoding of the token signs the same bytes
+	fd, _ := newTestDominion(t, AlgEd25519)
+	issued := issueTestToken(t, fd)
+	want2, err := signingPayload(issued)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := MarshalToken(issued)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := UnmarshalToken(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	compact, err := MarshalCompact(issued)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fromCompact, err := UnmarshalCompact(compact)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, tok := range map[string]*ForgeToken{"json": decoded, "compact": fromCompact} {
+		got, err := signingPayload(tok)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if !bytes.Equal(got, want2) {
+			t.Errorf("%s round trip changed the payload:\n%s\nwant\n%s", name, got, want2)
+		}
+		if err := fd.ValidateToken(tok); err != nil {
+			t.Errorf("%s round trip: %v", name, err)
+		}
+	}
+}
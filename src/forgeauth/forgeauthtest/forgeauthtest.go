@@ -0,0 +1,361 @@
+// Package forgeauthtest is a conformance harness for forgeauth.
+// Integrators with their own KeyProvider call it from their tests:
+//
+//	func TestVaultKeys(t *testing.T) {
+//		forgeauthtest.RunKeyProviderHarness(t, newVaultKeys(t), forgeauthtest.HarnessOptions{Tenants: []string{"acme"}})
+//	}
+//
+//	func FuzzDecode(f *testing.F) {
+//		corpus, err := forgeauthtest.FuzzCorpus(newVaultKeys(f))
+//		if err != nil {
+//			f.Fatal(err)
+//		}
+//		for _, seed := range corpus {
+//			f.Add(seed)
+//		}
+//		f.Fuzz(func(t *testing.T, data []byte) { forgeauthtest.CheckDecodeInput(t, data) })
+//	}
+//
+// The harness only needs HarnessTB, so it adds no dependency on the
+// testing package to the binary.
+package forgeauthtest
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/kswhitlock9493-jpg/SR-AIbridge-/src/forgeauth"
+)
+
+// HarnessTB is the subset of testing.TB used by the harness
+type HarnessTB interface {
+	Helper()
+	Errorf(format string, args ...any)
+	Fatalf(format string, args ...any)
+}
+
+// HarnessOptions tunes RunKeyProviderHarness
+type HarnessOptions struct {
+	// Tenants the provider holds keys for, besides the default tenant
+	Tenants []string
+
+	// Iterations of randomized tokens per algorithm; defaults to 50
+	Iterations int
+
+	// Seed makes a failing run reproducible; zero picks a random seed,
+	// which is reported on failure
+	Seed uint64
+}
+
+// RunKeyProviderHarness checks the dominion's properties with tokens signed
+// through keys: every encoding round-trips and still validates, changing
+// any claim or the signature is detected, and issue times are accepted up
+// to forgeauth.MaxClockSkew in the future and rejected beyond it.
+func RunKeyProviderHarness(t HarnessTB, keys forgeauth.KeyProvider, opts HarnessOptions) {
+	t.Helper()
+	if opts.Iterations <= 0 {
+		opts.Iterations = 50
+	}
+	if opts.Seed == 0 {
+		opts.Seed = rand.Uint64()
+	}
+	rng := rand.New(rand.NewPCG(opts.Seed, opts.Seed))
+	tenants := append([]string{""}, opts.Tenants...)
+
+	for _, alg := range forgeauth.SupportedAlgs() {
+		fd := forgeauth.NewForgeDominionWithKeys(keys)
+		if err := fd.SetSigningAlg(alg); errors.Is(err, forgeauth.ErrNotFIPSApproved) {
+			continue
+		} else if err != nil {
+			t.Fatalf("%s: %v", alg, err)
+		}
+		if err := fd.SetAllowedAlgs(alg); err != nil {
+			t.Fatalf("%s: %v", alg, err)
+		}
+		clock := forgeauth.NewFakeClock(time.Now())
+		fd.SetClock(clock)
+
+		for i := 0; i < opts.Iterations; i++ {
+			spec := randomSpec(rng, tenants[rng.IntN(len(tenants))])
+			token, err := issue(fd, spec)
+			if err != nil {
+				t.Fatalf("%s (seed %d): failed to issue %+v: %v", alg, opts.Seed, spec, err)
+			}
+			checkRoundTrip(t, fd, token)
+			checkTamper(t, fd, token)
+		}
+		for _, tenantID := range tenants {
+			checkSkew(t, fd, clock, tenantID)
+		}
+	}
+}
+
+// issue mints one token for spec
+func issue(fd *forgeauth.ForgeDominion, spec forgeauth.TokenSpec) (*forgeauth.ForgeToken, error) {
+	tokens, err := fd.RequestTokens([]forgeauth.TokenSpec{spec})
+	if err != nil {
+		return nil, err
+	}
+	return tokens[0], nil
+}
+
+// randomSpec returns a spec exercising the optional claims
+func randomSpec(rng *rand.Rand, tenantID string) forgeauth.TokenSpec {
+	segments := []string{"runtime", "execute", "read", "bridge", "*"}
+	var terms []string
+	for n := 1 + rng.IntN(3); len(terms) < n; {
+		term := segments[rng.IntN(len(segments)-1)]
+		for d := rng.IntN(3); d > 0; d-- {
+			term += ":" + segments[rng.IntN(len(segments))]
+		}
+		if rng.IntN(4) == 0 && len(terms) > 0 {
+			term = "!" + term
+		}
+		terms = append(terms, term)
+	}
+
+	spec := forgeauth.TokenSpec{
+		TenantID: tenantID,
+		NodeID:   fmt.Sprintf("node-%d", rng.IntN(1000)),
+		Scope:    strings.Join(terms, ","),
+		TTL:      time.Duration(1+rng.IntN(3600)) * time.Second,
+	}
+	if rng.IntN(2) == 0 {
+		spec.Audience = "svc-" + fmt.Sprint(rng.IntN(10))
+	}
+	if rng.IntN(3) == 0 {
+		spec.Networks = []string{fmt.Sprintf("10.%d.0.0/16", rng.IntN(256))}
+	}
+	if rng.IntN(4) == 0 {
+		spec.MaxUses = 1000
+	}
+	if rng.IntN(4) == 0 {
+		spec.IdleTimeout = time.Hour
+	}
+	if rng.IntN(3) == 0 {
+		spec.Claims = map[string]any{"rack": fmt.Sprintf("r%d", rng.IntN(100)), "canary": rng.IntN(2) == 0, "weight": rng.Float64()}
+	}
+	if rng.IntN(4) == 0 {
+		thumbprint := make([]byte, sha256.Size)
+		for i := range thumbprint {
+			thumbprint[i] = byte(rng.Uint32())
+		}
+		spec.KeyBinding = base64.RawURLEncoding.EncodeToString(thumbprint)
+	}
+	return spec
+}
+
+func checkRoundTrip(t HarnessTB, fd *forgeauth.ForgeDominion, token *forgeauth.ForgeToken) {
+	t.Helper()
+	decoders := []struct {
+		name   string
+		decode func() (*forgeauth.ForgeToken, error)
+	}{
+		{"bearer", func() (*forgeauth.ForgeToken, error) {
+			encoded, err := forgeauth.EncodeToken(token)
+			if err != nil {
+				return nil, err
+			}
+			return forgeauth.DecodeToken(encoded)
+		}},
+		{"json", func() (*forgeauth.ForgeToken, error) {
+			data, err := forgeauth.MarshalToken(token)
+			if err != nil {
+				return nil, err
+			}
+			return forgeauth.UnmarshalToken(data)
+		}},
+		{"compact", func() (*forgeauth.ForgeToken, error) {
+			data, err := forgeauth.MarshalCompact(token)
+			if err != nil {
+				return nil, err
+			}
+			return forgeauth.UnmarshalCompact(data)
+		}},
+	}
+	for _, d := range decoders {
+		decoded, err := d.decode()
+		if err != nil {
+			t.Errorf("%s round trip of %s failed: %v", d.name, token.ID, err)
+			continue
+		}
+		if err := fd.ValidateToken(decoded); err != nil {
+			t.Errorf("%s round trip of %s no longer validates: %v", d.name, token.ID, err)
+		}
+	}
+}
+
+// checkTamper changes each claim of token in turn and requires validation
+// to fail
+func checkTamper(t HarnessTB, fd *forgeauth.ForgeDominion, token *forgeauth.ForgeToken) {
+	t.Helper()
+	tampers := []struct {
+		claim  string
+		change func(*forgeauth.ForgeToken)
+	}{
+		{"node_id", func(tk *forgeauth.ForgeToken) { tk.NodeID += "x" }},
+		{"scope", func(tk *forgeauth.ForgeToken) { tk.Scope += ",admin" }},
+		{"tenant_id", func(tk *forgeauth.ForgeToken) { tk.TenantID += "x" }},
+		{"audience", func(tk *forgeauth.ForgeToken) { tk.Audience += "x" }},
+		{"jti", func(tk *forgeauth.ForgeToken) { tk.ID = "AAAAAAAAAAAAAAAAAAAAAA" }},
+		{"issued_at", func(tk *forgeauth.ForgeToken) { tk.IssuedAt = tk.IssuedAt.Add(-time.Second) }},
+		{"expires_at", func(tk *forgeauth.ForgeToken) { tk.ExpiresAt = tk.ExpiresAt.Add(time.Second) }},
+		{"networks", func(tk *forgeauth.ForgeToken) { tk.Networks = append(tk.Networks, "0.0.0.0/0") }},
+		{"max_uses", func(tk *forgeauth.ForgeToken) { tk.MaxUses++ }},
+		{"idle_timeout", func(tk *forgeauth.ForgeToken) { tk.IdleTimeout += time.Second }},
+		{"profile", func(tk *forgeauth.ForgeToken) { tk.Profile += "x" }},
+		{"claims", func(tk *forgeauth.ForgeToken) { tk.Claims = map[string]any{"rack": "forged"} }},
+		{"roles", func(tk *forgeauth.ForgeToken) { tk.Roles = append(slices.Clip(tk.Roles), "admin") }},
+		{"sid", func(tk *forgeauth.ForgeToken) { tk.SessionID = "AAAAAAAAAAAAAAAAAAAAAA" }},
+		{"attestation", func(tk *forgeauth.ForgeToken) { tk.Attestation += "x" }},
+		{"cnf", func(tk *forgeauth.ForgeToken) { tk.KeyBinding = "AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA" }},
+		{"signature", func(tk *forgeauth.ForgeToken) {
+			b := []byte(tk.Signature)
+			b[len(b)/2] ^= 'A' ^ 'B'
+			tk.Signature = string(b)
+		}},
+	}
+	for _, tamper := range tampers {
+		forged := *token
+		tamper.change(&forged)
+		if err := fd.ValidateToken(&forged); err == nil {
+			t.Errorf("changing %s of %s went undetected", tamper.claim, token.ID)
+		}
+	}
+}
+
+// checkSkew issues tokens with clock ahead of the validator's and checks
+// the skew window, then one already expired
+func checkSkew(t HarnessTB, fd *forgeauth.ForgeDominion, clock *forgeauth.FakeClock, tenantID string) {
+	t.Helper()
+	now := clock.Now()
+	defer clock.Set(now)
+	cases := []struct {
+		issuedAt time.Time
+		want     error
+	}{
+		{now.Add(forgeauth.MaxClockSkew / 2), nil},
+		{now.Add(forgeauth.MaxClockSkew + time.Minute), forgeauth.ErrClockSkew},
+		{now.Add(-2 * time.Hour), forgeauth.ErrExpired},
+	}
+	for _, c := range cases {
+		clock.Set(c.issuedAt)
+		token, err := issue(fd, forgeauth.TokenSpec{TenantID: tenantID, NodeID: "skew", Scope: "runtime:read", TTL: time.Hour})
+		clock.Set(now)
+		if err != nil {
+			t.Fatalf("failed to issue a token at %s: %v", c.issuedAt.Sub(now).Round(time.Second), err)
+		}
+		err = fd.ValidateToken(token)
+		if (c.want == nil && err != nil) || (c.want != nil && !errors.Is(err, c.want)) {
+			t.Errorf("token issued %s ahead: got %v, want %v", c.issuedAt.Sub(now).Round(time.Second), err, c.want)
+		}
+	}
+}
+
+// FuzzCorpus returns seed inputs for CheckDecodeInput: valid tokens in the
+// bearer, JSON and compact encodings, signed through keys
+func FuzzCorpus(keys forgeauth.KeyProvider) ([][]byte, error) {
+	fd := forgeauth.NewForgeDominionWithKeys(keys)
+	rng := rand.New(rand.NewPCG(1, 1))
+
+	var corpus [][]byte
+	for _, alg := range forgeauth.SupportedAlgs() {
+		if err := fd.SetSigningAlg(alg); errors.Is(err, forgeauth.ErrNotFIPSApproved) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		for range 4 {
+			token, err := issue(fd, randomSpec(rng, ""))
+			if err != nil {
+				return nil, err
+			}
+			encoded, err := forgeauth.EncodeToken(token)
+			if err != nil {
+				return nil, err
+			}
+			doc, err := forgeauth.MarshalToken(token)
+			if err != nil {
+				return nil, err
+			}
+			compact, err := forgeauth.MarshalCompact(token)
+			if err != nil {
+				return nil, err
+			}
+			corpus = append(corpus, []byte(encoded), doc, compact)
+		}
+	}
+	return corpus, nil
+}
+
+// CheckDecodeInput feeds arbitrary bytes to every token decoder. Decoders
+// must not panic, and anything they accept must re-encode and decode to
+// the same claims.
+func CheckDecodeInput(t HarnessTB, data []byte) {
+	t.Helper()
+	decoders := []struct {
+		name   string
+		decode func([]byte) (*forgeauth.ForgeToken, error)
+		encode func(*forgeauth.ForgeToken) ([]byte, error)
+	}{
+		{"bearer", func(b []byte) (*forgeauth.ForgeToken, error) { return forgeauth.DecodeToken(string(b)) }, func(tk *forgeauth.ForgeToken) ([]byte, error) {
+			s, err := forgeauth.EncodeToken(tk)
+			return []byte(s), err
+		}},
+		{"json", forgeauth.UnmarshalToken, forgeauth.MarshalToken},
+		{"compact", forgeauth.UnmarshalCompact, forgeauth.MarshalCompact},
+	}
+	for _, d := range decoders {
+		token, err := d.decode(data)
+		if err != nil {
+			continue
+		}
+		again, err := d.encode(token)
+		if err != nil {
+			continue
+		}
+		decoded, err := d.decode(again)
+		if err != nil {
+			t.Errorf("%s: re-encoded token no longer decodes: %v", d.name, err)
+			continue
+		}
+		if decoded.ID != token.ID || decoded.NodeID != token.NodeID || decoded.Scope != token.Scope ||
+			decoded.TenantID != token.TenantID || decoded.Signature != token.Signature ||
+			!decoded.ExpiresAt.Equal(token.ExpiresAt) {
+			t.Errorf("%s: claims changed across a re-encode: %+v became %+v", d.name, token, decoded)
+		}
+	}
+}
+
+// CheckValidateInput feeds arbitrary bytes to every token decoder and
+// validates whatever decodes with a fresh dominion over keys. Validation
+// must not panic, and a token it accepts must round-trip and detect any
+// change to its claims, as the harness requires of issued tokens.
+func CheckValidateInput(t HarnessTB, keys forgeauth.KeyProvider, data []byte) {
+	t.Helper()
+	decoders := []func([]byte) (*forgeauth.ForgeToken, error){
+		func(b []byte) (*forgeauth.ForgeToken, error) { return forgeauth.DecodeToken(string(b)) },
+		forgeauth.UnmarshalToken,
+		forgeauth.UnmarshalCompact,
+	}
+	for _, decode := range decoders {
+		token, err := decode(data)
+		if err != nil {
+			continue
+		}
+		// A fresh dominion, so use limits and sessions left by earlier
+		// inputs don't fail the checks below
+		fd := forgeauth.NewForgeDominionWithKeys(keys)
+		if fd.ValidateToken(token) != nil {
+			continue
+		}
+		checkRoundTrip(t, fd, token)
+		checkTamper(t, fd, token)
+	}
+}
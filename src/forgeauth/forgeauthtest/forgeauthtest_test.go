@@ -0,0 +1,41 @@
+package forgeauthtest
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/kswhitlock9493-jpg/SR-AIbridge-/src/forgeauth"
+)
+
+// testKeys holds fixed root keys, so the seeds under testdata/fuzz stay
+// signed by the keys the fuzz targets validate with
+var testKeys = forgeauth.StaticKeyProvider{
+	"":     bytes.Repeat([]byte{0x42}, 32),
+	"acme": bytes.Repeat([]byte{0x43}, 32),
+}
+
+func TestStaticKeyProvider(t *testing.T) {
+	RunKeyProviderHarness(t, testKeys, HarnessOptions{Tenants: []string{"acme"}, Iterations: 10})
+}
+
+// addFuzzCorpus adds FuzzCorpus to f's seeds, besides those under
+// testdata/fuzz
+func addFuzzCorpus(f *testing.F) {
+	corpus, err := FuzzCorpus(testKeys)
+	if err != nil {
+		f.Fatal(err)
+	}
+	for _, seed := range corpus {
+		f.Add(seed)
+	}
+}
+
+func FuzzDecode(f *testing.F) {
+	addFuzzCorpus(f)
+	f.Fuzz(func(t *testing.T, data []byte) { CheckDecodeInput(t, data) })
+}
+
+func FuzzValidate(f *testing.F) {
+	addFuzzCorpus(f)
+	f.Fuzz(func(t *testing.T, data []byte) { CheckValidateInput(t, testKeys, data) })
+}